@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards destructive endpoints. They take the admin_token from
+// the config, sent as "Authorization: Bearer <token>", or the session of a
+// user with the admin role. With neither a token nor users the endpoints
+// are disabled.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u := currentUser(r); u != nil {
+			if u.Role != roleAdmin {
+				apiError(w, r, http.StatusForbidden, "admin_required", "Admin role required")
+				return
+			}
+			h(w, r)
+			return
+		}
+		if config().AdminToken == "" {
+			apiError(w, r, http.StatusForbidden, "admin_disabled", "Admin API disabled: set admin_token in the config file or log in as an admin user")
+			return
+		}
+		if !hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="piheat"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// hasAdminToken reports whether r carries the configured admin_token.
+func hasAdminToken(r *http.Request) bool {
+	return isAdminToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// isAdminToken reports whether token is the configured admin_token.
+func isAdminToken(token string) bool {
+	if config().AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config().AdminToken)) == 1
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAggregateEntries bounds the cache; the sensor in chart requests is
+// whatever the client asks for.
+const maxAggregateEntries = 256
+
+// aggregateKey is what an aggregated chart depends on besides the
+// readings. resolution is the bucket the period averages into.
+type aggregateKey struct {
+	period, sensor, resolution string
+}
+
+// aggregateEntry is an aggregated chart as last queried. last and next
+// bound its newest bucket: readings in it only move that bucket's average
+// a little, which aggregate_cache_ttl allows for, while readings before or
+// after it change the chart's shape.
+type aggregateEntry struct {
+	data       []ChartDataPoint
+	version    chartVersionInfo
+	filled     time.Time
+	last, next time.Time
+}
+
+// aggregates caches the week, month and year charts so several viewers
+// refreshing them do not each run the GROUP BY queries.
+var aggregates = struct {
+	sync.Mutex
+	entries       map[aggregateKey]*aggregateEntry
+	hits, misses  int64
+	invalidations int64
+}{entries: map[aggregateKey]*aggregateEntry{}}
+
+// chartResolution is the bucket a period's chart averages into, or ""
+// for the day chart of raw readings, which is not cached.
+func chartResolution(period string) string {
+	switch period {
+	case "week":
+		return "hour"
+	case "month":
+		return "day"
+	case "year":
+		return "month"
+	}
+	return ""
+}
+
+// nextBucket is the start of the bucket after the one starting at t. Day
+// and month buckets start at local midnight, so t must be local for a
+// day that is 23 or 25 hours long to end where the query's does.
+func nextBucket(resolution string, t time.Time) time.Time {
+	switch resolution {
+	case "hour":
+		return t.Add(time.Hour)
+	case "day":
+		return t.AddDate(0, 0, 1)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+// aggregateChart returns the sensor's chart for an aggregated period and
+// its version, from the cache while aggregate_cache_ttl has not passed.
+// The points are a copy the caller may round.
+func aggregateChart(ctx context.Context, sensor, period string, now time.Time) ([]ChartDataPoint, chartVersionInfo, error) {
+	key := aggregateKey{period: period, sensor: sensor, resolution: chartResolution(period)}
+	ttl := config().AggregateCacheTTL.Duration
+	if ttl > 0 {
+		aggregates.Lock()
+		e, ok := aggregates.entries[key]
+		if ok && now.Sub(e.filled) < ttl {
+			aggregates.hits++
+			data, v := append([]ChartDataPoint(nil), e.data...), e.version
+			aggregates.Unlock()
+			// precision may have been reloaded since
+			v.decimals = readingDecimals(sensor)
+			return data, v, nil
+		}
+		aggregates.misses++
+		aggregates.Unlock()
+	}
+
+	v, err := chartVersion(ctx, sensor, period, now)
+	if err != nil {
+		return nil, v, err
+	}
+	data, err := chartData(ctx, sensor, period, now)
+	if err != nil || ttl <= 0 {
+		return data, v, err
+	}
+	e := &aggregateEntry{data: append([]ChartDataPoint(nil), data...), version: v, filled: now}
+	if len(data) > 0 {
+		e.last = time.Unix(data[len(data)-1].UnixTime, 0).In(time.Local)
+		e.next = nextBucket(key.resolution, e.last)
+	}
+	aggregates.Lock()
+	if len(aggregates.entries) >= maxAggregateEntries {
+		for k, old := range aggregates.entries {
+			if now.Sub(old.filled) >= ttl {
+				delete(aggregates.entries, k)
+			}
+		}
+		if len(aggregates.entries) >= maxAggregateEntries {
+			aggregates.entries = map[aggregateKey]*aggregateEntry{}
+		}
+	}
+	aggregates.entries[key] = e
+	aggregates.Unlock()
+	return data, v, nil
+}
+
+// noteReading drops the sensor's cached charts that a reading taken at
+// changes by more than their newest bucket: late readings for a finished
+// bucket, and readings starting a new one.
+func noteReading(sensor string, at time.Time) {
+	aggregates.Lock()
+	defer aggregates.Unlock()
+	for k, e := range aggregates.entries {
+		if k.sensor != sensor {
+			continue
+		}
+		if e.last.IsZero() || at.Before(e.last) || !at.Before(e.next) {
+			delete(aggregates.entries, k)
+			aggregates.invalidations++
+		}
+	}
+}
+
+// forgetAggregates empties the cache after readings were deleted.
+func forgetAggregates() {
+	aggregates.Lock()
+	defer aggregates.Unlock()
+	aggregates.invalidations += int64(len(aggregates.entries))
+	aggregates.entries = map[aggregateKey]*aggregateEntry{}
+}
+
+// writeAggregateCacheMetrics adds the chart cache to /metrics.
+func writeAggregateCacheMetrics(b *strings.Builder) {
+	aggregates.Lock()
+	defer aggregates.Unlock()
+	b.WriteString("# HELP piheat_aggregate_cache_entries Week, month and year charts cached.\n")
+	b.WriteString("# TYPE piheat_aggregate_cache_entries gauge\n")
+	fmt.Fprintf(b, "piheat_aggregate_cache_entries %d\n", len(aggregates.entries))
+	b.WriteString("# HELP piheat_aggregate_cache_hits_total Aggregated chart requests answered from the cache.\n")
+	b.WriteString("# TYPE piheat_aggregate_cache_hits_total counter\n")
+	fmt.Fprintf(b, "piheat_aggregate_cache_hits_total %d\n", aggregates.hits)
+	b.WriteString("# HELP piheat_aggregate_cache_misses_total Aggregated chart requests that queried the database.\n")
+	b.WriteString("# TYPE piheat_aggregate_cache_misses_total counter\n")
+	fmt.Fprintf(b, "piheat_aggregate_cache_misses_total %d\n", aggregates.misses)
+	b.WriteString("# HELP piheat_aggregate_cache_invalidations_total Cached charts dropped because readings changed them.\n")
+	b.WriteString("# TYPE piheat_aggregate_cache_invalidations_total counter\n")
+	fmt.Fprintf(b, "piheat_aggregate_cache_invalidations_total %d\n", aggregates.invalidations)
+}
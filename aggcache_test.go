@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestAggregateCacheDST caches the month chart on the day clocks go back
+// and checks a reading late in that 25-hour day keeps the cached chart,
+// while the first reading of the next day drops it.
+func TestAggregateCacheDST(t *testing.T) {
+	withScratchDatabase(t)
+	config().AggregateCacheTTL = Duration{time.Hour}
+	defer func() {
+		config().AggregateCacheTTL = Duration{}
+		forgetAggregates()
+	}()
+	now := time.Date(2024, 10, 27, 12, 0, 0, 0, time.Local)
+	for _, at := range []time.Time{now.AddDate(0, 0, -1), now.Add(-time.Hour)} {
+		if err := saveTemperature("attic", 12, "", at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := aggregateChart(context.Background(), "attic", "month", now); err != nil {
+		t.Fatal(err)
+	}
+	key := aggregateKey{period: "month", sensor: "attic", resolution: "day"}
+	cached := func() bool {
+		aggregates.Lock()
+		defer aggregates.Unlock()
+		_, ok := aggregates.entries[key]
+		return ok
+	}
+	if !cached() {
+		t.Fatal("month chart not cached")
+	}
+
+	// 23:30 is 24.5 hours after midnight on the day the clocks go back
+	noteReading("attic", time.Date(2024, 10, 27, 23, 30, 0, 0, time.Local))
+	if !cached() {
+		t.Error("a reading late on the 25-hour day dropped the chart cached for that day")
+	}
+	noteReading("attic", time.Date(2024, 10, 28, 0, 0, 30, 0, time.Local))
+	if cached() {
+		t.Error("the first reading of the next day kept the cached chart")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqliteTimeFormat matches SQLite's CURRENT_TIMESTAMP so stored times
+// compare correctly against datetime('now', ...) in queries.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// parseSQLiteTime parses a timestamp read back as text, which is either in
+// SQLite's own format or RFC3339 when the driver converted a DATETIME column.
+func parseSQLiteTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(sqliteTimeFormat, s)
+}
+
+type AlertEvent struct {
+	ID             int64      `json:"id"`
+	RuleID         int64      `json:"ruleId"`
+	RuleName       string     `json:"rule"`
+	Sensor         string     `json:"sensor"`
+	Condition      string     `json:"condition"`
+	Threshold      float64    `json:"threshold"`
+	Severity       string     `json:"severity"`
+	Value          float64    `json:"value"`
+	FiredAt        time.Time  `json:"firedAt"`
+	ResolvedAt     *time.Time `json:"resolvedAt"`
+	ResolvedValue  *float64   `json:"resolvedValue"`
+	AcknowledgedAt *time.Time `json:"acknowledgedAt"`
+	AcknowledgedBy string     `json:"acknowledgedBy,omitempty"`
+}
+
+func initAlertHistoryTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS alert_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		rule_id INTEGER NOT NULL,
+		rule_name TEXT NOT NULL,
+		sensor TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		threshold REAL NOT NULL,
+		severity TEXT NOT NULL,
+		value REAL NOT NULL,
+		fired_at DATETIME NOT NULL,
+		resolved_at DATETIME,
+		resolved_value REAL,
+		acknowledged_at DATETIME,
+		acknowledged_by TEXT NOT NULL DEFAULT ''
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_alert_events_fired_at ON alert_events(fired_at);")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Alert state lives in memory, so anything still open was interrupted
+	// by a restart and will fire again if the condition still holds.
+	_, err = db.Exec("UPDATE alert_events SET resolved_at = ? WHERE resolved_at IS NULL", sqliteTime(time.Now()))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func insertAlertEvent(a Alert) (int64, error) {
+	res, err := db.Exec("INSERT INTO alert_events (rule_id, rule_name, sensor, condition, threshold, severity, value, fired_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		a.RuleID, a.RuleName, a.Sensor, a.Condition, a.Threshold, a.Severity, a.Value, sqliteTime(a.Time))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func resolveAlertEvent(id int64, value float64, at time.Time) error {
+	_, err := db.Exec("UPDATE alert_events SET resolved_at = ?, resolved_value = ? WHERE id = ?", sqliteTime(at), value, id)
+	return err
+}
+
+// acknowledgeAlertEvent marks an active alert as acknowledged. It returns
+// sql.ErrNoRows if the alert does not exist or has already resolved.
+func acknowledgeAlertEvent(id int64, by string, at time.Time) error {
+	res, err := db.Exec("UPDATE alert_events SET acknowledged_at = ?, acknowledged_by = ? WHERE id = ? AND resolved_at IS NULL AND acknowledged_at IS NULL",
+		sqliteTime(at), by, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const alertEventColumns = "id, rule_id, rule_name, sensor, condition, threshold, severity, value, fired_at, resolved_at, resolved_value, acknowledged_at, acknowledged_by"
+
+func scanAlertEvent(s interface{ Scan(...interface{}) error }) (AlertEvent, error) {
+	var e AlertEvent
+	var resolvedAt, ackAt sql.NullTime
+	var resolvedValue sql.NullFloat64
+	err := s.Scan(&e.ID, &e.RuleID, &e.RuleName, &e.Sensor, &e.Condition, &e.Threshold, &e.Severity, &e.Value,
+		&e.FiredAt, &resolvedAt, &resolvedValue, &ackAt, &e.AcknowledgedBy)
+	if resolvedAt.Valid {
+		e.ResolvedAt = &resolvedAt.Time
+	}
+	if resolvedValue.Valid {
+		e.ResolvedValue = &resolvedValue.Float64
+	}
+	if ackAt.Valid {
+		e.AcknowledgedAt = &ackAt.Time
+	}
+	return e, err
+}
+
+type alertEventPage struct {
+	Total  int          `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+	Alerts []AlertEvent `json:"alerts"`
+}
+
+// alertsHandler lists alert history, newest first. Filters: state
+// (active, acknowledged, resolved), rule_id, sensor, severity, from, to
+// (RFC3339), with limit/offset pagination.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+
+	switch q.Get("state") {
+	case "":
+	case "active":
+		where = append(where, "resolved_at IS NULL")
+	case "acknowledged":
+		where = append(where, "resolved_at IS NULL AND acknowledged_at IS NOT NULL")
+	case "resolved":
+		where = append(where, "resolved_at IS NOT NULL")
+	default:
+		http.Error(w, "state must be active, acknowledged or resolved", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("rule_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid rule_id", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "rule_id = ?")
+		args = append(args, id)
+	}
+	for _, col := range []string{"sensor", "severity"} {
+		if v := q.Get(col); v != "" {
+			where = append(where, col+" = ?")
+			args = append(args, v)
+		}
+	}
+	for param, cond := range map[string]string{"from": "fired_at >= ?", "to": "fired_at < ?"} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			where = append(where, cond)
+			args = append(args, sqliteTime(t))
+		}
+	}
+	limit, offset, ok := pageParams(w, r, 50, 500)
+	if !ok {
+		return
+	}
+
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	page := alertEventPage{Limit: limit, Offset: offset, Alerts: []AlertEvent{}}
+	if err := db.QueryRow("SELECT COUNT(*) FROM alert_events"+filter, args...).Scan(&page.Total); err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query("SELECT "+alertEventColumns+" FROM alert_events"+filter+" ORDER BY fired_at DESC, id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanAlertEvent(rows)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		page.Alerts = append(page.Alerts, e)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// pageParams parses limit and offset query parameters, writing a 400
+// response and returning false if they are invalid.
+func pageParams(w http.ResponseWriter, r *http.Request, defaultLimit, maxLimit int) (limit, offset int, ok bool) {
+	limit = defaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// alertHandler serves GET /api/alerts/{id} and POST /api/alerts/{id}/ack.
+func alertHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/alerts/"), "/")
+	idStr, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		idStr, action = rest[:i], rest[i+1:]
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || (action != "" && action != "ack") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		e, err := scanAlertEvent(db.QueryRow("SELECT "+alertEventColumns+" FROM alert_events WHERE id = ?", id))
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		By string `json:"by"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := alertEngine.acknowledge(id, body.By, time.Now()); err == sql.ErrNoRows {
+		http.Error(w, "Alert not found or not active", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Error acknowledging alert: %v", err), http.StatusInternalServerError)
+		return
+	}
+	e, err := scanAlertEvent(db.QueryRow("SELECT "+alertEventColumns+" FROM alert_events WHERE id = ?", id))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
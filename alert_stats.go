@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// alertStatsDays is the default window of /api/alerts/stats.
+	alertStatsDays = 90
+	// alertStatsMaxPeriods bounds the periods of a response.
+	alertStatsMaxPeriods = 1000
+)
+
+// AlertPeriodStats is the alerts that fired in one day, week or month.
+// MeanRecoverySeconds is the mean time from firing to resolving of those
+// that resolved, missing without any.
+type AlertPeriodStats struct {
+	Start               string   `json:"start"`
+	Count               int      `json:"count"`
+	Critical            int      `json:"critical"`
+	Resolved            int      `json:"resolved"`
+	MeanRecoverySeconds *float64 `json:"meanRecoverySeconds,omitempty"`
+}
+
+// AlertSourceStats is how often one rule fired for one sensor.
+type AlertSourceStats struct {
+	Rule                string    `json:"rule"`
+	Sensor              string    `json:"sensor"`
+	Condition           string    `json:"condition"`
+	Count               int       `json:"count"`
+	MeanRecoverySeconds *float64  `json:"meanRecoverySeconds,omitempty"`
+	LastFiredAt         time.Time `json:"lastFiredAt"`
+}
+
+// AlertStats is the GET /api/alerts/stats response.
+type AlertStats struct {
+	From                time.Time          `json:"from"`
+	To                  time.Time          `json:"to"`
+	Bucket              string             `json:"bucket"`
+	Total               int                `json:"total"`
+	Resolved            int                `json:"resolved"`
+	Active              int                `json:"active"`
+	MeanRecoverySeconds *float64           `json:"meanRecoverySeconds,omitempty"`
+	BySeverity          map[string]int     `json:"bySeverity"`
+	Periods             []AlertPeriodStats `json:"periods"`
+	Sources             []AlertSourceStats `json:"sources"`
+}
+
+// alertBucketExpr groups fired_at by local day, week (from Monday) or
+// month, as YYYY-MM-DD of the first day.
+var alertBucketExpr = map[string]string{
+	"day":   "date(fired_at, 'localtime')",
+	"week":  "date(fired_at, 'localtime', '-6 days', 'weekday 1')",
+	"month": "date(fired_at, 'localtime', 'start of month')",
+}
+
+// alertBucketStart is the local start of the bucket holding t.
+func alertBucketStart(bucket string, t time.Time) time.Time {
+	t = t.In(time.Local)
+	y, m, d := t.Date()
+	switch bucket {
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.Local)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.Local)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+func nextAlertBucket(bucket string, t time.Time) time.Time {
+	switch bucket {
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// recoverySQL is an alert's time to recovery in seconds, NULL while active.
+const recoverySQL = "(julianday(resolved_at) - julianday(fired_at)) * 86400"
+
+// alertStats summarizes the alerts that fired between from and to. filter
+// and args narrow them further.
+func alertStats(ctx context.Context, from, to time.Time, bucket, filter string, args []interface{}) (AlertStats, error) {
+	defer timeQuery("alert_stats")()
+	s := AlertStats{From: from.UTC(), To: to.UTC(), Bucket: bucket, BySeverity: map[string]int{},
+		Periods: []AlertPeriodStats{}, Sources: []AlertSourceStats{}}
+	where := " WHERE fired_at >= ? AND fired_at < ?" + filter
+	args = append([]interface{}{sqliteTime(from), sqliteTime(to)}, args...)
+
+	rows, err := db.QueryContext(ctx, "SELECT severity, COUNT(*), COUNT(resolved_at), ROUND(AVG("+recoverySQL+")) FROM alert_events"+where+
+		" GROUP BY severity", args...)
+	if err != nil {
+		return s, err
+	}
+	var recoverySum float64
+	for rows.Next() {
+		var severity string
+		var count, resolved int
+		var mean *float64
+		if err := rows.Scan(&severity, &count, &resolved, &mean); err != nil {
+			rows.Close()
+			return s, err
+		}
+		s.BySeverity[severity] = count
+		s.Total += count
+		s.Resolved += resolved
+		if mean != nil {
+			recoverySum += *mean * float64(resolved)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	s.Active = s.Total - s.Resolved
+	if s.Resolved > 0 {
+		mean := math.Round(recoverySum / float64(s.Resolved))
+		s.MeanRecoverySeconds = &mean
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT "+alertBucketExpr[bucket]+" AS b, COUNT(*), SUM(severity = 'critical'), COUNT(resolved_at), ROUND(AVG("+
+		recoverySQL+")) FROM alert_events"+where+" GROUP BY b", args...)
+	if err != nil {
+		return s, err
+	}
+	counted := map[string]AlertPeriodStats{}
+	for rows.Next() {
+		var p AlertPeriodStats
+		if err := rows.Scan(&p.Start, &p.Count, &p.Critical, &p.Resolved, &p.MeanRecoverySeconds); err != nil {
+			rows.Close()
+			return s, err
+		}
+		counted[p.Start] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	// Periods without alerts are listed too, as they are the good news
+	for t := alertBucketStart(bucket, from); t.Before(to); t = nextAlertBucket(bucket, t) {
+		start := t.Format("2006-01-02")
+		p, ok := counted[start]
+		if !ok {
+			p = AlertPeriodStats{Start: start}
+		}
+		s.Periods = append(s.Periods, p)
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT rule_name, sensor, condition, COUNT(*), ROUND(AVG("+recoverySQL+")), MAX(fired_at) FROM alert_events"+where+
+		" GROUP BY rule_id, rule_name, sensor, condition ORDER BY COUNT(*) DESC, MAX(fired_at) DESC LIMIT 10", args...)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var src AlertSourceStats
+		var last string
+		if err := rows.Scan(&src.Rule, &src.Sensor, &src.Condition, &src.Count, &src.MeanRecoverySeconds, &last); err != nil {
+			return s, err
+		}
+		src.LastFiredAt, _ = parseSQLiteTime(last)
+		s.Sources = append(s.Sources, src)
+	}
+	return s, rows.Err()
+}
+
+// alertStatsHandler serves GET /api/alerts/stats.
+func alertStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.AddDate(0, 0, -alertStatsDays)
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		bucket = "week"
+	}
+	if _, ok := alertBucketExpr[bucket]; !ok {
+		http.Error(w, "bucket must be day, week or month", http.StatusBadRequest)
+		return
+	}
+	n := 0
+	for t := alertBucketStart(bucket, from); t.Before(to); t = nextAlertBucket(bucket, t) {
+		if n++; n > alertStatsMaxPeriods {
+			http.Error(w, fmt.Sprintf("At most %d periods; use a larger bucket", alertStatsMaxPeriods), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var where []string
+	var args []interface{}
+	if v := q.Get("rule_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid rule_id", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "rule_id = ?")
+		args = append(args, id)
+	}
+	for _, col := range []string{"sensor", "severity"} {
+		if v := q.Get(col); v != "" {
+			where = append(where, col+" = ?")
+			args = append(args, v)
+		}
+	}
+	filter := ""
+	if len(where) > 0 {
+		filter = " AND " + strings.Join(where, " AND ")
+	}
+	s, err := alertStats(r.Context(), from, to, bucket, filter, args)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AlertRule struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	Sensor    string   `json:"sensor"`
+	Condition string   `json:"condition"`
+	Threshold float64  `json:"threshold"`
+	For       Duration `json:"for"`
+	Severity  string   `json:"severity"`
+	Notifiers []string `json:"notifiers"`
+	Enabled   bool     `json:"enabled"`
+}
+
+// Conditions:
+//
+//	above   - value > threshold
+//	below   - value < threshold
+//	rate    - change in °C per minute > threshold (negative thresholds match falls)
+//	missing - no reading for the "for" duration
+var alertConditions = map[string]bool{"above": true, "below": true, "rate": true, "missing": true}
+
+var alertSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+func (r *AlertRule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Sensor == "" {
+		r.Sensor = "*"
+	}
+	if _, err := path.Match(r.Sensor, ""); err != nil {
+		return fmt.Errorf("invalid sensor selector %q", r.Sensor)
+	}
+	if !alertConditions[r.Condition] {
+		return fmt.Errorf("condition must be one of above, below, rate, missing")
+	}
+	if r.Condition == "missing" && r.For.Duration <= 0 {
+		return fmt.Errorf("missing condition requires a positive \"for\" duration")
+	}
+	if r.For.Duration < 0 {
+		return fmt.Errorf("\"for\" must not be negative")
+	}
+	if r.Severity == "" {
+		r.Severity = "warning"
+	}
+	if !alertSeverities[r.Severity] {
+		return fmt.Errorf("severity must be one of info, warning, critical")
+	}
+	if r.Notifiers == nil {
+		r.Notifiers = []string{}
+	}
+	return checkNotifierNames(r.Notifiers)
+}
+
+func (r *AlertRule) matches(sensor string) bool {
+	ok, _ := path.Match(r.Sensor, sensor)
+	return ok
+}
+
+func initAlertTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS alert_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		sensor TEXT NOT NULL DEFAULT '*',
+		condition TEXT NOT NULL,
+		threshold REAL NOT NULL DEFAULT 0,
+		for_seconds INTEGER NOT NULL DEFAULT 0,
+		severity TEXT NOT NULL DEFAULT 'warning',
+		notifiers TEXT NOT NULL DEFAULT '[]',
+		enabled INTEGER NOT NULL DEFAULT 1
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const alertRuleColumns = "id, name, sensor, condition, threshold, for_seconds, severity, notifiers, enabled"
+
+func scanAlertRule(s interface{ Scan(...interface{}) error }) (AlertRule, error) {
+	var r AlertRule
+	var forSeconds int64
+	var targets string
+	err := s.Scan(&r.ID, &r.Name, &r.Sensor, &r.Condition, &r.Threshold, &forSeconds, &r.Severity, &targets, &r.Enabled)
+	if err != nil {
+		return r, err
+	}
+	r.For = Duration{time.Duration(forSeconds) * time.Second}
+	if err := json.Unmarshal([]byte(targets), &r.Notifiers); err != nil {
+		r.Notifiers = []string{}
+	}
+	return r, nil
+}
+
+func listAlertRules() ([]AlertRule, error) {
+	rows, err := db.Query("SELECT " + alertRuleColumns + " FROM alert_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AlertRule{}
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func getAlertRule(id int64) (AlertRule, error) {
+	return scanAlertRule(db.QueryRow("SELECT "+alertRuleColumns+" FROM alert_rules WHERE id = ?", id))
+}
+
+func insertAlertRule(r *AlertRule) error {
+	targets, _ := json.Marshal(r.Notifiers)
+	res, err := db.Exec("INSERT INTO alert_rules (name, sensor, condition, threshold, for_seconds, severity, notifiers, enabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		r.Name, r.Sensor, r.Condition, r.Threshold, int64(r.For.Seconds()), r.Severity, string(targets), r.Enabled)
+	if err != nil {
+		return err
+	}
+	r.ID, err = res.LastInsertId()
+	return err
+}
+
+func updateAlertRule(r AlertRule) error {
+	targets, _ := json.Marshal(r.Notifiers)
+	res, err := db.Exec("UPDATE alert_rules SET name = ?, sensor = ?, condition = ?, threshold = ?, for_seconds = ?, severity = ?, notifiers = ?, enabled = ? WHERE id = ?",
+		r.Name, r.Sensor, r.Condition, r.Threshold, int64(r.For.Seconds()), r.Severity, string(targets), r.Enabled, r.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func deleteAlertRule(id int64) error {
+	res, err := db.Exec("DELETE FROM alert_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+type alertKey struct {
+	ruleID int64
+	sensor string
+}
+
+type alertState struct {
+	pendingSince time.Time
+	firing       bool
+	value        float64
+	eventID      int64
+	acknowledged bool
+	lastNotified time.Time
+}
+
+type lastReading struct {
+	value float64
+	time  time.Time
+}
+
+// AlertEngine evaluates the enabled rules against every recorded reading and,
+// for missing-data rules, on a periodic tick.
+type AlertEngine struct {
+	mu     sync.Mutex
+	rules  []AlertRule
+	states map[alertKey]*alertState
+	last   map[string]lastReading
+}
+
+var alertEngine = &AlertEngine{
+	states: map[alertKey]*alertState{},
+	last:   map[string]lastReading{},
+}
+
+// reload replaces the in-memory rules with the ones stored in the database,
+// dropping state for rules that were deleted or disabled.
+func (e *AlertEngine) reload() error {
+	rules, err := listAlertRules()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = rules
+	live := map[int64]bool{}
+	for _, r := range rules {
+		live[r.ID] = r.Enabled
+	}
+	for k, st := range e.states {
+		if !live[k.ruleID] {
+			if st.firing {
+				if err := resolveAlertEvent(st.eventID, st.value, clock.Now()); err != nil {
+					log.Printf("Error saving alert history: %v", err)
+				}
+			}
+			delete(e.states, k)
+		}
+	}
+	return nil
+}
+
+func (e *AlertEngine) run(interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C() {
+		e.checkMissing(now)
+	}
+}
+
+func (e *AlertEngine) evaluate(sensor string, value float64, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	prev, hasPrev := e.last[sensor]
+	e.last[sensor] = lastReading{value: value, time: now}
+
+	summer, _ := season.summer()
+	for _, r := range e.rules {
+		if !r.Enabled || !r.matches(sensor) {
+			continue
+		}
+		var active bool
+		switch r.Condition {
+		case "above":
+			active = value > r.Threshold
+		case "below":
+			active = value < r.Threshold
+		case "rate":
+			if !hasPrev || !now.After(prev.time) {
+				continue
+			}
+			rate := (value - prev.value) / now.Sub(prev.time).Minutes()
+			if r.Threshold >= 0 {
+				active = rate > r.Threshold
+			} else {
+				active = rate < r.Threshold
+			}
+		case "missing":
+			active = false
+		}
+		// A zone going cold in summer is expected, not a fault
+		if summer && heatingAlert(r, sensor) {
+			active = false
+		}
+		e.transition(r, sensor, value, active, now)
+	}
+}
+
+func (e *AlertEngine) checkMissing(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range e.rules {
+		if !r.Enabled || r.Condition != "missing" {
+			continue
+		}
+		for sensor, last := range e.last {
+			if !r.matches(sensor) {
+				continue
+			}
+			e.transition(r, sensor, last.value, now.Sub(last.time) >= r.For.Duration, now)
+		}
+	}
+}
+
+// transition applies the "for" duration and notifies on firing/resolving.
+// Missing-data rules carry their window in the condition itself.
+func (e *AlertEngine) transition(r AlertRule, sensor string, value float64, active bool, now time.Time) {
+	key := alertKey{r.ID, sensor}
+	st := e.states[key]
+	if st == nil {
+		if !active {
+			return
+		}
+		st = &alertState{}
+		e.states[key] = st
+	}
+	st.value = value
+
+	if !active {
+		if st.firing {
+			if err := resolveAlertEvent(st.eventID, value, now); err != nil {
+				log.Printf("Error saving alert history: %v", err)
+			}
+			notify(r.Notifiers, e.alert(r, st.eventID, sensor, value, "resolved", now))
+		}
+		delete(e.states, key)
+		return
+	}
+	if st.pendingSince.IsZero() {
+		st.pendingSince = now
+	}
+	hold := r.For.Duration
+	if r.Condition == "missing" {
+		hold = 0
+	}
+	if !st.firing && now.Sub(st.pendingSince) >= hold {
+		st.firing = true
+		st.lastNotified = now
+		a := e.alert(r, 0, sensor, value, "firing", now)
+		id, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		st.eventID, a.ID = id, id
+		notify(r.Notifiers, a)
+		return
+	}
+	repeat := config().AlertRepeatInterval.Duration
+	if st.firing && !st.acknowledged && repeat > 0 && now.Sub(st.lastNotified) >= repeat {
+		st.lastNotified = now
+		notify(r.Notifiers, e.alert(r, st.eventID, sensor, value, "firing", now))
+	}
+}
+
+// acknowledge marks an active alert as acknowledged, suppressing repeat
+// notifications until it resolves.
+func (e *AlertEngine) acknowledge(eventID int64, by string, now time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := acknowledgeAlertEvent(eventID, by, now); err != nil {
+		return err
+	}
+	for _, st := range e.states {
+		if st.eventID == eventID {
+			st.acknowledged = true
+		}
+	}
+	return nil
+}
+
+func (e *AlertEngine) alert(r AlertRule, eventID int64, sensor string, value float64, state string, now time.Time) Alert {
+	return Alert{
+		ID:        eventID,
+		RuleID:    r.ID,
+		RuleName:  r.Name,
+		Sensor:    sensor,
+		Condition: r.Condition,
+		Threshold: r.Threshold,
+		Severity:  r.Severity,
+		Value:     value,
+		State:     state,
+		Time:      now,
+	}
+}
+
+func alertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/alert-rules"), "/")
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			rules, err := listAlertRules()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, rules)
+		case http.MethodPost:
+			rule := AlertRule{Enabled: true}
+			if !decodeAlertRule(w, r, &rule) {
+				return
+			}
+			if err := insertAlertRule(&rule); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving alert rule: %v", err), http.StatusInternalServerError)
+				return
+			}
+			reloadAlertRules()
+			auditRequest(r, "alert_rule.create", strconv.FormatInt(rule.ID, 10), nil, rule)
+			writeJSON(w, http.StatusCreated, rule)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	rule, err := getAlertRule(id)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, rule)
+	case http.MethodPut:
+		old := rule
+		if !decodeAlertRule(w, r, &rule) {
+			return
+		}
+		rule.ID = id
+		if err := updateAlertRule(rule); err != nil {
+			http.Error(w, fmt.Sprintf("Error saving alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		reloadAlertRules()
+		auditRequest(r, "alert_rule.update", idStr, old, rule)
+		writeJSON(w, http.StatusOK, rule)
+	case http.MethodDelete:
+		if err := deleteAlertRule(id); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		reloadAlertRules()
+		auditRequest(r, "alert_rule.delete", idStr, rule, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeAlertRule decodes the request body over rule and validates it,
+// writing a 400 response and returning false on failure.
+func decodeAlertRule(w http.ResponseWriter, r *http.Request, rule *AlertRule) bool {
+	if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid alert rule: %v", err), http.StatusBadRequest)
+		return false
+	}
+	if err := rule.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid alert rule: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func reloadAlertRules() {
+	if err := alertEngine.reload(); err != nil {
+		log.Printf("Error reloading alert rules: %v", err)
+	}
+}
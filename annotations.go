@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAnnotationLabel bounds a label, which is drawn on the chart.
+const maxAnnotationLabel = 200
+
+// Annotation is an event worth seeing on the charts, such as a new
+// heatsink or the Pi moved to a cupboard. Sensor limits it to one sensor's
+// charts; without one it shows on all of them.
+type Annotation struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	UnixTime  int64     `json:"unixTime"`
+	Label     string    `json:"label"`
+	Sensor    string    `json:"sensor,omitempty"`
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// annotationRequest is the body of POST /api/annotations. Time defaults to
+// now.
+type annotationRequest struct {
+	Time   *time.Time `json:"time"`
+	Label  string     `json:"label"`
+	Sensor string     `json:"sensor"`
+}
+
+// AnnotatedChart is /api/chart-data with annotations=1: the chart and the
+// annotations in its period.
+type AnnotatedChart struct {
+	Points      []ChartDataPoint `json:"points"`
+	Annotations []Annotation     `json:"annotations"`
+	Actuators   []ActuatorBand   `json:"actuators,omitempty"`
+}
+
+func initAnnotationsTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS annotations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time DATETIME NOT NULL,
+		label TEXT NOT NULL,
+		sensor TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_annotations_time ON annotations(time);")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const annotationColumns = "id, time, label, sensor, actor, created_at"
+
+func scanAnnotations(query string, args ...interface{}) ([]Annotation, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		var at, createdAt string
+		if err := rows.Scan(&a.ID, &at, &a.Label, &a.Sensor, &a.Actor, &createdAt); err != nil {
+			return nil, err
+		}
+		a.Time, _ = parseSQLiteTime(at)
+		a.UnixTime = a.Time.Unix()
+		a.CreatedAt, _ = parseSQLiteTime(createdAt)
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// chartAnnotations returns the annotations of a sensor's chart between
+// from and to, oldest first.
+func chartAnnotations(sensor string, from, to time.Time) ([]Annotation, error) {
+	return scanAnnotations("SELECT "+annotationColumns+` FROM annotations
+		WHERE time >= ? AND time <= ? AND (sensor = '' OR sensor = ?) ORDER BY time, id`, sqliteTime(from), sqliteTime(to), sensor)
+}
+
+// annotatedETag folds the annotations into a chart's ETag, so adding or
+// deleting one is not answered with 304. Annotations cannot be edited, so
+// their count and latest ID tell every change apart.
+func annotatedETag(etag string) (string, error) {
+	var count int64
+	var maxID sql.NullInt64
+	if err := db.QueryRow("SELECT COUNT(*), MAX(id) FROM annotations").Scan(&count, &maxID); err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", etag, count, maxID.Int64)))
+	return `W/"` + hex.EncodeToString(h[:8]) + `"`, nil
+}
+
+// annotationsHandler serves GET and POST /api/annotations and GET and
+// DELETE /api/annotations/{id}.
+func annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/annotations"), "/")
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			listAnnotations(w, r)
+		case http.MethodPost:
+			createAnnotation(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	list, err := scanAnnotations("SELECT "+annotationColumns+" FROM annotations WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(list) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, list[0])
+	case http.MethodDelete:
+		if _, err := db.Exec("DELETE FROM annotations WHERE id = ?", id); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting annotation: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, "annotation.delete", idStr, list[0], nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listAnnotations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	if v := q.Get("sensor"); v != "" {
+		where = append(where, "(sensor = '' OR sensor = ?)")
+		args = append(args, v)
+	}
+	for param, cond := range map[string]string{"from": "time >= ?", "to": "time < ?"} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			where = append(where, cond)
+			args = append(args, sqliteTime(t))
+		}
+	}
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+	list, err := scanAnnotations("SELECT "+annotationColumns+" FROM annotations"+filter+" ORDER BY time, id", args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func createAnnotation(w http.ResponseWriter, r *http.Request) {
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Label = strings.TrimSpace(req.Label)
+	if req.Label == "" || len(req.Label) > maxAnnotationLabel {
+		http.Error(w, fmt.Sprintf("label is required, at most %d bytes", maxAnnotationLabel), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	a := Annotation{Time: now, Label: req.Label, Sensor: strings.TrimSpace(req.Sensor), Actor: requestActor(r), CreatedAt: now}
+	if req.Time != nil {
+		a.Time = req.Time.UTC().Truncate(time.Second)
+	}
+	a.UnixTime = a.Time.Unix()
+	res, err := db.Exec("INSERT INTO annotations (time, label, sensor, actor, created_at) VALUES (?, ?, ?, ?, ?)",
+		sqliteTime(a.Time), a.Label, a.Sensor, a.Actor, sqliteTime(a.CreatedAt))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving annotation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	a.ID, _ = res.LastInsertId()
+	auditRequest(r, "annotation.create", strconv.FormatInt(a.ID, 10), nil, a)
+	writeJSON(w, http.StatusCreated, a)
+}
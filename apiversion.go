@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The JSON API is versioned under /api/v1/. The unversioned /api/ paths
+// answer the same for now, marked deprecated, until legacyAPISunset.
+const (
+	apiVersion   = "v1"
+	apiV1Prefix  = "/api/" + apiVersion + "/"
+	legacyPrefix = "/api/"
+)
+
+var (
+	legacyAPIDeprecated = time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+	legacyAPISunset     = time.Date(2027, time.October, 15, 0, 0, 0, 0, time.UTC)
+)
+
+// versionAPI routes /api/v1/ to the handlers of /api/ and marks the
+// unversioned paths deprecated with a link to their successor. Errors of
+// both are problems. It runs before everything else that looks at the path.
+func versionAPI(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/"+apiVersion || strings.HasPrefix(r.URL.Path, apiV1Prefix):
+			r = withCorrelationID(w, r)
+			u := *r.URL
+			u.Path = legacyPrefix + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/"+apiVersion), "/")
+			u.RawPath = ""
+			r.URL = &u
+			// The dashboard answers every path no handler claims
+			if _, pattern := http.DefaultServeMux.Handler(r); pattern == "/" {
+				writeProblem(w, r, http.StatusNotFound, "not_found", "No such API endpoint")
+				return
+			}
+			pw := &problemWriter{ResponseWriter: w, r: r}
+			defer pw.finish()
+			h.ServeHTTP(pw, r)
+		case strings.HasPrefix(r.URL.Path, legacyPrefix):
+			successor := basePath + apiV1Prefix + strings.TrimPrefix(r.URL.Path, legacyPrefix)
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyAPIDeprecated.Unix()))
+			w.Header().Set("Sunset", legacyAPISunset.Format(http.TimeFormat))
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			r = withCorrelationID(w, r)
+			pw := &problemWriter{ResponseWriter: w, r: r}
+			defer pw.finish()
+			h.ServeHTTP(pw, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchiveManifest describes one archive object: the gzip-compressed CSV
+// of the readings a purge removed, in the export format. It is uploaded
+// after the data, so an archive without a manifest is incomplete.
+type ArchiveManifest struct {
+	Created  time.Time  `json:"created"`
+	Object   string     `json:"object"`
+	Size     int64      `json:"size"`
+	SHA256   string     `json:"sha256"`
+	Sensor   string     `json:"sensor,omitempty"`
+	From     *time.Time `json:"from,omitempty"`
+	To       *time.Time `json:"to,omitempty"`
+	Readings int64      `json:"readings"`
+	Sensors  []string   `json:"sensors"`
+	First    time.Time  `json:"first"`
+	Last     time.Time  `json:"last"`
+}
+
+// archivePrefix is where archives are kept in the bucket.
+func archivePrefix() string {
+	return config().Archive.Prefix + "readings/"
+}
+
+// archiveRange uploads the readings in the range, up to p.MaxIDs, to the
+// archive bucket. A range without readings uploads nothing.
+func archiveRange(p purgeRange) (*ArchiveManifest, error) {
+	f, err := ioutil.TempFile("", "piheat-archive-*.csv.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	now := time.Now().UTC()
+	m := &ArchiveManifest{Created: now.Truncate(time.Second), Sensor: p.Sensor}
+	if !p.From.IsZero() {
+		m.From = &p.From
+	}
+	if !p.To.IsZero() {
+		m.To = &p.To
+	}
+	h := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(f, h))
+	cw := csv.NewWriter(zw)
+	cw.Write([]string{"timestamp", "sensor", "temperature"})
+	sensors := map[string]bool{}
+	err = eachPurgedReading(p, func(r StoredReading) error {
+		if m.Readings == 0 || r.Timestamp.Before(m.First) {
+			m.First = r.Timestamp
+		}
+		if r.Timestamp.After(m.Last) {
+			m.Last = r.Timestamp
+		}
+		m.Readings++
+		sensors[r.Sensor] = true
+		return cw.Write([]string{r.Timestamp.Format(time.RFC3339), r.Sensor, strconv.FormatFloat(r.Temperature, 'f', -1, 64)})
+	})
+	if err != nil {
+		return nil, err
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	if m.Readings == 0 {
+		return nil, nil
+	}
+	for s := range sensors {
+		m.Sensors = append(m.Sensors, s)
+	}
+	sort.Strings(m.Sensors)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m.Size = info.Size()
+	m.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	base := archivePrefix() + now.Format("20060102T150405.000Z")
+	if p.Sensor != "" {
+		base += "-" + s3SafeName(p.Sensor)
+	}
+	m.Object = base + ".csv.gz"
+	if err := config().Archive.putFile(m.Object, f.Name()); err != nil {
+		return nil, err
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := config().Archive.putBytes(base+".json", manifest); err != nil {
+		return nil, err
+	}
+	log.Printf("Archived %d readings to %s", m.Readings, m.Object)
+	return m, nil
+}
+
+// eachPurgedReading calls fn with the readings of the tables in p.MaxIDs
+// that deleteRange would delete, in time order within each table.
+func eachPurgedReading(p purgeRange, fn func(StoredReading) error) error {
+	defer timeQuery("archive_scan")()
+	tables := make([]string, 0, len(p.MaxIDs))
+	for table := range p.MaxIDs {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		cond, args := p.readingsWhere(table)
+		rows, err := db.Query("SELECT id, sensor, temperature, timestamp FROM "+table+" WHERE "+cond+" ORDER BY timestamp, id", args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var rd StoredReading
+			if err := rows.Scan(&rd.ID, &rd.Sensor, &rd.Temperature, &rd.Timestamp); err != nil {
+				rows.Close()
+				return err
+			}
+			rd.Timestamp = rd.Timestamp.UTC()
+			if err := fn(rd); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3SafeName keeps sensor names readable in object keys.
+func s3SafeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// listArchives returns the manifests of the complete archives, oldest
+// data first.
+func listArchives() ([]ArchiveManifest, error) {
+	objects, err := config().Archive.list(archivePrefix())
+	if err != nil {
+		return nil, err
+	}
+	var list []ArchiveManifest
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, ".json") {
+			continue
+		}
+		b, err := config().Archive.getBytes(o.Key)
+		if err != nil {
+			return nil, err
+		}
+		var m ArchiveManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %v", o.Key, err)
+		}
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].First.Before(list[j].First) })
+	return list, nil
+}
+
+// overlaps reports whether the archive can hold readings for rq.
+func (m ArchiveManifest) overlaps(rq readingQuery) bool {
+	if rq.Sensor != "" {
+		i := sort.SearchStrings(m.Sensors, rq.Sensor)
+		if i == len(m.Sensors) || m.Sensors[i] != rq.Sensor {
+			return false
+		}
+	}
+	if !rq.From.IsZero() && m.Last.Before(rq.From) {
+		return false
+	}
+	return rq.To.IsZero() || m.First.Before(rq.To)
+}
+
+// eachArchivedReading calls fn for the archived readings matching rq,
+// downloading only the archives whose range overlaps it. Readings come in
+// time order within an archive, and archives by their oldest reading.
+func eachArchivedReading(rq readingQuery, fn func(StoredReading) error) (int, error) {
+	archives, err := listArchives()
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	for _, m := range archives {
+		if !m.overlaps(rq) {
+			continue
+		}
+		used++
+		if err := readArchive(m, rq, fn); err != nil {
+			return used, fmt.Errorf("%s: %v", m.Object, err)
+		}
+	}
+	return used, nil
+}
+
+func readArchive(m ArchiveManifest, rq readingQuery, fn func(StoredReading) error) error {
+	f, err := ioutil.TempFile("", "piheat-archive-*.csv.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := config().Archive.getFile(m.Object, f.Name()); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != m.SHA256 {
+		return fmt.Errorf("checksum mismatch")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	r := csv.NewReader(zr)
+	if _, err := r.Read(); err != nil {
+		return err
+	}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(rec) != 3 {
+			return fmt.Errorf("line has %d fields, want 3", len(rec))
+		}
+		ts, err := time.Parse(time.RFC3339, rec[0])
+		if err != nil {
+			return err
+		}
+		v, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return err
+		}
+		rd := StoredReading{Sensor: rec[1], Temperature: v, Timestamp: ts.UTC()}
+		if (rq.Sensor != "" && rd.Sensor != rq.Sensor) ||
+			(!rq.From.IsZero() && rd.Timestamp.Before(rq.From)) ||
+			(!rq.To.IsZero() && !rd.Timestamp.Before(rq.To)) {
+			continue
+		}
+		if err := fn(rd); err != nil {
+			return err
+		}
+	}
+}
+
+// archivesHandler serves GET /api/admin/archives, the manifests of the
+// archived readings.
+func archivesHandler(w http.ResponseWriter, r *http.Request) {
+	if config().Archive == nil {
+		http.Error(w, "No archive bucket configured", http.StatusNotFound)
+		return
+	}
+	list, err := listArchives()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing archives: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		list = []ArchiveManifest{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
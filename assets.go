@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//go:embed web
+var embeddedAssets embed.FS
+
+var (
+	// assets is the web/ tree, optionally overlaid by --assets-dir.
+	assets fs.FS
+	// assetsDir is set when files on disk override the embedded ones; they
+	// are then re-read on every request so edits show up without a restart.
+	assetsDir string
+	// assetVersion is a content hash appended to static URLs, so browsers
+	// can cache them indefinitely and still pick up a new release.
+	assetVersion string
+	// assetETags are the content hashes of the embedded static files, by
+	// path, for revalidating unversioned URLs.
+	assetETags map[string]string
+
+	templatesMu sync.Mutex
+	templates   = map[string]*template.Template{}
+)
+
+// overlayFS serves files from top when they exist there and from base
+// otherwise, so an assets directory only needs the files being customised.
+type overlayFS struct {
+	top, base fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+	return o.base.Open(name)
+}
+
+func setupAssets(dir string) error {
+	web, err := fs.Sub(embeddedAssets, "web")
+	if err != nil {
+		return err
+	}
+	assets = web
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return err
+		}
+		assets = overlayFS{top: os.DirFS(dir), base: web}
+		assetsDir = dir
+	}
+	assetVersion, assetETags, err = hashAssets(assets)
+	return err
+}
+
+// hashAssets returns a hash over all static files and one per file.
+func hashAssets(fsys fs.FS) (string, map[string]string, error) {
+	var paths []string
+	err := fs.WalkDir(fsys, "static", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			paths = append(paths, p)
+		}
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	files := map[string]string{}
+	for _, p := range paths {
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return "", nil, err
+		}
+		h.Write([]byte(p))
+		h.Write(data)
+		sum := sha256.Sum256(data)
+		files[p] = `"` + hex.EncodeToString(sum[:8]) + `"`
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12], files, nil
+}
+
+// templateFuncs are the helpers available to every page template, besides
+// those of its language.
+var templateFuncs = template.FuncMap{
+	"sub":   func(a, b int) int { return a - b },
+	"theme": currentTheme,
+}
+
+// parseTemplate returns the named page template in a language, parsed once
+// unless the assets come from disk.
+func parseTemplate(name, lang string) (*template.Template, error) {
+	messages, err := messagesFor(lang)
+	if err != nil {
+		return nil, err
+	}
+	parse := func() (*template.Template, error) {
+		return template.New(name).Funcs(templateFuncs).Funcs(languageFuncs(lang, messages)).ParseFS(assets, name)
+	}
+	if assetsDir != "" {
+		return parse()
+	}
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if t, ok := templates[lang+"/"+name]; ok {
+		return t, nil
+	}
+	t, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	templates[lang+"/"+name] = t
+	return t, nil
+}
+
+// staticHandler serves /static/. Versioned URLs of the embedded assets never
+// change content and are cached for a year; anything else is revalidated,
+// against the file's hash for embedded files and its modification time for
+// files from the assets directory.
+func staticHandler() http.Handler {
+	static, _ := fs.Sub(assets, "static")
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if assetsDir == "" && r.URL.Query().Get("v") == assetVersion {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if assetsDir == "" {
+			if etag, ok := assetETags[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+				w.Header().Set("ETag", etag)
+			}
+		}
+		files.ServeHTTP(w, r)
+	})
+}
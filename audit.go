@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AuditEntry records one change made to piheat: who made it, from where,
+// what was changed and its values before and after. Old is empty for
+// things created and New for things deleted.
+type AuditEntry struct {
+	ID     int64           `json:"id"`
+	Time   time.Time       `json:"time"`
+	Actor  string          `json:"actor"`
+	Remote string          `json:"remote,omitempty"`
+	Action string          `json:"action"`
+	Target string          `json:"target"`
+	Old    json.RawMessage `json:"old,omitempty"`
+	New    json.RawMessage `json:"new,omitempty"`
+}
+
+type auditPage struct {
+	Total   int          `json:"total"`
+	Limit   int          `json:"limit"`
+	Offset  int          `json:"offset"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// Actors of changes that do not come in over HTTP.
+const (
+	auditCLI       = "cli"
+	auditRetention = "retention"
+	auditSignal    = "SIGHUP"
+	auditGRPC      = "grpc"
+	auditDiskGuard = "disk_guard"
+	auditTRV       = "trv"
+)
+
+func initAuditTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		actor TEXT NOT NULL,
+		remote TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		old_value TEXT,
+		new_value TEXT
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_audit_timestamp ON audit_log(timestamp)")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// audit records a change. The change has already been made, so a failure
+// to record it is logged rather than returned.
+func audit(actor, remote, action, target string, old, new interface{}) {
+	oldValue, err := auditValue(old)
+	if err == nil {
+		var newValue interface{}
+		if newValue, err = auditValue(new); err == nil {
+			_, err = db.Exec("INSERT INTO audit_log (timestamp, actor, remote, action, target, old_value, new_value) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				sqliteTime(time.Now()), actor, remote, action, target, oldValue, newValue)
+		}
+	}
+	if err != nil {
+		log.Printf("Error recording %s of %s in the audit log: %v", action, target, err)
+	}
+}
+
+// auditRequest records a change made through an HTTP request.
+func auditRequest(r *http.Request, action, target string, old, new interface{}) {
+	audit(requestActor(r), r.RemoteAddr, action, target, old, new)
+}
+
+// requestActor names who made a request: the logged-in user, or
+// admin_token for scripts using the token.
+func requestActor(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Username
+	}
+	if hasAdminToken(r) {
+		return "admin_token"
+	}
+	return "anonymous"
+}
+
+// auditValue is the JSON stored for a value, or NULL for nil.
+func auditValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// auditQuery selects a page of the audit log. Action matches an action or,
+// without a dot, every action of that kind: "alert_rule" matches
+// "alert_rule.update".
+type auditQuery struct {
+	Action, Target, Actor string
+	From, To              time.Time
+	Limit, Offset         int
+}
+
+func (q auditQuery) filter() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if q.Action != "" {
+		if strings.Contains(q.Action, ".") {
+			where = append(where, "action = ?")
+			args = append(args, q.Action)
+		} else {
+			where = append(where, "action LIKE ?")
+			args = append(args, q.Action+".%")
+		}
+	}
+	if q.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, q.Target)
+	}
+	if q.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if !q.From.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, sqliteTime(q.From))
+	}
+	if !q.To.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, sqliteTime(q.To))
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func queryAudit(q auditQuery) (auditPage, error) {
+	filter, args := q.filter()
+	page := auditPage{Limit: q.Limit, Offset: q.Offset, Entries: []AuditEntry{}}
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_log"+filter, args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+	rows, err := db.Query("SELECT id, timestamp, actor, remote, action, target, COALESCE(old_value, ''), COALESCE(new_value, '') FROM audit_log"+filter+
+		" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEntry
+		var ts, oldValue, newValue string
+		if err := rows.Scan(&e.ID, &ts, &e.Actor, &e.Remote, &e.Action, &e.Target, &oldValue, &newValue); err != nil {
+			return page, err
+		}
+		e.Time, _ = parseSQLiteTime(ts)
+		if oldValue != "" {
+			e.Old = json.RawMessage(oldValue)
+		}
+		if newValue != "" {
+			e.New = json.RawMessage(newValue)
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	return page, rows.Err()
+}
+
+// auditHandler serves GET /api/audit, newest first. Filters: action,
+// target, actor, from, to.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	aq := auditQuery{Action: q.Get("action"), Target: q.Get("target"), Actor: q.Get("actor")}
+	for param, dst := range map[string]*time.Time{"from": &aq.From, "to": &aq.To} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	var ok bool
+	aq.Limit, aq.Offset, ok = pageParams(w, r, 100, 1000)
+	if !ok {
+		return
+	}
+	page, err := queryAudit(aq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
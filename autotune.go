@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// autotuneMaxDuration is how long an autotune may take to settle into
+	// a steady oscillation before it gives up.
+	autotuneMaxDuration = 24 * time.Hour
+	// autotuneAmplitude is half the swing of the relay's output, from off
+	// to fully on.
+	autotuneAmplitude = 0.5
+)
+
+// AutotuneStatus is the progress of a zone's autotune, and its result once
+// done. Cycles counts the full oscillations measured, of Required; Peaks
+// and Troughs are the turning points of the temperature so far.
+type AutotuneStatus struct {
+	Zone       string     `json:"zone"`
+	State      string     `json:"state"`
+	Target     float64    `json:"target"`
+	Hysteresis float64    `json:"hysteresis"`
+	Heating    bool       `json:"heating"`
+	Cycles     int        `json:"cycles"`
+	Required   int        `json:"required"`
+	Peaks      []float64  `json:"peaks"`
+	Troughs    []float64  `json:"troughs"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Actor      string     `json:"actor"`
+	Error      string     `json:"error,omitempty"`
+	Result     *PIDTuning `json:"result,omitempty"`
+}
+
+// AutotuneReport is the answer of GET /api/zones/{zone}/autotune: the
+// latest run since start, and the constants stored by the last one that
+// finished.
+type AutotuneReport struct {
+	Autotune *AutotuneStatus `json:"autotune"`
+	Tuning   *PIDTuning      `json:"tuning"`
+}
+
+// autotuneRequest is the body of POST /api/zones/{zone}/autotune.
+type autotuneRequest struct {
+	Hysteresis float64 `json:"hysteresis"`
+	Cycles     int     `json:"cycles"`
+}
+
+// autotuneRun is a relay-feedback (Åström–Hägglund) experiment on a zone:
+// its heaters are switched fully on below target minus hysteresis and off
+// above target plus it, and the period and amplitude of the oscillation
+// that settles in give the zone's ultimate gain and period. The first
+// cycle, from wherever the zone started, is left out.
+type autotuneRun struct {
+	st        AutotuneStatus
+	started   bool
+	low, high float64
+	rises     []time.Time
+}
+
+func newAutotune(zone string, req autotuneRequest, actor string, now time.Time) *autotuneRun {
+	return &autotuneRun{st: AutotuneStatus{Zone: zone, State: "running", Hysteresis: req.Hysteresis,
+		Required: req.Cycles, Peaks: []float64{}, Troughs: []float64{}, Started: now, Actor: actor}}
+}
+
+func (a *autotuneRun) running() bool { return a.st.State == "running" }
+
+// finish ends the run as state, with the reason of a failure.
+func (a *autotuneRun) finish(state, msg string, now time.Time) {
+	a.st.State, a.st.Error, a.st.Finished = state, msg, &now
+	if msg != "" {
+		log.Printf("Autotune of %s %s: %s", a.st.Zone, state, msg)
+	} else {
+		log.Printf("Autotune of %s %s", a.st.Zone, state)
+	}
+}
+
+// step switches the relay on the zone's latest reading and, once enough
+// cycles are in, works out the constants.
+func (a *autotuneRun) step(z *zoneState, now time.Time) (bool, string, string) {
+	temp := z.temp
+	if !a.started {
+		a.started, a.st.Target, a.st.Heating = true, z.target, temp < z.target
+		a.low, a.high = temp, temp
+		log.Printf("Autotune of %s started at %.1f°C ± %.2f°C", z.name, z.target, a.st.Hysteresis)
+	}
+	if z.target != a.st.Target {
+		a.finish("failed", fmt.Sprintf("the setpoint changed from %.1f°C to %.1f°C", a.st.Target, z.target), now)
+		return false, "autotune failed", "the autotune stopped: " + a.st.Error
+	}
+	if now.Sub(a.st.Started) > autotuneMaxDuration {
+		a.finish("failed", fmt.Sprintf("no steady oscillation within %s", autotuneMaxDuration), now)
+		return false, "autotune failed", "the autotune stopped: " + a.st.Error
+	}
+	a.low, a.high = math.Min(a.low, temp), math.Max(a.high, temp)
+	switch {
+	case a.st.Heating && temp > a.st.Target+a.st.Hysteresis:
+		a.st.Heating = false
+		a.st.Troughs = append(a.st.Troughs, a.low)
+		a.high = temp
+	case !a.st.Heating && temp < a.st.Target-a.st.Hysteresis:
+		a.st.Heating = true
+		a.st.Peaks = append(a.st.Peaks, a.high)
+		a.rises = append(a.rises, now)
+		a.low = temp
+	}
+	// A full cycle runs from one switch on to the next, the first from the
+	// start left out
+	a.st.Cycles = len(a.rises) - 1
+	if a.st.Cycles < 0 {
+		a.st.Cycles = 0
+	}
+	if a.st.Cycles >= a.st.Required && len(a.st.Troughs) > a.st.Required {
+		if err := a.result(now); err != nil {
+			a.finish("failed", err.Error(), now)
+			return false, "autotune failed", "the autotune stopped: " + a.st.Error
+		}
+		a.finish("done", "", now)
+		return false, "autotune done", fmt.Sprintf("the autotune found kp %.3f, ki %.3f, kd %.3f", a.st.Result.Kp, a.st.Result.Ki, a.st.Result.Kd)
+	}
+	why := fmt.Sprintf("autotune cycle %d of %d: heating %s between %.2f°C and %.2f°C", a.st.Cycles+1, a.st.Required,
+		onOff(a.st.Heating), a.st.Target-a.st.Hysteresis, a.st.Target+a.st.Hysteresis)
+	return a.st.Heating, "autotune", why
+}
+
+// result derives the constants from the last Required cycles by the
+// Ziegler–Nichols rules, times in hours.
+func (a *autotuneRun) result(now time.Time) error {
+	n := a.st.Required
+	rises := a.rises[len(a.rises)-n-1:]
+	tu := rises[n].Sub(rises[0]) / time.Duration(n)
+	peaks, troughs := a.st.Peaks[len(a.st.Peaks)-n:], a.st.Troughs[len(a.st.Troughs)-n:]
+	var swing float64
+	for i := range peaks {
+		swing += peaks[i] - troughs[i]
+	}
+	amplitude := swing / float64(2*n)
+	if amplitude <= 0 {
+		return errors.New("the temperature did not swing")
+	}
+	// The hysteresis delays each switch, which the describing function of
+	// a relay with hysteresis accounts for
+	eff := amplitude
+	if h := a.st.Hysteresis; amplitude > h*1.05 {
+		eff = math.Sqrt(amplitude*amplitude - h*h)
+	}
+	ku := 4 * autotuneAmplitude / (math.Pi * eff)
+	hours := tu.Hours()
+	a.st.Result = &PIDTuning{Kp: round3(0.6 * ku), Ki: round3(1.2 * ku / hours), Kd: round3(0.075 * ku * hours),
+		Ku: round3(ku), Tu: Duration{tu.Round(time.Second)}, TunedAt: now.UTC().Truncate(time.Second)}
+	return nil
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// zoneAutotuneHandler serves GET, POST and DELETE
+// /api/zones/{zone}/autotune.
+func zoneAutotuneHandler(w http.ResponseWriter, r *http.Request, z *zoneState) {
+	controller.mu.Lock()
+	var old *AutotuneStatus
+	if z.tune != nil {
+		st := z.tune.st
+		old = &st
+	}
+	tuning := z.tuning
+	controller.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if old == nil && tuning == nil {
+			http.Error(w, "No autotune", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, AutotuneReport{Autotune: old, Tuning: tuning})
+	case http.MethodPost:
+		req := autotuneRequest{Hysteresis: 0.3, Cycles: 3}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Hysteresis < 0.1 || req.Hysteresis > 2 {
+			http.Error(w, "hysteresis must be between 0.1 and 2°C", http.StatusBadRequest)
+			return
+		}
+		if req.Cycles < 2 || req.Cycles > 10 {
+			http.Error(w, "cycles must be between 2 and 10", http.StatusBadRequest)
+			return
+		}
+		if len(z.relays) == 0 {
+			http.Error(w, "The zone has no heaters of its own to switch", http.StatusConflict)
+			return
+		}
+		controller.mu.Lock()
+		if z.tune != nil && z.tune.running() {
+			controller.mu.Unlock()
+			http.Error(w, "An autotune is already running", http.StatusConflict)
+			return
+		}
+		run := newAutotune(z.name, req, requestActor(r), clock.Now().UTC().Truncate(time.Second))
+		z.tune = run
+		st := run.st
+		controller.mu.Unlock()
+		auditRequest(r, "autotune.start", z.name, nil, req)
+		writeJSON(w, http.StatusAccepted, st)
+	case http.MethodDelete:
+		controller.mu.Lock()
+		if z.tune == nil || !z.tune.running() {
+			controller.mu.Unlock()
+			http.Error(w, "No autotune running", http.StatusNotFound)
+			return
+		}
+		z.tune.finish("cancelled", "", clock.Now().UTC())
+		controller.mu.Unlock()
+		auditRequest(r, "autotune.cancel", z.name, old, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupConfig schedules snapshots of the database, kept in Dir and, when
+// S3 is set, uploaded to a bucket. Keep applies to both places.
+type BackupConfig struct {
+	Dir      string    `json:"dir"`
+	Interval Duration  `json:"interval"`
+	Keep     int       `json:"keep"`
+	S3       *S3Config `json:"s3,omitempty"`
+}
+
+// BackupInfo describes one backup archive.
+type BackupInfo struct {
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+	Location string    `json:"location"`
+	Files    []string  `json:"files,omitempty"`
+}
+
+// backupManifest is stored first in every archive.
+type backupManifest struct {
+	Created time.Time `json:"created"`
+	Files   []string  `json:"files"`
+}
+
+const (
+	backupPrefix       = "piheat-"
+	backupSuffix       = ".tar.gz"
+	backupManifestName = "backup.json"
+)
+
+// backups holds the effective backup settings. The mutex also keeps two
+// backups from running at once.
+var backups struct {
+	sync.Mutex
+	cfg BackupConfig
+}
+
+// setupBackups applies the defaults to the backup section of the config.
+// Without one, backups can still be taken on demand into
+// <data-dir>/backups.
+func setupBackups(c *BackupConfig, dbPath string) error {
+	b := BackupConfig{}
+	if c != nil {
+		b = *c
+		if b.Interval.Duration == 0 {
+			b.Interval.Duration = 24 * time.Hour
+		}
+	}
+	if b.Dir == "" {
+		b.Dir = filepath.Join(filepath.Dir(dbPath), "backups")
+	}
+	if b.Keep == 0 {
+		b.Keep = 7
+	}
+	if b.Keep < 0 {
+		return fmt.Errorf("backup: keep must be positive")
+	}
+	if b.S3 != nil {
+		s3 := *b.S3
+		if err := s3.check(); err != nil {
+			return fmt.Errorf("backup s3: %v", err)
+		}
+		b.S3 = &s3
+	}
+	backups.cfg = b
+	return nil
+}
+
+// startBackups takes a backup every interval when the config asks for it.
+func startBackups() {
+	if config().Backup == nil || backups.cfg.Interval.Duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(backups.cfg.Interval.Duration)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := createBackup(); err != nil {
+				log.Printf("Error creating backup: %v", err)
+			}
+		}
+	}()
+	log.Printf("Backing up every %s to %s", backups.cfg.Interval.Duration, backups.cfg.Dir)
+}
+
+// backupFileName is the name a database file gets inside the archive:
+// temperature.db for the main file, temperature-2024.db for a year file,
+// whatever the files are called on disk.
+func backupFileName(schema string) string {
+	if schema == "main" {
+		return "temperature.db"
+	}
+	return "temperature-" + strings.TrimPrefix(schema, "y") + ".db"
+}
+
+// createBackup snapshots the main database and every year file with VACUUM
+// INTO, which gives a consistent copy while piheat keeps writing, packs
+// them into one archive and rotates old archives.
+func createBackup() (BackupInfo, error) {
+	backups.Lock()
+	defer backups.Unlock()
+	b := backups.cfg
+	now := time.Now().UTC().Truncate(time.Second)
+	info := BackupInfo{Name: backupPrefix + now.Format("20060102-150405") + backupSuffix, Time: now, Location: "local"}
+
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return info, err
+	}
+	tmp, err := os.MkdirTemp(b.Dir, ".snapshot-")
+	if err != nil {
+		return info, err
+	}
+	defer os.RemoveAll(tmp)
+
+	files, err := backupSources()
+	if err != nil {
+		return info, err
+	}
+	for _, f := range files {
+		if err := vacuumInto(f.path, filepath.Join(tmp, f.name)); err != nil {
+			return info, fmt.Errorf("copying %s: %v", f.name, err)
+		}
+		info.Files = append(info.Files, f.name)
+	}
+
+	archive := filepath.Join(b.Dir, info.Name)
+	if err := writeBackupArchive(archive+".tmp", tmp, backupManifest{Created: now, Files: info.Files}); err != nil {
+		os.Remove(archive + ".tmp")
+		return info, err
+	}
+	if err := os.Rename(archive+".tmp", archive); err != nil {
+		return info, err
+	}
+	if st, err := os.Stat(archive); err == nil {
+		info.Size = st.Size()
+	}
+	log.Printf("Backup %s written (%d bytes)", archive, info.Size)
+	rotateLocalBackups(b)
+
+	if b.S3 != nil {
+		if err := b.S3.putFile(b.S3.Prefix+info.Name, archive); err != nil {
+			return info, fmt.Errorf("uploading to s3: %v", err)
+		}
+		info.Location = "local+s3"
+		rotateS3Backups(b)
+	}
+	return info, nil
+}
+
+type backupSource struct {
+	name, path string
+}
+
+// backupSources lists the main database and the year files attached to
+// it, with the names they get in the archive.
+func backupSources() ([]backupSource, error) {
+	rows, err := db.Query("PRAGMA database_list")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sources []backupSource
+	for rows.Next() {
+		var seq int
+		var name, file string
+		if err := rows.Scan(&seq, &name, &file); err != nil {
+			return nil, err
+		}
+		if name == "main" || (len(name) == 5 && strings.HasPrefix(name, "y")) {
+			sources = append(sources, backupSource{backupFileName(name), file})
+		}
+	}
+	return sources, rows.Err()
+}
+
+// vacuumInto copies a database file with VACUUM INTO, which is consistent
+// while piheat keeps writing. It uses a connection of its own: on the
+// shared ones the temperature_readings view would shadow the tables whose
+// indexes the copy recreates.
+func vacuumInto(src, dst string) error {
+	conn, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Exec("VACUUM INTO ?", dst)
+	return err
+}
+
+func writeBackupArchive(path, dir string, m backupManifest) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: backupManifestName, Mode: 0644, Size: int64(len(manifest)), ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, name := range m.Files {
+		if err := addFileToTar(tw, filepath.Join(dir, name), name, m.Created); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addFileToTar(tw *tar.Writer, path, name string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: st.Size(), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// backupTime parses the time from an archive name, so listings need not
+// open the archives.
+func backupTime(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102-150405", strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+	return t, err == nil
+}
+
+func listLocalBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []BackupInfo
+	for _, e := range entries {
+		t, ok := backupTime(e.Name())
+		if !ok || e.IsDir() {
+			continue
+		}
+		info := BackupInfo{Name: e.Name(), Time: t, Location: "local"}
+		if fi, err := e.Info(); err == nil {
+			info.Size = fi.Size()
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list, nil
+}
+
+func listS3Backups(c *S3Config) ([]BackupInfo, error) {
+	objects, err := c.list(c.Prefix + backupPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var list []BackupInfo
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, c.Prefix)
+		t, ok := backupTime(name)
+		if !ok || strings.Contains(name, "/") {
+			continue
+		}
+		list = append(list, BackupInfo{Name: name, Time: t, Size: o.Size, Location: "s3"})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list, nil
+}
+
+func rotateLocalBackups(b BackupConfig) {
+	list, err := listLocalBackups(b.Dir)
+	if err != nil {
+		log.Printf("Error listing backups: %v", err)
+		return
+	}
+	for i := b.Keep; i < len(list); i++ {
+		if err := os.Remove(filepath.Join(b.Dir, list[i].Name)); err != nil {
+			log.Printf("Error removing old backup: %v", err)
+		}
+	}
+}
+
+func rotateS3Backups(b BackupConfig) {
+	list, err := listS3Backups(b.S3)
+	if err != nil {
+		log.Printf("Error listing backups in s3: %v", err)
+		return
+	}
+	for i := b.Keep; i < len(list); i++ {
+		if err := b.S3.delete(b.S3.Prefix + list[i].Name); err != nil {
+			log.Printf("Error removing old backup from s3: %v", err)
+		}
+	}
+}
+
+// listBackups returns the local and, with S3 configured, remote backups,
+// newest first.
+func listBackups() ([]BackupInfo, error) {
+	b := backups.cfg
+	list, err := listLocalBackups(b.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if b.S3 != nil {
+		remote, err := listS3Backups(b.S3)
+		if err != nil {
+			return nil, fmt.Errorf("listing s3: %v", err)
+		}
+		list = append(list, remote...)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	if list == nil {
+		list = []BackupInfo{}
+	}
+	return list, nil
+}
+
+// backupHandler serves POST /api/admin/backup, which takes a backup now.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info, err := createBackup()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating backup: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+// backupsHandler serves GET /api/admin/backups.
+func backupsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := listBackups()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing backups: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// readBackupManifest returns the manifest at the start of an archive.
+func readBackupManifest(archive string) (backupManifest, error) {
+	var m backupManifest
+	f, err := os.Open(archive)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return m, err
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return m, fmt.Errorf("%s is not a piheat backup", archive)
+	}
+	err = json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&m)
+	return m, err
+}
+
+// restoreTarget maps a file name in an archive to its place next to dbPath.
+func restoreTarget(name, dbPath string) (string, error) {
+	if name == "temperature.db" {
+		return dbPath, nil
+	}
+	year, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "temperature-"), ".db"))
+	if err != nil || name != backupFileName(yearSchema(year)) {
+		return "", fmt.Errorf("unexpected file %q in backup", name)
+	}
+	return yearFile(dbPath, year), nil
+}
+
+// extractBackup writes the database files of an archive to their places
+// next to dbPath.
+func extractBackup(archive, dbPath string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == backupManifestName {
+			continue
+		}
+		target, err := restoreTarget(path.Clean(hdr.Name), dbPath)
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+// databaseFiles lists dbPath, its year files and their journals.
+func databaseFiles(dbPath string) ([]string, error) {
+	files := []string{dbPath}
+	years, err := yearFiles(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, y := range years {
+		files = append(files, y)
+	}
+	var existing []string
+	for _, f := range files {
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			if _, err := os.Stat(f + suffix); err == nil {
+				existing = append(existing, f+suffix)
+			}
+		}
+	}
+	return existing, nil
+}
+
+// purgesSince reads the purges recorded in the database at dbPath after
+// the given time.
+func purgesSince(dbPath string, since time.Time) ([]DataPurge, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	saved := db
+	defer func() { db = saved }()
+	var err error
+	db, err = sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'data_purges'").Scan(&exists); err != nil || exists == 0 {
+		return nil, err
+	}
+	all, err := listDataPurges()
+	if err != nil {
+		return nil, err
+	}
+	var purges []DataPurge
+	for _, p := range all {
+		// Timestamps have whole seconds: a purge in the second of the
+		// backup may or may not be in it, so it is applied again
+		if !p.PurgedAt.Before(since) {
+			purges = append(purges, p)
+		}
+	}
+	// Oldest first, in the order they were made
+	sort.Slice(purges, func(i, j int) bool { return purges[i].ID < purges[j].ID })
+	return purges, nil
+}
+
+// reapplyPurge deletes a purged range from restored data again and keeps
+// the audit record of the purge.
+func reapplyPurge(d DataPurge) (readings, alerts int64, err error) {
+	p := purgeRange{Sensor: d.Sensor}
+	if d.From != nil {
+		p.From = *d.From
+	}
+	if d.To != nil {
+		p.To = *d.To
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	readings, alerts, err = deleteRange(tx, p)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO data_purges (purged_at, sensor, range_from, range_to, readings, alerts, requested_by, reason)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM data_purges WHERE purged_at = ? AND sensor = ? AND range_from IS ? AND range_to IS ?)`,
+		sqliteTime(d.PurgedAt), d.Sensor, nullableTime(p.From), nullableTime(p.To), d.Readings, d.Alerts, d.RequestedBy, d.Reason,
+		sqliteTime(d.PurgedAt), d.Sensor, nullableTime(p.From), nullableTime(p.To))
+	if err != nil {
+		return 0, 0, err
+	}
+	return readings, alerts, tx.Commit()
+}
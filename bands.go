@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ActuatorBand is a stretch of time an actuator was running, for charts to
+// shade behind the readings. Duty is 1 for a heater that was on and the
+// opening, from 0 to 1, of a TRV.
+type ActuatorBand struct {
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	UnixFrom int64     `json:"unixFrom"`
+	UnixTo   int64     `json:"unixTo"`
+	Duty     float64   `json:"duty"`
+}
+
+// chartActuators picks the actuators of /api/chart-data's actuators
+// parameter: 1 for the heaters and TRVs of the zones the sensor controls,
+// all for every one, or a comma-separated list of heater:<name> and
+// trv:<name>.
+func chartActuators(param, sensor string) ([]actuatorKey, error) {
+	var keys []actuatorKey
+	switch param {
+	case "1":
+		for _, zc := range config().Zones {
+			if zc.Sensor != sensor {
+				continue
+			}
+			for _, h := range zc.Heaters {
+				keys = append(keys, actuatorKey{actuatorHeater, h})
+			}
+			for _, t := range zc.TRVs {
+				keys = append(keys, actuatorKey{actuatorTRV, t})
+			}
+		}
+	case "all":
+		for name := range config().Heaters {
+			keys = append(keys, actuatorKey{actuatorHeater, name})
+		}
+		for name := range config().TRVs {
+			keys = append(keys, actuatorKey{actuatorTRV, name})
+		}
+	default:
+		for _, id := range strings.Split(param, ",") {
+			kind, name, err := parseSeriesID(strings.TrimSpace(id))
+			if err != nil {
+				return nil, err
+			}
+			if kind == "sensor" {
+				return nil, fmt.Errorf("actuators must be 1, all or heater:<name> and trv:<name>")
+			}
+			keys = append(keys, actuatorKey{kind, name})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].name < keys[j].name
+	})
+	// A heater can warm more than one zone on the same sensor
+	out := keys[:0]
+	for i, k := range keys {
+		if i == 0 || k != keys[i-1] {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// bandedETag folds the actuator bands into a chart's ETag, so a heater
+// switching is not answered with 304. Events are only ever added, so each
+// actuator's latest one tells every change apart. latest is the time of
+// the newest event, for Last-Modified; while an actuator runs its band
+// is drawn up to now, so running is true and now goes into the ETag too.
+func bandedETag(etag string, keys []actuatorKey, now time.Time) (tag string, latest time.Time, running bool, err error) {
+	var b strings.Builder
+	b.WriteString(etag)
+	for _, key := range keys {
+		var id int64
+		var duty sql.NullFloat64
+		var ts string
+		err = db.QueryRow(`SELECT id, duty, timestamp FROM actuator_events WHERE kind = ? AND actuator = ?
+			ORDER BY timestamp DESC, id DESC LIMIT 1`, key.kind, key.name).Scan(&id, &duty, &ts)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return "", time.Time{}, false, err
+		}
+		fmt.Fprintf(&b, "\x00%s:%s:%d", key.kind, key.name, id)
+		if at, perr := parseSQLiteTime(ts); perr == nil && at.After(latest) {
+			latest = at
+		}
+		if duty.Valid && duty.Float64 > 0 {
+			running = true
+		}
+	}
+	if running {
+		fmt.Fprintf(&b, "\x00%d", now.Unix())
+	}
+	h := sha256.Sum256([]byte(b.String()))
+	return `W/"` + hex.EncodeToString(h[:8]) + `"`, latest, running, nil
+}
+
+// actuatorBands is when each actuator was running between from and to,
+// from its logged states: from its last event before from and its events
+// since. Consecutive events with the same duty make one band.
+func actuatorBands(keys []actuatorKey, from, to time.Time) ([]ActuatorBand, error) {
+	bands := []ActuatorBand{}
+	for _, key := range keys {
+		rows, err := db.Query(`SELECT duty, timestamp FROM actuator_events WHERE kind = ? AND actuator = ? AND timestamp < ?
+			AND timestamp >= COALESCE((SELECT MAX(timestamp) FROM actuator_events WHERE kind = ? AND actuator = ? AND timestamp <= ?), '')
+			ORDER BY timestamp, id`, key.kind, key.name, sqliteTime(to), key.kind, key.name, sqliteTime(from))
+		if err != nil {
+			return nil, err
+		}
+		var open *ActuatorBand
+		closeBand := func(at time.Time) {
+			if open != nil {
+				open.To, open.UnixTo = at.UTC(), at.Unix()
+				if open.To.After(open.From) {
+					bands = append(bands, *open)
+				}
+				open = nil
+			}
+		}
+		for rows.Next() {
+			var duty *float64
+			var ts string
+			if err := rows.Scan(&duty, &ts); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			at, _ := parseSQLiteTime(ts)
+			if at.Before(from) {
+				at = from
+			}
+			if open != nil && duty != nil && round3(*duty) == open.Duty {
+				continue
+			}
+			closeBand(at)
+			if duty != nil && *duty > 0 {
+				open = &ActuatorBand{Kind: key.kind, Name: key.name, From: at.UTC(), UnixFrom: at.Unix(), Duty: round3(*duty)}
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		closeBand(to)
+	}
+	sort.SliceStable(bands, func(i, j int) bool { return bands[i].From.Before(bands[j].From) })
+	return bands, nil
+}
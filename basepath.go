@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// basePath is the URL prefix piheat is served under, e.g. "/piheat" when a
+// reverse proxy forwards https://example.com/piheat/ without stripping the
+// prefix. It is empty when served from the root.
+var basePath string
+
+// normalizeBasePath turns "piheat", "/piheat/" and "/piheat" into "/piheat",
+// and "/" into "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// withBasePath serves h under prefix. Requests outside the prefix get a 404
+// and the bare prefix redirects to the dashboard at prefix + "/". Proxies
+// that strip the prefix before forwarding say so with X-Forwarded-Prefix,
+// and their requests are served as they come.
+func withBasePath(h http.Handler, prefix string) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	stripped := http.StripPrefix(prefix, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefix:
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		case normalizeBasePath(r.Header.Get("X-Forwarded-Prefix")) == prefix:
+			h.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// calibrationMaxOffset bounds an offset, so a reference typed into the
+	// wrong field cannot shift a sensor by 50°C.
+	calibrationMaxOffset = 10.0
+	// calibrationMaxAge is how recent the reading a reference is compared
+	// with must be.
+	calibrationMaxAge = 10 * time.Minute
+)
+
+// Calibration is one change of a sensor's offset. Reading is the sensor's
+// uncalibrated reading a Reference was compared with; both are missing
+// when the offset was set directly.
+type Calibration struct {
+	ID             int64     `json:"id"`
+	Sensor         string    `json:"sensor"`
+	Offset         float64   `json:"offset"`
+	PreviousOffset float64   `json:"previousOffset"`
+	Reference      *float64  `json:"reference,omitempty"`
+	Reading        *float64  `json:"reading,omitempty"`
+	Actor          string    `json:"actor"`
+	Remote         string    `json:"remote,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+// calibrationRequest is the body of POST /api/calibrations/{sensor}: a
+// reference thermometer's reading to compute the offset from, or the
+// offset itself.
+type calibrationRequest struct {
+	Reference *float64 `json:"reference"`
+	Offset    *float64 `json:"offset"`
+}
+
+// calibrationOffsets holds each sensor's current offset, which is added to
+// its readings as they are recorded.
+var calibrationOffsets = struct {
+	sync.Mutex
+	m map[string]float64
+}{m: map[string]float64{}}
+
+func initCalibrationTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS calibrations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sensor TEXT NOT NULL,
+		sensor_offset REAL NOT NULL,
+		previous_offset REAL NOT NULL,
+		reference REAL,
+		reading REAL,
+		actor TEXT NOT NULL,
+		remote TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_calibrations_sensor ON calibrations(sensor, id);")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadCalibrationOffsets reads the current offsets at start.
+func loadCalibrationOffsets() error {
+	list, err := currentCalibrations()
+	if err != nil {
+		return err
+	}
+	calibrationOffsets.Lock()
+	defer calibrationOffsets.Unlock()
+	for _, c := range list {
+		calibrationOffsets.m[c.Sensor] = c.Offset
+	}
+	return nil
+}
+
+// calibrated applies the sensor's offset to a reading.
+func calibrated(sensor string, value float64) float64 {
+	calibrationOffsets.Lock()
+	defer calibrationOffsets.Unlock()
+	return value + calibrationOffsets.m[sensor]
+}
+
+func calibrationOffset(sensor string) float64 {
+	calibrationOffsets.Lock()
+	defer calibrationOffsets.Unlock()
+	return calibrationOffsets.m[sensor]
+}
+
+const calibrationColumns = "id, sensor, sensor_offset, previous_offset, reference, reading, actor, remote, created_at"
+
+func scanCalibrations(query string, args ...interface{}) ([]Calibration, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Calibration{}
+	for rows.Next() {
+		var c Calibration
+		var createdAt string
+		if err := rows.Scan(&c.ID, &c.Sensor, &c.Offset, &c.PreviousOffset, &c.Reference, &c.Reading,
+			&c.Actor, &c.Remote, &createdAt); err != nil {
+			return nil, err
+		}
+		c.CreatedAt, _ = parseSQLiteTime(createdAt)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// currentCalibrations returns the latest calibration of every sensor.
+func currentCalibrations() ([]Calibration, error) {
+	return scanCalibrations("SELECT " + calibrationColumns + ` FROM calibrations
+		WHERE id IN (SELECT MAX(id) FROM calibrations GROUP BY sensor) ORDER BY sensor`)
+}
+
+// calibrationHistory returns a sensor's calibrations, newest first.
+func calibrationHistory(sensor string) ([]Calibration, error) {
+	return scanCalibrations("SELECT "+calibrationColumns+" FROM calibrations WHERE sensor = ? ORDER BY id DESC", sensor)
+}
+
+// newCalibration works out the sensor's new offset from the request, and
+// the status to refuse it with.
+func newCalibration(sensor string, req calibrationRequest) (Calibration, int, error) {
+	c := Calibration{Sensor: sensor, PreviousOffset: calibrationOffset(sensor), CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	switch {
+	case req.Reference != nil && req.Offset != nil:
+		return c, http.StatusBadRequest, fmt.Errorf("give either reference or offset")
+	case req.Offset != nil:
+		c.Offset = *req.Offset
+	case req.Reference != nil:
+		sensorsMonitor.mu.Lock()
+		st, ok := sensorsMonitor.sensors[sensor]
+		var value float64
+		var seen time.Time
+		if ok {
+			value, seen = st.value, st.lastSeen
+		}
+		sensorsMonitor.mu.Unlock()
+		if !ok || time.Since(seen) > calibrationMaxAge {
+			return c, http.StatusConflict, fmt.Errorf("no reading from %s in the last %s to compare the reference with", sensor, calibrationMaxAge)
+		}
+		raw := value - c.PreviousOffset
+		ref := *req.Reference
+		c.Reference, c.Reading = &ref, &raw
+		c.Offset = ref - raw
+	default:
+		return c, http.StatusBadRequest, fmt.Errorf("reference or offset is required")
+	}
+	c.Offset = math.Round(c.Offset*100) / 100
+	if math.IsNaN(c.Offset) || math.Abs(c.Offset) > calibrationMaxOffset {
+		return c, http.StatusBadRequest, fmt.Errorf("offset must be within ±%.0f°C", calibrationMaxOffset)
+	}
+	return c, http.StatusOK, nil
+}
+
+// saveCalibration stores a calibration and applies its offset to the
+// sensor's readings from now on.
+func saveCalibration(c *Calibration) error {
+	res, err := db.Exec(`INSERT INTO calibrations (sensor, sensor_offset, previous_offset, reference, reading, actor, remote, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, c.Sensor, c.Offset, c.PreviousOffset, c.Reference, c.Reading, c.Actor, c.Remote, sqliteTime(c.CreatedAt))
+	if err != nil {
+		return err
+	}
+	c.ID, _ = res.LastInsertId()
+	calibrationOffsets.Lock()
+	calibrationOffsets.m[c.Sensor] = c.Offset
+	calibrationOffsets.Unlock()
+	log.Printf("Sensor %s calibrated: offset %+.2f°C (was %+.2f°C)", c.Sensor, c.Offset, c.PreviousOffset)
+	return nil
+}
+
+// calibrationsHandler serves GET /api/calibrations, the current offset of
+// every calibrated sensor, and GET and POST /api/calibrations/{sensor}.
+func calibrationsHandler(w http.ResponseWriter, r *http.Request) {
+	sensor := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/calibrations"), "/")
+	if sensor == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list, err := currentCalibrations()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := calibrationHistory(sensor)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var req calibrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		c, status, err := newCalibration(sensor, req)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		c.Actor, c.Remote = requestActor(r), r.RemoteAddr
+		if err := saveCalibration(&c); err != nil {
+			http.Error(w, fmt.Sprintf("Error saving calibration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, "sensor.calibrate", sensor, c.PreviousOffset, c.Offset)
+		writeJSON(w, http.StatusCreated, c)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// calibratePageHandler serves the calibration wizard.
+func calibratePageHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := parseTemplate("calibrate.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+	}{basePath, assetVersion})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	chartGrid = color.RGBA{224, 224, 224, 255}
+	chartText = color.RGBA{85, 85, 85, 255}
+)
+
+var periodTitles = map[string]string{
+	"day":   "last 24 hours",
+	"week":  "last 7 days",
+	"month": "last month",
+	"year":  "last year",
+}
+
+// chartLayout maps readings onto an image with room for a title and axis
+// labels. The PNG and SVG renderers share it so both look the same.
+type chartLayout struct {
+	width, height            int
+	left, right, top, bottom int
+	lo, hi                   float64
+	t0, t1                   int64
+	yTicks                   []float64
+	xTicks                   []int64
+	xFormat                  string
+}
+
+func newChartLayout(points []ChartDataPoint, period string, width, height int) chartLayout {
+	l := chartLayout{width: width, height: height, left: 48, right: width - 16, top: 32, bottom: height - 24}
+	switch period {
+	case "week":
+		l.xFormat = "Mon 02"
+	case "month":
+		l.xFormat = "01-02"
+	case "year":
+		l.xFormat = "Jan 06"
+	default:
+		l.xFormat = "15:04"
+	}
+	if len(points) == 0 {
+		return l
+	}
+
+	l.lo, l.hi = points[0].Temperature, points[0].Temperature
+	l.t0, l.t1 = points[0].UnixTime, points[len(points)-1].UnixTime
+	for _, p := range points {
+		l.lo = math.Min(l.lo, p.Temperature)
+		l.hi = math.Max(l.hi, p.Temperature)
+	}
+	if l.t1 <= l.t0 {
+		l.t0, l.t1 = l.t0-1800, l.t0+1800
+	}
+
+	step := niceStep((l.hi - l.lo) / 4)
+	l.lo = math.Floor(l.lo/step) * step
+	l.hi = math.Ceil(l.hi/step) * step
+	if l.hi <= l.lo {
+		l.lo, l.hi = l.lo-step, l.hi+step
+	}
+	for v := l.lo; v <= l.hi+step/2; v += step {
+		l.yTicks = append(l.yTicks, v)
+	}
+	const xTickCount = 5
+	for i := 0; i <= xTickCount; i++ {
+		l.xTicks = append(l.xTicks, l.t0+(l.t1-l.t0)*int64(i)/xTickCount)
+	}
+	return l
+}
+
+// niceStep rounds a raw tick step up to 1, 2 or 5 times a power of ten.
+func niceStep(raw float64) float64 {
+	if raw <= 0 {
+		return 1
+	}
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if raw <= m*mag {
+			return m * mag
+		}
+	}
+	return 10 * mag
+}
+
+func (l chartLayout) x(t int64) int {
+	return l.left + int(float64(t-l.t0)/float64(l.t1-l.t0)*float64(l.right-l.left))
+}
+
+func (l chartLayout) y(v float64) int {
+	return l.bottom - int((v-l.lo)/(l.hi-l.lo)*float64(l.bottom-l.top))
+}
+
+func (l chartLayout) yLabel(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (l chartLayout) xLabel(t int64) string {
+	return time.Unix(t, 0).Local().Format(l.xFormat)
+}
+
+// xAnchor keeps the first and last time labels inside the image: 0 aligns
+// a label's start with its tick, 0.5 centres it and 1 aligns its end.
+func (l chartLayout) xAnchor(i int) float64 {
+	switch i {
+	case 0:
+		return 0
+	case len(l.xTicks) - 1:
+		return 1
+	}
+	return 0.5
+}
+
+func chartTitle(sensor, period string) string {
+	return sensor + " - " + periodTitles[period]
+}
+
+// renderChartPNG draws the chart with a built-in bitmap font, so it needs no
+// font files on the device.
+func renderChartPNG(points []ChartDataPoint, sensor, period string, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{sparkBackground}, image.Point{}, draw.Src)
+	l := newChartLayout(points, period, width, height)
+
+	text := func(s string, x, y int, anchor float64) {
+		d := &font.Drawer{Dst: img, Src: image.NewUniform(chartText), Face: basicfont.Face7x13}
+		x -= int(float64(d.MeasureString(s).Round()) * anchor)
+		d.Dot = fixed.P(x, y)
+		d.DrawString(s)
+	}
+	text(chartTitle(sensor, period), l.left, 18, 0)
+
+	if len(points) == 0 {
+		text("No data", width/2, height/2, 0.5)
+		return encodePNG(img)
+	}
+
+	for _, v := range l.yTicks {
+		y := l.y(v)
+		for x := l.left; x <= l.right; x++ {
+			img.Set(x, y, chartGrid)
+		}
+		text(l.yLabel(v), l.left-6, y+4, 1)
+	}
+	for i, t := range l.xTicks {
+		x := l.x(t)
+		for y := l.top; y <= l.bottom; y++ {
+			img.Set(x, y, chartGrid)
+		}
+		text(l.xLabel(t), x, height-8, l.xAnchor(i))
+	}
+
+	fill := lighten(sparkLine)
+	for i := 0; i < len(points)-1; i++ {
+		x0, y0 := l.x(points[i].UnixTime), l.y(points[i].Temperature)
+		x1, y1 := l.x(points[i+1].UnixTime), l.y(points[i+1].Temperature)
+		for px := x0; px <= x1; px++ {
+			top := y0
+			if x1 > x0 {
+				top = y0 + (y1-y0)*(px-x0)/(x1-x0)
+			}
+			for py := top + 1; py < l.bottom; py++ {
+				img.Set(px, py, fill)
+			}
+		}
+	}
+	for i := 0; i < len(points)-1; i++ {
+		drawLine(img, l.x(points[i].UnixTime), l.y(points[i].Temperature),
+			l.x(points[i+1].UnixTime), l.y(points[i+1].Temperature), sparkLine)
+	}
+	if len(points) == 1 {
+		y := l.y(points[0].Temperature)
+		drawLine(img, l.left, y, l.right, y, sparkLine)
+	}
+	return encodePNG(img)
+}
+
+func encodePNG(img image.Image) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// renderChartSVG draws the same chart as renderChartPNG as scalable SVG.
+func renderChartSVG(points []ChartDataPoint, sensor, period string, width, height int) []byte {
+	l := newChartLayout(points, period, width, height)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`,
+		width, height, width, height)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`, svgColor(sparkBackground))
+	text := func(s string, x, y int, anchor string) {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="%s" fill="%s">%s</text>`, x, y, anchor, svgColor(chartText), html.EscapeString(s))
+	}
+	text(chartTitle(sensor, period), l.left, 18, "start")
+
+	if len(points) == 0 {
+		text("No data", width/2, height/2, "middle")
+		b.WriteString("</svg>")
+		return []byte(b.String())
+	}
+
+	for _, v := range l.yTicks {
+		y := l.y(v)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`, l.left, y, l.right, y, svgColor(chartGrid))
+		text(l.yLabel(v), l.left-6, y+4, "end")
+	}
+	anchors := map[float64]string{0: "start", 0.5: "middle", 1: "end"}
+	for i, t := range l.xTicks {
+		x := l.x(t)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`, x, l.top, x, l.bottom, svgColor(chartGrid))
+		text(l.xLabel(t), x, height-8, anchors[l.xAnchor(i)])
+	}
+
+	var line strings.Builder
+	for i, p := range points {
+		if i > 0 {
+			line.WriteByte(' ')
+		}
+		fmt.Fprintf(&line, "%d,%d", l.x(p.UnixTime), l.y(p.Temperature))
+	}
+	if len(points) == 1 {
+		y := l.y(points[0].Temperature)
+		line.Reset()
+		fmt.Fprintf(&line, "%d,%d %d,%d", l.left, y, l.right, y)
+	}
+	first, last := l.x(points[0].UnixTime), l.x(points[len(points)-1].UnixTime)
+	if len(points) == 1 {
+		first, last = l.left, l.right
+	}
+	fmt.Fprintf(&b, `<polygon points="%d,%d %s %d,%d" fill="%s"/>`, first, l.bottom, line.String(), last, l.bottom, svgColor(lighten(sparkLine)))
+	fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`, line.String(), svgColor(sparkLine))
+	b.WriteString("</svg>")
+	return []byte(b.String())
+}
+
+// chartImageHandler serves /api/chart.png and /api/chart.svg with the same
+// data as the dashboard chart, for clients that cannot run JavaScript.
+func chartImageHandler(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkSignature(w, r) {
+			return
+		}
+		q := r.URL.Query()
+		sensor := q.Get("sensor")
+		if sensor == "" {
+			sensor = "cpu"
+		}
+		period := q.Get("period")
+		if period == "" {
+			period = "day"
+		}
+		if _, ok := periodTitles[period]; !ok {
+			http.Error(w, "period must be day, week, month or year", http.StatusBadRequest)
+			return
+		}
+		width, ok := sizeParam(w, q.Get("width"), "width", 800, 200, 2000)
+		if !ok {
+			return
+		}
+		height, ok := sizeParam(w, q.Get("height"), "height", 400, 100, 1500)
+		if !ok {
+			return
+		}
+
+		var points []ChartDataPoint
+		var err error
+		if chartResolution(period) != "" {
+			points, _, err = aggregateChart(r.Context(), sensor, period, time.Now())
+		} else {
+			points, err = chartData(r.Context(), sensor, period, time.Now())
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		roundChartData(sensor, points)
+		if format == "svg" {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write(renderChartSVG(points, sensor, period, width, height))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(renderChartPNG(points, sensor, period, width, height))
+	}
+}
+
+func sizeParam(w http.ResponseWriter, v, name string, def, lo, hi int) (int, bool) {
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		http.Error(w, fmt.Sprintf("%s must be between %d and %d", name, lo, hi), http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var commandHelp = []struct{ name, summary string }{
+	{"serve", "record temperatures and serve the dashboard (default)"},
+	{"export", "write stored readings as CSV or JSON"},
+	{"import", "add readings from a CSV file"},
+	{"prune", "delete readings and alert history older than a given age"},
+	{"stats", "print min/max/avg per sensor"},
+	{"backup", "take a backup of the database now"},
+	{"restore", "replace the database with a backup"},
+	{"user", "add, change, delete or list dashboard users"},
+}
+
+var commands = map[string]func(args []string){
+	"serve":   serve,
+	"export":  exportCmd,
+	"import":  importCmd,
+	"prune":   pruneCmd,
+	"stats":   statsCmd,
+	"backup":  backupCmd,
+	"restore": restoreCmd,
+	"user":    userCmd,
+	"help":    func([]string) { usage() },
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: piheat [command] [flags]\n\nCommands:\n")
+	for _, c := range commandHelp {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun piheat <command> -h for the flags of a command.\n")
+}
+
+// storageFlags are the flags every command needs to find the config and
+// the database.
+type storageFlags struct {
+	dataDir, configPath, dbPath string
+}
+
+func addStorageFlags(fs *flag.FlagSet) *storageFlags {
+	st := &storageFlags{}
+	fs.StringVar(&st.dataDir, "data-dir", envOr("PIHEAT_DATA_DIR", "."), "directory for the database and config file (env PIHEAT_DATA_DIR)")
+	fs.StringVar(&st.configPath, "config", os.Getenv("PIHEAT_CONFIG"), "path to the JSON config file (env PIHEAT_CONFIG, default <data-dir>/piheat.json)")
+	fs.StringVar(&st.dbPath, "db", os.Getenv("PIHEAT_DB"), "path to the SQLite database (env PIHEAT_DB, default <data-dir>/temperature.db)")
+	fs.BoolVar(&splitByYear, "split-by-year", envOr("PIHEAT_SPLIT_BY_YEAR", "false") == "true", "store readings in one database file per year (env PIHEAT_SPLIT_BY_YEAR)")
+	return st
+}
+
+// load fills in the default paths and loads the config file.
+func (st *storageFlags) load() {
+	if st.configPath == "" {
+		st.configPath = filepath.Join(st.dataDir, "piheat.json")
+	}
+	if st.dbPath == "" {
+		st.dbPath = filepath.Join(st.dataDir, "temperature.db")
+	}
+	c, err := loadConfig(st.configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	setConfig(c)
+	configPath = st.configPath
+}
+
+// open prepares the database for a command run without the server.
+// Commands that write take the instance lock, so they refuse to run while
+// piheat serve is recording into the same database; the others open it
+// read-only and can run alongside it.
+func (st *storageFlags) open(write bool) {
+	log.SetFlags(0)
+	st.load()
+	if write {
+		var err error
+		instanceLock, err = acquireInstanceLock(st.dbPath + ".lock")
+		if err != nil {
+			log.Fatalf("Error: %v; stop it first", err)
+		}
+	} else {
+		if _, err := os.Stat(st.dbPath); err != nil {
+			log.Fatalf("Error opening database: %v", err)
+		}
+		readOnly = true
+	}
+	initDatabase(st.dbPath)
+}
+
+// parseCLITime accepts RFC3339 or a local date. A date given as the end of
+// a range includes that whole day.
+func parseCLITime(name, v string, end bool) time.Time {
+	if v == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		log.Fatalf("Invalid -%s %q: use YYYY-MM-DD or RFC3339", name, v)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// parseAge is time.ParseDuration extended with days (90d) and weeks (12w).
+func parseAge(v string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(v, suffix)); err == nil && strings.HasSuffix(v, suffix) {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(v)
+}
+
+func exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	from := fs.String("from", "", "start of the export, YYYY-MM-DD or RFC3339")
+	to := fs.String("to", "", "end of the export, exclusive; a date includes that day")
+	sensor := fs.String("sensor", "", "only export this sensor")
+	format := fs.String("format", "csv", "csv or json")
+	output := fs.String("o", "", "write to this file instead of standard output")
+	archived := fs.Bool("archive", false, "also export readings pruned to the archive bucket")
+	fs.Parse(args)
+	if *format != "csv" && *format != "json" {
+		log.Fatalf("Unknown format %q", *format)
+	}
+	rq := readingQuery{Sensor: *sensor, Ascending: true, From: parseCLITime("from", *from, false), To: parseCLITime("to", *to, true)}
+	st.open(false)
+	if *archived && config().Archive == nil {
+		log.Fatalf("-archive needs an archive bucket in the config")
+	}
+	// Archived readings were pruned for their age, so they come before the
+	// ones still in the database
+	each := func(fn func(StoredReading) error) error {
+		if *archived {
+			n, err := eachArchivedReading(rq, fn)
+			if err != nil {
+				return fmt.Errorf("reading archive: %v", err)
+			}
+			log.Printf("Read %d archives", n)
+		}
+		return eachReading(context.Background(), rq, fn)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating %s: %v", *output, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	n := 0
+	var err error
+	if *format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"timestamp", "sensor", "temperature"})
+		err = each(func(r StoredReading) error {
+			n++
+			return cw.Write([]string{r.Timestamp.Format(time.RFC3339), r.Sensor, strconv.FormatFloat(r.Temperature, 'f', -1, 64)})
+		})
+		cw.Flush()
+	} else {
+		w.WriteString("[")
+		err = each(func(r StoredReading) error {
+			if n > 0 {
+				w.WriteString(",")
+			}
+			n++
+			b, err := json.Marshal(r)
+			w.WriteString("\n  ")
+			w.Write(b)
+			return err
+		})
+		w.WriteString("\n]\n")
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatalf("Error exporting readings: %v", err)
+	}
+	log.Printf("Exported %d readings", n)
+}
+
+// csvColumns finds the timestamp, sensor and temperature columns from a
+// header row; sensor is -1 when the file has no sensor column.
+func csvColumns(header []string) (ts, sensor, temp int, ok bool) {
+	ts, sensor, temp = -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "timestamp", "time":
+			ts = i
+		case "sensor":
+			sensor = i
+		case "temperature", "value":
+			temp = i
+		}
+	}
+	return ts, sensor, temp, ts >= 0 && temp >= 0
+}
+
+func parseImportTime(v string) (time.Time, error) {
+	if t, err := parseSQLiteTime(v); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", v)
+}
+
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	defaultSensor := fs.String("sensor", "cpu", "sensor for rows of files without a sensor column")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: piheat import [flags] file.csv\n\nColumns are timestamp,sensor,temperature or timestamp,temperature, with or\nwithout a header row. Use - to read standard input.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	in := os.Stdin
+	source := sourceImport + "stdin"
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", name, err)
+		}
+		defer f.Close()
+		in = f
+		source = sourceImport + filepath.Base(name)
+	}
+	st.open(true)
+
+	r := csv.NewReader(bufio.NewReader(in))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Error importing readings: %v", err)
+	}
+	defer tx.Rollback()
+	// Readings go into the main file; with -split-by-year they are moved
+	// into their year files the next time piheat starts
+	insert, err := tx.Prepare("INSERT INTO main.temperature_readings (sensor, temperature, timestamp, source) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		log.Fatalf("Error importing readings: %v", err)
+	}
+	exists, err := tx.Prepare("SELECT COUNT(*) FROM temperature_readings WHERE sensor = ? AND timestamp = ?")
+	if err != nil {
+		log.Fatalf("Error importing readings: %v", err)
+	}
+
+	tsCol, sensorCol, tempCol := 0, 1, 2
+	imported, skipped := 0, 0
+	var first, last time.Time
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Error reading line %d: %v", line, err)
+		}
+		if line == 1 {
+			if ts, sensor, temp, ok := csvColumns(rec); ok {
+				tsCol, sensorCol, tempCol = ts, sensor, temp
+				continue
+			}
+			if len(rec) == 2 {
+				tsCol, sensorCol, tempCol = 0, -1, 1
+			}
+		}
+		if len(rec) <= tsCol || len(rec) <= tempCol || len(rec) <= sensorCol {
+			log.Fatalf("Error on line %d: expected %d columns", line, len(rec))
+		}
+		t, err := parseImportTime(rec[tsCol])
+		if err != nil {
+			log.Fatalf("Error on line %d: %v", line, err)
+		}
+		temp, err := strconv.ParseFloat(rec[tempCol], 64)
+		if err != nil {
+			log.Fatalf("Error on line %d: invalid temperature %q", line, rec[tempCol])
+		}
+		sensor := *defaultSensor
+		if sensorCol >= 0 {
+			sensor = rec[sensorCol]
+		}
+
+		// Importing the same file twice must not double the readings
+		var n int
+		if err := exists.QueryRow(sensor, sqliteTime(t)).Scan(&n); err != nil {
+			log.Fatalf("Error importing readings: %v", err)
+		}
+		if n > 0 {
+			skipped++
+			continue
+		}
+		if _, err := insert.Exec(sensor, temp, sqliteTime(t), source); err != nil {
+			log.Fatalf("Error importing readings: %v", err)
+		}
+		imported++
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	// The year in review sums the imported days again
+	if imported > 0 {
+		if err := forgetRollup(tx, first, last); err != nil {
+			log.Fatalf("Error importing readings: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Error importing readings: %v", err)
+	}
+	log.Printf("Imported %d readings, skipped %d already stored", imported, skipped)
+}
+
+func pruneCmd(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	olderThan := fs.String("older-than", "", "delete data older than this age, e.g. 90d, 12w or 720h (required)")
+	sensor := fs.String("sensor", "", "only prune this sensor")
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	fs.Parse(args)
+	age, err := parseAge(*olderThan)
+	if err != nil || age <= 0 {
+		fmt.Fprintf(os.Stderr, "-older-than must be a positive age such as 90d\n")
+		os.Exit(2)
+	}
+	st.open(!*dryRun)
+
+	p := purgeRange{Sensor: *sensor, To: time.Now().Add(-age).UTC().Truncate(time.Second)}
+	if *dryRun {
+		readings, alerts, err := countPurge(p)
+		if err != nil {
+			log.Fatalf("Error querying database: %v", err)
+		}
+		log.Printf("Would delete %d readings and %d alerts before %s", readings, alerts, p.To.Local().Format(time.RFC3339))
+		return
+	}
+	rec, err := executePurge(p, "cli", "prune -older-than "+*olderThan)
+	if err != nil {
+		log.Fatalf("Error pruning: %v", err)
+	}
+	audit(auditCLI, "", "data.purge", p.Sensor, rec, nil)
+	log.Printf("Deleted %d readings and %d alerts before %s", rec.Readings, rec.Alerts, p.To.Local().Format(time.RFC3339))
+}
+
+func statsCmd(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	today := fs.Bool("today", false, "summarise today since midnight")
+	since := fs.String("since", "24h", "summarise this far back, e.g. 24h or 7d")
+	sensor := fs.String("sensor", "", "only this sensor")
+	fs.Parse(args)
+
+	var start time.Time
+	if *today {
+		now := time.Now()
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	} else {
+		age, err := parseAge(*since)
+		if err != nil || age <= 0 {
+			fmt.Fprintf(os.Stderr, "-since must be a positive age such as 24h or 7d\n")
+			os.Exit(2)
+		}
+		start = time.Now().Add(-age)
+	}
+	st.open(false)
+
+	query := `SELECT sensor, COUNT(*), MIN(temperature), MAX(temperature), AVG(temperature), MAX(timestamp)
+		FROM temperature_readings WHERE timestamp >= ?`
+	queryArgs := []interface{}{sqliteTime(start)}
+	if *sensor != "" {
+		query += " AND sensor = ?"
+		queryArgs = append(queryArgs, *sensor)
+	}
+	rows, err := db.Query(query+" GROUP BY sensor ORDER BY sensor", queryArgs...)
+	if err != nil {
+		log.Fatalf("Error querying database: %v", err)
+	}
+	defer rows.Close()
+
+	fmt.Printf("Since %s\n\n", start.Format("2006-01-02 15:04"))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SENSOR\tREADINGS\tMIN\tMAX\tAVG\tLAST")
+	for rows.Next() {
+		var name, last string
+		var count int
+		var min, max, avg float64
+		if err := rows.Scan(&name, &count, &min, &max, &avg, &last); err != nil {
+			log.Fatalf("Error querying database: %v", err)
+		}
+		if t, err := parseSQLiteTime(last); err == nil {
+			last = t.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.1f\t%.1f\t%s\n", name, count, min, max, avg, last)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error querying database: %v", err)
+	}
+	tw.Flush()
+}
+
+func backupCmd(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	fs.Parse(args)
+	st.open(false)
+	if err := setupBackups(config().Backup, st.dbPath); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	info, err := createBackup()
+	if err != nil {
+		log.Fatalf("Error creating backup: %v", err)
+	}
+	log.Printf("Backed up %s to %s (%s)", strings.Join(info.Files, ", "), info.Name, info.Location)
+}
+
+// restoreCmd replaces the database with a backup. The current files are
+// kept with a .before-restore suffix, and purges made after the backup was
+// taken are applied to the restored data again, so deleted data does not
+// come back.
+func restoreCmd(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	list := fs.Bool("list", false, "list the available backups")
+	fromS3 := fs.Bool("s3", false, "download the named backup from the s3 bucket in the backup config")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: piheat restore [flags] <backup>\n\n<backup> is an archive path, or its name with -s3.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	log.SetFlags(0)
+	st.load()
+	if err := setupBackups(config().Backup, st.dbPath); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	if *list {
+		backups, err := listBackups()
+		if err != nil {
+			log.Fatalf("Error listing backups: %v", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTIME\tSIZE\tLOCATION")
+		for _, b := range backups {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", b.Name, b.Time.Local().Format("2006-01-02 15:04"), b.Size, b.Location)
+		}
+		tw.Flush()
+		return
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	archive := fs.Arg(0)
+
+	var err error
+	instanceLock, err = acquireInstanceLock(st.dbPath + ".lock")
+	if err != nil {
+		log.Fatalf("Error: %v; stop it first", err)
+	}
+	if *fromS3 {
+		if backups.cfg.S3 == nil {
+			log.Fatalf("Error: no s3 bucket in the backup config")
+		}
+		local := filepath.Join(backups.cfg.Dir, filepath.Base(archive))
+		if err := os.MkdirAll(backups.cfg.Dir, 0755); err != nil {
+			log.Fatalf("Error downloading backup: %v", err)
+		}
+		if err := backups.cfg.S3.getFile(backups.cfg.S3.Prefix+filepath.Base(archive), local); err != nil {
+			os.Remove(local)
+			log.Fatalf("Error downloading backup: %v", err)
+		}
+		archive = local
+	}
+	m, err := readBackupManifest(archive)
+	if err != nil {
+		log.Fatalf("Error reading backup: %v", err)
+	}
+	years := false
+	for _, name := range m.Files {
+		if _, err := restoreTarget(name, st.dbPath); err != nil {
+			log.Fatalf("Error reading backup: %v", err)
+		}
+		years = years || name != "temperature.db"
+	}
+
+	purges, err := purgesSince(st.dbPath, m.Created)
+	if err != nil {
+		log.Fatalf("Error reading purges from the current database: %v", err)
+	}
+	current, err := databaseFiles(st.dbPath)
+	if err != nil {
+		log.Fatalf("Error listing database files: %v", err)
+	}
+	for _, f := range current {
+		if err := os.Rename(f, f+".before-restore"); err != nil {
+			log.Fatalf("Error moving %s aside: %v", f, err)
+		}
+	}
+	if err := extractBackup(archive, st.dbPath); err != nil {
+		log.Fatalf("Error restoring backup: %v (the previous files end in .before-restore)", err)
+	}
+	log.Printf("Restored %s, taken %s", strings.Join(m.Files, ", "), m.Created.Local().Format("2006-01-02 15:04:05"))
+	if len(current) > 0 {
+		log.Printf("The previous database files were renamed to *.before-restore")
+	}
+
+	if years && !splitByYear {
+		splitByYear = true
+		log.Printf("The backup stores readings per year: start piheat with -split-by-year")
+	}
+	initDatabase(st.dbPath)
+	for _, p := range purges {
+		readings, alerts, err := reapplyPurge(p)
+		if err != nil {
+			log.Fatalf("Error re-applying purge %d: %v", p.ID, err)
+		}
+		log.Printf("Re-applied purge of %s: deleted %d readings and %d alerts again", p.PurgedAt.Local().Format("2006-01-02 15:04"), readings, alerts)
+	}
+}
+
+// userCmd manages the users who can log in to the dashboard. Passwords are
+// read from standard input, so they stay out of the shell history.
+func userCmd(args []string) {
+	fs := flag.NewFlagSet("user", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	role := fs.String("role", "", "role of the user: viewer or admin (add defaults to viewer)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: piheat user add|passwd|del [flags] <name>\n       piheat user list\n\n")
+		fs.PrintDefaults()
+	}
+	// Flags may come before or after the action
+	fs.Parse(args)
+	action := fs.Arg(0)
+	if fs.NArg() > 0 {
+		fs.Parse(fs.Args()[1:])
+	}
+	name := fs.Arg(0)
+	if action == "" || (action == "list" && fs.NArg() != 0) || (action != "list" && fs.NArg() != 1) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	st.open(action != "list")
+
+	switch action {
+	case "list":
+		users, err := listUsers()
+		if err != nil {
+			log.Fatalf("Error querying database: %v", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tROLE\tCREATED")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", u.Username, u.Role, u.CreatedAt.Local().Format("2006-01-02 15:04"))
+		}
+		tw.Flush()
+	case "add":
+		if *role == "" {
+			*role = roleViewer
+		}
+		u, err := createUser(name, readPassword(), *role)
+		if err != nil {
+			log.Fatalf("Error adding user: %v", err)
+		}
+		audit(auditCLI, "", "user.create", u.Username, nil, u)
+		log.Printf("Added %s user %s", u.Role, u.Username)
+	case "passwd":
+		password := readPassword()
+		var newRole *string
+		if *role != "" {
+			newRole = role
+		}
+		old, err := getUser(name)
+		if err != nil {
+			log.Fatalf("Error changing user: %v", err)
+		}
+		u, err := updateUser(name, &password, newRole)
+		if err != nil {
+			log.Fatalf("Error changing user: %v", err)
+		}
+		audit(auditCLI, "", "user.update", name, userAuditValue(old, false), userAuditValue(u, true))
+		log.Printf("Changed user %s", name)
+	case "del":
+		old, err := getUser(name)
+		if err == nil {
+			err = deleteUser(name)
+		}
+		if err != nil {
+			log.Fatalf("Error deleting user: %v", err)
+		}
+		audit(auditCLI, "", "user.delete", name, old, nil)
+		log.Printf("Deleted user %s", name)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// readPassword reads one line from standard input.
+func readPassword() string {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Error reading password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The clock tests step a ManualClock through days of retention, a
+// vacation's schedule and a frost event, against a scratch database so the
+// golden dataset stays as it is.
+
+// withScratchDatabase points db at an empty database for the test and at
+// the previous one again afterwards.
+func withScratchDatabase(t *testing.T) {
+	t.Helper()
+	prev := db
+	initDatabase(filepath.Join(t.TempDir(), "scratch.db"))
+	scratch := db
+	t.Cleanup(func() {
+		scratch.Close()
+		db = prev
+	})
+}
+
+// withManualClock runs the test on a ManualClock standing at start.
+func withManualClock(t *testing.T, start time.Time) *ManualClock {
+	t.Helper()
+	prev := clock
+	c := NewManualClock(start)
+	clock = c
+	t.Cleanup(func() { clock = prev })
+	return c
+}
+
+// waitTicked waits until the clock's only ticker has been started and its
+// tick, if any, taken by the loop, so the next Advance is not dropped.
+func waitTicked(t *testing.T, c *ManualClock) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		done := len(c.tickers) == 1 && len(c.tickers[0].c) == 0
+		c.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ticker not started or its tick not taken")
+		}
+	}
+}
+
+// waitReadings waits until sensor has want readings left.
+func waitReadings(t *testing.T, sensor string, want int) {
+	t.Helper()
+	var n int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if err := db.QueryRow("SELECT COUNT(*) FROM temperature_readings WHERE sensor = ?", sensor).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n == want {
+			return
+		}
+	}
+	t.Fatalf("%s has %d readings, want %d", sensor, n, want)
+}
+
+func TestManualClockTicker(t *testing.T) {
+	c := NewManualClock(goldenNow)
+	ticker := c.NewTicker(time.Hour)
+	c.Advance(30 * time.Minute)
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("ticked at %s before its interval", tick)
+	default:
+	}
+	// Like time.Ticker, ticks nobody takes are dropped, not queued
+	c.Advance(3 * time.Hour)
+	if tick := <-ticker.C(); !tick.Equal(goldenNow.Add(time.Hour)) {
+		t.Errorf("first tick at %s, want %s", tick, goldenNow.Add(time.Hour))
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("dropped tick at %s was queued", tick)
+	default:
+	}
+	if now := c.Now(); !now.Equal(goldenNow.Add(210 * time.Minute)) {
+		t.Errorf("clock at %s after advancing 3h30m, want %s", now, goldenNow.Add(210*time.Minute))
+	}
+
+	ticker.Reset(10 * time.Minute)
+	c.Advance(10 * time.Minute)
+	if tick := <-ticker.C(); !tick.Equal(goldenNow.Add(220 * time.Minute)) {
+		t.Errorf("tick after Reset at %s, want %s", tick, goldenNow.Add(220*time.Minute))
+	}
+	ticker.Stop()
+	c.Advance(time.Hour)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("stopped ticker ticked at %s", tick)
+	default:
+	}
+}
+
+// TestRetentionManualClock runs the hourly retention loop through a day
+// and checks readings go once they are older than retention_days, and
+// not before.
+func TestRetentionManualClock(t *testing.T) {
+	withScratchDatabase(t)
+	c := withManualClock(t, goldenNow)
+	config().RetentionDays = 7
+	defer func() { config().RetentionDays = 0 }()
+
+	for _, age := range []time.Duration{10 * 24 * time.Hour, 6 * 24 * time.Hour, time.Hour} {
+		if _, err := db.Exec("INSERT INTO temperature_readings (sensor, temperature, timestamp) VALUES ('attic', 12.5, ?)", sqliteTime(goldenNow.Add(-age))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go runRetention()
+	waitTicked(t, c)
+
+	c.Advance(time.Hour)
+	waitReadings(t, "attic", 2)
+
+	// The six-day-old reading is seven days old at the 24th tick, which
+	// leaves it; the 25th deletes it
+	for i := 0; i < 23; i++ {
+		waitTicked(t, c)
+		c.Advance(time.Hour)
+	}
+	waitTicked(t, c)
+	var purges int
+	if err := db.QueryRow("SELECT COUNT(*) FROM data_purges").Scan(&purges); err != nil {
+		t.Fatal(err)
+	}
+	if purges != 1 {
+		t.Errorf("%d purges after 24 hours, want 1 for the ten-day-old reading", purges)
+	}
+	c.Advance(time.Hour)
+	waitReadings(t, "attic", 1)
+
+	var purgedAt sql.NullString
+	if err := db.QueryRow("SELECT MAX(purged_at) FROM data_purges").Scan(&purgedAt); err != nil {
+		t.Fatal(err)
+	}
+	at, err := parseSQLiteTime(purgedAt.String)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := goldenNow.Add(25 * time.Hour); !at.Equal(want) {
+		t.Errorf("purge recorded at %s, want the clock's %s", at, want)
+	}
+}
+
+// TestVacationScheduleManualClock steps through a vacation: nothing before
+// it starts, frost protection while away, the pre-heat before the return
+// and the setpoints again once back.
+func TestVacationScheduleManualClock(t *testing.T) {
+	withScratchDatabase(t)
+	c := withManualClock(t, goldenNow)
+	prev := vacations
+	vacations = &vacationPlan{}
+	defer func() { vacations = prev }()
+
+	from, to := goldenNow.Add(2*time.Hour), goldenNow.Add(72*time.Hour)
+	if _, err := db.Exec("INSERT INTO vacations (starts_at, ends_at, temperature, preheat_seconds, actor, created_at) VALUES (?, ?, 10, ?, 'test', ?)",
+		sqliteTime(from), sqliteTime(to), int64((6 * time.Hour).Seconds()), sqliteTime(goldenNow)); err != nil {
+		t.Fatal(err)
+	}
+	if err := vacations.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		advance time.Duration
+		state   string
+	}{
+		{time.Hour, ""},
+		{time.Hour, vacationActive},
+		{48 * time.Hour, vacationActive},
+		{16 * time.Hour, vacationPreheating},
+		{5 * time.Hour, vacationPreheating},
+		{time.Hour, ""},
+	}
+	for _, s := range steps {
+		c.Advance(s.advance)
+		now := c.Now()
+		vacations.announce(now)
+		v, ok := vacations.at(now)
+		if v.State != s.state {
+			t.Errorf("at %s: vacation state %q (under way: %v), want %q", now.Sub(goldenNow), v.State, ok, s.state)
+		}
+	}
+	if len(vacations.list) != 0 {
+		t.Errorf("%d vacations kept after the return, want none", len(vacations.list))
+	}
+}
+
+// TestFrostWatchdogManualClock lets a freezing zone's sensor go quiet: the
+// zone keeps heating for frost protection, the watchdog lets its relay
+// through, and max_on still cuts it.
+func TestFrostWatchdogManualClock(t *testing.T) {
+	withScratchDatabase(t)
+	c := withManualClock(t, goldenNow)
+	h := &heaterCheck{name: "attic-heater", cfg: HeaterConfig{Type: "gpio", MaxOn: Duration{time.Hour}}}
+	r := &relayActuator{heater: h, want: make(chan relayRequest, 1), sensors: []string{"attic"}, interval: time.Minute}
+	z := &zoneState{name: "attic", cfg: ZoneConfig{Sensor: "attic", Heaters: []string{h.name}, Hysteresis: 0.3}, relays: []*relayActuator{r}}
+	loop := &controlLoop{zones: []*zoneState{z}, bySensor: map[string][]*zoneState{"attic": {z}}, byName: map[string]*zoneState{"attic": z},
+		interval: time.Minute, frost: FrostConfig{Threshold: 5, Hysteresis: 1}}
+	defer func() {
+		sensorsMonitor.mu.Lock()
+		delete(sensorsMonitor.sensors, "attic")
+		sensorsMonitor.mu.Unlock()
+	}()
+
+	sensorsMonitor.observe("attic", 3, "", c.Now())
+	loop.observe("attic", 3, c.Now())
+	// step ticks the loop and hands its request to the relay, as run does
+	step := func() (bool, string) {
+		now := c.Now()
+		loop.tick(now)
+		req := <-r.want
+		r.wantedAt = now
+		on, limit := r.limit(req.on, req.frost, now)
+		if on && !r.on {
+			r.onSince = now
+		}
+		r.on = on
+		return on, limit
+	}
+	if on, limit := step(); !on {
+		t.Fatalf("freezing zone not heated: %s", limit)
+	}
+
+	c.Advance(watchdogStale + time.Minute)
+	on, limit := step()
+	if !on {
+		t.Errorf("relay of a freezing zone forced off after its sensor went quiet: %s", limit)
+	}
+	if st := loop.statuses()[0]; !st.Heating || st.Reason != frostHeld {
+		t.Errorf("zone heating %v for %q, want heating for %q", st.Heating, st.Reason, frostHeld)
+	}
+	if on, _ := r.limit(true, false, c.Now()); on {
+		t.Error("watchdog let heat through a stale sensor outside frost protection")
+	}
+
+	c.Advance(time.Hour)
+	if on, limit := step(); on || !strings.HasPrefix(limit, "max_on") {
+		t.Errorf("relay %s (%q) after an hour on, want off by max_on", onOff(on), limit)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// comfortMaxBuckets bounds the strip, so a small bucket over a long
+	// window cannot ask for an enormous response.
+	comfortMaxBuckets = 2000
+	// comfortMaxHours is the longest window of a strip.
+	comfortMaxHours = 7 * 24
+)
+
+// ComfortBucket is one bucket of a zone's comfort strip: the average
+// temperature, the setpoint the zone was held at at the end of the bucket
+// and State, where
+// the one was against the comfort band around the other: below, within or
+// above, or unknown without readings or a setpoint.
+type ComfortBucket struct {
+	Start       time.Time `json:"start"`
+	UnixTime    int64     `json:"unixTime"`
+	State       string    `json:"state"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	Setpoint    *float64  `json:"setpoint,omitempty"`
+}
+
+// ComfortStrip is the GET /api/zones/{zone}/comfort response. The
+// percentages are of the buckets whose state is known.
+type ComfortStrip struct {
+	Zone          string          `json:"zone"`
+	Sensor        string          `json:"sensor"`
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	Bucket        Duration        `json:"bucket"`
+	Band          float64         `json:"band"`
+	BelowPercent  float64         `json:"belowPercent"`
+	WithinPercent float64         `json:"withinPercent"`
+	AbovePercent  float64         `json:"abovePercent"`
+	Buckets       []ComfortBucket `json:"buckets"`
+}
+
+// setpointChange is a zone's setpoint from at on; old is what it was
+// before, missing for the zone's first setpoint.
+type setpointChange struct {
+	at       time.Time
+	old, new *float64
+}
+
+// setpointHistory returns a zone's setpoint changes up to the given time,
+// oldest first, from the audit log.
+func setpointHistory(ctx context.Context, zone string, until time.Time) ([]setpointChange, error) {
+	rows, err := db.QueryContext(ctx, `SELECT timestamp, old_value, new_value FROM audit_log
+		WHERE action = 'setpoint.set' AND target = ? AND timestamp < ? ORDER BY timestamp, id`, zone, sqliteTime(until))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []setpointChange
+	for rows.Next() {
+		var at string
+		var oldValue, newValue sql.NullString
+		if err := rows.Scan(&at, &oldValue, &newValue); err != nil {
+			return nil, err
+		}
+		var c setpointChange
+		c.at, _ = parseSQLiteTime(at)
+		c.old, c.new = auditFloat(oldValue), auditFloat(newValue)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+func auditFloat(v sql.NullString) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v.String, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// setpointAt is the setpoint in effect at t. Before the first recorded
+// change it is what that change replaced; without any, current.
+func setpointAt(history []setpointChange, current *float64, t time.Time) *float64 {
+	if len(history) == 0 {
+		return current
+	}
+	i := sort.Search(len(history), func(i int) bool { return history[i].at.After(t) })
+	if i == 0 {
+		return history[0].old
+	}
+	return history[i-1].new
+}
+
+// setpointLayers is what else decided the setpoint a zone was held at
+// over a window, for working out that of a past moment the way
+// effectiveSetpoint does for now: the vacations, when the house was
+// away, and the zone's overrides from the audit log.
+type setpointLayers struct {
+	vacations []Vacation
+	// presence are the away mode's changes, oldest first.
+	presence  []presenceChange
+	overrides []overrideSpan
+}
+
+type presenceChange struct {
+	at   time.Time
+	away bool
+}
+
+// overrideSpan is an override from when it was set until it ran out or
+// was ended.
+type overrideSpan struct {
+	from, until time.Time
+	target      float64
+}
+
+func loadSetpointLayers(ctx context.Context, zone string, from, to time.Time) (setpointLayers, error) {
+	var l setpointLayers
+	var err error
+	l.vacations, err = scanVacations(ctx, to, "SELECT "+vacationColumns+" FROM vacations WHERE ends_at > ? AND starts_at < ? ORDER BY starts_at",
+		sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return l, err
+	}
+	if presence != nil {
+		rows, err := db.QueryContext(ctx, "SELECT mode, timestamp FROM presence_changes WHERE timestamp < ? ORDER BY timestamp, id", sqliteTime(to))
+		if err != nil {
+			return l, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var mode, ts string
+			if err := rows.Scan(&mode, &ts); err != nil {
+				return l, err
+			}
+			at, _ := parseSQLiteTime(ts)
+			l.presence = append(l.presence, presenceChange{at: at, away: mode == presenceAway})
+		}
+		if err := rows.Err(); err != nil {
+			return l, err
+		}
+	}
+
+	// An override covering from was set at most overrideMaxDuration before
+	rows, err := db.QueryContext(ctx, `SELECT action, timestamp, new_value FROM audit_log
+		WHERE action IN ('override.set', 'override.clear') AND target = ? AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id`, zone, sqliteTime(from.Add(-overrideMaxDuration)), sqliteTime(to))
+	if err != nil {
+		return l, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var action, ts string
+		var newValue sql.NullString
+		if err := rows.Scan(&action, &ts, &newValue); err != nil {
+			return l, err
+		}
+		at, _ := parseSQLiteTime(ts)
+		// A new override replaces the one before, as does ending it
+		if n := len(l.overrides); n > 0 && l.overrides[n-1].until.After(at) {
+			l.overrides[n-1].until = at
+		}
+		var o ZoneOverride
+		if action == "override.set" && newValue.Valid && json.Unmarshal([]byte(newValue.String), &o) == nil {
+			l.overrides = append(l.overrides, overrideSpan{from: at, until: o.Until, target: o.Target})
+		}
+	}
+	return l, rows.Err()
+}
+
+// at is the setpoint the zone was held at, at t, from its own setpoint
+// then: lowered by a vacation and while away, and replaced by an
+// override. A heating curve is not applied.
+func (l setpointLayers) at(z *zoneState, setpoint *float64, t time.Time) *float64 {
+	sp := setpoint
+	if sp != nil {
+		v := *sp
+		preheating := false
+		for _, vac := range l.vacations {
+			switch vac.state(t) {
+			case vacationActive:
+				v = math.Min(v, vac.Temperature)
+			case vacationPreheating:
+				preheating = true
+			}
+		}
+		// Nobody is home yet while pre-heating for the return
+		i := sort.Search(len(l.presence), func(i int) bool { return l.presence[i].at.After(t) })
+		if i > 0 && l.presence[i-1].away && !preheating {
+			v = math.Min(v, presence.setback(z.name))
+		}
+		sp = &v
+	}
+	for _, o := range l.overrides {
+		if !t.Before(o.from) && t.Before(o.until) {
+			target := o.target
+			sp = &target
+		}
+	}
+	return sp
+}
+
+// comfortState places a temperature against the band around the setpoint.
+func comfortState(temp, setpoint, band float64) string {
+	switch {
+	case temp < setpoint-band:
+		return "below"
+	case temp > setpoint+band:
+		return "above"
+	}
+	return "within"
+}
+
+// comfortStrip works out a zone's comfort over the hours up to now.
+func comfortStrip(ctx context.Context, z *zoneState, hours int, bucket time.Duration, now time.Time) (ComfortStrip, error) {
+	// Buckets start on multiples of their length since the Unix epoch, as
+	// the query groups them, and the last one holds now
+	step := int64(bucket / time.Second)
+	to := time.Unix((now.Unix()/step+1)*step, 0)
+	n := int64(hours) * 3600 / step
+	if n < 1 {
+		n = 1
+	}
+	from := to.Add(-time.Duration(n*step) * time.Second)
+	s := ComfortStrip{Zone: z.name, Sensor: z.cfg.Sensor, From: from.UTC(), To: to.UTC(), Bucket: Duration{bucket},
+		Band: z.cfg.ComfortBand, Buckets: []ComfortBucket{}}
+
+	rows, err := db.QueryContext(ctx, `SELECT CAST(strftime('%s', timestamp) AS INTEGER) / ? AS b, AVG(temperature)
+		FROM temperature_readings WHERE sensor = ? AND timestamp >= ? AND timestamp < ? GROUP BY b`,
+		step, z.cfg.Sensor, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	temps := map[int64]float64{}
+	for rows.Next() {
+		var b int64
+		var v float64
+		if err := rows.Scan(&b, &v); err != nil {
+			return s, err
+		}
+		temps[b*step] = v
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+
+	history, err := setpointHistory(ctx, z.name, to)
+	if err != nil {
+		return s, err
+	}
+	layers, err := loadSetpointLayers(ctx, z.name, from, to)
+	if err != nil {
+		return s, err
+	}
+	var current *float64
+	if sp, err := getSetpoint(z.name); err == nil {
+		current = &sp.Temperature
+	} else if err != sql.ErrNoRows {
+		return s, err
+	}
+
+	counts := map[string]int{}
+	known := 0
+	for start := from; start.Before(to); start = start.Add(bucket) {
+		b := ComfortBucket{Start: start.UTC(), UnixTime: start.Unix(), State: "unknown"}
+		if t, ok := temps[start.Unix()]; ok {
+			t = roundReading(z.cfg.Sensor, t)
+			b.Temperature = &t
+		}
+		end := start.Add(bucket)
+		if end.After(now) {
+			end = now
+		}
+		b.Setpoint = layers.at(z, setpointAt(history, current, end), end)
+		if b.Temperature != nil && b.Setpoint != nil {
+			b.State = comfortState(*b.Temperature, *b.Setpoint, z.cfg.ComfortBand)
+			counts[b.State]++
+			known++
+		}
+		s.Buckets = append(s.Buckets, b)
+	}
+	if known > 0 {
+		s.BelowPercent = 100 * float64(counts["below"]) / float64(known)
+		s.WithinPercent = 100 * float64(counts["within"]) / float64(known)
+		s.AbovePercent = 100 * float64(counts["above"]) / float64(known)
+	}
+	return s, nil
+}
+
+// zoneHandler serves the /api/zones/{zone}/ endpoints.
+func zoneHandler(w http.ResponseWriter, r *http.Request) {
+	zone, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/zones/"), "/")
+	z, ok := controller.byName[zone]
+	switch {
+	case ok && rest == "comfort":
+		zoneComfortHandler(w, r, z)
+	case ok && rest == "override":
+		zoneOverrideHandler(w, r, z)
+	case ok && rest == "autotune":
+		zoneAutotuneHandler(w, r, z)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// zoneComfortHandler serves GET /api/zones/{zone}/comfort.
+func zoneComfortHandler(w http.ResponseWriter, r *http.Request, z *zoneState) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	hours := 24
+	if v := q.Get("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > comfortMaxHours {
+			http.Error(w, fmt.Sprintf("hours must be between 1 and %d", comfortMaxHours), http.StatusBadRequest)
+			return
+		}
+		hours = n
+	}
+	bucket := 15 * time.Minute
+	if v := q.Get("bucket"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute || d%time.Minute != 0 {
+			http.Error(w, "bucket must be a whole number of minutes, such as 15m", http.StatusBadRequest)
+			return
+		}
+		bucket = d
+	}
+	if time.Duration(hours)*time.Hour/bucket > comfortMaxBuckets {
+		http.Error(w, fmt.Sprintf("At most %d buckets; use a larger bucket", comfortMaxBuckets), http.StatusBadRequest)
+		return
+	}
+	s, err := comfortStrip(r.Context(), z, hours, bucket, clock.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ComparePoint is one bucket of a compared range. Offset is the bucket's
+// start in seconds from the start of its range, so the buckets of both
+// ranges line up; Label is the time of the current range at that offset.
+type ComparePoint struct {
+	Offset      int64   `json:"offset"`
+	Label       string  `json:"label"`
+	Temperature float64 `json:"temperature"`
+}
+
+// CompareRange is one of the two ranges of a comparison.
+type CompareRange struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Points []ComparePoint `json:"points"`
+}
+
+// ChartComparison is /api/chart-data with compare: the period so far and
+// the one it is compared against, averaged into the same buckets.
+type ChartComparison struct {
+	Sensor   string       `json:"sensor"`
+	Period   string       `json:"period"`
+	Compare  string       `json:"compare"`
+	Bucket   Duration     `json:"bucket"`
+	Current  CompareRange `json:"current"`
+	Previous CompareRange `json:"previous"`
+}
+
+// compareBuckets is the bucket of each period that can be compared.
+var compareBuckets = map[string]time.Duration{
+	"day":   15 * time.Minute,
+	"week":  time.Hour,
+	"month": 6 * time.Hour,
+}
+
+// compareStart is the local start of the day, week (from Monday) or month
+// holding now.
+func compareStart(period string, now time.Time) time.Time {
+	now = now.In(time.Local)
+	y, m, d := now.Date()
+	switch period {
+	case "week":
+		return time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, time.Local)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.Local)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// shiftPeriod moves a start by n periods; calendar arithmetic keeps it at
+// local midnight across daylight saving changes.
+func shiftPeriod(t time.Time, period string, n int) time.Time {
+	switch period {
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "month":
+		return t.AddDate(0, n, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
+
+// compareAgainst is the start of the range the one starting at start is
+// compared against: the previous period, the same weekday a week earlier
+// or the same period a year earlier.
+func compareAgainst(period, against string, start time.Time) (time.Time, error) {
+	switch against {
+	case "previous":
+		return shiftPeriod(start, period, -1), nil
+	case "week":
+		if period != "day" {
+			return time.Time{}, fmt.Errorf("compare=week is for period=day")
+		}
+		return start.AddDate(0, 0, -7), nil
+	case "year":
+		return start.AddDate(-1, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("compare must be previous, week or year")
+}
+
+// compareLabel labels an offset of the current range.
+func compareLabel(period string, at time.Time) string {
+	switch period {
+	case "week":
+		return at.Format("Mon 15:04")
+	case "month":
+		return at.Format("02 15:04")
+	}
+	return at.Format("15:04")
+}
+
+// compareRange averages a sensor's readings between from and to into
+// buckets counted from from. The labels come from the current range,
+// starting at labelFrom.
+func compareRange(ctx context.Context, sensor, period string, from, to, labelFrom time.Time, bucket time.Duration) (CompareRange, error) {
+	defer timeQuery("compare")()
+	cr := CompareRange{From: from.UTC(), To: to.UTC(), Points: []ComparePoint{}}
+	step := int64(bucket / time.Second)
+	rows, err := db.QueryContext(ctx, `SELECT (CAST(strftime('%s', timestamp) AS INTEGER) - ?) / ? AS b, AVG(temperature)
+		FROM temperature_readings WHERE sensor = ? AND timestamp >= ? AND timestamp < ? GROUP BY b ORDER BY b`,
+		from.Unix(), step, sensor, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return cr, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b int64
+		var v float64
+		if err := rows.Scan(&b, &v); err != nil {
+			return cr, err
+		}
+		offset := b * step
+		cr.Points = append(cr.Points, ComparePoint{
+			Offset:      offset,
+			Label:       compareLabel(period, labelFrom.Add(time.Duration(offset)*time.Second)),
+			Temperature: roundReading(sensor, v),
+		})
+	}
+	return cr, rows.Err()
+}
+
+// chartComparison compares a sensor's period so far with an earlier one.
+// The earlier range is complete; the current one ends at now.
+func chartComparison(ctx context.Context, sensor, period, against string, now time.Time) (ChartComparison, error) {
+	c := ChartComparison{Sensor: sensor, Period: period, Compare: against}
+	bucket, ok := compareBuckets[period]
+	if !ok {
+		return c, fmt.Errorf("compare is for period day, week or month")
+	}
+	c.Bucket = Duration{bucket}
+	start := compareStart(period, now)
+	prevStart, err := compareAgainst(period, against, start)
+	if err != nil {
+		return c, err
+	}
+	if c.Current, err = compareRange(ctx, sensor, period, start, now, start, bucket); err != nil {
+		return c, err
+	}
+	c.Current.To = shiftPeriod(start, period, 1).UTC()
+	c.Previous, err = compareRange(ctx, sensor, period, prevStart, shiftPeriod(prevStart, period, 1), start, bucket)
+	return c, err
+}
+
+// chartComparisonHandler serves /api/chart-data with compare.
+func chartComparisonHandler(w http.ResponseWriter, r *http.Request, sensor, period, against string) {
+	if _, ok := compareBuckets[period]; !ok {
+		http.Error(w, "compare is for period day, week or month", http.StatusBadRequest)
+		return
+	}
+	if _, err := compareAgainst(period, against, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := chartComparison(r.Context(), sensor, period, against, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, c)
+}
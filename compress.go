@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig sets how responses are compressed for clients that
+// accept gzip or deflate. Level 0 turns compression off. Responses smaller
+// than min_bytes, or of a type not in types, are sent as they are.
+type CompressionConfig struct {
+	Level    int      `json:"level"`
+	MinBytes int      `json:"min_bytes"`
+	Types    []string `json:"types"`
+}
+
+func (c CompressionConfig) check() error {
+	if c.Level < 0 || c.Level > 9 {
+		return fmt.Errorf("level must be 0 to 9")
+	}
+	if c.MinBytes < 0 {
+		return fmt.Errorf("min_bytes must not be negative")
+	}
+	return nil
+}
+
+// defaultCompressedTypes are the text formats piheat serves; images other
+// than SVG and PDFs are compressed already.
+var defaultCompressedTypes = []string{
+	"text/html", "text/css", "text/plain", "text/csv", "text/xml",
+	"text/javascript", "application/javascript", "application/json",
+	"application/xml", "application/rss+xml", "image/svg+xml",
+}
+
+func (c CompressionConfig) compresses(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.Types {
+		if t == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncoding picks gzip or deflate from the request's
+// Accept-Encoding, preferring gzip, or "" for neither.
+func acceptedEncoding(r *http.Request) string {
+	deflate := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip":
+			return "gzip"
+		case "deflate":
+			deflate = true
+		}
+	}
+	if deflate {
+		return "deflate"
+	}
+	return ""
+}
+
+// Compressors are pooled per encoding and level: each holds the
+// compression window, which is too large to allocate per response on a
+// Pi.
+var (
+	gzipPools    [10]sync.Pool
+	deflatePools [10]sync.Pool
+)
+
+type resetWriteCloser interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+func getCompressor(encoding string, level int, w io.Writer) resetWriteCloser {
+	pools := &gzipPools
+	if encoding == "deflate" {
+		pools = &deflatePools
+	}
+	if c, ok := pools[level].Get().(resetWriteCloser); ok {
+		c.Reset(w)
+		return c
+	}
+	if encoding == "deflate" {
+		c, _ := zlib.NewWriterLevel(w, level)
+		return c
+	}
+	c, _ := gzip.NewWriterLevel(w, level)
+	return c
+}
+
+func putCompressor(encoding string, level int, c resetWriteCloser) {
+	if encoding == "deflate" {
+		deflatePools[level].Put(c)
+	} else {
+		gzipPools[level].Put(c)
+	}
+}
+
+// compressWriter holds a response back until min_bytes have been written
+// or the handler returns, then sends it compressed if it qualifies.
+type compressWriter struct {
+	http.ResponseWriter
+	conf     CompressionConfig
+	encoding string
+	status   int
+	buf      bytes.Buffer
+	decided  bool
+	c        resetWriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		if cw.c != nil {
+			return cw.c.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf.Write(p)
+	if cw.buf.Len() >= cw.conf.MinBytes {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the header, compressed when big says the response reached
+// min_bytes and its status and type allow it, followed by what was held
+// back.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(cw.buf.Bytes()))
+	}
+	if big && cw.status == http.StatusOK && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		cw.conf.compresses(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		// The compressed bytes differ from the ones the validator was
+		// made for
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		h.Add("Vary", "Accept-Encoding")
+		h.Del("Content-Length")
+		cw.c = getCompressor(cw.encoding, cw.conf.Level, cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.c != nil {
+		_, err = cw.c.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+// finish sends a response that stayed under min_bytes and ends the
+// compressed stream.
+func (cw *compressWriter) finish() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// The handler wrote nothing; net/http sends its 200
+			return
+		}
+		cw.decide(false)
+	}
+	if cw.c != nil {
+		cw.c.Close()
+		putCompressor(cw.encoding, cw.conf.Level, cw.c)
+	}
+}
+
+// compress compresses responses as set by compression. The config is read
+// per request, so reloads apply at once.
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := config().Compression
+		encoding := acceptedEncoding(r)
+		if conf.Level == 0 || encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, conf: conf, encoding: encoding}
+		defer cw.finish()
+		h.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duration wraps time.Duration so it can be written as "30s" or "5m" in
+// JSON config files and API payloads.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5m\": %v", err)
+	}
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type NotifierConfig struct {
+	Type     string            `json:"type"`
+	URL      string            `json:"url,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Token    string            `json:"token,omitempty"`
+	User     string            `json:"user,omitempty"`
+	Topic    string            `json:"topic,omitempty"`
+	Priority *int              `json:"priority,omitempty"`
+}
+
+type ForwarderConfig struct {
+	Type     string   `json:"type"`
+	Interval Duration `json:"interval"`
+	Sensors  []string `json:"sensors,omitempty"`
+	Server   string   `json:"server,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	APIKey   string   `json:"api_key,omitempty"`
+	Node     string   `json:"node,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Token    string   `json:"token,omitempty"`
+
+	Inputs map[string]EmonCMSInput `json:"inputs,omitempty"`
+	Idx    map[string]int          `json:"idx,omitempty"`
+	Items  map[string]string       `json:"items,omitempty"`
+}
+
+// GraphiteConfig maps metrics received as Graphite or collectd lines to
+// sensors. Keys of Sensors are metric names or globs; an empty value keeps
+// the metric name. Without any mapping every metric is accepted.
+type GraphiteConfig struct {
+	Listen  string            `json:"listen"`
+	UDP     bool              `json:"udp,omitempty"`
+	Sensors map[string]string `json:"sensors,omitempty"`
+}
+
+// SyslogConfig turns matching syslog messages into readings.
+type SyslogConfig struct {
+	Listen string       `json:"listen"`
+	TCP    bool         `json:"tcp,omitempty"`
+	Rules  []SyslogRule `json:"rules"`
+}
+
+// SyslogRule extracts a reading from messages matching Pattern. Sensor may
+// refer to capture groups as ${name} or $1. Host (a glob) and Program
+// restrict the rule to messages from one device or process.
+type SyslogRule struct {
+	Pattern string `json:"pattern"`
+	Sensor  string `json:"sensor"`
+	Host    string `json:"host,omitempty"`
+	Program string `json:"program,omitempty"`
+}
+
+// MQTTConfig is the broker used by the MQTT integrations.
+type MQTTConfig struct {
+	Broker   string `json:"broker"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// HeaterConfig is a smart plug switching a heater, read over HTTP (URL) or
+// MQTT (Topic). OnWatts is the least power expected while the relay is on,
+// OffWatts the most tolerated while it is off. Watts is the heater's rated
+// power, for estimating its energy use. MaxOn and MinCycle are the safety
+// limits of the relay when the control loop switches it.
+type HeaterConfig struct {
+	Type     string `json:"type"`
+	URL      string `json:"url,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Pin is the GPIO line of a relay on the Pi itself, see GPIOConfig.
+	Pin       *int `json:"pin,omitempty"`
+	ActiveLow bool `json:"active_low,omitempty"`
+	// Switch and PowerSensor are the object IDs of an ESPHome device's
+	// relay and power sensor.
+	Switch      string   `json:"switch,omitempty"`
+	PowerSensor string   `json:"power_sensor,omitempty"`
+	Interval    Duration `json:"interval"`
+	OnWatts     float64  `json:"on_watts,omitempty"`
+	OffWatts    float64  `json:"off_watts,omitempty"`
+	Grace       Duration `json:"grace"`
+	Notifiers   []string `json:"notifiers,omitempty"`
+	Watts       float64  `json:"watts,omitempty"`
+	MaxOn       Duration `json:"max_on"`
+	MinCycle    Duration `json:"min_cycle"`
+}
+
+// TRVConfig is a smart radiator valve paired with zigbee2mqtt, which
+// publishes its state on Topic and takes commands on Topic/set. Its
+// local temperature is recorded as Sensor (default the TRV's name). In
+// "setpoint" mode (the default) the valve gets the zone's setpoint and
+// regulates itself; in "valve" mode it is opened and closed like a relay.
+// The properties default to zigbee2mqtt's current_heating_setpoint and
+// position. Watts is the radiator's output fully open, for estimating its
+// energy use.
+type TRVConfig struct {
+	Topic            string  `json:"topic"`
+	Sensor           string  `json:"sensor,omitempty"`
+	Mode             string  `json:"mode,omitempty"`
+	SetpointProperty string  `json:"setpoint_property,omitempty"`
+	PositionProperty string  `json:"position_property,omitempty"`
+	Watts            float64 `json:"watts,omitempty"`
+}
+
+// ZoneConfig is a heating zone: the sensor that measures it and the
+// heaters and TRVs, by name, that warm it. Heaters switch on below
+// setpoint minus Hysteresis and off at the setpoint. A zone heated by a shared boiler
+// names it in Boiler; its heaters are then the valves letting the boiler's
+// water in, Priority orders it against the boiler's other zones and Flow
+// is its share of the flow through the boiler (default 1). ComfortBand is
+// how far either side of the setpoint the zone still counts as
+// comfortable (default 1°C). Curve compensates the setpoint for the outdoor
+// temperature.
+type ZoneConfig struct {
+	Sensor      string        `json:"sensor"`
+	Heaters     []string      `json:"heaters"`
+	TRVs        []string      `json:"trvs,omitempty"`
+	Hysteresis  float64       `json:"hysteresis,omitempty"`
+	Boiler      string        `json:"boiler,omitempty"`
+	Priority    int           `json:"priority,omitempty"`
+	Flow        float64       `json:"flow,omitempty"`
+	ComfortBand float64       `json:"comfort_band,omitempty"`
+	Curve       *HeatingCurve `json:"curve,omitempty"`
+	PID         *PIDConfig    `json:"pid,omitempty"`
+}
+
+// BoilerConfig is a heat source shared by several zones: Heater, by name,
+// switches it, and it fires while any of its zones calls for heat.
+// MaxZones limits the zones it serves at once, by priority; MinFlow is the
+// flow, in the units of the zones' Flow, it needs to fire safely, made up
+// by opening the valves of further zones when the calling ones are not
+// enough. A boiler behind an OpenTherm gateway is sent a water temperature
+// between MinWater and MaxWater, WaterGain higher per degree its coldest
+// zone is below target.
+type BoilerConfig struct {
+	Heater    string  `json:"heater"`
+	MaxZones  int     `json:"max_zones,omitempty"`
+	MinFlow   float64 `json:"min_flow,omitempty"`
+	MinWater  float64 `json:"min_water,omitempty"`
+	MaxWater  float64 `json:"max_water,omitempty"`
+	WaterGain float64 `json:"water_gain,omitempty"`
+}
+
+// ThresholdConfig sets where the dashboard shows the CPU temperature as a
+// warning or critical, in °C.
+type ThresholdConfig struct {
+	Warning  float64 `json:"warning"`
+	Critical float64 `json:"critical"`
+}
+
+type StalenessConfig struct {
+	Factor    float64  `json:"factor"`
+	Notifiers []string `json:"notifiers"`
+}
+
+type Config struct {
+	PublicURL           string                      `json:"public_url"`
+	BasePath            string                      `json:"base_path"`
+	URLSigningKey       string                      `json:"url_signing_key"`
+	AdminToken          string                      `json:"admin_token"`
+	SessionLifetime     Duration                    `json:"session_lifetime"`
+	SignedURLTTL        Duration                    `json:"signed_url_ttl"`
+	SampleInterval      Duration                    `json:"sample_interval"`
+	Thresholds          ThresholdConfig             `json:"thresholds"`
+	Units               string                      `json:"units"`
+	RetentionDays       int                         `json:"retention_days"`
+	AlertRepeatInterval Duration                    `json:"alert_repeat_interval"`
+	Notifiers           map[string]NotifierConfig   `json:"notifiers"`
+	Forwarders          map[string]ForwarderConfig  `json:"forwarders"`
+	Staleness           StalenessConfig             `json:"staleness"`
+	Frost               FrostConfig                 `json:"frost"`
+	Graphite            *GraphiteConfig             `json:"graphite"`
+	Syslog              *SyslogConfig               `json:"syslog"`
+	MQTT                *MQTTConfig                 `json:"mqtt"`
+	Heaters             map[string]HeaterConfig     `json:"heaters"`
+	GPIO                GPIOConfig                  `json:"gpio"`
+	Simulation          SimulationConfig            `json:"simulation"`
+	TRVs                map[string]TRVConfig        `json:"trvs"`
+	Zones               map[string]ZoneConfig       `json:"zones"`
+	Boilers             map[string]BoilerConfig     `json:"boilers"`
+	ControlInterval     Duration                    `json:"control_interval"`
+	Precision           map[string]PrecisionConfig  `json:"precision"`
+	Validation          map[string]ValidationConfig `json:"validation"`
+	WebPush             WebPushConfig               `json:"web_push"`
+	Theme               ThemeConfig                 `json:"theme"`
+	SelfTest            SelfTestConfig              `json:"self_test"`
+	OutdoorSensor       string                      `json:"outdoor_sensor"`
+	EnergyPrice         float64                     `json:"energy_price"`
+	Currency            string                      `json:"currency"`
+	Tariff              []TariffBand                `json:"tariff"`
+	Backup              *BackupConfig               `json:"backup"`
+	Archive             *S3Config                   `json:"archive"`
+	MaintenanceInterval Duration                    `json:"maintenance_interval"`
+	DiskGuard           DiskGuardConfig             `json:"disk_guard"`
+	RiseAlert           RiseAlertConfig             `json:"rise_alert"`
+	RateLimit           RateLimitConfig             `json:"rate_limit"`
+	HTTP                HTTPConfig                  `json:"http"`
+	Debug               DebugConfig                 `json:"debug"`
+	Compression         CompressionConfig           `json:"compression"`
+	CORS                CORSConfig                  `json:"cors"`
+	Ingest              map[string]IngestConfig     `json:"ingest"`
+	Failover            *FailoverConfig             `json:"failover"`
+	MDNS                *MDNSConfig                 `json:"mdns"`
+	Season              *SeasonConfig               `json:"season"`
+	Presence            *PresenceConfig             `json:"presence"`
+	Derived             map[string]DerivedConfig    `json:"derived"`
+	Pressure            map[string]PressureConfig   `json:"pressure"`
+	OneWire             *OneWireConfig              `json:"onewire"`
+	PowerFailure        *PowerFailureConfig         `json:"power_failure"`
+	Weather             *WeatherConfig              `json:"weather"`
+	LandingView         string                      `json:"landing_view"`
+	AggregateCacheTTL   Duration                    `json:"aggregate_cache_ttl"`
+}
+
+var (
+	cfgMu sync.RWMutex
+	cfg   = defaultConfig()
+)
+
+// config is the running config. Reloads swap it for a new one rather than
+// change it, so callers may keep what they got for as long as they need a
+// consistent view, but should call config again for the next.
+func config() *Config {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return cfg
+}
+
+// setConfig makes c the running config.
+func setConfig(c *Config) {
+	cfgMu.Lock()
+	cfg = c
+	cfgMu.Unlock()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		SampleInterval:      Duration{time.Minute},
+		Thresholds:          ThresholdConfig{Warning: 60, Critical: 75},
+		Units:               "celsius",
+		LandingView:         viewCharts,
+		Theme:               ThemeConfig{Mode: themeLight, Accent: defaultAccent},
+		AlertRepeatInterval: Duration{time.Hour},
+		SignedURLTTL:        Duration{24 * time.Hour},
+		SessionLifetime:     Duration{30 * 24 * time.Hour},
+		ControlInterval:     Duration{10 * time.Second},
+		MaintenanceInterval: Duration{7 * 24 * time.Hour},
+		Notifiers:           map[string]NotifierConfig{},
+		Staleness:           StalenessConfig{Factor: 3, Notifiers: []string{"log"}},
+		DiskGuard:           DiskGuardConfig{MinFreeMB: 100, TargetFreeMB: 200, KeepDays: 7},
+		RiseAlert:           RiseAlertConfig{PerMinute: 10, Exclude: []string{"cpu"}},
+		RateLimit:           RateLimitConfig{Burst: 20},
+		Compression:         CompressionConfig{Level: 5, MinBytes: 1024, Types: defaultCompressedTypes},
+		AggregateCacheTTL:   Duration{time.Minute},
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: Duration{10 * time.Second},
+			ReadTimeout:       Duration{time.Minute},
+			WriteTimeout:      Duration{5 * time.Minute},
+			IdleTimeout:       Duration{2 * time.Minute},
+			RequestTimeout:    Duration{time.Minute},
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "If-None-Match"},
+			MaxAge:         Duration{10 * time.Minute},
+		},
+	}
+}
+
+// loadConfig reads the JSON config file at path on top of the defaults.
+// A missing file is not an error so piheat keeps working without one.
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// check validates the options that need no other part of piheat, for the
+// config file and for settings stored on top of it.
+func (c *Config) check() error {
+	if c.SampleInterval.Duration <= 0 {
+		return fmt.Errorf("sample_interval must be positive")
+	}
+	if c.Thresholds.Warning >= c.Thresholds.Critical {
+		return fmt.Errorf("thresholds.warning must be below thresholds.critical")
+	}
+	if c.Units != "celsius" && c.Units != "fahrenheit" {
+		return fmt.Errorf("units must be celsius or fahrenheit")
+	}
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+	if c.SessionLifetime.Duration <= 0 {
+		return fmt.Errorf("session_lifetime must be positive")
+	}
+	if c.ControlInterval.Duration <= 0 {
+		return fmt.Errorf("control_interval must be positive")
+	}
+	if c.MaintenanceInterval.Duration < 0 {
+		return fmt.Errorf("maintenance_interval must not be negative")
+	}
+	if c.AggregateCacheTTL.Duration < 0 {
+		return fmt.Errorf("aggregate_cache_ttl must not be negative")
+	}
+	if strings.ContainsAny(c.BasePath, "?#") {
+		return fmt.Errorf("base_path must be a path like /piheat")
+	}
+	if err := c.DiskGuard.check(); err != nil {
+		return fmt.Errorf("disk_guard: %v", err)
+	}
+	if err := c.RiseAlert.check(); err != nil {
+		return fmt.Errorf("rise_alert: %v", err)
+	}
+	if err := c.RateLimit.check(); err != nil {
+		return fmt.Errorf("rate_limit: %v", err)
+	}
+	if err := c.HTTP.check(); err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	if err := c.Compression.check(); err != nil {
+		return fmt.Errorf("compression: %v", err)
+	}
+	if err := c.CORS.check(); err != nil {
+		return fmt.Errorf("cors: %v", err)
+	}
+	if err := c.WebPush.check(); err != nil {
+		return fmt.Errorf("web_push: %v", err)
+	}
+	if err := c.Theme.check(); err != nil {
+		return fmt.Errorf("theme: %v", err)
+	}
+	for name, ic := range c.Ingest {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("ingest: device %q: name must be non-empty and without '/'", name)
+		}
+		if err := ic.check(); err != nil {
+			return fmt.Errorf("ingest: device %q: %v", name, err)
+		}
+	}
+	if c.MDNS != nil {
+		if err := c.MDNS.check(); err != nil {
+			return fmt.Errorf("mdns: %v", err)
+		}
+	}
+	if c.EnergyPrice < 0 {
+		return fmt.Errorf("energy_price must not be negative")
+	}
+	if len(c.Tariff) > 0 {
+		if c.EnergyPrice == 0 {
+			return fmt.Errorf("tariff needs energy_price, the price outside its bands")
+		}
+		if _, err := compileTariff(c.Tariff); err != nil {
+			return fmt.Errorf("tariff: %v", err)
+		}
+	}
+	if !dashboardViews[c.LandingView] {
+		return fmt.Errorf("landing_view must be charts, zones or summary")
+	}
+	if c.Weather != nil {
+		if err := c.Weather.check(); err != nil {
+			return fmt.Errorf("weather: %v", err)
+		}
+		if c.OutdoorSensor == "" {
+			c.OutdoorSensor = c.Weather.Sensor
+		}
+	}
+	for name, z := range c.Zones {
+		if z.Curve != nil && c.OutdoorSensor == "" {
+			return fmt.Errorf("zone %q: curve needs outdoor_sensor or weather", name)
+		}
+	}
+	for name, p := range c.Pressure {
+		if err := p.check(); err != nil {
+			return fmt.Errorf("pressure %q: %v", name, err)
+		}
+		c.Pressure[name] = p
+	}
+	if c.OneWire != nil {
+		if err := c.OneWire.check(c.SampleInterval.Duration); err != nil {
+			return fmt.Errorf("onewire: %v", err)
+		}
+	}
+	if err := checkDerived(c.Derived); err != nil {
+		return fmt.Errorf("derived: %v", err)
+	}
+	if c.Season != nil {
+		if err := c.Season.check(c.OutdoorSensor); err != nil {
+			return fmt.Errorf("season: %v", err)
+		}
+	}
+	if c.Presence != nil {
+		if err := c.Presence.check(); err != nil {
+			return fmt.Errorf("presence: %v", err)
+		}
+	}
+	if c.Archive != nil {
+		if err := c.Archive.check(); err != nil {
+			return fmt.Errorf("archive: %v", err)
+		}
+	}
+	if err := checkValidation(c.Validation); err != nil {
+		return err
+	}
+	if err := checkPrecision(c.Precision); err != nil {
+		return err
+	}
+	if c.Staleness.Factor < 1 {
+		return fmt.Errorf("staleness.factor must be at least 1")
+	}
+	if err := c.Frost.check(); err != nil {
+		return fmt.Errorf("frost: %v", err)
+	}
+	if err := c.GPIO.check(); err != nil {
+		return fmt.Errorf("gpio: %v", err)
+	}
+	if err := c.Simulation.check(c.Zones); err != nil {
+		return fmt.Errorf("simulation: %v", err)
+	}
+	if c.Notifiers == nil {
+		c.Notifiers = map[string]NotifierConfig{}
+	}
+	return nil
+}
+
+// cloneConfig returns a deep copy of c, so settings can be applied on top
+// of the config file without changing it.
+func cloneConfig(c *Config) *Config {
+	data, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	clone := &Config{}
+	if err := json.Unmarshal(data, clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
@@ -0,0 +1,818 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// controlDeadline is how long one pass over the zones may take. The
+	// pass only compares numbers held in memory, so anything close to
+	// this means the process is starved.
+	controlDeadline = 500 * time.Millisecond
+	// controlStale is how old a zone's reading may be before its heaters
+	// are switched off for lack of information.
+	controlStale = 5 * time.Minute
+	// relayEnforce is how often a relay that reports the wrong state is
+	// switched again.
+	relayEnforce = time.Minute
+)
+
+// ZoneStatus is what /api/zones reports for each heating zone.
+type ZoneStatus struct {
+	Zone          string        `json:"zone"`
+	Sensor        string        `json:"sensor"`
+	Temperature   *float64      `json:"temperature,omitempty"`
+	TemperatureAt *time.Time    `json:"temperatureAt,omitempty"`
+	Setpoint      *float64      `json:"setpoint,omitempty"`
+	Target        *float64      `json:"target,omitempty"`
+	Demand        bool          `json:"demand"`
+	Heating       bool          `json:"heating"`
+	ValveOpen     bool          `json:"valveOpen"`
+	Reason        string        `json:"reason"`
+	Heaters       []string      `json:"heaters"`
+	TRVs          []string      `json:"trvs,omitempty"`
+	Boiler        string        `json:"boiler,omitempty"`
+	Override      *ZoneOverride `json:"override,omitempty"`
+	Output        *float64      `json:"output,omitempty"`
+}
+
+// BoilerStatus is what /api/boilers reports for each shared boiler.
+type BoilerStatus struct {
+	Boiler string   `json:"boiler"`
+	Heater string   `json:"heater"`
+	Firing bool     `json:"firing"`
+	Reason string   `json:"reason"`
+	Zones  []string `json:"zones"`
+	Flow   float64  `json:"flow"`
+	Water  float64  `json:"water,omitempty"`
+}
+
+// zoneState is a zone's inputs and its latest decision. demand is the
+// zone's own call for heat; heating is whether it gets it, which a shared
+// boiler may refuse, and valve whether its heaters are switched on, which
+// a boiler may also ask for to get enough flow.
+type zoneState struct {
+	name     string
+	cfg      ZoneConfig
+	relays   []*relayActuator
+	trvs     []*trvState
+	setpoint float64
+	hasSP    bool
+	temp     float64
+	tempAt   time.Time
+	demand   bool
+	heating  bool
+	valve    bool
+	reason   string
+
+	// target is the setpoint the latest decision was made for, from the
+	// stored setpoint through steps; why spells the decision out.
+	target    float64
+	hasTarget bool
+	steps     []SetpointStep
+	why       string
+
+	// frost is set while the zone is heated for frost protection.
+	frost bool
+	// override holds the zone at a target for a while, over the rest.
+	override *ZoneOverride
+
+	// pid is the controller's memory for a zone with pid, tuning the
+	// constants of its last autotune and tune the latest autotune run.
+	pid    pidState
+	tuning *PIDTuning
+	tune   *autotuneRun
+
+	// logged is the heating curve target last recorded, at loggedAt.
+	logged   float64
+	loggedAt time.Time
+}
+
+// SetpointStep is one stage of working out the setpoint a zone is held
+// at, for /api/explain.
+type SetpointStep struct {
+	Layer    string  `json:"layer"`
+	Setpoint float64 `json:"setpoint"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+// effectiveSetpoint is the setpoint the zone is held at now and how it
+// came about.
+func (z *zoneState) effectiveSetpoint(now time.Time, outdoor lastReading) (float64, bool, []SetpointStep) {
+	if !z.hasSP && z.override == nil {
+		return 0, false, nil
+	}
+	var steps []SetpointStep
+	if z.hasSP {
+		steps = append(steps, SetpointStep{Layer: "setpoint", Setpoint: z.setpoint})
+		vacation, onVacation := vacations.at(now)
+		if onVacation {
+			steps = append(steps, z.vacationStep(z.setpoint, vacation))
+		}
+		// Nobody is home yet while pre-heating for the return
+		if away, since, reason := presence.away(); away && !(onVacation && vacation.State == vacationPreheating) {
+			steps = append(steps, z.awayStep(steps[len(steps)-1].Setpoint, since, reason))
+		}
+	}
+	if z.override != nil {
+		steps = append(steps, z.overrideStep(now))
+	}
+	if z.cfg.Curve != nil {
+		steps = append(steps, z.curveStep(steps[len(steps)-1].Setpoint, outdoor, now))
+	}
+	return steps[len(steps)-1].Setpoint, true, steps
+}
+
+// boilerState is a shared boiler, its zones by priority and its latest
+// decision, with the water temperature for one behind an OpenTherm
+// gateway.
+type boilerState struct {
+	name    string
+	cfg     BoilerConfig
+	relay   *relayActuator
+	gateway *otGateway
+	zones   []*zoneState
+	firing  bool
+	flow    float64
+	water   float64
+	reason  string
+}
+
+// relayActuator switches one heater plug on behalf of the control loop.
+// Plug requests can take seconds, so they run in the actuator's goroutine
+// and the loop only leaves the wanted state in a one-slot mailbox.
+type relayActuator struct {
+	heater *heaterCheck
+	want   chan relayRequest
+	// sensors are the readings its decisions depend on and interval the
+	// control loop's, for the watchdog.
+	sensors  []string
+	interval time.Duration
+
+	// The rest is only used by run: the state last switched to, when it
+	// was switched and last turned on, when the loop last asked, the end
+	// of a rest after max_on and its alert.
+	on         bool
+	changedAt  time.Time
+	onSince    time.Time
+	wantedAt   time.Time
+	restUntil  time.Time
+	maxOnEvent int64
+}
+
+// controlLoop switches each zone's heaters to hold the zone at its
+// setpoint. It runs on a fixed tick in its own goroutine and decides from
+// state kept in memory: readings are handed to it before they are stored,
+// and setpoints when they are saved. Neither HTTP requests nor a slow
+// database can delay a decision.
+type controlLoop struct {
+	mu       sync.Mutex
+	zones    []*zoneState
+	boilers  []*boilerState
+	bySensor map[string][]*zoneState
+	byName   map[string]*zoneState
+	interval time.Duration
+	// outdoor is the latest reading of outdoor_sensor, for heating curves.
+	outdoor lastReading
+	frost   FrostConfig
+	// held is why heating control is off, apart from frost protection.
+	held string
+
+	ticks, missed, overruns int64
+	lastDuration            time.Duration
+	maxDuration             time.Duration
+}
+
+var controller = &controlLoop{}
+
+// setupZones validates the zones and boilers sections of the config.
+// Heaters and TRVs are referred to by their names in the heaters and trvs
+// sections.
+func setupZones(configs map[string]ZoneConfig, boilers map[string]BoilerConfig, interval time.Duration) error {
+	byHeater := map[string]*heaterCheck{}
+	for _, h := range heaters {
+		byHeater[h.name] = h
+	}
+	byTRV := map[string]*trvState{}
+	for _, t := range trvs {
+		byTRV[t.name] = t
+	}
+	used := map[string]string{}
+	c := &controlLoop{bySensor: map[string][]*zoneState{}, byName: map[string]*zoneState{}, interval: interval, frost: config().Frost}
+	byBoiler := map[string]*boilerState{}
+	for name, bc := range boilers {
+		h, ok := byHeater[bc.Heater]
+		if !ok {
+			return fmt.Errorf("boiler %q: unknown heater %q", name, bc.Heater)
+		}
+		if other, ok := used[bc.Heater]; ok {
+			return fmt.Errorf("boiler %q: heater %q already belongs to %s", name, bc.Heater, other)
+		}
+		if bc.MaxZones < 0 || bc.MinFlow < 0 {
+			return fmt.Errorf("boiler %q: max_zones and min_flow must not be negative", name)
+		}
+		gateway := openthermGateway(h.cfg)
+		if err := bc.checkWater(gateway != nil); err != nil {
+			return fmt.Errorf("boiler %q: %v", name, err)
+		}
+		used[bc.Heater] = "boiler " + strconv.Quote(name)
+		b := &boilerState{name: name, cfg: bc, relay: &relayActuator{heater: h, want: make(chan relayRequest, 1), interval: interval}, gateway: gateway, reason: "starting"}
+		c.boilers = append(c.boilers, b)
+		byBoiler[name] = b
+	}
+	for name, zc := range configs {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("zone %q: name must be non-empty and without '/'", name)
+		}
+		if zc.Sensor == "" {
+			return fmt.Errorf("zone %q: sensor is required", name)
+		}
+		if len(zc.Heaters) == 0 && len(zc.TRVs) == 0 && zc.Boiler == "" {
+			return fmt.Errorf("zone %q: heaters, trvs or boiler is required", name)
+		}
+		if zc.Flow == 0 {
+			zc.Flow = 1
+		}
+		if zc.Flow < 0 {
+			return fmt.Errorf("zone %q: flow must be positive", name)
+		}
+		if zc.Hysteresis == 0 {
+			zc.Hysteresis = 0.3
+		}
+		if zc.Hysteresis < 0 {
+			return fmt.Errorf("zone %q: hysteresis must be positive", name)
+		}
+		if zc.ComfortBand == 0 {
+			zc.ComfortBand = 1
+		}
+		if zc.ComfortBand < 0 {
+			return fmt.Errorf("zone %q: comfort_band must be positive", name)
+		}
+		if zc.Curve != nil {
+			curve := *zc.Curve
+			if err := curve.check(name); err != nil {
+				return fmt.Errorf("zone %q: curve: %v", name, err)
+			}
+			zc.Curve = &curve
+		}
+		if zc.PID != nil {
+			pid := *zc.PID
+			if err := pid.check(); err != nil {
+				return fmt.Errorf("zone %q: pid: %v", name, err)
+			}
+			zc.PID = &pid
+		}
+		z := &zoneState{name: name, cfg: zc, reason: "starting"}
+		for _, hn := range zc.Heaters {
+			h, ok := byHeater[hn]
+			if !ok {
+				return fmt.Errorf("zone %q: unknown heater %q", name, hn)
+			}
+			if other, ok := used[hn]; ok {
+				return fmt.Errorf("zone %q: heater %q already belongs to %s", name, hn, other)
+			}
+			if h.cfg.Type == "opentherm" {
+				return fmt.Errorf("zone %q: heater %q is an opentherm boiler, which zones use through boilers", name, hn)
+			}
+			used[hn] = "zone " + strconv.Quote(name)
+			z.relays = append(z.relays, &relayActuator{heater: h, want: make(chan relayRequest, 1), sensors: []string{zc.Sensor}, interval: interval})
+		}
+		for _, tn := range zc.TRVs {
+			t, ok := byTRV[tn]
+			if !ok {
+				return fmt.Errorf("zone %q: unknown trv %q", name, tn)
+			}
+			if t.zone != "" {
+				return fmt.Errorf("zone %q: trv %q already belongs to zone %q", name, tn, t.zone)
+			}
+			t.zone = name
+			z.trvs = append(z.trvs, t)
+		}
+		if zc.Boiler != "" {
+			b, ok := byBoiler[zc.Boiler]
+			if !ok {
+				return fmt.Errorf("zone %q: unknown boiler %q", name, zc.Boiler)
+			}
+			b.zones = append(b.zones, z)
+		}
+		c.zones = append(c.zones, z)
+		c.bySensor[zc.Sensor] = append(c.bySensor[zc.Sensor], z)
+		c.byName[name] = z
+	}
+	sort.Slice(c.zones, func(i, j int) bool { return c.zones[i].name < c.zones[j].name })
+	sort.Slice(c.boilers, func(i, j int) bool { return c.boilers[i].name < c.boilers[j].name })
+	for _, b := range c.boilers {
+		if len(b.zones) == 0 {
+			return fmt.Errorf("boiler %q: no zone uses it", b.name)
+		}
+		zones := b.zones
+		for _, z := range zones {
+			b.relay.sensors = append(b.relay.sensors, z.cfg.Sensor)
+		}
+		sort.Slice(zones, func(i, j int) bool {
+			if zones[i].cfg.Priority != zones[j].cfg.Priority {
+				return zones[i].cfg.Priority > zones[j].cfg.Priority
+			}
+			return zones[i].name < zones[j].name
+		})
+	}
+	controller = c
+	return nil
+}
+
+// start loads the stored setpoints and starts the loop and the actuators.
+func (c *controlLoop) start() error {
+	if len(c.zones) == 0 {
+		return nil
+	}
+	setpoints, err := listSetpoints()
+	if err != nil {
+		return err
+	}
+	for _, sp := range setpoints {
+		c.setSetpoint(sp.Zone, sp.Temperature)
+	}
+	if err := c.loadOverrides(clock.Now()); err != nil {
+		return err
+	}
+	if err := c.loadTunings(); err != nil {
+		return err
+	}
+	if err := c.loadOutdoor(); err != nil {
+		return err
+	}
+	for _, z := range c.zones {
+		if z.cfg.Curve != nil {
+			go recordCurveTargets()
+			break
+		}
+	}
+	for _, z := range c.zones {
+		for _, r := range z.relays {
+			go r.run()
+		}
+		for _, t := range z.trvs {
+			go t.run()
+		}
+	}
+	for _, b := range c.boilers {
+		go b.relay.run()
+	}
+	go c.run()
+	if c.held != "" {
+		log.Printf("Heating control held (%s): only frost protection runs for %d zones", c.held, len(c.zones))
+		return nil
+	}
+	log.Printf("Controlling %d heating zones and %d boilers every %s", len(c.zones), len(c.boilers), c.interval)
+	return nil
+}
+
+// observe takes a reading for the zones measured by sensor.
+func (c *controlLoop) observe(sensor string, temp float64, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, z := range c.bySensor[sensor] {
+		z.temp, z.tempAt = temp, at
+	}
+	if sensor == config().OutdoorSensor {
+		c.outdoor = lastReading{value: temp, time: at}
+	}
+}
+
+// setSetpoint takes a zone's new setpoint; zones not in the config are
+// ignored.
+func (c *controlLoop) setSetpoint(zone string, temp float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.byName[zone]; ok {
+		z.setpoint, z.hasSP = temp, true
+	}
+}
+
+// hold keeps heating control off for reason, leaving only frost
+// protection to the loop.
+func (c *controlLoop) hold(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = reason
+	for _, z := range c.zones {
+		z.reason = reason
+	}
+}
+
+func (c *controlLoop) run() {
+	ticker := clock.NewTicker(c.interval)
+	defer ticker.Stop()
+	last := clock.Now()
+	for now := range ticker.C() {
+		// A ticker drops ticks its receiver is too late for, so a gap of
+		// more than one interval means decisions were skipped
+		gap := now.Sub(last)
+		last = now
+		var missed int64
+		if gap > c.interval*3/2 {
+			missed = int64((gap+c.interval/2)/c.interval) - 1
+			log.Printf("Control loop missed %d ticks (%s since the previous one)", missed, gap.Round(time.Millisecond))
+		}
+
+		start := clock.Now()
+		c.tick(now)
+		d := clock.Now().Sub(start)
+
+		c.mu.Lock()
+		c.ticks++
+		c.missed += missed
+		c.lastDuration = d
+		if d > c.maxDuration {
+			c.maxDuration = d
+		}
+		if d > controlDeadline {
+			c.overruns++
+		}
+		c.mu.Unlock()
+		if d > controlDeadline {
+			log.Printf("Control loop tick took %s, over its %s deadline", d.Round(time.Millisecond), controlDeadline)
+		}
+	}
+}
+
+// tick decides every zone: heat below setpoint minus hysteresis, stop at
+// the setpoint, and keep the current state in between, unless the zone
+// runs a PID controller or an autotune. Without a setpoint
+// or a recent reading the heaters are switched off. Boilers then decide
+// which of their zones' calls they serve.
+func (c *controlLoop) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := make([]bool, len(c.zones))
+	summer, summerWhy := season.summer()
+	vacations.announce(now)
+	for i, z := range c.zones {
+		was[i] = z.heating
+		z.expireOverride(now)
+		z.target, z.hasTarget, z.steps = z.effectiveSetpoint(now, c.outdoor)
+		z.logTarget(now)
+		demand, reason, why := z.demand, "", ""
+		temp := formatReading(z.cfg.Sensor, z.temp) + "°C"
+		low := z.target - z.cfg.Hysteresis
+		kp, ki, kd, pid := z.gains()
+		tuning, pidRan := z.tune != nil && z.tune.running(), false
+		switch {
+		case summer:
+			demand, reason, why = false, seasonHeld, "heating is off for the summer: "+summerWhy
+		case !z.hasTarget:
+			demand, reason, why = false, "no setpoint", "the zone has no setpoint"
+		case z.tempAt.IsZero():
+			demand, reason, why = false, "no recent reading from "+z.cfg.Sensor, "no reading from "+z.cfg.Sensor+" since start"
+		case now.Sub(z.tempAt) > controlStale:
+			demand, reason = false, "no recent reading from "+z.cfg.Sensor
+			why = fmt.Sprintf("the last reading from %s is %s old, over %s", z.cfg.Sensor, now.Sub(z.tempAt).Round(time.Second), controlStale)
+		case tuning && c.held == "":
+			demand, reason, why = z.tune.step(z, now)
+			tuning = false
+			if z.tune.st.Result != nil {
+				z.setTuning(*z.tune.st.Result)
+			}
+		case pid:
+			demand, reason, why = z.pidStep(now, kp, ki, kd)
+			pidRan = true
+		case z.temp < low:
+			demand, reason = true, "below setpoint"
+			why = fmt.Sprintf("%s < setpoint %.1f°C - hysteresis %.1f°C", temp, z.target, z.cfg.Hysteresis)
+		case z.temp >= z.target:
+			demand, reason = false, "setpoint reached"
+			why = fmt.Sprintf("%s ≥ setpoint %.1f°C", temp, z.target)
+		case demand:
+			reason = "heating up to setpoint"
+			why = fmt.Sprintf("%s < setpoint %.1f°C, heating since it fell below %.1f°C", temp, z.target, low)
+		default:
+			reason = "within hysteresis"
+			why = fmt.Sprintf("%s ≥ setpoint %.1f°C - hysteresis %.1f°C, not heating until below %.1f°C", temp, z.target, z.cfg.Hysteresis, low)
+		}
+		if c.held != "" {
+			demand, reason, why = false, c.held, "heating control is off: "+c.held
+		}
+		// Frost protection goes over everything else
+		if frostWhy, frost := z.frostStep(c.frost, now); frost {
+			demand, reason, why = true, frostHeld, frostWhy
+			tuning = z.tune != nil && z.tune.running()
+		}
+		// An autotune needs the zone to itself
+		if tuning {
+			z.tune.finish("failed", "heating was taken over: "+reason, now)
+		}
+		if !pidRan {
+			z.pid = pidState{}
+		}
+		z.demand, z.heating, z.valve, z.reason, z.why = demand, demand, demand, reason, why
+	}
+	// A failover hub without control decides as usual, for /api/explain,
+	// but leaves the heaters to its peer
+	standby := !failover.controlling()
+	for _, b := range c.boilers {
+		firing := b.firing
+		b.decide()
+		if standby {
+			b.firing, b.reason = false, failoverStandby
+		}
+		b.water = 0
+		if b.gateway != nil && b.firing {
+			b.water = b.waterSetpoint(c, summer)
+		}
+		if b.firing != firing {
+			log.Printf("Boiler %s: %s (%s)", b.name, onOff(b.firing), b.reason)
+		}
+	}
+	for i, z := range c.zones {
+		if standby {
+			z.heating, z.valve, z.reason = false, false, failoverStandby
+			z.why += "; " + failover.cfg.Peer + " has control"
+		}
+		if z.heating != was[i] {
+			log.Printf("Zone %s: heating %s (%s)", z.name, onOff(z.heating), z.reason)
+		}
+		if standby {
+			continue
+		}
+		for _, r := range z.relays {
+			r.set(z.valve, z.frost)
+		}
+		for _, t := range z.trvs {
+			switch {
+			case t.cfg.Mode == "valve" && z.valve:
+				t.set(100)
+			case t.cfg.Mode == "valve":
+				t.set(0)
+			case z.frost:
+				t.set(c.frostTarget(z, summer))
+			case z.hasTarget && !summer && c.held == "":
+				t.set(z.target)
+			}
+		}
+	}
+	if standby {
+		return
+	}
+	for _, b := range c.boilers {
+		if b.gateway != nil && b.firing {
+			b.gateway.setWater(b.water)
+		}
+		b.relay.set(b.firing, b.frost())
+	}
+}
+
+// frost reports whether the boiler fires for a zone in frost protection.
+func (b *boilerState) frost() bool {
+	for _, z := range b.zones {
+		if z.frost && z.heating {
+			return true
+		}
+	}
+	return false
+}
+
+// decide serves the zones calling for heat in priority order, up to
+// max_zones, and fires when their flow, topped up by opening the valves of
+// further zones, reaches min_flow. It stays off while a pressure sensor on
+// it is outside its limits.
+func (b *boilerState) decide() {
+	if fault := boilerPressureFault(b.name); fault != "" {
+		b.firing, b.flow, b.reason = false, 0, fault
+		for _, z := range b.zones {
+			if z.demand {
+				z.heating, z.valve = false, false
+				z.reason = fmt.Sprintf("boiler %s held off: %s", b.name, fault)
+			}
+		}
+		return
+	}
+	var served []*zoneState
+	for _, z := range b.zones {
+		if !z.demand {
+			continue
+		}
+		if b.cfg.MaxZones > 0 && len(served) == b.cfg.MaxZones {
+			z.heating, z.valve = false, false
+			z.reason = fmt.Sprintf("waiting for boiler %s, which serves %d zones at once", b.name, b.cfg.MaxZones)
+			continue
+		}
+		served = append(served, z)
+	}
+	b.flow = 0
+	if len(served) == 0 {
+		b.firing, b.reason = false, "no zone calls for heat"
+		return
+	}
+	for _, z := range served {
+		b.flow += z.cfg.Flow
+	}
+	var opened []*zoneState
+	for _, z := range b.zones {
+		if b.flow >= b.cfg.MinFlow {
+			break
+		}
+		if !z.valve && !z.demand {
+			opened = append(opened, z)
+			b.flow += z.cfg.Flow
+		}
+	}
+	if b.flow < b.cfg.MinFlow {
+		b.firing = false
+		b.reason = fmt.Sprintf("flow %g below min_flow %g with every valve open", b.flow, b.cfg.MinFlow)
+		for _, z := range served {
+			z.heating, z.valve = false, false
+			z.reason = fmt.Sprintf("boiler %s cannot fire: %s", b.name, b.reason)
+		}
+		b.flow = 0
+		return
+	}
+	for _, z := range opened {
+		z.valve = true
+		z.reason += fmt.Sprintf("; valve open for the minimum flow of boiler %s", b.name)
+	}
+	b.firing = true
+	b.reason = fmt.Sprintf("%d zones calling for heat", len(served))
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// relayRequest is the state the control loop wants a relay in, and
+// whether that is for frost protection.
+type relayRequest struct {
+	on, frost bool
+}
+
+// set replaces the wanted state in the mailbox without blocking.
+func (r *relayActuator) set(on, frost bool) {
+	select {
+	case <-r.want:
+	default:
+	}
+	r.want <- relayRequest{on: on, frost: frost}
+}
+
+// run switches the relay when the wanted state changes, and again while
+// the plug keeps reporting the other state. Between requests it checks
+// the safety limits, so a relay is switched off even when the control
+// loop stops asking; a standby failover hub leaves the relays alone.
+func (r *relayActuator) run() {
+	ticker := clock.NewTicker(relayWatchdog)
+	defer ticker.Stop()
+	var want relayRequest
+	var sent *bool
+	var sentAt time.Time
+	for {
+		select {
+		case want = <-r.want:
+			r.wantedAt = clock.Now()
+		case <-ticker.C():
+			if r.wantedAt.IsZero() || !failover.controlling() {
+				continue
+			}
+		}
+		now := clock.Now()
+		on, limit := r.limit(want.on, want.frost, now)
+		r.heater.setLimit(limit)
+		st := r.heater.snapshot()
+		mismatch := st.LastSeen != nil && st.RelayOn != on
+		if sent != nil && *sent == on && (!mismatch || now.Sub(sentAt) < relayEnforce) {
+			continue
+		}
+		if err := switchPlug(r.heater.plug(), on); err != nil {
+			log.Printf("Error switching heater %s %s: %v", r.heater.name, onOff(on), err)
+			sent = nil
+			continue
+		}
+		r.heater.update(func(s *plugStatus) { s.relayOn = on })
+		if on != r.on {
+			r.changedAt = now
+			if on {
+				r.onSince = now
+			}
+		}
+		r.on = on
+		v := on
+		sent, sentAt = &v, now
+	}
+}
+
+func (c *controlLoop) statuses() []ZoneStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]ZoneStatus, 0, len(c.zones))
+	for _, z := range c.zones {
+		s := ZoneStatus{Zone: z.name, Sensor: z.cfg.Sensor, Demand: z.demand, Heating: z.heating, ValveOpen: z.valve,
+			Reason: z.reason, Heaters: z.cfg.Heaters, TRVs: z.cfg.TRVs, Boiler: z.cfg.Boiler}
+		if !z.tempAt.IsZero() {
+			t, at := roundReading(z.cfg.Sensor, z.temp), z.tempAt
+			s.Temperature, s.TemperatureAt = &t, &at
+		}
+		if z.hasSP {
+			sp := z.setpoint
+			s.Setpoint = &sp
+		}
+		if z.hasTarget && (z.cfg.Curve != nil || z.override != nil) {
+			t := z.target
+			s.Target = &t
+		}
+		s.Override = z.currentOverride(clock.Now())
+		if !z.pid.cycleStart.IsZero() {
+			out := math.Round(z.pid.duty * 100)
+			s.Output = &out
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+func (c *controlLoop) boilerStatuses() []BoilerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]BoilerStatus, 0, len(c.boilers))
+	for _, b := range c.boilers {
+		s := BoilerStatus{Boiler: b.name, Heater: b.cfg.Heater, Firing: b.firing, Reason: b.reason, Flow: b.flow, Water: b.water, Zones: []string{}}
+		for _, z := range b.zones {
+			s.Zones = append(s.Zones, z.name)
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// writeMetrics adds the zone states and the loop's timing to /metrics.
+func (c *controlLoop) writeMetrics(b *strings.Builder) {
+	if len(c.zones) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b.WriteString("# HELP piheat_zone_heating Whether the control loop is heating the zone.\n")
+	b.WriteString("# TYPE piheat_zone_heating gauge\n")
+	for _, z := range c.zones {
+		v := 0
+		if z.heating {
+			v = 1
+		}
+		fmt.Fprintf(b, "piheat_zone_heating{zone=%s} %d\n", strconv.Quote(z.name), v)
+	}
+	curves := false
+	for _, z := range c.zones {
+		if z.cfg.Curve != nil && z.hasTarget {
+			if !curves {
+				b.WriteString("# HELP piheat_zone_target_celsius Target the heating curve sets for the zone.\n")
+				b.WriteString("# TYPE piheat_zone_target_celsius gauge\n")
+				curves = true
+			}
+			fmt.Fprintf(b, "piheat_zone_target_celsius{zone=%s} %s\n", strconv.Quote(z.name), strconv.FormatFloat(z.target, 'f', -1, 64))
+		}
+	}
+	if len(c.boilers) > 0 {
+		b.WriteString("# HELP piheat_boiler_firing Whether the control loop is firing the shared boiler.\n")
+		b.WriteString("# TYPE piheat_boiler_firing gauge\n")
+		for _, bs := range c.boilers {
+			v := 0
+			if bs.firing {
+				v = 1
+			}
+			fmt.Fprintf(b, "piheat_boiler_firing{boiler=%s} %d\n", strconv.Quote(bs.name), v)
+		}
+	}
+	b.WriteString("# HELP piheat_control_ticks_total Control loop passes over the zones.\n")
+	b.WriteString("# TYPE piheat_control_ticks_total counter\n")
+	fmt.Fprintf(b, "piheat_control_ticks_total %d\n", c.ticks)
+	b.WriteString("# HELP piheat_control_missed_ticks_total Control loop ticks skipped because the loop was late.\n")
+	b.WriteString("# TYPE piheat_control_missed_ticks_total counter\n")
+	fmt.Fprintf(b, "piheat_control_missed_ticks_total %d\n", c.missed)
+	b.WriteString("# HELP piheat_control_deadline_overruns_total Control loop passes that took longer than their deadline.\n")
+	b.WriteString("# TYPE piheat_control_deadline_overruns_total counter\n")
+	fmt.Fprintf(b, "piheat_control_deadline_overruns_total %d\n", c.overruns)
+	b.WriteString("# HELP piheat_control_tick_seconds Duration of the latest control loop pass.\n")
+	b.WriteString("# TYPE piheat_control_tick_seconds gauge\n")
+	fmt.Fprintf(b, "piheat_control_tick_seconds %s\n", strconv.FormatFloat(c.lastDuration.Seconds(), 'f', -1, 64))
+	b.WriteString("# HELP piheat_control_tick_max_seconds Longest control loop pass since start.\n")
+	b.WriteString("# TYPE piheat_control_tick_max_seconds gauge\n")
+	fmt.Fprintf(b, "piheat_control_tick_max_seconds %s\n", strconv.FormatFloat(c.maxDuration.Seconds(), 'f', -1, 64))
+}
+
+// zonesHandler serves GET /api/zones.
+func zonesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, controller.statuses())
+}
+
+// boilersHandler serves GET /api/boilers.
+func boilersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, controller.boilerStatuses())
+}
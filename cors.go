@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browser apps served from other origins call /api/.
+// Without allowed_origins, cross-origin requests get no CORS headers and
+// browsers refuse them as before. "*" allows any origin, but not with
+// allow_credentials.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+func (c CORSConfig) check() error {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("allowed_origins \"*\" cannot be combined with allow_credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("allowed_origins: %q is not an origin like https://example.com", o)
+		}
+	}
+	if len(c.AllowedMethods) == 0 {
+		return fmt.Errorf("allowed_methods must not be empty")
+	}
+	if c.MaxAge.Duration < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	return nil
+}
+
+// allows reports whether origin may call the API, and the value of
+// Access-Control-Allow-Origin for it.
+func (c CORSConfig) allows(origin string) (string, bool) {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// corsExposedHeaders are the response headers scripts from other origins
+// may read besides the basic ones.
+const corsExposedHeaders = "ETag, Last-Modified, Retry-After, Content-Disposition, Location, X-Request-Id"
+
+// cors adds CORS headers to /api/ responses for allowed origins and
+// answers their preflight requests, which carry no credentials and so
+// must not reach requireLogin. The config is read per request, so reloads
+// apply at once.
+func cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := config().CORS
+		if len(conf.AllowedOrigins) == 0 || !strings.HasPrefix(r.URL.Path, "/api/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		allowOrigin, ok := conf.allows(origin)
+		if origin == "" || !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		if conf.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(conf.AllowedMethods, ", "))
+			if len(conf.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(conf.AllowedHeaders, ", "))
+			}
+			if conf.MaxAge.Duration > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(conf.MaxAge.Duration/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether origin is this hub: the host the request was
+// sent to, the one a proxy forwarded it for, or that of public_url.
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	hosts := []string{r.Host, r.Header.Get("X-Forwarded-Host")}
+	if p, err := url.Parse(config().PublicURL); err == nil {
+		hosts = append(hosts, p.Host)
+	}
+	for _, h := range hosts {
+		if h != "" && strings.EqualFold(h, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectCrossSite refuses changes sent by browsers from other sites: an
+// unsafe method whose Origin is neither this hub nor in allowed_origins,
+// or, from browsers that send no Origin, whose Sec-Fetch-Site is
+// cross-site. CORS alone does not stop them, as the browser only hides the
+// answer after the change is made, and with allow_credentials the session
+// cookie goes along. Clients that are not browsers send neither header.
+func rejectCrossSite(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if _, ok := config().CORS.allows(origin); !ok && !sameOrigin(r, origin) {
+				apiError(w, r, http.StatusForbidden, "cross_site", fmt.Sprintf("Requests from %s may not make changes; add it to cors.allowed_origins", origin))
+				return
+			}
+		} else if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+			apiError(w, r, http.StatusForbidden, "cross_site", "Requests from other sites may not make changes")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// curveMax is the default highest target of a heating curve, the
+	// flow temperature most boilers are limited to.
+	curveMax = 80.0
+	// curveOutdoorStale is how old the outdoor temperature may be before
+	// a curve is set aside and the zone held at its setpoint. The weather
+	// is fetched every 15 minutes by default, so this allows for several
+	// failed fetches.
+	curveOutdoorStale = 3 * time.Hour
+	// curveLogInterval is how often a zone's computed target is recorded
+	// while it stays the same, so the chart has a line to draw.
+	curveLogInterval = 5 * time.Minute
+	// curveLogStep is the change of target that is recorded straight away.
+	curveLogStep = 0.1
+)
+
+// HeatingCurve is a zone's weather compensation: instead of the setpoint,
+// the zone is held at setpoint + Offset + Slope × (setpoint - outdoor
+// temperature), limited to Min and Max (default 80°C). With the zone's
+// sensor on the flow pipe this is a boiler's heating curve; with a room
+// sensor and a small slope it makes up for a room cooling faster in the
+// cold. The target is recorded as readings of TargetSensor (default
+// "<zone>.target") for the charts.
+type HeatingCurve struct {
+	Slope        float64 `json:"slope"`
+	Offset       float64 `json:"offset,omitempty"`
+	Min          float64 `json:"min,omitempty"`
+	Max          float64 `json:"max,omitempty"`
+	TargetSensor string  `json:"target_sensor,omitempty"`
+}
+
+func (c *HeatingCurve) check(zone string) error {
+	if c.Slope < 0 || math.IsNaN(c.Slope) {
+		return fmt.Errorf("slope must not be negative")
+	}
+	if c.Max == 0 {
+		c.Max = curveMax
+	}
+	if c.Min >= c.Max {
+		return fmt.Errorf("min must be below max")
+	}
+	if c.TargetSensor == "" {
+		c.TargetSensor = zone + ".target"
+	}
+	return nil
+}
+
+// target is where the curve puts a setpoint at an outdoor temperature,
+// and the working for /api/explain.
+func (c *HeatingCurve) target(setpoint, outdoor float64) (float64, string) {
+	t := setpoint + c.Offset + c.Slope*(setpoint-outdoor)
+	detail := fmt.Sprintf("outdoor %.1f°C: %.1f + %.1f + %.2f × (%.1f - %.1f)", outdoor, setpoint, c.Offset, c.Slope, setpoint, outdoor)
+	switch {
+	case t > c.Max:
+		t = c.Max
+		detail += fmt.Sprintf(", limited to max %.1f°C", c.Max)
+	case t < c.Min:
+		t = c.Min
+		detail += fmt.Sprintf(", raised to min %.1f°C", c.Min)
+	}
+	return math.Round(t*10) / 10, detail
+}
+
+// curveStep applies a zone's curve to the setpoint it would otherwise be
+// held at. Without a recent outdoor temperature the setpoint stands.
+func (z *zoneState) curveStep(setpoint float64, outdoor lastReading, now time.Time) SetpointStep {
+	c := z.cfg.Curve
+	if outdoor.time.IsZero() {
+		return SetpointStep{Layer: "curve", Setpoint: setpoint,
+			Detail: "no reading from " + config().OutdoorSensor + " yet; holding the setpoint"}
+	}
+	if age := now.Sub(outdoor.time); age > curveOutdoorStale {
+		return SetpointStep{Layer: "curve", Setpoint: setpoint,
+			Detail: fmt.Sprintf("the last reading from %s is %s old; holding the setpoint", config().OutdoorSensor, age.Round(time.Minute))}
+	}
+	t, detail := c.target(setpoint, outdoor.value)
+	return SetpointStep{Layer: "curve", Setpoint: t, Detail: detail}
+}
+
+// curveTargets hands the targets to record from the control loop to
+// recordCurveTargets, so a slow database cannot hold up a decision.
+var curveTargets = make(chan Reading, 64)
+
+// logTarget queues a zone's computed target when it changed or has not
+// been recorded for a while.
+func (z *zoneState) logTarget(now time.Time) {
+	if z.cfg.Curve == nil || !z.hasTarget {
+		return
+	}
+	if !z.loggedAt.IsZero() && math.Abs(z.target-z.logged) < curveLogStep && now.Sub(z.loggedAt) < curveLogInterval {
+		return
+	}
+	select {
+	case curveTargets <- Reading{Sensor: z.cfg.Curve.TargetSensor, Value: z.target, Time: now, Source: sourceCurve}:
+		z.logged, z.loggedAt = z.target, now
+	default:
+		log.Printf("Dropped the heating curve target of zone %s: the database is falling behind", z.name)
+	}
+}
+
+// recordCurveTargets stores the queued targets as readings.
+func recordCurveTargets() {
+	for r := range curveTargets {
+		if err := saveTemperature(r.Sensor, r.Value, r.Source, r.Time); err != nil {
+			log.Printf("Error saving heating curve target: %v", err)
+		}
+	}
+}
+
+// loadOutdoor gives the control loop the latest stored outdoor
+// temperature, so curves apply from the start instead of waiting for the
+// next reading.
+func (c *controlLoop) loadOutdoor() error {
+	if config().OutdoorSensor == "" {
+		return nil
+	}
+	var value float64
+	var at string
+	err := db.QueryRow("SELECT temperature, timestamp FROM temperature_readings WHERE sensor = ? ORDER BY timestamp DESC LIMIT 1",
+		config().OutdoorSensor).Scan(&value, &at)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t, err := parseSQLiteTime(at)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.outdoor.time) {
+		c.outdoor = lastReading{value: value, time: t}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDashboardPanels is how many panels one dashboard may have.
+	maxDashboardPanels = 20
+	// maxDashboardTitle is the longest title of a dashboard or panel.
+	maxDashboardTitle = 100
+)
+
+// Panel chart types: a line or bar chart of the series over the period,
+// or their latest values as large numbers.
+var dashboardCharts = map[string]bool{"line": true, "bar": true, "value": true}
+
+// DashboardPanel is one panel of a dashboard: the series it shows, named
+// like /api/series ids, over Period as Chart.
+type DashboardPanel struct {
+	Title  string   `json:"title,omitempty"`
+	Series []string `json:"series"`
+	Period string   `json:"period,omitempty"`
+	Chart  string   `json:"chart,omitempty"`
+}
+
+// Dashboard is a named layout of panels, which a screen opens at
+// /dashboards/{name}. Refresh is how often the page reloads its data.
+type Dashboard struct {
+	Name      string           `json:"name"`
+	Title     string           `json:"title"`
+	Refresh   Duration         `json:"refresh"`
+	Panels    []DashboardPanel `json:"panels"`
+	UpdatedBy string           `json:"updatedBy"`
+	CreatedAt time.Time        `json:"createdAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+}
+
+// dashboardRequest is the body of POST /api/dashboards and PUT
+// /api/dashboards/{name}; the name comes from the path on PUT.
+type dashboardRequest struct {
+	Name    string           `json:"name,omitempty"`
+	Title   string           `json:"title"`
+	Refresh Duration         `json:"refresh,omitempty"`
+	Panels  []DashboardPanel `json:"panels"`
+}
+
+// check validates a dashboard and fills in the defaults: a minute's
+// refresh, and each panel a line chart of the day.
+func (d *dashboardRequest) check() error {
+	d.Name, d.Title = strings.TrimSpace(d.Name), strings.TrimSpace(d.Title)
+	if d.Name == "" || strings.ContainsAny(d.Name, "/ ?#") {
+		return fmt.Errorf("name must be non-empty, without spaces, slashes, ? or #")
+	}
+	if d.Title == "" {
+		d.Title = d.Name
+	}
+	if len(d.Title) > maxDashboardTitle {
+		return fmt.Errorf("title must be at most %d bytes", maxDashboardTitle)
+	}
+	if d.Refresh.Duration == 0 {
+		d.Refresh.Duration = time.Minute
+	}
+	if d.Refresh.Duration < 10*time.Second || d.Refresh.Duration > time.Hour {
+		return fmt.Errorf("refresh must be between 10s and 1h")
+	}
+	if len(d.Panels) == 0 || len(d.Panels) > maxDashboardPanels {
+		return fmt.Errorf("a dashboard needs 1 to %d panels", maxDashboardPanels)
+	}
+	for i := range d.Panels {
+		p := &d.Panels[i]
+		if err := p.check(); err != nil {
+			return fmt.Errorf("panel %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (p *DashboardPanel) check() error {
+	p.Title = strings.TrimSpace(p.Title)
+	if len(p.Title) > maxDashboardTitle {
+		return fmt.Errorf("title must be at most %d bytes", maxDashboardTitle)
+	}
+	if p.Period == "" {
+		p.Period = "day"
+	}
+	if chartResolution(p.Period) == "" && p.Period != "day" {
+		return fmt.Errorf("period must be day, week, month or year")
+	}
+	if p.Chart == "" {
+		p.Chart = "line"
+	}
+	if !dashboardCharts[p.Chart] {
+		return fmt.Errorf("chart must be line, bar or value")
+	}
+	if len(p.Series) == 0 || len(p.Series) > seriesMaxIDs {
+		return fmt.Errorf("a panel needs 1 to %d series", seriesMaxIDs)
+	}
+	for i, id := range p.Series {
+		p.Series[i] = strings.TrimSpace(id)
+		if _, _, err := parseSeriesID(p.Series[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func initDashboardsTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS dashboards (
+		name TEXT PRIMARY KEY,
+		title TEXT NOT NULL,
+		refresh_seconds INTEGER NOT NULL,
+		panels TEXT NOT NULL,
+		updated_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const dashboardColumns = "name, title, refresh_seconds, panels, updated_by, created_at, updated_at"
+
+func scanDashboard(row interface{ Scan(...interface{}) error }) (Dashboard, error) {
+	var d Dashboard
+	var refresh int64
+	var panels, createdAt, updatedAt string
+	if err := row.Scan(&d.Name, &d.Title, &refresh, &panels, &d.UpdatedBy, &createdAt, &updatedAt); err != nil {
+		return d, err
+	}
+	d.Refresh = Duration{time.Duration(refresh) * time.Second}
+	if err := json.Unmarshal([]byte(panels), &d.Panels); err != nil {
+		return d, fmt.Errorf("dashboard %s: %v", d.Name, err)
+	}
+	d.CreatedAt, _ = parseSQLiteTime(createdAt)
+	d.UpdatedAt, _ = parseSQLiteTime(updatedAt)
+	return d, nil
+}
+
+// saveDashboard stores a checked dashboard, keeping its creation time when
+// it replaces one.
+func saveDashboard(d Dashboard) error {
+	panels, err := json.Marshal(d.Panels)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO dashboards (name, title, refresh_seconds, panels, updated_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET title = excluded.title, refresh_seconds = excluded.refresh_seconds, panels = excluded.panels,
+		updated_by = excluded.updated_by, updated_at = excluded.updated_at`,
+		d.Name, d.Title, int64(d.Refresh.Duration/time.Second), string(panels), d.UpdatedBy, sqliteTime(d.CreatedAt), sqliteTime(d.UpdatedAt))
+	return err
+}
+
+// dashboardsHandler serves GET and POST /api/dashboards and GET, PUT and
+// DELETE /api/dashboards/{name}.
+func dashboardsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/dashboards"), "/")
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query("SELECT " + dashboardColumns + " FROM dashboards ORDER BY name")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+			list := []Dashboard{}
+			for rows.Next() {
+				d, err := scanDashboard(rows)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+					return
+				}
+				list = append(list, d)
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			var req dashboardRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid dashboard: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := req.check(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var exists int
+			if err := db.QueryRow("SELECT COUNT(*) FROM dashboards WHERE name = ?", req.Name).Scan(&exists); err != nil {
+				http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if exists > 0 {
+				http.Error(w, fmt.Sprintf("Dashboard %s already exists; PUT /api/v1/dashboards/%s replaces it", req.Name, req.Name), http.StatusConflict)
+				return
+			}
+			now := time.Now().UTC().Truncate(time.Second)
+			d := Dashboard{Name: req.Name, Title: req.Title, Refresh: req.Refresh, Panels: req.Panels,
+				UpdatedBy: requestActor(r), CreatedAt: now, UpdatedAt: now}
+			if err := saveDashboard(d); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving dashboard: %v", err), http.StatusInternalServerError)
+				return
+			}
+			auditRequest(r, "dashboard.create", d.Name, nil, d)
+			writeJSON(w, http.StatusCreated, d)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	old, err := scanDashboard(db.QueryRow("SELECT "+dashboardColumns+" FROM dashboards WHERE name = ?", name))
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, old)
+	case http.MethodPut:
+		var req dashboardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid dashboard: %v", err), http.StatusBadRequest)
+			return
+		}
+		req.Name = name
+		if err := req.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		d := Dashboard{Name: req.Name, Title: req.Title, Refresh: req.Refresh, Panels: req.Panels,
+			UpdatedBy: requestActor(r), CreatedAt: now, UpdatedAt: now}
+		if found {
+			d.CreatedAt = old.CreatedAt
+		}
+		if err := saveDashboard(d); err != nil {
+			http.Error(w, fmt.Sprintf("Error saving dashboard: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if found {
+			auditRequest(r, "dashboard.update", d.Name, old, d)
+			writeJSON(w, http.StatusOK, d)
+		} else {
+			auditRequest(r, "dashboard.create", d.Name, nil, d)
+			writeJSON(w, http.StatusCreated, d)
+		}
+	case http.MethodDelete:
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM dashboards WHERE name = ?", name); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting dashboard: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, "dashboard.delete", name, old, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// dashboardPageHandler serves /dashboards/{name}, which shows a stored
+// dashboard, and /dashboards, which lists them.
+func dashboardPageHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := parseTemplate("dashboard.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+		Name         string
+	}{basePath, assetVersion, strings.Trim(strings.TrimPrefix(r.URL.Path, "/dashboards"), "/")})
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fallbackDSN is the in-memory database piheat runs on when its database
+// file cannot be opened at start.
+const fallbackDSN = "file:piheat-fallback?mode=memory&cache=shared"
+
+// maxQueuedReadings bounds the readings kept in memory while the database
+// cannot be written. Beyond it the oldest are dropped.
+const maxQueuedReadings = 100000
+
+// recoveryInterval is how often a degraded database is tried again.
+const recoveryInterval = 30 * time.Second
+
+// DatabaseStatus describes a database piheat cannot write to. Fallback is
+// set when the file could not be opened at start and piheat runs on an
+// in-memory database; otherwise writes started failing while running and
+// Queued readings wait in memory to be written.
+type DatabaseStatus struct {
+	Since    time.Time `json:"since"`
+	Reason   string    `json:"reason"`
+	Fallback bool      `json:"fallback"`
+	Queued   int       `json:"queued"`
+	Dropped  int64     `json:"dropped"`
+}
+
+type queuedReading struct {
+	sensor, source string
+	value          float64
+	at             time.Time
+}
+
+// dbHealth is the state of the database. since is zero while it is healthy.
+var dbHealth struct {
+	sync.Mutex
+	since    time.Time
+	reason   string
+	fallback bool
+	queue    []queuedReading
+	dropped  int64
+}
+
+// probeDatabase opens the database file on a connection of its own and
+// reads its schema, which fails for a file that is not a database, is
+// corrupt at its start or cannot be opened at all.
+func probeDatabase(path string) error {
+	pdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer pdb.Close()
+	var n int
+	return pdb.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&n)
+}
+
+// enterFallback switches to the in-memory database after the file failed
+// its probe and returns the DSN to open instead.
+func enterFallback(path string, err error) string {
+	log.Printf("Error opening database %s: %v; keeping readings in memory until it can be opened", path, err)
+	// Year files live next to the main file; the in-memory database has
+	// no place for them
+	splitByYear = false
+	dbHealth.Lock()
+	dbHealth.fallback = true
+	dbHealth.Unlock()
+	markDegraded(err)
+	return fallbackDSN
+}
+
+// inFallback reports whether piheat runs on the in-memory database.
+func inFallback() bool {
+	dbHealth.Lock()
+	defer dbHealth.Unlock()
+	return dbHealth.fallback
+}
+
+// markDegraded records a database failure and alerts on the first one.
+func markDegraded(err error) {
+	dbHealth.Lock()
+	first := dbHealth.since.IsZero()
+	if first {
+		dbHealth.since = time.Now()
+	}
+	dbHealth.reason = err.Error()
+	queued := len(dbHealth.queue)
+	dbHealth.Unlock()
+	if first {
+		notifyDatabase("firing", queued)
+	}
+}
+
+// markRecovered clears the degraded state after the queue was written.
+func markRecovered(written int) {
+	dbHealth.Lock()
+	since := dbHealth.since
+	dbHealth.since, dbHealth.reason = time.Time{}, ""
+	dbHealth.Unlock()
+	if since.IsZero() {
+		return
+	}
+	log.Printf("Database writable again after %s, %d queued readings written", time.Since(since).Round(time.Second), written)
+	notifyDatabase("resolved", written)
+}
+
+// notifyDatabase tells the staleness notifiers: without the database no
+// data is being recorded, much as when a sensor goes offline. It is not
+// kept in the alert history, which lives in the database.
+func notifyDatabase(state string, readings int) {
+	notify(config().Staleness.Notifiers, Alert{
+		RuleName:  "Database unavailable",
+		Sensor:    "database",
+		Condition: "database",
+		Severity:  "critical",
+		Value:     float64(readings),
+		State:     state,
+		Time:      time.Now(),
+	})
+}
+
+// queueReading keeps a reading the database refused, dropping the oldest
+// when the queue is full.
+func queueReading(sensor string, value float64, source string, at time.Time, err error) {
+	dbHealth.Lock()
+	dbHealth.queue = append(dbHealth.queue, queuedReading{sensor: sensor, source: source, value: value, at: at})
+	if n := len(dbHealth.queue) - maxQueuedReadings; n > 0 {
+		dbHealth.queue = dbHealth.queue[n:]
+		dbHealth.dropped += int64(n)
+	}
+	dbHealth.Unlock()
+	markDegraded(err)
+}
+
+// databaseStatus returns the state of a degraded database, or nil while
+// it is healthy.
+func databaseStatus() *DatabaseStatus {
+	dbHealth.Lock()
+	defer dbHealth.Unlock()
+	if dbHealth.since.IsZero() {
+		return nil
+	}
+	s := &DatabaseStatus{
+		Since:    dbHealth.since.UTC().Truncate(time.Second),
+		Reason:   dbHealth.reason,
+		Fallback: dbHealth.fallback,
+		Queued:   len(dbHealth.queue),
+		Dropped:  dbHealth.dropped,
+	}
+	if s.Fallback {
+		// Readings are stored in the in-memory database meanwhile
+		db.QueryRow("SELECT COUNT(*) FROM temperature_readings").Scan(&s.Queued)
+	}
+	return s
+}
+
+// flushQueuedReadings writes the queued readings in one transaction. On
+// failure they go back to the front of the queue.
+func flushQueuedReadings() {
+	dbHealth.Lock()
+	batch := dbHealth.queue
+	dbHealth.queue = nil
+	dbHealth.Unlock()
+	if err := insertReadings(db, batch); err != nil {
+		dbHealth.Lock()
+		dbHealth.queue = append(batch, dbHealth.queue...)
+		if n := len(dbHealth.queue) - maxQueuedReadings; n > 0 {
+			dbHealth.queue = dbHealth.queue[n:]
+			dbHealth.dropped += int64(n)
+		}
+		dbHealth.Unlock()
+		markDegraded(err)
+		return
+	}
+	markRecovered(len(batch))
+}
+
+func insertReadings(d *sql.DB, readings []queuedReading) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Queued readings may span New Year, so each goes to its year's table
+	stmts := map[string]*sql.Stmt{}
+	for _, q := range readings {
+		table := readingsTableFor(q.at)
+		stmt := stmts[table]
+		if stmt == nil {
+			if stmt, err = tx.Prepare("INSERT INTO " + table + " (sensor, temperature, timestamp, source) VALUES (?, ?, ?, ?)"); err != nil {
+				return err
+			}
+			defer stmt.Close()
+			stmts[table] = stmt
+		}
+		if _, err := stmt.Exec(q.sensor, q.value, sqliteTime(q.at), q.source); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, q := range readings {
+		noteReading(q.sensor, q.at)
+		noteRollup(q.at)
+	}
+	return nil
+}
+
+// runDatabaseRecovery tries a degraded database again every
+// recoveryInterval. Queued readings are written once writes succeed. On
+// the in-memory database, piheat restarts itself as soon as the file can
+// be opened, carrying the readings recorded meanwhile over in the pending
+// file.
+func runDatabaseRecovery(path string) {
+	ticker := time.NewTicker(recoveryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if inFallback() {
+			if err := probeDatabase(path); err != nil {
+				markDegraded(err)
+				continue
+			}
+			if err := savePendingReadings(path); err != nil {
+				log.Printf("Database %s can be opened again but the readings kept in memory cannot be saved: %v", path, err)
+				continue
+			}
+			log.Printf("Database %s can be opened again, restarting", path)
+			restartSelf()
+			continue
+		}
+		dbHealth.Lock()
+		degraded := !dbHealth.since.IsZero()
+		dbHealth.Unlock()
+		if degraded {
+			flushQueuedReadings()
+		}
+	}
+}
+
+// restartSelf replaces the process with a fresh start of the same binary.
+// Listeners and the instance lock are closed on exec.
+func restartSelf() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Printf("Error restarting: %v", err)
+		return
+	}
+	if err := syscall.Exec(exe, os.Args, os.Environ()); err != nil {
+		log.Printf("Error restarting: %v", err)
+	}
+}
+
+// pendingPath is the file readings that could not be stored are kept in
+// until the next start.
+func pendingPath(dbPath string) string {
+	return dbPath + ".pending"
+}
+
+// savePendingReadings writes the readings not yet in the database file,
+// one JSON object per line, for importPendingReadings on the next start:
+// the queue and, on the in-memory database, every reading in it. It can
+// run more than once, when a restart fails, so the file is rewritten
+// rather than appended to: the readings already in it are kept, and
+// written once.
+func savePendingReadings(dbPath string) error {
+	dbHealth.Lock()
+	queue := append([]queuedReading(nil), dbHealth.queue...)
+	fallback := dbHealth.fallback
+	dbHealth.Unlock()
+	if !fallback && len(queue) == 0 {
+		return nil
+	}
+
+	path := pendingPath(dbPath)
+	kept, err := readPendingReadings(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	type pendingKey struct {
+		sensor, source string
+		value          float64
+		at             int64
+	}
+	seen := map[pendingKey]bool{}
+	n := 0
+	write := func(sr StoredReading) error {
+		key := pendingKey{sr.Sensor, sr.Source, sr.Temperature, sr.Timestamp.UnixNano()}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		n++
+		return enc.Encode(sr)
+	}
+	for _, sr := range kept {
+		if err = write(sr); err != nil {
+			break
+		}
+	}
+	for _, q := range queue {
+		if err != nil {
+			break
+		}
+		err = write(StoredReading{Sensor: q.sensor, Temperature: q.value, Timestamp: q.at.UTC(), Source: q.source})
+	}
+	if err == nil && fallback {
+		err = eachReading(context.Background(), readingQuery{Ascending: true}, write)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	log.Printf("Saved %d readings to %s", n, path)
+	return nil
+}
+
+// readPendingReadings reads a file savePendingReadings wrote.
+func readPendingReadings(path string) ([]StoredReading, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var readings []StoredReading
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var sr StoredReading
+		if err := json.Unmarshal([]byte(line), &sr); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		readings = append(readings, sr)
+	}
+	return readings, scanner.Err()
+}
+
+// importPendingReadings stores the readings savePendingReadings left,
+// removes the file and resolves the database alert. If they cannot be
+// stored, the file stays for the next start.
+func importPendingReadings(dbPath string) {
+	path := pendingPath(dbPath)
+	stored, err := readPendingReadings(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading pending readings: %v", err)
+		return
+	}
+	readings := make([]queuedReading, 0, len(stored))
+	for _, sr := range stored {
+		readings = append(readings, queuedReading{sensor: sr.Sensor, source: sr.Source, value: sr.Temperature, at: sr.Timestamp})
+	}
+	if err := insertReadings(db, readings); err != nil {
+		log.Printf("Error storing pending readings, keeping %s for the next start: %v", path, err)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error removing %s: %v", path, err)
+	}
+	log.Printf("Stored %d pending readings from %s", len(readings), path)
+	// They were left by a degraded database, whose alert is still open
+	notifyDatabase("resolved", len(readings))
+}
+
+// rejectWritesInFallback refuses changes while piheat runs on the
+// in-memory database: they would be lost when it switches back.
+func rejectWritesInFallback(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+			h.ServeHTTP(w, r)
+		case strings.HasPrefix(r.URL.Path, "/api/ingest/"):
+			// Readings are kept like the listeners' and carried over
+			h.ServeHTTP(w, r)
+		default:
+			apiError(w, r, http.StatusServiceUnavailable, "database_unavailable", "The database is unavailable; changes cannot be saved until it recovers")
+		}
+	})
+}
+
+// writeDatabaseMetrics adds the database state to /metrics.
+func writeDatabaseMetrics(b *strings.Builder) {
+	if readOnly {
+		return
+	}
+	degraded, queued, dropped := 0, 0, int64(0)
+	if s := databaseStatus(); s != nil {
+		degraded, queued, dropped = 1, s.Queued, s.Dropped
+	}
+	b.WriteString("# HELP piheat_database_degraded Whether the database cannot be written (1) or is healthy (0).\n")
+	b.WriteString("# TYPE piheat_database_degraded gauge\n")
+	fmt.Fprintf(b, "piheat_database_degraded %d\n", degraded)
+	b.WriteString("# HELP piheat_database_queued_readings Readings kept in memory until the database can be written.\n")
+	b.WriteString("# TYPE piheat_database_queued_readings gauge\n")
+	fmt.Fprintf(b, "piheat_database_queued_readings %d\n", queued)
+	b.WriteString("# HELP piheat_database_dropped_readings_total Queued readings dropped because the queue was full.\n")
+	b.WriteString("# TYPE piheat_database_dropped_readings_total counter\n")
+	fmt.Fprintf(b, "piheat_database_dropped_readings_total %d\n", dropped)
+}
@@ -154,7 +154,7 @@ if [[ ! -f "$BINARY_NAME" ]]; then
     go mod tidy
     
     print_status "Building binary for $GO_ARCH..."
-    CGO_ENABLED=1 GOOS=linux GOARCH=$GO_ARCH go build -o "$BINARY_NAME" main.go
+    CGO_ENABLED=1 GOOS=linux GOARCH=$GO_ARCH go build -o "$BINARY_NAME" .
     
     if [[ ! -f "$BINARY_NAME" ]]; then
         print_error "Failed to build binary"
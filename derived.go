@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// derivedMaxAge is how old an input may be, by default, for a derived
+// metric to be worked out from it.
+const derivedMaxAge = 5 * time.Minute
+
+// DerivedConfig is a metric worked out from other sensors with Expr each
+// time one of them reports, and recorded as a sensor of its own. Unit
+// labels it (default °C); MaxAge is how old its inputs may be (default
+// 5m).
+type DerivedConfig struct {
+	Expr   string   `json:"expr"`
+	Unit   string   `json:"unit,omitempty"`
+	MaxAge Duration `json:"max_age"`
+}
+
+// checkDerived parses every expression and makes sure no metric depends
+// on itself, directly or through others.
+func checkDerived(metrics map[string]DerivedConfig) error {
+	deps := map[string][]string{}
+	for name, d := range metrics {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("%q: name must be non-empty and without '/'", name)
+		}
+		e, err := parseExpr(d.Expr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if d.MaxAge.Duration < 0 {
+			return fmt.Errorf("%s: max_age must not be negative", name)
+		}
+		deps[name] = e.inputs()
+	}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("%s depends on itself: %s", name, strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, in := range deps[name] {
+			if _, ok := deps[in]; ok {
+				if err := visit(in, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type derivedMetric struct {
+	name   string
+	cfg    DerivedConfig
+	expr   exprNode
+	inputs []string
+	// err is why the metric could not be worked out lately, once it has
+	// been recorded: until then its inputs are only starting to report.
+	err      string
+	recorded bool
+}
+
+// derivedEngine works out the derived metrics from the latest reading of
+// each of their inputs.
+type derivedEngine struct {
+	mu      sync.Mutex
+	byInput map[string][]*derivedMetric
+	latest  map[string]lastReading
+	units   map[string]string
+}
+
+var derived = &derivedEngine{byInput: map[string][]*derivedMetric{}, latest: map[string]lastReading{}, units: map[string]string{}}
+
+// setupDerived prepares the derived metrics of a checked config.
+func setupDerived(metrics map[string]DerivedConfig) {
+	e := &derivedEngine{byInput: map[string][]*derivedMetric{}, latest: map[string]lastReading{}, units: map[string]string{}}
+	for name, d := range metrics {
+		expr, _ := parseExpr(d.Expr)
+		if d.Unit == "" {
+			d.Unit = "°C"
+		}
+		if d.MaxAge.Duration == 0 {
+			d.MaxAge.Duration = derivedMaxAge
+		}
+		m := &derivedMetric{name: name, cfg: d, expr: expr, inputs: expr.inputs()}
+		for _, in := range m.inputs {
+			e.byInput[in] = append(e.byInput[in], m)
+		}
+		e.units[name] = d.Unit
+	}
+	for _, ms := range e.byInput {
+		sort.Slice(ms, func(i, j int) bool { return ms[i].name < ms[j].name })
+	}
+	if len(metrics) > 0 {
+		log.Printf("Deriving %d metrics", len(metrics))
+	}
+	derived = e
+}
+
+// unit is the unit of a derived metric, empty for other sensors.
+func (e *derivedEngine) unit(sensor string) string {
+	return e.units[sensor]
+}
+
+// observe takes a reading and records every derived metric that uses it
+// and can be worked out. Those are readings in turn, so metrics derived
+// from derived metrics follow.
+func (e *derivedEngine) observe(sensor string, value float64, now time.Time) {
+	if len(e.byInput[sensor]) == 0 {
+		return
+	}
+	type result struct {
+		name  string
+		value float64
+	}
+	var results []result
+	e.mu.Lock()
+	e.latest[sensor] = lastReading{value: value, time: now}
+	for _, m := range e.byInput[sensor] {
+		v, err := m.evaluate(e.latest, now)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if m.recorded && msg != m.err {
+			if msg != "" {
+				log.Printf("Derived metric %s not recorded: %s", m.name, msg)
+			} else {
+				log.Printf("Derived metric %s recorded again", m.name)
+			}
+			m.err = msg
+		}
+		if err == nil {
+			m.recorded = true
+			results = append(results, result{m.name, v})
+		}
+	}
+	e.mu.Unlock()
+	for _, r := range results {
+		recordReading(r.name, r.value, sourceDerived)
+	}
+}
+
+// evaluate works out the metric from the latest readings. Inputs not seen
+// within max_age, and results that are not a number, such as after a
+// division by zero, are errors.
+func (m *derivedMetric) evaluate(latest map[string]lastReading, now time.Time) (float64, error) {
+	vals := map[string]float64{}
+	for _, in := range m.inputs {
+		r, ok := latest[in]
+		if !ok {
+			return 0, fmt.Errorf("no reading from %s yet", in)
+		}
+		if age := now.Sub(r.time); age > m.cfg.MaxAge.Duration {
+			return 0, fmt.Errorf("the last reading from %s is %s old", in, age.Round(time.Second))
+		}
+		vals[in] = r.value
+	}
+	v := m.expr.eval(vals)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("%s is not a number", m.cfg.Expr)
+	}
+	return v, nil
+}
+
+// exprNode is a parsed derived metric expression.
+type exprNode interface {
+	eval(vals map[string]float64) float64
+	inputs() []string
+}
+
+type exprNumber float64
+
+func (n exprNumber) eval(map[string]float64) float64 { return float64(n) }
+func (n exprNumber) inputs() []string                { return nil }
+
+type exprSensor string
+
+func (s exprSensor) eval(vals map[string]float64) float64 { return vals[string(s)] }
+func (s exprSensor) inputs() []string                     { return []string{string(s)} }
+
+type exprBinary struct {
+	op   byte
+	l, r exprNode
+}
+
+func (b exprBinary) eval(vals map[string]float64) float64 {
+	l, r := b.l.eval(vals), b.r.eval(vals)
+	switch b.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	}
+	return l / r
+}
+
+func (b exprBinary) inputs() []string { return mergeInputs(b.l, b.r) }
+
+type exprCall struct {
+	fn   string
+	args []exprNode
+}
+
+// exprFuncs are the functions an expression can call: abs of one value,
+// and min, max and avg of any number.
+var exprFuncs = map[string]bool{"abs": true, "min": true, "max": true, "avg": true}
+
+func (c exprCall) eval(vals map[string]float64) float64 {
+	v := c.args[0].eval(vals)
+	switch c.fn {
+	case "abs":
+		return math.Abs(v)
+	case "min":
+		for _, a := range c.args[1:] {
+			v = math.Min(v, a.eval(vals))
+		}
+	case "max":
+		for _, a := range c.args[1:] {
+			v = math.Max(v, a.eval(vals))
+		}
+	case "avg":
+		for _, a := range c.args[1:] {
+			v += a.eval(vals)
+		}
+		v /= float64(len(c.args))
+	}
+	return v
+}
+
+func (c exprCall) inputs() []string { return mergeInputs(c.args...) }
+
+// mergeInputs lists the sensors of the nodes once each, sorted.
+func mergeInputs(nodes ...exprNode) []string {
+	seen := map[string]bool{}
+	var list []string
+	for _, n := range nodes {
+		for _, in := range n.inputs() {
+			if !seen[in] {
+				seen[in] = true
+				list = append(list, in)
+			}
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// exprParser reads an expression: numbers, sensors by name, or in braces
+// when the name has other characters than letters, digits, '_' and '.',
+// + - * / with the usual precedence, parentheses and the exprFuncs.
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func parseExpr(s string) (exprNode, error) {
+	p := &exprParser{s: s}
+	n, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos+1)
+	}
+	if len(n.inputs()) == 0 {
+		return nil, fmt.Errorf("expr must use at least one sensor")
+	}
+	return n, nil
+}
+
+func (p *exprParser) skip() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// next consumes c if it comes next.
+func (p *exprParser) next(c byte) bool {
+	p.skip()
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) sum() (exprNode, error) {
+	n, err := p.product()
+	for err == nil {
+		var op byte
+		switch {
+		case p.next('+'):
+			op = '+'
+		case p.next('-'):
+			op = '-'
+		default:
+			return n, nil
+		}
+		var r exprNode
+		if r, err = p.product(); err == nil {
+			n = exprBinary{op: op, l: n, r: r}
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) product() (exprNode, error) {
+	n, err := p.unary()
+	for err == nil {
+		var op byte
+		switch {
+		case p.next('*'):
+			op = '*'
+		case p.next('/'):
+			op = '/'
+		default:
+			return n, nil
+		}
+		var r exprNode
+		if r, err = p.unary(); err == nil {
+			n = exprBinary{op: op, l: n, r: r}
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if p.next('-') {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return exprBinary{op: '-', l: exprNumber(0), r: n}, nil
+	}
+	return p.operand()
+}
+
+func identChar(c byte) bool {
+	return c == '_' || c == '.' || c < unicode.MaxASCII && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)))
+}
+
+func (p *exprParser) operand() (exprNode, error) {
+	p.skip()
+	if p.pos == len(p.s) {
+		return nil, fmt.Errorf("unexpected end of expr")
+	}
+	start := p.pos
+	switch c := p.s[p.pos]; {
+	case c == '(':
+		p.pos++
+		n, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.next(')') {
+			return nil, fmt.Errorf("missing ) for ( at %d", start+1)
+		}
+		return n, nil
+	case c == '{':
+		end := strings.IndexByte(p.s[p.pos:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("missing } for { at %d", start+1)
+		}
+		name := strings.TrimSpace(p.s[p.pos+1 : p.pos+end])
+		if name == "" {
+			return nil, fmt.Errorf("empty sensor name at %d", start+1)
+		}
+		p.pos += end + 1
+		return exprSensor(name), nil
+	case c >= '0' && c <= '9' || c == '.':
+		for p.pos < len(p.s) && (p.s[p.pos] >= '0' && p.s[p.pos] <= '9' || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.s[start:p.pos])
+		}
+		return exprNumber(v), nil
+	case identChar(c):
+		for p.pos < len(p.s) && identChar(p.s[p.pos]) {
+			p.pos++
+		}
+		name := p.s[start:p.pos]
+		if !p.next('(') {
+			return exprSensor(name), nil
+		}
+		if !exprFuncs[name] {
+			return nil, fmt.Errorf("unknown function %s", name)
+		}
+		var args []exprNode
+		for !p.next(')') {
+			if len(args) > 0 && !p.next(',') {
+				return nil, fmt.Errorf("expected , or ) in %s() at %d", name, p.pos+1)
+			}
+			a, err := p.sum()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+		}
+		if len(args) == 0 || name == "abs" && len(args) != 1 {
+			return nil, fmt.Errorf("wrong number of arguments to %s()", name)
+		}
+		return exprCall{fn: name, args: args}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos+1)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// volumeFree is the space available to piheat on the volume holding dir.
+func volumeFree(dir string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	r, _, err := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW").Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
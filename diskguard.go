@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskGuardConfig keeps the database volume from filling up. Below
+// min_free_mb the oldest readings are deleted until target_free_mb is
+// free, but never readings from the last keep_days.
+type DiskGuardConfig struct {
+	MinFreeMB    int64 `json:"min_free_mb"`
+	TargetFreeMB int64 `json:"target_free_mb"`
+	KeepDays     int   `json:"keep_days"`
+}
+
+func (c DiskGuardConfig) check() error {
+	if c.MinFreeMB < 0 {
+		return fmt.Errorf("min_free_mb must not be negative")
+	}
+	if c.MinFreeMB == 0 {
+		return nil
+	}
+	if c.TargetFreeMB < c.MinFreeMB {
+		return fmt.Errorf("target_free_mb must be at least min_free_mb")
+	}
+	if c.KeepDays < 1 {
+		return fmt.Errorf("keep_days must be at least 1")
+	}
+	return nil
+}
+
+// diskGuardInterval is how often free space is checked.
+const diskGuardInterval = time.Minute
+
+// diskGuard keeps the totals for /metrics. low is set once free space
+// fell below min_free_mb and has been alerted.
+var diskGuard struct {
+	sync.Mutex
+	available int64
+	deleted   int64
+	purges    int64
+	low       bool
+}
+
+// runDiskGuard checks free space every diskGuardInterval while
+// disk_guard.min_free_mb is set.
+func runDiskGuard() {
+	checkDiskSpace()
+	ticker := time.NewTicker(diskGuardInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkDiskSpace()
+	}
+}
+
+func checkDiskSpace() {
+	gc := config().DiskGuard
+	if gc.MinFreeMB <= 0 {
+		return
+	}
+	files, err := attachedFiles()
+	if err != nil {
+		log.Printf("Error checking disk space: %v", err)
+		return
+	}
+	avail, err := availableBytes(files)
+	if err != nil {
+		log.Printf("Error checking disk space: %v", err)
+		return
+	}
+	diskGuard.Lock()
+	diskGuard.available = avail
+	low := diskGuard.low
+	diskGuard.Unlock()
+
+	if avail >= gc.MinFreeMB<<20 {
+		if low {
+			log.Printf("Disk space guard: %d MB free again", avail>>20)
+			notifyDisk("Disk space low", "resolved", avail, gc)
+			diskGuard.Lock()
+			diskGuard.low = false
+			diskGuard.Unlock()
+		}
+		return
+	}
+
+	log.Printf("Disk space guard: %d MB free, below %d MB; deleting the oldest readings", avail>>20, gc.MinFreeMB)
+	readings, before, avail, err := emergencyRetention(files, gc, avail)
+	if err != nil {
+		log.Printf("Error in emergency retention: %v", err)
+	}
+	diskGuard.Lock()
+	diskGuard.available = avail
+	diskGuard.low = true
+	diskGuard.Unlock()
+	switch {
+	case readings > 0:
+		log.Printf("Disk space guard: deleted %d readings before %s, %d MB free", readings, before.Format("2006-01-02 15:04"), avail>>20)
+		notifyDisk(fmt.Sprintf("Emergency retention deleted %d readings before %s", readings, before.Format("2006-01-02 15:04")), "firing", avail, gc)
+	case !low:
+		log.Printf("Disk space guard: no readings older than %d days left to delete", gc.KeepDays)
+		notifyDisk("Disk space low", "firing", avail, gc)
+	}
+}
+
+// emergencyRetention deletes a day of the oldest readings at a time, and
+// the alert history with them, until target_free_mb is free or only the
+// last keep_days are left. It returns how many readings went, the end of
+// the range deleted and the space available afterwards.
+func emergencyRetention(files []dbFile, gc DiskGuardConfig, avail int64) (int64, time.Time, int64, error) {
+	floor := time.Now().AddDate(0, 0, -gc.KeepDays).UTC().Truncate(time.Second)
+	var deleted int64
+	var before time.Time
+	for avail < gc.TargetFreeMB<<20 {
+		var oldest sql.NullString
+		if err := db.QueryRow("SELECT MIN(timestamp) FROM temperature_readings").Scan(&oldest); err != nil {
+			return deleted, before, avail, err
+		}
+		if !oldest.Valid {
+			break
+		}
+		t, err := parseSQLiteTime(oldest.String)
+		if err != nil {
+			return deleted, before, avail, err
+		}
+		if !t.Before(floor) {
+			break
+		}
+		to := t.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		if to.After(floor) {
+			to = floor
+		}
+		p := purgeRange{To: to}
+		rec, err := executePurge(p, "disk_guard", fmt.Sprintf("%d MB free, below disk_guard.min_free_mb %d", avail>>20, gc.MinFreeMB))
+		if err != nil {
+			return deleted, before, avail, err
+		}
+		audit(auditDiskGuard, "", "data.purge", "", rec, nil)
+		deleted += rec.Readings
+		before = to
+		if err := reclaimFreePages(files); err != nil {
+			return deleted, before, avail, err
+		}
+		if avail, err = availableBytes(files); err != nil {
+			return deleted, before, avail, err
+		}
+	}
+	if deleted > 0 {
+		forgetPurgedSensors()
+		diskGuard.Lock()
+		diskGuard.deleted += deleted
+		diskGuard.purges++
+		diskGuard.Unlock()
+	}
+	return deleted, before, avail, nil
+}
+
+// availableBytes is the space the database can still grow into: what the
+// volume has free plus the free pages inside the database files, which
+// new readings reuse.
+func availableBytes(files []dbFile) (int64, error) {
+	if len(files) == 0 {
+		return 0, fmt.Errorf("no database file")
+	}
+	avail, err := volumeFree(filepath.Dir(files[0].path))
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		var pages, size int64
+		if err := db.QueryRow("PRAGMA " + f.schema + ".freelist_count").Scan(&pages); err != nil {
+			return 0, err
+		}
+		if err := db.QueryRow("PRAGMA " + f.schema + ".page_size").Scan(&size); err != nil {
+			return 0, err
+		}
+		avail += pages * size
+	}
+	return avail, nil
+}
+
+// reclaimFreePages returns the free pages of files set up for incremental
+// vacuum to the file system. A full VACUUM would need room for a copy of
+// the file, which a nearly full volume does not have.
+func reclaimFreePages(files []dbFile) error {
+	for _, f := range files {
+		fdb, err := sql.Open("sqlite3", f.path)
+		if err != nil {
+			return err
+		}
+		fdb.SetMaxOpenConns(1)
+		var mode int
+		err = fdb.QueryRow("PRAGMA auto_vacuum").Scan(&mode)
+		if err == nil && mode == 2 {
+			err = incrementalVacuum(fdb)
+		}
+		fdb.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.schema, err)
+		}
+	}
+	return nil
+}
+
+// notifyDisk tells the staleness notifiers what the guard did.
+func notifyDisk(what, state string, avail int64, gc DiskGuardConfig) {
+	notify(config().Staleness.Notifiers, Alert{
+		RuleName:  what,
+		Sensor:    "disk",
+		Condition: "disk",
+		Threshold: float64(gc.MinFreeMB),
+		Severity:  "critical",
+		Value:     float64(avail >> 20),
+		State:     state,
+		Time:      time.Now(),
+	})
+}
+
+// writeDiskGuardMetrics adds the disk space guard to /metrics.
+func writeDiskGuardMetrics(b *strings.Builder) {
+	if readOnly || config().DiskGuard.MinFreeMB <= 0 {
+		return
+	}
+	diskGuard.Lock()
+	defer diskGuard.Unlock()
+	b.WriteString("# HELP piheat_disk_available_bytes Space the database can grow into, free on its volume and inside its files.\n")
+	b.WriteString("# TYPE piheat_disk_available_bytes gauge\n")
+	fmt.Fprintf(b, "piheat_disk_available_bytes %d\n", diskGuard.available)
+	b.WriteString("# HELP piheat_disk_guard_purges_total Emergency retention runs since start.\n")
+	b.WriteString("# TYPE piheat_disk_guard_purges_total counter\n")
+	fmt.Fprintf(b, "piheat_disk_guard_purges_total %d\n", diskGuard.purges)
+	b.WriteString("# HELP piheat_disk_guard_deleted_readings_total Readings deleted by emergency retention since start.\n")
+	b.WriteString("# TYPE piheat_disk_guard_deleted_readings_total counter\n")
+	fmt.Fprintf(b, "piheat_disk_guard_deleted_readings_total %d\n", diskGuard.deleted)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// einkRow is one line of the e-ink page: a name, its latest value and,
+// for a zone, the setpoint and whether it is heating.
+type einkRow struct {
+	name, value, detail string
+	heating             bool
+}
+
+// einkPalette is black and white only, which png encodes at one bit per
+// pixel.
+var einkPalette = color.Palette{color.White, color.Black}
+
+// einkText draws s with the built-in bitmap font scaled up by scale, with
+// its top left corner at x, y, and returns its width. anchor 1 aligns its
+// end with x instead. The font has no degree sign, so a ring is drawn in
+// its place.
+func einkText(img *image.RGBA, s string, x, y, scale int, c color.Color, anchor float64) int {
+	face := basicfont.Face7x13
+	w := font.MeasureString(face, s).Round()
+	mask := image.NewAlpha(image.Rect(0, 0, w, face.Height))
+	d := &font.Drawer{Dst: mask, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+	for _, r := range s {
+		if r != '°' {
+			d.DrawString(string(r))
+			continue
+		}
+		at := d.Dot.X.Round()
+		for _, p := range [][2]int{{2, 1}, {3, 1}, {1, 2}, {4, 2}, {1, 3}, {4, 3}, {2, 4}, {3, 4}} {
+			mask.SetAlpha(at+p[0], p[1], color.Alpha{255})
+		}
+		d.Dot.X += fixed.I(face.Advance)
+	}
+	x -= int(float64(w*scale) * anchor)
+	for py := 0; py < face.Height; py++ {
+		for px := 0; px < w; px++ {
+			if mask.AlphaAt(px, py).A < 128 {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.Set(x+px*scale+dx, y+py*scale+dy, c)
+				}
+			}
+		}
+	}
+	return w * scale
+}
+
+// einkWidth is how wide einkText draws s.
+func einkWidth(s string, scale int) int {
+	return utf8.RuneCountInString(s) * basicfont.Face7x13.Advance * scale
+}
+
+// einkRows are the CPU, the outdoor sensor and each zone, with "--" for a
+// sensor without readings.
+func einkRows() []einkRow {
+	value := func(sensor string) string {
+		if v, _, ok := sensorsMonitor.lastValue(sensor); ok {
+			return formatReading(sensor, v) + "°C"
+		}
+		return "--"
+	}
+	rows := []einkRow{{name: "CPU", value: value("cpu")}}
+	if config().OutdoorSensor != "" {
+		rows = append(rows, einkRow{name: "Outdoor", value: value(config().OutdoorSensor)})
+	}
+	for _, z := range controller.statuses() {
+		row := einkRow{name: z.Zone, value: "--", heating: z.Heating}
+		if z.Temperature != nil {
+			row.value = formatReading(z.Sensor, *z.Temperature) + "°C"
+		}
+		// The target differs from the setpoint under a curve or override
+		if z.Target != nil {
+			row.detail = fmt.Sprintf("set %.1f°C", *z.Target)
+		} else if z.Setpoint != nil {
+			row.detail = fmt.Sprintf("set %.1f°C", *z.Setpoint)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// renderEink draws the status page in black and white: a header with the
+// time, a line per sensor and zone, and the day's chart of sensor below.
+// Text is scaled up to fill the rows, down to the plain font when there
+// are many.
+func renderEink(rows []einkRow, points []ChartDataPoint, sensor string, width, height int, now time.Time) *image.Paletted {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	black := color.Black
+
+	header := 13*2 + 12
+	if height < 240 {
+		header = 13 + 8
+	}
+	hs := (header - 8) / 13
+	draw.Draw(img, image.Rect(0, 0, width, header), image.Black, image.Point{}, draw.Src)
+	einkText(img, "piheat", 10, 4+hs, hs, color.White, 0)
+	stamp := now.Local().Format("Mon 2 Jan 15:04")
+	if einkWidth("piheat "+stamp, hs)+20 > width {
+		stamp = now.Local().Format("15:04")
+	}
+	einkText(img, stamp, width-10, 4+hs, hs, color.White, 1)
+
+	chartTop := height - height*35/100
+	if len(points) == 0 {
+		chartTop = height
+	}
+	body := chartTop - header - 8
+	// The largest text that fits every row, across and down
+	fits := func(scale int) bool {
+		if len(rows)*(13*scale+8) > body {
+			return false
+		}
+		for _, row := range rows {
+			w := einkWidth(row.name, scale) + einkWidth(row.value, scale) + 40
+			if row.heating {
+				w += einkWidth("HEAT", 1) + 12
+			}
+			if row.detail != "" {
+				w += einkWidth(row.detail, 1) + 10
+			}
+			if w > width {
+				return false
+			}
+		}
+		return true
+	}
+	scale := 3
+	for scale > 1 && !fits(scale) {
+		scale--
+	}
+	rowHeight := 13*scale + 8
+	y := header + 8
+	for _, row := range rows {
+		if y+rowHeight > chartTop {
+			break
+		}
+		x := 10 + einkText(img, row.name, 10, y+4, scale, black, 0)
+		if row.heating {
+			einkText(img, "HEAT", x+12, y+4+(scale-1)*13/2, 1, black, 0)
+		}
+		right := width - 10
+		if row.detail != "" {
+			right -= einkText(img, row.detail, right, y+4+(scale-1)*13, 1, black, 1) + 10
+		}
+		einkText(img, row.value, right, y+4, scale, black, 1)
+		for x := 10; x < width-10; x += 4 {
+			img.Set(x, y+rowHeight-1, black)
+		}
+		y += rowHeight
+	}
+
+	if len(points) > 0 {
+		l := newChartLayout(points, "day", width, height-chartTop)
+		l.top, l.bottom = chartTop+26, height-18
+		einkText(img, sensor+" - "+periodTitles["day"], 10, chartTop+4, 1, black, 0)
+		for _, v := range l.yTicks {
+			y := l.y(v)
+			for x := l.left; x <= l.right; x += 3 {
+				img.Set(x, y, black)
+			}
+			einkText(img, l.yLabel(v), l.left-6, y-6, 1, black, 1)
+		}
+		for i, t := range l.xTicks {
+			einkText(img, l.xLabel(t), l.x(t), height-15, 1, black, l.xAnchor(i))
+		}
+		for i := 0; i < len(points)-1; i++ {
+			drawLine(img, l.x(points[i].UnixTime), l.y(points[i].Temperature),
+				l.x(points[i+1].UnixTime), l.y(points[i+1].Temperature), black)
+		}
+		if len(points) == 1 {
+			y := l.y(points[0].Temperature)
+			drawLine(img, l.left, y, l.right, y, black)
+		}
+	}
+
+	out := image.NewPaletted(img.Bounds(), einkPalette)
+	for py := 0; py < height; py++ {
+		for px := 0; px < width; px++ {
+			if img.RGBAAt(px, py).R < 128 {
+				out.SetColorIndex(px, py, 1)
+			}
+		}
+	}
+	return out
+}
+
+// einkHandler serves /eink, the status page as a 1-bit PNG for e-paper
+// displays to fetch and show as is.
+func einkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	width, ok := sizeParam(w, q.Get("width"), "width", 800, 200, 2000)
+	if !ok {
+		return
+	}
+	height, ok := sizeParam(w, q.Get("height"), "height", 480, 100, 1500)
+	if !ok {
+		return
+	}
+	sensor := q.Get("sensor")
+	if sensor == "" {
+		sensor = "cpu"
+	}
+	now := time.Now()
+	var points []ChartDataPoint
+	if q.Get("chart") != "0" {
+		var err error
+		if points, err = chartData(r.Context(), sensor, "day", now); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		roundChartData(sensor, points)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(encodePNG(renderEink(einkRows(), points, sensor, width, height, now)))
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Kinds of actuator whose state changes are recorded.
+const (
+	actuatorHeater = "heater"
+	actuatorTRV    = "trv"
+)
+
+// energyMaxPeriods bounds the periods of an /api/energy response.
+const energyMaxPeriods = 1000
+
+// energyDefaultPeriods is how many periods /api/energy covers without from.
+var energyDefaultPeriods = map[string]int{"day": 30, "week": 12, "month": 12}
+
+// EnergyPeriod is an actuator's use in one day, week or month. Runtime is
+// in full-power hours: an hour with a valve half open counts as half an
+// hour.
+type EnergyPeriod struct {
+	Start        string   `json:"start"`
+	RuntimeHours float64  `json:"runtimeHours"`
+	EstimatedKWh *float64 `json:"estimatedKWh,omitempty"`
+	Cost         *float64 `json:"cost,omitempty"`
+}
+
+// ActuatorEnergy is one heater plug's or radiator valve's use between from
+// and to. Estimates need the actuator's watts in the config, unless the
+// plug measured its power, which is then Measured and used instead.
+type ActuatorEnergy struct {
+	Actuator     string         `json:"actuator"`
+	Kind         string         `json:"kind"`
+	Watts        float64        `json:"watts,omitempty"`
+	Measured     bool           `json:"measured,omitempty"`
+	RuntimeHours float64        `json:"runtimeHours"`
+	EstimatedKWh *float64       `json:"estimatedKWh,omitempty"`
+	Cost         *float64       `json:"cost,omitempty"`
+	Periods      []EnergyPeriod `json:"periods"`
+}
+
+// EnergyReport is the GET /api/energy response, with the totals of every
+// actuator per period. Costs follow the tariff's time-of-use bands.
+type EnergyReport struct {
+	From         time.Time        `json:"from"`
+	To           time.Time        `json:"to"`
+	Period       string           `json:"period"`
+	Currency     string           `json:"currency,omitempty"`
+	RuntimeHours float64          `json:"runtimeHours"`
+	EstimatedKWh float64          `json:"estimatedKWh"`
+	Cost         *float64         `json:"cost,omitempty"`
+	Periods      []EnergyPeriod   `json:"periods"`
+	Actuators    []ActuatorEnergy `json:"actuators"`
+}
+
+// initActuatorTables creates the log of actuator states. duty is 0 or 1
+// for a relay and the opening from 0 to 1 for a valve; NULL means unknown,
+// from when piheat stopped.
+func initActuatorTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS actuator_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actuator TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		duty REAL,
+		timestamp DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_actuator_events ON actuator_events(kind, actuator, timestamp);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// recordActuator logs an actuator's new state; a nil duty is unknown.
+func recordActuator(kind, name string, duty *float64, at time.Time) {
+	_, err := db.Exec("INSERT INTO actuator_events (actuator, kind, duty, timestamp) VALUES (?, ?, ?, ?)",
+		name, kind, duty, sqliteTime(at))
+	if err != nil {
+		log.Printf("Error saving %s %s state: %v", kind, name, err)
+	}
+}
+
+// stopActuators marks every actuator's state unknown from now, so the
+// time piheat is not running counts neither as on nor as off.
+func stopActuators() {
+	now := time.Now()
+	for _, h := range heaters {
+		recordActuator(actuatorHeater, h.name, nil, now)
+	}
+	for _, t := range trvs {
+		recordActuator(actuatorTRV, t.name, nil, now)
+	}
+}
+
+// actuatorWatts is the rated power of a configured actuator, 0 when it
+// has none.
+func actuatorWatts(kind, name string) float64 {
+	switch kind {
+	case actuatorHeater:
+		for _, h := range heaters {
+			if h.name == name {
+				return h.plug().Watts
+			}
+		}
+	case actuatorTRV:
+		for _, t := range trvs {
+			if t.name == name {
+				return t.cfg.Watts
+			}
+		}
+	}
+	return 0
+}
+
+type actuatorKey struct{ kind, name string }
+
+// actuatorRuntime adds up how long an actuator ran, weighted by duty, in
+// each period between the starts, the last one ending at to, and the same
+// weighted by the tariff's price for the cost. Its state comes from its
+// last event before the first start and its events since.
+func actuatorRuntime(ctx context.Context, key actuatorKey, starts []time.Time, to time.Time, bands []compiledPeriod) (hours, priced []float64, err error) {
+	defer timeQuery("actuator_runtime")()
+	rows, err := db.QueryContext(ctx, `SELECT duty, timestamp FROM actuator_events WHERE kind = ? AND actuator = ? AND timestamp < ?
+		AND timestamp >= COALESCE((SELECT MAX(timestamp) FROM actuator_events WHERE kind = ? AND actuator = ? AND timestamp <= ?), '')
+		ORDER BY timestamp, id`, key.kind, key.name, sqliteTime(to), key.kind, key.name, sqliteTime(starts[0]))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	type state struct {
+		duty *float64
+		at   time.Time
+	}
+	var states []state
+	for rows.Next() {
+		var s state
+		var at string
+		if err := rows.Scan(&s.duty, &at); err != nil {
+			return nil, nil, err
+		}
+		s.at, _ = parseSQLiteTime(at)
+		states = append(states, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	hours, priced = make([]float64, len(starts)), make([]float64, len(starts))
+	for i, s := range states {
+		if s.duty == nil || *s.duty == 0 {
+			continue
+		}
+		end := to
+		if i+1 < len(states) {
+			end = states[i+1].at
+		}
+		for p, start := range starts {
+			pEnd := to
+			if p+1 < len(starts) {
+				pEnd = starts[p+1]
+			}
+			from, until := s.at, end
+			if from.Before(start) {
+				from = start
+			}
+			if until.After(pEnd) {
+				until = pEnd
+			}
+			if until.After(from) {
+				hours[p] += *s.duty * until.Sub(from).Hours()
+				priced[p] += *s.duty * priceHours(bands, from, until)
+			}
+		}
+	}
+	return hours, priced, nil
+}
+
+// measuredEnergy adds up the energy a heater plug measured in each period
+// between the starts, the last one ending at to, from its recorded power,
+// and the same weighted by the tariff's price for the cost. Each reading
+// holds until the next, for maxUsageGap at most. ok is false without any
+// recorded power.
+func measuredEnergy(ctx context.Context, heater string, starts []time.Time, to time.Time, bands []compiledPeriod) (kwh, priced []float64, ok bool, err error) {
+	kwh, priced = make([]float64, len(starts)), make([]float64, len(starts))
+	add := func(watts float64, from, until time.Time) {
+		if until.After(to) {
+			until = to
+		}
+		for p, start := range starts {
+			pEnd := to
+			if p+1 < len(starts) {
+				pEnd = starts[p+1]
+			}
+			f, u := from, until
+			if f.Before(start) {
+				f = start
+			}
+			if u.After(pEnd) {
+				u = pEnd
+			}
+			if u.After(f) {
+				kwh[p] += watts / 1000 * u.Sub(f).Hours()
+				priced[p] += watts / 1000 * priceHours(bands, f, u)
+			}
+		}
+	}
+	var prev *StoredReading
+	rq := readingQuery{Sensor: heaterPowerSensor(heater), From: starts[0].Add(-maxUsageGap), To: to, Ascending: true}
+	err = eachReading(ctx, rq, func(rd StoredReading) error {
+		if prev != nil {
+			until := prev.Timestamp.Add(maxUsageGap)
+			if rd.Timestamp.Before(until) {
+				until = rd.Timestamp
+			}
+			add(prev.Temperature, prev.Timestamp, until)
+		}
+		prev, ok = &rd, true
+		return nil
+	})
+	if prev != nil {
+		add(prev.Temperature, prev.Timestamp, prev.Timestamp.Add(maxUsageGap))
+	}
+	return kwh, priced, ok, err
+}
+
+// energyReport works out the runtime, energy and cost of every actuator
+// with recorded states between from and to, by period.
+func energyReport(ctx context.Context, from, to time.Time, period string) (EnergyReport, error) {
+	rep := EnergyReport{From: from.UTC(), To: to.UTC(), Period: period, Actuators: []ActuatorEnergy{}}
+	if config().EnergyPrice > 0 {
+		rep.Currency = config().Currency
+	}
+	var starts []time.Time
+	for t := compareStart(period, from); t.Before(to); t = shiftPeriod(t, period, 1) {
+		starts = append(starts, t)
+	}
+	// The first period starts at from, so nothing before it is counted
+	starts[0] = from
+
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT kind, actuator FROM actuator_events WHERE timestamp < ?", sqliteTime(to))
+	if err != nil {
+		return rep, err
+	}
+	var keys []actuatorKey
+	for rows.Next() {
+		var k actuatorKey
+		if err := rows.Scan(&k.kind, &k.name); err != nil {
+			rows.Close()
+			return rep, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	// The last known state lasts until now, not into the future
+	end := to
+	if now := time.Now(); now.Before(end) {
+		end = now
+	}
+	bands := tariff()
+	total := make([]energyUse, len(starts))
+	var all energyUse
+	for _, k := range keys {
+		hours, priced, err := actuatorRuntime(ctx, k, starts, end, bands)
+		if err != nil {
+			return rep, err
+		}
+		a := ActuatorEnergy{Actuator: k.name, Kind: k.kind, Watts: actuatorWatts(k.kind, k.name), Periods: []EnergyPeriod{}}
+		var kwh, cost []float64
+		if k.kind == actuatorHeater {
+			if kwh, cost, a.Measured, err = measuredEnergy(ctx, k.name, starts, end, bands); err != nil {
+				return rep, err
+			}
+		}
+		var sum energyUse
+		for i := range hours {
+			u := energyUse{hours: hours[i], kwh: hours[i] * a.Watts / 1000, cost: priced[i] * a.Watts / 1000}
+			if a.Measured {
+				u.kwh, u.cost = kwh[i], cost[i]
+			}
+			a.Periods = append(a.Periods, u.period(compareStart(period, starts[i]), a.Watts > 0 || a.Measured))
+			sum.add(u)
+			total[i].add(u)
+		}
+		all.add(sum)
+		p := sum.period(time.Time{}, a.Watts > 0 || a.Measured)
+		a.RuntimeHours, a.EstimatedKWh, a.Cost = p.RuntimeHours, p.EstimatedKWh, p.Cost
+		rep.Actuators = append(rep.Actuators, a)
+	}
+	rep.Periods = make([]EnergyPeriod, len(starts))
+	for i, u := range total {
+		rep.Periods[i] = u.period(compareStart(period, starts[i]), true)
+	}
+	p := all.period(time.Time{}, true)
+	rep.RuntimeHours, rep.EstimatedKWh, rep.Cost = p.RuntimeHours, *p.EstimatedKWh, p.Cost
+	return rep, nil
+}
+
+// energyUse is what actuators used in a period, unrounded.
+type energyUse struct {
+	hours, kwh, cost float64
+}
+
+func (u *energyUse) add(o energyUse) {
+	u.hours += o.hours
+	u.kwh += o.kwh
+	u.cost += o.cost
+}
+
+// period rounds the use for the response. The estimates are left out
+// without watts, and the cost without energy_price.
+func (u energyUse) period(start time.Time, estimated bool) EnergyPeriod {
+	p := EnergyPeriod{RuntimeHours: roundEnergy(u.hours)}
+	if !start.IsZero() {
+		p.Start = start.Format("2006-01-02")
+	}
+	if estimated {
+		p.EstimatedKWh = floatPtr(roundEnergy(u.kwh))
+		if config().EnergyPrice > 0 {
+			p.Cost = floatPtr(math.Round(u.cost*100) / 100)
+		}
+	}
+	return p
+}
+
+// roundEnergy keeps hours and kWh to three decimals.
+func roundEnergy(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// energyHandler serves GET /api/energy.
+func energyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	period := q.Get("period")
+	if period == "" {
+		period = "day"
+	}
+	n, ok := energyDefaultPeriods[period]
+	if !ok {
+		http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+		return
+	}
+	to := time.Now()
+	from := shiftPeriod(compareStart(period, to), period, 1-n)
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	count := 0
+	for t := compareStart(period, from); t.Before(to); t = shiftPeriod(t, period, 1) {
+		if count++; count > energyMaxPeriods {
+			http.Error(w, fmt.Sprintf("At most %d periods; use a longer period", energyMaxPeriods), http.StatusBadRequest)
+			return
+		}
+	}
+	rep, err := energyReport(r.Context(), from, to, period)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// dutyOf is a relay state as a duty.
+func dutyOf(on bool) *float64 {
+	if on {
+		return floatPtr(1)
+	}
+	return floatPtr(0)
+}
+
+// positionDuty is a valve position in percent as a duty.
+func positionDuty(position float64) *float64 {
+	return floatPtr(math.Max(0, math.Min(position, 100)) / 100)
+}
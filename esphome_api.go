@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// esphomeAPIPort is where ESPHome's native API listens by default.
+	esphomeAPIPort = "6053"
+	// esphomeReconnect is how long to wait before reconnecting to a device.
+	esphomeReconnect = 10 * time.Second
+	// esphomePing is how often an idle connection is pinged, and
+	// esphomeSilence how long the device may send nothing before the
+	// connection is dropped.
+	esphomePing    = 20 * time.Second
+	esphomeSilence = time.Minute
+)
+
+// Message types of the ESPHome native API that piheat sends or handles,
+// from ESPHome's api.proto.
+const (
+	esphomeHelloRequest         = 1
+	esphomeHelloResponse        = 2
+	esphomeConnectRequest       = 3
+	esphomeConnectResponse      = 4
+	esphomeDisconnectRequest    = 5
+	esphomeDisconnectResponse   = 6
+	esphomePingRequest          = 7
+	esphomePingResponse         = 8
+	esphomeListEntitiesRequest  = 11
+	esphomeListSensor           = 16
+	esphomeListSwitch           = 17
+	esphomeListEntitiesDone     = 19
+	esphomeSubscribeStates      = 20
+	esphomeSensorState          = 25
+	esphomeSwitchState          = 26
+	esphomeSwitchCommandRequest = 33
+	esphomeGetTimeRequest       = 36
+	esphomeGetTimeResponse      = 37
+)
+
+// errESPHomeEncrypted is returned for a device whose API is encrypted,
+// which piheat does not speak.
+var errESPHomeEncrypted = errors.New("the device's API uses encryption, which piheat does not support; remove api encryption or use its web_server with an http:// url")
+
+// esphomeAPI is an ESPHome device reached over its native API, the
+// protobuf protocol Home Assistant uses, in plaintext. The connection
+// stays open: the device sends its relay and power sensor states as they
+// change, and the relay is switched over it.
+type esphomeAPI struct {
+	h    *heaterCheck
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// switchKey and powerKey are the keys of the relay and power sensor
+	// entities; a device without the power sensor has no powerKey.
+	switchKey, powerKey uint32
+	hasSwitch, hasPower bool
+	status              plugStatus
+	stated              bool
+	write               sync.Mutex
+}
+
+// esphomeDevices are the esphome heaters reached over the native API, by
+// url.
+var esphomeDevices = map[string]*esphomeAPI{}
+
+// esphomeDevice is the native API connection of an esphome heater, nil
+// for other heaters and those reached over HTTP or MQTT.
+func esphomeDevice(hc HeaterConfig) *esphomeAPI {
+	if hc.Type != "esphome" {
+		return nil
+	}
+	return esphomeDevices[hc.URL]
+}
+
+// esphomeAPIAddr is the host:port of a tcp:// url, with the default port
+// if it names none.
+func esphomeAPIAddr(url string) (string, error) {
+	hostport := strings.TrimPrefix(url, "tcp://")
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport, nil
+	}
+	if hostport == "" || strings.ContainsAny(hostport, "/?#") {
+		return "", fmt.Errorf("url must be tcp://host or tcp://host:port")
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), esphomeAPIPort), nil
+}
+
+func (a *esphomeAPI) run() {
+	for {
+		conn, err := net.DialTimeout("tcp", a.addr, 10*time.Second)
+		if err != nil {
+			log.Printf("Error connecting to ESPHome device %s: %v", a.h.name, err)
+			time.Sleep(esphomeReconnect)
+			continue
+		}
+		err = a.serve(conn)
+		a.mu.Lock()
+		a.conn, a.stated, a.status = nil, false, plugStatus{}
+		a.mu.Unlock()
+		conn.Close()
+		log.Printf("ESPHome device %s disconnected: %v", a.h.name, err)
+		time.Sleep(esphomeReconnect)
+	}
+}
+
+// serve logs in, finds the relay and power sensor, subscribes to their
+// states and handles the device's messages until the connection fails.
+func (a *esphomeAPI) serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	hello := protowire.AppendTag(nil, 1, protowire.BytesType)
+	hello = protowire.AppendString(hello, "piheat")
+	hello = protowire.AppendTag(hello, 2, protowire.VarintType)
+	hello = protowire.AppendVarint(hello, 1)
+	hello = protowire.AppendTag(hello, 3, protowire.VarintType)
+	hello = protowire.AppendVarint(hello, 9)
+	if err := a.send(conn, esphomeHelloRequest, hello); err != nil {
+		return err
+	}
+	if _, err := a.expect(conn, r, esphomeHelloResponse); err != nil {
+		return err
+	}
+	var login []byte
+	if pw := a.h.plug().Password; pw != "" {
+		login = protowire.AppendTag(nil, 1, protowire.BytesType)
+		login = protowire.AppendString(login, pw)
+	}
+	if err := a.send(conn, esphomeConnectRequest, login); err != nil {
+		return err
+	}
+	body, err := a.expect(conn, r, esphomeConnectResponse)
+	if err != nil {
+		return err
+	}
+	if esphomeField(body, 1) != nil && esphomeVarint(body, 1) != 0 {
+		return fmt.Errorf("invalid password")
+	}
+
+	hc := a.h.plug()
+	if err := a.send(conn, esphomeListEntitiesRequest, nil); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.hasSwitch, a.hasPower = false, false
+	a.mu.Unlock()
+	for done := false; !done; {
+		typ, body, err := a.receive(conn, r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case esphomeListSwitch, esphomeListSensor:
+			id, key := esphomeString(body, 1), esphomeFixed32(body, 2)
+			a.mu.Lock()
+			if typ == esphomeListSwitch && id == hc.Switch {
+				a.switchKey, a.hasSwitch = key, true
+			}
+			if typ == esphomeListSensor && id == hc.PowerSensor {
+				a.powerKey, a.hasPower = key, true
+			}
+			a.mu.Unlock()
+		case esphomeListEntitiesDone:
+			done = true
+		}
+	}
+	a.mu.Lock()
+	hasSwitch, hasPower := a.hasSwitch, a.hasPower
+	a.mu.Unlock()
+	if !hasSwitch {
+		return fmt.Errorf("no switch %q on the device", hc.Switch)
+	}
+	if err := a.send(conn, esphomeSubscribeStates, nil); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.conn = conn
+	a.mu.Unlock()
+	log.Printf("ESPHome device %s connected at %s (power sensor: %v)", a.h.name, a.addr, hasPower)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.keepAlive(conn, stop)
+	for {
+		typ, body, err := a.receive(conn, r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case esphomeSwitchState:
+			a.mu.Lock()
+			match := esphomeFixed32(body, 1) == a.switchKey
+			a.mu.Unlock()
+			if match {
+				on := esphomeVarint(body, 2) != 0
+				a.mu.Lock()
+				a.stated = true
+				a.mu.Unlock()
+				a.state(func(s *plugStatus) { s.relayOn = on })
+			}
+		case esphomeSensorState:
+			a.mu.Lock()
+			match := a.hasPower && esphomeFixed32(body, 1) == a.powerKey
+			a.mu.Unlock()
+			// No reading yet still shows the device has a meter
+			p := float64(math.Float32frombits(esphomeFixed32(body, 2)))
+			if esphomeVarint(body, 3) != 0 || math.IsNaN(p) {
+				p = 0
+			}
+			if match {
+				a.state(func(s *plugStatus) { s.power, s.hasPower = p, true })
+			}
+		case esphomeDisconnectRequest:
+			a.send(conn, esphomeDisconnectResponse, nil)
+			return fmt.Errorf("device closed the connection")
+		}
+	}
+}
+
+// state applies a state change the device sent, to the heater check and
+// to the status the self-test reads.
+func (a *esphomeAPI) state(apply func(*plugStatus)) {
+	a.mu.Lock()
+	apply(&a.status)
+	a.mu.Unlock()
+	a.h.update(apply)
+}
+
+func (a *esphomeAPI) keepAlive(conn net.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(esphomePing)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := a.send(conn, esphomePingRequest, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// send writes a plaintext frame: a zero byte, the length of the message
+// and its type as varints, and the message.
+func (a *esphomeAPI) send(conn net.Conn, typ uint64, msg []byte) error {
+	frame := []byte{0}
+	frame = protowire.AppendVarint(frame, uint64(len(msg)))
+	frame = protowire.AppendVarint(frame, typ)
+	frame = append(frame, msg...)
+	a.write.Lock()
+	defer a.write.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := conn.Write(frame)
+	return err
+}
+
+// receive reads the next frame, answering the pings and time requests the
+// device sends on its own.
+func (a *esphomeAPI) receive(conn net.Conn, r *bufio.Reader) (uint64, []byte, error) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(esphomeSilence))
+		preamble, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if preamble == 1 {
+			return 0, nil, errESPHomeEncrypted
+		}
+		if preamble != 0 {
+			return 0, nil, fmt.Errorf("not an ESPHome API frame")
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		typ, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		if size > 1<<16 {
+			return 0, nil, fmt.Errorf("message of %d bytes is too large", size)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return 0, nil, err
+		}
+		switch typ {
+		case esphomePingRequest:
+			err = a.send(conn, esphomePingResponse, nil)
+		case esphomeGetTimeRequest:
+			now := protowire.AppendTag(nil, 1, protowire.Fixed32Type)
+			now = protowire.AppendFixed32(now, uint32(time.Now().Unix()))
+			err = a.send(conn, esphomeGetTimeResponse, now)
+		default:
+			return typ, body, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// expect reads frames until one of type typ, during the login.
+func (a *esphomeAPI) expect(conn net.Conn, r *bufio.Reader, typ uint64) ([]byte, error) {
+	for {
+		got, body, err := a.receive(conn, r)
+		if err != nil {
+			return nil, err
+		}
+		if got == typ {
+			return body, nil
+		}
+		if got == esphomeDisconnectRequest {
+			return nil, fmt.Errorf("device closed the connection")
+		}
+	}
+}
+
+// waitState waits until the device is connected and has sent the relay's
+// state, and until ok accepts that state.
+func (a *esphomeAPI) waitState(timeout time.Duration, ok func(plugStatus) bool) (plugStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		a.mu.Lock()
+		st, stated := a.status, a.stated
+		a.mu.Unlock()
+		if stated && ok(st) {
+			return st, nil
+		}
+		if time.Now().After(deadline) {
+			if !stated {
+				return st, fmt.Errorf("not connected to %s", a.addr)
+			}
+			return st, fmt.Errorf("device did not confirm the relay state")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// plugStatus is the device's latest state, for the self-test, which runs
+// as the connection is made and so waits for it a little.
+func (a *esphomeAPI) plugStatus() (plugStatus, error) {
+	return a.waitState(10*time.Second, func(plugStatus) bool { return true })
+}
+
+// switchRelay sends the relay a command and waits for the device to
+// report the new state.
+func (a *esphomeAPI) switchRelay(on bool) error {
+	if _, err := a.plugStatus(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	conn, key := a.conn, a.switchKey
+	a.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("not connected to %s", a.addr)
+	}
+	msg := protowire.AppendTag(nil, 1, protowire.Fixed32Type)
+	msg = protowire.AppendFixed32(msg, key)
+	msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, protowire.EncodeBool(on))
+	if err := a.send(conn, esphomeSwitchCommandRequest, msg); err != nil {
+		return err
+	}
+	_, err := a.waitState(5*time.Second, func(st plugStatus) bool { return st.relayOn == on })
+	return err
+}
+
+// esphomeField returns the last value of field num in a message, raw, or
+// nil if it is missing.
+func esphomeField(msg []byte, num protowire.Number) []byte {
+	var found []byte
+	for len(msg) > 0 {
+		n, typ, l := protowire.ConsumeTag(msg)
+		if l < 0 {
+			return found
+		}
+		msg = msg[l:]
+		v := protowire.ConsumeFieldValue(n, typ, msg)
+		if v < 0 {
+			return found
+		}
+		if n == num {
+			found = msg[:v]
+		}
+		msg = msg[v:]
+	}
+	return found
+}
+
+func esphomeString(msg []byte, num protowire.Number) string {
+	s, _ := protowire.ConsumeString(esphomeField(msg, num))
+	return s
+}
+
+func esphomeFixed32(msg []byte, num protowire.Number) uint32 {
+	v, _ := protowire.ConsumeFixed32(esphomeField(msg, num))
+	return v
+}
+
+func esphomeVarint(msg []byte, num protowire.Number) uint64 {
+	v, _ := protowire.ConsumeVarint(esphomeField(msg, num))
+	return v
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ZoneExplanation is what /api/explain reports for a zone: the setpoint
+// it is held at and how that came about, the reading the latest decision
+// was made on, the decision, and what it asks of the heaters, valves and
+// boiler.
+type ZoneExplanation struct {
+	Zone          string          `json:"zone"`
+	Sensor        string          `json:"sensor"`
+	Temperature   *float64        `json:"temperature"`
+	TemperatureAt *time.Time      `json:"temperatureAt,omitempty"`
+	Setpoint      *float64        `json:"setpoint"`
+	SetpointSteps []SetpointStep  `json:"setpointSteps"`
+	Hysteresis    float64         `json:"hysteresis"`
+	Demand        bool            `json:"demand"`
+	Heating       bool            `json:"heating"`
+	Reason        string          `json:"reason"`
+	Why           string          `json:"why"`
+	Boiler        *BoilerStatus   `json:"boiler,omitempty"`
+	Actuators     []ActuatorState `json:"actuators"`
+}
+
+// ActuatorState is what the latest decision asks of one heater plug or
+// radiator valve.
+type ActuatorState struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Wants string `json:"wants"`
+}
+
+// Explanation is the /api/explain response.
+type Explanation struct {
+	Time    time.Time         `json:"time"`
+	Control string            `json:"control"`
+	Zones   []ZoneExplanation `json:"zones"`
+}
+
+func (c *controlLoop) explain() []ZoneExplanation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	boilers := map[string]*boilerState{}
+	for _, b := range c.boilers {
+		boilers[b.name] = b
+	}
+	list := make([]ZoneExplanation, 0, len(c.zones))
+	for _, z := range c.zones {
+		e := ZoneExplanation{Zone: z.name, Sensor: z.cfg.Sensor, SetpointSteps: append([]SetpointStep{}, z.steps...),
+			Hysteresis: z.cfg.Hysteresis, Demand: z.demand, Heating: z.heating, Reason: z.reason, Why: z.why}
+		if !z.tempAt.IsZero() {
+			t, at := roundReading(z.cfg.Sensor, z.temp), z.tempAt
+			e.Temperature, e.TemperatureAt = &t, &at
+		}
+		if z.hasTarget {
+			sp := z.target
+			e.Setpoint = &sp
+		}
+		if b, ok := boilers[z.cfg.Boiler]; ok {
+			e.Boiler = &BoilerStatus{Boiler: b.name, Heater: b.cfg.Heater, Firing: b.firing, Reason: b.reason, Flow: b.flow}
+			for _, bz := range b.zones {
+				e.Boiler.Zones = append(e.Boiler.Zones, bz.name)
+			}
+		}
+		e.Actuators = []ActuatorState{}
+		for _, r := range z.relays {
+			e.Actuators = append(e.Actuators, ActuatorState{Kind: "heater", Name: r.heater.name, Wants: onOff(z.valve)})
+		}
+		for _, t := range z.trvs {
+			a := ActuatorState{Kind: "trv", Name: t.name}
+			switch {
+			case t.cfg.Mode == "valve" && z.valve:
+				a.Wants = "position 100"
+			case t.cfg.Mode == "valve":
+				a.Wants = "position 0"
+			case z.hasTarget:
+				a.Wants = fmt.Sprintf("setpoint %.1f", z.target)
+			default:
+				a.Wants = "unchanged"
+			}
+			e.Actuators = append(e.Actuators, a)
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+// describeSetpoints adds who last set each zone's stored setpoint, from
+// the audit log, to the setpoint step.
+func describeSetpoints(zones []ZoneExplanation) {
+	for i := range zones {
+		for j := range zones[i].SetpointSteps {
+			step := &zones[i].SetpointSteps[j]
+			if step.Layer != "setpoint" {
+				continue
+			}
+			var actor, remote, at string
+			err := db.QueryRow(`SELECT actor, remote, timestamp FROM audit_log WHERE action = 'setpoint.set' AND target = ?
+				ORDER BY id DESC LIMIT 1`, zones[i].Zone).Scan(&actor, &remote, &at)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				log.Printf("Error querying database: %v", err)
+				continue
+			}
+			step.Detail = "set by " + actor
+			if actor == auditTRV {
+				step.Detail += " " + remote
+			}
+			if t, err := parseSQLiteTime(at); err == nil {
+				step.Detail += " at " + t.Local().Format("2006-01-02 15:04")
+			}
+		}
+	}
+}
+
+// explainHandler serves GET /api/explain.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	selfTest.Lock()
+	control := selfTest.report.Control
+	selfTest.Unlock()
+	e := Explanation{Time: time.Now().UTC().Truncate(time.Second), Control: control, Zones: controller.explain()}
+	describeSetpoints(e.Zones)
+	writeJSON(w, http.StatusOK, e)
+}
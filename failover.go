@@ -0,0 +1,577 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sourceReplica is the source of readings copied from the active hub,
+	// followed by its host.
+	sourceReplica = "replica:"
+	// failoverBuffer is how many readings a hub keeps for its peer to
+	// catch up on after missing a few heartbeats.
+	failoverBuffer = 10000
+	// failoverBatch bounds the readings in one sync response.
+	failoverBatch = 1000
+	// failoverStandby is the reason zones and boilers give while the peer
+	// has control.
+	failoverStandby = "standby for the failover peer"
+)
+
+// FailoverConfig pairs two hubs that control the same heating. The one
+// holding the higher term has control; the other copies its readings and
+// setpoints and takes over when it has not heard from it for
+// takeover_after. Role only decides which hub takes control when both
+// start together.
+type FailoverConfig struct {
+	Role          string   `json:"role"`
+	Peer          string   `json:"peer"`
+	Token         string   `json:"token"`
+	Heartbeat     Duration `json:"heartbeat"`
+	TakeoverAfter Duration `json:"takeover_after"`
+}
+
+func (c *FailoverConfig) check() error {
+	if c.Role != "primary" && c.Role != "standby" {
+		return fmt.Errorf("role must be primary or standby")
+	}
+	u, err := url.Parse(c.Peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("peer must be the other hub's URL, like http://pi-b:8082")
+	}
+	if c.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if c.Heartbeat.Duration <= 0 {
+		return fmt.Errorf("heartbeat must be positive")
+	}
+	if c.TakeoverAfter.Duration < 3*c.Heartbeat.Duration {
+		return fmt.Errorf("takeover_after must be at least three heartbeats")
+	}
+	return nil
+}
+
+// ReplicatedReading is a reading the active hub hands its peer.
+type ReplicatedReading struct {
+	Seq    int64     `json:"seq"`
+	Sensor string    `json:"sensor"`
+	Value  float64   `json:"value"`
+	Time   time.Time `json:"time"`
+}
+
+// FailoverSync is the answer to a peer's heartbeat: the hub's term and
+// whether it has control and, while it has, the readings recorded since
+// the peer's cursor and every setpoint. Run changes when the hub
+// restarts, which resets the cursor. Gap says readings were dropped from
+// the buffer before the peer fetched them.
+type FailoverSync struct {
+	Run       string              `json:"run"`
+	Term      int64               `json:"term"`
+	Active    bool                `json:"active"`
+	Seq       int64               `json:"seq"`
+	More      bool                `json:"more,omitempty"`
+	Gap       bool                `json:"gap,omitempty"`
+	Readings  []ReplicatedReading `json:"readings,omitempty"`
+	Setpoints []Setpoint          `json:"setpoints,omitempty"`
+}
+
+// FailoverStatus is what /api/failover reports.
+type FailoverStatus struct {
+	Role       string     `json:"role"`
+	Active     bool       `json:"active"`
+	Term       int64      `json:"term"`
+	Since      *time.Time `json:"since,omitempty"`
+	Peer       string     `json:"peer"`
+	PeerActive bool       `json:"peerActive"`
+	PeerTerm   int64      `json:"peerTerm"`
+	PeerSeen   *time.Time `json:"peerSeen,omitempty"`
+	PeerError  string     `json:"peerError,omitempty"`
+	Replicated int64      `json:"replicatedReadings"`
+	Takeovers  int64      `json:"takeovers"`
+}
+
+// failoverState is this hub's side of the pair. A hub starts without
+// control and only takes it once it knows the peer does not have it, so a
+// hub coming back after a failover cannot switch heaters against the one
+// that took over. Terms fence the two: a hub that sees its peer in control
+// with a higher term gives up control at once.
+type failoverState struct {
+	cfg FailoverConfig
+	run string
+
+	mu     sync.Mutex
+	term   int64
+	active bool
+	since  time.Time
+
+	peerTerm       int64
+	peerActive     bool
+	peerSeen       time.Time
+	peerError      string
+	lastActivePeer time.Time
+	peerRun        string
+	after          int64
+	peerLost       bool
+
+	buf       []ReplicatedReading
+	seq       int64
+	copied    int64
+	takeovers int64
+}
+
+// failover is nil unless the config pairs this hub with another.
+var failover *failoverState
+
+func initFailoverTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS failover (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		term INTEGER NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loadFailoverTerm() (int64, error) {
+	var term int64
+	err := db.QueryRow("SELECT term FROM failover WHERE id = 1").Scan(&term)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return term, err
+}
+
+func saveFailoverTerm(term int64) error {
+	_, err := db.Exec(`INSERT INTO failover (id, term) VALUES (1, ?)
+		ON CONFLICT(id) DO UPDATE SET term = excluded.term`, term)
+	return err
+}
+
+// setupFailover validates the failover section of the config.
+func setupFailover(c *FailoverConfig) error {
+	if c == nil {
+		return nil
+	}
+	fc := *c
+	if fc.Heartbeat.Duration == 0 {
+		fc.Heartbeat.Duration = 5 * time.Second
+	}
+	if fc.TakeoverAfter.Duration == 0 {
+		fc.TakeoverAfter.Duration = 30 * time.Second
+	}
+	fc.Peer = strings.TrimSuffix(fc.Peer, "/")
+	if err := fc.check(); err != nil {
+		return fmt.Errorf("failover: %v", err)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("failover: %v", err)
+	}
+	failover = &failoverState{cfg: fc, run: hex.EncodeToString(b)}
+	return nil
+}
+
+// start loads the term and starts the heartbeats, without control.
+func (f *failoverState) start() {
+	term, err := loadFailoverTerm()
+	if err != nil {
+		log.Printf("Error loading failover term: %v", err)
+	}
+	now := clock.Now()
+	f.mu.Lock()
+	f.term, f.lastActivePeer = term, now
+	f.mu.Unlock()
+	log.Printf("Failover: %s at term %d, waiting for %s before taking control", f.cfg.Role, term, f.cfg.Peer)
+	go f.loop()
+}
+
+// controlling reports whether this hub may switch heaters and valves:
+// always without failover, otherwise while it has control.
+func (f *failoverState) controlling() bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// record keeps a reading for the peer. The hub's own CPU is the peer's
+// business, and copied readings are not sent back.
+func (f *failoverState) record(r Reading) {
+	if f == nil || r.Source == sourceLocal || strings.HasPrefix(r.Source, sourceReplica) {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	f.buf = append(f.buf, ReplicatedReading{Seq: f.seq, Sensor: r.Sensor, Value: r.Value, Time: r.Time.UTC()})
+	if len(f.buf) > 2*failoverBuffer {
+		f.buf = append([]ReplicatedReading(nil), f.buf[len(f.buf)-failoverBuffer:]...)
+	}
+}
+
+// observePeer takes the peer's term and state, from its answer to a
+// heartbeat or from its own heartbeat.
+func (f *failoverState) observePeer(term int64, active bool, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.peerTerm, f.peerActive, f.peerSeen, f.peerError = term, active, now, ""
+	if f.peerLost {
+		f.peerLost = false
+		log.Printf("Failover: %s is reachable again", f.cfg.Peer)
+		f.notifyPeerLost("resolved", now)
+	}
+	if active {
+		f.lastActivePeer = now
+	}
+	switch {
+	case active && f.active && (term > f.term || term == f.term && f.cfg.Role == "standby"):
+		f.active = false
+		log.Printf("Failover: %s has control at term %d, giving up control at term %d", f.cfg.Peer, term, f.term)
+	case !active && !f.active && f.cfg.Role == "primary":
+		f.takeOver(now, "the standby does not have control", false)
+	}
+	if active && term > f.term {
+		f.term = term
+		if err := saveFailoverTerm(term); err != nil {
+			log.Printf("Error saving failover term: %v", err)
+		}
+	}
+}
+
+// takeOver gives this hub control with a term above any it has seen. It
+// is called with f.mu held.
+func (f *failoverState) takeOver(now time.Time, why string, alert bool) {
+	f.term = max64(f.term, f.peerTerm) + 1
+	if err := saveFailoverTerm(f.term); err != nil {
+		log.Printf("Error saving failover term: %v", err)
+	}
+	f.active, f.since = true, now
+	f.takeovers++
+	log.Printf("Failover: taking control at term %d: %s", f.term, why)
+	if alert {
+		go notify(config().Staleness.Notifiers, Alert{
+			RuleName:  "Failover",
+			Sensor:    f.cfg.Peer,
+			Condition: "failover",
+			Severity:  "critical",
+			Value:     float64(f.term),
+			State:     "firing",
+			Time:      now,
+		})
+	}
+}
+
+// notifyPeerLost tells the staleness notifiers that a hub in control has
+// lost its peer, or found it again. The peer takes control as well if it
+// is still running and only the link between the two failed, and both then
+// switch the heaters until they hear from each other again. It is called
+// with f.mu held.
+func (f *failoverState) notifyPeerLost(state string, now time.Time) {
+	go notify(config().Staleness.Notifiers, Alert{
+		RuleName:  "Failover",
+		Sensor:    f.cfg.Peer,
+		Condition: "failover-peer-lost",
+		Severity:  "warning",
+		Value:     float64(f.term),
+		State:     state,
+		Time:      now,
+	})
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (f *failoverState) loop() {
+	ticker := clock.NewTicker(f.cfg.Heartbeat.Duration)
+	defer ticker.Stop()
+	for {
+		for f.heartbeat() {
+		}
+		now := clock.Now()
+		f.mu.Lock()
+		if !f.active && now.Sub(f.lastActivePeer) >= f.cfg.TakeoverAfter.Duration {
+			why := fmt.Sprintf("no heartbeat from %s with control for %s", f.cfg.Peer, f.cfg.TakeoverAfter.Duration)
+			// A primary starting alone takes control as expected; anything
+			// else means the peer has failed
+			f.takeOver(now, why, f.takeovers > 0 || f.cfg.Role == "standby" || !f.peerSeen.IsZero())
+		} else if f.active && !f.peerLost && !f.peerSeen.IsZero() && now.Sub(f.peerSeen) >= f.cfg.TakeoverAfter.Duration {
+			f.peerLost = true
+			log.Printf("Failover: no contact with %s for %s; if it is still running it takes control too", f.cfg.Peer, f.cfg.TakeoverAfter.Duration)
+			f.notifyPeerLost("firing", now)
+		}
+		f.mu.Unlock()
+		<-ticker.C()
+	}
+}
+
+// heartbeat tells the peer this hub's term and state and copies what the
+// peer recorded while it has control. It reports whether the peer has more
+// readings waiting.
+func (f *failoverState) heartbeat() bool {
+	f.mu.Lock()
+	q := url.Values{
+		"term":   {strconv.FormatInt(f.term, 10)},
+		"active": {strconv.FormatBool(f.active)},
+		"run":    {f.peerRun},
+		"after":  {strconv.FormatInt(f.after, 10)},
+	}
+	f.mu.Unlock()
+	req, err := http.NewRequest(http.MethodGet, f.cfg.Peer+"/api/failover/sync?"+q.Encode(), nil)
+	if err != nil {
+		f.peerFailed(err)
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+f.cfg.Token)
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		f.peerFailed(err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		f.peerFailed(fmt.Errorf("%s", resp.Status))
+		return false
+	}
+	var s FailoverSync
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		f.peerFailed(err)
+		return false
+	}
+	f.observePeer(s.Term, s.Active, clock.Now())
+	return f.copy(s)
+}
+
+func (f *failoverState) peerFailed(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.peerError = err.Error()
+}
+
+// copy records the readings and setpoints of a peer that has control.
+// Sensors this hub hears from itself, such as over a shared MQTT broker,
+// keep their own readings.
+func (f *failoverState) copy(s FailoverSync) bool {
+	f.mu.Lock()
+	f.peerRun, f.after = s.Run, s.Seq
+	follow := s.Active && !f.active
+	f.mu.Unlock()
+	if !follow {
+		return false
+	}
+	if s.Gap {
+		log.Printf("Failover: some readings from %s were missed", f.cfg.Peer)
+	}
+	source := sourceReplica + hostOf(f.cfg.Peer)
+	var copied int64
+	for _, rd := range s.Readings {
+		if f.ownSensor(rd.Sensor) {
+			continue
+		}
+		at := rd.Time
+		controller.observe(rd.Sensor, rd.Value, at)
+		if err := saveTemperature(rd.Sensor, rd.Value, source, at); err != nil {
+			log.Printf("Error saving temperature to database: %v", err)
+			queueReading(rd.Sensor, rd.Value, source, at, err)
+		}
+		observeReading(rd.Sensor, rd.Value, at)
+		sensorsMonitor.observe(rd.Sensor, rd.Value, source, at)
+		publishReading(Reading{Sensor: rd.Sensor, Value: rd.Value, Time: at, Source: source})
+		copied++
+	}
+	f.mu.Lock()
+	f.copied += copied
+	f.mu.Unlock()
+
+	current := map[string]float64{}
+	if list, err := listSetpoints(); err == nil {
+		for _, sp := range list {
+			current[sp.Zone] = sp.Temperature
+		}
+	}
+	for _, sp := range s.Setpoints {
+		if v, ok := current[sp.Zone]; ok && math.Abs(v-sp.Temperature) < 0.05 {
+			continue
+		}
+		if _, err := setSetpoint(sp.Zone, sp.Temperature); err != nil {
+			log.Printf("Error saving setpoint from %s: %v", f.cfg.Peer, err)
+		}
+	}
+	return s.More
+}
+
+// ownSensor reports whether this hub recently had a reading of sensor
+// that did not come from the peer.
+func (f *failoverState) ownSensor(sensor string) bool {
+	sensorsMonitor.mu.Lock()
+	defer sensorsMonitor.mu.Unlock()
+	st, ok := sensorsMonitor.sensors[sensor]
+	return ok && !strings.HasPrefix(st.source, sourceReplica) && clock.Now().Sub(st.lastSeen) < f.cfg.TakeoverAfter.Duration
+}
+
+func hostOf(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		return u.Host
+	}
+	return rawURL
+}
+
+// sync answers a peer's heartbeat from its cursor.
+func (f *failoverState) sync(run string, after int64) FailoverSync {
+	f.mu.Lock()
+	s := FailoverSync{Run: f.run, Term: f.term, Active: f.active, Seq: f.seq}
+	// A peer that just started or lost track of this run only follows
+	// from now on; after a restart here everything recorded is new to it
+	if !f.active || run == "" {
+		f.mu.Unlock()
+		return s
+	}
+	if run != f.run {
+		after = 0
+	}
+	first := f.seq - int64(len(f.buf)) + 1
+	if after+1 < first {
+		s.Gap, after = true, first-1
+	}
+	start := int(after + 1 - first)
+	end := start + failoverBatch
+	if end > len(f.buf) {
+		end = len(f.buf)
+	}
+	s.Readings = append([]ReplicatedReading(nil), f.buf[start:end]...)
+	s.More = end < len(f.buf)
+	if len(s.Readings) > 0 {
+		s.Seq = s.Readings[len(s.Readings)-1].Seq
+	}
+	f.mu.Unlock()
+	if list, err := listSetpoints(); err == nil {
+		s.Setpoints = list
+	} else {
+		log.Printf("Error querying database: %v", err)
+	}
+	return s
+}
+
+// failoverSyncHandler serves GET /api/failover/sync, the heartbeat the
+// peer sends with the failover token.
+func failoverSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if failover == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(failover.cfg.Token)) != 1 {
+		http.Error(w, "Invalid failover token", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	term, err := strconv.ParseInt(q.Get("term"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid term", http.StatusBadRequest)
+		return
+	}
+	after, _ := strconv.ParseInt(q.Get("after"), 10, 64)
+	failover.observePeer(term, q.Get("active") == "true", clock.Now())
+	writeJSON(w, http.StatusOK, failover.sync(q.Get("run"), after))
+}
+
+func (f *failoverState) status() FailoverStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := FailoverStatus{Role: f.cfg.Role, Active: f.active, Term: f.term, Peer: f.cfg.Peer, PeerActive: f.peerActive,
+		PeerTerm: f.peerTerm, PeerError: f.peerError, Replicated: f.copied, Takeovers: f.takeovers}
+	if f.active {
+		since := f.since.UTC()
+		s.Since = &since
+	}
+	if !f.peerSeen.IsZero() {
+		seen := f.peerSeen.UTC()
+		s.PeerSeen = &seen
+	}
+	return s
+}
+
+// failoverHandler serves GET /api/failover.
+func failoverHandler(w http.ResponseWriter, r *http.Request) {
+	if failover == nil {
+		http.Error(w, "Failover is not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, failover.status())
+}
+
+// failoverTakeoverHandler serves POST /api/admin/failover/takeover, which
+// moves control to this hub, for example back to the primary once it has
+// been repaired. The peer gives up control at its next heartbeat.
+func failoverTakeoverHandler(w http.ResponseWriter, r *http.Request) {
+	if failover == nil {
+		http.Error(w, "Failover is not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	failover.mu.Lock()
+	old := failover.term
+	if !failover.active {
+		failover.takeOver(clock.Now(), "requested over the API", false)
+	}
+	failover.mu.Unlock()
+	s := failover.status()
+	auditRequest(r, "failover.takeover", failover.cfg.Peer, old, s.Term)
+	writeJSON(w, http.StatusOK, s)
+}
+
+// writeFailoverMetrics adds the failover state to /metrics.
+func writeFailoverMetrics(b *strings.Builder) {
+	if failover == nil {
+		return
+	}
+	s := failover.status()
+	active := 0
+	if s.Active {
+		active = 1
+	}
+	b.WriteString("# HELP piheat_failover_active Whether this hub has heating control.\n")
+	b.WriteString("# TYPE piheat_failover_active gauge\n")
+	fmt.Fprintf(b, "piheat_failover_active %d\n", active)
+	b.WriteString("# HELP piheat_failover_term Failover term this hub is at.\n")
+	b.WriteString("# TYPE piheat_failover_term gauge\n")
+	fmt.Fprintf(b, "piheat_failover_term %d\n", s.Term)
+	b.WriteString("# HELP piheat_failover_replicated_readings_total Readings copied from the peer while it had control.\n")
+	b.WriteString("# TYPE piheat_failover_replicated_readings_total counter\n")
+	fmt.Fprintf(b, "piheat_failover_replicated_readings_total %d\n", s.Replicated)
+	b.WriteString("# HELP piheat_failover_takeovers_total Times this hub took heating control.\n")
+	b.WriteString("# TYPE piheat_failover_takeovers_total counter\n")
+	fmt.Fprintf(b, "piheat_failover_takeovers_total %d\n", s.Takeovers)
+}
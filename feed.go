@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Feed sizes: alerts are capped by count, summaries by days.
+const (
+	feedAlerts = 50
+	feedDays   = 14
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title    string       `xml:"title"`
+	ID       string       `xml:"id"`
+	Updated  string       `xml:"updated"`
+	Link     atomLink     `xml:"link"`
+	Category atomCategory `xml:"category"`
+	Content  atomContent  `xml:"content"`
+	updated  time.Time
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// dailySummary is one sensor's readings over one local calendar day.
+type dailySummary struct {
+	Day           string
+	Sensor        string
+	Min, Max, Avg float64
+	Readings      int
+}
+
+// feedBaseURL is the absolute address links in the feed point to:
+// public_url when set, otherwise the address the feed was requested on.
+func feedBaseURL(r *http.Request) string {
+	if base := dashboardURL(); base != "" {
+		return base
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + basePath
+}
+
+// dailySummaries returns min/max/avg per sensor for the local days completed
+// by now, going back feedDays days, newest first.
+func dailySummaries(ctx context.Context, sensor string, now time.Time) ([]dailySummary, error) {
+	defer timeQuery("daily_summaries")()
+	now = now.Local()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	query := `SELECT date(timestamp, 'localtime') AS day, sensor, MIN(temperature), MAX(temperature), AVG(temperature), COUNT(*)
+		FROM temperature_readings
+		WHERE timestamp >= ? AND timestamp < ?`
+	args := []interface{}{sqliteTime(today.AddDate(0, 0, -feedDays)), sqliteTime(today)}
+	if sensor != "" {
+		query += " AND sensor = ?"
+		args = append(args, sensor)
+	}
+	query += " GROUP BY day, sensor ORDER BY day DESC, sensor"
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []dailySummary
+	for rows.Next() {
+		var d dailySummary
+		if err := rows.Scan(&d.Day, &d.Sensor, &d.Min, &d.Max, &d.Avg, &d.Readings); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func recentAlertEvents(ctx context.Context, sensor string) ([]AlertEvent, error) {
+	defer timeQuery("recent_alerts")()
+	query := "SELECT " + alertEventColumns + " FROM alert_events"
+	var args []interface{}
+	if sensor != "" {
+		query += " WHERE sensor = ?"
+		args = append(args, sensor)
+	}
+	query += fmt.Sprintf(" ORDER BY fired_at DESC, id DESC LIMIT %d", feedAlerts)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []AlertEvent
+	for rows.Next() {
+		e, err := scanAlertEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func alertEntry(base string, e AlertEvent) atomEntry {
+	a := Alert{RuleName: e.RuleName, Sensor: e.Sensor, Condition: e.Condition, Threshold: e.Threshold,
+		Severity: e.Severity, Value: e.Value, State: "firing"}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<p>%s</p><ul><li>Fired: %s</li>", html.EscapeString(a.Summary()), e.FiredAt.Local().Format("2006-01-02 15:04:05"))
+	updated := e.FiredAt
+	title := a.Summary()
+	if e.ResolvedAt != nil {
+		updated = *e.ResolvedAt
+		title += " (resolved)"
+		fmt.Fprintf(&b, "<li>Resolved: %s", e.ResolvedAt.Local().Format("2006-01-02 15:04:05"))
+		if e.ResolvedValue != nil {
+			fmt.Fprintf(&b, " at %s", a.formatValue(*e.ResolvedValue))
+		}
+		b.WriteString("</li>")
+	}
+	if e.AcknowledgedAt != nil {
+		fmt.Fprintf(&b, "<li>Acknowledged by %s at %s</li>", html.EscapeString(e.AcknowledgedBy), e.AcknowledgedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	b.WriteString("</ul>")
+	return atomEntry{
+		Title:    title,
+		ID:       fmt.Sprintf("%s/api/alerts/%d", base, e.ID),
+		Link:     atomLink{Href: base + "/"},
+		Category: atomCategory{Term: "alert"},
+		Content:  atomContent{Type: "html", Body: b.String()},
+		updated:  updated,
+	}
+}
+
+// summaryEntries groups the daily summaries into one entry per day, dated
+// at the end of that day.
+func summaryEntries(base string, days []dailySummary) []atomEntry {
+	var entries []atomEntry
+	for i := 0; i < len(days); {
+		day := days[i].Day
+		var b strings.Builder
+		b.WriteString("<table><tr><th>Sensor</th><th>Min</th><th>Max</th><th>Avg</th><th>Readings</th></tr>")
+		for ; i < len(days) && days[i].Day == day; i++ {
+			d := days[i]
+			fmt.Fprintf(&b, "<tr><td>%s</td><td>%s°C</td><td>%s°C</td><td>%s°C</td><td>%d</td></tr>",
+				html.EscapeString(d.Sensor), formatReading(d.Sensor, d.Min), formatReading(d.Sensor, d.Max), formatReading(d.Sensor, d.Avg), d.Readings)
+		}
+		b.WriteString("</table>")
+		start, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, atomEntry{
+			Title:    "Daily summary for " + start.Format("Monday, 2 January 2006"),
+			ID:       base + "/feed.xml#summary-" + day,
+			Link:     atomLink{Href: base + "/"},
+			Category: atomCategory{Term: "summary"},
+			Content:  atomContent{Type: "html", Body: b.String()},
+			updated:  start.AddDate(0, 0, 1),
+		})
+	}
+	return entries
+}
+
+// feedHandler serves /feed.xml, an Atom feed of recent alerts and daily
+// min/max/avg summaries, optionally limited to one sensor.
+func feedHandler(w http.ResponseWriter, r *http.Request) {
+	sensor := r.URL.Query().Get("sensor")
+	events, err := recentAlertEvents(r.Context(), sensor)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	days, err := dailySummaries(r.Context(), sensor, time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	base := feedBaseURL(r)
+	entries := summaryEntries(base, days)
+	for _, e := range events {
+		entries = append(entries, alertEntry(base, e))
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].updated.After(entries[j].updated) })
+
+	self := base + "/feed.xml"
+	title := "piheat alerts and daily summaries"
+	if sensor != "" {
+		self += "?sensor=" + url.QueryEscape(sensor)
+		title += " for " + sensor
+	}
+	feed := atomFeed{
+		Title:  title,
+		ID:     self,
+		Links:  []atomLink{{Href: self, Rel: "self", Type: "application/atom+xml"}, {Href: base + "/"}},
+		Author: atomAuthor{Name: "piheat"},
+	}
+	updated := time.Unix(0, 0)
+	for i := range entries {
+		entries[i].Updated = entries[i].updated.UTC().Format(time.RFC3339)
+		if entries[i].updated.After(updated) {
+			updated = entries[i].updated
+		}
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	feed.Entries = entries
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+}
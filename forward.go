@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+)
+
+// Reading is a single recorded sensor value as handed to forwarders.
+type Reading struct {
+	Sensor string
+	Value  float64
+	Time   time.Time
+	Source string
+}
+
+// Forwarder pushes batches of readings to an external system.
+type Forwarder interface {
+	Forward(readings []Reading) error
+}
+
+// Purger is implemented by forwarders whose destination can delete data it
+// has already received. It is called when data is purged locally.
+type Purger interface {
+	Purge(p purgeRange) error
+}
+
+// forwarderQueueSize bounds how many readings are kept per forwarder while
+// its destination is unreachable; the oldest are dropped first.
+const forwarderQueueSize = 10000
+
+type forwarderRunner struct {
+	name      string
+	forwarder Forwarder
+	sensors   []string
+	interval  time.Duration
+	in        chan Reading
+	purges    chan purgeRange
+}
+
+var forwarders []*forwarderRunner
+
+func setupForwarders(configs map[string]ForwarderConfig) error {
+	var runners []*forwarderRunner
+	for name, fc := range configs {
+		f, err := newForwarder(fc)
+		if err != nil {
+			return fmt.Errorf("forwarder %q: %v", name, err)
+		}
+		for _, s := range fc.Sensors {
+			if _, err := path.Match(s, ""); err != nil {
+				return fmt.Errorf("forwarder %q: invalid sensor selector %q", name, s)
+			}
+		}
+		interval := fc.Interval.Duration
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		runners = append(runners, &forwarderRunner{
+			name:      name,
+			forwarder: f,
+			sensors:   fc.Sensors,
+			interval:  interval,
+			in:        make(chan Reading, 256),
+			purges:    make(chan purgeRange, 16),
+		})
+	}
+	forwarders = runners
+	return nil
+}
+
+func newForwarder(fc ForwarderConfig) (Forwarder, error) {
+	switch fc.Type {
+	case "zabbix":
+		return newZabbixForwarder(fc)
+	case "emoncms":
+		return newEmonCMSForwarder(fc)
+	case "domoticz":
+		return newDomoticzForwarder(fc)
+	case "openhab":
+		return newOpenHABForwarder(fc)
+	default:
+		return nil, fmt.Errorf("unknown type %q", fc.Type)
+	}
+}
+
+func startForwarders() {
+	for _, f := range forwarders {
+		go f.run()
+	}
+}
+
+// forwardReading hands a reading to every forwarder interested in its
+// sensor without blocking the caller.
+func forwardReading(r Reading) {
+	for _, f := range forwarders {
+		if !f.wants(r.Sensor) {
+			continue
+		}
+		select {
+		case f.in <- r:
+		default:
+			log.Printf("Forwarder %q is falling behind, dropping reading", f.name)
+		}
+	}
+}
+
+// forwarderPurgeModes reports, per forwarder that receives data in the
+// range, whether a purge also deletes it remotely or only drops readings
+// still queued for sending.
+func forwarderPurgeModes(p purgeRange) map[string]string {
+	modes := map[string]string{}
+	for _, f := range forwarders {
+		if p.Sensor != "" && !f.wants(p.Sensor) {
+			continue
+		}
+		if _, ok := f.forwarder.(Purger); ok {
+			modes[f.name] = "remote-delete"
+		} else {
+			modes[f.name] = "queue-only"
+		}
+	}
+	return modes
+}
+
+// purgeForwardTimeout bounds how long a purge waits for a forwarder whose
+// tombstone queue is full, e.g. while a slow flush holds its loop.
+const purgeForwardTimeout = 10 * time.Second
+
+// purgeForwarded sends a tombstone for the range to every forwarder. It
+// gives up on a forwarder that does not take it before ctx ends or
+// purgeForwardTimeout passes, and returns the names of those.
+func purgeForwarded(ctx context.Context, p purgeRange) []string {
+	ctx, cancel := context.WithTimeout(ctx, purgeForwardTimeout)
+	defer cancel()
+	var missed []string
+	for _, f := range forwarders {
+		if p.Sensor != "" && !f.wants(p.Sensor) {
+			continue
+		}
+		select {
+		case f.purges <- p:
+		case <-ctx.Done():
+			log.Printf("Forwarder %q did not take the purge tombstone: %v", f.name, ctx.Err())
+			missed = append(missed, f.name)
+		}
+	}
+	return missed
+}
+
+func (f *forwarderRunner) wants(sensor string) bool {
+	if len(f.sensors) == 0 {
+		return true
+	}
+	for _, s := range f.sensors {
+		if ok, _ := path.Match(s, sensor); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// run batches readings and flushes them every interval. Failed batches are
+// kept and retried with the next flush. Tombstones remove matching readings
+// from the queue and, where supported, from the destination.
+func (f *forwarderRunner) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	var pending []Reading
+	for {
+		select {
+		case r := <-f.in:
+			pending = append(pending, r)
+			if len(pending) > forwarderQueueSize {
+				pending = pending[len(pending)-forwarderQueueSize:]
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+			if err := f.forwarder.Forward(pending); err != nil {
+				log.Printf("Error forwarding %d readings to %q: %v", len(pending), f.name, err)
+				continue
+			}
+			pending = nil
+		case p := <-f.purges:
+			kept := pending[:0]
+			for _, r := range pending {
+				if !p.contains(r) {
+					kept = append(kept, r)
+				}
+			}
+			pending = kept
+			if purger, ok := f.forwarder.(Purger); ok {
+				if err := purger.Purge(p); err != nil {
+					log.Printf("Error purging data from %q: %v", f.name, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type EmonCMSInput struct {
+	Node string `json:"node,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// emoncmsForwarder posts readings to the EmonCMS input API. Each sensor is
+// sent as input Key on Node, defaulting to the sensor name on the
+// forwarder's node.
+type emoncmsForwarder struct {
+	url    string
+	apiKey string
+	node   string
+	inputs map[string]EmonCMSInput
+}
+
+func newEmonCMSForwarder(fc ForwarderConfig) (*emoncmsForwarder, error) {
+	if fc.URL == "" {
+		return nil, fmt.Errorf("emoncms requires url")
+	}
+	if fc.APIKey == "" {
+		return nil, fmt.Errorf("emoncms requires api_key (the read & write key)")
+	}
+	node := fc.Node
+	if node == "" {
+		node = "piheat"
+	}
+	return &emoncmsForwarder{
+		url:    strings.TrimSuffix(fc.URL, "/"),
+		apiKey: fc.APIKey,
+		node:   node,
+		inputs: fc.Inputs,
+	}, nil
+}
+
+func (e *emoncmsForwarder) input(sensor string) (node, key string) {
+	in := e.inputs[sensor]
+	node, key = in.Node, in.Key
+	if node == "" {
+		node = e.node
+	}
+	if key == "" {
+		key = sensor
+	}
+	return node, key
+}
+
+// Forward sends the batch with one input/bulk call, where each entry is
+// [unix time, node, {key: value}].
+func (e *emoncmsForwarder) Forward(readings []Reading) error {
+	data := make([][]interface{}, 0, len(readings))
+	for _, r := range readings {
+		node, key := e.input(r.Sensor)
+		data = append(data, []interface{}{r.Time.Unix(), node, map[string]float64{key: r.Value}})
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return postForm(e.url+"/input/bulk", map[string]string{"Authorization": "Bearer " + e.apiKey},
+		url.Values{"data": {string(payload)}})
+}
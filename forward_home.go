@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latestPerSensor reduces a batch to the newest reading of each sensor, for
+// destinations that only hold a current state.
+func latestPerSensor(readings []Reading) []Reading {
+	index := map[string]int{}
+	var latest []Reading
+	for _, r := range readings {
+		if i, ok := index[r.Sensor]; ok {
+			if !r.Time.Before(latest[i].Time) {
+				latest[i] = r
+			}
+			continue
+		}
+		index[r.Sensor] = len(latest)
+		latest = append(latest, r)
+	}
+	return latest
+}
+
+// domoticzForwarder updates Domoticz virtual temperature devices through
+// the JSON API. Sensors without an idx mapping are skipped.
+type domoticzForwarder struct {
+	url      string
+	username string
+	password string
+	idx      map[string]int
+}
+
+func newDomoticzForwarder(fc ForwarderConfig) (*domoticzForwarder, error) {
+	if fc.URL == "" {
+		return nil, fmt.Errorf("domoticz requires url")
+	}
+	if len(fc.Idx) == 0 {
+		return nil, fmt.Errorf("domoticz requires idx mapping sensors to device idx")
+	}
+	return &domoticzForwarder{
+		url:      strings.TrimSuffix(fc.URL, "/"),
+		username: fc.Username,
+		password: fc.Password,
+		idx:      fc.Idx,
+	}, nil
+}
+
+func (d *domoticzForwarder) Forward(readings []Reading) error {
+	for _, r := range latestPerSensor(readings) {
+		idx, ok := d.idx[r.Sensor]
+		if !ok {
+			continue
+		}
+		q := url.Values{
+			"type":   {"command"},
+			"param":  {"udevice"},
+			"idx":    {strconv.Itoa(idx)},
+			"nvalue": {"0"},
+			"svalue": {strconv.FormatFloat(r.Value, 'f', 2, 64)},
+		}
+		target := d.url + "/json.htm?" + q.Encode()
+		err := sendRequest(func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodGet, target, nil)
+			if err != nil {
+				return nil, err
+			}
+			if d.username != "" {
+				req.SetBasicAuth(d.username, d.password)
+			}
+			return req, nil
+		})
+		if err != nil {
+			return fmt.Errorf("sensor %s: %v", r.Sensor, err)
+		}
+	}
+	return nil
+}
+
+// openHABForwarder sets the state of openHAB Number items through the REST
+// API. Sensors without an item mapping are skipped.
+type openHABForwarder struct {
+	url   string
+	token string
+	items map[string]string
+}
+
+func newOpenHABForwarder(fc ForwarderConfig) (*openHABForwarder, error) {
+	if fc.URL == "" {
+		return nil, fmt.Errorf("openhab requires url")
+	}
+	if len(fc.Items) == 0 {
+		return nil, fmt.Errorf("openhab requires items mapping sensors to item names")
+	}
+	return &openHABForwarder{
+		url:   strings.TrimSuffix(fc.URL, "/"),
+		token: fc.Token,
+		items: fc.Items,
+	}, nil
+}
+
+func (o *openHABForwarder) Forward(readings []Reading) error {
+	for _, r := range latestPerSensor(readings) {
+		item, ok := o.items[r.Sensor]
+		if !ok {
+			continue
+		}
+		target := o.url + "/rest/items/" + url.PathEscape(item) + "/state"
+		state := strconv.FormatFloat(r.Value, 'f', -1, 64) + " °C"
+		err := sendRequest(func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPut, target, strings.NewReader(state))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			if o.token != "" {
+				req.Header.Set("Authorization", "Bearer "+o.token)
+			}
+			return req, nil
+		})
+		if err != nil {
+			return fmt.Errorf("sensor %s: %v", r.Sensor, err)
+		}
+	}
+	return nil
+}
+
+// Purge deletes persisted states of the mapped items in the range through
+// the persistence API of openHAB's default persistence service.
+func (o *openHABForwarder) Purge(p purgeRange) error {
+	from, to := p.From, p.To
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	q := url.Values{
+		"starttime": {from.UTC().Format(time.RFC3339)},
+		"endtime":   {to.UTC().Format(time.RFC3339)},
+	}
+	for sensor, item := range o.items {
+		if p.Sensor != "" && sensor != p.Sensor {
+			continue
+		}
+		target := o.url + "/rest/persistence/items/" + url.PathEscape(item) + "?" + q.Encode()
+		err := sendRequest(func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodDelete, target, nil)
+			if err != nil {
+				return nil, err
+			}
+			if o.token != "" {
+				req.Header.Set("Authorization", "Bearer "+o.token)
+			}
+			return req, nil
+		})
+		if err != nil {
+			return fmt.Errorf("item %s: %v", item, err)
+		}
+	}
+	return nil
+}
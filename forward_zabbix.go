@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zabbixDiscoveryKey = "piheat.sensors.discovery"
+	zabbixItemKey      = "piheat.temperature[%s]"
+)
+
+// zabbixForwarder pushes readings to Zabbix trapper items using the
+// zabbix_sender protocol, and keeps the low-level discovery item up to date
+// so new sensors get items created from the prototype automatically.
+type zabbixForwarder struct {
+	server string
+	host   string
+
+	mu         sync.Mutex
+	discovered map[string]bool
+	lastLLD    time.Time
+}
+
+// zabbixLLDInterval re-sends discovery even without new sensors so Zabbix
+// does not expire the discovered items.
+const zabbixLLDInterval = time.Hour
+
+func newZabbixForwarder(fc ForwarderConfig) (*zabbixForwarder, error) {
+	if fc.Host == "" {
+		return nil, fmt.Errorf("zabbix requires host (the host name configured in Zabbix)")
+	}
+	server := fc.Server
+	if server == "" {
+		return nil, fmt.Errorf("zabbix requires server")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "10051")
+	}
+	return &zabbixForwarder{server: server, host: fc.Host, discovered: map[string]bool{}}, nil
+}
+
+type zabbixSenderItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock,omitempty"`
+	NS    int    `json:"ns,omitempty"`
+}
+
+func (z *zabbixForwarder) Forward(readings []Reading) error {
+	if err := z.discover(readings); err != nil {
+		return fmt.Errorf("discovery: %v", err)
+	}
+	items := make([]zabbixSenderItem, 0, len(readings))
+	for _, r := range readings {
+		items = append(items, zabbixSenderItem{
+			Host:  z.host,
+			Key:   fmt.Sprintf(zabbixItemKey, r.Sensor),
+			Value: strconv.FormatFloat(r.Value, 'f', -1, 64),
+			Clock: r.Time.Unix(),
+			NS:    r.Time.Nanosecond(),
+		})
+	}
+	return z.send(items)
+}
+
+// discover sends the LLD item whenever a sensor not yet announced appears,
+// and periodically otherwise.
+func (z *zabbixForwarder) discover(readings []Reading) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	changed := time.Since(z.lastLLD) >= zabbixLLDInterval
+	for _, r := range readings {
+		if !z.discovered[r.Sensor] {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	sensors, err := listSensorNames()
+	if err != nil {
+		return err
+	}
+	for _, r := range readings {
+		if !containsString(sensors, r.Sensor) {
+			sensors = append(sensors, r.Sensor)
+		}
+	}
+	lld, _ := json.Marshal(zabbixDiscovery(sensors))
+	if err := z.send([]zabbixSenderItem{{Host: z.host, Key: zabbixDiscoveryKey, Value: string(lld)}}); err != nil {
+		return err
+	}
+	for _, s := range sensors {
+		z.discovered[s] = true
+	}
+	z.lastLLD = time.Now()
+	return nil
+}
+
+// send performs one zabbix_sender exchange: a ZBXD header, the payload
+// length as a little-endian uint64, then the JSON request.
+func (z *zabbixForwarder) send(items []zabbixSenderItem) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"request": "sender data",
+		"data":    items,
+		"clock":   time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", z.server, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	var header [13]byte
+	copy(header[:], "ZBXD\x01")
+	binary.LittleEndian.PutUint64(header[5:], uint64(len(payload)))
+	if _, err := conn.Write(append(header[:], payload...)); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("reading response: %v", err)
+	}
+	if !bytes.HasPrefix(header[:], []byte("ZBXD")) {
+		return fmt.Errorf("unexpected response header %q", header[:4])
+	}
+	size := binary.LittleEndian.Uint64(header[5:])
+	if size > 1<<20 {
+		return fmt.Errorf("response too large (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("reading response: %v", err)
+	}
+
+	var resp struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("parsing response: %v", err)
+	}
+	if resp.Response != "success" {
+		return fmt.Errorf("server replied %q: %s", resp.Response, resp.Info)
+	}
+	// Items Zabbix does not know about are reported as failed, which is
+	// normal until discovery has created them.
+	if !strings.Contains(resp.Info, "failed: 0") {
+		log.Printf("Zabbix %s: %s", z.server, resp.Info)
+	}
+	return nil
+}
+
+func zabbixDiscovery(sensors []string) map[string]interface{} {
+	data := make([]map[string]string, 0, len(sensors))
+	for _, s := range sensors {
+		data = append(data, map[string]string{"{#SENSOR}": s})
+	}
+	return map[string]interface{}{"data": data}
+}
+
+// zabbixDiscoveryHandler returns the same LLD document for Zabbix HTTP agent
+// discovery rules, as an alternative to the trapper push.
+func zabbixDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	sensors, err := listSensorNames()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, zabbixDiscovery(sensors))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
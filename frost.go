@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// frostHeld is the reason zones give while heated for frost protection.
+const frostHeld = "frost protection"
+
+// FrostConfig heats any zone whose temperature falls below Threshold
+// (default 5°C) until it is Hysteresis (default 1°C) above it, whatever
+// the setpoint, season, vacation or self-test say, and raises a critical
+// alert to Notifiers, by default the staleness ones.
+type FrostConfig struct {
+	Threshold  float64  `json:"threshold,omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty"`
+	Notifiers  []string `json:"notifiers,omitempty"`
+}
+
+func (c *FrostConfig) check() error {
+	if c.Threshold == 0 {
+		c.Threshold = 5
+	}
+	if c.Hysteresis == 0 {
+		c.Hysteresis = 1
+	}
+	if c.Threshold < 1 || c.Threshold > setpointMin+5 {
+		return fmt.Errorf("threshold must be between 1 and %.0f°C", setpointMin+5)
+	}
+	if c.Hysteresis < 0.1 || c.Hysteresis > 5 {
+		return fmt.Errorf("hysteresis must be between 0.1 and 5°C")
+	}
+	return nil
+}
+
+// frostAlerts holds the alert history ID of each zone's frost alert, which
+// is written outside the control loop.
+var frostAlerts = struct {
+	sync.Mutex
+	id map[string]int64
+}{id: map[string]int64{}}
+
+// frostStep decides whether a zone needs heat to keep it from freezing,
+// returning the reason and explanation while it does. A zone stays in
+// frost protection until a recent reading is back above the threshold
+// plus hysteresis, so a sensor going quiet while the zone is freezing
+// does not switch its heaters off.
+func (z *zoneState) frostStep(c FrostConfig, now time.Time) (string, bool) {
+	fresh := !z.tempAt.IsZero() && now.Sub(z.tempAt) <= controlStale
+	temp := formatReading(z.cfg.Sensor, z.temp) + "°C"
+	switch {
+	case fresh && z.temp < c.Threshold:
+		if !z.frost {
+			z.frost = true
+			log.Printf("Zone %s: %s, below the frost threshold of %.1f°C", z.name, temp, c.Threshold)
+			go z.frostAlert(c, "firing", z.temp, now)
+		}
+		return fmt.Sprintf("%s < frost threshold %.1f°C", temp, c.Threshold), true
+	case !z.frost:
+		return "", false
+	case fresh && z.temp >= c.Threshold+c.Hysteresis:
+		z.frost = false
+		log.Printf("Zone %s: %s, frost protection over", z.name, temp)
+		go z.frostAlert(c, "resolved", z.temp, now)
+		return "", false
+	case !fresh:
+		return fmt.Sprintf("heating for frost protection, without a recent reading from %s", z.cfg.Sensor), true
+	}
+	return fmt.Sprintf("%s < frost threshold %.1f°C + hysteresis %.1f°C, heating since it fell below %.1f°C",
+		temp, c.Threshold, c.Hysteresis, c.Threshold), true
+}
+
+// frostTarget is the setpoint sent to a zone's radiator valves during
+// frost protection: the top of its hysteresis, or the zone's own target
+// when that is higher and heating control is on.
+func (c *controlLoop) frostTarget(z *zoneState, summer bool) float64 {
+	t := c.frost.Threshold + c.frost.Hysteresis
+	if z.hasTarget && !summer && c.held == "" && z.target > t {
+		return z.target
+	}
+	return t
+}
+
+// frostAlert records a zone's frost alert in the alert history and
+// notifies.
+func (z *zoneState) frostAlert(c FrostConfig, state string, value float64, now time.Time) {
+	frostAlerts.Lock()
+	defer frostAlerts.Unlock()
+	a := Alert{
+		ID:        frostAlerts.id[z.name],
+		RuleName:  "Frost protection",
+		Sensor:    z.cfg.Sensor,
+		Condition: "frost",
+		Threshold: c.Threshold,
+		Severity:  "critical",
+		Value:     value,
+		State:     state,
+		Time:      now,
+	}
+	if state == "firing" {
+		id, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		a.ID = id
+		frostAlerts.id[z.name] = id
+	} else if a.ID != 0 {
+		if err := resolveAlertEvent(a.ID, value, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		delete(frostAlerts.id, z.name)
+	}
+	targets := c.Notifiers
+	if len(targets) == 0 {
+		targets = config().Staleness.Notifiers
+	}
+	notify(targets, a)
+}
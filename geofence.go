@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The away_when rules: the house is away once the last person has left,
+// or as soon as anyone has.
+const (
+	awayLastLeaves  = "last_leaves"
+	awayFirstLeaves = "first_leaves"
+)
+
+// PersonConfig is someone whose phone reports arriving home and leaving to
+// POST /api/presence/{person}, authenticated with Token. Region, when set,
+// is the OwnTracks region that counts as home; events for other regions
+// are ignored.
+type PersonConfig struct {
+	Token  string `json:"token"`
+	Region string `json:"region,omitempty"`
+}
+
+// PersonPresence is whether a person is home, from their last event.
+// State is empty until they have sent one.
+type PersonPresence struct {
+	Person string     `json:"person"`
+	State  string     `json:"state,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+}
+
+type personState struct {
+	state string
+	since time.Time
+}
+
+// geofenceEvent is an event from a phone: OwnTracks posts a transition
+// with _type, event and desc, the region; a shortcut or automation only
+// needs event.
+type geofenceEvent struct {
+	Type  string `json:"_type"`
+	Event string `json:"event"`
+	Desc  string `json:"desc"`
+}
+
+// loadPeople restores each person's last event, so a restart keeps who is
+// home.
+func (p *presenceState) loadPeople() error {
+	rows, err := db.Query("SELECT person, state, since FROM presence_people")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, since string
+		var ps personState
+		if err := rows.Scan(&name, &ps.state, &since); err != nil {
+			return err
+		}
+		if _, ok := p.cfg.People[name]; !ok {
+			continue
+		}
+		ps.since, _ = parseSQLiteTime(since)
+		p.people[name] = ps
+	}
+	return rows.Err()
+}
+
+// names lists the configured people in order.
+func (p *presenceState) names() []string {
+	names := make([]string, 0, len(p.cfg.People))
+	for name := range p.cfg.People {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// peopleStatus is each person's presence. It is called with p.mu held.
+func (p *presenceState) peopleStatus() []PersonPresence {
+	list := []PersonPresence{}
+	for _, name := range p.names() {
+		pp := PersonPresence{Person: name}
+		if ps, ok := p.people[name]; ok {
+			since := ps.since
+			pp.State, pp.Since = ps.state, &since
+		}
+		list = append(list, pp)
+	}
+	return list
+}
+
+// personEvent records a person arriving or leaving and switches the mode
+// if that changes it.
+func (p *presenceState) personEvent(name, state, via string, now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps := personState{state: state, since: now.UTC().Truncate(time.Second)}
+	_, err := db.Exec(`INSERT INTO presence_people (person, state, since) VALUES (?, ?, ?)
+		ON CONFLICT(person) DO UPDATE SET state = excluded.state, since = excluded.since`, name, ps.state, sqliteTime(ps.since))
+	if err != nil {
+		return err
+	}
+	p.people[name] = ps
+	verb := "arrived home"
+	if state == presenceAway {
+		verb = "left"
+	}
+	log.Printf("Presence: %s %s (%s)", name, verb, via)
+	p.update(now)
+	return nil
+}
+
+// presenceEventHandler serves POST /api/presence/{person}, the webhook for
+// phone automations. The person's token comes as a Bearer token, a token
+// parameter or, as OwnTracks sends it, the password of basic auth.
+func presenceEventHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/presence/")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var pc PersonConfig
+	ok := false
+	if presence != nil {
+		pc, ok = presence.cfg.People[name]
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, basic := r.BasicAuth(); basic {
+		token = password
+	}
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	// Unknown people and wrong tokens look the same
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(pc.Token)) != 1 {
+		http.Error(w, "Invalid person or token", http.StatusUnauthorized)
+		return
+	}
+
+	var ev geofenceEvent
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &ev); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid event: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if ev.Event == "" {
+		ev.Event = r.URL.Query().Get("event")
+	}
+	// OwnTracks also posts locations and other messages, and takes a list
+	// of messages back
+	if ev.Type != "" {
+		w.Header().Set("Content-Type", "application/json")
+		if ev.Type == "transition" && (pc.Region == "" || strings.EqualFold(ev.Desc, pc.Region)) {
+			state, err := ev.state()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := presence.personEvent(name, state, "OwnTracks region "+ev.Desc, clock.Now()); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving event: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Write([]byte("[]"))
+		return
+	}
+	state, err := ev.state()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := presence.personEvent(name, state, "webhook", clock.Now()); err != nil {
+		http.Error(w, fmt.Sprintf("Error saving event: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s, err := presence.status()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// state is the presence an event puts its person in.
+func (ev geofenceEvent) state() (string, error) {
+	switch strings.ToLower(ev.Event) {
+	case "enter":
+		return presenceHome, nil
+	case "leave":
+		return presenceAway, nil
+	}
+	return "", fmt.Errorf("event must be enter or leave")
+}
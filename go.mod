@@ -2,4 +2,21 @@ module piheat
 
 go 1.18
 
-require github.com/mattn/go-sqlite3 v1.14.17
+require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/go-pdf/fpdf v0.6.0
+	github.com/mattn/go-sqlite3 v1.14.17
+	golang.org/x/image v0.12.0
+	golang.org/x/net v0.9.0
+	golang.org/x/sys v0.7.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+)
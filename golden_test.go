@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "time/tzdata"
+)
+
+// The golden tests run the chart and summary queries over a canned dataset
+// and compare the results with testdata/golden, once against a single
+// database file and once against per-year storage. A query rewrite that
+// changes any result shows up as a diff; when a change is intended, rerun
+// with -update and review the new golden files.
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// goldenNow is the fixed "now" of the tests: five days after the autumn DST
+// change, so the week, month and feed windows all span it.
+var goldenNow = time.Date(2024, 11, 1, 12, 0, 0, 0, time.UTC)
+
+// goldenLayouts are the storage layouts every golden test runs against.
+var goldenLayouts []struct {
+	name string
+	db   *sql.DB
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Both Go and SQLite's 'localtime' must see the same zone. The POSIX
+	// form needs no zoneinfo files on the host; Go's zone comes from the
+	// embedded tzdata.
+	os.Setenv("TZ", "CET-1CEST,M3.5.0,M10.5.0/3")
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	time.Local = loc
+
+	dir, err := ioutil.TempDir("", "piheat-golden")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(ioutil.Discard)
+
+	single := filepath.Join(dir, "single.db")
+	initDatabase(single)
+	loadGoldenFixture()
+	goldenLayouts = append(goldenLayouts, struct {
+		name string
+		db   *sql.DB
+	}{"single", db})
+
+	// Per-year storage is built the way an existing install is upgraded:
+	// readings written to the main file are moved into year files on start
+	yearly := filepath.Join(dir, "yearly.db")
+	initDatabase(yearly)
+	loadGoldenFixture()
+	db.Close()
+	splitByYear = true
+	initDatabase(yearly)
+	splitByYear = false
+	goldenLayouts = append(goldenLayouts, struct {
+		name string
+		db   *sql.DB
+	}{"split-by-year", db})
+
+	code := m.Run()
+	for _, l := range goldenLayouts {
+		l.db.Close()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// loadGoldenFixture writes the canned dataset into db:
+//
+//   - cpu every 10 minutes around both 2024 DST changes and through the last
+//     month, every 3 hours otherwise since 2023
+//   - hall every 15 minutes at :07 from 20 October 2024, so its buckets
+//     must line up with cpu's although no reading shares a timestamp,
+//     with a gap of a day and a half and one around the extra autumn hour
+//   - runtime and energy of one heater in both years
+//
+// Values are a daily wave plus a weekly offset, rounded to 0.1 like real
+// readings.
+func loadGoldenFixture() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	insert, err := tx.Prepare("INSERT INTO temperature_readings (sensor, temperature, timestamp) VALUES (?, ?, ?)")
+	if err != nil {
+		log.Fatal(err)
+	}
+	add := func(sensor string, base, swing float64, t time.Time) {
+		minute := float64(t.Hour()*60 + t.Minute())
+		v := base + swing*math.Sin(2*math.Pi*minute/1440) + float64(t.YearDay()%7)*0.3
+		if _, err := insert.Exec(sensor, math.Round(v*10)/10, sqliteTime(t)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	dense := func(t time.Time) bool {
+		return (!t.Before(time.Date(2024, 3, 29, 0, 0, 0, 0, time.UTC)) && t.Before(time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC))) ||
+			!t.Before(time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC))
+	}
+	for t := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC); !t.After(goldenNow); t = t.Add(10 * time.Minute) {
+		if dense(t) || (t.Hour()%3 == 0 && t.Minute() == 0) {
+			add("cpu", 45, 8, t)
+		}
+	}
+	gaps := [][2]time.Time{
+		{time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC), time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC)},
+		{time.Date(2024, 10, 29, 6, 0, 0, 0, time.UTC), time.Date(2024, 10, 30, 18, 0, 0, 0, time.UTC)},
+	}
+next:
+	for t := time.Date(2024, 10, 20, 0, 7, 0, 0, time.UTC); !t.After(goldenNow); t = t.Add(15 * time.Minute) {
+		for _, g := range gaps {
+			if !t.Before(g[0]) && t.Before(g[1]) {
+				continue next
+			}
+		}
+		add("hall", 19.5, 1.5, t)
+	}
+	insert.Close()
+
+	for _, u := range []struct {
+		day     string
+		seconds float64
+		wh      float64
+	}{
+		{"2023-01-15", 21600, 9000},
+		{"2023-12-31", 7200, 3000},
+		{"2024-01-01", 3600, 1500},
+		{"2024-03-31", 14400, 6000},
+		{"2024-10-27", 18000, 7500},
+	} {
+		if _, err := tx.Exec("INSERT INTO heater_usage (day, heater, on_seconds, energy_wh) VALUES (?, 'hall', ?, ?)", u.day, u.seconds, u.wh); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// forEachLayout runs fn against every storage layout.
+func forEachLayout(t *testing.T, fn func(t *testing.T)) {
+	for _, l := range goldenLayouts {
+		l := l
+		t.Run(l.name, func(t *testing.T) {
+			db = l.db
+			var local string
+			if err := db.QueryRow("SELECT datetime('2024-07-01 12:00:00', 'localtime')").Scan(&local); err != nil {
+				t.Fatal(err)
+			}
+			if local != "2024-07-01 14:00:00" {
+				t.Fatalf("SQLite does not use the test time zone: noon UTC is %s", local)
+			}
+			fn(t)
+		})
+	}
+}
+
+// checkGolden compares v, as indented JSON, with testdata/golden/name.
+// Floats are rounded to 9 decimals first, so a different summation order
+// does not count as a change.
+func checkGolden(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(roundFloats(generic), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\n%s", name, firstDiff(want, got))
+	}
+}
+
+func roundFloats(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return math.Round(v*1e9) / 1e9
+	case []interface{}:
+		for i := range v {
+			v[i] = roundFloats(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = roundFloats(v[k])
+		}
+	}
+	return v
+}
+
+// firstDiff shows the first differing line, which is enough to find the
+// change in the usually long golden files.
+func firstDiff(want, got []byte) string {
+	w, g := bytes.Split(want, []byte("\n")), bytes.Split(got, []byte("\n"))
+	for i := 0; i < len(w) || i < len(g); i++ {
+		var wl, gl []byte
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if !bytes.Equal(wl, gl) {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, wl, gl)
+		}
+	}
+	return ""
+}
+
+func TestChartDataGolden(t *testing.T) {
+	forEachLayout(t, func(t *testing.T) {
+		for _, sensor := range []string{"cpu", "hall"} {
+			for _, period := range []string{"day", "week", "month", "year"} {
+				data, err := chartData(context.Background(), sensor, period, goldenNow)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkGolden(t, fmt.Sprintf("chart-data-%s-%s.json", sensor, period), data)
+			}
+		}
+	})
+}
+
+// TestChartDataAlignment checks that buckets of sensors sampled at
+// different times share their timestamps, so the series can be drawn on
+// one axis.
+func TestChartDataAlignment(t *testing.T) {
+	forEachLayout(t, func(t *testing.T) {
+		for _, period := range []string{"week", "month", "year"} {
+			cpu, err := chartData(context.Background(), "cpu", period, goldenNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hall, err := chartData(context.Background(), "hall", period, goldenNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buckets := map[int64]bool{}
+			for _, p := range cpu {
+				buckets[p.UnixTime] = true
+			}
+			for _, p := range hall {
+				if !buckets[p.UnixTime] {
+					t.Errorf("%s: hall bucket %s has no cpu bucket", period, p.Timestamp)
+				}
+			}
+		}
+	})
+}
+
+func TestDailySummariesGolden(t *testing.T) {
+	forEachLayout(t, func(t *testing.T) {
+		days, err := dailySummaries(context.Background(), "", goldenNow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "daily-summaries.json", days)
+
+		// 27 October 2024 has 25 hours in the test zone
+		for _, d := range days {
+			if d.Day == "2024-10-27" && d.Sensor == "cpu" && d.Readings != 25*6 {
+				t.Errorf("cpu has %d readings on the day clocks went back, want %d", d.Readings, 25*6)
+			}
+		}
+	})
+}
+
+func TestYearReportGolden(t *testing.T) {
+	config().EnergyPrice, config().Currency = 0.3, "EUR"
+	defer func() { config().EnergyPrice, config().Currency = 0, "" }()
+	forEachLayout(t, func(t *testing.T) {
+		for _, year := range []int{2023, 2024} {
+			rec := httptest.NewRecorder()
+			reportAPIHandler(rec, httptest.NewRequest("GET", fmt.Sprintf("/api/report/%d", year), nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET /api/report/%d: %d %s", year, rec.Code, rec.Body)
+			}
+			var rep YearReport
+			if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, fmt.Sprintf("report-%d.json", year), rep)
+		}
+	})
+}
+
+// TestYearReportRollup checks the year in review sums a day again after a
+// reading was back-dated into it or the day was purged.
+func TestYearReportRollup(t *testing.T) {
+	withScratchDatabase(t)
+	withManualClock(t, goldenNow)
+	for _, r := range []struct {
+		age  time.Duration
+		temp float64
+	}{{48 * time.Hour, 20}, {time.Hour, 22}} {
+		if err := saveTemperature("attic", r.temp, "", goldenNow.Add(-r.age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readings := func(want int) {
+		t.Helper()
+		rep, err := buildYearReport(context.Background(), 2024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rep.Sensors) != 1 || rep.Sensors[0].Readings != want {
+			t.Fatalf("report has %+v, want %d attic readings", rep.Sensors, want)
+		}
+	}
+	readings(2)
+	var rolled int
+	if err := db.QueryRow("SELECT COUNT(*) FROM daily_rollup_days WHERE day = ?", localDay(goldenNow)).Scan(&rolled); err != nil {
+		t.Fatal(err)
+	}
+	if rolled != 0 {
+		t.Error("today was rolled up before it was over")
+	}
+
+	if err := saveTemperature("attic", 23, "", goldenNow.Add(-47*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	readings(3)
+	if _, err := executePurge(purgeRange{From: goldenNow.Add(-72 * time.Hour), To: goldenNow.Add(-24 * time.Hour)}, "test", ""); err != nil {
+		t.Fatal(err)
+	}
+	readings(1)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// GPIOConfig picks the driver of heaters switched by a relay on one of the
+// Pi's own GPIO pins. Chip is the GPIO character device (default
+// gpiochip0); Driver is "chardev" for it, or "mock", which only keeps and
+// logs the pins' states. Without Driver the mock is used when Chip does
+// not exist, as on a laptop.
+type GPIOConfig struct {
+	Chip   string `json:"chip,omitempty"`
+	Driver string `json:"driver,omitempty"`
+}
+
+func (c *GPIOConfig) check() error {
+	if c.Chip == "" {
+		c.Chip = "gpiochip0"
+	}
+	switch c.Driver {
+	case "", "chardev", "mock":
+	default:
+		return fmt.Errorf("driver must be chardev or mock")
+	}
+	return nil
+}
+
+// gpioMaxPin is the highest GPIO line a heater can use.
+const gpioMaxPin = 63
+
+// gpioDriver switches output pins. Pins are claimed as outputs, off, by
+// setup before they are set.
+type gpioDriver interface {
+	setup(pin int, activeLow bool) error
+	set(pin int, on bool) error
+	get(pin int) (bool, error)
+	name() string
+}
+
+// gpio is the driver of the gpio heaters, nil without any.
+var gpio gpioDriver
+
+// setupGPIO picks the driver and claims the pins of the gpio heaters.
+func setupGPIO(c GPIOConfig, configs map[string]HeaterConfig) error {
+	var names []string
+	for name, hc := range configs {
+		if hc.Type == "gpio" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		gpio = nil
+		return nil
+	}
+	sort.Strings(names)
+	driver := c.Driver
+	if driver == "" {
+		driver = "chardev"
+		if _, err := os.Stat("/dev/" + c.Chip); err != nil {
+			log.Printf("GPIO: /dev/%s not found, using the mock driver", c.Chip)
+			driver = "mock"
+		}
+	}
+	if driver == "mock" {
+		gpio = &mockGPIO{pins: map[int]bool{}}
+	} else {
+		d, err := openGPIOChip(c.Chip)
+		if err != nil {
+			return fmt.Errorf("gpio: %v", err)
+		}
+		gpio = d
+	}
+	used := map[int]string{}
+	for _, name := range names {
+		hc := configs[name]
+		if other, ok := used[*hc.Pin]; ok {
+			return fmt.Errorf("heater %q: pin %d already belongs to heater %q", name, *hc.Pin, other)
+		}
+		used[*hc.Pin] = name
+		if err := gpio.setup(*hc.Pin, hc.ActiveLow); err != nil {
+			return fmt.Errorf("heater %q: pin %d: %v", name, *hc.Pin, err)
+		}
+	}
+	return nil
+}
+
+// mockGPIO stands in for the pins off the Pi: it keeps their states and
+// logs every change, so the control loop can be tried out anywhere.
+type mockGPIO struct {
+	mu   sync.Mutex
+	pins map[int]bool
+}
+
+func (m *mockGPIO) setup(pin int, activeLow bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pins[pin] = false
+	return nil
+}
+
+func (m *mockGPIO) set(pin int, on bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if was, ok := m.pins[pin]; !ok {
+		return fmt.Errorf("pin %d not set up", pin)
+	} else if was != on {
+		log.Printf("GPIO mock: pin %d %s", pin, onOff(on))
+	}
+	m.pins[pin] = on
+	return nil
+}
+
+func (m *mockGPIO) get(pin int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	on, ok := m.pins[pin]
+	if !ok {
+		return false, fmt.Errorf("pin %d not set up", pin)
+	}
+	return on, nil
+}
+
+func (m *mockGPIO) name() string { return "mock" }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The GPIO character device's line handle ioctls, from linux/gpio.h.
+const (
+	gpioGetLineHandle      = 0xc16cb403
+	gpioGetLineValues      = 0xc040b408
+	gpioSetLineValues      = 0xc040b409
+	gpioHandleOutput       = 1 << 1
+	gpioHandleActiveLow    = 1 << 2
+	gpioHandlesMax         = 64
+	gpioConsumerLabelBytes = 32
+)
+
+type gpioHandleRequest struct {
+	lineOffsets   [gpioHandlesMax]uint32
+	flags         uint32
+	defaultValues [gpioHandlesMax]uint8
+	consumerLabel [gpioConsumerLabelBytes]byte
+	lines         uint32
+	fd            int32
+}
+
+type gpioHandleData struct {
+	values [gpioHandlesMax]uint8
+}
+
+// chardevGPIO drives pins through the kernel's GPIO character device,
+// holding a line handle per pin. The kernel inverts active low pins.
+type chardevGPIO struct {
+	chip  *os.File
+	mu    sync.Mutex
+	lines map[int]int
+}
+
+func openGPIOChip(chip string) (gpioDriver, error) {
+	f, err := os.OpenFile("/dev/"+chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &chardevGPIO{chip: f, lines: map[int]int{}}, nil
+}
+
+func (c *chardevGPIO) setup(pin int, activeLow bool) error {
+	req := gpioHandleRequest{flags: gpioHandleOutput, lines: 1}
+	if activeLow {
+		req.flags |= gpioHandleActiveLow
+	}
+	req.lineOffsets[0] = uint32(pin)
+	copy(req.consumerLabel[:], "piheat")
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, c.chip.Fd(), gpioGetLineHandle, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines[pin] = int(req.fd)
+	return nil
+}
+
+func (c *chardevGPIO) line(pin int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fd, ok := c.lines[pin]
+	if !ok {
+		return 0, fmt.Errorf("pin %d not set up", pin)
+	}
+	return fd, nil
+}
+
+func (c *chardevGPIO) set(pin int, on bool) error {
+	fd, err := c.line(pin)
+	if err != nil {
+		return err
+	}
+	var data gpioHandleData
+	if on {
+		data.values[0] = 1
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), gpioSetLineValues, uintptr(unsafe.Pointer(&data))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (c *chardevGPIO) get(pin int) (bool, error) {
+	fd, err := c.line(pin)
+	if err != nil {
+		return false, err
+	}
+	var data gpioHandleData
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), gpioGetLineValues, uintptr(unsafe.Pointer(&data))); errno != 0 {
+		return false, errno
+	}
+	return data.values[0] != 0, nil
+}
+
+func (c *chardevGPIO) name() string { return "chardev" }
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// openGPIOChip is only supported on Linux; elsewhere gpio heaters use the
+// mock driver.
+func openGPIOChip(chip string) (gpioDriver, error) {
+	return nil, fmt.Errorf("the GPIO character device is only supported on Linux, use the mock driver")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"piheat/piheatpb"
+)
+
+// grpcService implements the gRPC API on top of the same storage and
+// in-memory state as the HTTP handlers.
+type grpcService struct {
+	piheatpb.UnimplementedPiheatServer
+}
+
+func matchesAny(patterns []string, sensor string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, sensor); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid sensor selector %q", p)
+		}
+	}
+	return nil
+}
+
+func (grpcService) GetCurrent(ctx context.Context, req *piheatpb.GetCurrentRequest) (*piheatpb.GetCurrentResponse, error) {
+	if err := checkPatterns(req.Sensors); err != nil {
+		return nil, err
+	}
+	resp := &piheatpb.GetCurrentResponse{}
+	for _, s := range sensorsMonitor.statuses(time.Now()) {
+		if !matchesAny(req.Sensors, s.Name) {
+			continue
+		}
+		resp.Sensors = append(resp.Sensors, &piheatpb.SensorStatus{
+			Name:            s.Name,
+			LastValue:       s.LastValue,
+			LastSeen:        timestamppb.New(s.LastSeen),
+			IntervalSeconds: int64(s.Interval.Seconds()),
+			Online:          s.Online,
+		})
+	}
+	return resp, nil
+}
+
+func (grpcService) StreamReadings(req *piheatpb.StreamReadingsRequest, stream piheatpb.Piheat_StreamReadingsServer) error {
+	if err := checkPatterns(req.Sensors); err != nil {
+		return err
+	}
+	readings, cancel := subscribeReadings()
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case r := <-readings:
+			if !matchesAny(req.Sensors, r.Sensor) {
+				continue
+			}
+			err := stream.Send(&piheatpb.Reading{
+				Sensor:      r.Sensor,
+				Temperature: r.Value,
+				Time:        timestamppb.New(r.Time),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (grpcService) QueryRange(ctx context.Context, req *piheatpb.QueryRangeRequest) (*piheatpb.QueryRangeResponse, error) {
+	rq := readingQuery{
+		Sensor:    req.Sensor,
+		Ascending: req.Ascending,
+		Limit:     int(req.Limit),
+		Offset:    int(req.Offset),
+	}
+	if rq.Limit <= 0 {
+		rq.Limit = 100
+	}
+	if rq.Limit > 1000 {
+		rq.Limit = 1000
+	}
+	if rq.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+	if req.From != nil {
+		rq.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		rq.To = req.To.AsTime()
+	}
+	page, err := queryReadings(ctx, rq)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "querying database: %v", err)
+	}
+	resp := &piheatpb.QueryRangeResponse{Total: int64(page.Total)}
+	for _, r := range page.Readings {
+		resp.Readings = append(resp.Readings, &piheatpb.Reading{
+			Id:          r.ID,
+			Sensor:      r.Sensor,
+			Temperature: r.Temperature,
+			Time:        timestamppb.New(r.Timestamp),
+		})
+	}
+	return resp, nil
+}
+
+func (grpcService) SetSetpoint(ctx context.Context, req *piheatpb.SetSetpointRequest) (*piheatpb.Setpoint, error) {
+	if readOnly {
+		return nil, status.Error(codes.PermissionDenied, "this piheat instance is read-only")
+	}
+	if err := validateSetpoint(req.Zone, req.Temperature); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	old := currentSetpointValue(req.Zone)
+	actor := auditGRPC
+	if u, ok := ctx.Value(userKey{}).(*User); ok {
+		actor = u.Username
+	}
+	sp, err := setSetpoint(req.Zone, req.Temperature)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "saving setpoint: %v", err)
+	}
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	audit(actor, remote, "setpoint.set", req.Zone, old, sp.Temperature)
+	return &piheatpb.Setpoint{
+		Zone:        sp.Zone,
+		Temperature: sp.Temperature,
+		UpdatedAt:   timestamppb.New(sp.UpdatedAt),
+	}, nil
+}
+
+// grpcWrites are the RPCs that change something, which need an admin.
+var grpcWrites = map[string]bool{piheatpb.Piheat_SetSetpoint_FullMethodName: true}
+
+// authorizeGRPC checks the bearer token in the authorization metadata as
+// requireLogin and requireAdmin check HTTP requests: any user may read once
+// users exist, and only the admin_token or an admin's session may write. The
+// session token is the piheat_session cookie of /api/v1/login.
+func authorizeGRPC(ctx context.Context, method string) (context.Context, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			token = strings.TrimPrefix(v[0], "Bearer ")
+		}
+	}
+	if token != "" && isAdminToken(token) {
+		return ctx, nil
+	}
+	var u *User
+	if token != "" {
+		u = tokenUser(token)
+	}
+	if u != nil {
+		ctx = context.WithValue(ctx, userKey{}, u)
+	}
+	if !grpcWrites[method] {
+		if u == nil && usersEnabled() {
+			return nil, status.Error(codes.Unauthenticated, "login required: send a session token as authorization: Bearer <token>")
+		}
+		return ctx, nil
+	}
+	switch {
+	case u != nil && u.Role == roleAdmin:
+		return ctx, nil
+	case u != nil:
+		return nil, status.Error(codes.PermissionDenied, "admin role required")
+	case config().AdminToken == "" && !usersEnabled():
+		return nil, status.Error(codes.PermissionDenied, "admin API disabled: set admin_token in the config file or add an admin user")
+	}
+	return nil, status.Error(codes.Unauthenticated, "send admin_token or an admin's session token as authorization: Bearer <token>")
+}
+
+func unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authorizeGRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := authorizeGRPC(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// startGRPC serves the gRPC API on addr in the background.
+func startGRPC(addr string) (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(unaryAuth), grpc.StreamInterceptor(streamAuth))
+	piheatpb.RegisterPiheatServer(srv, grpcService{})
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Printf("Error serving gRPC: %v", err)
+		}
+	}()
+	log.Printf("gRPC API listening on %s", addr)
+	return srv, nil
+}
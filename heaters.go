@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// plugStatus is what a smart plug reports about the heater it switches.
+// An OpenTherm boiler reports central heating as its relay, and its fault
+// flag and OEM fault code instead of power.
+type plugStatus struct {
+	relayOn bool
+	power   float64
+	// hasPower is set when the plug measures power; one without a meter
+	// only reports its relay.
+	hasPower  bool
+	fault     bool
+	faultCode float64
+}
+
+// HeaterStatus is what /api/heaters reports for each monitored heater.
+type HeaterStatus struct {
+	Name     string     `json:"name"`
+	RelayOn  bool       `json:"relayOn"`
+	Power    *float64   `json:"power"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	Fault    string     `json:"fault,omitempty"`
+	Limit    string     `json:"limit,omitempty"`
+	Mock     bool       `json:"mock,omitempty"`
+}
+
+// heaterCheck compares a plug's relay state with the power it measures.
+// A relay that is on while the heater draws nothing points to a tripped
+// breaker or cut-out; power drawn while the relay is off points to a welded
+// relay. Either must persist for the grace period before it alerts, so the
+// heater's own thermostat cycling does not.
+type heaterCheck struct {
+	name   string
+	cfg    HeaterConfig
+	mu     sync.Mutex
+	status plugStatus
+	seen   time.Time
+	since  time.Time
+	fault  string
+	event  int64
+	// limit is the safety limit holding the relay, see relayActuator.limit.
+	limit string
+	// metered is set once the plug has reported any power, from when its
+	// power is recorded.
+	metered bool
+}
+
+var heaters []*heaterCheck
+
+// setupHeaters validates the heaters section of the config.
+func setupHeaters(configs map[string]HeaterConfig) error {
+	var checks []*heaterCheck
+	for name, hc := range configs {
+		switch hc.Type {
+		case "tasmota", "shelly", "shelly-gen2":
+		case "esphome":
+			if strings.HasPrefix(hc.URL, "tcp://") {
+				if hc.Topic != "" {
+					return fmt.Errorf("heater %q: the native API takes a url, not a topic", name)
+				}
+				if _, err := esphomeAPIAddr(hc.URL); err != nil {
+					return fmt.Errorf("heater %q: %v", name, err)
+				}
+			}
+		case "gpio":
+			if hc.URL != "" || hc.Topic != "" {
+				return fmt.Errorf("heater %q: a gpio relay takes a pin, not a url or topic", name)
+			}
+			if hc.Pin == nil || *hc.Pin < 0 || *hc.Pin > gpioMaxPin {
+				return fmt.Errorf("heater %q: pin must be between 0 and %d", name, gpioMaxPin)
+			}
+		case "opentherm":
+			if hc.Topic != "" {
+				return fmt.Errorf("heater %q: an opentherm gateway takes a url, not a topic", name)
+			}
+			if err := checkOpenThermURL(hc.URL); err != nil {
+				return fmt.Errorf("heater %q: %v", name, err)
+			}
+		default:
+			return fmt.Errorf("heater %q: unknown type %q", name, hc.Type)
+		}
+		if hc.URL == "" && hc.Topic == "" && hc.Type != "gpio" {
+			return fmt.Errorf("heater %q: url or topic is required", name)
+		}
+		if hc.Topic != "" && (config().MQTT == nil || config().MQTT.Broker == "") {
+			return fmt.Errorf("heater %q: topic needs an mqtt broker", name)
+		}
+		hc = heaterDefaults(hc)
+		if err := hc.checkSafety(); err != nil {
+			return fmt.Errorf("heater %q: %v", name, err)
+		}
+		if err := checkNotifierNames(hc.Notifiers); err != nil {
+			return fmt.Errorf("heater %q: %v", name, err)
+		}
+		if simulating {
+			hc = simulatedHeater(name, hc)
+		}
+		checks = append(checks, &heaterCheck{name: name, cfg: hc})
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+	if !simulating {
+		if err := setupGPIO(config().GPIO, configs); err != nil {
+			return err
+		}
+	}
+	heaters = checks
+	otGateways = map[string]*otGateway{}
+	esphomeDevices = map[string]*esphomeAPI{}
+	for _, h := range heaters {
+		if h.cfg.Type == "opentherm" {
+			otGateways[h.cfg.URL] = &otGateway{h: h, url: h.cfg.URL, recorded: map[string]time.Time{}, replies: make(chan string, 4)}
+		}
+		if h.cfg.Type == "esphome" && strings.HasPrefix(h.cfg.URL, "tcp://") {
+			addr, _ := esphomeAPIAddr(h.cfg.URL)
+			esphomeDevices[h.cfg.URL] = &esphomeAPI{h: h, addr: addr}
+		}
+	}
+	return nil
+}
+
+func heaterDefaults(hc HeaterConfig) HeaterConfig {
+	if hc.Interval.Duration <= 0 {
+		hc.Interval.Duration = 30 * time.Second
+	}
+	if hc.Grace.Duration <= 0 {
+		hc.Grace.Duration = 2 * time.Minute
+	}
+	if hc.OnWatts == 0 {
+		hc.OnWatts = 20
+	}
+	if hc.OffWatts == 0 {
+		hc.OffWatts = 5
+	}
+	if hc.Notifiers == nil {
+		hc.Notifiers = []string{"log"}
+	}
+	if hc.Type == "esphome" {
+		if hc.Switch == "" {
+			hc.Switch = "relay"
+		}
+		if hc.PowerSensor == "" {
+			hc.PowerSensor = "power"
+		}
+	}
+	return hc
+}
+
+// plug returns the heater's config for talking to its plug.
+func (h *heaterCheck) plug() HeaterConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cfg
+}
+
+// setLimits takes new fault thresholds, notifiers, watts and safety
+// limits from a reloaded config; the plug itself only changes with a
+// restart.
+func (h *heaterCheck) setLimits(hc HeaterConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg.OnWatts, h.cfg.OffWatts = hc.OnWatts, hc.OffWatts
+	h.cfg.Grace, h.cfg.Notifiers, h.cfg.Watts = hc.Grace, hc.Notifiers, hc.Watts
+	h.cfg.MaxOn, h.cfg.MinCycle = hc.MaxOn, hc.MinCycle
+}
+
+// startHeaterChecks polls HTTP plugs, subscribes to MQTT plugs or connects
+// to OpenTherm gateways and ESPHome's native API.
+func startHeaterChecks() {
+	for _, h := range heaters {
+		if g := openthermGateway(h.cfg); g != nil {
+			go g.run()
+		} else if a := esphomeDevice(h.cfg); a != nil {
+			go a.run()
+		} else if h.cfg.Topic != "" {
+			for _, topic := range plugTopics(h.cfg) {
+				if err := mqttSubscribe(topic, h.message); err != nil {
+					log.Printf("Error subscribing to heater %s: %v", h.name, err)
+				}
+			}
+		} else {
+			go h.poll()
+		}
+		go h.watch()
+		if h.cfg.Type != "opentherm" {
+			go h.recordPower()
+		}
+	}
+}
+
+func (h *heaterCheck) poll() {
+	ticker := time.NewTicker(h.cfg.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		st, err := fetchPlugStatus(h.plug())
+		if err != nil {
+			log.Printf("Error reading heater %s: %v", h.name, err)
+		} else {
+			h.update(func(s *plugStatus) { *s = st })
+		}
+		<-ticker.C
+	}
+}
+
+// watch re-evaluates regularly so a fault is raised even when the plug
+// stops reporting changes.
+func (h *heaterCheck) watch() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.mu.Lock()
+		h.evaluate(now)
+		h.mu.Unlock()
+	}
+}
+
+func (h *heaterCheck) update(apply func(*plugStatus)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.recordUsage(now)
+	was, known := h.status.relayOn, !h.seen.IsZero()
+	apply(&h.status)
+	if h.status.power > 0 {
+		h.metered = true
+	}
+	if !known || h.status.relayOn != was {
+		recordActuator(actuatorHeater, h.name, dutyOf(h.status.relayOn), now)
+	}
+	h.seen = now
+	h.evaluate(h.seen)
+}
+
+// heaterPowerSensor is the sensor a heater plug's measured power is
+// recorded as.
+func heaterPowerSensor(heater string) string {
+	return heater + "_power"
+}
+
+// heaterPowerUnit is the unit of a heater's power sensor, empty for other
+// sensors.
+func heaterPowerUnit(sensor string) string {
+	for _, h := range heaters {
+		if sensor == heaterPowerSensor(h.name) {
+			return "W"
+		}
+	}
+	return ""
+}
+
+// recordPower records the power a metered plug last reported every
+// interval, however it reports, so /api/energy can add up what the heater
+// really used. A plug that has not reported for maxUsageGap is left out.
+func (h *heaterCheck) recordPower() {
+	sensor := heaterPowerSensor(h.name)
+	sensorsMonitor.expect(sensor, h.cfg.Interval.Duration)
+	ticker := time.NewTicker(h.cfg.Interval.Duration)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.mu.Lock()
+		power, record := h.status.power, h.metered && now.Sub(h.seen) <= maxUsageGap
+		h.mu.Unlock()
+		if record {
+			recordReading(sensor, power, sourcePlug+h.name)
+		}
+	}
+}
+
+// maxUsageGap caps how long a plug state is assumed to have lasted, so a
+// plug that was unreachable for hours does not count as running all along.
+const maxUsageGap = 10 * time.Minute
+
+// recordUsage adds the time since the previous update, and the energy used
+// in it, to the daily rollup of the heater.
+func (h *heaterCheck) recordUsage(now time.Time) {
+	dt := now.Sub(h.seen)
+	if h.seen.IsZero() || dt <= 0 || dt > maxUsageGap {
+		return
+	}
+	var on float64
+	if h.status.relayOn {
+		on = dt.Seconds()
+	}
+	wh := h.status.power * dt.Hours()
+	if on == 0 && wh == 0 {
+		return
+	}
+	_, err := db.Exec(`INSERT INTO heater_usage (day, heater, on_seconds, energy_wh) VALUES (?, ?, ?, ?)
+		ON CONFLICT(day, heater) DO UPDATE SET on_seconds = on_seconds + excluded.on_seconds, energy_wh = energy_wh + excluded.energy_wh`,
+		now.Format("2006-01-02"), h.name, on, wh)
+	if err != nil {
+		log.Printf("Error saving heater usage: %v", err)
+	}
+}
+
+// initHeaterTables creates the daily rollup of heater runtime and energy,
+// keyed by local date.
+func initHeaterTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS heater_usage (
+		day TEXT NOT NULL,
+		heater TEXT NOT NULL,
+		on_seconds REAL NOT NULL,
+		energy_wh REAL NOT NULL,
+		PRIMARY KEY (day, heater)
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (h *heaterCheck) mismatch() (condition string, threshold float64) {
+	// A relay on a GPIO pin has no power meter
+	if h.cfg.Type == "gpio" {
+		return "", 0
+	}
+	if h.cfg.Type == "opentherm" {
+		if h.status.fault {
+			return "boiler-fault", 0
+		}
+		return "", 0
+	}
+	switch {
+	case !h.status.hasPower:
+	case h.status.relayOn && h.status.power < h.cfg.OnWatts:
+		return "no-power", h.cfg.OnWatts
+	case !h.status.relayOn && h.status.power > h.cfg.OffWatts:
+		return "stuck-relay", h.cfg.OffWatts
+	}
+	return "", 0
+}
+
+func (h *heaterCheck) evaluate(now time.Time) {
+	if h.seen.IsZero() {
+		return
+	}
+	condition, threshold := h.mismatch()
+	if condition == "" {
+		h.since = time.Time{}
+		if h.fault != "" {
+			h.changed("resolved", h.fault, threshold, now)
+			h.fault = ""
+		}
+		return
+	}
+	if h.since.IsZero() {
+		h.since = now
+	}
+	if h.fault == "" && now.Sub(h.since) >= h.cfg.Grace.Duration {
+		h.fault = condition
+		h.changed("firing", condition, threshold, now)
+	}
+}
+
+// changed records the fault in the alert history and notifies, the same
+// way sensorMonitor.changed handles sensors going offline.
+func (h *heaterCheck) changed(state, condition string, threshold float64, now time.Time) {
+	a := Alert{
+		ID:        h.event,
+		RuleName:  "Heater interlock",
+		Sensor:    h.name,
+		Condition: condition,
+		Threshold: threshold,
+		Severity:  "critical",
+		Value:     h.status.power,
+		State:     state,
+		Time:      now,
+	}
+	if condition == "boiler-fault" {
+		a.Value = h.status.faultCode
+	}
+	if state == "firing" {
+		log.Printf("Heater %s fault: %s", h.name, a.Summary())
+		id, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		h.event, a.ID = id, id
+	} else {
+		log.Printf("Heater %s fault cleared", h.name)
+		if err := resolveAlertEvent(h.event, a.Value, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		h.event = 0
+	}
+	notify(h.cfg.Notifiers, a)
+}
+
+func (h *heaterCheck) snapshot() HeaterStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HeaterStatus{Name: h.name, RelayOn: h.status.relayOn, Fault: h.fault, Limit: h.limit,
+		Mock: h.cfg.Type == "simulated" || h.cfg.Type == "gpio" && gpio.name() == "mock"}
+	if h.status.hasPower {
+		power := h.status.power
+		s.Power = &power
+	}
+	if !h.seen.IsZero() {
+		seen := h.seen
+		s.LastSeen = &seen
+	}
+	return s
+}
+
+func heatersHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]HeaterStatus, 0, len(heaters))
+	for _, h := range heaters {
+		list = append(list, h.snapshot())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// errNoEntity is what an ESPHome web server answers for an object ID the
+// device does not have.
+var errNoEntity = errors.New("no such entity")
+
+// fetchPlugStatus asks a plug for its relay state and, if it measures it,
+// power over HTTP.
+func fetchPlugStatus(hc HeaterConfig) (plugStatus, error) {
+	if g := openthermGateway(hc); g != nil {
+		return g.plugStatus()
+	}
+	if a := esphomeDevice(hc); a != nil {
+		return a.plugStatus()
+	}
+	if hc.Type == "simulated" {
+		return simulation.plugStatus(hc)
+	}
+	var st plugStatus
+	if hc.Type == "gpio" {
+		on, err := gpio.get(*hc.Pin)
+		st.relayOn = on
+		return st, err
+	}
+	base := strings.TrimRight(hc.URL, "/")
+	switch hc.Type {
+	case "tasmota":
+		q := url.Values{"cmnd": {"Status 0"}}
+		if hc.Username != "" {
+			q.Set("user", hc.Username)
+			q.Set("password", hc.Password)
+		}
+		var resp struct {
+			StatusSTS tasmotaState
+			StatusSNS tasmotaSensor
+		}
+		if err := getPlugJSON(base+"/cm?"+q.Encode(), hc, &resp); err != nil {
+			return st, err
+		}
+		st.relayOn = resp.StatusSTS.POWER == "ON"
+		if resp.StatusSNS.ENERGY.Power != nil {
+			st.power, st.hasPower = resp.StatusSNS.ENERGY.power(), true
+		}
+	case "shelly":
+		var resp struct {
+			Relays []struct {
+				IsOn bool `json:"ison"`
+			} `json:"relays"`
+			Meters []struct {
+				Power float64 `json:"power"`
+			} `json:"meters"`
+		}
+		if err := getPlugJSON(base+"/status", hc, &resp); err != nil {
+			return st, err
+		}
+		if len(resp.Relays) == 0 {
+			return st, fmt.Errorf("shelly reports no relay")
+		}
+		// A Shelly 1 has a relay but no meter
+		st.relayOn = resp.Relays[0].IsOn
+		if len(resp.Meters) > 0 {
+			st.power, st.hasPower = resp.Meters[0].Power, true
+		}
+	case "shelly-gen2":
+		var resp shellySwitch
+		if err := getPlugJSON(base+"/rpc/Switch.GetStatus?id=0", hc, &resp); err != nil {
+			return st, err
+		}
+		st.relayOn = resp.Output
+		if resp.APower != nil {
+			st.power, st.hasPower = *resp.APower, true
+		}
+	case "esphome":
+		var sw, power esphomeState
+		if err := getPlugJSON(base+"/switch/"+url.PathEscape(hc.Switch), hc, &sw); err != nil {
+			return st, err
+		}
+		st.relayOn = sw.State == "ON"
+		err := getPlugJSON(base+"/sensor/"+url.PathEscape(hc.PowerSensor), hc, &power)
+		if errors.Is(err, errNoEntity) {
+			return st, nil
+		}
+		if err != nil {
+			return st, err
+		}
+		// NaN before the first reading still shows the device has a meter
+		st.power, _ = power.Value.(float64)
+		st.hasPower = true
+	}
+	return st, nil
+}
+
+// switchPlug turns a plug's relay on or off, over HTTP or MQTT like its
+// status is read.
+func switchPlug(hc HeaterConfig, on bool) error {
+	if g := openthermGateway(hc); g != nil {
+		return g.switchCH(on)
+	}
+	if a := esphomeDevice(hc); a != nil {
+		return a.switchRelay(on)
+	}
+	if hc.Type == "gpio" {
+		return gpio.set(*hc.Pin, on)
+	}
+	if hc.Type == "simulated" {
+		return simulation.switchHeater(hc, on)
+	}
+	if hc.Topic != "" {
+		topic, payload := plugCommand(hc, on)
+		return mqttPublish(topic, payload)
+	}
+	base := strings.TrimRight(hc.URL, "/")
+	var target string
+	switch hc.Type {
+	case "tasmota":
+		state := "Off"
+		if on {
+			state = "On"
+		}
+		q := url.Values{"cmnd": {"Power " + state}}
+		if hc.Username != "" {
+			q.Set("user", hc.Username)
+			q.Set("password", hc.Password)
+		}
+		target = base + "/cm?" + q.Encode()
+	case "shelly":
+		turn := "off"
+		if on {
+			turn = "on"
+		}
+		target = base + "/relay/0?turn=" + turn
+	case "shelly-gen2":
+		target = base + "/rpc/Switch.Set?id=0&on=" + strconv.FormatBool(on)
+	case "esphome":
+		action := "turn_off"
+		if on {
+			action = "turn_on"
+		}
+		return postPlug(base+"/switch/"+url.PathEscape(hc.Switch)+"/"+action, hc)
+	}
+	var ignored json.RawMessage
+	return getPlugJSON(target, hc, &ignored)
+}
+
+// plugCommand is the MQTT message that switches a plug.
+func plugCommand(hc HeaterConfig, on bool) (string, []byte) {
+	topic := hc.Topic
+	switch hc.Type {
+	case "tasmota":
+		if on {
+			return "cmnd/" + topic + "/POWER", []byte("ON")
+		}
+		return "cmnd/" + topic + "/POWER", []byte("OFF")
+	case "shelly":
+		if on {
+			return "shellies/" + topic + "/relay/0/command", []byte("on")
+		}
+		return "shellies/" + topic + "/relay/0/command", []byte("off")
+	case "esphome":
+		if on {
+			return topic + "/switch/" + hc.Switch + "/command", []byte("ON")
+		}
+		return topic + "/switch/" + hc.Switch + "/command", []byte("OFF")
+	default:
+		return topic + "/rpc", []byte(fmt.Sprintf(`{"id":1,"src":"piheat","method":"Switch.Set","params":{"id":0,"on":%t}}`, on))
+	}
+}
+
+func getPlugJSON(target string, hc HeaterConfig, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Username != "" && hc.Type != "tasmota" {
+		req.SetBasicAuth(hc.Username, hc.Password)
+	}
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && hc.Type == "esphome" {
+		return fmt.Errorf("GET %s: %w", req.URL.Path, errNoEntity)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// postPlug sends a command that answers without a body, as ESPHome's web
+// server does.
+func postPlug(target string, hc HeaterConfig) error {
+	req, err := http.NewRequest(http.MethodPost, target, nil)
+	if err != nil {
+		return err
+	}
+	if hc.Username != "" {
+		req.SetBasicAuth(hc.Username, hc.Password)
+	}
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+type tasmotaState struct {
+	POWER string
+}
+
+type tasmotaSensor struct {
+	ENERGY tasmotaEnergy
+}
+
+// tasmotaEnergy.Power is a number, or an array on multi-channel devices.
+type tasmotaEnergy struct {
+	Power json.RawMessage
+}
+
+func (e tasmotaEnergy) power() float64 {
+	var p float64
+	if json.Unmarshal(e.Power, &p) == nil {
+		return p
+	}
+	var ps []float64
+	if json.Unmarshal(e.Power, &ps) == nil && len(ps) > 0 {
+		return ps[0]
+	}
+	return 0
+}
+
+// shellySwitch is a Shelly Plus switch; APower is missing on those
+// without a meter, such as the Plus 1.
+type shellySwitch struct {
+	Output bool     `json:"output"`
+	APower *float64 `json:"apower"`
+}
+
+// esphomeState is an ESPHome web server entity. Value is a sensor's
+// number, or NaN, which ESPHome sends as a string, before its first
+// reading.
+type esphomeState struct {
+	State string      `json:"state"`
+	Value interface{} `json:"value"`
+}
+
+// plugTopics lists the MQTT topics a plug publishes its state on, given
+// its Tasmota topic, Shelly device ID, Shelly Plus topic prefix or ESPHome
+// topic prefix.
+func plugTopics(hc HeaterConfig) []string {
+	topic := hc.Topic
+	switch hc.Type {
+	case "tasmota":
+		return []string{"stat/" + topic + "/POWER", "tele/" + topic + "/STATE", "tele/" + topic + "/SENSOR"}
+	case "shelly":
+		return []string{"shellies/" + topic + "/relay/0", "shellies/" + topic + "/relay/0/power"}
+	case "esphome":
+		return []string{topic + "/switch/" + hc.Switch + "/state", topic + "/sensor/" + hc.PowerSensor + "/state"}
+	default:
+		return []string{topic + "/status/switch:0"}
+	}
+}
+
+func (h *heaterCheck) message(topic string, payload []byte) {
+	text := strings.TrimSpace(string(payload))
+	hc := h.plug()
+	switch {
+	case hc.Type == "esphome" && strings.HasSuffix(topic, "/switch/"+hc.Switch+"/state"):
+		h.update(func(s *plugStatus) { s.relayOn = text == "ON" })
+	case hc.Type == "esphome" && strings.HasSuffix(topic, "/sensor/"+hc.PowerSensor+"/state"):
+		if p, err := strconv.ParseFloat(text, 64); err == nil {
+			h.update(func(s *plugStatus) { s.power, s.hasPower = p, true })
+		}
+	case strings.HasSuffix(topic, "/POWER"):
+		h.update(func(s *plugStatus) { s.relayOn = text == "ON" })
+	case strings.HasSuffix(topic, "/STATE"):
+		var st tasmotaState
+		if json.Unmarshal(payload, &st) == nil && st.POWER != "" {
+			h.update(func(s *plugStatus) { s.relayOn = st.POWER == "ON" })
+		}
+	case strings.HasSuffix(topic, "/SENSOR"):
+		var sns tasmotaSensor
+		if json.Unmarshal(payload, &sns) == nil && sns.ENERGY.Power != nil {
+			h.update(func(s *plugStatus) { s.power, s.hasPower = sns.ENERGY.power(), true })
+		}
+	case strings.HasSuffix(topic, "/relay/0"):
+		h.update(func(s *plugStatus) { s.relayOn = text == "on" })
+	case strings.HasSuffix(topic, "/relay/0/power"):
+		if p, err := strconv.ParseFloat(text, 64); err == nil {
+			h.update(func(s *plugStatus) { s.power, s.hasPower = p, true })
+		}
+	case strings.HasSuffix(topic, "/status/switch:0"):
+		var sw shellySwitch
+		if json.Unmarshal(payload, &sw) == nil {
+			h.update(func(s *plugStatus) {
+				*s = plugStatus{relayOn: sw.Output}
+				if sw.APower != nil {
+					s.power, s.hasPower = *sw.APower, true
+				}
+			})
+		}
+	}
+}
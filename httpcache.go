@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chartVersionInfo is what a chart's data depends on: the readings in its
+// window, summed up by their count and latest ID and time, and the
+// display precision it is rounded to. Readings arriving or leaving the
+// window change the count or the latest ID.
+type chartVersionInfo struct {
+	sensor, period string
+	count, maxID   int64
+	latest         time.Time
+	decimals       int
+	// variant is what else the request asked for that changes the
+	// response, such as smoothing or actuator bands.
+	variant string
+}
+
+func chartVersion(ctx context.Context, sensor, period string, now time.Time) (chartVersionInfo, error) {
+	defer timeQuery("chart_version")()
+	v := chartVersionInfo{sensor: sensor, period: period, decimals: readingDecimals(sensor)}
+	var maxID sql.NullInt64
+	var latest sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), MAX(id), MAX(timestamp) FROM temperature_readings WHERE sensor = ? AND timestamp >= ?",
+		sensor, sqliteTime(chartSince(period, now))).Scan(&v.count, &maxID, &latest)
+	if err != nil {
+		return v, err
+	}
+	v.maxID = maxID.Int64
+	if latest.Valid {
+		v.latest, _ = parseSQLiteTime(latest.String)
+	}
+	return v, nil
+}
+
+// etag is weak: the same data is sent compressed or not.
+func (v chartVersionInfo) etag() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%d\x00%d\x00%s", v.sensor, v.period, v.count, v.maxID, v.latest.Unix(), v.decimals, v.variant)))
+	return `W/"` + hex.EncodeToString(h[:8]) + `"`
+}
+
+// notModified sets the ETag and, unless modified is zero, Last-Modified
+// headers and answers 304 when the request already has that version. As
+// in RFC 9110, If-Modified-Since only counts without If-None-Match.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	match := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				match = true
+				break
+			}
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modified.Truncate(time.Second).After(t) {
+			match = true
+		}
+	}
+	if match {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return match
+}
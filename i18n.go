@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// languages are the languages the web UI is translated to. English is
+// complete; strings missing from another language fall back to it.
+var languages = []string{"en", "de", "fr", "nl"}
+
+const (
+	defaultLanguage = "en"
+	languageCookie  = "piheat_lang"
+)
+
+var (
+	messagesMu    sync.Mutex
+	messagesCache = map[string]map[string]string{}
+)
+
+func isLanguage(lang string) bool {
+	for _, l := range languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// readMessages reads i18n/{lang}.json, a flat object of UI strings by key.
+func readMessages(lang string) (map[string]string, error) {
+	data, err := fs.ReadFile(assets, "i18n/"+lang+".json")
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("i18n/%s.json: %v", lang, err)
+	}
+	return m, nil
+}
+
+// messagesFor returns the UI strings of lang over the English ones, read
+// once unless the assets come from disk.
+func messagesFor(lang string) (map[string]string, error) {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	if m, ok := messagesCache[lang]; ok && assetsDir == "" {
+		return m, nil
+	}
+	m, err := readMessages(defaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+	if lang != defaultLanguage {
+		own, err := readMessages(lang)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range own {
+			m[k] = v
+		}
+	}
+	messagesCache[lang] = m
+	return m, nil
+}
+
+// translate fills {0}, {1}... of a string with args.
+func translate(messages map[string]string, key string, args ...interface{}) string {
+	s, ok := messages[key]
+	if !ok {
+		return key
+	}
+	for i, arg := range args {
+		s = strings.ReplaceAll(s, "{"+strconv.Itoa(i)+"}", fmt.Sprint(arg))
+	}
+	return s
+}
+
+// localNumber formats v with decimals digits and the language's decimal
+// separator.
+func localNumber(messages map[string]string, v float64, decimals int) string {
+	return strings.Replace(strconv.FormatFloat(v, 'f', decimals, 64), ".", messages["format.decimal"], 1)
+}
+
+// languageFuncs are the template helpers of a language: t translates a
+// key, num, temp and cost format numbers, month and date name months and
+// days, and messages hands every string to the page's scripts.
+func languageFuncs(lang string, messages map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"lang":     func() string { return lang },
+		"messages": func() map[string]string { return messages },
+		"t": func(key string, args ...interface{}) string {
+			return translate(messages, key, args...)
+		},
+		"num": func(v float64, decimals int) string { return localNumber(messages, v, decimals) },
+		"temp": func(v *float64) string {
+			if v == nil {
+				return "-"
+			}
+			return localNumber(messages, *v, 1) + "°C"
+		},
+		"cost": func(v *float64) string {
+			if v == nil {
+				return "-"
+			}
+			s := localNumber(messages, *v, 2)
+			if config().Currency != "" {
+				s += " " + config().Currency
+			}
+			return s
+		},
+		"month": func(m int) string { return messages["month."+strconv.Itoa(m)] },
+		"months": func() []string {
+			names := make([]string, 12)
+			for m := range names {
+				names[m] = messages["month."+strconv.Itoa(m+1)]
+			}
+			return names
+		},
+		"date": func(day string) string {
+			d, err := time.Parse("2006-01-02", day)
+			if err != nil {
+				return day
+			}
+			return translate(messages, "format.date", d.Day(), messages["month."+strconv.Itoa(int(d.Month()))], d.Year())
+		},
+	}
+}
+
+// acceptedLanguage is the first of the Accept-Language header's languages,
+// by quality, that the UI is translated to.
+func acceptedLanguage(header string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.Index(tag, "-"); i >= 0 {
+			tag = tag[:i]
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				if parsed, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if isLanguage(tag) && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return ""
+	}
+	return choices[0].lang
+}
+
+func initLanguageTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS user_language (
+		username TEXT PRIMARY KEY,
+		language TEXT NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Language is the language pages are shown in to a request, and where it
+// came from: the user's setting, this browser's cookie, the browser's
+// Accept-Language or the default.
+type Language struct {
+	Language  string           `json:"language"`
+	Source    string           `json:"source"`
+	Available []LanguageOption `json:"available"`
+}
+
+// LanguageOption is a language to choose from, by its own name.
+type LanguageOption struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+func languageFor(r *http.Request) Language {
+	l := Language{Language: defaultLanguage, Source: "default", Available: []LanguageOption{}}
+	for _, code := range languages {
+		if m, err := messagesFor(code); err == nil {
+			l.Available = append(l.Available, LanguageOption{code, m["language.name"]})
+		}
+	}
+	if u := currentUser(r); u != nil {
+		var lang string
+		err := db.QueryRow("SELECT language FROM user_language WHERE username = ?", u.Username).Scan(&lang)
+		if err == nil && isLanguage(lang) {
+			l.Language, l.Source = lang, "user"
+			return l
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error reading the language of %s: %v", u.Username, err)
+		}
+	}
+	if c, err := r.Cookie(languageCookie); err == nil && isLanguage(c.Value) {
+		l.Language, l.Source = c.Value, "cookie"
+		return l
+	}
+	if lang := acceptedLanguage(r.Header.Get("Accept-Language")); lang != "" {
+		l.Language, l.Source = lang, "browser"
+	}
+	return l
+}
+
+// requestLanguage is the language to show pages in to r.
+func requestLanguage(r *http.Request) string {
+	return languageFor(r).Language
+}
+
+// languageHandler serves GET /api/language and PUT /api/language, which
+// sets the language of the logged-in user, or of this browser without
+// one. An empty language goes back to the browser's.
+func languageHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, languageFor(r))
+	case http.MethodPut:
+		var req struct {
+			Language string `json:"language"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Language != "" && !isLanguage(req.Language) {
+			http.Error(w, fmt.Sprintf("language must be one of %s, or empty for the browser's", strings.Join(languages, ", ")), http.StatusBadRequest)
+			return
+		}
+		cookie := &http.Cookie{Name: languageCookie, Value: req.Language, Path: basePath + "/", MaxAge: 365 * 24 * 3600,
+			HttpOnly: true, SameSite: http.SameSiteLaxMode}
+		if req.Language == "" {
+			cookie.MaxAge = -1
+		}
+		http.SetCookie(w, cookie)
+		if u := currentUser(r); u != nil {
+			var old interface{}
+			var oldLanguage string
+			if err := db.QueryRow("SELECT language FROM user_language WHERE username = ?", u.Username).Scan(&oldLanguage); err == nil {
+				old = oldLanguage
+			}
+			var err error
+			if req.Language == "" {
+				_, err = db.Exec("DELETE FROM user_language WHERE username = ?", u.Username)
+			} else {
+				_, err = db.Exec(`INSERT INTO user_language (username, language) VALUES (?, ?)
+					ON CONFLICT(username) DO UPDATE SET language = excluded.language`, u.Username, req.Language)
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving language: %v", err), http.StatusInternalServerError)
+				return
+			}
+			auditRequest(r, "language.set", u.Username, old, req.Language)
+		}
+		// Answer as the next request, with the new cookie, will be
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != languageCookie {
+				r.AddCookie(c)
+			}
+		}
+		if req.Language != "" {
+			r.AddCookie(cookie)
+		}
+		writeJSON(w, http.StatusOK, languageFor(r))
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
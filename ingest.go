@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// IngestConfig is a device posting its own payloads to
+// /api/ingest/{device}. Value and SensorField are JSON paths such as
+// $.data.temp or, for CSV, column names or numbers from 1. Records is the
+// JSON path of an array holding one record per reading; without it an
+// array payload is taken as records and anything else as one record.
+// Sensor names the readings unless SensorField picks the name from the
+// record. Values are multiplied by Scale (default 1) and Offset added.
+type IngestConfig struct {
+	Token       string  `json:"token"`
+	Format      string  `json:"format,omitempty"`
+	Records     string  `json:"records,omitempty"`
+	Value       string  `json:"value"`
+	Sensor      string  `json:"sensor,omitempty"`
+	SensorField string  `json:"sensor_field,omitempty"`
+	Scale       float64 `json:"scale,omitempty"`
+	Offset      float64 `json:"offset,omitempty"`
+	Delimiter   string  `json:"delimiter,omitempty"`
+}
+
+func (c IngestConfig) check() error {
+	if c.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	if c.Value == "" {
+		return fmt.Errorf("value is required")
+	}
+	if c.Sensor == "" && c.SensorField == "" {
+		return fmt.Errorf("sensor or sensor_field is required")
+	}
+	switch c.Format {
+	case "", "json":
+		for _, p := range []string{c.Records, c.Value, c.SensorField} {
+			if p == "" {
+				continue
+			}
+			if _, err := parseJSONPath(p); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		if c.Records != "" {
+			return fmt.Errorf("records only applies to json")
+		}
+		if len([]rune(c.Delimiter)) > 1 {
+			return fmt.Errorf("delimiter must be one character")
+		}
+	default:
+		return fmt.Errorf("format must be json or csv")
+	}
+	return nil
+}
+
+// IngestResult is the response to a device's post.
+type IngestResult struct {
+	Recorded int      `json:"recorded"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// maxIngestErrors caps the errors returned for one post.
+const maxIngestErrors = 10
+
+// ingestHandler serves POST /api/ingest/{device}. Devices authenticate
+// with their own token as a Bearer token or token parameter, so they need
+// no user account.
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	device := strings.TrimPrefix(r.URL.Path, "/api/ingest/")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dc, ok := config().Ingest[device]
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	// Unknown devices and wrong tokens look the same
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(dc.Token)) != 1 {
+		http.Error(w, "Invalid device or token", http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var readings []ingestReading
+	var res IngestResult
+	if dc.Format == "csv" {
+		readings, res.Errors, err = mapCSV(dc, body)
+	} else {
+		readings, res.Errors, err = mapJSON(dc, body)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, rd := range readings {
+		recordReading(rd.sensor, rd.value, sourceIngest+device)
+	}
+	res.Recorded = len(readings)
+	if len(res.Errors) > maxIngestErrors {
+		res.Errors = append(res.Errors[:maxIngestErrors], fmt.Sprintf("and %d more", len(res.Errors)-maxIngestErrors))
+	}
+	status := http.StatusOK
+	if res.Recorded == 0 && len(res.Errors) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, res)
+}
+
+type ingestReading struct {
+	sensor string
+	value  float64
+}
+
+// reading maps a record's value and sensor name into a reading.
+func (c IngestConfig) reading(value, sensor interface{}) (ingestReading, error) {
+	v, err := ingestNumber(value)
+	if err != nil {
+		return ingestReading{}, fmt.Errorf("value: %v", err)
+	}
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	rd := ingestReading{sensor: c.Sensor, value: v*scale + c.Offset}
+	if c.SensorField != "" {
+		s, ok := sensor.(string)
+		if f, isNum := sensor.(float64); isNum {
+			s, ok = strconv.FormatFloat(f, 'f', -1, 64), true
+		}
+		s = strings.TrimSpace(s)
+		if !ok || s == "" {
+			return rd, fmt.Errorf("sensor_field: no sensor name")
+		}
+		if c.Sensor != "" {
+			s = c.Sensor + "." + s
+		}
+		rd.sensor = s
+	}
+	return rd, nil
+}
+
+func ingestNumber(v interface{}) (float64, error) {
+	var f float64
+	switch x := v.(type) {
+	case float64:
+		f = x
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(strings.TrimSpace(x), 64); err != nil {
+			return 0, fmt.Errorf("%q is not a number", x)
+		}
+	case nil:
+		return 0, fmt.Errorf("missing")
+	default:
+		return 0, fmt.Errorf("not a number")
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("not a finite number")
+	}
+	return f, nil
+}
+
+func mapJSON(c IngestConfig, body []byte) ([]ingestReading, []string, error) {
+	var payload interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := dec.Decode(&payload); err != nil {
+		return nil, nil, err
+	}
+	var records []interface{}
+	if c.Records != "" {
+		v, err := evalJSONPath(c.Records, payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("records: %v", err)
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("records: not an array")
+		}
+		records = list
+	} else if list, ok := payload.([]interface{}); ok {
+		records = list
+	} else {
+		records = []interface{}{payload}
+	}
+	var readings []ingestReading
+	var errs []string
+	for i, rec := range records {
+		value, err := evalJSONPath(c.Value, rec)
+		var sensor interface{}
+		if err == nil && c.SensorField != "" {
+			sensor, err = evalJSONPath(c.SensorField, rec)
+		}
+		var rd ingestReading
+		if err == nil {
+			rd, err = c.reading(value, sensor)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("record %d: %v", i+1, err))
+			continue
+		}
+		readings = append(readings, rd)
+	}
+	return readings, errs, nil
+}
+
+// jsonPathStep is a member name or, with index >= 0, an array index.
+type jsonPathStep struct {
+	name  string
+	index int
+}
+
+// parseJSONPath reads the JSONPath subset devices need: $ followed by
+// .name, ['name'] and [index] steps.
+func parseJSONPath(p string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("json path %q must start with $", p)
+	}
+	var steps []jsonPathStep
+	rest := p[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("json path %q: empty name", p)
+			}
+			steps = append(steps, jsonPathStep{name: name, index: -1})
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: unterminated ['", p)
+			}
+			steps = append(steps, jsonPathStep{name: rest[2:end], index: -1})
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: unterminated [", p)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("json path %q: invalid index %q", p, rest[1:end])
+			}
+			steps = append(steps, jsonPathStep{index: i})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("json path %q: unexpected %q", p, rest)
+		}
+	}
+	return steps, nil
+}
+
+func evalJSONPath(p string, v interface{}) (interface{}, error) {
+	steps, err := parseJSONPath(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range steps {
+		if s.index >= 0 {
+			list, ok := v.([]interface{})
+			if !ok || s.index >= len(list) {
+				return nil, fmt.Errorf("%s: no element %d", p, s.index)
+			}
+			v = list[s.index]
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: no member %q", p, s.name)
+		}
+		if v, ok = obj[s.name]; !ok {
+			return nil, fmt.Errorf("%s: no member %q", p, s.name)
+		}
+	}
+	return v, nil
+}
+
+// mapCSV takes one reading per row. Columns are numbers from 1 or, when
+// any column is named, names from the header row.
+func mapCSV(c IngestConfig, body []byte) ([]ingestReading, []string, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	if c.Delimiter != "" {
+		r.Comma = []rune(c.Delimiter)[0]
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	named := !isColumnNumber(c.Value) || (c.SensorField != "" && !isColumnNumber(c.SensorField))
+	var header []string
+	if named {
+		if len(rows) == 0 {
+			return nil, nil, fmt.Errorf("no header row")
+		}
+		header, rows = rows[0], rows[1:]
+	}
+	column := func(ref string) (int, error) {
+		if isColumnNumber(ref) {
+			n, _ := strconv.Atoi(ref)
+			return n - 1, nil
+		}
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), ref) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("no column %q in the header", ref)
+	}
+	valueCol, err := column(c.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	sensorCol := -1
+	if c.SensorField != "" {
+		if sensorCol, err = column(c.SensorField); err != nil {
+			return nil, nil, err
+		}
+	}
+	var readings []ingestReading
+	var errs []string
+	for i, row := range rows {
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		var value, sensor interface{}
+		if valueCol < len(row) {
+			value = row[valueCol]
+		}
+		if sensorCol >= 0 && sensorCol < len(row) {
+			sensor = row[sensorCol]
+		}
+		rd, err := c.reading(value, sensor)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("row %d: %v", i+1, err))
+			continue
+		}
+		readings = append(readings, rd)
+	}
+	return readings, errs, nil
+}
+
+func isColumnNumber(ref string) bool {
+	if ref == "" || ref == "0" {
+		return false
+	}
+	for _, r := range ref {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// readOnly is set for a second instance serving the dashboard from a
+// database another instance is recording into. It does not sample, alert,
+// forward or change anything.
+var readOnly bool
+
+// instanceLock holds the lock file open for the life of the process; the
+// lock is released when the file is closed, including by the garbage
+// collector, so it must stay referenced.
+var instanceLock *os.File
+
+// rejectWrites refuses every request that could modify data on a
+// read-only instance.
+func rejectWrites(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+		default:
+			apiError(w, r, http.StatusForbidden, "read_only", "This piheat instance is read-only")
+		}
+	})
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// acquireInstanceLock takes an exclusive advisory lock on path and writes
+// the process ID into it. The lock disappears with the process, so a stale
+// file left by a crash does not block the next start.
+func acquireInstanceLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		data, _ := os.ReadFile(path)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid := strings.TrimSpace(string(data))
+			if pid == "" {
+				pid = "unknown"
+			}
+			return nil, fmt.Errorf("another piheat instance (pid %s) is already using this database (lock %s)", pid, path)
+		}
+		return nil, err
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
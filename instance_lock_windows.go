@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// acquireInstanceLock only creates the lock file on Windows, which has no
+// flock; running two instances there is not detected.
+func acquireInstanceLock(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
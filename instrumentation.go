@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	_ "net/http/pprof" // registers /debug/pprof/ on the default mux, behind guardPprof
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// DebugConfig turns on the Go profiler at /debug/pprof/, for admins only.
+type DebugConfig struct {
+	Pprof bool `json:"pprof"`
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the duration
+// histograms: from a cached answer to a year-long query on an SD card.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	max    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// quantile estimates the q-quantile as the upper bound of the bucket it
+// falls in, or the largest value seen beyond the last.
+func (h *histogram) quantile(q float64) float64 {
+	rank := uint64(q*float64(h.count) + 0.5)
+	for i, le := range latencyBuckets {
+		if h.counts[i] >= rank {
+			if le > h.max {
+				return h.max
+			}
+			return le
+		}
+	}
+	return h.max
+}
+
+// histogramVec is a duration histogram per set of label values, e.g. per
+// route, method and status.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: map[string]*histogram{}}
+}
+
+func (v *histogramVec) observe(d time.Duration, values ...string) {
+	key := strings.Join(values, "\x00")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h := v.series[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		v.series[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// keys returns the label values of each series, sorted. The caller holds mu.
+func (v *histogramVec) keys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *histogramVec) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	for i, value := range strings.Split(key, "\x00") {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", v.labels[i], strconv.Quote(value)))
+	}
+	return "{" + strings.Join(append(pairs, extra...), ",") + "}"
+}
+
+func (v *histogramVec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", v.name)
+	for _, k := range v.keys() {
+		h := v.series[k]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelPairs(k, `le="`+strconv.FormatFloat(le, 'f', -1, 64)+`"`), h.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelPairs(k, `le="+Inf"`), h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, v.labelPairs(k), strconv.FormatFloat(h.sum, 'f', -1, 64))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, v.labelPairs(k), h.count)
+	}
+}
+
+// writeTable lists the series for /debug/status, slowest on average first.
+func (v *histogramVec) writeTable(tw *tabwriter.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := v.keys()
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := v.series[keys[i]], v.series[keys[j]]
+		return a.sum/float64(a.count) > b.sum/float64(b.count)
+	})
+	fmt.Fprintf(tw, "%s\tcount\tavg\tp50\tp95\tmax\n", strings.Join(v.labels, "\t"))
+	ms := func(s float64) string { return strconv.FormatFloat(s*1000, 'f', 1, 64) + "ms" }
+	for _, k := range keys {
+		h := v.series[k]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", strings.ReplaceAll(k, "\x00", "\t"), h.count,
+			ms(h.sum/float64(h.count)), ms(h.quantile(0.5)), ms(h.quantile(0.95)), ms(h.max))
+	}
+}
+
+var (
+	httpDurations = newHistogramVec("piheat_http_request_duration_seconds",
+		"Time to serve HTTP requests, by route, method and status.", "route", "method", "code")
+	queryDurations = newHistogramVec("piheat_db_query_duration_seconds",
+		"Time taken by database queries, by query.", "query")
+	sensorReadDurations = newHistogramVec("piheat_sensor_read_duration_seconds",
+		"Time to read a local sensor, by sensor.", "sensor")
+)
+
+// readingInserts counts readings written to the database, and those the
+// database refused and that were queued instead.
+var readingInserts struct {
+	ok, failed int64
+}
+
+var processStart = time.Now()
+
+// timeQuery starts timing the named query: defer timeQuery("name")().
+func timeQuery(name string) func() {
+	start := time.Now()
+	return func() { queryDurations.observe(time.Since(start), name) }
+}
+
+func observeInsert(err error) {
+	if err != nil {
+		atomic.AddInt64(&readingInserts.failed, 1)
+	} else {
+		atomic.AddInt64(&readingInserts.ok, 1)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// instrument times each request by the route that serves it, the pattern
+// it was registered with, so paths with IDs share one series.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := http.DefaultServeMux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		default:
+			method = "other"
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		httpDurations.observe(time.Since(start), route, method, strconv.Itoa(sw.status))
+	})
+}
+
+// guardPprof keeps /debug/pprof/ unknown unless debug.pprof is set, and to
+// anyone but admins. The config is read per request, so reloads apply at
+// once.
+func guardPprof(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !config().Debug.Pprof {
+			http.NotFound(w, r)
+			return
+		}
+		requireAdmin(h.ServeHTTP)(w, r)
+	})
+}
+
+// writeInstrumentationMetrics adds the process, insert and duration
+// metrics to /metrics.
+func writeInstrumentationMetrics(b *strings.Builder) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	b.WriteString("# HELP piheat_goroutines Goroutines running.\n")
+	b.WriteString("# TYPE piheat_goroutines gauge\n")
+	fmt.Fprintf(b, "piheat_goroutines %d\n", runtime.NumGoroutine())
+	b.WriteString("# HELP piheat_heap_bytes Bytes of allocated heap objects.\n")
+	b.WriteString("# TYPE piheat_heap_bytes gauge\n")
+	fmt.Fprintf(b, "piheat_heap_bytes %d\n", mem.HeapAlloc)
+	b.WriteString("# HELP piheat_db_open_connections Open connections to the database.\n")
+	b.WriteString("# TYPE piheat_db_open_connections gauge\n")
+	fmt.Fprintf(b, "piheat_db_open_connections %d\n", db.Stats().OpenConnections)
+	b.WriteString("# HELP piheat_readings_inserted_total Readings written to the database.\n")
+	b.WriteString("# TYPE piheat_readings_inserted_total counter\n")
+	fmt.Fprintf(b, "piheat_readings_inserted_total %d\n", atomic.LoadInt64(&readingInserts.ok))
+	b.WriteString("# HELP piheat_reading_insert_errors_total Readings the database refused, queued to be written later.\n")
+	b.WriteString("# TYPE piheat_reading_insert_errors_total counter\n")
+	fmt.Fprintf(b, "piheat_reading_insert_errors_total %d\n", atomic.LoadInt64(&readingInserts.failed))
+	httpDurations.write(b)
+	queryDurations.write(b)
+	sensorReadDurations.write(b)
+}
+
+// debugStatusHandler serves /debug/status, the instrumentation of
+// /metrics as plain text for reading over SSH or in a browser.
+func debugStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := db.Stats()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "piheat %s, %s, up %s\n\n", assetVersion, runtime.Version(), time.Since(processStart).Round(time.Second))
+	fmt.Fprintf(tw, "Goroutines\t%d\n", runtime.NumGoroutine())
+	fmt.Fprintf(tw, "Heap\t%.1f MiB\n", float64(mem.HeapAlloc)/(1<<20))
+	fmt.Fprintf(tw, "GC runs\t%d\n", mem.NumGC)
+	fmt.Fprintf(tw, "DB connections\t%d open, %d in use\n", stats.OpenConnections, stats.InUse)
+	fmt.Fprintf(tw, "Readings inserted\t%d, %d refused\n", atomic.LoadInt64(&readingInserts.ok), atomic.LoadInt64(&readingInserts.failed))
+	for _, s := range []struct {
+		title string
+		v     *histogramVec
+	}{
+		{"HTTP requests", httpDurations},
+		{"Database queries", queryDurations},
+		{"Sensor reads", sensorReadDurations},
+	} {
+		fmt.Fprintf(tw, "\n%s\n", s.title)
+		s.v.writeTable(tw)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dashboard views: the full dashboard with charts, an overview of the
+// heating zones, and a summary of every sensor's latest reading for small
+// screens.
+const (
+	viewCharts  = "charts"
+	viewZones   = "zones"
+	viewSummary = "summary"
+)
+
+var dashboardViews = map[string]bool{viewCharts: true, viewZones: true, viewSummary: true}
+
+// deviceCookie holds a device token, which tells a kiosk or wall display
+// apart from other browsers.
+const deviceCookie = "piheat_device"
+
+// Device is a browser registered to open a given view, such as a kiosk in
+// the hall. It is identified by the token in its cookie, which the
+// registering admin sees once.
+type Device struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	View      string     `json:"view"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+}
+
+// NewDevice is the POST /api/admin/devices response: the device, its token
+// and the link that sets it up on the device.
+type NewDevice struct {
+	Device
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// Landing is the view / opens with for a request, and where that choice
+// comes from: the device, the user or landing_view.
+type Landing struct {
+	View   string  `json:"view"`
+	Source string  `json:"source"`
+	Device *Device `json:"device,omitempty"`
+	User   string  `json:"user,omitempty"`
+}
+
+func initLandingTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS devices (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		view TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_seen DATETIME
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_landing (
+		username TEXT PRIMARY KEY,
+		view TEXT NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const deviceColumns = "id, name, view, created_at, last_seen"
+
+func scanDevice(row interface{ Scan(...interface{}) error }) (Device, error) {
+	var d Device
+	var createdAt string
+	var lastSeen sql.NullString
+	if err := row.Scan(&d.ID, &d.Name, &d.View, &createdAt, &lastSeen); err != nil {
+		return d, err
+	}
+	d.CreatedAt, _ = parseSQLiteTime(createdAt)
+	if lastSeen.Valid {
+		t, _ := parseSQLiteTime(lastSeen.String)
+		d.LastSeen = &t
+	}
+	return d, nil
+}
+
+// requestDevice returns the device whose cookie r carries, or nil.
+func requestDevice(r *http.Request) *Device {
+	c, err := r.Cookie(deviceCookie)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	return deviceByToken(c.Value)
+}
+
+func deviceByToken(token string) *Device {
+	d, err := scanDevice(db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE token_hash = ?", hashToken(token)))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error querying database: %v", err)
+		}
+		return nil
+	}
+	return &d
+}
+
+// newDeviceLink reports whether r opens the link that sets up a device.
+func newDeviceLink(r *http.Request) bool {
+	token := r.URL.Query().Get("device")
+	return r.URL.Path == "/" && token != "" && deviceByToken(token) != nil
+}
+
+func setDeviceCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookie,
+		Value:    token,
+		Path:     basePath + "/",
+		MaxAge:   10 * 365 * 24 * 3600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// landingFor works out the view / opens with: the device's, then the
+// logged-in user's, then landing_view.
+func landingFor(r *http.Request) (Landing, error) {
+	if d := requestDevice(r); d != nil {
+		if _, err := db.Exec("UPDATE devices SET last_seen = ? WHERE id = ?", sqliteTime(time.Now()), d.ID); err != nil {
+			return Landing{}, err
+		}
+		return Landing{View: d.View, Source: "device", Device: d}, nil
+	}
+	if u := currentUser(r); u != nil {
+		var view string
+		err := db.QueryRow("SELECT view FROM user_landing WHERE username = ?", u.Username).Scan(&view)
+		if err == nil {
+			return Landing{View: view, Source: "user", User: u.Username}, nil
+		}
+		if err != sql.ErrNoRows {
+			return Landing{}, err
+		}
+	}
+	return Landing{View: config().LandingView, Source: "default"}, nil
+}
+
+// landingHandler serves GET /api/landing, the view / opens with here, and
+// PUT /api/landing, which sets it for the logged-in user.
+func landingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l, err := landingFor(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+	case http.MethodPut:
+		u := currentUser(r)
+		if u == nil {
+			http.Error(w, "Log in to choose your own view; devices are registered under /api/v1/admin/devices", http.StatusConflict)
+			return
+		}
+		var req struct {
+			View string `json:"view"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var old interface{}
+		var oldView string
+		if err := db.QueryRow("SELECT view FROM user_landing WHERE username = ?", u.Username).Scan(&oldView); err == nil {
+			old = oldView
+		}
+		if req.View == "" {
+			if _, err := db.Exec("DELETE FROM user_landing WHERE username = ?", u.Username); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving view: %v", err), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			if !dashboardViews[req.View] {
+				http.Error(w, "view must be charts, zones or summary, or empty for the default", http.StatusBadRequest)
+				return
+			}
+			if _, err := db.Exec(`INSERT INTO user_landing (username, view) VALUES (?, ?)
+				ON CONFLICT(username) DO UPDATE SET view = excluded.view`, u.Username, req.View); err != nil {
+				http.Error(w, fmt.Sprintf("Error saving view: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		auditRequest(r, "landing.set", u.Username, old, req.View)
+		l, err := landingFor(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, l)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type deviceRequest struct {
+	Name string `json:"name"`
+	View string `json:"view"`
+}
+
+func (d deviceRequest) check() error {
+	if strings.TrimSpace(d.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !dashboardViews[d.View] {
+		return fmt.Errorf("view must be charts, zones or summary")
+	}
+	return nil
+}
+
+// devicesHandler serves GET and POST /api/admin/devices and PUT and DELETE
+// /api/admin/devices/{id}.
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/devices"), "/")
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			rows, err := db.Query("SELECT " + deviceColumns + " FROM devices ORDER BY name, id")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+			list := []Device{}
+			for rows.Next() {
+				d, err := scanDevice(rows)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+					return
+				}
+				list = append(list, d)
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			createDevice(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := scanDevice(db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var req deviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid device: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := req.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("UPDATE devices SET name = ?, view = ? WHERE id = ?", strings.TrimSpace(req.Name), req.View, id); err != nil {
+			http.Error(w, fmt.Sprintf("Error saving device: %v", err), http.StatusInternalServerError)
+			return
+		}
+		updated := d
+		updated.Name, updated.View = strings.TrimSpace(req.Name), req.View
+		auditRequest(r, "device.update", idStr, d, updated)
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		if _, err := db.Exec("DELETE FROM devices WHERE id = ?", id); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting device: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, "device.delete", idStr, d, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createDevice(w http.ResponseWriter, r *http.Request) {
+	var req deviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid device: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, fmt.Sprintf("Error creating token: %v", err), http.StatusInternalServerError)
+		return
+	}
+	nd := NewDevice{Device: Device{Name: strings.TrimSpace(req.Name), View: req.View, CreatedAt: time.Now().UTC().Truncate(time.Second)},
+		Token: base64.RawURLEncoding.EncodeToString(b)}
+	res, err := db.Exec("INSERT INTO devices (name, token_hash, view, created_at) VALUES (?, ?, ?, ?)",
+		nd.Name, hashToken(nd.Token), nd.View, sqliteTime(nd.CreatedAt))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving device: %v", err), http.StatusInternalServerError)
+		return
+	}
+	nd.ID, _ = res.LastInsertId()
+	nd.URL = basePath + "/?device=" + nd.Token
+	if u := dashboardURL(); u != "" {
+		nd.URL = u + "/?device=" + nd.Token
+	}
+	auditRequest(r, "device.create", strconv.FormatInt(nd.ID, 10), nil, nd.Device)
+	writeJSON(w, http.StatusCreated, nd)
+}
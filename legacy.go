@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// legacyReading is a sensor's value for the /legacy endpoints: the CPU
+// read live as for /api/temperature, others their latest reading. ok is
+// false for a sensor piheat has never heard from, and online false for
+// one that has gone quiet.
+func legacyReading(sensor string) (value float64, online, ok bool, err error) {
+	if sensor == "cpu" {
+		temp, err := getTemperature()
+		if err != nil {
+			return 0, false, true, err
+		}
+		return calibrated("cpu", temp), true, true, nil
+	}
+	for _, s := range sensorsMonitor.statuses(clock.Now()) {
+		if s.Name == sensor {
+			return s.LastValue, s.Online, true, nil
+		}
+	}
+	return 0, false, false, nil
+}
+
+// legacyHandler serves the plain text formats older scripts and tools
+// expect, under /legacy/:
+//
+//	/legacy/temp    temp=55.2
+//	/legacy/value   55.2
+//	/legacy/munin   a Munin plugin's values, with /config and /autoconf
+//
+// temp and value give the CPU temperature, or another sensor's with
+// sensor=.
+func legacyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	name := strings.TrimPrefix(r.URL.Path, "/legacy/")
+	switch name {
+	case "temp", "value":
+		sensor := r.URL.Query().Get("sensor")
+		if sensor == "" {
+			sensor = "cpu"
+		}
+		v, online, ok, err := legacyReading(sensor)
+		switch {
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error reading temperature: %v", err), http.StatusInternalServerError)
+			return
+		case !ok:
+			http.Error(w, "Unknown sensor", http.StatusNotFound)
+			return
+		case !online:
+			// A failing request tells a cron script not to record a stale value
+			http.Error(w, fmt.Sprintf("Sensor %s is offline", sensor), http.StatusServiceUnavailable)
+			return
+		}
+		if name == "temp" {
+			fmt.Fprintf(w, "temp=%s\n", formatReading(sensor, v))
+		} else {
+			fmt.Fprintln(w, formatReading(sensor, v))
+		}
+	case "munin", "munin/":
+		writeMunin(w, false)
+	case "munin/config":
+		writeMunin(w, true)
+	case "munin/autoconf":
+		fmt.Fprintln(w, "yes")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeMunin writes the temperature sensors as one Munin graph: its config
+// with a label per sensor and the thresholds on the CPU, or else the
+// values, U for a sensor that is offline. Sensors with another unit, such
+// as pressure, are left out.
+func writeMunin(w http.ResponseWriter, describe bool) {
+	if describe {
+		fmt.Fprintln(w, "graph_title piheat temperatures")
+		fmt.Fprintln(w, "graph_vlabel °C")
+		fmt.Fprintln(w, "graph_category sensors")
+		fmt.Fprintln(w, "graph_args --base 1000")
+	}
+	for _, s := range sensorsMonitor.statuses(clock.Now()) {
+		if s.Unit != "" {
+			continue
+		}
+		field := muninField(s.Name)
+		if describe {
+			fmt.Fprintf(w, "%s.label %s\n", field, s.Name)
+			if s.Name == "cpu" {
+				fmt.Fprintf(w, "%s.warning %g\n", field, config().Thresholds.Warning)
+				fmt.Fprintf(w, "%s.critical %g\n", field, config().Thresholds.Critical)
+			}
+			continue
+		}
+		value := "U"
+		if s.Online {
+			value = formatReading(s.Name, s.LastValue)
+		}
+		fmt.Fprintf(w, "%s.value %s\n", field, value)
+	}
+}
+
+// muninField turns a sensor name into a Munin field name, which may only
+// hold letters, digits and underscores and must not start with a digit.
+func muninField(sensor string) string {
+	field := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, sensor)
+	if field == "" || field[0] >= '0' && field[0] <= '9' {
+		field = "_" + field
+	}
+	return field
+}
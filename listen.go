@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes sockets on.
+const systemdFirstFD = 3
+
+// systemdSockets holds the sockets systemd passed open for the life of the
+// process, so piheat restarting itself in place gets them again.
+var systemdSockets []*os.File
+
+// openListeners opens the HTTP listeners: the sockets systemd passed when
+// started by socket activation, otherwise each of the comma-separated
+// addresses in spec. An address is host:port, [::1]:port for IPv6 or
+// unix:/path for a Unix socket, which gets socketMode.
+func openListeners(spec string, socketMode os.FileMode) ([]net.Listener, error) {
+	if ls, err := systemdListeners(); err != nil || len(ls) > 0 {
+		return ls, err
+	}
+	var ls []net.Listener
+	for _, addr := range strings.Split(spec, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		l, err := listen(addr, socketMode)
+		if err != nil {
+			for _, open := range ls {
+				open.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	return ls, nil
+}
+
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	// A socket file left by a crash would make the listen fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Set exactly, whatever the umask, so only the owner and the group the
+	// proxy is in can connect by default
+	if err := os.Chmod(path, socketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket
+// activation, if any were passed to this process.
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	var ls []net.Listener
+	for fd := systemdFirstFD; fd < systemdFirstFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd socket "+strconv.Itoa(fd))
+		systemdSockets = append(systemdSockets, f)
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("socket %d from systemd: %v", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// listenerAddrs lists where the listeners accept connections, for the log.
+func listenerAddrs(ls []net.Listener) string {
+	addrs := make([]string, len(ls))
+	for i, l := range ls {
+		addrs[i] = l.Addr().String()
+		if l.Addr().Network() == "unix" {
+			addrs[i] = "unix:" + addrs[i]
+		}
+	}
+	return strings.Join(addrs, ", ")
+}
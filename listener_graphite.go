@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lineListener accepts metrics as Graphite plaintext ("name value
+// timestamp") or collectd PUTVAL lines and records the mapped ones as
+// readings. Readings are stored at arrival time; timestamps in the lines
+// are ignored.
+type lineListener struct {
+	sensors map[string]string
+}
+
+func (l *lineListener) sensorFor(metric string) (string, bool) {
+	if len(l.sensors) == 0 {
+		return metric, true
+	}
+	if s, ok := l.sensors[metric]; ok {
+		return orDefault(s, metric), true
+	}
+	for pattern, s := range l.sensors {
+		if ok, _ := path.Match(pattern, metric); ok {
+			return orDefault(s, metric), true
+		}
+	}
+	return "", false
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// parseLine returns the metric and value of one line in either format.
+func parseLine(line string) (metric string, value float64, err error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "PUTVAL" {
+		return parsePutval(fields[1:])
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", 0, fmt.Errorf("want \"name value [timestamp]\"")
+	}
+	value, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value %q", fields[1])
+	}
+	return fields[0], value, nil
+}
+
+// parsePutval handles `PUTVAL host/plugin/type [interval=N] time:value`,
+// taking the first value of the last sample.
+func parsePutval(fields []string) (string, float64, error) {
+	if len(fields) < 2 {
+		return "", 0, fmt.Errorf("want \"PUTVAL identifier [options] time:value\"")
+	}
+	ident := strings.Trim(fields[0], `"`)
+	sample := fields[len(fields)-1]
+	parts := strings.Split(sample, ":")
+	if len(parts) < 2 {
+		return "", 0, fmt.Errorf("invalid sample %q", sample)
+	}
+	if parts[1] == "U" {
+		return ident, math.NaN(), nil
+	}
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid value %q", parts[1])
+	}
+	return ident, value, nil
+}
+
+func (l *lineListener) handle(line, from string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	metric, value, err := parseLine(line)
+	if err != nil {
+		log.Printf("Error parsing metric line from %s: %v", from, err)
+		return
+	}
+	// collectd sends U for unknown values
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	if sensor, ok := l.sensorFor(metric); ok {
+		recordReading(sensor, value, sourceGraphite+remoteHost(from))
+	}
+}
+
+// remoteHost drops the port from a remote address, which changes with each
+// connection of the same device.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (l *lineListener) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error accepting metric connection: %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			from := conn.RemoteAddr().String()
+			r := bufio.NewReader(conn)
+			for {
+				// Idle connections are dropped so clients that vanish
+				// without closing do not pile up
+				conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+				line, err := r.ReadString('\n')
+				l.handle(line, from)
+				if err != nil {
+					if err != io.EOF {
+						log.Printf("Error reading metrics from %s: %v", from, err)
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (l *lineListener) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Error reading metric datagram: %v", err)
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handle(line, addr.String())
+		}
+	}
+}
+
+// startLineListener opens the configured TCP (and optionally UDP) port.
+func startLineListener(c *GraphiteConfig) error {
+	for pattern := range c.Sensors {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("graphite: invalid metric pattern %q", pattern)
+		}
+	}
+	l := &lineListener{sensors: c.Sensors}
+	ln, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return err
+	}
+	go l.serveTCP(ln)
+	if c.UDP {
+		pc, err := net.ListenPacket("udp", c.Listen)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		go l.serveUDP(pc)
+	}
+	log.Printf("Accepting Graphite/collectd lines on %s", c.Listen)
+	return nil
+}
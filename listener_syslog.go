@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogRule is a compiled SyslogRule.
+type syslogRule struct {
+	host    string
+	program string
+	re      *regexp.Regexp
+	value   int
+	sensor  string
+}
+
+// syslogMessage is the part of a syslog line the rules look at.
+type syslogMessage struct {
+	host, program, text string
+}
+
+// parseSyslog splits an RFC 3164 or RFC 5424 line into host, program and
+// message text. Lines without a priority are taken as bare message text.
+func parseSyslog(line string) syslogMessage {
+	if !strings.HasPrefix(line, "<") {
+		return syslogMessage{text: line}
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 0 {
+		return syslogMessage{text: line}
+	}
+	rest := line[end+1:]
+
+	// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	if strings.HasPrefix(rest, "1 ") {
+		f := strings.SplitN(rest, " ", 7)
+		if len(f) == 7 {
+			m := syslogMessage{host: nilValue(f[2]), program: nilValue(f[3])}
+			msg := f[6]
+			if strings.HasPrefix(msg, "[") {
+				// Skip structured data up to the closing bracket that is
+				// followed by a space or the end of the line
+				for i := 1; i < len(msg); i++ {
+					if msg[i] == ']' && msg[i-1] != '\\' && (i+1 == len(msg) || msg[i+1] == ' ') {
+						msg = msg[i+1:]
+						break
+					}
+				}
+			} else if strings.HasPrefix(msg, "- ") || msg == "-" {
+				msg = msg[1:]
+			}
+			m.text = strings.TrimPrefix(strings.TrimSpace(msg), "\ufeff")
+			return m
+		}
+	}
+
+	// RFC 3164: "Mmm dd hh:mm:ss host tag[pid]: message"
+	if len(rest) > 16 && rest[3] == ' ' && rest[15] == ' ' {
+		if _, err := time.Parse(time.Stamp, rest[:15]); err == nil {
+			rest = rest[16:]
+			m := syslogMessage{}
+			if i := strings.IndexByte(rest, ' '); i > 0 {
+				m.host, rest = rest[:i], rest[i+1:]
+			}
+			if i := strings.Index(rest, ": "); i > 0 && !strings.Contains(rest[:i], " ") {
+				m.program, rest = rest[:i], rest[i+2:]
+				if j := strings.IndexByte(m.program, '['); j > 0 {
+					m.program = m.program[:j]
+				}
+			}
+			m.text = rest
+			return m
+		}
+	}
+	return syslogMessage{text: strings.TrimSpace(rest)}
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// syslogListener records readings from syslog lines matched by its rules.
+type syslogListener struct {
+	rules []syslogRule
+}
+
+func (l *syslogListener) handle(line, from string) {
+	line = strings.TrimRight(line, "\r\n\x00")
+	if line == "" {
+		return
+	}
+	m := parseSyslog(line)
+	// The host named in the message identifies a device behind a relay
+	source := sourceSyslog + m.host
+	if m.host == "" {
+		source = sourceSyslog + remoteHost(from)
+	}
+	for _, r := range l.rules {
+		if r.host != "" {
+			if ok, _ := path.Match(r.host, m.host); !ok {
+				continue
+			}
+		}
+		if r.program != "" && r.program != m.program {
+			continue
+		}
+		match := r.re.FindStringSubmatchIndex(m.text)
+		// An optional value group that took no part in the match has no value
+		if match == nil || match[2*r.value] < 0 {
+			continue
+		}
+		raw := m.text[match[2*r.value]:match[2*r.value+1]]
+		value, err := strconv.ParseFloat(strings.Replace(raw, ",", ".", 1), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			log.Printf("Error parsing syslog value %q from %s", raw, from)
+			continue
+		}
+		sensor := string(r.re.ExpandString(nil, r.sensor, m.text, match))
+		if sensor == "" {
+			log.Printf("Error in syslog rule %q: sensor name is empty for %q", r.re, m.text)
+			continue
+		}
+		recordReading(sensor, value, source)
+	}
+}
+
+func (l *syslogListener) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Error reading syslog datagram: %v", err)
+			return
+		}
+		l.handle(string(buf[:n]), addr.String())
+	}
+}
+
+// serveTCP accepts both newline-terminated and octet-counted (RFC 6587)
+// framing.
+func (l *syslogListener) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Error accepting syslog connection: %v", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			from := conn.RemoteAddr().String()
+			r := bufio.NewReader(conn)
+			for {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+				line, err := readSyslogFrame(r)
+				l.handle(line, from)
+				if err != nil {
+					if err != io.EOF {
+						log.Printf("Error reading syslog from %s: %v", from, err)
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] < '0' || b[0] > '9' {
+		return r.ReadString('\n')
+	}
+	n, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(n))
+	if err != nil || size > 65536 {
+		return "", fmt.Errorf("invalid frame length %q", n)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// compileSyslogRules checks the configured rules. A rule's value is the
+// capture group named "value", or else the first unnamed group.
+func compileSyslogRules(rules []SyslogRule) ([]syslogRule, error) {
+	var compiled []syslogRule
+	for i, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("syslog rule %d: %v", i+1, err)
+		}
+		value := re.SubexpIndex("value")
+		for j, name := range re.SubexpNames() {
+			if value < 0 && j > 0 && name == "" {
+				value = j
+			}
+		}
+		if value < 0 {
+			return nil, fmt.Errorf("syslog rule %d: pattern needs a \"value\" or unnamed capture group", i+1)
+		}
+		if r.Sensor == "" {
+			return nil, fmt.Errorf("syslog rule %d: sensor is required", i+1)
+		}
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return nil, fmt.Errorf("syslog rule %d: invalid host pattern %q", i+1, r.Host)
+		}
+		compiled = append(compiled, syslogRule{host: r.Host, program: r.Program, re: re, value: value, sensor: r.Sensor})
+	}
+	return compiled, nil
+}
+
+// startSyslogListener opens the configured UDP (and optionally TCP) port.
+func startSyslogListener(c *SyslogConfig) error {
+	rules, err := compileSyslogRules(c.Rules)
+	if err != nil {
+		return err
+	}
+	l := &syslogListener{rules: rules}
+	pc, err := net.ListenPacket("udp", c.Listen)
+	if err != nil {
+		return err
+	}
+	go l.serveUDP(pc)
+	if c.TCP {
+		ln, err := net.Listen("tcp", c.Listen)
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		go l.serveTCP(ln)
+	}
+	log.Printf("Accepting syslog messages on %s with %d rules", c.Listen, len(rules))
+	return nil
+}
@@ -1,36 +1,63 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc"
 )
 
 type TemperatureReading struct {
-	Temperature float64 `json:"temperature"`
-	Timestamp   string  `json:"timestamp"`
+	Temperature float64         `json:"temperature"`
+	Decimals    int             `json:"decimals"`
+	Timestamp   string          `json:"timestamp"`
+	Units       string          `json:"units"`
+	Thresholds  ThresholdConfig `json:"thresholds"`
+	// Database is set while the database cannot be written
+	Database *DatabaseStatus `json:"database,omitempty"`
 }
 
 type ChartDataPoint struct {
-	Temperature float64 `json:"temperature"`
-	Timestamp   string  `json:"timestamp"`
-	UnixTime    int64   `json:"unixTime"`
+	Temperature float64  `json:"temperature"`
+	Smoothed    *float64 `json:"smoothed,omitempty"`
+	Timestamp   string   `json:"timestamp"`
+	UnixTime    int64    `json:"unixTime"`
 }
 
 var db *sql.DB
 
-func initDatabase() {
+func initDatabase(path string) {
 	var err error
-	db, err = sql.Open("sqlite3", "./temperature.db")
+	if readOnly {
+		// The recording instance owns the schema; only read what it wrote
+		dsn := "file:" + path + "?mode=ro"
+		db, err = sql.Open("sqlite3", dsn)
+		if err == nil {
+			err = db.Ping()
+		}
+		if err == nil && splitByYear {
+			err = openYearlyStorage(path, dsn)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	db, err = sql.Open("sqlite3", path)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,22 +73,208 @@ func initDatabase() {
 		log.Fatal(err)
 	}
 
+	// Readings stored before sensors were tracked all came from the CPU
+	if err := addColumnIfMissing("temperature_readings", "sensor", "TEXT NOT NULL DEFAULT 'cpu'"); err != nil {
+		log.Fatal(err)
+	}
+
+	// Readings from before sources were recorded have none
+	if err := addColumnIfMissing("temperature_readings", "source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Fatal(err)
+	}
+
 	// Create index for faster queries
 	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_timestamp ON temperature_readings(timestamp);")
 	if err != nil {
 		log.Fatal(err)
 	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_sensor_timestamp ON temperature_readings(sensor, timestamp);")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	initAlertTables()
+	initAlertHistoryTables()
+	initSecretsTable()
+	initPurgeTables()
+	initSetpointTables()
+	initHeaterTables()
+	initRollupTables()
+	initSettingsTable()
+	initMaintenanceTables()
+	initUserTables()
+	initAuditTable()
+	initFailoverTable()
+	initCalibrationTable()
+	initAnnotationsTable()
+	initSeasonTable()
+	initLandingTables()
+	initActuatorTables()
+	initOutageTable()
+	initPresenceTables()
+	initVacationTable()
+	initOverrideTable()
+	initTuningTable()
+	initOneWireTable()
+	initDashboardsTable()
+	initPushTable()
+	initLanguageTable()
+
+	if splitByYear {
+		if err := openYearlyStorage(path, path); err != nil {
+			log.Fatalf("Error opening per-year storage: %v", err)
+		}
+	}
 }
 
-func saveTemperature(temp float64) error {
-	_, err := db.Exec("INSERT INTO temperature_readings (temperature) VALUES (?)", temp)
+// addColumnIfMissing adds a column to an existing table, so databases created
+// by older versions are upgraded in place.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func saveTemperature(sensor string, temp float64, source string, at time.Time) error {
+	defer timeQuery("insert_reading")()
+	_, err := db.Exec("INSERT INTO "+readingsTableFor(at)+" (sensor, temperature, timestamp, source) VALUES (?, ?, ?, ?)", sensor, temp, sqliteTime(at), source)
+	observeInsert(err)
+	if err == nil {
+		noteReading(sensor, at)
+		noteRollup(at)
+	}
 	return err
 }
 
+// listSensorNames returns every sensor that has stored readings.
+func listSensorNames() ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT sensor FROM temperature_readings ORDER BY sensor")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Sources of readings: the local sensor driver, or a listener followed by
+// the device it heard from, the file a reading was imported from or the
+// weather provider it was fetched from, a zone's heating curve target, a
+// derived metric, a pressure transducer, an OpenTherm gateway, a heater
+// plug followed by the heater's name, the room model of -simulate or a
+// 1-Wire probe followed by its ID.
+const (
+	sourceLocal     = "local"
+	sourceGraphite  = "graphite:"
+	sourceSyslog    = "syslog:"
+	sourceImport    = "import:"
+	sourceIngest    = "ingest:"
+	sourceWeather   = "weather:"
+	sourceCurve     = "curve"
+	sourceDerived   = "derived"
+	sourcePressure  = "pressure"
+	sourceOpenTherm = "opentherm"
+	sourcePlug      = "plug:"
+	sourceSimulated = "simulated"
+	sourceOneWire   = "w1:"
+)
+
+// recordReading stores a reading, feeds it to the alert engine and queues it
+// for the configured forwarders. source says how the reading arrived. A
+// reading its validation rejects is dropped, and one the database refuses
+// is queued until it can be written.
+func recordReading(sensor string, temp float64, source string) {
+	now := clock.Now()
+	temp = calibrated(sensor, temp)
+	temp, ok := validateReading(sensor, temp, source, now)
+	if !ok {
+		return
+	}
+	// The control loop gets the reading first so a slow write cannot hold
+	// it back
+	controller.observe(sensor, temp, now)
+	if err := saveTemperature(sensor, temp, source, now); err != nil {
+		log.Printf("Error saving temperature to database: %v", err)
+		queueReading(sensor, temp, source, now, err)
+	}
+	observeReading(sensor, temp, now)
+	sensorsMonitor.observe(sensor, temp, source, now)
+	r := Reading{Sensor: sensor, Value: temp, Time: now, Source: source}
+	// A failover standby leaves alerts and forwarding to the hub in control
+	if failover.controlling() {
+		alertEngine.evaluate(sensor, temp, now)
+		riseAlerts.observe(sensor, temp, now)
+		forwardReading(r)
+	}
+	failover.record(r)
+	publishReading(r)
+	derived.observe(sensor, temp, now)
+}
+
+// samplerInterval hands a reloaded sample_interval to the running sampler.
+var samplerInterval = make(chan time.Duration, 1)
+
+// runSampler records the CPU temperature every interval.
+func runSampler(interval time.Duration) {
+	sample := func() {
+		start := time.Now()
+		temp, err := getTemperature()
+		sensorReadDurations.observe(time.Since(start), "cpu")
+		if err != nil {
+			log.Printf("Error reading temperature: %v", err)
+			return
+		}
+		recordReading("cpu", temp, sourceLocal)
+	}
+	sample()
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			sample()
+		case d := <-samplerInterval:
+			ticker.Reset(d)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
 func getTemperature() (float64, error) {
-	// Try to read from Raspberry Pi thermal zone first
+	// Try to read from Raspberry Pi thermal zone first, unless simulating
 	data, err := ioutil.ReadFile("/sys/class/thermal/thermal_zone0/temp")
-	if err == nil {
+	if err == nil && !simulating {
 		tempStr := strings.TrimSpace(string(data))
 		tempMilliCelsius, err := strconv.Atoi(tempStr)
 		if err == nil {
@@ -94,15 +307,15 @@ func temperatureHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Error reading temperature: %v", err), http.StatusInternalServerError)
 		return
 	}
-
-	// Save to database
-	if err := saveTemperature(temp); err != nil {
-		log.Printf("Error saving temperature to database: %v", err)
-	}
+	temp = calibrated("cpu", temp)
 
 	reading := TemperatureReading{
-		Temperature: temp,
+		Temperature: roundReading("cpu", temp),
+		Decimals:    readingDecimals("cpu"),
 		Timestamp:   time.Now().Format("2006-01-02 15:04:05"),
+		Units:       config().Units,
+		Thresholds:  config().Thresholds,
+		Database:    databaseStatus(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -114,32 +327,159 @@ func chartDataHandler(w http.ResponseWriter, r *http.Request) {
 	if period == "" {
 		period = "day"
 	}
+	sensor := r.URL.Query().Get("sensor")
+	if sensor == "" {
+		sensor = "cpu"
+	}
+
+	if against := r.URL.Query().Get("compare"); against != "" {
+		chartComparisonHandler(w, r, sensor, period, against)
+		return
+	}
+	annotated := r.URL.Query().Get("annotations") == "1"
+	smoothing, smoothed, err := parseSmoothing(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var actuators []actuatorKey
+	banded := r.URL.Query().Get("actuators") != ""
+	if banded {
+		if actuators, err = chartActuators(r.URL.Query().Get("actuators"), sensor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := clock.Now()
+	w.Header().Set("Cache-Control", "no-cache")
+	// unchanged answers 304 when the client has this version of the chart.
+	// Annotations carry no time to compare If-Modified-Since with, and a
+	// running actuator's band grows with the time, so those charts only go
+	// by their ETag.
+	unchanged := func(v chartVersionInfo) (bool, error) {
+		v.variant = fmt.Sprintf("%s:%d:%t:%v", smoothing.method, smoothing.window, banded, actuators)
+		etag, modified := v.etag(), v.latest
+		if annotated {
+			var err error
+			if etag, err = annotatedETag(etag); err != nil {
+				return false, err
+			}
+			modified = time.Time{}
+		}
+		if banded {
+			tag, latest, running, err := bandedETag(etag, actuators, now)
+			if err != nil {
+				return false, err
+			}
+			etag = tag
+			if running {
+				modified = time.Time{}
+			} else if !modified.IsZero() && latest.After(modified) {
+				modified = latest
+			}
+		}
+		return notModified(w, r, etag, modified), nil
+	}
+	var data []ChartDataPoint
+	if chartResolution(period) != "" {
+		var v chartVersionInfo
+		var err error
+		data, v, err = aggregateChart(r.Context(), sensor, period, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if same, err := unchanged(v); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		} else if same {
+			return
+		}
+	} else {
+		v, err := chartVersion(r.Context(), sensor, period, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if same, err := unchanged(v); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		} else if same {
+			return
+		}
+		if data, err = chartData(r.Context(), sensor, period, now); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if smoothed {
+		smoothing.smooth(data)
+	}
+	roundChartData(sensor, data)
+	w.Header().Set("Content-Type", "application/json")
+	if !annotated && !banded {
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	chart := AnnotatedChart{Points: data, Annotations: []Annotation{}}
+	if annotated {
+		if chart.Annotations, err = chartAnnotations(sensor, chartSince(period, now), now); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if banded {
+		if chart.Actuators, err = actuatorBands(actuators, chartSince(period, now), now); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if chart.Points == nil {
+		chart.Points = []ChartDataPoint{}
+	}
+	json.NewEncoder(w).Encode(chart)
+}
+
+// chartSince is where the chart of a period ending now starts.
+func chartSince(period string, now time.Time) time.Time {
+	switch period {
+	case "week":
+		return now.AddDate(0, 0, -7)
+	case "month":
+		return now.UTC().AddDate(0, -1, 0)
+	case "year":
+		return now.UTC().AddDate(-1, 0, 0)
+	}
+	return now.Add(-24 * time.Hour)
+}
 
+// chartData returns a sensor's readings over the period (day, week, month
+// or year) up to now, averaged into buckets for the longer periods. Day
+// and month buckets are local calendar days and months.
+func chartData(ctx context.Context, sensor, period string, now time.Time) ([]ChartDataPoint, error) {
+	defer timeQuery("chart_data")()
 	var query string
 	var timeFormat string
 
 	switch period {
-	case "day":
-		query = "SELECT temperature, timestamp FROM temperature_readings WHERE timestamp >= datetime('now', '-1 day') ORDER BY timestamp"
-		timeFormat = "15:04"
 	case "week":
-		query = "SELECT AVG(temperature) as temperature, datetime(timestamp, 'start of hour') as timestamp FROM temperature_readings WHERE timestamp >= datetime('now', '-7 days') GROUP BY datetime(timestamp, 'start of hour') ORDER BY timestamp"
+		query = "SELECT AVG(temperature) as temperature, strftime('%Y-%m-%d %H:00:00', timestamp) as timestamp FROM temperature_readings WHERE sensor = ? AND timestamp >= ? GROUP BY strftime('%Y-%m-%d %H:00:00', timestamp) ORDER BY timestamp"
 		timeFormat = "01-02 15:04"
 	case "month":
-		query = "SELECT AVG(temperature) as temperature, date(timestamp) as timestamp FROM temperature_readings WHERE timestamp >= datetime('now', '-1 month') GROUP BY date(timestamp) ORDER BY timestamp"
+		query = "SELECT AVG(temperature) as temperature, date(timestamp, 'localtime') as timestamp FROM temperature_readings WHERE sensor = ? AND timestamp >= ? GROUP BY date(timestamp, 'localtime') ORDER BY timestamp"
 		timeFormat = "01-02"
 	case "year":
-		query = "SELECT AVG(temperature) as temperature, date(timestamp, 'start of month') as timestamp FROM temperature_readings WHERE timestamp >= datetime('now', '-1 year') GROUP BY date(timestamp, 'start of month') ORDER BY timestamp"
+		query = "SELECT AVG(temperature) as temperature, date(timestamp, 'localtime', 'start of month') as timestamp FROM temperature_readings WHERE sensor = ? AND timestamp >= ? GROUP BY date(timestamp, 'localtime', 'start of month') ORDER BY timestamp"
 		timeFormat = "2006-01"
 	default:
-		query = "SELECT temperature, timestamp FROM temperature_readings WHERE timestamp >= datetime('now', '-1 day') ORDER BY timestamp"
+		query = "SELECT temperature, timestamp FROM temperature_readings WHERE sensor = ? AND timestamp >= ? ORDER BY timestamp"
 		timeFormat = "15:04"
 	}
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query, sensor, sqliteTime(chartSince(period, now)))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -161,8 +501,9 @@ func chartDataHandler(w http.ResponseWriter, r *http.Request) {
 			// Try standard datetime format
 			parsedTime, parseErr = time.Parse("2006-01-02 15:04:05", timestampStr)
 			if parseErr != nil {
-				// Try date only format
-				parsedTime, parseErr = time.Parse("2006-01-02", timestampStr)
+				// Try date only format: day and month buckets start at
+				// local midnight
+				parsedTime, parseErr = time.ParseInLocation("2006-01-02", timestampStr, time.Local)
 				if parseErr != nil {
 					continue
 				}
@@ -175,338 +516,416 @@ func chartDataHandler(w http.ResponseWriter, r *http.Request) {
 			UnixTime:    parsedTime.Unix(),
 		})
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	return data, rows.Err()
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := `
-<!DOCTYPE html>
-<html>
-<head>
-    <title>Pi CPU Temperature Monitor</title>
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <script src="https://cdn.jsdelivr.net/npm/chart.js"></script>
-    <style>
-        * { box-sizing: border-box; margin: 0; padding: 0; }
-        body { 
-            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; 
-            background: #f5f5f5;
-            min-height: 100vh;
-            padding: 20px;
-        }
-        .container { 
-            max-width: 1200px; 
-            margin: 0 auto; 
-            background: white; 
-            border-radius: 20px; 
-            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
-            overflow: hidden;
-        }
-        .header {
-            background: linear-gradient(45deg, #2196F3, #21CBF3);
-            color: white;
-            padding: 30px;
-            text-align: center;
-        }
-        h1 { 
-            font-size: 2.5em; 
-            margin-bottom: 10px;
-            text-shadow: 0 2px 4px rgba(0,0,0,0.3);
-        }
-        .subtitle {
-            font-size: 1.1em;
-            opacity: 0.9;
-        }
-        .dashboard {
-            display: grid;
-            grid-template-columns: 1fr 2fr;
-            gap: 30px;
-            padding: 30px;
-        }
-        .current-temp {
-            background: white;
-            border-radius: 15px;
-            padding: 30px;
-            box-shadow: 0 10px 30px rgba(0,0,0,0.1);
-            text-align: center;
-        }
-        .temp-display { 
-            font-size: 4em; 
-            font-weight: bold;
-            margin: 20px 0;
-            background: linear-gradient(45deg, #2196F3, #21CBF3);
-            -webkit-background-clip: text;
-            -webkit-text-fill-color: transparent;
-            background-clip: text;
-        }
-        .timestamp { 
-            color: #666; 
-            margin-bottom: 20px;
-            font-size: 0.9em;
-        }
-        .status { 
-            padding: 15px; 
-            border-radius: 10px; 
-            margin: 20px 0;
-            font-weight: bold;
-            transition: all 0.3s ease;
-        }
-        .normal { background: linear-gradient(45deg, #4CAF50, #45a049); color: white; }
-        .warning { background: linear-gradient(45deg, #FF9800, #F57C00); color: white; }
-        .danger { background: linear-gradient(45deg, #f44336, #d32f2f); color: white; }
-        .chart-container {
-            background: white;
-            border-radius: 15px;
-            padding: 30px;
-            box-shadow: 0 10px 30px rgba(0,0,0,0.1);
-        }
-        .time-buttons {
-            display: flex;
-            gap: 10px;
-            margin-bottom: 20px;
-            flex-wrap: wrap;
-        }
-        .time-btn {
-            background: linear-gradient(45deg, #e3f2fd, #bbdefb);
-            border: 2px solid #2196F3;
-            color: #1976D2;
-            padding: 12px 24px;
-            border-radius: 25px;
-            cursor: pointer;
-            font-weight: bold;
-            transition: all 0.3s ease;
-            font-size: 0.9em;
-        }
-        .time-btn:hover {
-            background: linear-gradient(45deg, #2196F3, #21CBF3);
-            color: white;
-            transform: translateY(-2px);
-            box-shadow: 0 5px 15px rgba(33, 150, 243, 0.4);
-        }
-        .time-btn.active {
-            background: linear-gradient(45deg, #2196F3, #21CBF3);
-            color: white;
-            box-shadow: 0 5px 15px rgba(33, 150, 243, 0.4);
-        }
-        .refresh-btn {
-            background: linear-gradient(45deg, #4CAF50, #45a049);
-            color: white;
-            border: none;
-            padding: 15px 30px;
-            border-radius: 25px;
-            cursor: pointer;
-            font-weight: bold;
-            margin-top: 20px;
-            transition: all 0.3s ease;
-        }
-        .refresh-btn:hover {
-            transform: translateY(-2px);
-            box-shadow: 0 5px 15px rgba(76, 175, 80, 0.4);
-        }
-        #temperatureChart {
-            height: 400px !important;
-        }
-        .loading {
-            text-align: center;
-            color: #666;
-            font-style: italic;
-        }
-        @media (max-width: 768px) {
-            .dashboard {
-                grid-template-columns: 1fr;
-                gap: 20px;
-                padding: 20px;
-            }
-            .temp-display { font-size: 3em; }
-            h1 { font-size: 2em; }
-            .time-buttons { justify-content: center; }
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <div class="header">
-            <h1>🖥️ Raspberry Pi CPU Temperature Monitor</h1>
-            <div class="subtitle">Real-time CPU temperature monitoring with historical data analysis</div>
-        </div>
-        
-        <div class="dashboard">
-            <div class="current-temp">
-                <h2>Current CPU Temperature</h2>
-                <div id="temperature" class="temp-display">Loading...</div>
-                <div id="timestamp" class="timestamp"></div>
-                <div id="status" class="status"></div>
-                <button class="refresh-btn" onclick="updateTemperature()">🔄 Refresh</button>
-            </div>
-            
-            <div class="chart-container">
-                <h2>CPU Temperature History</h2>
-                <div class="time-buttons">
-                    <button class="time-btn active" onclick="changePeriod('day', this)">📅 Today</button>
-                    <button class="time-btn" onclick="changePeriod('week', this)">📊 Week</button>
-                    <button class="time-btn" onclick="changePeriod('month', this)">📈 Month</button>
-                    <button class="time-btn" onclick="changePeriod('year', this)">📉 Year</button>
-                </div>
-                <canvas id="temperatureChart"></canvas>
-            </div>
-        </div>
-    </div>
-
-    <script>
-        let chart;
-        let currentPeriod = 'day';
-
-        function initChart() {
-            const ctx = document.getElementById('temperatureChart').getContext('2d');
-            chart = new Chart(ctx, {
-                type: 'line',
-                data: {
-                    labels: [],
-                    datasets: [{
-                        label: 'CPU Temperature (°C)',
-                        data: [],
-                        borderColor: 'rgb(33, 150, 243)',
-                        backgroundColor: 'rgba(33, 150, 243, 0.1)',
-                        borderWidth: 3,
-                        fill: true,
-                        tension: 0.4,
-                        pointBackgroundColor: 'rgb(33, 150, 243)',
-                        pointBorderColor: 'white',
-                        pointBorderWidth: 2,
-                        pointRadius: 4,
-                        pointHoverRadius: 6
-                    }]
-                },
-                options: {
-                    responsive: true,
-                    maintainAspectRatio: false,
-                    plugins: {
-                        legend: {
-                            display: true,
-                            position: 'top'
-                        }
-                    },
-                    scales: {
-                        x: {
-                            display: true,
-                            title: {
-                                display: true,
-                                text: 'Time'
-                            },
-                            grid: {
-                                color: 'rgba(0,0,0,0.1)'
-                            }
-                        },
-                        y: {
-                            display: true,
-                            title: {
-                                display: true,
-                                text: 'CPU Temperature (°C)'
-                            },
-                            grid: {
-                                color: 'rgba(0,0,0,0.1)'
-                            },
-                            beginAtZero: false
-                        }
-                    },
-                    interaction: {
-                        intersect: false,
-                        mode: 'index'
-                    }
-                }
-            });
-        }
-
-        function updateChart(period = currentPeriod) {
-            fetch('/api/chart-data?period=' + period)
-                .then(response => response.json())
-                .then(data => {
-                    chart.data.labels = data.map(d => d.timestamp);
-                    chart.data.datasets[0].data = data.map(d => d.temperature);
-                    chart.update();
-                })
-                .catch(error => {
-                    console.error('Error updating chart:', error);
-                });
-        }
-
-        function updateTemperature() {
-            fetch('/api/temperature')
-                .then(response => response.json())
-                .then(data => {
-                    document.getElementById('temperature').textContent = data.temperature.toFixed(1) + '°C';
-                    document.getElementById('timestamp').textContent = 'Last updated: ' + data.timestamp;
-                    
-                    const statusDiv = document.getElementById('status');
-                    const temp = data.temperature;
-                    
-                    if (temp < 60) {
-                        statusDiv.className = 'status normal';
-                        statusDiv.textContent = '✅ Temperature Normal';
-                    } else if (temp < 75) {
-                        statusDiv.className = 'status warning';
-                        statusDiv.textContent = '⚠️ Temperature Warning';
-                    } else {
-                        statusDiv.className = 'status danger';
-                        statusDiv.textContent = '🔥 Temperature Critical!';
-                    }
-                    
-                    // Update chart if we're on current day view
-                    if (currentPeriod === 'day') {
-                        updateChart();
-                    }
-                })
-                .catch(error => {
-                    console.error('Error:', error);
-                    document.getElementById('temperature').textContent = 'Error';
-                    document.getElementById('timestamp').textContent = 'Failed to fetch data';
-                });
-        }
-
-        function changePeriod(period, button) {
-            currentPeriod = period;
-            
-            // Update button states
-            document.querySelectorAll('.time-btn').forEach(btn => btn.classList.remove('active'));
-            button.classList.add('active');
-            
-            // Update chart
-            updateChart(period);
-        }
-
-        // Initialize everything
-        initChart();
-        updateTemperature();
-        updateChart();
-        
-        // Auto-refresh current temperature every 5 seconds
-        setInterval(updateTemperature, 5000);
-        
-        // Auto-refresh chart every 30 seconds for day view
-        setInterval(() => {
-            if (currentPeriod === 'day') {
-                updateChart();
-            }
-        }, 30000);
-    </script>
-</body>
-</html>`
-
-	t := template.Must(template.New("index").Parse(tmpl))
-	t.Execute(w, nil)
+	// The link of a new device sets its cookie, and is not kept in the
+	// address bar or history
+	if token := r.URL.Query().Get("device"); token != "" {
+		if deviceByToken(token) == nil {
+			http.Error(w, "Unknown device token", http.StatusNotFound)
+			return
+		}
+		setDeviceCookie(w, r, token)
+		http.Redirect(w, r, basePath+"/", http.StatusSeeOther)
+		return
+	}
+	view := r.URL.Query().Get("view")
+	if !dashboardViews[view] {
+		l, err := landingFor(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		view = l.View
+	}
+	t, err := parseTemplate("index.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+		User         *User
+		View         string
+	}{basePath, assetVersion, currentUser(r), view})
 }
 
 
 func main() {
-	initDatabase()
-	defer db.Close()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	run, ok := commands[cmd]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	run(args)
+}
+
+// serve runs the monitor and dashboard; it is also what piheat does when
+// started without a command.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	st := addStorageFlags(fs)
+	listenAddr := fs.String("listen", envOr("PIHEAT_LISTEN", ":8082"), "HTTP listen addresses, comma separated; unix:/path for a Unix socket (env PIHEAT_LISTEN)")
+	socketMode := fs.String("socket-mode", envOr("PIHEAT_SOCKET_MODE", "0660"), "permissions of unix: listen sockets, in octal (env PIHEAT_SOCKET_MODE)")
+	basePathFlag := fs.String("base-path", os.Getenv("PIHEAT_BASE_PATH"), "URL prefix when served behind a reverse proxy, e.g. /piheat; overrides base_path (env PIHEAT_BASE_PATH)")
+	assetsDirFlag := fs.String("assets-dir", os.Getenv("PIHEAT_ASSETS_DIR"), "directory whose files override the built-in web assets (env PIHEAT_ASSETS_DIR)")
+	logFormat := fs.String("log-format", envOr("PIHEAT_LOG_FORMAT", "text"), "log format: text or json (env PIHEAT_LOG_FORMAT)")
+	grpcAddr := fs.String("grpc-listen", os.Getenv("PIHEAT_GRPC_LISTEN"), "gRPC listen address, e.g. :9082; disabled when empty (env PIHEAT_GRPC_LISTEN)")
+	fs.BoolVar(&readOnly, "read-only", envOr("PIHEAT_READ_ONLY", "false") == "true", "serve the dashboard from a database another instance records into (env PIHEAT_READ_ONLY)")
+	fs.BoolVar(&simulating, "simulate", envOr("PIHEAT_SIMULATE", "false") == "true", "switch heaters in memory and record the zones' temperatures from a model of the rooms (env PIHEAT_SIMULATE)")
+	fs.Parse(args)
+	if simulating && readOnly {
+		log.Fatalf("-simulate and -read-only cannot be combined")
+	}
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: os.Stdout})
+	default:
+		log.Fatalf("Unknown log format %q", *logFormat)
+	}
+	sockMode, modeErr := strconv.ParseUint(*socketMode, 8, 32)
+	if modeErr != nil || sockMode > 0777 {
+		log.Fatalf("Invalid -socket-mode %q: must be octal permissions, like 0660", *socketMode)
+	}
+	st.load()
+	if err := setupNotifiers(config().Notifiers); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := checkNotifierNames(config().Staleness.Notifiers); err != nil {
+		log.Fatalf("Error loading config: staleness: %v", err)
+	}
+	if err := checkNotifierNames(config().RiseAlert.Notifiers); err != nil {
+		log.Fatalf("Error loading config: rise_alert: %v", err)
+	}
+	if err := checkNotifierNames(config().Frost.Notifiers); err != nil {
+		log.Fatalf("Error loading config: frost: %v", err)
+	}
+	if config().PowerFailure != nil {
+		if err := checkNotifierNames(config().PowerFailure.Notifiers); err != nil {
+			log.Fatalf("Error loading config: power_failure: %v", err)
+		}
+	}
+	if err := setupForwarders(config().Forwarders); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupHeaters(config().Heaters); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupTRVs(config().TRVs); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupZones(config().Zones, config().Boilers, config().ControlInterval.Duration); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupPressures(config().Pressure); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupOneWire(config().OneWire); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	setupDerived(config().Derived)
+	if err := setupBackups(config().Backup, st.dbPath); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupFailover(config().Failover); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	var err error
+	if !readOnly {
+		instanceLock, err = acquireInstanceLock(st.dbPath + ".lock")
+		if err != nil {
+			log.Fatalf("Error: %v; stop the other instance or start this one with -read-only", err)
+		}
+	}
+	// A database that cannot be opened is replaced by one in memory, so
+	// live readings keep being served until it recovers
+	dsn := st.dbPath
+	if !readOnly {
+		if err := probeDatabase(st.dbPath); err != nil {
+			dsn = enterFallback(st.dbPath, err)
+		}
+	}
+	initDatabase(dsn)
+	if !readOnly && !inFallback() {
+		importPendingReadings(st.dbPath)
+	}
+	if err := setupSettings(); err != nil {
+		log.Fatalf("Error loading settings: %v", err)
+	}
+	if err := setupURLSigning(); err != nil {
+		log.Fatalf("Error loading URL signing key: %v", err)
+	}
+	if err := setupWebPush(); err != nil {
+		log.Fatalf("Error loading web push key: %v", err)
+	}
+	if err := loadCalibrationOffsets(); err != nil {
+		log.Fatalf("Error loading calibrations: %v", err)
+	}
+	if err := setupSeason(config().Season); err != nil {
+		log.Fatalf("Error loading season: %v", err)
+	}
+	if err := setupPresence(config().Presence); err != nil {
+		log.Fatalf("Error loading presence: %v", err)
+	}
+	if err := vacations.load(); err != nil {
+		log.Fatalf("Error loading vacations: %v", err)
+	}
+
+	if err := alertEngine.reload(); err != nil {
+		log.Fatalf("Error loading alert rules: %v", err)
+	}
+	// Sensors are seeded from the latest readings, which a damaged
+	// database may fail to read; they fill in again as readings arrive
+	if err := sensorsMonitor.seed(); err != nil {
+		log.Printf("Error loading sensors: %v", err)
+	}
+	if simulating {
+		setupSimulation(config().Simulation, config().Zones, config().Boilers)
+	}
+	if readOnly {
+		go sensorsMonitor.follow(10 * time.Second)
+		runSelfTest()
+	} else {
+		// Before the sampler records the first reading since
+		if !inFallback() {
+			catchUp(clock.Now())
+		}
+		go alertEngine.run(15 * time.Second)
+		go sensorsMonitor.run(10 * time.Second)
+		startForwarders()
+		go runSampler(config().SampleInterval.Duration)
+		if config().Graphite != nil && config().Graphite.Listen != "" {
+			if err := startLineListener(config().Graphite); err != nil {
+				log.Fatalf("Error starting Graphite listener: %v", err)
+			}
+		}
+		if config().Syslog != nil && config().Syslog.Listen != "" {
+			if err := startSyslogListener(config().Syslog); err != nil {
+				log.Fatalf("Error starting syslog listener: %v", err)
+			}
+		}
+		startHeaterChecks()
+		if simulation != nil {
+			simulation.start()
+		}
+		startTRVs()
+		startPressures()
+		if onewire != nil {
+			onewire.start()
+		}
+		if failover != nil {
+			failover.start()
+		}
+		if config().Weather != nil {
+			startWeather(config().Weather)
+		}
+		if season != nil {
+			season.start()
+		}
+		if presence != nil {
+			presence.start()
+		}
+		// Heating control only starts once the database, sensors and
+		// heaters have been checked and the heaters switched off. After a
+		// failed check the loop is held, and runs for frost protection
+		runSelfTest()
+		if err := controller.start(); err != nil {
+			log.Fatalf("Error loading setpoints: %v", err)
+		}
+		// These work on the database file, which the in-memory database
+		// stands in for
+		if !inFallback() {
+			startBackups()
+			go runRetention()
+			startMaintenance()
+			go runDiskGuard()
+		}
+		go runDatabaseRecovery(st.dbPath)
+	}
+
+	basePath = normalizeBasePath(config().BasePath)
+	if *basePathFlag != "" {
+		basePath = normalizeBasePath(*basePathFlag)
+	}
+	if err := setupAssets(*assetsDirFlag); err != nil {
+		log.Fatalf("Error loading assets: %v", err)
+	}
 
 	http.HandleFunc("/", indexHandler)
+	http.Handle("/static/", staticHandler())
+	http.HandleFunc("/manifest.json", manifestHandler)
+	http.HandleFunc("/sw.js", serviceWorkerHandler)
+	http.HandleFunc("/icons/", appIconHandler)
 	http.HandleFunc("/api/temperature", temperatureHandler)
 	http.HandleFunc("/api/chart-data", chartDataHandler)
-
-	log.Println("Pi Temperature Monitor starting on :8082")
-	log.Fatal(http.ListenAndServe(":8082", nil))
+	http.HandleFunc("/api/series", seriesHandler)
+	http.HandleFunc("/api/readings", readingsHandler)
+	http.HandleFunc("/api/sensors", sensorsHandler)
+	http.HandleFunc("/api/sensors/health", sensorsHealthHandler)
+	http.HandleFunc("/api/sensors/health/", requireAdmin(sensorsHealthHandler))
+	http.HandleFunc("/api/heaters", heatersHandler)
+	http.HandleFunc("/api/zones", zonesHandler)
+	http.HandleFunc("/api/zones/", zoneHandler)
+	http.HandleFunc("/api/boilers", boilersHandler)
+	http.HandleFunc("/api/trvs", trvsHandler)
+	http.HandleFunc("/api/explain", explainHandler)
+	http.HandleFunc("/api/ingest/", ingestHandler)
+	http.HandleFunc("/api/failover", failoverHandler)
+	http.HandleFunc("/api/peers", peersHandler)
+	http.HandleFunc("/api/season", seasonHandler)
+	http.HandleFunc("/api/presence", presenceHandler)
+	http.HandleFunc("/api/presence/", presenceEventHandler)
+	http.HandleFunc("/api/vacations", vacationsHandler)
+	http.HandleFunc("/api/vacations/", vacationsHandler)
+	http.HandleFunc("/api/landing", landingHandler)
+	http.HandleFunc("/api/language", languageHandler)
+	http.HandleFunc("/api/failover/sync", failoverSyncHandler)
+	http.HandleFunc("/api/selftest", selfTestHandler)
+	http.HandleFunc("/api/schedule/simulate", simulateHandler)
+	http.HandleFunc("/api/simulation", simulationHandler)
+	http.HandleFunc("/api/sparkline.png", sparklineHandler)
+	http.HandleFunc("/api/chart.png", chartImageHandler("png"))
+	http.HandleFunc("/api/chart.svg", chartImageHandler("svg"))
+	http.HandleFunc("/api/alert-rules", alertRulesHandler)
+	http.HandleFunc("/api/alert-rules/", alertRulesHandler)
+	http.HandleFunc("/api/alert-rules/prometheus", prometheusRulesHandler)
+	http.HandleFunc("/api/alerts", alertsHandler)
+	http.HandleFunc("/api/alerts/", alertHandler)
+	http.HandleFunc("/api/alerts/stats", alertStatsHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/debug/status", requireAdmin(debugStatusHandler))
+	http.HandleFunc("/feed.xml", feedHandler)
+	http.HandleFunc("/api/report/", reportAPIHandler)
+	http.HandleFunc("/api/energy", energyHandler)
+	http.HandleFunc("/api/outages", outagesHandler)
+	http.HandleFunc("/legacy/", legacyHandler)
+	http.HandleFunc("/report/", reportHandler)
+	http.HandleFunc("/api/zabbix/discovery", zabbixDiscoveryHandler)
+	http.HandleFunc("/api/admin/purge", requireAdmin(purgeHandler))
+	http.HandleFunc("/api/admin/purges", requireAdmin(dataPurgesHandler))
+	http.HandleFunc("/api/admin/backup", requireAdmin(backupHandler))
+	http.HandleFunc("/api/admin/backups", requireAdmin(backupsHandler))
+	http.HandleFunc("/api/admin/archives", requireAdmin(archivesHandler))
+	http.HandleFunc("/api/admin/reload", requireAdmin(reloadHandler))
+	http.HandleFunc("/api/admin/maintenance", requireAdmin(maintenanceHandler))
+	http.HandleFunc("/api/admin/users", requireAdmin(usersHandler))
+	http.HandleFunc("/api/admin/users/", requireAdmin(usersHandler))
+	http.HandleFunc("/api/admin/failover/takeover", requireAdmin(failoverTakeoverHandler))
+	http.HandleFunc("/api/admin/devices", requireAdmin(devicesHandler))
+	http.HandleFunc("/api/admin/devices/", requireAdmin(devicesHandler))
+	http.HandleFunc("/api/audit", requireAdmin(auditHandler))
+	http.HandleFunc("/api/settings", requireAdmin(settingsHandler))
+	http.HandleFunc("/api/settings/theme", themeHandler)
+	http.HandleFunc("/settings", settingsPageHandler)
+	http.HandleFunc("/api/setpoints", setpointsHandler)
+	http.HandleFunc("/api/setpoints/", setpointsHandler)
+	http.HandleFunc("/api/calibrations", calibrationsHandler)
+	http.HandleFunc("/api/annotations", annotationsHandler)
+	http.HandleFunc("/api/annotations/", annotationsHandler)
+	http.HandleFunc("/api/dashboards", dashboardsHandler)
+	http.HandleFunc("/api/dashboards/", dashboardsHandler)
+	http.HandleFunc("/api/push/key", pushKeyHandler)
+	http.HandleFunc("/api/push/subscribe", pushSubscribeHandler)
+	http.HandleFunc("/api/push/unsubscribe", pushSubscribeHandler)
+	http.HandleFunc("/api/push/subscriptions", requireAdmin(pushSubscriptionsHandler))
+	http.HandleFunc("/api/push/subscriptions/", requireAdmin(pushSubscriptionsHandler))
+	http.HandleFunc("/api/calibrations/", calibrationsHandler)
+	http.HandleFunc("/calibrate", calibratePageHandler)
+	http.HandleFunc("/dashboards", dashboardPageHandler)
+	http.HandleFunc("/eink", einkHandler)
+	http.HandleFunc("/dashboards/", dashboardPageHandler)
+	http.HandleFunc("/login", loginPageHandler)
+	http.HandleFunc("/logout", logoutPageHandler)
+	http.HandleFunc("/api/login", loginHandler)
+	http.HandleFunc("/api/logout", logoutHandler)
+	http.HandleFunc("/api/session", sessionHandler)
+	http.HandleFunc("/api/openapi.json", openAPIHandler)
+	http.HandleFunc("/api/docs", apiDocsHandler)
+
+	var handler http.Handler = http.DefaultServeMux
+	handler = guardPprof(handler)
+	if readOnly {
+		handler = rejectWrites(handler)
+	} else if inFallback() {
+		handler = rejectWritesInFallback(handler)
+	}
+	handler = requireLogin(handler)
+	handler = compress(handler)
+	handler = throttle(handler)
+	handler = rejectCrossSite(handler)
+	// Outside every check, so browsers on allowed origins can read their
+	// refusals too, Retry-After included
+	handler = cors(handler)
+	handler = instrument(handler)
+	handler = versionAPI(handler)
+	handler = limitRequests(handler)
+	srv := newHTTPServer(withBasePath(handler, basePath))
+	listeners, err := openListeners(*listenAddr, os.FileMode(sockMode))
+	if err != nil {
+		log.Fatalf("Error listening: %v", err)
+	}
+	if config().MDNS != nil {
+		if err := startMDNS(config().MDNS, listeners); err != nil {
+			log.Printf("Error starting mDNS, not advertising: %v", err)
+		}
+	}
+	var grpcSrv *grpc.Server
+	if *grpcAddr != "" {
+		if grpcSrv, err = startGRPC(*grpcAddr); err != nil {
+			log.Fatalf("Error starting gRPC: %v", err)
+		}
+	}
+	watchReloadSignal()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		mdns.stop()
+		if grpcSrv != nil {
+			// Streams never end on their own, so don't wait for them
+			grpcSrv.Stop()
+		}
+		// Container runtimes escalate to SIGKILL after a grace period, so
+		// give in-flight requests only a moment before closing the database.
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if readOnly {
+		log.Printf("Pi Temperature Monitor starting read-only on %s at %s/", listenerAddrs(listeners), basePath)
+	} else {
+		log.Printf("Pi Temperature Monitor starting on %s at %s/", listenerAddrs(listeners), basePath)
+	}
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { served <- srv.Serve(l) }(l)
+	}
+	for range listeners {
+		if err := <-served; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	if !readOnly {
+		if err := savePendingReadings(st.dbPath); err != nil {
+			log.Printf("Error saving readings not yet in the database, they are lost: %v", err)
+		}
+		stopActuators()
+		markStopped()
+	}
+	db.Close()
+	log.Println("Pi Temperature Monitor stopped")
 }
\ No newline at end of file
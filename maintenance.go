@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceRun is one pass of the database maintenance job.
+type MaintenanceRun struct {
+	ID             int64     `json:"id"`
+	StartedAt      time.Time `json:"startedAt"`
+	DurationMs     float64   `json:"durationMs"`
+	ReclaimedBytes int64     `json:"reclaimedBytes"`
+	Converted      []string  `json:"converted,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// maintenance keeps the totals for /metrics; running keeps two runs from
+// overlapping without holding up /metrics during a long VACUUM.
+var maintenance struct {
+	sync.Mutex
+	running        sync.Mutex
+	runs, failures int64
+	reclaimed      int64
+	last           *MaintenanceRun
+}
+
+func initMaintenanceTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS maintenance_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at DATETIME NOT NULL,
+		duration_ms REAL NOT NULL,
+		reclaimed_bytes INTEGER NOT NULL,
+		converted TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT ''
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// startMaintenance checks every hour whether maintenance_interval has
+// passed since the last run. The last run is kept in the database, so
+// restarts more frequent than the interval do not postpone it forever.
+func startMaintenance() {
+	interval := config().MaintenanceInterval.Duration
+	if interval <= 0 {
+		return
+	}
+	check := func(now time.Time) {
+		var last sql.NullString
+		if err := db.QueryRow("SELECT MAX(started_at) FROM maintenance_runs").Scan(&last); err != nil {
+			log.Printf("Error querying database: %v", err)
+			return
+		}
+		if last.Valid {
+			if t, err := parseSQLiteTime(last.String); err == nil && now.Sub(t) < interval {
+				return
+			}
+		}
+		runMaintenance()
+	}
+	go func() {
+		// Leave start-up to the sampler and the self-test
+		time.Sleep(5 * time.Minute)
+		check(clock.Now())
+		ticker := clock.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for now := range ticker.C() {
+			check(now)
+		}
+	}()
+	log.Printf("Database maintenance every %s", interval)
+}
+
+// runMaintenance refreshes the query planner statistics and returns free
+// pages to the file system, for the main database and every year file.
+// Files not yet set up for incremental vacuum are converted with one full
+// VACUUM, which blocks writes while it runs; afterwards each run only
+// frees what deletes left behind.
+func runMaintenance() MaintenanceRun {
+	maintenance.running.Lock()
+	defer maintenance.running.Unlock()
+	run := MaintenanceRun{StartedAt: clock.Now().UTC().Truncate(time.Second)}
+	start := time.Now()
+	reclaimed, converted, err := maintainDatabase()
+	run.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	run.ReclaimedBytes, run.Converted = reclaimed, converted
+	if err != nil {
+		run.Error = err.Error()
+		log.Printf("Error in database maintenance: %v", err)
+	} else {
+		log.Printf("Database maintenance done in %s, %d bytes reclaimed", time.Since(start).Round(time.Millisecond), reclaimed)
+	}
+	res, dbErr := db.Exec("INSERT INTO maintenance_runs (started_at, duration_ms, reclaimed_bytes, converted, error) VALUES (?, ?, ?, ?, ?)",
+		sqliteTime(run.StartedAt), run.DurationMs, run.ReclaimedBytes, strings.Join(run.Converted, ","), run.Error)
+	if dbErr != nil {
+		log.Printf("Error saving maintenance run: %v", dbErr)
+	} else {
+		run.ID, _ = res.LastInsertId()
+	}
+	maintenance.Lock()
+	maintenance.runs++
+	maintenance.reclaimed += reclaimed
+	if err != nil {
+		maintenance.failures++
+	}
+	maintenance.last = &run
+	maintenance.Unlock()
+	return run
+}
+
+// dbFile is a database file attached to db, the main one or a year file.
+type dbFile struct{ schema, path string }
+
+// attachedFiles lists the database files attached to db.
+func attachedFiles() ([]dbFile, error) {
+	var files []dbFile
+	rows, err := db.Query("PRAGMA database_list")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var seq int
+		var f dbFile
+		if err := rows.Scan(&seq, &f.schema, &f.path); err != nil {
+			return nil, err
+		}
+		if f.schema != "temp" && f.path != "" {
+			files = append(files, f)
+		}
+	}
+	return files, rows.Err()
+}
+
+func maintainDatabase() (reclaimed int64, converted []string, err error) {
+	files, err := attachedFiles()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Each file is maintained over a connection of its own: with per-year
+	// storage the shared connections have a view over all years that
+	// would shadow the main file's readings table during VACUUM
+	for _, f := range files {
+		n, conv, err := maintainFile(f.path)
+		reclaimed += n
+		if conv {
+			converted = append(converted, f.schema)
+		}
+		if err != nil {
+			return reclaimed, converted, fmt.Errorf("%s: %v", f.schema, err)
+		}
+	}
+	return reclaimed, converted, nil
+}
+
+// maintainFile vacuums and analyzes one database file and returns the
+// bytes reclaimed and whether it was converted to incremental vacuum.
+func maintainFile(path string) (int64, bool, error) {
+	fdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer fdb.Close()
+	fdb.SetMaxOpenConns(1)
+
+	var mode int
+	if err := fdb.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return 0, false, err
+	}
+	before, err := fileBytes(fdb)
+	if err != nil {
+		return 0, false, err
+	}
+	// 2 is incremental; changing to it from none takes a full VACUUM
+	converted := mode != 2
+	if converted {
+		log.Printf("Database maintenance: converting %s to incremental vacuum", path)
+		if _, err := fdb.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return 0, false, err
+		}
+		if _, err := fdb.Exec("VACUUM"); err != nil {
+			return 0, false, fmt.Errorf("vacuum: %v", err)
+		}
+	} else if err := incrementalVacuum(fdb); err != nil {
+		return 0, false, fmt.Errorf("incremental vacuum: %v", err)
+	}
+	after, err := fileBytes(fdb)
+	if err != nil {
+		return 0, converted, err
+	}
+	// Converting adds the pages incremental vacuum keeps its bookkeeping
+	// in, which can outweigh what a nearly full file frees
+	reclaimed := before - after
+	if reclaimed < 0 {
+		reclaimed = 0
+	}
+
+	// Sampling a thousand rows per index is plenty for the planner and
+	// keeps ANALYZE quick on years of readings
+	for _, stmt := range []string{"PRAGMA analysis_limit = 1000", "ANALYZE", "PRAGMA optimize"} {
+		if _, err := fdb.Exec(stmt); err != nil {
+			return reclaimed, converted, fmt.Errorf("%s: %v", stmt, err)
+		}
+	}
+	return reclaimed, converted, nil
+}
+
+// incrementalVacuum frees all free pages. The pragma frees one page per
+// step, so its result rows have to be read to the end.
+func incrementalVacuum(fdb *sql.DB) error {
+	rows, err := fdb.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// fileBytes is the size of a database file.
+func fileBytes(fdb *sql.DB) (int64, error) {
+	var pages, size int64
+	if err := fdb.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := fdb.QueryRow("PRAGMA page_size").Scan(&size); err != nil {
+		return 0, err
+	}
+	return pages * size, nil
+}
+
+func listMaintenanceRuns() ([]MaintenanceRun, error) {
+	rows, err := db.Query("SELECT id, started_at, duration_ms, reclaimed_bytes, converted, error FROM maintenance_runs ORDER BY id DESC LIMIT 50")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []MaintenanceRun{}
+	for rows.Next() {
+		var m MaintenanceRun
+		var startedAt, converted string
+		if err := rows.Scan(&m.ID, &startedAt, &m.DurationMs, &m.ReclaimedBytes, &converted, &m.Error); err != nil {
+			return nil, err
+		}
+		m.StartedAt, _ = parseSQLiteTime(startedAt)
+		if converted != "" {
+			m.Converted = strings.Split(converted, ",")
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// writeMaintenanceMetrics adds the maintenance job to /metrics.
+func writeMaintenanceMetrics(b *strings.Builder) {
+	if readOnly {
+		return
+	}
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	b.WriteString("# HELP piheat_maintenance_runs_total Database maintenance runs since start.\n")
+	b.WriteString("# TYPE piheat_maintenance_runs_total counter\n")
+	fmt.Fprintf(b, "piheat_maintenance_runs_total %d\n", maintenance.runs)
+	b.WriteString("# HELP piheat_maintenance_failures_total Database maintenance runs that failed.\n")
+	b.WriteString("# TYPE piheat_maintenance_failures_total counter\n")
+	fmt.Fprintf(b, "piheat_maintenance_failures_total %d\n", maintenance.failures)
+	b.WriteString("# HELP piheat_maintenance_reclaimed_bytes_total Bytes returned to the file system by database maintenance.\n")
+	b.WriteString("# TYPE piheat_maintenance_reclaimed_bytes_total counter\n")
+	fmt.Fprintf(b, "piheat_maintenance_reclaimed_bytes_total %d\n", maintenance.reclaimed)
+	if m := maintenance.last; m != nil {
+		b.WriteString("# HELP piheat_maintenance_last_duration_seconds Duration of the latest database maintenance run.\n")
+		b.WriteString("# TYPE piheat_maintenance_last_duration_seconds gauge\n")
+		fmt.Fprintf(b, "piheat_maintenance_last_duration_seconds %s\n", strconv.FormatFloat(m.DurationMs/1000, 'f', -1, 64))
+		b.WriteString("# HELP piheat_maintenance_last_reclaimed_bytes Bytes reclaimed by the latest database maintenance run.\n")
+		b.WriteString("# TYPE piheat_maintenance_last_reclaimed_bytes gauge\n")
+		fmt.Fprintf(b, "piheat_maintenance_last_reclaimed_bytes %d\n", m.ReclaimedBytes)
+		b.WriteString("# HELP piheat_maintenance_last_run_timestamp_seconds Unix time of the latest database maintenance run.\n")
+		b.WriteString("# TYPE piheat_maintenance_last_run_timestamp_seconds gauge\n")
+		fmt.Fprintf(b, "piheat_maintenance_last_run_timestamp_seconds %d\n", m.StartedAt.Unix())
+	}
+}
+
+// maintenanceHandler serves GET /api/admin/maintenance, the recent runs,
+// and POST, which runs maintenance now.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := listMaintenanceRuns()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		run := runMaintenance()
+		if run.Error != "" {
+			writeJSON(w, http.StatusInternalServerError, run)
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	mdnsService  = "_piheat._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	// mdnsTTL is how long, in seconds, other hosts may keep the records.
+	mdnsTTL = 120
+	// mdnsQueryInterval is how often the other instances are asked for,
+	// well within mdnsTTL so they stay listed while they run.
+	mdnsQueryInterval = time.Minute
+	// mdnsCacheFlush marks records only this host answers for.
+	mdnsCacheFlush = 1 << 15
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSConfig advertises piheat on the local network as _piheat._tcp and
+// keeps a list of the other instances advertising themselves. Name is the
+// instance name, the host name by default; Interface limits both to one
+// network interface.
+type MDNSConfig struct {
+	Name      string `json:"name,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+func (c *MDNSConfig) check() error {
+	if strings.Contains(c.Name, ".") || len(c.Name) > 63 {
+		return fmt.Errorf("name must be at most 63 bytes and without dots")
+	}
+	return nil
+}
+
+// Peer is another piheat instance found on the local network.
+type Peer struct {
+	Name      string    `json:"name"`
+	Host      string    `json:"host"`
+	Addresses []string  `json:"addresses"`
+	Port      int       `json:"port"`
+	URL       string    `json:"url"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// mdnsPeer is what is known of another instance, gathered from records
+// that may arrive in separate packets.
+type mdnsPeer struct {
+	name    string
+	host    string
+	port    int
+	path    string
+	from    net.IP
+	seen    time.Time
+	expires time.Time
+}
+
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	ifi      *net.Interface
+	instance string
+	host     string
+	port     int
+	stopped  chan struct{}
+
+	mu    sync.Mutex
+	peers map[string]*mdnsPeer
+	hosts map[string]mdnsHost
+}
+
+// mdnsHost is the addresses of a host, until its records expire.
+type mdnsHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// mdns is nil unless mdns is configured.
+var mdns *mdnsResponder
+
+// startMDNS advertises the port of the first TCP listener and starts
+// looking for other instances.
+func startMDNS(c *MDNSConfig, ls []net.Listener) error {
+	port := 0
+	for _, l := range ls {
+		if a, ok := l.Addr().(*net.TCPAddr); ok {
+			port = a.Port
+			break
+		}
+	}
+	if port == 0 {
+		return fmt.Errorf("no TCP listener to advertise")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	name := c.Name
+	if name == "" {
+		name = hostname
+	}
+	var ifi *net.Interface
+	if c.Interface != "" {
+		if ifi, err = net.InterfaceByName(c.Interface); err != nil {
+			return err
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	// Go turns loopback off, which hides piheat from avahi and other
+	// instances on the same host
+	if err := ipv4.NewPacketConn(conn).SetMulticastLoopback(true); err != nil {
+		conn.Close()
+		return err
+	}
+	mdns = &mdnsResponder{conn: conn, ifi: ifi, instance: name + "." + mdnsService, host: hostname + ".local.",
+		port: port, stopped: make(chan struct{}), peers: map[string]*mdnsPeer{}, hosts: map[string]mdnsHost{}}
+	go mdns.receive()
+	go mdns.loop()
+	log.Printf("Advertising %s on port %d over mDNS", mdns.instance, port)
+	return nil
+}
+
+// stop says goodbye, so the other instances drop this one at once.
+func (m *mdnsResponder) stop() {
+	if m == nil {
+		return
+	}
+	m.announce(0)
+	close(m.stopped)
+	m.conn.Close()
+}
+
+func (m *mdnsResponder) loop() {
+	// Announced twice in case the first is lost, as RFC 6762 asks
+	m.announce(mdnsTTL)
+	m.query()
+	time.Sleep(time.Second)
+	m.announce(mdnsTTL)
+	t := time.NewTicker(mdnsQueryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stopped:
+			return
+		case <-t.C:
+			m.query()
+		}
+	}
+}
+
+func (m *mdnsResponder) receive() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("mDNS: %v", err)
+			continue
+		}
+		m.handle(buf[:n], from)
+	}
+}
+
+func (m *mdnsResponder) handle(packet []byte, from *net.UDPAddr) {
+	var p dnsmessage.Parser
+	h, err := p.Start(packet)
+	if err != nil {
+		return
+	}
+	if h.Response {
+		m.learn(&p, from)
+		return
+	}
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	m.answer(h.ID, qs, from)
+}
+
+func mdnsRecord(name string, ttl uint32, unique bool, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= mdnsCacheFlush
+	}
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: class, TTL: ttl}, Body: body}
+}
+
+// records returns this instance's records: the service type, the
+// instance, where it listens, its base path and the host's addresses.
+func (m *mdnsResponder) records(ttl uint32) (services, ptr, srv, txt dnsmessage.Resource, addrs []dnsmessage.Resource) {
+	services = mdnsRecord(mdnsServices, ttl, false, &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsService)})
+	ptr = mdnsRecord(mdnsService, ttl, false, &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(m.instance)})
+	srv = mdnsRecord(m.instance, ttl, true, &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(m.host), Port: uint16(m.port)})
+	txt = mdnsRecord(m.instance, ttl, true, &dnsmessage.TXTResource{TXT: []string{"txtvers=1", "path=" + basePath}})
+	for _, ip := range localIPv4(m.ifi) {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		addrs = append(addrs, mdnsRecord(m.host, ttl, true, &a))
+	}
+	return
+}
+
+// localIPv4 lists the IPv4 addresses of the interfaces that are up,
+// leaving out loopback.
+func localIPv4(only *net.Interface) []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 || (only != nil && ifi.Index != only.Index) {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				ips = append(ips, n.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+func (m *mdnsResponder) announce(ttl uint32) {
+	services, ptr, srv, txt, addrs := m.records(ttl)
+	answers := append([]dnsmessage.Resource{services, ptr, srv, txt}, addrs...)
+	m.send(dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: answers}, mdnsGroup)
+}
+
+func (m *mdnsResponder) query() {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	m.send(dnsmessage.Message{Questions: []dnsmessage.Question{q}}, mdnsGroup)
+}
+
+func (m *mdnsResponder) send(msg dnsmessage.Message, to *net.UDPAddr) {
+	packet, err := msg.Pack()
+	if err != nil {
+		log.Printf("mDNS: %v", err)
+		return
+	}
+	if _, err := m.conn.WriteToUDP(packet, to); err != nil {
+		log.Printf("mDNS: %v", err)
+	}
+}
+
+// answer replies to the questions about this instance.
+func (m *mdnsResponder) answer(id uint16, qs []dnsmessage.Question, from *net.UDPAddr) {
+	services, ptr, srv, txt, addrs := m.records(mdnsTTL)
+	instance, host := strings.ToLower(m.instance), strings.ToLower(m.host)
+	var answers, additionals []dnsmessage.Resource
+	for _, q := range qs {
+		name, all := strings.ToLower(q.Name.String()), q.Type == dnsmessage.TypeALL
+		switch {
+		case name == mdnsServices && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, services)
+		case name == mdnsService && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, ptr)
+			additionals = append(append(additionals, srv, txt), addrs...)
+		case name == instance:
+			if all || q.Type == dnsmessage.TypeSRV {
+				answers = append(answers, srv)
+				additionals = append(additionals, addrs...)
+			}
+			if all || q.Type == dnsmessage.TypeTXT {
+				answers = append(answers, txt)
+			}
+		case name == host && (all || q.Type == dnsmessage.TypeA):
+			answers = append(answers, addrs...)
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: answers, Additionals: additionals}
+	to := mdnsGroup
+	// A plain resolver asks from another port and only takes a unicast
+	// reply that repeats its question
+	if from.Port != mdnsGroup.Port {
+		msg.Header.ID, msg.Questions, to = id, qs, from
+	}
+	m.send(msg, to)
+}
+
+// learn keeps the records of other instances from a response.
+func (m *mdnsResponder) learn(p *dnsmessage.Parser, from *net.UDPAddr) {
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	records, err := p.AllAnswers()
+	if err != nil {
+		return
+	}
+	if err := p.SkipAllAuthorities(); err == nil {
+		additionals, _ := p.AllAdditionals()
+		records = append(records, additionals...)
+	}
+	now := time.Now()
+	addrs := map[string]mdnsHost{}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+	// A peer first heard of in an SRV or TXT record lasts as long as that
+	// record until its PTR record arrives
+	peer := func(instance string, ttl uint32) *mdnsPeer {
+		key := strings.ToLower(instance)
+		if key == strings.ToLower(m.instance) || !strings.HasSuffix(key, "."+mdnsService) {
+			return nil
+		}
+		pr, ok := m.peers[key]
+		if !ok {
+			pr = &mdnsPeer{name: instance[:len(instance)-len(mdnsService)-1], expires: now.Add(time.Duration(ttl) * time.Second)}
+			m.peers[key] = pr
+		}
+		return pr
+	}
+	for _, r := range records {
+		name := r.Header.Name.String()
+		switch b := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			pr := peer(b.PTR.String(), r.Header.TTL)
+			if pr == nil || !strings.EqualFold(name, mdnsService) {
+				continue
+			}
+			if r.Header.TTL == 0 {
+				delete(m.peers, strings.ToLower(b.PTR.String()))
+				continue
+			}
+			pr.seen, pr.expires, pr.from = now, now.Add(time.Duration(r.Header.TTL)*time.Second), from.IP
+		case *dnsmessage.SRVResource:
+			if pr := peer(name, r.Header.TTL); pr != nil {
+				pr.host, pr.port = strings.ToLower(b.Target.String()), int(b.Port)
+			}
+		case *dnsmessage.TXTResource:
+			if pr := peer(name, r.Header.TTL); pr != nil {
+				for _, kv := range b.TXT {
+					if strings.HasPrefix(kv, "path=") {
+						pr.path = strings.TrimPrefix(kv, "path=")
+					}
+				}
+			}
+		case *dnsmessage.AResource:
+			key := strings.ToLower(name)
+			h := addrs[key]
+			h.ips = append(h.ips, net.IP(append([]byte(nil), b.A[:]...)))
+			if expires := now.Add(time.Duration(r.Header.TTL) * time.Second); expires.After(h.expires) {
+				h.expires = expires
+			}
+			addrs[key] = h
+		}
+	}
+	for host, h := range addrs {
+		if !h.expires.After(now) {
+			delete(m.hosts, host)
+			continue
+		}
+		m.hosts[host] = h
+	}
+}
+
+// prune forgets the peers and host addresses whose records have expired,
+// so instances and hosts that left without saying goodbye do not pile up.
+func (m *mdnsResponder) prune(now time.Time) {
+	for key, pr := range m.peers {
+		if now.After(pr.expires) {
+			delete(m.peers, key)
+		}
+	}
+	for host, h := range m.hosts {
+		if now.After(h.expires) {
+			delete(m.hosts, host)
+		}
+	}
+}
+
+// list returns the other instances whose records have not expired.
+func (m *mdnsResponder) list() []Peer {
+	list := []Peer{}
+	if m == nil {
+		return list
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+	for _, pr := range m.peers {
+		// Listed once its PTR record and its SRV record have both arrived
+		if pr.seen.IsZero() || pr.port == 0 {
+			continue
+		}
+		p := Peer{Name: pr.name, Host: strings.TrimSuffix(pr.host, "."), Addresses: []string{}, Port: pr.port, LastSeen: pr.seen}
+		for _, ip := range m.hosts[pr.host].ips {
+			p.Addresses = append(p.Addresses, ip.String())
+		}
+		addr := pr.from.String()
+		if len(p.Addresses) > 0 {
+			addr = p.Addresses[0]
+		}
+		p.URL = "http://" + net.JoinHostPort(addr, strconv.Itoa(pr.port)) + pr.path + "/"
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// peersHandler serves GET /api/peers, the other instances found over mDNS.
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, mdns.list())
+}
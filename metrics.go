@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sensorGauges holds the latest reading per sensor for the Prometheus
+// exposition at /metrics.
+var sensorGauges = struct {
+	sync.Mutex
+	value map[string]float64
+	time  map[string]time.Time
+}{value: map[string]float64{}, time: map[string]time.Time{}}
+
+func observeReading(sensor string, temp float64, at time.Time) {
+	sensorGauges.Lock()
+	defer sensorGauges.Unlock()
+	sensorGauges.value[sensor] = temp
+	sensorGauges.time[sensor] = at
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	sensorGauges.Lock()
+	sensors := make([]string, 0, len(sensorGauges.value))
+	for s := range sensorGauges.value {
+		sensors = append(sensors, s)
+	}
+	sort.Strings(sensors)
+
+	var b strings.Builder
+	b.WriteString("# HELP piheat_temperature_celsius Latest temperature reading per sensor.\n")
+	b.WriteString("# TYPE piheat_temperature_celsius gauge\n")
+	for _, s := range sensors {
+		fmt.Fprintf(&b, "piheat_temperature_celsius{sensor=%s} %s\n", strconv.Quote(s), strconv.FormatFloat(sensorGauges.value[s], 'f', -1, 64))
+	}
+	b.WriteString("# HELP piheat_last_reading_timestamp_seconds Unix time of the latest reading per sensor.\n")
+	b.WriteString("# TYPE piheat_last_reading_timestamp_seconds gauge\n")
+	for _, s := range sensors {
+		fmt.Fprintf(&b, "piheat_last_reading_timestamp_seconds{sensor=%s} %d\n", strconv.Quote(s), sensorGauges.time[s].Unix())
+	}
+	sensorGauges.Unlock()
+	controller.writeMetrics(&b)
+	writeMaintenanceMetrics(&b)
+	writeDatabaseMetrics(&b)
+	writeDiskGuardMetrics(&b)
+	writeRateLimitMetrics(&b)
+	writeAggregateCacheMetrics(&b)
+	writeFailoverMetrics(&b)
+	writeSeasonMetrics(&b)
+	writePresenceMetrics(&b)
+	writeVacationMetrics(&b)
+	writeValidationMetrics(&b)
+	writePushMetrics(&b)
+	writeInstrumentationMetrics(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttBroker is the connection to the broker in the mqtt config section,
+// shared by every integration that talks MQTT. Subscriptions are kept so
+// they can be renewed after a reconnect.
+var mqttBroker = struct {
+	sync.Mutex
+	client mqtt.Client
+	subs   map[string]mqtt.MessageHandler
+}{subs: map[string]mqtt.MessageHandler{}}
+
+func mqttClient() (mqtt.Client, error) {
+	mqttBroker.Lock()
+	defer mqttBroker.Unlock()
+	if mqttBroker.client != nil {
+		return mqttBroker.client, nil
+	}
+	if config().MQTT == nil || config().MQTT.Broker == "" {
+		return nil, fmt.Errorf("no mqtt broker configured")
+	}
+	clientID := config().MQTT.ClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "piheat-" + host
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config().MQTT.Broker).
+		SetClientID(clientID).
+		SetUsername(config().MQTT.Username).
+		SetPassword(config().MQTT.Password).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(30 * time.Second).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker: %v", err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			log.Printf("Connected to MQTT broker %s", config().MQTT.Broker)
+			mqttBroker.Lock()
+			defer mqttBroker.Unlock()
+			for topic, h := range mqttBroker.subs {
+				c.Subscribe(topic, 0, h)
+			}
+		})
+	mqttBroker.client = mqtt.NewClient(opts)
+	// With ConnectRetry the token only completes once connected, so don't
+	// wait for it: piheat should start even while the broker is down
+	mqttBroker.client.Connect()
+	return mqttBroker.client, nil
+}
+
+// mqttSubscribe calls handler for every message on topic, connecting to the
+// broker on first use.
+func mqttSubscribe(topic string, handler func(topic string, payload []byte)) error {
+	c, err := mqttClient()
+	if err != nil {
+		return err
+	}
+	h := func(_ mqtt.Client, m mqtt.Message) { handler(m.Topic(), m.Payload()) }
+	mqttBroker.Lock()
+	mqttBroker.subs[topic] = h
+	mqttBroker.Unlock()
+	if c.IsConnected() {
+		c.Subscribe(topic, 0, h)
+	}
+	return nil
+}
+
+// mqttPublish sends payload to topic, waiting up to ten seconds for the
+// broker to accept it.
+func mqttPublish(topic string, payload []byte) error {
+	c, err := mqttClient()
+	if err != nil {
+		return err
+	}
+	if !c.IsConnected() {
+		return fmt.Errorf("not connected to mqtt broker %s", config().MQTT.Broker)
+	}
+	t := c.Publish(topic, 0, false, payload)
+	if !t.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("publishing to %s timed out", topic)
+	}
+	return t.Error()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert is a state change of an alert rule for one sensor, handed to
+// notifiers when a rule starts or stops firing.
+type Alert struct {
+	ID        int64     `json:"id"`
+	RuleID    int64     `json:"ruleId"`
+	RuleName  string    `json:"rule"`
+	Sensor    string    `json:"sensor"`
+	Condition string    `json:"condition"`
+	Threshold float64   `json:"threshold"`
+	Severity  string    `json:"severity"`
+	Value     float64   `json:"value"`
+	State     string    `json:"state"`
+	Time      time.Time `json:"time"`
+	// Urgent alerts are pushed at the highest priority whatever the
+	// notifier's own, so they get through a phone's quiet hours.
+	Urgent bool `json:"urgent,omitempty"`
+}
+
+func (a Alert) Summary() string {
+	if a.Condition == "database" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %.0f queued readings written", a.Severity, a.RuleName, a.Value)
+		}
+		return fmt.Sprintf("[%s] %s: readings are kept in memory until it recovers", a.Severity, a.RuleName)
+	}
+	if a.Condition == "failover" {
+		return fmt.Sprintf("[%s] %s: took over heating control from %s at term %.0f", a.Severity, a.RuleName, a.Sensor, a.Value)
+	}
+	if a.Condition == "failover-peer-lost" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %s is reachable again", a.Severity, a.RuleName, a.Sensor)
+		}
+		return fmt.Sprintf("[%s] %s: lost contact with %s while in control; if it is still running, both may switch the heaters", a.Severity, a.RuleName, a.Sensor)
+	}
+	if a.Condition == "disk" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %.0f MB free", a.Severity, a.RuleName, a.Value)
+		}
+		return fmt.Sprintf("[%s] %s: %.0f MB free on the database volume, below %.0f MB", a.Severity, a.RuleName, a.Value, a.Threshold)
+	}
+	if a.Condition == "season" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s: winter mode entered, heating control is back on (%s)", a.Severity, a.RuleName, a.Sensor)
+		}
+		return fmt.Sprintf("[%s] %s: summer mode entered, heating control is off (%s)", a.Severity, a.RuleName, a.Sensor)
+	}
+	if a.Condition == "outage" {
+		down := time.Duration(a.Value) * time.Second
+		return fmt.Sprintf("[%s] %s: piheat was down for %s, since %s", a.Severity, a.RuleName, down, a.Time.Add(-down).Local().Format("2006-01-02 15:04"))
+	}
+	if a.Condition == "frost" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %s back up to %s°C", a.Severity, a.RuleName, a.Sensor, a.formatValue(a.Value))
+		}
+		return fmt.Sprintf("[%s] %s: %s is %s°C, below %s°C; heating on to keep it from freezing", a.Severity, a.RuleName, a.Sensor, a.formatValue(a.Value), a.formatValue(a.Threshold))
+	}
+	if a.Condition == "max-on" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %s relay may switch on again", a.Severity, a.RuleName, a.Sensor)
+		}
+		return fmt.Sprintf("[%s] %s: %s relay on for %s, over max_on %s; switched off", a.Severity, a.RuleName, a.Sensor,
+			time.Duration(a.Value)*time.Second, time.Duration(a.Threshold)*time.Second)
+	}
+	if a.Condition == "probe-missing" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %s is back on the 1-Wire bus", a.Severity, a.RuleName, a.Sensor)
+		}
+		return fmt.Sprintf("[%s] %s: %s is no longer on the 1-Wire bus, check its wiring", a.Severity, a.RuleName, a.Sensor)
+	}
+	if a.Condition == "probe-errors" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %s failing %.0f%% of reads", a.Severity, a.RuleName, a.Sensor, a.Value)
+		}
+		return fmt.Sprintf("[%s] %s: %s failing %.0f%% of reads (at least %.0f%%), check its wiring", a.Severity, a.RuleName, a.Sensor, a.Value, a.Threshold)
+	}
+	if a.Condition == "rise" {
+		if a.State == "resolved" {
+			return fmt.Sprintf("[%s] %s resolved: %s no longer rising rapidly", a.Severity, a.RuleName, a.Sensor)
+		}
+		return fmt.Sprintf("[%s] %s: %s rising %.1f°C/min (at least %.1f°C/min), check for fire", a.Severity, a.RuleName, a.Sensor, a.Value, a.Threshold)
+	}
+	if a.State == "resolved" {
+		return fmt.Sprintf("[%s] %s resolved for %s (%s)", a.Severity, a.RuleName, a.Sensor, a.formatValue(a.Value))
+	}
+	if a.Condition == "missing" {
+		return fmt.Sprintf("[%s] %s: no data from %s", a.Severity, a.RuleName, a.Sensor)
+	}
+	switch a.Condition {
+	case "low-pressure", "high-pressure":
+		unit := pressureUnit(a.Sensor)
+		return fmt.Sprintf("[%s] %s: %s is %.2f %s (%s %.2f %s)", a.Severity, a.RuleName, a.Sensor, a.Value, unit, a.Condition, a.Threshold, unit)
+	case "pressure-leak":
+		unit := pressureUnit(a.Sensor)
+		return fmt.Sprintf("[%s] %s: lowest pressure of %s down %.2f %s on the period before (at least %.2f %s), check for a leak", a.Severity, a.RuleName, a.Sensor, a.Value, unit, a.Threshold, unit)
+	case "boiler-fault":
+		return fmt.Sprintf("[%s] %s: boiler %s reports a fault, OEM code %.0f", a.Severity, a.RuleName, a.Sensor, a.Value)
+	case "no-power":
+		return fmt.Sprintf("[%s] %s: %s relay is on but draws only %.1f W", a.Severity, a.RuleName, a.Sensor, a.Value)
+	case "stuck-relay":
+		return fmt.Sprintf("[%s] %s: %s relay is off but draws %.1f W", a.Severity, a.RuleName, a.Sensor, a.Value)
+	}
+	return fmt.Sprintf("[%s] %s: %s is %s (%s %s)", a.Severity, a.RuleName, a.Sensor, a.formatValue(a.Value), a.Condition, a.formatValue(a.Threshold))
+}
+
+// formatValue formats a value or threshold of the alert: temperatures with
+// the sensor's precision, rates and power with one decimal.
+func (a Alert) formatValue(v float64) string {
+	switch a.Condition {
+	case "rate", "no-power", "stuck-relay":
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return formatReading(a.Sensor, v)
+}
+
+type Notifier interface {
+	Notify(a Alert) error
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(a Alert) error {
+	log.Printf("Alert: %s", a.Summary())
+	return nil
+}
+
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (n webhookNotifier) Notify(a Alert) error {
+	return postJSON(n.url, n.headers, a)
+}
+
+var (
+	notifiersMu sync.RWMutex
+	notifiers   = map[string]Notifier{"log": logNotifier{}, "push": pushNotifier{}}
+)
+
+// setupNotifiers builds the notifier targets named in the config. The
+// built-in "log" and "push" targets are always available.
+func setupNotifiers(configs map[string]NotifierConfig) error {
+	built, err := buildNotifiers(configs)
+	if err != nil {
+		return err
+	}
+	setNotifiers(built)
+	return nil
+}
+
+func buildNotifiers(configs map[string]NotifierConfig) (map[string]Notifier, error) {
+	built := map[string]Notifier{"log": logNotifier{}, "push": pushNotifier{}}
+	for name, nc := range configs {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %q: %v", name, err)
+		}
+		built[name] = n
+	}
+	return built, nil
+}
+
+// setNotifiers replaces the notifier targets; alerts already being sent
+// finish with the old ones.
+func setNotifiers(built map[string]Notifier) {
+	notifiersMu.Lock()
+	notifiers = built
+	notifiersMu.Unlock()
+}
+
+func newNotifier(nc NotifierConfig) (Notifier, error) {
+	switch nc.Type {
+	case "log":
+		return logNotifier{}, nil
+	case "webhook":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("webhook requires url")
+		}
+		return webhookNotifier{url: nc.URL, headers: nc.Headers}, nil
+	case "slack", "discord":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("%s requires url (the incoming webhook URL)", nc.Type)
+		}
+		if nc.Type == "slack" {
+			return slackNotifier{url: nc.URL}, nil
+		}
+		return discordNotifier{url: nc.URL}, nil
+	case "pushover":
+		return newPushoverNotifier(nc)
+	case "ntfy":
+		return newNtfyNotifier(nc)
+	default:
+		return nil, fmt.Errorf("unknown type %q", nc.Type)
+	}
+}
+
+// checkNotifierNames reports the first name that is not a configured target.
+func checkNotifierNames(names []string) error {
+	notifiersMu.RLock()
+	defer notifiersMu.RUnlock()
+	return checkNotifiersIn(notifiers, names)
+}
+
+func checkNotifiersIn(set map[string]Notifier, names []string) error {
+	for _, name := range names {
+		if _, ok := set[name]; !ok {
+			return fmt.Errorf("unknown notifier %q (configured: %s)", name, strings.Join(sortedNotifierNames(set), ", "))
+		}
+	}
+	return nil
+}
+
+func notifierNames() []string {
+	notifiersMu.RLock()
+	defer notifiersMu.RUnlock()
+	return sortedNotifierNames(notifiers)
+}
+
+func sortedNotifierNames(set map[string]Notifier) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// notify delivers a to every named target in the background.
+func notify(targets []string, a Alert) {
+	notifiersMu.RLock()
+	defer notifiersMu.RUnlock()
+	for _, name := range targets {
+		n, ok := notifiers[name]
+		if !ok {
+			log.Printf("Alert %q references unknown notifier %q", a.RuleName, name)
+			continue
+		}
+		go func(name string, n Notifier) {
+			if err := n.Notify(a); err != nil {
+				log.Printf("Error sending alert to notifier %q: %v", name, err)
+			}
+		}(name, n)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dashboardURL returns the externally reachable URL of the dashboard, or ""
+// if public_url is not configured.
+func dashboardURL() string {
+	return strings.TrimSuffix(config().PublicURL, "/")
+}
+
+// alertSparklineURL links to the alert's sparkline with a signed URL that
+// expires after signed_url_ttl.
+func alertSparklineURL(a Alert) string {
+	params := url.Values{"sensor": {a.Sensor}, "window": {"1h"}}
+	return signedURL("/api/sparkline.png", params, config().SignedURLTTL.Duration)
+}
+
+func alertValue(a Alert) string {
+	if a.Condition == "missing" && a.State != "resolved" {
+		return "no data"
+	}
+	return a.formatValue(a.Value) + "°C"
+}
+
+func alertThreshold(a Alert) string {
+	switch a.Condition {
+	case "missing":
+		return "reporting"
+	case "rate":
+		return fmt.Sprintf("%s %.1f°C/min", a.Condition, a.Threshold)
+	}
+	return fmt.Sprintf("%s %s°C", a.Condition, a.formatValue(a.Threshold))
+}
+
+func alertColorHex(a Alert) string {
+	c := severityColor(a)
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// slackNotifier posts to a Slack incoming webhook. Incoming webhooks cannot
+// upload files, so the sparkline is linked from the dashboard and only
+// shown when public_url is set.
+type slackNotifier struct {
+	url string
+}
+
+func (n slackNotifier) Notify(a Alert) error {
+	fields := []map[string]string{
+		{"type": "mrkdwn", "text": "*Sensor*\n" + a.Sensor},
+		{"type": "mrkdwn", "text": "*Value*\n" + alertValue(a)},
+		{"type": "mrkdwn", "text": "*Threshold*\n" + alertThreshold(a)},
+		{"type": "mrkdwn", "text": "*Severity*\n" + a.Severity},
+	}
+	blocks := []map[string]interface{}{
+		{"type": "header", "text": map[string]string{"type": "plain_text", "text": alertTitle(a)}},
+		{"type": "section", "fields": fields},
+	}
+	if base := dashboardURL(); base != "" {
+		blocks = append(blocks,
+			map[string]interface{}{
+				"type":      "image",
+				"image_url": alertSparklineURL(a),
+				"alt_text":  a.Sensor + " over the last hour",
+			},
+			map[string]interface{}{
+				"type": "context",
+				"elements": []map[string]string{
+					{"type": "mrkdwn", "text": fmt.Sprintf("<%s/|Open dashboard>", base)},
+				},
+			})
+	}
+	return postJSON(n.url, nil, map[string]interface{}{
+		"text": a.Summary(),
+		"attachments": []map[string]interface{}{
+			{"color": alertColorHex(a), "blocks": blocks},
+		},
+	})
+}
+
+// discordNotifier posts an embed to a Discord webhook with the sparkline
+// uploaded as an attachment, so it works without public_url.
+type discordNotifier struct {
+	url string
+}
+
+func (n discordNotifier) Notify(a Alert) error {
+	c := severityColor(a)
+	embed := map[string]interface{}{
+		"title":       alertTitle(a),
+		"description": a.Summary(),
+		"color":       int(c.R)<<16 | int(c.G)<<8 | int(c.B),
+		"timestamp":   a.Time.UTC().Format(time.RFC3339),
+		"fields": []map[string]interface{}{
+			{"name": "Sensor", "value": a.Sensor, "inline": true},
+			{"name": "Value", "value": alertValue(a), "inline": true},
+			{"name": "Threshold", "value": alertThreshold(a), "inline": true},
+		},
+	}
+	if base := dashboardURL(); base != "" {
+		embed["url"] = base + "/"
+	}
+	payload := map[string]interface{}{"embeds": []interface{}{embed}}
+
+	image, err := alertSparkline(a)
+	if err != nil {
+		log.Printf("Error rendering sparkline for %s: %v", a.Sensor, err)
+		return postJSON(n.url, nil, payload)
+	}
+	embed["image"] = map[string]string{"url": "attachment://sparkline.png"}
+	payload["attachments"] = []map[string]interface{}{{"id": 0, "filename": "sparkline.png"}}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	payloadJSON, _ := json.Marshal(payload)
+	if err := mw.WriteField("payload_json", string(payloadJSON)); err != nil {
+		return err
+	}
+	part, err := mw.CreateFormFile("files[0]", "sparkline.png")
+	if err != nil {
+		return err
+	}
+	part.Write(image)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	return sendRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req, nil
+	})
+}
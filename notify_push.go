@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const pushoverAPI = "https://api.pushover.net/1/messages.json"
+
+// pushoverNotifier sends alerts through the Pushover message API. Without a
+// configured priority, critical alerts are high priority and resolutions
+// are delivered quietly. Urgent alerts are always high priority, which
+// Pushover delivers during the user's quiet hours too.
+type pushoverNotifier struct {
+	token    string
+	user     string
+	priority *int
+}
+
+func newPushoverNotifier(nc NotifierConfig) (*pushoverNotifier, error) {
+	if nc.Token == "" || nc.User == "" {
+		return nil, fmt.Errorf("pushover requires token (application) and user (user or group key)")
+	}
+	if nc.Priority != nil && (*nc.Priority < -2 || *nc.Priority > 1) {
+		return nil, fmt.Errorf("pushover priority must be between -2 and 1")
+	}
+	return &pushoverNotifier{token: nc.Token, user: nc.User, priority: nc.Priority}, nil
+}
+
+func (n *pushoverNotifier) Notify(a Alert) error {
+	priority := 0
+	switch {
+	case a.Urgent && a.State == "firing":
+		priority = 1
+	case n.priority != nil:
+		priority = *n.priority
+	case a.State == "resolved" || a.Severity == "info":
+		priority = -1
+	case a.Severity == "critical":
+		priority = 1
+	}
+	return postForm(pushoverAPI, nil, url.Values{
+		"token":     {n.token},
+		"user":      {n.user},
+		"title":     {alertTitle(a)},
+		"message":   {a.Summary()},
+		"priority":  {strconv.Itoa(priority)},
+		"timestamp": {strconv.FormatInt(a.Time.Unix(), 10)},
+	})
+}
+
+// ntfyNotifier publishes alerts to an ntfy topic, on ntfy.sh unless url
+// points at a self-hosted server.
+type ntfyNotifier struct {
+	url      string
+	token    string
+	priority *int
+}
+
+func newNtfyNotifier(nc NotifierConfig) (*ntfyNotifier, error) {
+	if nc.Topic == "" {
+		return nil, fmt.Errorf("ntfy requires topic")
+	}
+	if nc.Priority != nil && (*nc.Priority < 1 || *nc.Priority > 5) {
+		return nil, fmt.Errorf("ntfy priority must be between 1 and 5")
+	}
+	server := nc.URL
+	if server == "" {
+		server = "https://ntfy.sh"
+	}
+	return &ntfyNotifier{
+		url:      strings.TrimSuffix(server, "/") + "/" + url.PathEscape(nc.Topic),
+		token:    nc.Token,
+		priority: nc.Priority,
+	}, nil
+}
+
+func (n *ntfyNotifier) Notify(a Alert) error {
+	priority := 3
+	tags := "thermometer"
+	switch {
+	case a.Urgent && a.State == "firing":
+		priority, tags = 5, "rotating_light,fire"
+	case n.priority != nil:
+		priority = *n.priority
+	case a.State == "resolved":
+		priority, tags = 2, "white_check_mark"
+	case a.Severity == "critical":
+		priority, tags = 5, "rotating_light"
+	case a.Severity == "warning":
+		priority, tags = 4, "warning"
+	}
+	message := a.Summary()
+	return sendRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, n.url, strings.NewReader(message))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Title", alertTitle(a))
+		req.Header.Set("Priority", strconv.Itoa(priority))
+		req.Header.Set("Tags", tags)
+		if n.token != "" {
+			req.Header.Set("Authorization", "Bearer "+n.token)
+		}
+		return req, nil
+	})
+}
+
+func alertTitle(a Alert) string {
+	if a.State == "resolved" {
+		return "Resolved: " + a.RuleName
+	}
+	return "piheat " + a.Severity + ": " + a.RuleName
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// w1Devices is where the kernel's w1-gpio driver lists the devices it
+	// found on the bus.
+	w1Devices = "/sys/bus/w1/devices"
+	// w1Window is how many of a probe's latest reads its error rate is
+	// taken over.
+	w1Window = 100
+	// w1MinReads is how many reads the window needs before a high error
+	// rate is alerted on.
+	w1MinReads = 20
+	// w1PowerOnReset is what a DS18B20 reports when it lost power between
+	// its conversion and the read, a sign of a weak supply or bad wiring.
+	w1PowerOnReset = 85000
+)
+
+// w1Families are the 1-Wire family codes of the temperature probes read:
+// DS18S20, DS1822, DS18B20, MAX31850 and DS28EA00.
+var w1Families = map[string]bool{"10": true, "22": true, "28": true, "3b": true, "42": true}
+
+// OneWireConfig reads the temperature probes on the Pi's 1-Wire bus, set
+// up with dtoverlay=w1-gpio. Each probe is recorded every Interval (default
+// sample_interval) as the sensor Names gives its ID, or as the ID. The bus
+// is rescanned every Scan (default 1m) for probes plugged in or pulled
+// out. A probe gone from the bus, or whose share of failed reads over its
+// latest reads reaches ErrorRate percent (default 10), raises a warning to
+// Notifiers, by default the staleness ones.
+type OneWireConfig struct {
+	Dir       string            `json:"dir,omitempty"`
+	Interval  Duration          `json:"interval,omitempty"`
+	Scan      Duration          `json:"scan,omitempty"`
+	Names     map[string]string `json:"names,omitempty"`
+	ErrorRate float64           `json:"error_rate,omitempty"`
+	Notifiers []string          `json:"notifiers,omitempty"`
+}
+
+func (c *OneWireConfig) check(sampleInterval time.Duration) error {
+	if c.Dir == "" {
+		c.Dir = w1Devices
+	}
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = sampleInterval
+	}
+	if c.Interval.Duration < 5*time.Second {
+		return fmt.Errorf("interval must be at least 5s, as each probe takes up to 750ms to read")
+	}
+	if c.Scan.Duration == 0 {
+		c.Scan.Duration = time.Minute
+	}
+	if c.Scan.Duration < 10*time.Second {
+		return fmt.Errorf("scan must be at least 10s")
+	}
+	if c.ErrorRate == 0 {
+		c.ErrorRate = 10
+	}
+	if c.ErrorRate < 1 || c.ErrorRate > 100 {
+		return fmt.Errorf("error_rate must be between 1 and 100%%")
+	}
+	sensors := map[string]string{}
+	for id, name := range c.Names {
+		if name == "" {
+			return fmt.Errorf("names: probe %s has an empty name", id)
+		}
+		if other, ok := sensors[name]; ok {
+			return fmt.Errorf("names: probes %s and %s are both %q", other, id, name)
+		}
+		sensors[name] = id
+	}
+	return nil
+}
+
+// ProbeHealth is what /api/sensors/health reports for each probe seen on
+// the bus. ErrorRate is the percentage of failed reads among the latest
+// ones; CRCErrors counts reads whose checksum did not match and
+// ReadErrors the other failures, such as the power-on reset value.
+type ProbeHealth struct {
+	ID         string     `json:"id"`
+	Sensor     string     `json:"sensor"`
+	Present    bool       `json:"present"`
+	FirstSeen  time.Time  `json:"firstSeen"`
+	Removed    *time.Time `json:"removed,omitempty"`
+	LastRead   *time.Time `json:"lastRead,omitempty"`
+	LastValue  *float64   `json:"lastValue,omitempty"`
+	Reads      int        `json:"reads"`
+	CRCErrors  int        `json:"crcErrors"`
+	ReadErrors int        `json:"readErrors"`
+	ErrorRate  float64    `json:"errorRate"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+// BusHealth is the answer of /api/sensors/health.
+type BusHealth struct {
+	Dir      string        `json:"dir"`
+	LastScan *time.Time    `json:"lastScan,omitempty"`
+	ScanErr  string        `json:"scanError,omitempty"`
+	Probes   []ProbeHealth `json:"probes"`
+}
+
+type w1Probe struct {
+	health  ProbeHealth
+	window  []bool
+	missing int64
+	errors  int64
+}
+
+// oneWireBus keeps the probes seen on the bus, including those pulled
+// out, which are remembered in the database across restarts.
+type oneWireBus struct {
+	cfg      OneWireConfig
+	mu       sync.Mutex
+	probes   map[string]*w1Probe
+	lastScan time.Time
+	scanErr  string
+}
+
+// onewire is the 1-Wire bus, nil without the onewire section.
+var onewire *oneWireBus
+
+func initOneWireTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS onewire_probes (
+		id TEXT PRIMARY KEY,
+		first_seen DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func setupOneWire(c *OneWireConfig) error {
+	if c == nil {
+		onewire = nil
+		return nil
+	}
+	if err := checkNotifierNames(c.Notifiers); err != nil {
+		return fmt.Errorf("onewire: %v", err)
+	}
+	onewire = &oneWireBus{cfg: *c, probes: map[string]*w1Probe{}}
+	return nil
+}
+
+// sensorName is the sensor a probe is recorded as.
+func (b *oneWireBus) sensorName(id string) string {
+	if name := b.cfg.Names[id]; name != "" {
+		return name
+	}
+	return id
+}
+
+// start loads the probes known from earlier runs and reads the bus.
+func (b *oneWireBus) start() {
+	rows, err := db.Query("SELECT id, first_seen FROM onewire_probes")
+	if err != nil {
+		log.Printf("Error loading 1-Wire probes: %v", err)
+	} else {
+		b.mu.Lock()
+		for rows.Next() {
+			var id, firstSeen string
+			if err := rows.Scan(&id, &firstSeen); err != nil {
+				log.Printf("Error loading 1-Wire probes: %v", err)
+				break
+			}
+			p := &w1Probe{health: ProbeHealth{ID: id, Sensor: b.sensorName(id)}}
+			p.health.FirstSeen, _ = parseSQLiteTime(firstSeen)
+			b.probes[id] = p
+		}
+		b.mu.Unlock()
+		rows.Close()
+	}
+	log.Printf("Reading 1-Wire probes in %s every %s", b.cfg.Dir, b.cfg.Interval.Duration)
+	b.scan(clock.Now())
+	go b.run()
+}
+
+func (b *oneWireBus) run() {
+	read := clock.NewTicker(b.cfg.Interval.Duration)
+	defer read.Stop()
+	scan := clock.NewTicker(b.cfg.Scan.Duration)
+	defer scan.Stop()
+	b.readAll()
+	for {
+		select {
+		case <-read.C():
+			b.readAll()
+		case now := <-scan.C():
+			b.scan(now)
+		}
+	}
+}
+
+// scan lists the probes on the bus, logging those plugged in and raising
+// an alert for those pulled out.
+func (b *oneWireBus) scan(now time.Time) {
+	entries, err := ioutil.ReadDir(b.cfg.Dir)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastScan = now
+	if err != nil {
+		if b.scanErr == "" {
+			log.Printf("Error scanning the 1-Wire bus: %v", err)
+		}
+		b.scanErr = err.Error()
+		return
+	}
+	b.scanErr = ""
+	present := map[string]bool{}
+	for _, e := range entries {
+		id := e.Name()
+		if family, _, ok := strings.Cut(id, "-"); ok && w1Families[strings.ToLower(family)] {
+			present[id] = true
+		}
+	}
+	for id := range present {
+		p, known := b.probes[id]
+		if !known {
+			p = &w1Probe{health: ProbeHealth{ID: id, Sensor: b.sensorName(id), FirstSeen: now.UTC().Truncate(time.Second)}}
+			b.probes[id] = p
+			log.Printf("1-Wire: probe %s found, recorded as %s", id, p.health.Sensor)
+			sensorsMonitor.expect(p.health.Sensor, b.cfg.Interval.Duration)
+			go func(id string, at time.Time) {
+				if _, err := db.Exec("INSERT OR IGNORE INTO onewire_probes (id, first_seen) VALUES (?, ?)", id, sqliteTime(at)); err != nil {
+					log.Printf("Error saving 1-Wire probe %s: %v", id, err)
+				}
+			}(id, p.health.FirstSeen)
+		}
+		if !p.health.Present {
+			if p.health.Removed != nil {
+				log.Printf("1-Wire: probe %s (%s) is back", id, p.health.Sensor)
+				sensorsMonitor.expect(p.health.Sensor, b.cfg.Interval.Duration)
+			}
+			p.health.Present, p.health.Removed = true, nil
+			if p.missing != 0 {
+				p.missing = b.alert(p, "resolved", "probe-missing", 0, p.missing, 0, now)
+			}
+		}
+	}
+	for id, p := range b.probes {
+		if present[id] || (!p.health.Present && p.health.Removed != nil) {
+			continue
+		}
+		at := now.UTC().Truncate(time.Second)
+		p.health.Present, p.health.Removed = false, &at
+		log.Printf("1-Wire: probe %s (%s) is no longer on the bus", id, p.health.Sensor)
+		p.missing = b.alert(p, "firing", "probe-missing", 0, 0, 0, now)
+	}
+}
+
+// readAll reads every probe on the bus in turn.
+func (b *oneWireBus) readAll() {
+	b.mu.Lock()
+	var ids []string
+	sensors := map[string]string{}
+	for id, p := range b.probes {
+		if p.health.Present {
+			ids = append(ids, id)
+			sensors[id] = p.health.Sensor
+		}
+	}
+	b.mu.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		start := time.Now()
+		v, crc, err := readW1Probe(filepath.Join(b.cfg.Dir, id, "w1_slave"))
+		sensorReadDurations.observe(time.Since(start), sensors[id])
+		b.observe(id, v, crc, err, clock.Now())
+	}
+}
+
+// observe counts a read of a probe and records its temperature.
+func (b *oneWireBus) observe(id string, v float64, crc bool, err error, now time.Time) {
+	b.mu.Lock()
+	p := b.probes[id]
+	if p == nil || !p.health.Present {
+		b.mu.Unlock()
+		return
+	}
+	h := &p.health
+	h.Reads++
+	failed := err != nil
+	switch {
+	case failed && crc:
+		h.CRCErrors++
+	case failed:
+		h.ReadErrors++
+	}
+	if failed {
+		h.LastError = err.Error()
+	} else {
+		at := now.UTC()
+		h.LastRead, h.LastValue = &at, &v
+	}
+	p.window = append(p.window, failed)
+	if len(p.window) > w1Window {
+		p.window = p.window[len(p.window)-w1Window:]
+	}
+	n := 0
+	for _, f := range p.window {
+		if f {
+			n++
+		}
+	}
+	h.ErrorRate = float64(n) * 100 / float64(len(p.window))
+	switch {
+	case p.errors == 0 && len(p.window) >= w1MinReads && h.ErrorRate >= b.cfg.ErrorRate:
+		log.Printf("1-Wire: probe %s (%s) failed %.0f%% of its last %d reads, last: %s", id, h.Sensor, h.ErrorRate, len(p.window), h.LastError)
+		p.errors = b.alert(p, "firing", "probe-errors", b.cfg.ErrorRate, 0, h.ErrorRate, now)
+	case p.errors != 0 && h.ErrorRate < b.cfg.ErrorRate/2:
+		p.errors = b.alert(p, "resolved", "probe-errors", b.cfg.ErrorRate, p.errors, h.ErrorRate, now)
+	}
+	sensor := h.Sensor
+	b.mu.Unlock()
+	if !failed {
+		recordReading(sensor, v, sourceOneWire+id)
+	}
+}
+
+// readW1Probe reads a probe's w1_slave file: a line of the scratchpad
+// ending in the CRC check, then the temperature in thousandths of a °C.
+// crc is set when the read failed its check.
+func readW1Probe(path string) (v float64, crc bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 {
+		return 0, false, fmt.Errorf("short read")
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, true, fmt.Errorf("CRC mismatch")
+	}
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, false, fmt.Errorf("no temperature in %q", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, false, fmt.Errorf("bad temperature in %q", lines[1])
+	}
+	if milli == w1PowerOnReset {
+		return 0, false, fmt.Errorf("power-on reset value 85°C")
+	}
+	return float64(milli) / 1000, false, nil
+}
+
+// alert records a probe's alert and notifies, returning the alert's ID
+// while firing and 0 once resolved. Callers hold b.mu.
+func (b *oneWireBus) alert(p *w1Probe, state, condition string, threshold float64, id int64, value float64, now time.Time) int64 {
+	a := Alert{
+		ID:        id,
+		RuleName:  "1-Wire probe",
+		Sensor:    p.health.Sensor,
+		Condition: condition,
+		Threshold: threshold,
+		Severity:  "warning",
+		Value:     value,
+		State:     state,
+		Time:      now,
+	}
+	if state == "firing" {
+		newID, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		a.ID = newID
+	} else if err := resolveAlertEvent(id, value, now); err != nil {
+		log.Printf("Error saving alert history: %v", err)
+	}
+	targets := b.cfg.Notifiers
+	if len(targets) == 0 {
+		targets = config().Staleness.Notifiers
+	}
+	go notify(targets, a)
+	if state == "resolved" {
+		return 0
+	}
+	return a.ID
+}
+
+func (b *oneWireBus) health() BusHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := BusHealth{Dir: b.cfg.Dir, ScanErr: b.scanErr, Probes: []ProbeHealth{}}
+	if !b.lastScan.IsZero() {
+		at := b.lastScan.UTC()
+		h.LastScan = &at
+	}
+	for _, p := range b.probes {
+		h.Probes = append(h.Probes, p.health)
+	}
+	sort.Slice(h.Probes, func(i, j int) bool { return h.Probes[i].Sensor < h.Probes[j].Sensor })
+	return h
+}
+
+// errProbePresent refuses to forget a probe that is still on the bus.
+var errProbePresent = errors.New("the probe is still on the bus")
+
+// forget drops a probe that was pulled out for good, closing its alert.
+func (b *oneWireBus) forget(id string, now time.Time) (ProbeHealth, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.probes[id]
+	if !ok {
+		return ProbeHealth{}, os.ErrNotExist
+	}
+	if p.health.Present {
+		return ProbeHealth{}, errProbePresent
+	}
+	if _, err := db.Exec("DELETE FROM onewire_probes WHERE id = ?", id); err != nil {
+		return ProbeHealth{}, err
+	}
+	// The alert is closed without a notification, as the probe is not back
+	if p.missing != 0 {
+		if err := resolveAlertEvent(p.missing, 0, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+	}
+	delete(b.probes, id)
+	log.Printf("1-Wire: probe %s (%s) forgotten", id, p.health.Sensor)
+	return p.health, nil
+}
+
+// sensorsHealthHandler serves GET /api/sensors/health and DELETE
+// /api/sensors/health/{probe}, which forgets a probe no longer on the bus.
+func sensorsHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if onewire == nil {
+		http.Error(w, "No 1-Wire bus configured", http.StatusNotFound)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sensors/health"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, onewire.health())
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	old, err := onewire.forget(id, clock.Now())
+	switch {
+	case err == os.ErrNotExist:
+		http.Error(w, "Unknown probe", http.StatusNotFound)
+		return
+	case err == errProbePresent:
+		http.Error(w, "The probe is still on the bus", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error forgetting probe: %v", err), http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "probe.forget", id, old, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// apiParam is a query or path parameter of an API operation.
+type apiParam struct {
+	name, in, typ, description string
+}
+
+func query(name, typ, description string) apiParam {
+	return apiParam{name: name, in: "query", typ: typ, description: description}
+}
+
+var (
+	idParam     = apiParam{name: "id", in: "path", typ: "integer", description: "Numeric ID"}
+	zoneParam   = apiParam{name: "zone", in: "path", typ: "string", description: "Heating zone name"}
+	userParam   = apiParam{name: "username", in: "path", typ: "string", description: "Username"}
+	sensorParam = apiParam{name: "sensor", in: "path", typ: "string", description: "Sensor name"}
+	probeParam  = apiParam{name: "probe", in: "path", typ: "string", description: "1-Wire probe ID, e.g. 28-0316a2799aff"}
+	dashParam   = apiParam{name: "name", in: "path", typ: "string", description: "Dashboard name"}
+
+	chartImageParams = []apiParam{
+		query("period", "string", "day (default), week, month or year"),
+		query("sensor", "string", "Sensor name, default cpu"),
+		query("width", "integer", "Width in pixels, 200-2000, default 800"),
+		query("height", "integer", "Height in pixels, 100-1500, default 400"),
+		query("exp", "integer", "Expiry of a signed link, Unix seconds"),
+		query("sig", "string", "Signature of a signed link"),
+	}
+)
+
+// apiOperation describes one endpoint for the OpenAPI document. Request and
+// response schemas are derived from the Go values the handlers encode, so
+// they follow the structs instead of being written twice.
+type apiOperation struct {
+	method, path, tag, summary string
+	params                     []apiParam
+	body                       interface{}
+	status                     int
+	response                   interface{}
+	contentType                string
+	admin                      bool
+}
+
+var apiOperations = []apiOperation{
+	{method: "get", path: "/api/temperature", tag: "readings", summary: "Current CPU temperature, read live",
+		response: TemperatureReading{}},
+	{method: "get", path: "/api/chart-data", tag: "readings", summary: "Readings shaped for the dashboard chart",
+		params: []apiParam{
+			query("period", "string", "day (default), week, month or year"),
+			query("sensor", "string", "Sensor name, default cpu"),
+			query("annotations", "integer", "1 returns {points, annotations} with the annotations in the period"),
+			query("actuators", "string", "1 (the sensor's zones), all, or heater:<name> and trv:<name> comma-separated returns {points, annotations, actuators} with when they ran"),
+			query("compare", "string", "previous, week or year returns {current, previous}: the day, week or month so far and an earlier one in aligned buckets"),
+			query("smooth", "string", "ma (moving average) or ema (exponential smoothing) adds a smoothed value to each point"),
+			query("window", "integer", "Points smoothed over, 2 to 100, default 5"),
+			{name: "If-None-Match", in: "header", typ: "string", description: "ETag of an earlier response; answered with 304 while the chart is unchanged"},
+		},
+		response: []ChartDataPoint{}},
+	{method: "get", path: "/api/series", tag: "readings", summary: "Several sensors and actuators resampled onto one time grid",
+		params: []apiParam{
+			query("ids", "string", "Comma-separated series: a sensor name, sensor:<name>, heater:<name> or trv:<name>; at most 10"),
+			query("from", "date-time", "Start, default 24 hours ago"),
+			query("to", "date-time", "End, default now"),
+			query("step", "string", "Grid step in whole minutes, e.g. 5m; default the smallest of 1m to 24h giving under 300 points"),
+		},
+		response: SeriesResponse{}},
+	{method: "get", path: "/api/annotations", tag: "readings", summary: "Annotations of the charts, oldest first",
+		params: []apiParam{
+			query("sensor", "string", "Only those shown on this sensor's charts"),
+			query("from", "date-time", "Earliest time, inclusive"),
+			query("to", "date-time", "Latest time, exclusive"),
+		},
+		response: []Annotation{}},
+	{method: "post", path: "/api/annotations", tag: "readings", summary: "Record an event to mark on the charts",
+		body: annotationRequest{}, response: Annotation{}},
+	{method: "get", path: "/api/annotations/{id}", tag: "readings", summary: "An annotation",
+		params: []apiParam{idParam}, response: Annotation{}},
+	{method: "delete", path: "/api/annotations/{id}", tag: "readings", summary: "Delete an annotation",
+		params: []apiParam{idParam}},
+	{method: "get", path: "/api/dashboards", tag: "readings", summary: "Stored dashboards, by name",
+		response: []Dashboard{}},
+	{method: "post", path: "/api/dashboards", tag: "readings", summary: "Create a dashboard",
+		body: dashboardRequest{}, response: Dashboard{}, status: http.StatusCreated},
+	{method: "get", path: "/api/dashboards/{name}", tag: "readings", summary: "A dashboard",
+		params: []apiParam{dashParam}, response: Dashboard{}},
+	{method: "put", path: "/api/dashboards/{name}", tag: "readings", summary: "Create or replace a dashboard",
+		params: []apiParam{dashParam}, body: dashboardRequest{}, response: Dashboard{}},
+	{method: "delete", path: "/api/dashboards/{name}", tag: "readings", summary: "Delete a dashboard",
+		params: []apiParam{dashParam}, status: http.StatusNoContent},
+	{method: "post", path: "/api/ingest/{device}", tag: "readings", summary: "Record readings from a device's own JSON or CSV payload, mapped by its ingest config",
+		params:   []apiParam{{name: "device", in: "path", typ: "string", description: "Device name in the ingest config"}, query("token", "string", "The device's token, unless sent as a Bearer token")},
+		response: IngestResult{}},
+	{method: "get", path: "/api/readings", tag: "readings", summary: "Page through raw stored readings",
+		params: []apiParam{
+			query("sensor", "string", "Only this sensor"),
+			query("source", "string", "Only readings that arrived this way, such as local or graphite:192.168.1.20"),
+			query("from", "date-time", "Earliest timestamp, inclusive"),
+			query("to", "date-time", "Latest timestamp, exclusive"),
+			query("order", "string", "desc (default) or asc"),
+			query("limit", "integer", "Page size, default 100, max 1000"),
+			query("offset", "integer", "Readings to skip"),
+		},
+		response: readingPage{}},
+	{method: "get", path: "/api/sensors", tag: "readings", summary: "Known sensors with their last reading and online state",
+		response: []SensorStatus{}},
+	{method: "get", path: "/api/sensors/health", tag: "readings", summary: "1-Wire probes on the bus, those pulled out and their read error rates",
+		response: BusHealth{}},
+	{method: "delete", path: "/api/sensors/health/{probe}", tag: "readings", summary: "Forget a 1-Wire probe no longer on the bus",
+		params: []apiParam{probeParam}, status: http.StatusNoContent},
+	{method: "get", path: "/api/sparkline.png", tag: "readings", summary: "Small PNG chart of a sensor's recent readings",
+		params: []apiParam{
+			query("sensor", "string", "Sensor name, default cpu"),
+			query("window", "string", "How far back, default 1h, max 168h"),
+			query("exp", "integer", "Expiry of a signed link, Unix seconds"),
+			query("sig", "string", "Signature of a signed link"),
+		},
+		contentType: "image/png"},
+	{method: "get", path: "/api/chart.png", tag: "readings", summary: "Temperature chart rendered as PNG",
+		params: chartImageParams, contentType: "image/png"},
+	{method: "get", path: "/api/chart.svg", tag: "readings", summary: "Temperature chart rendered as SVG",
+		params: chartImageParams, contentType: "image/svg+xml"},
+	{method: "get", path: "/api/alert-rules", tag: "alerts", summary: "List alert rules",
+		response: []AlertRule{}},
+	{method: "post", path: "/api/alert-rules", tag: "alerts", summary: "Create an alert rule",
+		body: AlertRule{}, status: http.StatusCreated, response: AlertRule{}},
+	{method: "get", path: "/api/alert-rules/{id}", tag: "alerts", summary: "Get an alert rule",
+		params: []apiParam{idParam}, response: AlertRule{}},
+	{method: "put", path: "/api/alert-rules/{id}", tag: "alerts", summary: "Replace an alert rule",
+		params: []apiParam{idParam}, body: AlertRule{}, response: AlertRule{}},
+	{method: "delete", path: "/api/alert-rules/{id}", tag: "alerts", summary: "Delete an alert rule",
+		params: []apiParam{idParam}, status: http.StatusNoContent},
+	{method: "get", path: "/api/alert-rules/prometheus", tag: "alerts", summary: "Alert rules as a Prometheus rules file",
+		contentType: "application/yaml"},
+	{method: "get", path: "/api/alerts", tag: "alerts", summary: "Alert history, newest first",
+		params: []apiParam{
+			query("state", "string", "active, acknowledged or resolved"),
+			query("rule_id", "integer", "Only this rule"),
+			query("sensor", "string", "Only this sensor"),
+			query("severity", "string", "info, warning or critical"),
+			query("from", "date-time", "Fired at or after"),
+			query("to", "date-time", "Fired before"),
+			query("limit", "integer", "Page size, default 50, max 500"),
+			query("offset", "integer", "Alerts to skip"),
+		},
+		response: alertEventPage{}},
+	{method: "get", path: "/api/alerts/stats", tag: "alerts", summary: "How often alerts fired per period, how long they took to recover and their most common sources",
+		params: []apiParam{
+			query("from", "date-time", "Fired at or after, default 90 days ago"),
+			query("to", "date-time", "Fired before, default now"),
+			query("bucket", "string", "day, week (default) or month"),
+			query("rule_id", "integer", "Only this rule"),
+			query("sensor", "string", "Only this sensor"),
+			query("severity", "string", "info, warning or critical"),
+		},
+		response: AlertStats{}},
+	{method: "get", path: "/api/alerts/{id}", tag: "alerts", summary: "Get an alert",
+		params: []apiParam{idParam}, response: AlertEvent{}},
+	{method: "post", path: "/api/alerts/{id}/ack", tag: "alerts", summary: "Acknowledge an active alert, stopping repeat notifications",
+		params: []apiParam{idParam}, body: struct {
+			By string `json:"by"`
+		}{}, response: AlertEvent{}},
+	{method: "get", path: "/api/push/key", tag: "alerts", summary: "The VAPID public key browsers subscribe to push notifications with",
+		response: map[string]string{"publicKey": ""}},
+	{method: "post", path: "/api/push/subscribe", tag: "alerts", summary: "Subscribe a browser to alerts of at least a severity, or update its subscription",
+		body: pushSubscribeRequest{}, response: PushSubscription{}, status: http.StatusCreated},
+	{method: "post", path: "/api/push/unsubscribe", tag: "alerts", summary: "Remove a browser's subscription by its endpoint",
+		body: struct {
+			Endpoint string `json:"endpoint"`
+		}{}, status: http.StatusNoContent},
+	{method: "get", path: "/api/push/subscriptions", tag: "alerts", summary: "Every browser subscribed to alerts",
+		response: []PushSubscription{}, admin: true},
+	{method: "delete", path: "/api/push/subscriptions/{id}", tag: "alerts", summary: "Remove a browser's subscription",
+		params: []apiParam{idParam}, status: http.StatusNoContent, admin: true},
+	{method: "get", path: "/api/heaters", tag: "heating", summary: "Relay state, measured power and interlock fault of each heater plug",
+		response: []HeaterStatus{}},
+	{method: "get", path: "/api/zones", tag: "heating", summary: "Temperature, setpoint and heating decision of each zone the control loop runs",
+		response: []ZoneStatus{}},
+	{method: "get", path: "/api/boilers", tag: "heating", summary: "Firing decision, flow and zones of each shared boiler",
+		response: []BoilerStatus{}},
+	{method: "get", path: "/api/zones/{zone}/comfort", tag: "heating", summary: "Per bucket, whether the zone was below, within or above its comfort band",
+		params: []apiParam{zoneParam,
+			query("hours", "integer", "Length of the window up to now, 1-168, default 24"),
+			query("bucket", "string", "Bucket length in whole minutes, default 15m"),
+		}, response: ComfortStrip{}},
+	{method: "get", path: "/api/zones/{zone}/override", tag: "heating", summary: "The zone's override and how long it has left",
+		params: []apiParam{zoneParam}, response: ZoneOverride{}},
+	{method: "post", path: "/api/zones/{zone}/override", tag: "heating", summary: "Hold the zone at a target for a while, over its setpoint, vacation and away mode",
+		params: []apiParam{zoneParam}, body: overrideRequest{}, response: ZoneOverride{}},
+	{method: "delete", path: "/api/zones/{zone}/override", tag: "heating", summary: "End the zone's override early",
+		params: []apiParam{zoneParam}, status: http.StatusNoContent},
+	{method: "get", path: "/api/zones/{zone}/autotune", tag: "heating", summary: "Progress of the zone's autotune and the PID constants it stored",
+		params: []apiParam{zoneParam}, response: AutotuneReport{}},
+	{method: "post", path: "/api/zones/{zone}/autotune", tag: "heating", summary: "Start a relay-feedback autotune of the zone's PID constants",
+		params: []apiParam{zoneParam}, body: autotuneRequest{}, status: http.StatusAccepted, response: AutotuneStatus{}},
+	{method: "delete", path: "/api/zones/{zone}/autotune", tag: "heating", summary: "Cancel the zone's running autotune",
+		params: []apiParam{zoneParam}, status: http.StatusNoContent},
+	{method: "get", path: "/api/explain", tag: "heating", summary: "Setpoint, decision and reasoning of each zone right now",
+		response: Explanation{}},
+	{method: "get", path: "/api/trvs", tag: "heating", summary: "Temperature, setpoint and valve position each radiator valve last reported",
+		response: []TRVStatus{}},
+	{method: "get", path: "/api/peers", tag: "integrations", summary: "Other piheat instances on the local network, found over mDNS",
+		response: []Peer{}},
+	{method: "get", path: "/api/failover", tag: "heating", summary: "Whether this hub or its failover peer has heating control, and the peer's last heartbeat",
+		response: FailoverStatus{}},
+	{method: "get", path: "/api/failover/sync", tag: "heating", summary: "Heartbeat between failover hubs; answers with the term, readings and setpoints to replicate",
+		params: []apiParam{
+			query("term", "integer", "The calling hub's term"),
+			query("active", "boolean", "Whether the calling hub has control"),
+			query("run", "string", "Run of this hub the cursor belongs to"),
+			query("after", "integer", "Last reading sequence number received"),
+		},
+		response: FailoverSync{}},
+	{method: "get", path: "/api/season", tag: "heating", summary: "Whether heating is off for the summer, why, and the daily outdoor means it was decided on",
+		response: SeasonStatus{}},
+	{method: "put", path: "/api/season", tag: "heating", summary: "Fix the season to summer or winter, or hand it back to detection with auto",
+		body: struct {
+			Override string `json:"override"`
+		}{}, response: SeasonStatus{}},
+	{method: "get", path: "/api/presence", tag: "heating", summary: "Whether anybody is home, why, the presence devices last seen and the recent mode changes",
+		response: PresenceStatus{}},
+	{method: "put", path: "/api/presence", tag: "heating", summary: "Set the house home or away, setting the zones back while away, or hand it back to the devices with auto",
+		body: struct {
+			Mode string `json:"mode"`
+		}{}, response: PresenceStatus{}},
+	{method: "post", path: "/api/presence/{person}", tag: "heating", summary: "Webhook for a person's phone entering or leaving home, from OwnTracks or an automation",
+		params: []apiParam{{name: "person", in: "path", typ: "string", description: "Person in the presence config"},
+			query("token", "string", "The person's token, unless sent as a Bearer token or basic auth password"),
+			query("event", "string", "enter or leave, unless in the body")},
+		body: geofenceEvent{}, response: PresenceStatus{}},
+	{method: "get", path: "/api/vacations", tag: "heating", summary: "Vacations, latest first, and whether each is scheduled, active, preheating or ended",
+		response: []Vacation{}},
+	{method: "post", path: "/api/vacations", tag: "heating", summary: "Hold the zones at frost protection while away, pre-heating before the return",
+		body: vacationRequest{}, status: http.StatusCreated, response: Vacation{}},
+	{method: "get", path: "/api/vacations/{id}", tag: "heating", summary: "A vacation",
+		params: []apiParam{idParam}, response: Vacation{}},
+	{method: "delete", path: "/api/vacations/{id}", tag: "heating", summary: "Cancel a vacation, or end it early",
+		params: []apiParam{idParam}},
+	{method: "get", path: "/api/selftest", tag: "heating", summary: "Result of the start-up self-test and whether heating control was enabled",
+		response: SelfTestReport{}},
+	{method: "post", path: "/api/schedule/simulate", tag: "heating", summary: "Estimate comfort and heater runtime of a schedule over the zone's recorded month",
+		body: simulateRequest{}, response: SimulationReport{}},
+	{method: "get", path: "/api/simulation", tag: "heating", summary: "Outdoor temperature, heaters and rooms of the model while started with -simulate",
+		response: SimulationStatus{}},
+	{method: "get", path: "/api/setpoints", tag: "heating", summary: "Target temperature of each zone",
+		response: []Setpoint{}},
+	{method: "get", path: "/api/setpoints/{zone}", tag: "heating", summary: "Target temperature of a zone",
+		params: []apiParam{zoneParam}, response: Setpoint{}},
+	{method: "put", path: "/api/setpoints/{zone}", tag: "heating", summary: "Set the target temperature of a zone",
+		params: []apiParam{zoneParam}, body: struct {
+			Temperature float64 `json:"temperature"`
+		}{}, response: Setpoint{}},
+	{method: "get", path: "/api/calibrations", tag: "readings", summary: "Current offset of each calibrated sensor",
+		response: []Calibration{}},
+	{method: "get", path: "/api/calibrations/{sensor}", tag: "readings", summary: "Calibration history of a sensor, newest first",
+		params: []apiParam{sensorParam}, response: []Calibration{}},
+	{method: "post", path: "/api/calibrations/{sensor}", tag: "readings", summary: "Calibrate a sensor against a reference thermometer's reading, or set its offset",
+		params: []apiParam{sensorParam}, body: calibrationRequest{}, response: Calibration{}},
+	{method: "get", path: "/api/zabbix/discovery", tag: "integrations", summary: "Zabbix low-level discovery of sensors",
+		response: map[string]interface{}{}},
+	{method: "get", path: "/feed.xml", tag: "alerts", summary: "Atom feed of recent alerts and daily summaries",
+		params:      []apiParam{query("sensor", "string", "Only this sensor")},
+		contentType: "application/atom+xml"},
+	{method: "get", path: "/api/report/{year}", tag: "readings", summary: "Year in review: monthly averages, coldest and warmest days, heater runtime, energy and cost against the previous year",
+		params: []apiParam{{name: "year", in: "path", typ: "integer", description: "Calendar year"}}, response: YearReport{}},
+	{method: "get", path: "/api/energy", tag: "heating", summary: "Runtime, estimated energy and tariff cost of each heater plug and radiator valve, and their totals, per day, week or month",
+		params: []apiParam{
+			query("period", "string", "day (default), week or month"),
+			query("from", "date-time", "Start, default 30 days, 12 weeks or 12 months back"),
+			query("to", "date-time", "End, default now"),
+		}, response: EnergyReport{}},
+	{method: "get", path: "/api/outages", tag: "readings", summary: "Times piheat was not running, newest first, and whether it was stopped or lost power",
+		response: []Outage{}},
+	{method: "get", path: "/report/{year}.pdf", tag: "readings", summary: "Year in review as a PDF",
+		params: []apiParam{{name: "year", in: "path", typ: "integer", description: "Calendar year"}}, contentType: "application/pdf"},
+	{method: "get", path: "/metrics", tag: "integrations", summary: "Prometheus metrics",
+		contentType: "text/plain"},
+	{method: "get", path: "/debug/status", tag: "admin", summary: "Request, query and sensor read timings and process state as plain text",
+		contentType: "text/plain", admin: true},
+	{method: "get", path: "/eink", tag: "integrations", summary: "Status page as a 1-bit PNG for e-paper displays",
+		params: []apiParam{
+			query("width", "integer", "Width in pixels, 200-2000, default 800"),
+			query("height", "integer", "Height in pixels, 100-1500, default 480"),
+			query("sensor", "string", "Sensor of the chart, default cpu"),
+			query("chart", "integer", "0 leaves the chart out"),
+		},
+		contentType: "image/png"},
+	{method: "get", path: "/legacy/temp", tag: "integrations", summary: "A sensor's value as temp=55.2, for older scripts",
+		params: []apiParam{query("sensor", "string", "Sensor name, default cpu")}, contentType: "text/plain"},
+	{method: "get", path: "/legacy/value", tag: "integrations", summary: "A sensor's bare value, for older scripts",
+		params: []apiParam{query("sensor", "string", "Sensor name, default cpu")}, contentType: "text/plain"},
+	{method: "get", path: "/legacy/munin", tag: "integrations", summary: "Temperatures as a Munin plugin's values",
+		contentType: "text/plain"},
+	{method: "get", path: "/legacy/munin/config", tag: "integrations", summary: "Munin plugin config for the temperatures",
+		contentType: "text/plain"},
+	{method: "post", path: "/api/admin/purge", tag: "admin", summary: "Preview, then with confirm, permanently delete data",
+		body: purgeRequest{}, response: purgePreview{}, admin: true},
+	{method: "get", path: "/api/admin/purges", tag: "admin", summary: "Audit trail of executed purges",
+		response: []DataPurge{}, admin: true},
+	{method: "post", path: "/api/admin/backup", tag: "admin", summary: "Take a backup of the database now",
+		status: http.StatusCreated, response: BackupInfo{}, admin: true},
+	{method: "get", path: "/api/admin/backups", tag: "admin", summary: "Backups in the backup directory and bucket, newest first",
+		response: []BackupInfo{}, admin: true},
+	{method: "get", path: "/api/admin/archives", tag: "admin", summary: "Manifests of the readings archived to the archive bucket, oldest data first",
+		response: []ArchiveManifest{}, admin: true},
+	{method: "get", path: "/api/admin/maintenance", tag: "admin", summary: "Recent database maintenance runs, newest first",
+		response: []MaintenanceRun{}, admin: true},
+	{method: "post", path: "/api/admin/maintenance", tag: "admin", summary: "Run database maintenance now",
+		response: MaintenanceRun{}, admin: true},
+	{method: "get", path: "/api/settings", tag: "admin", summary: "Editable settings, with notifier credentials masked",
+		response: SettingsResponse{}, admin: true},
+	{method: "put", path: "/api/settings", tag: "admin", summary: "Store and apply the given settings; null returns one to the config file's value",
+		body: Settings{}, response: SettingsResponse{}, admin: true},
+	{method: "get", path: "/api/settings/theme", tag: "users", summary: "The theme of the web UI and the CSS variables derived from it",
+		response: Theme{}},
+	{method: "put", path: "/api/settings/theme", tag: "admin", summary: "Store and apply the theme; fields left out keep their value",
+		body: ThemeConfig{}, response: Theme{}, admin: true},
+	{method: "delete", path: "/api/settings/theme", tag: "admin", summary: "Go back to the config file's theme",
+		response: Theme{}, admin: true},
+	{method: "post", path: "/api/admin/reload", tag: "admin", summary: "Reload the config file and apply it without restarting, like SIGHUP",
+		response: ReloadResult{}, admin: true},
+	{method: "get", path: "/api/audit", tag: "admin", summary: "Audit log of changes, newest first",
+		params: []apiParam{
+			query("action", "string", "An action such as setpoint.set, or a kind such as alert_rule"),
+			query("target", "string", "Only changes to this zone, rule ID, user or other target"),
+			query("actor", "string", "Only changes by this user, admin_token, cli, retention, SIGHUP or grpc"),
+			query("from", "date-time", "Earliest change, inclusive"),
+			query("to", "date-time", "Latest change, exclusive"),
+			query("limit", "integer", "Page size, default 100, max 1000"),
+			query("offset", "integer", "Entries to skip"),
+		},
+		response: auditPage{}, admin: true},
+	{method: "post", path: "/api/admin/failover/takeover", tag: "admin", summary: "Move heating control to this failover hub",
+		response: FailoverStatus{}, admin: true},
+	{method: "get", path: "/api/admin/users", tag: "admin", summary: "Users who can log in, with their roles",
+		response: []User{}, admin: true},
+	{method: "post", path: "/api/admin/users", tag: "admin", summary: "Create a user; the role defaults to viewer",
+		body: userRequest{}, status: http.StatusCreated, response: User{}, admin: true},
+	{method: "put", path: "/api/admin/users/{username}", tag: "admin", summary: "Change the password or role of a user",
+		params: []apiParam{userParam}, body: userRequest{}, response: User{}, admin: true},
+	{method: "delete", path: "/api/admin/users/{username}", tag: "admin", summary: "Delete a user and end their sessions",
+		params: []apiParam{userParam}, status: http.StatusNoContent, admin: true},
+	{method: "get", path: "/api/admin/devices", tag: "admin", summary: "Devices registered to open a given view",
+		response: []Device{}, admin: true},
+	{method: "post", path: "/api/admin/devices", tag: "admin", summary: "Register a device; the token and setup link are only shown here",
+		body: deviceRequest{}, status: http.StatusCreated, response: NewDevice{}, admin: true},
+	{method: "put", path: "/api/admin/devices/{id}", tag: "admin", summary: "Rename a device or change its view",
+		params: []apiParam{idParam}, body: deviceRequest{}, response: Device{}, admin: true},
+	{method: "delete", path: "/api/admin/devices/{id}", tag: "admin", summary: "Forget a device",
+		params: []apiParam{idParam}, status: http.StatusNoContent, admin: true},
+	{method: "get", path: "/api/landing", tag: "users", summary: "The view the dashboard opens with here, and where it comes from",
+		response: Landing{}},
+	{method: "put", path: "/api/landing", tag: "users", summary: "Set the view the dashboard opens with for the logged-in user; empty for the default",
+		body: struct {
+			View string `json:"view"`
+		}{}, response: Landing{}},
+	{method: "get", path: "/api/language", tag: "users", summary: "The language pages are shown in here, where it comes from and the languages available",
+		response: Language{}},
+	{method: "put", path: "/api/language", tag: "users", summary: "Set the language of the logged-in user, or of this browser without one; empty for the browser's",
+		body: struct {
+			Language string `json:"language"`
+		}{}, response: Language{}},
+	{method: "post", path: "/api/login", tag: "users", summary: "Log in and set the session cookie",
+		body: loginRequest{}, response: User{}},
+	{method: "post", path: "/api/logout", tag: "users", summary: "End the session",
+		status: http.StatusNoContent},
+	{method: "get", path: "/api/session", tag: "users", summary: "The logged-in user",
+		response: User{}},
+}
+
+// schemaBuilder turns Go types into JSON schemas, collecting named structs
+// as reusable components.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(Duration{})
+)
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "string", "description": "Duration such as 30s, 5m or 1h"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		s["nullable"] = true
+		return s
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil // guards against recursive types
+			b.components[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (p apiParam) spec() map[string]interface{} {
+	s := map[string]interface{}{"type": p.typ}
+	if p.typ == "date-time" {
+		s = map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	return map[string]interface{}{
+		"name":        p.name,
+		"in":          p.in,
+		"required":    p.in == "path",
+		"description": p.description,
+		"schema":      s,
+	}
+}
+
+// openAPIDocument builds the OpenAPI 3 description of the HTTP API, with the
+// JSON API under /api/v1/. Operation IDs keep the unversioned path so
+// generated clients don't rename their methods.
+func openAPIDocument() map[string]interface{} {
+	b := &schemaBuilder{components: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+	for _, op := range apiOperations {
+		spec := map[string]interface{}{
+			"summary":     op.summary,
+			"tags":        []string{op.tag},
+			"operationId": operationID(op),
+		}
+		var params []interface{}
+		for _, p := range op.params {
+			params = append(params, p.spec())
+		}
+		if params != nil {
+			spec["parameters"] = params
+		}
+		if op.body != nil {
+			spec["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.body))},
+				},
+			}
+		}
+		status := op.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		resp := map[string]interface{}{"description": http.StatusText(status)}
+		switch {
+		case op.response != nil:
+			resp["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.response))},
+			}
+		case op.contentType != "":
+			schema := map[string]interface{}{"type": "string"}
+			if strings.HasPrefix(op.contentType, "image/") {
+				schema["format"] = "binary"
+			}
+			resp["content"] = map[string]interface{}{op.contentType: map[string]interface{}{"schema": schema}}
+		}
+		responses := map[string]interface{}{fmt.Sprint(status): resp}
+		path := op.path
+		if strings.HasPrefix(path, legacyPrefix) {
+			path = apiV1Prefix + strings.TrimPrefix(path, legacyPrefix)
+			responses["default"] = map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					problemContentType: map[string]interface{}{"schema": b.schema(reflect.TypeOf(Problem{}))},
+				},
+			}
+		}
+		spec["responses"] = responses
+		if op.admin {
+			spec["security"] = []map[string][]string{{"adminToken": {}}, {"session": {}}}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][op.method] = spec
+	}
+
+	server := basePath
+	if server == "" {
+		server = "/"
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "piheat",
+			"description": "Temperature monitoring, alerting and forwarding for the Raspberry Pi.",
+			"version":     assetVersion,
+		},
+		"servers": []map[string]string{{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]string{"type": "http", "scheme": "bearer", "description": "admin_token from the config file"},
+				"session":    map[string]string{"type": "apiKey", "in": "cookie", "name": sessionCookie, "description": "Session of a user with the admin role, from /api/v1/login"},
+			},
+		},
+	}
+}
+
+// operationID derives a stable identifier such as getApiAlertRulesId for
+// client generators.
+func operationID(op apiOperation) string {
+	id := op.method
+	for _, part := range strings.FieldsFunc(op.path, func(r rune) bool {
+		return r == '/' || r == '-' || r == '.' || r == '{' || r == '}'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument())
+}
+
+// apiDocsHandler serves Swagger UI for the OpenAPI document.
+func apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := parseTemplate("docs.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+	}{basePath, assetVersion})
+}
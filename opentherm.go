@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// openthermReconnect is how long to wait before reconnecting to a
+	// gateway.
+	openthermReconnect = 10 * time.Second
+	// openthermSilence is how long a gateway may send nothing before the
+	// connection is dropped; a boiler talks to its thermostat every second.
+	openthermSilence = time.Minute
+	// openthermReply is how long a command waits for the gateway's answer.
+	openthermReply = 5 * time.Second
+)
+
+// OpenTherm message types and data IDs the gateway's boiler messages are
+// read for.
+const (
+	otReadAck  = 4
+	otWriteAck = 5
+
+	otStatus     = 0
+	otFaultFlags = 5
+	otModulation = 17
+	otFlow       = 25
+	otReturn     = 28
+)
+
+// otConn is a connection to a gateway, over TCP or its serial port.
+type otConn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(time.Time) error
+}
+
+// otGateway is an OpenTherm Gateway (OTGW) in gateway mode, between a
+// boiler and its thermostat. It reads the boiler's flow and return
+// temperatures and modulation level from the traffic it reports, which
+// are recorded as the sensors <heater>_flow, <heater>_return and
+// <heater>_modulation. As a boiler's heater, it is switched with the CH
+// command and the control loop sets the boiler's control setpoint (the
+// water temperature) with CS, instead of a relay being switched.
+type otGateway struct {
+	h   *heaterCheck
+	url string
+
+	mu   sync.Mutex
+	conn otConn
+	// water is the control setpoint the control loop wants and sent the
+	// one last sent since connecting.
+	water, sent float64
+	// recorded is when each sensor, or "status" for the heater, was last
+	// recorded, so the traffic is sampled every interval.
+	recorded map[string]time.Time
+	relayOn  bool
+	fault    bool
+	code     float64
+
+	// cmd serializes commands, whose replies come in between the boiler
+	// messages.
+	cmd     sync.Mutex
+	replies chan string
+}
+
+// otGateways are the opentherm heaters by url.
+var otGateways = map[string]*otGateway{}
+
+// openthermGateway is the gateway of an opentherm heater, nil for other
+// heaters.
+func openthermGateway(hc HeaterConfig) *otGateway {
+	if hc.Type != "opentherm" {
+		return nil
+	}
+	return otGateways[hc.URL]
+}
+
+// checkOpenThermURL validates a gateway's url: tcp://host:port for the
+// network interface of the gateway, or ser2net, or the path of its serial
+// port.
+func checkOpenThermURL(url string) error {
+	switch {
+	case strings.HasPrefix(url, "tcp://"):
+		if _, _, err := net.SplitHostPort(strings.TrimPrefix(url, "tcp://")); err != nil {
+			return fmt.Errorf("url: %v", err)
+		}
+	case strings.HasPrefix(url, "/"):
+	default:
+		return fmt.Errorf("url must be tcp://host:port or a serial device such as /dev/ttyUSB0")
+	}
+	return nil
+}
+
+func dialOpenTherm(url string) (otConn, error) {
+	if strings.HasPrefix(url, "/") {
+		return openSerial(url)
+	}
+	return net.DialTimeout("tcp", strings.TrimPrefix(url, "tcp://"), 10*time.Second)
+}
+
+// openthermSensor is which of a gateway's readings sensor is, flow, return
+// or modulation, empty for other sensors.
+func openthermSensor(sensor string) string {
+	for _, g := range otGateways {
+		for _, kind := range []string{"flow", "return", "modulation"} {
+			if sensor == g.h.name+"_"+kind {
+				return kind
+			}
+		}
+	}
+	return ""
+}
+
+// openthermUnit is the unit of a gateway's sensor other than °C, empty for
+// other sensors.
+func openthermUnit(sensor string) string {
+	if openthermSensor(sensor) == "modulation" {
+		return "%"
+	}
+	return ""
+}
+
+// run keeps the gateway connected and reads its messages.
+func (g *otGateway) run() {
+	for _, kind := range []string{"flow", "return", "modulation"} {
+		sensorsMonitor.expect(g.h.name+"_"+kind, g.h.cfg.Interval.Duration)
+	}
+	go g.keepWater()
+	for {
+		conn, err := dialOpenTherm(g.url)
+		if err != nil {
+			log.Printf("Error connecting to OpenTherm gateway %s: %v", g.h.name, err)
+			time.Sleep(openthermReconnect)
+			continue
+		}
+		log.Printf("OpenTherm gateway %s connected at %s", g.h.name, g.url)
+		g.mu.Lock()
+		g.conn, g.sent = conn, 0
+		g.mu.Unlock()
+		err = g.read(conn)
+		g.mu.Lock()
+		g.conn = nil
+		g.mu.Unlock()
+		conn.Close()
+		log.Printf("OpenTherm gateway %s disconnected: %v", g.h.name, err)
+		time.Sleep(openthermReconnect)
+	}
+}
+
+// read handles the gateway's lines until the connection fails or goes
+// quiet. Boiler messages are B followed by eight hex digits; replies to
+// commands are "XX: value", or a two letter error code such as NG.
+func (g *otGateway) read(conn otConn) error {
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(openthermSilence))
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(line) == 9 && line[0] == 'B':
+			if b, err := hex.DecodeString(line[1:]); err == nil {
+				g.message(b, clock.Now())
+			}
+		case strings.Contains(line, ": ") || len(line) == 2:
+			select {
+			case g.replies <- line:
+			default:
+			}
+		}
+	}
+}
+
+// message takes in one message from the boiler.
+func (g *otGateway) message(b []byte, now time.Time) {
+	if typ := b[0] >> 4 & 7; typ != otReadAck && typ != otWriteAck {
+		return
+	}
+	// Temperatures and the modulation level are f8.8 fixed point
+	value := float64(int16(uint16(b[2])<<8|uint16(b[3]))) / 256
+	switch b[1] {
+	case otStatus:
+		// The boiler echoes the master's flags, with CH enable as the
+		// gateway passed it on, and adds its own, fault first
+		g.status(b[2]&1 != 0, b[3]&1 != 0, now)
+	case otFaultFlags:
+		g.mu.Lock()
+		g.code = float64(b[3])
+		g.mu.Unlock()
+	case otModulation:
+		g.record(g.h.name+"_modulation", value, now)
+	case otFlow:
+		g.record(g.h.name+"_flow", value, now)
+	case otReturn:
+		g.record(g.h.name+"_return", value, now)
+	}
+}
+
+// due reports whether key is to be recorded now, at most once an interval.
+func (g *otGateway) due(key string, now time.Time) bool {
+	if now.Sub(g.recorded[key]) < g.h.plug().Interval.Duration {
+		return false
+	}
+	g.recorded[key] = now
+	return true
+}
+
+func (g *otGateway) record(sensor string, value float64, now time.Time) {
+	g.mu.Lock()
+	due := g.due(sensor, now)
+	g.mu.Unlock()
+	if due {
+		recordReading(sensor, math.Round(value*100)/100, sourceOpenTherm)
+	}
+}
+
+// status hands the boiler's CH enable and fault flags to the heater
+// check when they change, or else once an interval.
+func (g *otGateway) status(ch, fault bool, now time.Time) {
+	g.mu.Lock()
+	changed := ch != g.relayOn || fault != g.fault
+	g.relayOn, g.fault = ch, fault
+	due := g.due("status", now) || changed
+	code := g.code
+	g.mu.Unlock()
+	if due {
+		g.h.update(func(s *plugStatus) { s.relayOn, s.fault, s.faultCode = ch, fault, code })
+	}
+}
+
+// plugStatus is the gateway's latest status, for the self-test.
+func (g *otGateway) plugStatus() (plugStatus, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn == nil {
+		return plugStatus{}, fmt.Errorf("gateway not connected")
+	}
+	return plugStatus{relayOn: g.relayOn, fault: g.fault, faultCode: g.code}, nil
+}
+
+// command sends a command and waits for the gateway to acknowledge it.
+func (g *otGateway) command(cmd, arg string) error {
+	g.cmd.Lock()
+	defer g.cmd.Unlock()
+	g.mu.Lock()
+	conn := g.conn
+	g.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("gateway not connected")
+	}
+	for len(g.replies) > 0 {
+		<-g.replies
+	}
+	if _, err := fmt.Fprintf(conn, "%s=%s\r\n", cmd, arg); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(openthermReply)
+	defer timeout.Stop()
+	for {
+		select {
+		case reply := <-g.replies:
+			if strings.HasPrefix(reply, cmd+":") {
+				return nil
+			}
+			if len(reply) == 2 {
+				return fmt.Errorf("%s=%s: gateway answered %s", cmd, arg, reply)
+			}
+		case <-timeout.C:
+			return fmt.Errorf("%s=%s: no answer from the gateway", cmd, arg)
+		}
+	}
+}
+
+// waitConnected waits up to timeout for the gateway to connect, for the
+// self-test at start.
+func (g *otGateway) waitConnected(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		g.mu.Lock()
+		connected := g.conn != nil
+		g.mu.Unlock()
+		if connected {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gateway not connected")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// switchCH enables or disables central heating, first sending the control
+// setpoint when it is enabled with one that has not been sent yet.
+func (g *otGateway) switchCH(on bool) error {
+	if err := g.waitConnected(10 * time.Second); err != nil {
+		return err
+	}
+	if on {
+		if err := g.sendWater(); err != nil {
+			return err
+		}
+	}
+	arg := "0"
+	if on {
+		arg = "1"
+	}
+	if err := g.command("CH", arg); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.relayOn = on
+	g.mu.Unlock()
+	return nil
+}
+
+// setWater takes the control setpoint the control loop wants; the heater's
+// relay actuator sends it.
+func (g *otGateway) setWater(water float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.water = water
+}
+
+// sendWater sends the wanted control setpoint unless it was sent already.
+func (g *otGateway) sendWater() error {
+	g.mu.Lock()
+	water, sent := g.water, g.sent
+	g.mu.Unlock()
+	if water == 0 || water == sent {
+		return nil
+	}
+	if err := g.command("CS", fmt.Sprintf("%.1f", water)); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.sent = water
+	g.mu.Unlock()
+	log.Printf("OpenTherm gateway %s: control setpoint %.1f°C", g.h.name, water)
+	return nil
+}
+
+// keepWater sends a changed control setpoint while the boiler fires, which
+// the relay actuator only does when switching it on.
+func (g *otGateway) keepWater() {
+	ticker := time.NewTicker(relayWatchdog)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.mu.Lock()
+		firing := g.conn != nil && g.relayOn
+		g.mu.Unlock()
+		if !firing {
+			continue
+		}
+		if err := g.sendWater(); err != nil {
+			log.Printf("Error setting OpenTherm gateway %s: %v", g.h.name, err)
+		}
+	}
+}
+
+// checkWater validates and defaults the control setpoint limits of a
+// boiler with an OpenTherm gateway as its heater.
+func (bc *BoilerConfig) checkWater(opentherm bool) error {
+	if !opentherm {
+		if bc.MinWater != 0 || bc.MaxWater != 0 || bc.WaterGain != 0 {
+			return fmt.Errorf("min_water, max_water and water_gain need an opentherm heater")
+		}
+		return nil
+	}
+	if bc.MinWater == 0 {
+		bc.MinWater = 30
+	}
+	if bc.MaxWater == 0 {
+		bc.MaxWater = 70
+	}
+	if bc.WaterGain == 0 {
+		bc.WaterGain = 10
+	}
+	if bc.MinWater < 10 || bc.MaxWater > 90 || bc.MinWater >= bc.MaxWater {
+		return fmt.Errorf("min_water and max_water must be between 10 and 90°C, min_water below max_water")
+	}
+	if bc.WaterGain < 0 {
+		return fmt.Errorf("water_gain must not be negative")
+	}
+	return nil
+}
+
+// waterSetpoint is the control setpoint an OpenTherm boiler is asked for:
+// min_water, plus water_gain for each degree the coldest zone it serves is
+// below its target, up to max_water, in half degrees.
+func (b *boilerState) waterSetpoint(c *controlLoop, summer bool) float64 {
+	var short float64
+	for _, z := range b.zones {
+		if !z.heating {
+			continue
+		}
+		target := z.target
+		if z.frost {
+			target = c.frostTarget(z, summer)
+		}
+		if d := target - z.temp; d > short {
+			short = d
+		}
+	}
+	water := b.cfg.MinWater + b.cfg.WaterGain*short
+	if water > b.cfg.MaxWater {
+		water = b.cfg.MaxWater
+	}
+	return math.Round(water*2) / 2
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// openSerial is only supported on Linux; elsewhere the gateway is reached
+// over TCP.
+func openSerial(path string) (otConn, error) {
+	return nil, fmt.Errorf("serial ports are only supported on Linux, use tcp://host:port")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// outageMinimum is the shortest downtime recorded as an outage; quicker
+// restarts, such as for an upgrade, are left out.
+const outageMinimum = time.Minute
+
+// PowerFailureConfig sends a notification to Notifiers when piheat comes
+// back after a power failure.
+type PowerFailureConfig struct {
+	Notifiers []string `json:"notifiers"`
+}
+
+// Outage is a time piheat was not running. Clean is set when it was
+// stopped; otherwise it went away without stopping, such as in a power
+// failure, and the outage starts at its last reading.
+type Outage struct {
+	ID       int64     `json:"id"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration Duration  `json:"duration"`
+	Clean    bool      `json:"clean"`
+}
+
+// initOutageTable creates the outage log. A clean stop adds a row without
+// ended_at, which the next start completes.
+func initOutageTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS outages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at DATETIME NOT NULL,
+		ended_at DATETIME,
+		clean INTEGER NOT NULL DEFAULT 0
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// markStopped records a clean stop, so the next start can tell it from a
+// power failure.
+func markStopped() {
+	if _, err := db.Exec("INSERT INTO outages (started_at, clean) VALUES (?, 1)", sqliteTime(time.Now())); err != nil {
+		log.Printf("Error recording the stop: %v", err)
+	}
+}
+
+// detectOutage works out, at start, how long piheat was not running: since
+// its clean stop, or else since the last stored reading. Downtime of at
+// least twice sample_interval, and at least a minute, is kept as an outage;
+// it returns nil for anything shorter and for a new database.
+func detectOutage(now time.Time) (*Outage, error) {
+	o := &Outage{End: now.UTC().Truncate(time.Second)}
+	var started string
+	err := db.QueryRow("SELECT id, started_at FROM outages WHERE ended_at IS NULL ORDER BY id DESC LIMIT 1").Scan(&o.ID, &started)
+	switch {
+	case err == nil:
+		o.Clean = true
+	case err == sql.ErrNoRows:
+		var last sql.NullString
+		if err := db.QueryRow("SELECT MAX(timestamp) FROM temperature_readings").Scan(&last); err != nil {
+			return nil, err
+		}
+		if !last.Valid {
+			return nil, nil
+		}
+		started = last.String
+	default:
+		return nil, err
+	}
+	if o.Start, err = parseSQLiteTime(started); err != nil {
+		return nil, err
+	}
+	o.Duration = Duration{o.End.Sub(o.Start)}
+
+	shortest := 2 * config().SampleInterval.Duration
+	if shortest < outageMinimum {
+		shortest = outageMinimum
+	}
+	if o.Duration.Duration < shortest {
+		if o.Clean {
+			_, err = db.Exec("DELETE FROM outages WHERE ended_at IS NULL")
+		}
+		return nil, err
+	}
+	if o.Clean {
+		_, err = db.Exec("UPDATE outages SET ended_at = ? WHERE ended_at IS NULL", sqliteTime(o.End))
+		return o, err
+	}
+	res, err := db.Exec("INSERT INTO outages (started_at, ended_at, clean) VALUES (?, ?, 0)", sqliteTime(o.Start), sqliteTime(o.End))
+	if err != nil {
+		return nil, err
+	}
+	o.ID, _ = res.LastInsertId()
+	return o, nil
+}
+
+// catchUp handles the start after an outage: the sensors are judged from
+// now rather than from before it, and a power failure is noted on the
+// charts and, with power_failure notifiers, notified.
+func catchUp(now time.Time) {
+	o, err := detectOutage(now)
+	if err != nil {
+		log.Printf("Error checking for an outage: %v", err)
+		return
+	}
+	if o == nil {
+		return
+	}
+	sensorsMonitor.resume(o.End)
+	if o.Clean {
+		log.Printf("Back after being stopped for %s", o.Duration.Duration)
+		return
+	}
+	log.Printf("Power restored: no reading since %s, down for %s", o.Start.Local().Format(time.RFC3339), o.Duration.Duration)
+	_, err = db.Exec("INSERT INTO annotations (time, label, sensor, actor, created_at) VALUES (?, ?, '', 'piheat', ?)",
+		sqliteTime(o.Start), "Power failure, down "+o.Duration.Duration.String(), sqliteTime(o.End))
+	if err != nil {
+		log.Printf("Error saving annotation: %v", err)
+	}
+	if config().PowerFailure != nil {
+		go notify(config().PowerFailure.Notifiers, Alert{
+			RuleName:  "Power restored",
+			Condition: "outage",
+			Severity:  "warning",
+			Value:     o.Duration.Seconds(),
+			State:     "resolved",
+			Time:      o.End,
+		})
+	}
+}
+
+// outagesHandler serves GET /api/outages, the recorded outages, newest
+// first.
+func outagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rows, err := db.Query("SELECT id, started_at, ended_at, clean FROM outages WHERE ended_at IS NOT NULL ORDER BY started_at DESC LIMIT 100")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Outage{}
+	for rows.Next() {
+		var o Outage
+		var started, ended string
+		if err := rows.Scan(&o.ID, &started, &ended, &o.Clean); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		o.Start, _ = parseSQLiteTime(started)
+		o.End, _ = parseSQLiteTime(ended)
+		o.Duration = Duration{o.End.Sub(o.Start)}
+		list = append(list, o)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
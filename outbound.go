@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// outboundClient is shared by notifiers and forwarders for all calls to
+// external services.
+var outboundClient = &http.Client{Timeout: 10 * time.Second}
+
+const outboundAttempts = 3
+
+// sendRequest performs the request built by newReq, retrying network errors,
+// 429 and 5xx responses with exponential backoff. newReq is called once per
+// attempt so request bodies can be replayed.
+func sendRequest(newReq func() (*http.Request, error)) error {
+	backoff := time.Second
+	var lastErr error
+	for attempt := 1; attempt <= outboundAttempts; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return err
+		}
+		resp, err := outboundClient.Do(req)
+		if err == nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			lastErr = fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Host, resp.Status, bytes.TrimSpace(body))
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				return lastErr
+			}
+		} else {
+			lastErr = err
+		}
+		if attempt < outboundAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return lastErr
+}
+
+func postJSON(url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return sendRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	})
+}
+
+func postForm(target string, headers map[string]string, form url.Values) error {
+	body := form.Encode()
+	return sendRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// overrideMaxDuration bounds how long an override may last.
+const overrideMaxDuration = 7 * 24 * time.Hour
+
+// ZoneOverride holds a zone at Target until Until, over its setpoint,
+// vacation and away mode, after which the zone goes back to them.
+// Remaining is worked out when it is reported.
+type ZoneOverride struct {
+	Target    float64   `json:"target"`
+	Until     time.Time `json:"until"`
+	Remaining Duration  `json:"remaining"`
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// overrideRequest is the body of POST /api/zones/{zone}/override.
+type overrideRequest struct {
+	Target   float64  `json:"target"`
+	Duration Duration `json:"duration"`
+}
+
+func initOverrideTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS zone_overrides (
+		zone TEXT PRIMARY KEY,
+		target REAL NOT NULL,
+		until DATETIME NOT NULL,
+		actor TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadOverrides hands the stored overrides that have not expired to the
+// control loop.
+func (c *controlLoop) loadOverrides(now time.Time) error {
+	rows, err := db.Query("SELECT zone, target, until, actor, created_at FROM zone_overrides WHERE until > ?", sqliteTime(now))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var zone, until, createdAt string
+		var o ZoneOverride
+		if err := rows.Scan(&zone, &o.Target, &until, &o.Actor, &createdAt); err != nil {
+			return err
+		}
+		o.Until, _ = parseSQLiteTime(until)
+		o.CreatedAt, _ = parseSQLiteTime(createdAt)
+		c.setOverride(zone, &o)
+	}
+	return rows.Err()
+}
+
+// setOverride takes a zone's override, or with nil ends it.
+func (c *controlLoop) setOverride(zone string, o *ZoneOverride) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.byName[zone]; ok {
+		z.override = o
+	}
+}
+
+// currentOverride is a zone's override with its remaining time, nil
+// without one.
+func (z *zoneState) currentOverride(now time.Time) *ZoneOverride {
+	if z.override == nil {
+		return nil
+	}
+	o := *z.override
+	o.Remaining = Duration{o.Until.Sub(now).Round(time.Second)}
+	return &o
+}
+
+// expireOverride ends a zone's override once its time is up. It is called
+// by the control loop, so the row is deleted outside it.
+func (z *zoneState) expireOverride(now time.Time) {
+	if z.override == nil || now.Before(z.override.Until) {
+		return
+	}
+	log.Printf("Override of %s at %.1f°C expired", z.name, z.override.Target)
+	z.override = nil
+	go func(zone string) {
+		if _, err := db.Exec("DELETE FROM zone_overrides WHERE zone = ? AND until <= ?", zone, sqliteTime(now)); err != nil {
+			log.Printf("Error deleting override of %s: %v", zone, err)
+		}
+	}(z.name)
+}
+
+// overrideStep holds the zone at its override.
+func (z *zoneState) overrideStep(now time.Time) SetpointStep {
+	o := z.override
+	return SetpointStep{Layer: "override", Setpoint: o.Target,
+		Detail: fmt.Sprintf("set by %s until %s, %s left", o.Actor, o.Until.Local().Format("2006-01-02 15:04"), o.Until.Sub(now).Round(time.Minute))}
+}
+
+// zoneOverrideHandler serves GET, POST and DELETE
+// /api/zones/{zone}/override.
+func zoneOverrideHandler(w http.ResponseWriter, r *http.Request, z *zoneState) {
+	controller.mu.Lock()
+	old := z.currentOverride(clock.Now())
+	controller.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		if old == nil {
+			http.Error(w, "No override", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, old)
+	case http.MethodPost:
+		var req overrideRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateSetpoint(z.name, req.Target); err != nil {
+			http.Error(w, "target: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Duration.Duration < time.Minute || req.Duration.Duration > overrideMaxDuration {
+			http.Error(w, fmt.Sprintf("duration must be between 1m and %s", overrideMaxDuration), http.StatusBadRequest)
+			return
+		}
+		now := clock.Now().UTC().Truncate(time.Second)
+		o := &ZoneOverride{Target: req.Target, Until: now.Add(req.Duration.Duration), Actor: requestActor(r), CreatedAt: now}
+		_, err := db.Exec(`INSERT INTO zone_overrides (zone, target, until, actor, created_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(zone) DO UPDATE SET target = excluded.target, until = excluded.until, actor = excluded.actor, created_at = excluded.created_at`,
+			z.name, o.Target, sqliteTime(o.Until), o.Actor, sqliteTime(o.CreatedAt))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error saving override: %v", err), http.StatusInternalServerError)
+			return
+		}
+		controller.setOverride(z.name, o)
+		log.Printf("Override of %s set to %.1f°C for %s", z.name, o.Target, req.Duration.Duration)
+		o.Remaining = req.Duration
+		auditRequest(r, "override.set", z.name, old, o)
+		writeJSON(w, http.StatusOK, o)
+	case http.MethodDelete:
+		if old == nil {
+			http.Error(w, "No override", http.StatusNotFound)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM zone_overrides WHERE zone = ?", z.name); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting override: %v", err), http.StatusInternalServerError)
+			return
+		}
+		controller.setOverride(z.name, nil)
+		log.Printf("Override of %s cancelled", z.name)
+		auditRequest(r, "override.clear", z.name, old, nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// PIDConfig switches a zone by a PID controller instead of its hysteresis.
+// Its output, 0 to 100%, is the share of each Cycle (default 15m) the
+// heaters are on. Kp, Ki and Kd are per °C below target, Ki per hour and
+// Kd in hours; constants from an autotune of the zone replace them.
+type PIDConfig struct {
+	Kp    float64  `json:"kp,omitempty"`
+	Ki    float64  `json:"ki,omitempty"`
+	Kd    float64  `json:"kd,omitempty"`
+	Cycle Duration `json:"cycle,omitempty"`
+}
+
+func (c *PIDConfig) check() error {
+	if c.Cycle.Duration == 0 {
+		c.Cycle.Duration = 15 * time.Minute
+	}
+	if c.Cycle.Duration < 5*time.Minute || c.Cycle.Duration > time.Hour {
+		return fmt.Errorf("cycle must be between 5m and 1h")
+	}
+	if c.Kp < 0 || c.Ki < 0 || c.Kd < 0 {
+		return fmt.Errorf("kp, ki and kd must not be negative")
+	}
+	return nil
+}
+
+// PIDTuning is the set of constants an autotune derived for a zone, with
+// the ultimate gain and period of the oscillation they came from.
+type PIDTuning struct {
+	Kp      float64   `json:"kp"`
+	Ki      float64   `json:"ki"`
+	Kd      float64   `json:"kd"`
+	Ku      float64   `json:"ku"`
+	Tu      Duration  `json:"tu"`
+	TunedAt time.Time `json:"tunedAt"`
+}
+
+// pidState is a PID zone's memory between ticks. slope is the rate of
+// change, per hour, between the last two readings; duty is the output
+// fixed at the start of the current cycle.
+type pidState struct {
+	integral   float64
+	lastAt     time.Time
+	readTemp   float64
+	readAt     time.Time
+	slope      float64
+	cycleStart time.Time
+	duty       float64
+}
+
+func initTuningTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS zone_tunings (
+		zone TEXT PRIMARY KEY,
+		kp REAL NOT NULL,
+		ki REAL NOT NULL,
+		kd REAL NOT NULL,
+		ku REAL NOT NULL,
+		tu_seconds INTEGER NOT NULL,
+		tuned_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadTunings hands the stored autotune results to their zones.
+func (c *controlLoop) loadTunings() error {
+	rows, err := db.Query("SELECT zone, kp, ki, kd, ku, tu_seconds, tuned_at FROM zone_tunings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for rows.Next() {
+		var zone, tunedAt string
+		var tu int64
+		var t PIDTuning
+		if err := rows.Scan(&zone, &t.Kp, &t.Ki, &t.Kd, &t.Ku, &tu, &tunedAt); err != nil {
+			return err
+		}
+		t.Tu = Duration{time.Duration(tu) * time.Second}
+		t.TunedAt, _ = parseSQLiteTime(tunedAt)
+		if z, ok := c.byName[zone]; ok {
+			z.tuning = &t
+		}
+	}
+	return rows.Err()
+}
+
+// saveTuning stores a zone's autotune result, replacing the previous one.
+func saveTuning(zone string, t PIDTuning) error {
+	_, err := db.Exec(`INSERT INTO zone_tunings (zone, kp, ki, kd, ku, tu_seconds, tuned_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(zone) DO UPDATE SET kp = excluded.kp, ki = excluded.ki, kd = excluded.kd, ku = excluded.ku,
+		tu_seconds = excluded.tu_seconds, tuned_at = excluded.tuned_at`,
+		zone, t.Kp, t.Ki, t.Kd, t.Ku, int64(t.Tu.Duration/time.Second), sqliteTime(t.TunedAt))
+	return err
+}
+
+// gains are the PID constants a zone runs with, from its autotune or its
+// config; ok is false for a zone without pid or with neither.
+func (z *zoneState) gains() (kp, ki, kd float64, ok bool) {
+	if z.cfg.PID == nil {
+		return 0, 0, 0, false
+	}
+	if t := z.tuning; t != nil {
+		return t.Kp, t.Ki, t.Kd, true
+	}
+	p := z.cfg.PID
+	return p.Kp, p.Ki, p.Kd, p.Kp != 0 || p.Ki != 0 || p.Kd != 0
+}
+
+// pidStep runs a zone's PID controller on its latest reading and decides
+// whether its heaters are on at this point of the cycle. The integral is
+// kept between 0 and 100% output and the derivative is taken on the
+// temperature, so a change of target does not kick the output.
+func (z *zoneState) pidStep(now time.Time, kp, ki, kd float64) (bool, string, string) {
+	p := &z.pid
+	e := z.target - z.temp
+	if !p.lastAt.IsZero() {
+		p.integral = math.Max(0, math.Min(1, p.integral+ki*e*now.Sub(p.lastAt).Hours()))
+	}
+	p.lastAt = now
+	if z.tempAt.After(p.readAt) {
+		if !p.readAt.IsZero() {
+			p.slope = (z.temp - p.readTemp) / z.tempAt.Sub(p.readAt).Hours()
+		}
+		p.readTemp, p.readAt = z.temp, z.tempAt
+	}
+	d := -kd * p.slope
+	out := math.Max(0, math.Min(1, kp*e+p.integral+d))
+	cycle := z.cfg.PID.Cycle.Duration
+	if p.cycleStart.IsZero() || now.Sub(p.cycleStart) >= cycle {
+		p.cycleStart, p.duty = now, out
+	}
+	on := now.Sub(p.cycleStart) < time.Duration(p.duty*float64(cycle))
+	reason := fmt.Sprintf("PID output %.0f%%", p.duty*100)
+	why := fmt.Sprintf("%s°C against setpoint %.1f°C (error %+.2f°C): P %.2f + I %.2f + D %.2f gives %.0f%%; heating for %.0f%% of each %s cycle",
+		formatReading(z.cfg.Sensor, z.temp), z.target, e, kp*e, p.integral, d, out*100, p.duty*100, cycle)
+	return on, reason, why
+}
+
+// setTuning takes a finished autotune's constants, which the zone runs
+// with from now on if it has pid, and stores them outside the control
+// loop.
+func (z *zoneState) setTuning(t PIDTuning) {
+	z.tuning, z.pid = &t, pidState{}
+	log.Printf("Autotune of %s: kp %.3f, ki %.3f, kd %.3f (ku %.3f, tu %s)", z.name, t.Kp, t.Ki, t.Kd, t.Ku, t.Tu)
+	go func(zone string) {
+		if err := saveTuning(zone, t); err != nil {
+			log.Printf("Error saving autotune of %s: %v", zone, err)
+		}
+	}(z.name)
+}
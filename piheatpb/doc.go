@@ -0,0 +1,6 @@
+// Package piheatpb holds the gRPC service definition of piheat and the code
+// generated from it. Other Go services can import it, or generate their own
+// client from piheat.proto.
+package piheatpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative piheat.proto
@@ -0,0 +1,258 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: piheat.proto
+
+package piheatpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Piheat_GetCurrent_FullMethodName     = "/piheat.v1.Piheat/GetCurrent"
+	Piheat_StreamReadings_FullMethodName = "/piheat.v1.Piheat/StreamReadings"
+	Piheat_QueryRange_FullMethodName     = "/piheat.v1.Piheat/QueryRange"
+	Piheat_SetSetpoint_FullMethodName    = "/piheat.v1.Piheat/SetSetpoint"
+)
+
+// PiheatClient is the client API for Piheat service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PiheatClient interface {
+	// GetCurrent returns the latest reading and state of each sensor.
+	GetCurrent(ctx context.Context, in *GetCurrentRequest, opts ...grpc.CallOption) (*GetCurrentResponse, error)
+	// StreamReadings sends every reading as it is recorded, until the client
+	// cancels.
+	StreamReadings(ctx context.Context, in *StreamReadingsRequest, opts ...grpc.CallOption) (Piheat_StreamReadingsClient, error)
+	// QueryRange pages through stored readings.
+	QueryRange(ctx context.Context, in *QueryRangeRequest, opts ...grpc.CallOption) (*QueryRangeResponse, error)
+	// SetSetpoint sets the target temperature of a zone.
+	SetSetpoint(ctx context.Context, in *SetSetpointRequest, opts ...grpc.CallOption) (*Setpoint, error)
+}
+
+type piheatClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPiheatClient(cc grpc.ClientConnInterface) PiheatClient {
+	return &piheatClient{cc}
+}
+
+func (c *piheatClient) GetCurrent(ctx context.Context, in *GetCurrentRequest, opts ...grpc.CallOption) (*GetCurrentResponse, error) {
+	out := new(GetCurrentResponse)
+	err := c.cc.Invoke(ctx, Piheat_GetCurrent_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *piheatClient) StreamReadings(ctx context.Context, in *StreamReadingsRequest, opts ...grpc.CallOption) (Piheat_StreamReadingsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Piheat_ServiceDesc.Streams[0], Piheat_StreamReadings_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &piheatStreamReadingsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Piheat_StreamReadingsClient interface {
+	Recv() (*Reading, error)
+	grpc.ClientStream
+}
+
+type piheatStreamReadingsClient struct {
+	grpc.ClientStream
+}
+
+func (x *piheatStreamReadingsClient) Recv() (*Reading, error) {
+	m := new(Reading)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *piheatClient) QueryRange(ctx context.Context, in *QueryRangeRequest, opts ...grpc.CallOption) (*QueryRangeResponse, error) {
+	out := new(QueryRangeResponse)
+	err := c.cc.Invoke(ctx, Piheat_QueryRange_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *piheatClient) SetSetpoint(ctx context.Context, in *SetSetpointRequest, opts ...grpc.CallOption) (*Setpoint, error) {
+	out := new(Setpoint)
+	err := c.cc.Invoke(ctx, Piheat_SetSetpoint_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PiheatServer is the server API for Piheat service.
+// All implementations must embed UnimplementedPiheatServer
+// for forward compatibility
+type PiheatServer interface {
+	// GetCurrent returns the latest reading and state of each sensor.
+	GetCurrent(context.Context, *GetCurrentRequest) (*GetCurrentResponse, error)
+	// StreamReadings sends every reading as it is recorded, until the client
+	// cancels.
+	StreamReadings(*StreamReadingsRequest, Piheat_StreamReadingsServer) error
+	// QueryRange pages through stored readings.
+	QueryRange(context.Context, *QueryRangeRequest) (*QueryRangeResponse, error)
+	// SetSetpoint sets the target temperature of a zone.
+	SetSetpoint(context.Context, *SetSetpointRequest) (*Setpoint, error)
+	mustEmbedUnimplementedPiheatServer()
+}
+
+// UnimplementedPiheatServer must be embedded to have forward compatible implementations.
+type UnimplementedPiheatServer struct {
+}
+
+func (UnimplementedPiheatServer) GetCurrent(context.Context, *GetCurrentRequest) (*GetCurrentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCurrent not implemented")
+}
+func (UnimplementedPiheatServer) StreamReadings(*StreamReadingsRequest, Piheat_StreamReadingsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamReadings not implemented")
+}
+func (UnimplementedPiheatServer) QueryRange(context.Context, *QueryRangeRequest) (*QueryRangeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryRange not implemented")
+}
+func (UnimplementedPiheatServer) SetSetpoint(context.Context, *SetSetpointRequest) (*Setpoint, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSetpoint not implemented")
+}
+func (UnimplementedPiheatServer) mustEmbedUnimplementedPiheatServer() {}
+
+// UnsafePiheatServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PiheatServer will
+// result in compilation errors.
+type UnsafePiheatServer interface {
+	mustEmbedUnimplementedPiheatServer()
+}
+
+func RegisterPiheatServer(s grpc.ServiceRegistrar, srv PiheatServer) {
+	s.RegisterService(&Piheat_ServiceDesc, srv)
+}
+
+func _Piheat_GetCurrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCurrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PiheatServer).GetCurrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Piheat_GetCurrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PiheatServer).GetCurrent(ctx, req.(*GetCurrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Piheat_StreamReadings_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamReadingsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PiheatServer).StreamReadings(m, &piheatStreamReadingsServer{stream})
+}
+
+type Piheat_StreamReadingsServer interface {
+	Send(*Reading) error
+	grpc.ServerStream
+}
+
+type piheatStreamReadingsServer struct {
+	grpc.ServerStream
+}
+
+func (x *piheatStreamReadingsServer) Send(m *Reading) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Piheat_QueryRange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PiheatServer).QueryRange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Piheat_QueryRange_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PiheatServer).QueryRange(ctx, req.(*QueryRangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Piheat_SetSetpoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetSetpointRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PiheatServer).SetSetpoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Piheat_SetSetpoint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PiheatServer).SetSetpoint(ctx, req.(*SetSetpointRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Piheat_ServiceDesc is the grpc.ServiceDesc for Piheat service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Piheat_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "piheat.v1.Piheat",
+	HandlerType: (*PiheatServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCurrent",
+			Handler:    _Piheat_GetCurrent_Handler,
+		},
+		{
+			MethodName: "QueryRange",
+			Handler:    _Piheat_QueryRange_Handler,
+		},
+		{
+			MethodName: "SetSetpoint",
+			Handler:    _Piheat_SetSetpoint_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamReadings",
+			Handler:       _Piheat_StreamReadings_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "piheat.proto",
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrecisionConfig sets how a sensor's temperatures are shown: rounded to
+// Decimals places, or to multiples of Step such as 0.5. Mode is "nearest"
+// (default), "down" or "up".
+type PrecisionConfig struct {
+	Decimals *int    `json:"decimals,omitempty"`
+	Step     float64 `json:"step,omitempty"`
+	Mode     string  `json:"mode,omitempty"`
+}
+
+func (p PrecisionConfig) check() error {
+	if p.Decimals != nil && p.Step != 0 {
+		return fmt.Errorf("set either decimals or step")
+	}
+	if p.Decimals != nil && (*p.Decimals < 0 || *p.Decimals > 6) {
+		return fmt.Errorf("decimals must be between 0 and 6")
+	}
+	if p.Step < 0 {
+		return fmt.Errorf("step must be positive")
+	}
+	switch p.Mode {
+	case "", "nearest", "down", "up":
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	return nil
+}
+
+func checkPrecision(configs map[string]PrecisionConfig) error {
+	for pattern, p := range configs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("precision: invalid sensor pattern %q", pattern)
+		}
+		if err := p.check(); err != nil {
+			return fmt.Errorf("precision %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// precisionFor returns the precision of sensor: an entry with its exact
+// name, else the first matching glob in sorted order. Sensors without one
+// are shown with one decimal but returned by the API as stored.
+func precisionFor(sensor string) (PrecisionConfig, bool) {
+	if p, ok := config().Precision[sensor]; ok {
+		return p, true
+	}
+	patterns := make([]string, 0, len(config().Precision))
+	for pattern := range config().Precision {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, sensor); ok {
+			return config().Precision[pattern], true
+		}
+	}
+	return PrecisionConfig{}, false
+}
+
+// step is the unit values are rounded to.
+func (p PrecisionConfig) step() float64 {
+	if p.Step > 0 {
+		return p.Step
+	}
+	return math.Pow10(-p.decimals())
+}
+
+// decimals is how many places a rounded value needs: the configured
+// number, those of the step, or one.
+func (p PrecisionConfig) decimals() int {
+	if p.Decimals != nil {
+		return *p.Decimals
+	}
+	if p.Step > 0 {
+		s := strconv.FormatFloat(p.Step, 'f', -1, 64)
+		if i := strings.IndexByte(s, '.'); i >= 0 {
+			return len(s) - i - 1
+		}
+		return 0
+	}
+	return 1
+}
+
+func (p PrecisionConfig) round(v float64) float64 {
+	step := p.step()
+	// Dividing by a power of ten leaves values such as 20.449999 that
+	// floor or ceil would push to the wrong side, so snap them first
+	q := math.Round(v/step*1e6) / 1e6
+	switch p.Mode {
+	case "down":
+		q = math.Floor(q)
+	case "up":
+		q = math.Ceil(q)
+	default:
+		q = math.Round(q)
+	}
+	// Rounding to the decimals drops the float noise of the multiplication
+	r, _ := strconv.ParseFloat(strconv.FormatFloat(q*step, 'f', p.decimals(), 64), 64)
+	return r
+}
+
+// roundReading rounds a value of sensor for API responses. Sensors without
+// a precision entry keep the stored value.
+func roundReading(sensor string, v float64) float64 {
+	p, ok := precisionFor(sensor)
+	if !ok {
+		return v
+	}
+	return p.round(v)
+}
+
+// formatReading formats a value of sensor for display, without unit.
+func formatReading(sensor string, v float64) string {
+	p, _ := precisionFor(sensor)
+	return strconv.FormatFloat(p.round(v), 'f', p.decimals(), 64)
+}
+
+// readingDecimals is how many decimals the dashboard shows for sensor.
+func readingDecimals(sensor string) int {
+	p, _ := precisionFor(sensor)
+	return p.decimals()
+}
+
+// roundChartData rounds the points of a sensor's chart in place.
+func roundChartData(sensor string, points []ChartDataPoint) {
+	for i := range points {
+		points[i].Temperature = roundReading(sensor, points[i].Temperature)
+		if s := points[i].Smoothed; s != nil {
+			*s = roundReading(sensor, *s)
+		}
+	}
+}
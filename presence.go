@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	presenceHome = "home"
+	presenceAway = "away"
+	// presenceProbePort is the TCP port a device is knocked on. iPhones
+	// listen on it; other devices refusing the connection, or only
+	// answering ARP, count as present all the same.
+	presenceProbePort = "62078"
+	// presenceProbeTimeout bounds one knock.
+	presenceProbeTimeout = 2 * time.Second
+	// presenceHistory is how many mode changes /api/presence reports.
+	presenceHistory = 20
+	// arpTable is the kernel's table of neighbours on the local network.
+	arpTable = "/proc/net/arp"
+)
+
+// PresenceConfig holds the zones at a lower setpoint while nobody is home:
+// Setback (default 16°C), or the zone's own in Zones. The mode is set with
+// PUT /api/presence, or follows Devices, phones given by IP or MAC address,
+// which are looked for on the network every Interval (default 1m), and
+// People, whose phones report entering and leaving home. The house is away
+// once no device has been seen for AwayAfter (default 15m) and the people
+// have left by the AwayWhen rule.
+type PresenceConfig struct {
+	Setback   float64                 `json:"setback,omitempty"`
+	Zones     map[string]float64      `json:"zones,omitempty"`
+	Devices   []string                `json:"devices,omitempty"`
+	Interval  Duration                `json:"interval"`
+	AwayAfter Duration                `json:"away_after"`
+	People    map[string]PersonConfig `json:"people,omitempty"`
+	AwayWhen  string                  `json:"away_when,omitempty"`
+}
+
+func (c *PresenceConfig) check() error {
+	if c.Setback == 0 {
+		c.Setback = 16
+	}
+	if err := validateSetpoint("setback", c.Setback); err != nil {
+		return fmt.Errorf("setback: %v", err)
+	}
+	for zone, t := range c.Zones {
+		if err := validateSetpoint(zone, t); err != nil {
+			return fmt.Errorf("zone %q: %v", zone, err)
+		}
+	}
+	for _, d := range c.Devices {
+		if net.ParseIP(d) == nil {
+			if _, err := net.ParseMAC(d); err != nil {
+				return fmt.Errorf("device %q is neither an IP nor a MAC address", d)
+			}
+		}
+	}
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = time.Minute
+	}
+	if c.Interval.Duration < 10*time.Second {
+		return fmt.Errorf("interval must be at least 10s")
+	}
+	if c.AwayAfter.Duration == 0 {
+		c.AwayAfter.Duration = 15 * time.Minute
+	}
+	if c.AwayAfter.Duration < c.Interval.Duration {
+		return fmt.Errorf("away_after must not be shorter than interval")
+	}
+	for name, pc := range c.People {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("people: %q: name must be non-empty and without '/'", name)
+		}
+		if pc.Token == "" {
+			return fmt.Errorf("people: %q: token is required", name)
+		}
+	}
+	switch c.AwayWhen {
+	case "":
+		c.AwayWhen = awayLastLeaves
+	case awayLastLeaves, awayFirstLeaves:
+	default:
+		return fmt.Errorf("away_when must be last_leaves or first_leaves")
+	}
+	return nil
+}
+
+// DeviceSeen is a presence device and when it was last on the network.
+type DeviceSeen struct {
+	Device   string     `json:"device"`
+	Present  bool       `json:"present"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceChange is one switch between home and away.
+type PresenceChange struct {
+	Mode   string    `json:"mode"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// PresenceStatus is the GET /api/presence response. Mode is the one in
+// effect: Override when one is set, otherwise Detected.
+type PresenceStatus struct {
+	Mode     string           `json:"mode"`
+	Detected string           `json:"detected"`
+	Override string           `json:"override,omitempty"`
+	Since    time.Time        `json:"since"`
+	Reason   string           `json:"reason"`
+	Setback  float64          `json:"setback"`
+	Devices  []DeviceSeen     `json:"devices"`
+	People   []PersonPresence `json:"people"`
+	Changes  []PresenceChange `json:"changes"`
+}
+
+type presenceState struct {
+	mu       sync.Mutex
+	cfg      PresenceConfig
+	detected string
+	override string
+	mode     string
+	since    time.Time
+	reason   string
+	// seen is when each device was last found; devices start out as seen
+	// at start, so a restart does not send the house away.
+	seen map[string]time.Time
+	// people is the last event of each person heard from.
+	people map[string]personState
+}
+
+// presence is nil unless presence is configured, and the zones are then
+// always at their setpoint.
+var presence *presenceState
+
+func initPresenceTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS presence (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		detected TEXT NOT NULL,
+		override TEXT NOT NULL DEFAULT '',
+		mode TEXT NOT NULL,
+		since DATETIME NOT NULL,
+		reason TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS presence_changes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mode TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		timestamp DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS presence_people (
+		person TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		since DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setupPresence takes the presence section of the config and the mode
+// stored at the last change, so a restart keeps it.
+func setupPresence(c *PresenceConfig) error {
+	if c == nil {
+		return nil
+	}
+	for zone := range c.Zones {
+		if _, ok := config().Zones[zone]; !ok {
+			return fmt.Errorf("presence: unknown zone %q", zone)
+		}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	p := &presenceState{cfg: *c, detected: presenceHome, mode: presenceHome, since: now,
+		reason: "nobody has been away yet", seen: map[string]time.Time{}, people: map[string]personState{}}
+	for _, d := range c.Devices {
+		p.seen[d] = now
+	}
+	if err := p.loadPeople(); err != nil {
+		return err
+	}
+	var since string
+	err := db.QueryRow("SELECT detected, override, mode, since, reason FROM presence WHERE id = 1").
+		Scan(&p.detected, &p.override, &p.mode, &since, &p.reason)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		p.since, _ = parseSQLiteTime(since)
+	}
+	presence = p
+	return nil
+}
+
+func (p *presenceState) save() error {
+	_, err := db.Exec(`INSERT INTO presence (id, detected, override, mode, since, reason) VALUES (1, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET detected = excluded.detected, override = excluded.override, mode = excluded.mode,
+		since = excluded.since, reason = excluded.reason`, p.detected, p.override, p.mode, sqliteTime(p.since), p.reason)
+	return err
+}
+
+// away reports whether nobody is home, since when and why.
+func (p *presenceState) away() (bool, time.Time, string) {
+	if p == nil {
+		return false, time.Time{}, ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mode == presenceAway, p.since, p.reason
+}
+
+// setback is the setpoint a zone is held at while nobody is home.
+func (p *presenceState) setback(zone string) float64 {
+	if t, ok := p.cfg.Zones[zone]; ok {
+		return t
+	}
+	return p.cfg.Setback
+}
+
+// awayStep lowers a zone's setpoint to its setback while nobody is home.
+// A setpoint already below it stands.
+func (z *zoneState) awayStep(setpoint float64, since time.Time, reason string) SetpointStep {
+	t := presence.setback(z.name)
+	detail := fmt.Sprintf("away since %s (%s): setback %.1f°C", since.Local().Format("2006-01-02 15:04"), reason, t)
+	if setpoint <= t {
+		return SetpointStep{Layer: "away", Setpoint: setpoint, Detail: detail + ", already below"}
+	}
+	return SetpointStep{Layer: "away", Setpoint: t, Detail: detail}
+}
+
+func (p *presenceState) status() (PresenceStatus, error) {
+	p.mu.Lock()
+	s := PresenceStatus{Mode: p.mode, Detected: p.detected, Override: p.override, Since: p.since, Reason: p.reason,
+		Setback: p.cfg.Setback, Devices: []DeviceSeen{}, Changes: []PresenceChange{}}
+	now := clock.Now()
+	for _, d := range p.cfg.Devices {
+		ds := DeviceSeen{Device: d, Present: now.Sub(p.seen[d]) < p.cfg.AwayAfter.Duration}
+		if t := p.seen[d]; !t.IsZero() {
+			ds.LastSeen = &t
+		}
+		s.Devices = append(s.Devices, ds)
+	}
+	s.People = p.peopleStatus()
+	p.mu.Unlock()
+
+	rows, err := db.Query("SELECT mode, reason, timestamp FROM presence_changes ORDER BY timestamp DESC, id DESC LIMIT ?", presenceHistory)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c PresenceChange
+		var at string
+		if err := rows.Scan(&c.Mode, &c.Reason, &at); err != nil {
+			return s, err
+		}
+		c.Time, _ = parseSQLiteTime(at)
+		s.Changes = append(s.Changes, c)
+	}
+	return s, rows.Err()
+}
+
+// start looks for the devices every interval. Without devices the mode
+// only changes through the API.
+func (p *presenceState) start() {
+	if len(p.cfg.Devices) == 0 {
+		return
+	}
+	log.Printf("Looking for %d presence devices every %s", len(p.cfg.Devices), p.cfg.Interval.Duration)
+	go func() {
+		ticker := clock.NewTicker(p.cfg.Interval.Duration)
+		defer ticker.Stop()
+		for now := range ticker.C() {
+			p.check(now)
+		}
+	}()
+}
+
+// check looks for every device and switches to the mode they call for.
+func (p *presenceState) check(now time.Time) {
+	found := make([]bool, len(p.cfg.Devices))
+	var wg sync.WaitGroup
+	for i, d := range p.cfg.Devices {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			found[i] = deviceOnNetwork(d)
+		}(i, d)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, d := range p.cfg.Devices {
+		if found[i] {
+			p.seen[d] = now
+		}
+	}
+	p.update(now)
+}
+
+// update switches to the mode the devices and people call for, unless one
+// is set by hand. It is called with p.mu held.
+func (p *presenceState) update(now time.Time) {
+	detected, reason := p.detect(now)
+	changed := detected != p.detected
+	p.detected = detected
+	if p.override == "" && detected != p.mode {
+		p.enter(detected, reason, now)
+		return
+	}
+	if changed {
+		if err := p.save(); err != nil {
+			log.Printf("Error saving the presence mode: %v", err)
+		}
+	}
+}
+
+// detect works out whether anybody is home: the house is home while any
+// device has been seen within away_after, or while the people say so.
+// With away_when last_leaves the people keep it home until the last one
+// leaves, with first_leaves only while none has left. People not heard
+// from yet count as home.
+func (p *presenceState) detect(now time.Time) (string, string) {
+	var home, away []string
+	for _, d := range p.cfg.Devices {
+		if now.Sub(p.seen[d]) < p.cfg.AwayAfter.Duration {
+			home = append(home, d+" on the network")
+		}
+	}
+	devicesHome := len(home) > 0
+	var left []string
+	for _, name := range p.names() {
+		if p.people[name].state == presenceAway {
+			left = append(left, name)
+		} else {
+			home = append(home, name+" at home")
+		}
+	}
+	if len(p.cfg.People) > 0 && p.cfg.AwayWhen == awayFirstLeaves && len(left) > 0 && !devicesHome {
+		return presenceAway, strings.Join(left, ", ") + " left"
+	}
+	if len(home) > 0 {
+		return presenceHome, strings.Join(home, ", ")
+	}
+	if len(p.cfg.Devices) > 0 {
+		away = append(away, fmt.Sprintf("no device seen for %s", p.cfg.AwayAfter.Duration))
+	}
+	if len(p.cfg.People) > 0 {
+		away = append(away, "everyone left")
+	}
+	if len(away) == 0 {
+		return presenceHome, "no devices or people to go by"
+	}
+	return presenceAway, strings.Join(away, ", ")
+}
+
+// enter switches to a mode and logs it. It is called with p.mu held.
+func (p *presenceState) enter(mode, reason string, now time.Time) {
+	p.mode, p.since, p.reason = mode, now.UTC().Truncate(time.Second), reason
+	if err := p.save(); err != nil {
+		log.Printf("Error saving the presence mode: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO presence_changes (mode, reason, timestamp) VALUES (?, ?, ?)", mode, reason, sqliteTime(p.since)); err != nil {
+		log.Printf("Error saving the presence mode: %v", err)
+	}
+	log.Printf("Presence: %s (%s)", mode, reason)
+}
+
+// setOverride fixes the mode, or with "" hands it back to the devices and
+// people.
+func (p *presenceState) setOverride(mode string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.override = mode
+	want, reason := p.detected, "set back to automatic"
+	if mode != "" {
+		want, reason = mode, "set by hand"
+	}
+	if want != p.mode {
+		p.enter(want, reason, now)
+		return
+	}
+	if err := p.save(); err != nil {
+		log.Printf("Error saving the presence mode: %v", err)
+	}
+}
+
+// deviceOnNetwork knocks on a device and reports whether it answered. A
+// phone asleep may ignore the knock but still answer the ARP request
+// sent for it, which leaves it in the kernel's neighbour table. A MAC
+// address is knocked on at the IP the table last had for it.
+func deviceOnNetwork(device string) bool {
+	ip := device
+	if net.ParseIP(device) == nil {
+		mac, _ := net.ParseMAC(device)
+		if ip = arpAddress(mac.String()); ip == "" {
+			return false
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, presenceProbePort), presenceProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	return arpComplete(ip)
+}
+
+// arpEntries reads the neighbour table as IP, flags and MAC address.
+func arpEntries() [][3]string {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var entries [][3]string
+	sc := bufio.NewScanner(f)
+	sc.Scan() // the header
+	for sc.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 4 {
+			entries = append(entries, [3]string{fields[0], fields[2], strings.ToLower(fields[3])})
+		}
+	}
+	return entries
+}
+
+// arpAddress is the IP the neighbour table has for a MAC address.
+func arpAddress(mac string) string {
+	for _, e := range arpEntries() {
+		if e[2] == mac {
+			return e[0]
+		}
+	}
+	return ""
+}
+
+// arpComplete reports whether the neighbour table has a resolved entry
+// for ip.
+func arpComplete(ip string) bool {
+	for _, e := range arpEntries() {
+		if e[0] == ip && e[1] != "0x0" {
+			return true
+		}
+	}
+	return false
+}
+
+// presenceHandler serves GET and PUT /api/presence.
+func presenceHandler(w http.ResponseWriter, r *http.Request) {
+	if presence == nil {
+		http.Error(w, "No presence configured", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s, err := presence.status()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case http.MethodPut:
+		var req struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		mode := strings.ToLower(req.Mode)
+		if mode == "auto" {
+			mode = ""
+		}
+		if mode != "" && mode != presenceHome && mode != presenceAway {
+			http.Error(w, "mode must be home, away or auto", http.StatusBadRequest)
+			return
+		}
+		presence.mu.Lock()
+		old := presence.override
+		presence.mu.Unlock()
+		presence.setOverride(mode, clock.Now())
+		auditRequest(r, "presence.set", "", old, mode)
+		s, err := presence.status()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writePresenceMetrics(b *strings.Builder) {
+	if presence == nil {
+		return
+	}
+	away, _, _ := presence.away()
+	v := 0
+	if away {
+		v = 1
+	}
+	b.WriteString("# HELP piheat_presence_away Whether the zones are set back because nobody is home.\n")
+	b.WriteString("# TYPE piheat_presence_away gauge\n")
+	fmt.Fprintf(b, "piheat_presence_away %d\n", v)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// iioDevices is where the kernel's industrial I/O drivers, such as
+	// ads1015 for the ADS1015 and ADS1115, publish their ADC channels.
+	iioDevices = "/sys/bus/iio/devices"
+	// psiPerBar converts bar to psi.
+	psiPerBar = 14.5038
+	// pressureLeakCheck is how often the pressure sensors are checked for
+	// a slow decline.
+	pressureLeakCheck = time.Hour
+)
+
+// PressureConfig is an analog pressure transducer on an ADC channel,
+// recorded as a sensor in Unit, bar (default) or psi. The transducer puts
+// out MinVolts (default 0.5) at no pressure and MaxVolts (default 4.5) at
+// Range; Divider is the ratio of a voltage divider in front of the ADC
+// (default 1). Low and High raise alerts, and hold Boiler off, outside the
+// safe pressure; a minimum over LeakWindow (default 24h) at least LeakDrop
+// (default 0.2 bar) below the one of the window before is a leak.
+type PressureConfig struct {
+	Device     string   `json:"device"`
+	Channel    int      `json:"channel"`
+	Unit       string   `json:"unit,omitempty"`
+	MinVolts   float64  `json:"min_volts,omitempty"`
+	MaxVolts   float64  `json:"max_volts,omitempty"`
+	Range      float64  `json:"range"`
+	Divider    float64  `json:"divider,omitempty"`
+	Interval   Duration `json:"interval"`
+	Low        float64  `json:"low,omitempty"`
+	High       float64  `json:"high,omitempty"`
+	LeakDrop   float64  `json:"leak_drop,omitempty"`
+	LeakWindow Duration `json:"leak_window"`
+	Boiler     string   `json:"boiler,omitempty"`
+	Notifiers  []string `json:"notifiers,omitempty"`
+}
+
+func (c *PressureConfig) check() error {
+	if c.Device == "" {
+		c.Device = "iio:device0"
+	}
+	if c.Channel < 0 {
+		return fmt.Errorf("channel must not be negative")
+	}
+	switch c.Unit {
+	case "":
+		c.Unit = "bar"
+	case "bar", "psi":
+	default:
+		return fmt.Errorf("unit must be bar or psi")
+	}
+	if c.MinVolts == 0 && c.MaxVolts == 0 {
+		c.MinVolts, c.MaxVolts = 0.5, 4.5
+	}
+	if c.MinVolts < 0 || c.MaxVolts <= c.MinVolts {
+		return fmt.Errorf("max_volts must be above min_volts")
+	}
+	if c.Range <= 0 {
+		return fmt.Errorf("range, the pressure at max_volts, is required")
+	}
+	if c.Divider == 0 {
+		c.Divider = 1
+	}
+	if c.Divider < 1 {
+		return fmt.Errorf("divider must be at least 1")
+	}
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = 30 * time.Second
+	}
+	if c.Interval.Duration < time.Second {
+		return fmt.Errorf("interval must be at least 1s")
+	}
+	if c.Low < 0 || c.High < 0 || c.High > 0 && c.High <= c.Low {
+		return fmt.Errorf("high must be above low")
+	}
+	if c.LeakDrop == 0 {
+		c.LeakDrop = c.fromBar(0.2)
+	}
+	if c.LeakDrop < 0 {
+		return fmt.Errorf("leak_drop must be positive")
+	}
+	if c.LeakWindow.Duration == 0 {
+		c.LeakWindow.Duration = 24 * time.Hour
+	}
+	if c.LeakWindow.Duration < time.Hour {
+		return fmt.Errorf("leak_window must be at least 1h")
+	}
+	return nil
+}
+
+// fromBar converts a pressure in bar to the unit of the sensor.
+func (c *PressureConfig) fromBar(v float64) float64 {
+	if c.Unit == "psi" {
+		return math.Round(v*psiPerBar*10) / 10
+	}
+	return v
+}
+
+// channelPath is the sysfs file of the channel's raw value; the scale
+// turning it into millivolts sits next to it.
+func (c *PressureConfig) channelPath() string {
+	dir := c.Device
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(iioDevices, dir)
+	}
+	return filepath.Join(dir, fmt.Sprintf("in_voltage%d_raw", c.Channel))
+}
+
+// readVolts reads the voltage at the transducer, before the divider.
+func (c *PressureConfig) readVolts() (float64, error) {
+	path := c.channelPath()
+	raw, err := readSysfsFloat(path)
+	if err != nil {
+		return 0, err
+	}
+	// Drivers publish the scale per channel or once for all of them
+	scale, err := readSysfsFloat(strings.TrimSuffix(path, "_raw") + "_scale")
+	if err != nil {
+		if scale, err = readSysfsFloat(filepath.Join(filepath.Dir(path), "in_voltage_scale")); err != nil {
+			return 0, err
+		}
+	}
+	return raw * scale / 1000 * c.Divider, nil
+}
+
+func readSysfsFloat(path string) (float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+// pressure turns the transducer's voltage into pressure. A voltage well
+// below min_volts means no transducer is connected: a broken wire reads
+// 0 V, not 0 bar.
+func (c *PressureConfig) pressure(volts float64) (float64, error) {
+	if volts < c.MinVolts/2 {
+		return 0, fmt.Errorf("%.2f V is well below min_volts %.2f V; is the transducer connected?", volts, c.MinVolts)
+	}
+	p := (volts - c.MinVolts) / (c.MaxVolts - c.MinVolts) * c.Range
+	return math.Max(p, 0), nil
+}
+
+// pressureSensor is one transducer and its alerts: low or high pressure,
+// which also holds its boiler off, and a leak.
+type pressureSensor struct {
+	name string
+	cfg  PressureConfig
+
+	mu      sync.Mutex
+	value   float64
+	fault   string
+	faultID int64
+	leaking bool
+	leakID  int64
+}
+
+var pressures []*pressureSensor
+
+// setupPressures validates the pressure section of the config.
+func setupPressures(configs map[string]PressureConfig) error {
+	var list []*pressureSensor
+	for name, pc := range configs {
+		if pc.Boiler != "" {
+			if _, ok := config().Boilers[pc.Boiler]; !ok {
+				return fmt.Errorf("pressure %q: unknown boiler %q", name, pc.Boiler)
+			}
+		}
+		if err := checkNotifierNames(pc.Notifiers); err != nil {
+			return fmt.Errorf("pressure %q: %v", name, err)
+		}
+		list = append(list, &pressureSensor{name: name, cfg: pc})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	pressures = list
+	return nil
+}
+
+// pressureUnit is the unit of a pressure sensor, empty for other sensors.
+func pressureUnit(sensor string) string {
+	for _, p := range pressures {
+		if p.name == sensor {
+			return p.cfg.Unit
+		}
+	}
+	return ""
+}
+
+// boilerPressureFault is why a boiler must not fire for its pressure,
+// empty while every transducer on it is within low and high.
+func boilerPressureFault(boiler string) string {
+	for _, p := range pressures {
+		if p.cfg.Boiler != boiler {
+			continue
+		}
+		p.mu.Lock()
+		fault := p.fault
+		value := p.value
+		p.mu.Unlock()
+		switch fault {
+		case "low-pressure":
+			return fmt.Sprintf("low pressure on %s: %.2f %s (low %.2f %s)", p.name, value, p.cfg.Unit, p.cfg.Low, p.cfg.Unit)
+		case "high-pressure":
+			return fmt.Sprintf("high pressure on %s: %.2f %s (high %.2f %s)", p.name, value, p.cfg.Unit, p.cfg.High, p.cfg.Unit)
+		}
+	}
+	return ""
+}
+
+// startPressures reads each transducer every interval and checks them all
+// for leaks every hour.
+func startPressures() {
+	if len(pressures) == 0 {
+		return
+	}
+	for _, p := range pressures {
+		log.Printf("Reading pressure %s from %s every %s", p.name, p.cfg.channelPath(), p.cfg.Interval.Duration)
+		sensorsMonitor.expect(p.name, p.cfg.Interval.Duration)
+		go p.run()
+	}
+	go func() {
+		ticker := clock.NewTicker(pressureLeakCheck)
+		defer ticker.Stop()
+		for now := range ticker.C() {
+			for _, p := range pressures {
+				p.checkLeak(now)
+			}
+		}
+	}()
+}
+
+func (p *pressureSensor) run() {
+	ticker := clock.NewTicker(p.cfg.Interval.Duration)
+	defer ticker.Stop()
+	for {
+		volts, err := p.cfg.readVolts()
+		if err == nil {
+			var v float64
+			if v, err = p.cfg.pressure(volts); err == nil {
+				recordReading(p.name, v, sourcePressure)
+				p.observe(v, clock.Now())
+			}
+		}
+		if err != nil {
+			log.Printf("Error reading pressure %s: %v", p.name, err)
+		}
+		<-ticker.C()
+	}
+}
+
+// observe checks a reading against low and high. An alert resolves once
+// the pressure is back by 2% of the range, so noise around a limit does
+// not flap it.
+func (p *pressureSensor) observe(v float64, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.value = v
+	margin := p.cfg.Range * 0.02
+	fault := p.fault
+	switch {
+	case p.cfg.Low > 0 && v < p.cfg.Low:
+		fault = "low-pressure"
+	case p.cfg.High > 0 && v > p.cfg.High:
+		fault = "high-pressure"
+	case fault == "low-pressure" && v >= p.cfg.Low+margin,
+		fault == "high-pressure" && v <= p.cfg.High-margin:
+		fault = ""
+	}
+	if fault == p.fault {
+		return
+	}
+	if p.fault != "" {
+		p.alert("resolved", p.fault, p.limit(p.fault), p.faultID, v, now)
+		p.faultID = 0
+	}
+	if fault != "" {
+		p.faultID = p.alert("firing", fault, p.limit(fault), 0, v, now)
+	}
+	p.fault = fault
+}
+
+func (p *pressureSensor) limit(fault string) float64 {
+	if fault == "high-pressure" {
+		return p.cfg.High
+	}
+	return p.cfg.Low
+}
+
+// checkLeak compares the lowest pressure of the last leak window with the
+// lowest of the window before. Comparing minimums leaves out the rise and
+// fall of the pressure as the water heats and cools.
+func (p *pressureSensor) checkLeak(now time.Time) {
+	w := p.cfg.LeakWindow.Duration
+	var recent, before *float64
+	err := db.QueryRow(`SELECT
+		(SELECT MIN(temperature) FROM temperature_readings WHERE sensor = ? AND timestamp >= ? AND timestamp < ?),
+		(SELECT MIN(temperature) FROM temperature_readings WHERE sensor = ? AND timestamp >= ? AND timestamp < ?)`,
+		p.name, sqliteTime(now.Add(-w)), sqliteTime(now), p.name, sqliteTime(now.Add(-2*w)), sqliteTime(now.Add(-w))).Scan(&recent, &before)
+	if err != nil {
+		log.Printf("Error checking pressure %s for leaks: %v", p.name, err)
+		return
+	}
+	if recent == nil || before == nil {
+		return
+	}
+	drop := *before - *recent
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case drop >= p.cfg.LeakDrop && !p.leaking:
+		log.Printf("Pressure %s: lowest %.2f %s over %s, down %.2f %s from the %s before", p.name, *recent, p.cfg.Unit, w, drop, p.cfg.Unit, w)
+		p.leaking = true
+		p.leakID = p.alert("firing", "pressure-leak", p.cfg.LeakDrop, 0, drop, now)
+	case drop < p.cfg.LeakDrop/2 && p.leaking:
+		p.alert("resolved", "pressure-leak", p.cfg.LeakDrop, p.leakID, drop, now)
+		p.leaking, p.leakID = false, 0
+	}
+}
+
+// alert records a pressure alert in the alert history and notifies; for
+// a leak the value is the drop. It returns the alert's ID when firing.
+func (p *pressureSensor) alert(state, condition string, threshold float64, id int64, value float64, now time.Time) int64 {
+	a := Alert{
+		ID:        id,
+		RuleName:  "Pressure",
+		Sensor:    p.name,
+		Condition: condition,
+		Threshold: threshold,
+		Severity:  "critical",
+		Value:     value,
+		State:     state,
+		Time:      now,
+	}
+	if condition == "pressure-leak" {
+		a.RuleName, a.Severity = "Pressure leak", "warning"
+	}
+	if state == "firing" {
+		log.Printf("Pressure %s: %s", p.name, a.Summary())
+		newID, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		a.ID = newID
+	} else {
+		log.Printf("Pressure %s %s cleared", p.name, condition)
+		if err := resolveAlertEvent(id, value, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+	}
+	targets := p.cfg.Notifiers
+	if len(targets) == 0 {
+		targets = config().Staleness.Notifiers
+	}
+	notify(targets, a)
+	return a.ID
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Errors of the JSON API are RFC 7807 problem details. Handlers keep using
+// http.Error, which problemWriter turns into a problem with a code derived
+// from the status; apiError sets a more specific code.
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem detail, extended with a machine-readable
+// code and the ID of the request, also sent as X-Request-Id, to find it in
+// the log.
+type Problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail"`
+	Code          string `json:"code"`
+	CorrelationID string `json:"correlationId"`
+	Instance      string `json:"instance"`
+}
+
+// problemCode is the code of a status, e.g. method_not_allowed.
+func problemCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return fmt.Sprintf("status_%d", status)
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+type correlationKey struct{}
+
+// validRequestID accepts the X-Request-Id of a proxy in front, so its log
+// and piheat's share IDs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withCorrelationID gives r the ID of the X-Request-Id it came with, or a
+// new one, and sends it back on w.
+func withCorrelationID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-Id")
+	if !validRequestID.MatchString(id) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set("X-Request-Id", id)
+	return r.WithContext(context.WithValue(r.Context(), correlationKey{}, id))
+}
+
+// correlationID is the ID withCorrelationID gave r, "" outside the API.
+func correlationID(r *http.Request) string {
+	id, _ := r.Context().Value(correlationKey{}).(string)
+	return id
+}
+
+// writeProblem sends a problem, logging server errors with their request
+// ID so a client reporting one can be matched to the cause. Work stopped by
+// request_timeout is a 503 request_timeout rather than a server error.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	if status >= 500 && r.Context().Err() == context.DeadlineExceeded {
+		status, code = http.StatusServiceUnavailable, "request_timeout"
+		detail = fmt.Sprintf("Gave up after request_timeout (%v): %s", config().HTTP.RequestTimeout.Duration, detail)
+	}
+	p := Problem{
+		Type:          "about:blank",
+		Title:         http.StatusText(status),
+		Status:        status,
+		Detail:        detail,
+		Code:          code,
+		CorrelationID: correlationID(r),
+		Instance:      strings.SplitN(r.RequestURI, "?", 2)[0],
+	}
+	// A client that went away is told nothing, and is no fault to log
+	if status >= 500 && r.Context().Err() != context.Canceled {
+		log.Printf("API error %s %s: %d %s (request %s)", r.Method, p.Instance, status, detail, p.CorrelationID)
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// apiError replies with a problem of the given code to API requests, and
+// with plain text to the pages, for middleware that guards both.
+func apiError(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	if correlationID(r) == "" {
+		http.Error(w, detail, status)
+		return
+	}
+	writeProblem(w, r, status, code, detail)
+}
+
+// problemWriter turns the plain-text errors of http.Error into problems,
+// leaving every other response alone.
+type problemWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	status  int
+	capture bool
+	buf     bytes.Buffer
+}
+
+func (pw *problemWriter) WriteHeader(code int) {
+	if pw.status != 0 {
+		return
+	}
+	pw.status = code
+	if code >= 400 && strings.HasPrefix(pw.Header().Get("Content-Type"), "text/plain") {
+		pw.capture = true
+		return
+	}
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *problemWriter) Write(p []byte) (int, error) {
+	if pw.status == 0 {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if pw.capture {
+		return pw.buf.Write(p)
+	}
+	return pw.ResponseWriter.Write(p)
+}
+
+func (pw *problemWriter) finish() {
+	if pw.capture {
+		writeProblem(pw.ResponseWriter, pw.r, pw.status, problemCode(pw.status), strings.TrimSpace(pw.buf.String()))
+	}
+}
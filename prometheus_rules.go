@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// prometheusRulesHandler serves the enabled alert rules as a Prometheus
+// rules file, expressed over the series exported at /metrics, so
+// Alertmanager users can mirror piheat's alerts without duplicating them.
+func prometheusRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := listAlertRules()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by piheat from /api/v1/alert-rules. Do not edit by hand.\n")
+	b.WriteString("groups:\n")
+	b.WriteString("  - name: piheat\n")
+	b.WriteString("    rules:\n")
+	count := 0
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		count++
+		fmt.Fprintf(&b, "      - alert: %s\n", prometheusAlertName(rule.Name))
+		fmt.Fprintf(&b, "        expr: %s\n", strconv.Quote(prometheusExpr(rule)))
+		if rule.For.Duration > 0 && rule.Condition != "missing" {
+			fmt.Fprintf(&b, "        for: %s\n", prometheusDuration(rule.For.Seconds()))
+		}
+		b.WriteString("        labels:\n")
+		fmt.Fprintf(&b, "          severity: %s\n", strconv.Quote(rule.Severity))
+		fmt.Fprintf(&b, "          piheat_rule_id: %s\n", strconv.Quote(strconv.FormatInt(rule.ID, 10)))
+		b.WriteString("        annotations:\n")
+		fmt.Fprintf(&b, "          summary: %s\n", strconv.Quote(prometheusSummary(rule)))
+	}
+	if count == 0 {
+		// An empty list keeps the file valid for promtool
+		b.WriteString("      []\n")
+	}
+
+	w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="piheat-rules.yml"`)
+	w.Write([]byte(b.String()))
+}
+
+func prometheusExpr(rule AlertRule) string {
+	selector := ""
+	if rule.Sensor != "*" {
+		selector = fmt.Sprintf("{sensor=~%s}", strconv.Quote(globToRegexp(rule.Sensor)))
+	}
+	threshold := strconv.FormatFloat(rule.Threshold, 'f', -1, 64)
+
+	switch rule.Condition {
+	case "above":
+		return "piheat_temperature_celsius" + selector + " > " + threshold
+	case "below":
+		return "piheat_temperature_celsius" + selector + " < " + threshold
+	case "rate":
+		op := " > "
+		if rule.Threshold < 0 {
+			op = " < "
+		}
+		return "deriv(piheat_temperature_celsius" + selector + "[5m]) * 60" + op + threshold
+	case "missing":
+		return fmt.Sprintf("time() - piheat_last_reading_timestamp_seconds%s > %d", selector, int64(rule.For.Seconds()))
+	}
+	return "vector(0) > 1"
+}
+
+func prometheusSummary(rule AlertRule) string {
+	switch rule.Condition {
+	case "missing":
+		return fmt.Sprintf("%s: no data from {{ $labels.sensor }}", rule.Name)
+	case "rate":
+		return fmt.Sprintf("%s: {{ $labels.sensor }} changing at {{ $value | printf \"%%.1f\" }}°C/min", rule.Name)
+	}
+	return fmt.Sprintf("%s: {{ $labels.sensor }} is {{ $value | printf \"%%.1f\" }}°C", rule.Name)
+}
+
+// prometheusAlertName turns a free-form rule name into a CamelCase alert
+// name, e.g. "CPU hot" becomes "PiheatCPUHot".
+func prometheusAlertName(name string) string {
+	var b strings.Builder
+	b.WriteString("Piheat")
+	upper := true
+	for _, c := range name {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func prometheusDuration(seconds float64) string {
+	s := int64(seconds)
+	switch {
+	case s%3600 == 0:
+		return fmt.Sprintf("%dh", s/3600)
+	case s%60 == 0:
+		return fmt.Sprintf("%dm", s/60)
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+// globToRegexp converts a path.Match style sensor selector into the RE2
+// syntax used by Prometheus label matchers, which are fully anchored.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	inClass := false
+	for _, c := range glob {
+		switch {
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			b.WriteRune(c)
+		case c == '*':
+			b.WriteString(".*")
+		case c == '?':
+			b.WriteString(".")
+		case c == '[':
+			inClass = true
+			b.WriteRune(c)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
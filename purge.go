@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// purgeConfirmTTL is how long the confirmation token from a purge preview
+// stays valid.
+const purgeConfirmTTL = 10 * time.Minute
+
+// purgeRange selects the data removed by a purge. An empty sensor means
+// every sensor; zero times leave that end of the range open. With MaxIDs
+// only the readings each table held when they were taken are selected.
+type purgeRange struct {
+	Sensor string
+	From   time.Time
+	To     time.Time
+	MaxIDs map[string]int64
+}
+
+func (p purgeRange) contains(r Reading) bool {
+	if p.Sensor != "" && r.Sensor != p.Sensor {
+		return false
+	}
+	if !p.From.IsZero() && r.Time.Before(p.From) {
+		return false
+	}
+	return p.To.IsZero() || r.Time.Before(p.To)
+}
+
+// where returns an SQL condition and arguments for the range, using the
+// given sensor and time columns.
+func (p purgeRange) where(timeCol string) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if p.Sensor != "" {
+		conds = append(conds, "sensor = ?")
+		args = append(args, p.Sensor)
+	}
+	if !p.From.IsZero() {
+		conds = append(conds, timeCol+" >= ?")
+		args = append(args, sqliteTime(p.From))
+	}
+	if !p.To.IsZero() {
+		conds = append(conds, timeCol+" < ?")
+		args = append(args, sqliteTime(p.To))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// confirmToken binds a preview to the exact range it was computed for, so
+// the confirming request cannot purge something else.
+func (p purgeRange) confirmToken(exp int64) string {
+	params := url.Values{
+		"sensor": {p.Sensor},
+		"from":   {timeParam(p.From)},
+		"to":     {timeParam(p.To)},
+		"exp":    {strconv.FormatInt(exp, 10)},
+	}
+	return strconv.FormatInt(exp, 10) + "." + urlSignature("purge", params)
+}
+
+func (p purgeRange) checkConfirm(token string) bool {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.confirmToken(exp))) == 1
+}
+
+func timeParam(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// DataPurge is the audit record kept for every executed purge. The records
+// also serve as exclusion markers: data restored from a backup taken before
+// a purge has these ranges removed again.
+type DataPurge struct {
+	ID          int64      `json:"id"`
+	PurgedAt    time.Time  `json:"purgedAt"`
+	Sensor      string     `json:"sensor,omitempty"`
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+	Readings    int64      `json:"readings"`
+	Alerts      int64      `json:"alerts"`
+	RequestedBy string     `json:"requestedBy"`
+	Reason      string     `json:"reason,omitempty"`
+	// Set only in the purge response: forwarders that did not take the
+	// tombstone in time and so keep their copy of the range
+	ForwardersMissed []string `json:"forwardersMissed,omitempty"`
+}
+
+func initPurgeTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS data_purges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		purged_at DATETIME NOT NULL,
+		sensor TEXT NOT NULL DEFAULT '',
+		range_from DATETIME,
+		range_to DATETIME,
+		readings INTEGER NOT NULL,
+		alerts INTEGER NOT NULL,
+		requested_by TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT ''
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return sqliteTime(t)
+}
+
+func countPurge(p purgeRange) (readings, alerts int64, err error) {
+	cond, args := p.where("timestamp")
+	if err = db.QueryRow("SELECT COUNT(*) FROM temperature_readings WHERE "+cond, args...).Scan(&readings); err != nil {
+		return
+	}
+	cond, args = p.where("fired_at")
+	err = db.QueryRow("SELECT COUNT(*) FROM alert_events WHERE "+cond, args...).Scan(&alerts)
+	return
+}
+
+// readingBounds returns the highest reading ID of each readings table,
+// so a purge archives and deletes the same readings however many arrive
+// in between, back-dated ones included. IDs only grow within a table.
+func readingBounds() (map[string]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	tables, err := readingTables(tx)
+	if err != nil {
+		return nil, err
+	}
+	bounds := map[string]int64{}
+	for _, table := range tables {
+		var max int64
+		if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM " + table).Scan(&max); err != nil {
+			return nil, err
+		}
+		bounds[table] = max
+	}
+	return bounds, nil
+}
+
+// readingsWhere is the condition selecting the range's readings in table.
+func (p purgeRange) readingsWhere(table string) (string, []interface{}) {
+	cond, args := p.where("timestamp")
+	if p.MaxIDs != nil {
+		cond += " AND id <= ?"
+		args = append(args, p.MaxIDs[table])
+	}
+	return cond, args
+}
+
+// deleteRange deletes the readings and alert history in the range.
+func deleteRange(tx *sql.Tx, p purgeRange) (readings, alerts int64, err error) {
+	tables, err := readingTables(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, table := range tables {
+		cond, args := p.readingsWhere(table)
+		res, err := tx.Exec("DELETE FROM "+table+" WHERE "+cond, args...)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, _ := res.RowsAffected()
+		readings += n
+	}
+	cond, args := p.where("fired_at")
+	res, err := tx.Exec("DELETE FROM alert_events WHERE "+cond, args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	alerts, _ = res.RowsAffected()
+	return readings, alerts, nil
+}
+
+// executePurge deletes the readings and alert history in the range and
+// records the purge, all in one transaction. With an archive bucket the
+// readings are uploaded there first.
+func executePurge(p purgeRange, by, reason string) (DataPurge, error) {
+	rec := DataPurge{PurgedAt: clock.Now().UTC().Truncate(time.Second), Sensor: p.Sensor, RequestedBy: by, Reason: reason}
+	// Archiving happens first and outside the transaction, which would
+	// otherwise block the sampler's writes for the whole upload. A purge
+	// whose archive fails deletes nothing, and readings recorded during the
+	// upload are past the bounds, so they are neither archived nor deleted.
+	if config().Archive != nil {
+		bounds, err := readingBounds()
+		if err != nil {
+			return rec, err
+		}
+		p.MaxIDs = bounds
+		if _, err := archiveRange(p); err != nil {
+			return rec, fmt.Errorf("archiving readings: %v", err)
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return rec, err
+	}
+	defer tx.Rollback()
+
+	rec.Readings, rec.Alerts, err = deleteRange(tx, p)
+	if err != nil {
+		return rec, err
+	}
+	if err := forgetRollup(tx, p.From, p.To); err != nil {
+		return rec, err
+	}
+	res, err := tx.Exec(`INSERT INTO data_purges (purged_at, sensor, range_from, range_to, readings, alerts, requested_by, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sqliteTime(rec.PurgedAt), p.Sensor, nullableTime(p.From), nullableTime(p.To), rec.Readings, rec.Alerts, by, reason)
+	if err != nil {
+		return rec, err
+	}
+	rec.ID, _ = res.LastInsertId()
+	if !p.From.IsZero() {
+		rec.From = &p.From
+	}
+	if !p.To.IsZero() {
+		rec.To = &p.To
+	}
+	if err := tx.Commit(); err != nil {
+		return rec, err
+	}
+	forgetAggregates()
+	return rec, nil
+}
+
+// runRetention applies retention_days once an hour.
+func runRetention() {
+	ticker := clock.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for now := range ticker.C() {
+		applyRetention(now)
+	}
+}
+
+// applyRetention deletes readings and alert history older than
+// retention_days before now, while it is set.
+func applyRetention(now time.Time) {
+	days := config().RetentionDays
+	if days <= 0 {
+		return
+	}
+	p := purgeRange{To: now.AddDate(0, 0, -days).UTC().Truncate(time.Second)}
+	readings, alerts, err := countPurge(p)
+	if err != nil {
+		log.Printf("Error applying retention: %v", err)
+		return
+	}
+	if readings == 0 && alerts == 0 {
+		return
+	}
+	rec, err := executePurge(p, "retention", fmt.Sprintf("retention_days %d", days))
+	if err != nil {
+		log.Printf("Error applying retention: %v", err)
+		return
+	}
+	log.Printf("Retention: deleted %d readings and %d alerts older than %d days", rec.Readings, rec.Alerts, days)
+	audit(auditRetention, "", "data.purge", "", rec, nil)
+	forgetPurgedSensors()
+}
+
+func listDataPurges() ([]DataPurge, error) {
+	rows, err := db.Query(`SELECT id, purged_at, sensor, range_from, range_to, readings, alerts, requested_by, reason
+		FROM data_purges ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	purges := []DataPurge{}
+	for rows.Next() {
+		var d DataPurge
+		var from, to sql.NullTime
+		if err := rows.Scan(&d.ID, &d.PurgedAt, &d.Sensor, &from, &to, &d.Readings, &d.Alerts, &d.RequestedBy, &d.Reason); err != nil {
+			return nil, err
+		}
+		if from.Valid {
+			t := from.Time.UTC()
+			d.From = &t
+		}
+		if to.Valid {
+			t := to.Time.UTC()
+			d.To = &t
+		}
+		d.PurgedAt = d.PurgedAt.UTC()
+		purges = append(purges, d)
+	}
+	return purges, rows.Err()
+}
+
+// forgetPurgedSensors drops in-memory state for sensors left without any
+// readings, so they disappear from /api/sensors, /metrics and alerting.
+func forgetPurgedSensors() {
+	remaining, err := listSensorNames()
+	if err != nil {
+		log.Printf("Error listing sensors after purge: %v", err)
+		return
+	}
+	keep := map[string]bool{}
+	for _, s := range remaining {
+		keep[s] = true
+	}
+
+	sensorsMonitor.mu.Lock()
+	for s := range sensorsMonitor.sensors {
+		if !keep[s] {
+			delete(sensorsMonitor.sensors, s)
+		}
+	}
+	sensorsMonitor.mu.Unlock()
+
+	sensorGauges.Lock()
+	for s := range sensorGauges.value {
+		if !keep[s] {
+			delete(sensorGauges.value, s)
+			delete(sensorGauges.time, s)
+		}
+	}
+	sensorGauges.Unlock()
+
+	alertEngine.mu.Lock()
+	for s := range alertEngine.last {
+		if !keep[s] {
+			delete(alertEngine.last, s)
+		}
+	}
+	for k := range alertEngine.states {
+		if !keep[k.sensor] {
+			delete(alertEngine.states, k)
+		}
+	}
+	alertEngine.mu.Unlock()
+}
+
+type purgeRequest struct {
+	Sensor  string `json:"sensor"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Reason  string `json:"reason"`
+	Confirm string `json:"confirm"`
+}
+
+// purgePreview is the answer to an unconfirmed purge request.
+type purgePreview struct {
+	Readings   int64             `json:"readings"`
+	Alerts     int64             `json:"alerts"`
+	Forwarders map[string]string `json:"forwarders"`
+	Confirm    string            `json:"confirm"`
+	ExpiresAt  time.Time         `json:"expiresAt"`
+}
+
+// purgeHandler serves POST /api/admin/purge. Without "confirm" it only
+// counts what would be deleted and returns a confirmation token; repeating
+// the request with that token deletes the data.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	p := purgeRange{Sensor: req.Sensor}
+	for _, f := range []struct {
+		name, value string
+		dst         *time.Time
+	}{{"from", req.From, &p.From}, {"to", req.To, &p.To}} {
+		if f.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, f.value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", f.name), http.StatusBadRequest)
+			return
+		}
+		*f.dst = t.UTC()
+	}
+	if p.Sensor == "" && p.From.IsZero() && p.To.IsZero() {
+		http.Error(w, "At least one of sensor, from or to is required", http.StatusBadRequest)
+		return
+	}
+	if !p.From.IsZero() && !p.To.IsZero() && !p.From.Before(p.To) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	if req.Confirm == "" {
+		readings, alerts, err := countPurge(p)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		exp := time.Now().Add(purgeConfirmTTL)
+		writeJSON(w, http.StatusOK, purgePreview{
+			Readings:   readings,
+			Alerts:     alerts,
+			Forwarders: forwarderPurgeModes(p),
+			Confirm:    p.confirmToken(exp.Unix()),
+			ExpiresAt:  exp.UTC().Truncate(time.Second),
+		})
+		return
+	}
+	if !p.checkConfirm(req.Confirm) {
+		http.Error(w, "Confirmation token invalid or expired; request a new preview", http.StatusConflict)
+		return
+	}
+
+	rec, err := executePurge(p, requestActor(r), req.Reason)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error purging data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Purged %d readings and %d alerts (sensor %q, from %s, to %s) for %s",
+		rec.Readings, rec.Alerts, p.Sensor, timeParam(p.From), timeParam(p.To), rec.RequestedBy)
+	auditRequest(r, "data.purge", p.Sensor, rec, nil)
+	forgetPurgedSensors()
+	rec.ForwardersMissed = purgeForwarded(r.Context(), p)
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// dataPurgesHandler serves GET /api/admin/purges, the purge audit trail.
+func dataPurgesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	purges, err := listDataPurges()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, purges)
+}
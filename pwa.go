@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// pwaIconSizes are the sizes of the app icon the manifest lists.
+var pwaIconSizes = []int{192, 512}
+
+var (
+	pwaThemeColor = color.RGBA{33, 150, 243, 255}
+	pwaIconColor  = color.RGBA{255, 255, 255, 255}
+	pwaMercury    = color.RGBA{244, 67, 54, 255}
+)
+
+// WebManifest is /manifest.json, which lets browsers install the dashboard
+// as an app.
+type WebManifest struct {
+	Name            string         `json:"name"`
+	ShortName       string         `json:"short_name"`
+	StartURL        string         `json:"start_url"`
+	Scope           string         `json:"scope"`
+	Display         string         `json:"display"`
+	BackgroundColor string         `json:"background_color"`
+	ThemeColor      string         `json:"theme_color"`
+	Icons           []ManifestIcon `json:"icons"`
+}
+
+// ManifestIcon is an app icon of the manifest.
+type ManifestIcon struct {
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose"`
+}
+
+// manifestHandler serves /manifest.json.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	theme := currentTheme()
+	background := "#ffffff"
+	if theme.Mode == themeDark {
+		background = "#121212"
+	}
+	m := WebManifest{Name: "piheat", ShortName: "piheat", StartURL: basePath + "/", Scope: basePath + "/",
+		Display: "standalone", BackgroundColor: background, ThemeColor: theme.Accent, Icons: []ManifestIcon{}}
+	for _, size := range pwaIconSizes {
+		m.Icons = append(m.Icons, ManifestIcon{Src: fmt.Sprintf("%s/icons/%d.png?v=%s", basePath, size, assetVersion),
+			Sizes: fmt.Sprintf("%dx%d", size, size), Type: "image/png", Purpose: "any maskable"})
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, m)
+}
+
+// renderAppIcon draws the app icon: a thermometer on the theme colour,
+// kept inside the middle 80% so launchers may crop it to any shape.
+func renderAppIcon(size int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{pwaThemeColor}, image.Point{}, draw.Src)
+	u := float64(size) / 100
+	cx := size / 2
+	circle := func(x, y, r int, c color.Color) {
+		for py := y - r; py <= y+r; py++ {
+			for px := x - r; px <= x+r; px++ {
+				if (px-x)*(px-x)+(py-y)*(py-y) <= r*r {
+					img.Set(px, py, c)
+				}
+			}
+		}
+	}
+	rect := func(x0, y0, x1, y1 int, c color.Color) {
+		draw.Draw(img, image.Rect(x0, y0, x1, y1), &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+	// The tube and bulb in white, the mercury inside them in red
+	tube, bulb := int(7*u), int(14*u)
+	top, bottom := int(22*u), int(70*u)
+	circle(cx, top, tube, pwaIconColor)
+	rect(cx-tube, top, cx+tube+1, bottom, pwaIconColor)
+	circle(cx, bottom, bulb, pwaIconColor)
+	rect(cx-tube/2, int(40*u), cx+tube/2+1, bottom, pwaMercury)
+	circle(cx, bottom, bulb*2/3, pwaMercury)
+	return encodePNG(img)
+}
+
+// appIconHandler serves /icons/{size}.png.
+func appIconHandler(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/icons/"), ".png"))
+	known := false
+	for _, s := range pwaIconSizes {
+		known = known || s == size
+	}
+	if err != nil || !known {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("v") == assetVersion {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(renderAppIcon(size))
+}
+
+// serviceWorkerHandler serves static/sw.js as /sw.js, so its scope is the
+// whole dashboard rather than /static/. It is never cached, so browsers
+// find a new release's worker at once.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := fs.ReadFile(assets, "static/sw.js")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading service worker: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitConfig throttles HTTP clients so scanners cannot swamp the Pi.
+// requests_per_second and burst size a token bucket per client address
+// for /api/ requests; max_concurrent caps the requests served at once. 0
+// turns either off.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	MaxConcurrent     int     `json:"max_concurrent"`
+}
+
+func (c RateLimitConfig) check() error {
+	if c.RequestsPerSecond < 0 {
+		return fmt.Errorf("requests_per_second must not be negative")
+	}
+	if c.RequestsPerSecond > 0 && c.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must not be negative")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time since it was last used and takes a
+// token. Without one it returns how long until the next is there.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limiter holds a bucket per client address. Buckets idle long enough to
+// have filled up again are swept once a minute.
+var limiter = struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	inFlight  int64
+	limited   int64
+	overload  int64
+}{buckets: map[string]*tokenBucket{}}
+
+// allowClient takes a token from the client's bucket.
+func allowClient(client string, now time.Time, rate float64, burst int) (bool, time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	if now.Sub(limiter.lastSweep) > time.Minute {
+		full := time.Duration(float64(burst) / rate * float64(time.Second))
+		for c, b := range limiter.buckets {
+			if now.Sub(b.last) > full {
+				delete(limiter.buckets, c)
+			}
+		}
+		limiter.lastSweep = now
+	}
+	b, ok := limiter.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		limiter.buckets[client] = b
+	}
+	ok, wait := b.take(now, rate, burst)
+	if !ok {
+		limiter.limited++
+	}
+	return ok, wait
+}
+
+// throttle applies rate_limit to h. Clients over their rate get 429 and
+// requests beyond max_concurrent 503, both with Retry-After. The config is
+// read per request, so reloads apply at once.
+func throttle(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := config().RateLimit
+		n := atomic.AddInt64(&limiter.inFlight, 1)
+		defer atomic.AddInt64(&limiter.inFlight, -1)
+		if rl.MaxConcurrent > 0 && n > int64(rl.MaxConcurrent) {
+			atomic.AddInt64(&limiter.overload, 1)
+			w.Header().Set("Retry-After", "1")
+			apiError(w, r, http.StatusServiceUnavailable, "overloaded", "Too many requests in progress, try again shortly")
+			return
+		}
+		if rl.RequestsPerSecond > 0 && strings.HasPrefix(r.URL.Path, "/api/") {
+			if ok, wait := allowClient(remoteHost(r.RemoteAddr), time.Now(), rl.RequestsPerSecond, rl.Burst); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				apiError(w, r, http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded")
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeRateLimitMetrics adds the throttling counters to /metrics.
+func writeRateLimitMetrics(b *strings.Builder) {
+	limiter.Lock()
+	limited := limiter.limited
+	limiter.Unlock()
+	b.WriteString("# HELP piheat_http_requests_in_flight HTTP requests being served.\n")
+	b.WriteString("# TYPE piheat_http_requests_in_flight gauge\n")
+	fmt.Fprintf(b, "piheat_http_requests_in_flight %d\n", atomic.LoadInt64(&limiter.inFlight))
+	b.WriteString("# HELP piheat_http_rate_limited_total API requests refused because the client was over rate_limit.requests_per_second.\n")
+	b.WriteString("# TYPE piheat_http_rate_limited_total counter\n")
+	fmt.Fprintf(b, "piheat_http_rate_limited_total %d\n", limited)
+	b.WriteString("# HELP piheat_http_overload_rejected_total Requests refused because rate_limit.max_concurrent were in progress.\n")
+	b.WriteString("# TYPE piheat_http_overload_rejected_total counter\n")
+	fmt.Fprintf(b, "piheat_http_overload_rejected_total %d\n", atomic.LoadInt64(&limiter.overload))
+}
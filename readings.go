@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoredReading is a raw row of temperature_readings.
+type StoredReading struct {
+	ID          int64     `json:"id"`
+	Sensor      string    `json:"sensor"`
+	Temperature float64   `json:"temperature"`
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+}
+
+type readingPage struct {
+	Total    int             `json:"total"`
+	Limit    int             `json:"limit"`
+	Offset   int             `json:"offset"`
+	Readings []StoredReading `json:"readings"`
+}
+
+// readingQuery selects a page of stored readings. An empty sensor or source
+// and zero times leave that filter out.
+type readingQuery struct {
+	Sensor    string
+	Source    string
+	From, To  time.Time
+	Ascending bool
+	Limit     int
+	Offset    int
+}
+
+// filter returns the WHERE clause, if any, and its arguments.
+func (rq readingQuery) filter() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if rq.Sensor != "" {
+		where = append(where, "sensor = ?")
+		args = append(args, rq.Sensor)
+	}
+	if rq.Source != "" {
+		where = append(where, "source = ?")
+		args = append(args, rq.Source)
+	}
+	if !rq.From.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, sqliteTime(rq.From))
+	}
+	if !rq.To.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, sqliteTime(rq.To))
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func (rq readingQuery) order() string {
+	if rq.Ascending {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// queryReadings is the storage side of /api/readings and the gRPC
+// QueryRange call.
+func queryReadings(ctx context.Context, rq readingQuery) (readingPage, error) {
+	defer timeQuery("readings_page")()
+	filter, args := rq.filter()
+	order := rq.order()
+
+	page := readingPage{Limit: rq.Limit, Offset: rq.Offset, Readings: []StoredReading{}}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM temperature_readings"+filter, args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, sensor, temperature, timestamp, source FROM temperature_readings"+filter+
+		" ORDER BY timestamp "+order+", id "+order+" LIMIT ? OFFSET ?",
+		append(args, rq.Limit, rq.Offset)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rd StoredReading
+		if err := rows.Scan(&rd.ID, &rd.Sensor, &rd.Temperature, &rd.Timestamp, &rd.Source); err != nil {
+			return page, err
+		}
+		rd.Timestamp = rd.Timestamp.UTC()
+		page.Readings = append(page.Readings, rd)
+	}
+	return page, rows.Err()
+}
+
+// eachReading calls fn for every reading matching rq, ignoring its limit and
+// offset, without holding them all in memory.
+func eachReading(ctx context.Context, rq readingQuery, fn func(StoredReading) error) error {
+	defer timeQuery("readings_scan")()
+	filter, args := rq.filter()
+	rows, err := db.QueryContext(ctx, "SELECT id, sensor, temperature, timestamp, source FROM temperature_readings"+filter+
+		" ORDER BY timestamp "+rq.order()+", id "+rq.order(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rd StoredReading
+		if err := rows.Scan(&rd.ID, &rd.Sensor, &rd.Temperature, &rd.Timestamp, &rd.Source); err != nil {
+			return err
+		}
+		rd.Timestamp = rd.Timestamp.UTC()
+		if err := fn(rd); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// readingsHandler pages through raw readings. Filters: sensor, source, from, to;
+// order is asc or desc (default, newest first).
+func readingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	rq := readingQuery{Sensor: q.Get("sensor"), Source: q.Get("source")}
+	for param, dst := range map[string]*time.Time{"from": &rq.From, "to": &rq.To} {
+		if v := q.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			*dst = t
+		}
+	}
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		rq.Ascending = true
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	var ok bool
+	rq.Limit, rq.Offset, ok = pageParams(w, r, 100, 1000)
+	if !ok {
+		return
+	}
+
+	page, err := queryReadings(r.Context(), rq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// readingSubscribers receive every recorded reading, for live streams.
+var readingSubscribers = struct {
+	sync.Mutex
+	chans map[chan Reading]bool
+}{chans: map[chan Reading]bool{}}
+
+// subscribeReadings returns a channel of new readings and a function that
+// ends the subscription. Slow subscribers miss readings rather than delay
+// recording.
+func subscribeReadings() (<-chan Reading, func()) {
+	ch := make(chan Reading, 64)
+	readingSubscribers.Lock()
+	readingSubscribers.chans[ch] = true
+	readingSubscribers.Unlock()
+	return ch, func() {
+		readingSubscribers.Lock()
+		delete(readingSubscribers.chans, ch)
+		readingSubscribers.Unlock()
+	}
+}
+
+func publishReading(r Reading) {
+	readingSubscribers.Lock()
+	defer readingSubscribers.Unlock()
+	for ch := range readingSubscribers.chans {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configPath is the config file serve loaded, read again on reload.
+var configPath string
+
+// restartOnlyConfig are the config options whose listeners, connections or
+// loops are set up once at start. A reload keeps their running values.
+var restartOnlyConfig = map[string]bool{
+	"url_signing_key":  true,
+	"base_path":        true,
+	"graphite":         true,
+	"syslog":           true,
+	"mqtt":             true,
+	"forwarders":       true,
+	"zones":            true,
+	"derived":          true,
+	"pressure":         true,
+	"onewire":          true,
+	"power_failure":    true,
+	"presence":         true,
+	"frost":            true,
+	"gpio":             true,
+	"simulation":       true,
+	"trvs":             true,
+	"boilers":          true,
+	"control_interval": true,
+	"backup":           true,
+	"archive":          true,
+	"failover":         true,
+	"mdns":             true,
+	"season":           true,
+	"weather":          true,
+
+	"maintenance_interval": true,
+}
+
+// ReloadResult is what POST /api/admin/reload returns: the config options
+// that changed and were applied, and those that only change on restart.
+type ReloadResult struct {
+	ReloadedAt      time.Time `json:"reloadedAt"`
+	Changed         []string  `json:"changed"`
+	RestartRequired []string  `json:"restartRequired"`
+}
+
+// reloadMu serialises reloads and settings changes.
+var reloadMu sync.Mutex
+
+// fileConfig is the config as read from the file, before the stored
+// settings are applied on top of it.
+var fileConfig *Config
+
+// reloadConfig reads the config file again and applies it, with the stored
+// settings on top, to the running subsystems. Alert rules are reloaded from
+// the database on the way.
+func reloadConfig() (ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	file, err := loadConfig(configPath)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	stored, err := loadSettings()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	next, err := withSettings(file, stored)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	ch, err := prepareConfig(next)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	if err := alertEngine.reload(); err != nil {
+		return ReloadResult{}, fmt.Errorf("loading alert rules: %v", err)
+	}
+	fileConfig = file
+	ch.apply("Reloaded config from " + configPath)
+	return ch.result, nil
+}
+
+// configChange is a validated config with everything built that the
+// running subsystems need to switch to it.
+type configChange struct {
+	next      *Config
+	notifiers map[string]Notifier
+	limits    []HeaterConfig
+	result    ReloadResult
+}
+
+// prepareConfig validates next against the running config and builds its
+// notifiers. Options that only change on restart keep their running
+// values. Nothing running is changed yet, so a config with an error has no
+// effect.
+func prepareConfig(next *Config) (*configChange, error) {
+	ch := &configChange{next: next}
+	ch.result = ReloadResult{ReloadedAt: time.Now().UTC().Truncate(time.Second), Changed: []string{}, RestartRequired: []string{}}
+	old := reflect.ValueOf(config()).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		name := strings.Split(nv.Type().Field(i).Tag.Get("json"), ",")[0]
+		if reflect.DeepEqual(old.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if restartOnlyConfig[name] || (name == "heaters" && !sameHeaterPlugs(config().Heaters, next.Heaters)) {
+			nv.Field(i).Set(old.Field(i))
+			ch.result.RestartRequired = append(ch.result.RestartRequired, name)
+			continue
+		}
+		// The connection timeouts are set on the server at start; only
+		// request_timeout is read per request
+		if name == "http" {
+			running := config().HTTP
+			running.RequestTimeout = next.HTTP.RequestTimeout
+			if running != next.HTTP {
+				next.HTTP = running
+				ch.result.RestartRequired = append(ch.result.RestartRequired, name)
+			}
+			if next.HTTP == config().HTTP {
+				continue
+			}
+		}
+		ch.result.Changed = append(ch.result.Changed, name)
+	}
+
+	var err error
+	if ch.notifiers, err = buildNotifiers(next.Notifiers); err != nil {
+		return nil, err
+	}
+	if err := checkNotifiersIn(ch.notifiers, next.Staleness.Notifiers); err != nil {
+		return nil, fmt.Errorf("staleness: %v", err)
+	}
+	if err := checkNotifiersIn(ch.notifiers, next.RiseAlert.Notifiers); err != nil {
+		return nil, fmt.Errorf("rise_alert: %v", err)
+	}
+	ch.limits = make([]HeaterConfig, len(heaters))
+	for i, h := range heaters {
+		ch.limits[i] = heaterDefaults(next.Heaters[h.name])
+		if err := ch.limits[i].checkSafety(); err != nil {
+			return nil, fmt.Errorf("heater %q: %v", h.name, err)
+		}
+		if err := checkNotifiersIn(ch.notifiers, ch.limits[i].Notifiers); err != nil {
+			return nil, fmt.Errorf("heater %q: %v", h.name, err)
+		}
+	}
+	return ch, nil
+}
+
+// apply switches the running subsystems over together and logs what
+// changed after what.
+func (ch *configChange) apply(what string) {
+	setNotifiers(ch.notifiers)
+	for i, h := range heaters {
+		h.setLimits(ch.limits[i])
+	}
+	if ch.next.SampleInterval != config().SampleInterval {
+		select {
+		case <-samplerInterval:
+		default:
+		}
+		samplerInterval <- ch.next.SampleInterval.Duration
+	}
+	setConfig(ch.next)
+
+	msg := "no changes"
+	if len(ch.result.Changed) > 0 {
+		msg = "changed " + strings.Join(ch.result.Changed, ", ")
+	}
+	if len(ch.result.RestartRequired) > 0 {
+		msg += "; restart to apply " + strings.Join(ch.result.RestartRequired, ", ")
+	}
+	log.Printf("%s: %s", what, msg)
+}
+
+// sameHeaterPlugs reports whether two heaters sections name the same plugs,
+// reached the same way, so only their thresholds, notifiers and watts differ.
+func sameHeaterPlugs(a, b map[string]HeaterConfig) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, ha := range a {
+		hb, ok := b[name]
+		if !ok {
+			return false
+		}
+		ha.OnWatts, ha.OffWatts, ha.Grace, ha.Notifiers, ha.Watts = 0, 0, Duration{}, nil, 0
+		hb.OnWatts, hb.OffWatts, hb.Grace, hb.Notifiers, hb.Watts = 0, 0, Duration{}, nil, 0
+		ha.MaxOn, ha.MinCycle, hb.MaxOn, hb.MinCycle = Duration{}, Duration{}, Duration{}, Duration{}
+		if !reflect.DeepEqual(ha, hb) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchReloadSignal reloads the config on SIGHUP.
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			res, err := reloadConfig()
+			if err != nil {
+				log.Printf("Error reloading config, keeping the running one: %v", err)
+				continue
+			}
+			audit(auditSignal, "", "config.reload", configPath, nil, res)
+		}
+	}()
+}
+
+// reloadHandler serves POST /api/admin/reload.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := reloadConfig()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reloading config: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	auditRequest(r, "config.reload", configPath, nil, res)
+	writeJSON(w, http.StatusOK, res)
+}
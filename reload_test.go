@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestReloadHTTPTimeouts checks a reload applies request_timeout and
+// leaves the server's connection timeouts for the next restart.
+func TestReloadHTTPTimeouts(t *testing.T) {
+	running := config().HTTP
+	contains := func(list []string, s string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tc := range []struct {
+		name             string
+		edit             func(*HTTPConfig)
+		changed, restart bool
+	}{
+		{"request_timeout", func(c *HTTPConfig) { c.RequestTimeout = Duration{running.RequestTimeout.Duration + time.Second} }, true, false},
+		{"read_timeout", func(c *HTTPConfig) { c.ReadTimeout = Duration{running.ReadTimeout.Duration + time.Second} }, false, true},
+		{"both", func(c *HTTPConfig) {
+			c.WriteTimeout = Duration{running.WriteTimeout.Duration + time.Second}
+			c.RequestTimeout = Duration{running.RequestTimeout.Duration + time.Second}
+		}, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			next := *config()
+			tc.edit(&next.HTTP)
+			want := next.HTTP.RequestTimeout
+			ch, err := prepareConfig(&next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := contains(ch.result.Changed, "http"); got != tc.changed {
+				t.Errorf("http in changed: %v, want %v (%+v)", got, tc.changed, ch.result)
+			}
+			if got := contains(ch.result.RestartRequired, "http"); got != tc.restart {
+				t.Errorf("http in restartRequired: %v, want %v (%+v)", got, tc.restart, ch.result)
+			}
+			applied := running
+			applied.RequestTimeout = want
+			if next.HTTP != applied {
+				t.Errorf("reload would run with %+v, want the running connection timeouts and request_timeout %s", next.HTTP, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// MonthSummary is one sensor's readings over one calendar month, next to
+// the same month of the previous year.
+type MonthSummary struct {
+	Month       int      `json:"month"`
+	Avg         *float64 `json:"avg,omitempty"`
+	Min         *float64 `json:"min,omitempty"`
+	Max         *float64 `json:"max,omitempty"`
+	Readings    int      `json:"readings"`
+	PreviousAvg *float64 `json:"previousAvg,omitempty"`
+}
+
+// DayAverage is the average temperature of one local calendar day.
+type DayAverage struct {
+	Date string  `json:"date"`
+	Avg  float64 `json:"avg"`
+}
+
+// SensorReport is the year of one sensor.
+type SensorReport struct {
+	Sensor      string         `json:"sensor"`
+	Avg         *float64       `json:"avg,omitempty"`
+	PreviousAvg *float64       `json:"previousAvg,omitempty"`
+	Readings    int            `json:"readings"`
+	Coldest     *DayAverage    `json:"coldestDay,omitempty"`
+	Warmest     *DayAverage    `json:"warmestDay,omitempty"`
+	Months      []MonthSummary `json:"months"`
+}
+
+// HeaterReport is the runtime and energy use of one heater plug over the
+// year and the year before.
+type HeaterReport struct {
+	Heater               string   `json:"heater"`
+	RuntimeHours         float64  `json:"runtimeHours"`
+	EnergyKWh            float64  `json:"energyKWh"`
+	Cost                 *float64 `json:"cost,omitempty"`
+	PreviousRuntimeHours float64  `json:"previousRuntimeHours"`
+	PreviousEnergyKWh    float64  `json:"previousEnergyKWh"`
+	PreviousCost         *float64 `json:"previousCost,omitempty"`
+}
+
+// YearReport is the year in review served by /api/report/{year}.
+type YearReport struct {
+	Year    int            `json:"year"`
+	Sensors []SensorReport `json:"sensors"`
+	Heaters []HeaterReport `json:"heaters"`
+	// Totals over all heaters
+	RuntimeHours         float64  `json:"runtimeHours"`
+	EnergyKWh            float64  `json:"energyKWh"`
+	Cost                 *float64 `json:"cost,omitempty"`
+	PreviousRuntimeHours float64  `json:"previousRuntimeHours"`
+	PreviousEnergyKWh    float64  `json:"previousEnergyKWh"`
+	PreviousCost         *float64 `json:"previousCost,omitempty"`
+	Currency             string   `json:"currency,omitempty"`
+}
+
+// readingTotals sums readings so averages weigh every reading equally,
+// however unevenly they are spread over days and months.
+type readingTotals struct {
+	sum      float64
+	count    int
+	min, max float64
+}
+
+func (t *readingTotals) add(sum float64, count int, min, max float64) {
+	if t.count == 0 || min < t.min {
+		t.min = min
+	}
+	if t.count == 0 || max > t.max {
+		t.max = max
+	}
+	t.sum += sum
+	t.count += count
+}
+
+func (t readingTotals) avg() *float64 {
+	if t.count == 0 {
+		return nil
+	}
+	v := t.sum / float64(t.count)
+	return &v
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// buildYearReport summarises the given year and the one before it from the
+// daily_readings and heater_usage rollups. Today, and on a read-only
+// instance every day, is grouped from the raw readings instead.
+func buildYearReport(ctx context.Context, year int) (YearReport, error) {
+	defer timeQuery("year_report")()
+	rep := YearReport{Year: year, Sensors: []SensorReport{}, Heaters: []HeaterReport{}}
+	from := time.Date(year-1, 1, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(year+1, 1, 1, 0, 0, 0, 0, time.Local)
+
+	query := `SELECT sensor, date(timestamp, 'localtime') AS day, SUM(temperature), COUNT(*), MIN(temperature), MAX(temperature)
+		FROM temperature_readings
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY sensor, day`
+	args := []interface{}{sqliteTime(from), sqliteTime(to)}
+	// The recording instance owns the rollup; a read-only one cannot fill it
+	if !readOnly {
+		cut, err := ensureRollup(ctx, from, to)
+		if err != nil {
+			return rep, err
+		}
+		query = `SELECT sensor, day, sum, count, min, max
+		FROM daily_readings WHERE day >= ? AND day < ?
+		UNION ALL ` + query
+		args = []interface{}{localDay(from), localDay(cut), sqliteTime(cut), sqliteTime(to)}
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY sensor, day", args...)
+	if err != nil {
+		return rep, err
+	}
+	defer rows.Close()
+
+	type sensorYears struct {
+		months           [2][12]readingTotals
+		years            [2]readingTotals
+		coldest, warmest *DayAverage
+	}
+	bySensor := map[string]*sensorYears{}
+	for rows.Next() {
+		var sensor, day string
+		var sum, min, max float64
+		var count int
+		if err := rows.Scan(&sensor, &day, &sum, &count, &min, &max); err != nil {
+			return rep, err
+		}
+		d, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			continue
+		}
+		s := bySensor[sensor]
+		if s == nil {
+			s = &sensorYears{}
+			bySensor[sensor] = s
+		}
+		i := 0
+		if d.Year() == year {
+			i = 1
+			avg := DayAverage{Date: day, Avg: sum / float64(count)}
+			if s.coldest == nil || avg.Avg < s.coldest.Avg {
+				s.coldest = &avg
+			}
+			if s.warmest == nil || avg.Avg > s.warmest.Avg {
+				s.warmest = &avg
+			}
+		}
+		s.months[i][d.Month()-1].add(sum, count, min, max)
+		s.years[i].add(sum, count, min, max)
+	}
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+
+	for sensor, s := range bySensor {
+		if s.years[1].count == 0 {
+			continue
+		}
+		sr := SensorReport{
+			Sensor:      sensor,
+			Avg:         s.years[1].avg(),
+			PreviousAvg: s.years[0].avg(),
+			Readings:    s.years[1].count,
+			Coldest:     s.coldest,
+			Warmest:     s.warmest,
+		}
+		for m := 0; m < 12; m++ {
+			cur := s.months[1][m]
+			ms := MonthSummary{Month: m + 1, Avg: cur.avg(), Readings: cur.count, PreviousAvg: s.months[0][m].avg()}
+			if cur.count > 0 {
+				ms.Min, ms.Max = floatPtr(cur.min), floatPtr(cur.max)
+			}
+			sr.Months = append(sr.Months, ms)
+		}
+		roundSensorReport(&sr)
+		rep.Sensors = append(rep.Sensors, sr)
+	}
+	sort.Slice(rep.Sensors, func(i, j int) bool { return rep.Sensors[i].Sensor < rep.Sensors[j].Sensor })
+
+	heaterRows, err := db.QueryContext(ctx, `SELECT heater, CAST(substr(day, 1, 4) AS INTEGER) AS y, SUM(on_seconds), SUM(energy_wh)
+		FROM heater_usage WHERE day >= ? AND day < ?
+		GROUP BY heater, y ORDER BY heater`, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return rep, err
+	}
+	defer heaterRows.Close()
+	byHeater := map[string]*HeaterReport{}
+	var names []string
+	for heaterRows.Next() {
+		var name string
+		var y int
+		var seconds, wh float64
+		if err := heaterRows.Scan(&name, &y, &seconds, &wh); err != nil {
+			return rep, err
+		}
+		h := byHeater[name]
+		if h == nil {
+			h = &HeaterReport{Heater: name}
+			byHeater[name] = h
+			names = append(names, name)
+		}
+		if y == year {
+			h.RuntimeHours, h.EnergyKWh = seconds/3600, wh/1000
+		} else {
+			h.PreviousRuntimeHours, h.PreviousEnergyKWh = seconds/3600, wh/1000
+		}
+	}
+	if err := heaterRows.Err(); err != nil {
+		return rep, err
+	}
+	for _, name := range names {
+		h := byHeater[name]
+		if config().EnergyPrice > 0 {
+			h.Cost = floatPtr(h.EnergyKWh * config().EnergyPrice)
+			h.PreviousCost = floatPtr(h.PreviousEnergyKWh * config().EnergyPrice)
+		}
+		rep.RuntimeHours += h.RuntimeHours
+		rep.EnergyKWh += h.EnergyKWh
+		rep.PreviousRuntimeHours += h.PreviousRuntimeHours
+		rep.PreviousEnergyKWh += h.PreviousEnergyKWh
+		rep.Heaters = append(rep.Heaters, *h)
+	}
+	if config().EnergyPrice > 0 {
+		rep.Cost = floatPtr(rep.EnergyKWh * config().EnergyPrice)
+		rep.PreviousCost = floatPtr(rep.PreviousEnergyKWh * config().EnergyPrice)
+		rep.Currency = config().Currency
+	}
+	return rep, nil
+}
+
+// roundSensorReport rounds a sensor's averages, minima and maxima to its
+// display precision, once they have been worked out.
+func roundSensorReport(sr *SensorReport) {
+	round := func(v *float64) *float64 {
+		if v == nil {
+			return nil
+		}
+		return floatPtr(roundReading(sr.Sensor, *v))
+	}
+	sr.Avg, sr.PreviousAvg = round(sr.Avg), round(sr.PreviousAvg)
+	for _, d := range []*DayAverage{sr.Coldest, sr.Warmest} {
+		if d != nil {
+			d.Avg = roundReading(sr.Sensor, d.Avg)
+		}
+	}
+	for i := range sr.Months {
+		m := &sr.Months[i]
+		m.Avg, m.Min, m.Max, m.PreviousAvg = round(m.Avg), round(m.Min), round(m.Max), round(m.PreviousAvg)
+	}
+}
+
+// reportYear parses the year from a path such as /report/2024.pdf. An empty
+// year means the current one.
+func reportYear(rest string) (int, bool) {
+	if rest == "" {
+		return time.Now().Year(), true
+	}
+	year, err := strconv.Atoi(rest)
+	if err != nil || year < 1970 || year > 9999 {
+		return 0, false
+	}
+	return year, true
+}
+
+// reportAPIHandler serves GET /api/report/{year}.
+func reportAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	year, ok := reportYear(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/report/"), "/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rep, err := buildYearReport(r.Context(), year)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// reportHandler serves the year in review as a page at /report/{year} and
+// as a PDF at /report/{year}.pdf. /report/ redirects to the current year.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/report/"), "/")
+	if rest == "" {
+		http.Redirect(w, r, fmt.Sprintf("%s/report/%d", basePath, time.Now().Year()), http.StatusFound)
+		return
+	}
+	pdf := strings.HasSuffix(rest, ".pdf")
+	year, ok := reportYear(strings.TrimSuffix(rest, ".pdf"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rep, err := buildYearReport(r.Context(), year)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if pdf {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"piheat-%d.pdf\"", year))
+		if err := writeReportPDF(w, rep); err != nil {
+			log.Printf("Error writing report PDF: %v", err)
+		}
+		return
+	}
+
+	t, err := parseTemplate("report.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+		Report       YearReport
+	}{basePath, assetVersion, rep})
+}
+
+// monthNames are the short English month names of the PDF.
+func monthNames() []string {
+	names := make([]string, 12)
+	for m := range names {
+		names[m] = time.Month(m + 1).String()[:3]
+	}
+	return names
+}
+
+// formatTemp formats an optional temperature for the PDF, "-" when missing.
+func formatTemp(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f°C", *v)
+}
+
+// formatChange formats the difference to the previous year with its sign.
+func formatChange(cur, prev float64, unit string) string {
+	d := cur - prev
+	if math.Abs(d) < 0.05 {
+		return "±0" + unit
+	}
+	return fmt.Sprintf("%+.1f%s", d, unit)
+}
+
+func formatCost(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	s := fmt.Sprintf("%.2f", *v)
+	if config().Currency != "" {
+		s += " " + config().Currency
+	}
+	return s
+}
+
+// writeReportPDF lays out the report on A4 with the PDF core fonts, which
+// need text in cp1252.
+func writeReportPDF(w http.ResponseWriter, rep YearReport) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetTitle(fmt.Sprintf("piheat %d in review", rep.Year), true)
+	pdf.SetCreator("piheat", true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, fmt.Sprintf("%d in review", rep.Year), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.SetTextColor(100, 100, 100)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Compared with %d. Generated %s", rep.Year-1, time.Now().Format("2 January 2006 15:04")), "", 1, "L", false, 0, "")
+	pdf.SetTextColor(0, 0, 0)
+
+	heading := func(s string) {
+		pdf.Ln(4)
+		pdf.SetFont("Helvetica", "B", 13)
+		pdf.CellFormat(0, 8, tr(s), "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+	}
+	table := func(widths []float64, header []string, rows [][]string) {
+		pdf.SetFont("Helvetica", "B", 9)
+		pdf.SetFillColor(227, 242, 253)
+		for i, h := range header {
+			pdf.CellFormat(widths[i], 6, tr(h), "B", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+		for _, row := range rows {
+			for i, c := range row {
+				pdf.CellFormat(widths[i], 5.5, tr(c), "", 0, "L", false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+
+	if len(rep.Heaters) > 0 {
+		heading("Heating")
+		var rows [][]string
+		for _, h := range rep.Heaters {
+			rows = append(rows, []string{h.Heater,
+				fmt.Sprintf("%.1f h", h.RuntimeHours), formatChange(h.RuntimeHours, h.PreviousRuntimeHours, " h"),
+				fmt.Sprintf("%.1f kWh", h.EnergyKWh), formatChange(h.EnergyKWh, h.PreviousEnergyKWh, " kWh"),
+				formatCost(h.Cost)})
+		}
+		rows = append(rows, []string{"Total",
+			fmt.Sprintf("%.1f h", rep.RuntimeHours), formatChange(rep.RuntimeHours, rep.PreviousRuntimeHours, " h"),
+			fmt.Sprintf("%.1f kWh", rep.EnergyKWh), formatChange(rep.EnergyKWh, rep.PreviousEnergyKWh, " kWh"),
+			formatCost(rep.Cost)})
+		table([]float64{40, 25, 30, 30, 30, 25},
+			[]string{"Heater", "Runtime", "vs last year", "Energy", "vs last year", "Cost"}, rows)
+	}
+
+	names := monthNames()
+	for _, s := range rep.Sensors {
+		heading(s.Sensor)
+		summary := fmt.Sprintf("Average %s", formatTemp(s.Avg))
+		if s.Avg != nil && s.PreviousAvg != nil {
+			summary += fmt.Sprintf(" (%s vs %d)", formatChange(*s.Avg, *s.PreviousAvg, "°C"), rep.Year-1)
+		}
+		if s.Coldest != nil {
+			summary += fmt.Sprintf(". Coldest day %s at %.1f°C, warmest %s at %.1f°C",
+				s.Coldest.Date, s.Coldest.Avg, s.Warmest.Date, s.Warmest.Avg)
+		}
+		pdf.MultiCell(0, 5, tr(summary+"."), "", "L", false)
+		pdf.Ln(1)
+		var rows [][]string
+		for _, m := range s.Months {
+			rows = append(rows, []string{names[m.Month-1], formatTemp(m.Avg), formatTemp(m.Min), formatTemp(m.Max),
+				formatTemp(m.PreviousAvg), strconv.Itoa(m.Readings)})
+		}
+		table([]float64{25, 28, 28, 28, 35, 25},
+			[]string{"Month", "Average", "Min", "Max", fmt.Sprintf("Average %d", rep.Year-1), "Readings"}, rows)
+	}
+	if len(rep.Sensors) == 0 {
+		pdf.Ln(4)
+		pdf.CellFormat(0, 6, fmt.Sprintf("No readings in %d.", rep.Year), "", 1, "L", false, 0, "")
+	}
+	return pdf.Output(w)
+}
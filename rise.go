@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+// riseWindow is the span over which a rise is measured: a reading is
+// compared with the lowest one of the minute before it.
+const riseWindow = time.Minute
+
+// RiseAlertConfig is the built-in alert on a temperature climbing faster
+// than anything but a fire should make it, PerMinute °C per minute (default
+// 10, 0 disables) on every sensor but those matching Exclude. Its alerts
+// go to Notifiers, or the staleness notifiers without any, always critical
+// and urgent.
+type RiseAlertConfig struct {
+	PerMinute float64  `json:"per_minute"`
+	Exclude   []string `json:"exclude"`
+	Notifiers []string `json:"notifiers,omitempty"`
+}
+
+func (c RiseAlertConfig) check() error {
+	if c.PerMinute < 0 {
+		return fmt.Errorf("per_minute must not be negative")
+	}
+	for _, p := range c.Exclude {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("exclude %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func (c RiseAlertConfig) excludes(sensor string) bool {
+	for _, p := range c.Exclude {
+		if ok, _ := path.Match(p, sensor); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c RiseAlertConfig) targets() []string {
+	if len(c.Notifiers) > 0 {
+		return c.Notifiers
+	}
+	return config().Staleness.Notifiers
+}
+
+type riseSensor struct {
+	recent  []lastReading
+	eventID int64
+	firing  bool
+}
+
+// riseMonitor follows every sensor's recent readings for the rise alert.
+type riseMonitor struct {
+	mu      sync.Mutex
+	sensors map[string]*riseSensor
+}
+
+var riseAlerts = &riseMonitor{sensors: map[string]*riseSensor{}}
+
+// rate is how fast a reading at now rose: against the lowest reading of
+// the last riseWindow, counted over the whole window so a jump between
+// two close readings is not blown up into an enormous rate, or against
+// the previous reading over the time since it when that is older.
+func (s *riseSensor) rate(value float64, now time.Time) (float64, bool) {
+	if len(s.recent) == 0 {
+		return 0, false
+	}
+	last := s.recent[len(s.recent)-1]
+	if now.Sub(last.time) > riseWindow {
+		if !now.After(last.time) {
+			return 0, false
+		}
+		return (value - last.value) / now.Sub(last.time).Minutes(), true
+	}
+	low := last.value
+	for _, r := range s.recent {
+		if now.Sub(r.time) <= riseWindow && r.value < low {
+			low = r.value
+		}
+	}
+	return (value - low) / riseWindow.Minutes(), true
+}
+
+// observe checks a reading for a rapid rise, raising or clearing the
+// sensor's alert.
+func (m *riseMonitor) observe(sensor string, value float64, now time.Time) {
+	c := config().RiseAlert
+	// A boiler's water heats up fast as a matter of course, and a heater's
+	// power is no temperature
+	if c.PerMinute <= 0 || c.excludes(sensor) || openthermSensor(sensor) != "" || heaterPowerUnit(sensor) != "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sensors[sensor]
+	if s == nil {
+		s = &riseSensor{}
+		m.sensors[sensor] = s
+	}
+	rate, ok := s.rate(value, now)
+	// The window is all that is kept, besides this reading
+	keep := s.recent[:0]
+	for _, r := range s.recent {
+		if now.Sub(r.time) <= riseWindow {
+			keep = append(keep, r)
+		}
+	}
+	s.recent = append(keep, lastReading{value: value, time: now})
+	if !ok {
+		return
+	}
+
+	a := Alert{
+		ID:        s.eventID,
+		RuleName:  "Rapid temperature rise",
+		Sensor:    sensor,
+		Condition: "rise",
+		Threshold: c.PerMinute,
+		Severity:  "critical",
+		Value:     rate,
+		Time:      now,
+		Urgent:    true,
+	}
+	switch {
+	case rate >= c.PerMinute && !s.firing:
+		log.Printf("Sensor %s rising %.1f°C/min, at or over %.1f°C/min: possible fire", sensor, rate, c.PerMinute)
+		a.State = "firing"
+		id, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		s.firing, s.eventID, a.ID = true, id, id
+	case rate < c.PerMinute && s.firing:
+		log.Printf("Sensor %s no longer rising rapidly", sensor)
+		a.State = "resolved"
+		if err := resolveAlertEvent(s.eventID, value, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		s.firing, s.eventID = false, 0
+	default:
+		return
+	}
+	notify(c.targets(), a)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The year in review covers two years of readings. Rather than grouping
+// every raw reading on each request, complete local days are summed once
+// into daily_readings, and daily_rollup_days records which days are done.
+// A day is summed again after readings were back-dated into it, imported
+// or purged.
+
+// rollupStale holds the days whose marker a back-dated reading already
+// removed, so a burst of them deletes it once.
+var rollupStale = struct {
+	sync.Mutex
+	days map[string]bool
+}{days: map[string]bool{}}
+
+func initRollupTables() {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS daily_readings (
+		day TEXT NOT NULL,
+		sensor TEXT NOT NULL,
+		sum REAL NOT NULL,
+		count INTEGER NOT NULL,
+		min REAL NOT NULL,
+		max REAL NOT NULL,
+		PRIMARY KEY (day, sensor)
+	);`,
+		`CREATE TABLE IF NOT EXISTS daily_rollup_days (
+		day TEXT PRIMARY KEY
+	);`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// localDay is the local calendar day t falls on, as stored in day columns.
+func localDay(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+// rollupCut is the start of today: the days before it are complete.
+func rollupCut() time.Time {
+	now := clock.Now().Local()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// noteRollup forgets the rollup of at's day when a reading lands in a day
+// that is already over, so the next report sums that day again.
+func noteRollup(at time.Time) {
+	if !at.Before(rollupCut()) {
+		return
+	}
+	day := localDay(at)
+	rollupStale.Lock()
+	defer rollupStale.Unlock()
+	if rollupStale.days[day] {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM daily_rollup_days WHERE day = ?", day); err != nil {
+		log.Printf("Error forgetting the daily rollup of %s: %v", day, err)
+		return
+	}
+	rollupStale.days[day] = true
+}
+
+// forgetRollup removes the markers of the days from from to to, either of
+// which may be zero for an open end, inside a purge or import.
+func forgetRollup(tx *sql.Tx, from, to time.Time) error {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if !from.IsZero() {
+		conds = append(conds, "day >= ?")
+		args = append(args, localDay(from))
+	}
+	if !to.IsZero() {
+		conds = append(conds, "day <= ?")
+		args = append(args, localDay(to))
+	}
+	_, err := tx.Exec("DELETE FROM daily_rollup_days WHERE "+strings.Join(conds, " AND "), args...)
+	return err
+}
+
+// ensureRollup sums the complete days from from, a local midnight, up to
+// to or today, whichever is earlier, that are not rolled up yet. It returns
+// where the rolled-up days end; readings from there on are still raw.
+func ensureRollup(ctx context.Context, from, to time.Time) (time.Time, error) {
+	cut := rollupCut()
+	if to.Before(cut) {
+		cut = to
+	}
+	if !from.Before(cut) {
+		return from, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT day FROM daily_rollup_days WHERE day >= ? AND day < ?", localDay(from), localDay(cut))
+	if err != nil {
+		return from, err
+	}
+	done := map[string]bool{}
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return from, err
+		}
+		done[day] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return from, err
+	}
+	var first, end time.Time
+	for d := from; d.Before(cut); d = d.AddDate(0, 0, 1) {
+		if !done[localDay(d)] {
+			if first.IsZero() {
+				first = d
+			}
+			end = d.AddDate(0, 0, 1)
+		}
+	}
+	if first.IsZero() {
+		return cut, nil
+	}
+
+	// Readings back-dated from here on remove the markers set below again
+	rollupStale.Lock()
+	rollupStale.days = map[string]bool{}
+	rollupStale.Unlock()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return from, err
+	}
+	defer tx.Rollback()
+	// Marking first takes the write lock, so no reading slips in between
+	// the sums and the commit unnoticed
+	mark, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO daily_rollup_days (day) VALUES (?)")
+	if err != nil {
+		return from, err
+	}
+	defer mark.Close()
+	for d := first; d.Before(end); d = d.AddDate(0, 0, 1) {
+		if _, err := mark.ExecContext(ctx, localDay(d)); err != nil {
+			return from, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM daily_readings WHERE day >= ? AND day < ?", localDay(first), localDay(end)); err != nil {
+		return from, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO daily_readings (day, sensor, sum, count, min, max)
+		SELECT date(timestamp, 'localtime') AS d, sensor, SUM(temperature), COUNT(*), MIN(temperature), MAX(temperature)
+		FROM temperature_readings
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY sensor, d`, sqliteTime(first), sqliteTime(end)); err != nil {
+		return from, err
+	}
+	if err := tx.Commit(); err != nil {
+		return from, err
+	}
+	return cut, nil
+}
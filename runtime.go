@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// envOr returns the environment variable key, or def when it is unset, so
+// every path and address can be set either by flag or by environment (as
+// container runtimes prefer).
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// jsonLogWriter turns each line written by the standard logger into a JSON
+// object, for log collectors that expect structured output. The logger
+// must have its flags cleared so lines carry only the message.
+type jsonLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(p, "\n"))
+	line, err := json.Marshal(logEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   logLevel(msg),
+		Message: msg,
+	})
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logLevel infers a level from the message conventions used throughout
+// piheat: failures start with "Error", alert deliveries with "Alert:".
+func logLevel(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "Error"):
+		return "error"
+	case strings.HasPrefix(msg, "Alert:"), strings.Contains(msg, " offline"):
+		return "warn"
+	}
+	return "info"
+}
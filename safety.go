@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// relayWatchdog is how often a relay checks its safety limits between
+	// the control loop's requests.
+	relayWatchdog = 10 * time.Second
+	// watchdogStale is how old the newest reading of a relay's sensors may
+	// be before the relay is forced off. It is longer than controlStale,
+	// so the control loop switches off first unless it is at fault. Frost
+	// protection keeps heating without readings, so it is exempt.
+	watchdogStale = controlStale + time.Minute
+	// maxOnRest is how long a relay stays off after max_on without a
+	// min_cycle.
+	maxOnRest = 5 * time.Minute
+)
+
+// checkSafety validates the safety limits of a heater's relay.
+func (hc HeaterConfig) checkSafety() error {
+	if hc.MaxOn.Duration != 0 && hc.MaxOn.Duration < time.Minute {
+		return fmt.Errorf("max_on must be at least 1m")
+	}
+	if hc.MinCycle.Duration < 0 || hc.MinCycle.Duration > time.Hour {
+		return fmt.Errorf("min_cycle must be between 0 and 1h")
+	}
+	return nil
+}
+
+// lastSeen is when sensor last reported, zero if never.
+func (m *sensorMonitor) lastSeen(sensor string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st := m.sensors[sensor]; st != nil {
+		return st.lastSeen
+	}
+	return time.Time{}
+}
+
+// stalled is how long the control loop may go without asking for a
+// relay's state before the relay is forced off.
+func (r *relayActuator) stalled() time.Duration {
+	if d := 3 * r.interval; d > time.Minute {
+		return d
+	}
+	return time.Minute
+}
+
+// limit applies the safety limits to the state the control loop wants,
+// returning the state to switch to and the limit that decided it, if
+// any. The watchdog and max_on switch off at once; min_cycle holds any
+// other change until the relay has been in its state long enough. Heat
+// for frost protection is let through stale sensors, as frostStep keeps
+// a freezing zone heated when its sensor goes quiet.
+func (r *relayActuator) limit(want, frost bool, now time.Time) (bool, string) {
+	hc := r.heater.plug()
+	if r.restUntil.IsZero() && r.on && hc.MaxOn.Duration > 0 && now.Sub(r.onSince) >= hc.MaxOn.Duration {
+		rest := hc.MinCycle.Duration
+		if rest <= 0 {
+			rest = maxOnRest
+		}
+		r.restUntil = now.Add(rest)
+		r.maxOnAlert("firing", now.Sub(r.onSince), hc, now)
+	}
+	if !r.restUntil.IsZero() && !now.Before(r.restUntil) {
+		r.restUntil = time.Time{}
+		r.maxOnAlert("resolved", 0, hc, now)
+	}
+	if want {
+		if now.Sub(r.wantedAt) > r.stalled() {
+			return false, fmt.Sprintf("watchdog: no decision from the control loop since %s", r.wantedAt.Local().Format("15:04:05"))
+		}
+		var newest time.Time
+		for _, s := range r.sensors {
+			if t := sensorsMonitor.lastSeen(s); t.After(newest) {
+				newest = t
+			}
+		}
+		if now.Sub(newest) > watchdogStale && !frost {
+			since := "start"
+			if !newest.IsZero() {
+				since = newest.Local().Format("15:04:05")
+			}
+			return false, fmt.Sprintf("watchdog: no reading from %s since %s", strings.Join(r.sensors, ", "), since)
+		}
+		if !r.restUntil.IsZero() {
+			return false, fmt.Sprintf("max_on: on for %s, off until %s", hc.MaxOn.Duration, r.restUntil.Local().Format("15:04:05"))
+		}
+	}
+	if want != r.on && !r.changedAt.IsZero() && now.Sub(r.changedAt) < hc.MinCycle.Duration {
+		return r.on, fmt.Sprintf("min_cycle: stays %s until %s", onOff(r.on), r.changedAt.Add(hc.MinCycle.Duration).Local().Format("15:04:05"))
+	}
+	return want, ""
+}
+
+// maxOnAlert records a relay cut off by max_on in the alert history and
+// notifies the heater's notifiers; it resolves once the rest is over.
+func (r *relayActuator) maxOnAlert(state string, on time.Duration, hc HeaterConfig, now time.Time) {
+	a := Alert{
+		ID:        r.maxOnEvent,
+		RuleName:  "Heater safety limit",
+		Sensor:    r.heater.name,
+		Condition: "max-on",
+		Threshold: hc.MaxOn.Seconds(),
+		Severity:  "warning",
+		Value:     on.Round(time.Second).Seconds(),
+		State:     state,
+		Time:      now,
+	}
+	if state == "firing" {
+		log.Printf("Heater %s: %s", r.heater.name, a.Summary())
+		id, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		r.maxOnEvent, a.ID = id, id
+	} else {
+		if r.maxOnEvent == 0 {
+			return
+		}
+		if err := resolveAlertEvent(r.maxOnEvent, 0, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		r.maxOnEvent = 0
+	}
+	go notify(hc.Notifiers, a)
+}
+
+// setLimit records the safety limit holding the heater's relay, for
+// /api/heaters, and logs when it changes.
+func (h *heaterCheck) setLimit(limit string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if limit == h.limit {
+		return
+	}
+	if limit == "" {
+		log.Printf("Heater %s: safety limit lifted", h.name)
+	} else if strings.SplitN(limit, ":", 2)[0] != strings.SplitN(h.limit, ":", 2)[0] {
+		log.Printf("Heater %s: %s", h.name, limit)
+	}
+	h.limit = limit
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	seasonWinter = "winter"
+	seasonSummer = "summer"
+	// seasonCheckInterval is how often the season is worked out again.
+	seasonCheckInterval = time.Hour
+	// seasonHeld is the reason zones give while heating is off for the
+	// summer.
+	seasonHeld = "summer mode"
+)
+
+// SeasonConfig switches heating control off for the summer. With
+// SummerFrom and SummerTo, as MM-DD, summer is the days between them;
+// otherwise it starts once the daily mean of the outdoor sensor has been
+// at least SummerAbove (default 15°C) for Days (default 3) days running
+// and ends once it has been below WinterBelow (default 12°C) as long.
+type SeasonConfig struct {
+	SummerAbove float64 `json:"summer_above,omitempty"`
+	WinterBelow float64 `json:"winter_below,omitempty"`
+	Days        int     `json:"days,omitempty"`
+	SummerFrom  string  `json:"summer_from,omitempty"`
+	SummerTo    string  `json:"summer_to,omitempty"`
+}
+
+func (c *SeasonConfig) check(outdoorSensor string) error {
+	if c.SummerAbove == 0 && c.WinterBelow == 0 {
+		c.SummerAbove, c.WinterBelow = 15, 12
+	}
+	if c.Days == 0 {
+		c.Days = 3
+	}
+	if c.Days < 1 || c.Days > 30 {
+		return fmt.Errorf("days must be between 1 and 30")
+	}
+	if c.WinterBelow > c.SummerAbove {
+		return fmt.Errorf("winter_below must not be above summer_above")
+	}
+	if (c.SummerFrom == "") != (c.SummerTo == "") {
+		return fmt.Errorf("summer_from and summer_to go together")
+	}
+	if c.SummerFrom == "" {
+		if outdoorSensor == "" {
+			return fmt.Errorf("outdoor_sensor, or summer_from and summer_to, is required")
+		}
+		return nil
+	}
+	for _, d := range []string{c.SummerFrom, c.SummerTo} {
+		if _, err := time.Parse("01-02", d); err != nil {
+			return fmt.Errorf("%q is not a MM-DD date", d)
+		}
+	}
+	return nil
+}
+
+// DailyMean is a local day's mean outdoor temperature.
+type DailyMean struct {
+	Date        string  `json:"date"`
+	Temperature float64 `json:"temperature"`
+}
+
+// SeasonStatus is the GET /api/season response. Mode is the one in
+// effect: Override when one is set, otherwise Detected.
+type SeasonStatus struct {
+	Mode       string      `json:"mode"`
+	Detected   string      `json:"detected"`
+	Override   string      `json:"override,omitempty"`
+	Since      time.Time   `json:"since"`
+	Reason     string      `json:"reason"`
+	DailyMeans []DailyMean `json:"dailyMeans,omitempty"`
+}
+
+type seasonState struct {
+	mu       sync.Mutex
+	cfg      SeasonConfig
+	detected string
+	// detectedWhy is why the detected season was detected.
+	detectedWhy string
+	override    string
+	mode        string
+	since       time.Time
+	reason      string
+	means       []DailyMean
+}
+
+// season is nil unless season is configured, and heating then never
+// stops for the summer.
+var season *seasonState
+
+func initSeasonTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS season (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		detected TEXT NOT NULL,
+		override TEXT NOT NULL DEFAULT '',
+		mode TEXT NOT NULL,
+		since DATETIME NOT NULL,
+		reason TEXT NOT NULL DEFAULT ''
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// setupSeason takes the season section of the config and the season
+// stored at the last change, so a restart keeps it.
+func setupSeason(c *SeasonConfig) error {
+	if c == nil {
+		return nil
+	}
+	s := &seasonState{cfg: *c, detected: seasonWinter, mode: seasonWinter, since: time.Now().UTC().Truncate(time.Second),
+		reason: "no season worked out yet"}
+	var since string
+	err := db.QueryRow("SELECT detected, override, mode, since, reason FROM season WHERE id = 1").
+		Scan(&s.detected, &s.override, &s.mode, &since, &s.reason)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		s.since, _ = parseSQLiteTime(since)
+	}
+	season = s
+	return nil
+}
+
+func (s *seasonState) save() error {
+	_, err := db.Exec(`INSERT INTO season (id, detected, override, mode, since, reason) VALUES (1, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET detected = excluded.detected, override = excluded.override, mode = excluded.mode,
+		since = excluded.since, reason = excluded.reason`, s.detected, s.override, s.mode, sqliteTime(s.since), s.reason)
+	return err
+}
+
+// summer reports whether heating is off for the summer, and why.
+func (s *seasonState) summer() (bool, string) {
+	if s == nil {
+		return false, ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode == seasonSummer, s.reason
+}
+
+func (s *seasonState) status() SeasonStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SeasonStatus{Mode: s.mode, Detected: s.detected, Override: s.override, Since: s.since, Reason: s.reason,
+		DailyMeans: append([]DailyMean(nil), s.means...)}
+}
+
+func (s *seasonState) start() {
+	go func() {
+		s.check(clock.Now())
+		ticker := clock.NewTicker(seasonCheckInterval)
+		defer ticker.Stop()
+		for now := range ticker.C() {
+			s.check(now)
+		}
+	}()
+}
+
+// check works out the season again and switches to it.
+func (s *seasonState) check(now time.Time) {
+	detected, reason, means, err := s.detect(now)
+	if err != nil {
+		log.Printf("Error working out the season: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.means = means
+	if detected == "" {
+		// Not sustained either way: the season carries on
+		detected, reason = s.detected, s.detectedWhy
+	}
+	s.detected, s.detectedWhy = detected, reason
+	if s.override == "" && detected != s.mode {
+		s.enter(detected, reason, now)
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Error saving the season: %v", err)
+	}
+}
+
+// detect returns the season the dates or the outdoor temperature call
+// for, or none while the temperature is not sustained either way.
+func (s *seasonState) detect(now time.Time) (string, string, []DailyMean, error) {
+	c := s.cfg
+	local := now.In(time.Local)
+	if c.SummerFrom != "" {
+		today := local.Format("01-02")
+		summer := today >= c.SummerFrom && today <= c.SummerTo
+		if c.SummerFrom > c.SummerTo {
+			summer = today >= c.SummerFrom || today <= c.SummerTo
+		}
+		if summer {
+			return seasonSummer, fmt.Sprintf("summer from %s to %s", c.SummerFrom, c.SummerTo), nil, nil
+		}
+		return seasonWinter, fmt.Sprintf("outside summer from %s to %s", c.SummerFrom, c.SummerTo), nil, nil
+	}
+
+	y, m, d := local.Date()
+	to := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	from := to.AddDate(0, 0, -c.Days)
+	rows, err := db.Query(`SELECT date(timestamp, 'localtime') AS day, AVG(temperature) FROM temperature_readings
+		WHERE sensor = ? AND timestamp >= ? AND timestamp < ? GROUP BY day ORDER BY day`,
+		config().OutdoorSensor, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer rows.Close()
+	var means []DailyMean
+	for rows.Next() {
+		var dm DailyMean
+		if err := rows.Scan(&dm.Date, &dm.Temperature); err != nil {
+			return "", "", nil, err
+		}
+		dm.Temperature = roundReading(config().OutdoorSensor, dm.Temperature)
+		means = append(means, dm)
+	}
+	if err := rows.Err(); err != nil {
+		return "", "", nil, err
+	}
+	// A day without readings breaks the run
+	if len(means) < c.Days {
+		return "", "", means, nil
+	}
+	warm, cold := true, true
+	for _, dm := range means {
+		warm = warm && dm.Temperature >= c.SummerAbove
+		cold = cold && dm.Temperature < c.WinterBelow
+	}
+	switch {
+	case warm:
+		return seasonSummer, fmt.Sprintf("daily mean of %s at least %.1f°C for %d days", config().OutdoorSensor, c.SummerAbove, c.Days), means, nil
+	case cold:
+		return seasonWinter, fmt.Sprintf("daily mean of %s below %.1f°C for %d days", config().OutdoorSensor, c.WinterBelow, c.Days), means, nil
+	}
+	return "", "", means, nil
+}
+
+// enter switches to a season and announces it. It is called with s.mu
+// held.
+func (s *seasonState) enter(mode, reason string, now time.Time) {
+	s.mode, s.since, s.reason = mode, now.UTC().Truncate(time.Second), reason
+	if err := s.save(); err != nil {
+		log.Printf("Error saving the season: %v", err)
+	}
+	log.Printf("Season: %s mode entered: %s", mode, reason)
+	state := "firing"
+	if mode == seasonWinter {
+		state = "resolved"
+	}
+	go notify(config().Staleness.Notifiers, Alert{
+		RuleName:  "Season",
+		Sensor:    reason,
+		Condition: "season",
+		Severity:  "info",
+		State:     state,
+		Time:      now,
+	})
+}
+
+// setOverride fixes the season, or with "" hands it back to detection.
+func (s *seasonState) setOverride(mode string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.override = mode
+	want, reason := s.detected, s.detectedWhy
+	if reason == "" {
+		reason = "set back to automatic"
+	}
+	if mode != "" {
+		want, reason = mode, "set by hand"
+	}
+	if want != s.mode {
+		s.enter(want, reason, now)
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Error saving the season: %v", err)
+	}
+}
+
+// heatingAlert reports whether a rule warns of a zone getting cold, which
+// is expected while heating is off for the summer.
+func heatingAlert(r AlertRule, sensor string) bool {
+	return r.Condition == "below" && len(controller.bySensor[sensor]) > 0
+}
+
+// seasonHandler serves GET and PUT /api/season.
+func seasonHandler(w http.ResponseWriter, r *http.Request) {
+	if season == nil {
+		http.Error(w, "No season configured", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, season.status())
+	case http.MethodPut:
+		var req struct {
+			Override string `json:"override"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		mode := strings.ToLower(req.Override)
+		if mode == "auto" {
+			mode = ""
+		}
+		if mode != "" && mode != seasonSummer && mode != seasonWinter {
+			http.Error(w, "override must be summer, winter or auto", http.StatusBadRequest)
+			return
+		}
+		old := season.status().Override
+		season.setOverride(mode, clock.Now())
+		auditRequest(r, "season.override", "", old, mode)
+		writeJSON(w, http.StatusOK, season.status())
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSeasonMetrics(b *strings.Builder) {
+	if season == nil {
+		return
+	}
+	summer, _ := season.summer()
+	v := 0
+	if summer {
+		v = 1
+	}
+	b.WriteString("# HELP piheat_season_summer Whether heating control is off for the summer.\n")
+	b.WriteString("# TYPE piheat_season_summer gauge\n")
+	fmt.Fprintf(b, "piheat_season_summer %d\n", v)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SelfTestConfig selects the optional start-up checks. With Notifiers set,
+// the host of every notifier is resolved and connected to, without sending
+// anything.
+type SelfTestConfig struct {
+	Notifiers bool `json:"notifiers"`
+}
+
+// SelfTestCheck is the outcome of one start-up check. A failed critical
+// check keeps heating control off.
+type SelfTestCheck struct {
+	Name       string  `json:"name"`
+	Critical   bool    `json:"critical"`
+	OK         bool    `json:"ok"`
+	Detail     string  `json:"detail,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// SelfTestReport is what /api/selftest returns. Control is "enabled",
+// "disabled" after a failed critical check, "off" without zones or
+// "read-only".
+type SelfTestReport struct {
+	RanAt   time.Time       `json:"ranAt"`
+	Passed  bool            `json:"passed"`
+	Control string          `json:"control"`
+	Checks  []SelfTestCheck `json:"checks"`
+}
+
+var selfTest struct {
+	sync.Mutex
+	report SelfTestReport
+}
+
+// runSelfTest checks the database, the sensors, the heaters and optionally
+// the notifiers, logs each result and keeps the report for /api/selftest.
+// Heaters of zones are switched off on the way, so control starts from a
+// known state; in read-only mode nothing is switched.
+func runSelfTest() SelfTestReport {
+	rep := SelfTestReport{RanAt: time.Now().UTC().Truncate(time.Second), Passed: true}
+	check := func(name string, critical bool, fn func() (string, error)) {
+		start := time.Now()
+		detail, err := fn()
+		c := SelfTestCheck{Name: name, Critical: critical, OK: err == nil, Detail: detail,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			c.Error = err.Error()
+			if critical {
+				rep.Passed = false
+			}
+			log.Printf("Self-test: %s failed: %v", name, err)
+		} else if detail != "" {
+			log.Printf("Self-test: %s ok (%s)", name, detail)
+		} else {
+			log.Printf("Self-test: %s ok", name)
+		}
+		rep.Checks = append(rep.Checks, c)
+	}
+
+	check("database", true, selfTestDatabase)
+
+	zoneSensors := map[string]bool{}
+	controlled := map[string]bool{}
+	for _, z := range controller.zones {
+		zoneSensors[z.cfg.Sensor] = true
+		for _, r := range z.relays {
+			controlled[r.heater.name] = true
+		}
+	}
+	for _, b := range controller.boilers {
+		controlled[b.relay.heater.name] = true
+	}
+	// The CPU is the only sensor piheat reads itself; the others report
+	// on their own, and a zone without a recent reading stays off anyway
+	check("sensor cpu", zoneSensors["cpu"], func() (string, error) {
+		t, err := getTemperature()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%.1f°C", t), nil
+	})
+	for _, z := range controller.zones {
+		if z.cfg.Sensor == "cpu" {
+			continue
+		}
+		sensor := z.cfg.Sensor
+		check("sensor "+sensor, false, func() (string, error) {
+			sensorsMonitor.mu.Lock()
+			st, ok := sensorsMonitor.sensors[sensor]
+			var last time.Time
+			if ok {
+				last = st.lastSeen
+			}
+			sensorsMonitor.mu.Unlock()
+			if !ok {
+				return "", fmt.Errorf("no reading yet; zone %s stays off until one arrives", z.name)
+			}
+			return "last reading " + last.Local().Format("2006-01-02 15:04:05"), nil
+		})
+	}
+
+	for _, h := range heaters {
+		h := h
+		// A failover hub starts without control and leaves the heaters
+		// to its peer until it takes it
+		if controlled[h.name] && !readOnly && failover == nil {
+			check("heater "+h.name, true, func() (string, error) { return selfTestSwitchOff(h) })
+			continue
+		}
+		check("heater "+h.name, false, func() (string, error) { return selfTestPlug(h) })
+	}
+
+	if config().SelfTest.Notifiers {
+		for _, name := range notifierNames() {
+			nc, ok := config().Notifiers[name]
+			if !ok {
+				continue
+			}
+			check("notifier "+name, false, func() (string, error) { return selfTestNotifier(nc) })
+		}
+	}
+
+	switch {
+	case readOnly:
+		rep.Control = "read-only"
+	case len(controller.zones) == 0:
+		rep.Control = "off"
+	case rep.Passed:
+		rep.Control = "enabled"
+	default:
+		rep.Control = "disabled"
+		controller.hold("self-test failed")
+		log.Printf("Self-test failed: heating control stays off, see /api/v1/selftest")
+	}
+	selfTest.Lock()
+	selfTest.report = rep
+	selfTest.Unlock()
+	return rep
+}
+
+// selfTestDatabase writes a reading where new ones go and rolls it back.
+func selfTestDatabase() (string, error) {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		return "", err
+	}
+	if readOnly {
+		return "read-only", nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO "+readingsTableFor(time.Now())+" (sensor, temperature, timestamp) VALUES ('selftest', 0, ?)", sqliteTime(time.Now())); err != nil {
+		return "", fmt.Errorf("writing: %v", err)
+	}
+	return "writable", nil
+}
+
+// selfTestSwitchOff switches a zone's heater off and, for plugs polled over
+// HTTP, reads back that the relay is off.
+func selfTestSwitchOff(h *heaterCheck) (string, error) {
+	if h.cfg.Topic != "" {
+		if err := waitMQTT(10 * time.Second); err != nil {
+			return "", err
+		}
+	}
+	if err := switchPlug(h.cfg, false); err != nil {
+		return "", fmt.Errorf("switching off: %v", err)
+	}
+	if h.cfg.Topic != "" {
+		return "switched off", nil
+	}
+	st, err := fetchPlugStatus(h.cfg)
+	if err != nil {
+		return "", fmt.Errorf("reading back: %v", err)
+	}
+	if st.relayOn {
+		return "", fmt.Errorf("relay still on after switching off")
+	}
+	switch h.cfg.Type {
+	case "opentherm":
+		return "central heating off", nil
+	case "gpio", "simulated":
+		return "switched off", nil
+	}
+	return "switched off, " + plugPower(st), nil
+}
+
+// selfTestPlug checks that a heater piheat only monitors can be reached.
+func selfTestPlug(h *heaterCheck) (string, error) {
+	if h.cfg.Topic != "" {
+		if err := waitMQTT(10 * time.Second); err != nil {
+			return "", err
+		}
+		return "mqtt connected", nil
+	}
+	st, err := fetchPlugStatus(h.cfg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("relay %s, %s", onOff(st.relayOn), plugPower(st)), nil
+}
+
+func plugPower(st plugStatus) string {
+	if !st.hasPower {
+		return "no power meter"
+	}
+	return fmt.Sprintf("%.0f W", st.power)
+}
+
+func waitMQTT(timeout time.Duration) error {
+	c, err := mqttClient()
+	if err != nil {
+		return err
+	}
+	for deadline := time.Now().Add(timeout); !c.IsConnected(); time.Sleep(200 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not connected to mqtt broker %s", config().MQTT.Broker)
+		}
+	}
+	return nil
+}
+
+// selfTestNotifier resolves and connects to the notifier's server.
+func selfTestNotifier(nc NotifierConfig) (string, error) {
+	target := nc.URL
+	switch nc.Type {
+	case "log":
+		return "", nil
+	case "pushover":
+		target = pushoverAPI
+	case "ntfy":
+		if target == "" {
+			target = "https://ntfy.sh"
+		}
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(u.Hostname(), port), 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return "reached " + u.Host, nil
+}
+
+// selfTestHandler serves GET /api/selftest, the result of the start-up
+// self-test.
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	selfTest.Lock()
+	rep := selfTest.report
+	selfTest.Unlock()
+	writeJSON(w, http.StatusOK, rep)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SensorStatus is what /api/sensors reports for each known sensor. Unit
+// is only set for derived metrics and pressure; other sensors are in °C.
+type SensorStatus struct {
+	Name         string           `json:"name"`
+	LastValue    float64          `json:"lastValue"`
+	LastSeen     time.Time        `json:"lastSeen"`
+	LastSource   string           `json:"lastSource"`
+	Interval     Duration         `json:"interval"`
+	Online       bool             `json:"online"`
+	OfflineSince *time.Time       `json:"offlineSince,omitempty"`
+	Unit         string           `json:"unit,omitempty"`
+	Rejected     map[string]int64 `json:"rejected,omitempty"`
+}
+
+type sensorState struct {
+	value    float64
+	lastSeen time.Time
+	source   string
+	interval time.Duration
+	offline  bool
+	eventID  int64
+}
+
+// sensorMonitor tracks when each sensor last reported and marks it offline
+// once it has been silent for staleness.factor times its usual interval.
+// The interval is learned from the gaps between readings, so remote
+// sensors reporting on their own schedule are judged by their own cadence.
+type sensorMonitor struct {
+	mu      sync.Mutex
+	sensors map[string]*sensorState
+	// expected is the interval of sensors on a known schedule, which they
+	// start from instead of sample_interval.
+	expected map[string]time.Duration
+	// resumed is the end of an outage. Sensors last seen before it are
+	// judged from then, as they could not report while piheat was down.
+	resumed time.Time
+}
+
+var sensorsMonitor = &sensorMonitor{sensors: map[string]*sensorState{}, expected: map[string]time.Duration{}}
+
+// expect sets the interval a sensor on a known schedule is judged by
+// until it has one of its own.
+func (m *sensorMonitor) expect(sensor string, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expected[sensor] = interval
+	if st := m.sensors[sensor]; st != nil && st.interval < interval {
+		st.interval = interval
+	}
+}
+
+// lastValue is a sensor's latest reading and when it was taken, ok
+// false if it never reported.
+func (m *sensorMonitor) lastValue(sensor string) (value float64, at time.Time, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st := m.sensors[sensor]; st != nil {
+		return st.value, st.lastSeen, true
+	}
+	return 0, time.Time{}, false
+}
+
+// resume judges the sensors from the end of an outage rather than from
+// their last reading before it.
+func (m *sensorMonitor) resume(at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resumed = at
+}
+
+// since is when a sensor's silence started counting.
+func (m *sensorMonitor) since(st *sensorState) time.Time {
+	if st.lastSeen.Before(m.resumed) {
+		return m.resumed
+	}
+	return st.lastSeen
+}
+
+func (m *sensorMonitor) startInterval(sensor string) time.Duration {
+	if d, ok := m.expected[sensor]; ok {
+		return d
+	}
+	return config().SampleInterval.Duration
+}
+
+// seed loads the last reading of every sensor so sensors that stopped
+// reporting before a restart are still noticed.
+func (m *sensorMonitor) seed() error {
+	rows, err := db.Query("SELECT sensor, temperature, source, MAX(timestamp) FROM temperature_readings GROUP BY sensor")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for rows.Next() {
+		var name, source string
+		var value float64
+		var lastStr string
+		if err := rows.Scan(&name, &value, &source, &lastStr); err != nil {
+			return err
+		}
+		last, err := parseSQLiteTime(lastStr)
+		if err != nil {
+			continue
+		}
+		m.sensors[name] = &sensorState{value: value, lastSeen: last, source: source, interval: m.startInterval(name)}
+	}
+	return rows.Err()
+}
+
+func (m *sensorMonitor) observe(sensor string, value float64, source string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.sensors[sensor]
+	if st == nil {
+		st = &sensorState{interval: m.startInterval(sensor)}
+		m.sensors[sensor] = st
+	} else if gap := now.Sub(st.lastSeen); gap > 0 && !st.offline && !st.lastSeen.Before(m.resumed) {
+		// Smooth the learned interval so one late reading does not move it much
+		st.interval = (st.interval*7 + gap) / 8
+	}
+	st.value = value
+	st.lastSeen = now
+	st.source = source
+	if st.offline {
+		st.offline = false
+		m.changed(sensor, st, "resolved", now)
+	}
+}
+
+func (m *sensorMonitor) run(interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C() {
+		m.check(now)
+	}
+}
+
+// follow keeps a read-only instance up to date by reloading the latest
+// readings another instance recorded, instead of observing them.
+func (m *sensorMonitor) follow(interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		if err := m.seed(); err != nil {
+			log.Printf("Error loading sensors: %v", err)
+		}
+	}
+}
+
+func (m *sensorMonitor) check(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, st := range m.sensors {
+		if !st.offline && now.Sub(m.since(st)) > m.staleAfter(st) {
+			st.offline = true
+			m.changed(name, st, "firing", now)
+		}
+	}
+}
+
+func (m *sensorMonitor) staleAfter(st *sensorState) time.Duration {
+	return time.Duration(config().Staleness.Factor * float64(st.interval))
+}
+
+// changed records the offline/online transition in the alert history and
+// notifies the staleness notifiers.
+func (m *sensorMonitor) changed(name string, st *sensorState, state string, now time.Time) {
+	a := Alert{
+		ID:        st.eventID,
+		RuleName:  "Sensor offline",
+		Sensor:    name,
+		Condition: "missing",
+		Severity:  "warning",
+		Value:     st.value,
+		State:     state,
+		Time:      now,
+	}
+	if state == "firing" {
+		log.Printf("Sensor %s offline: no reading since %s", name, st.lastSeen.Format(time.RFC3339))
+		id, err := insertAlertEvent(a)
+		if err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		st.eventID, a.ID = id, id
+	} else {
+		log.Printf("Sensor %s back online", name)
+		if err := resolveAlertEvent(st.eventID, st.value, now); err != nil {
+			log.Printf("Error saving alert history: %v", err)
+		}
+		st.eventID = 0
+	}
+	notify(config().Staleness.Notifiers, a)
+}
+
+func (m *sensorMonitor) statuses(now time.Time) []SensorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]SensorStatus, 0, len(m.sensors))
+	rejected := rejectedReadings()
+	for name, st := range m.sensors {
+		s := SensorStatus{
+			Name:       name,
+			LastValue:  roundReading(name, st.value),
+			LastSeen:   st.lastSeen,
+			LastSource: st.source,
+			Interval:   Duration{st.interval.Round(time.Second)},
+			Online:     now.Sub(m.since(st)) <= m.staleAfter(st),
+			Unit:       sensorUnit(name),
+			Rejected:   rejected[name],
+		}
+		if !s.Online {
+			since := m.since(st).Add(m.staleAfter(st))
+			s.OfflineSince = &since
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// sensorUnit is the unit of a sensor that is not a temperature.
+func sensorUnit(sensor string) string {
+	if u := derived.unit(sensor); u != "" {
+		return u
+	}
+	if u := openthermUnit(sensor); u != "" {
+		return u
+	}
+	if u := heaterPowerUnit(sensor); u != "" {
+		return u
+	}
+	return pressureUnit(sensor)
+}
+
+func sensorsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, sensorsMonitor.statuses(clock.Now()))
+}
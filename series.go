@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// seriesMaxIDs is how many series one request may ask for.
+	seriesMaxIDs = 10
+	// seriesMaxPoints is how many grid points a request may span.
+	seriesMaxPoints = 2000
+	// seriesTargetPoints is about how many points the default step gives.
+	seriesTargetPoints = 300
+)
+
+// seriesSteps are the steps /api/series picks from without step, the
+// smallest giving at most seriesTargetPoints.
+var seriesSteps = []time.Duration{
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// Series is one metric of /api/series, a value per point of the grid.
+// Sensors have their readings averaged over each step, null where there
+// are none; heaters and TRVs the share of each step they were on, or
+// their mean opening.
+type Series struct {
+	ID     string     `json:"id"`
+	Kind   string     `json:"kind"`
+	Name   string     `json:"name"`
+	Unit   string     `json:"unit,omitempty"`
+	Values []*float64 `json:"values"`
+}
+
+// SeriesResponse is the answer of /api/series: the grid, as the Unix time
+// each step starts, and the series on it in the order asked for.
+type SeriesResponse struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Step   Duration  `json:"step"`
+	Times  []int64   `json:"times"`
+	Series []Series  `json:"series"`
+}
+
+// parseSeriesID splits an identifier into its kind and name; a bare name
+// is a sensor.
+func parseSeriesID(id string) (kind, name string, err error) {
+	kind, name = "sensor", id
+	if i := strings.Index(id, ":"); i >= 0 {
+		switch id[:i] {
+		case "sensor", actuatorHeater, actuatorTRV:
+			kind, name = id[:i], id[i+1:]
+		}
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("empty series id %q", id)
+	}
+	switch kind {
+	case actuatorHeater:
+		if _, ok := config().Heaters[name]; !ok {
+			return "", "", fmt.Errorf("unknown heater %q", name)
+		}
+	case actuatorTRV:
+		if _, ok := config().TRVs[name]; !ok {
+			return "", "", fmt.Errorf("unknown TRV %q", name)
+		}
+	}
+	return kind, name, nil
+}
+
+// seriesStep is the smallest of seriesSteps that covers from to to in at
+// most seriesTargetPoints.
+func seriesStep(from, to time.Time) time.Duration {
+	for _, step := range seriesSteps {
+		if to.Sub(from)/step < seriesTargetPoints {
+			return step
+		}
+	}
+	return seriesSteps[len(seriesSteps)-1]
+}
+
+// sensorSeries averages a sensor's readings into the steps of the grid
+// starting at start.
+func sensorSeries(ctx context.Context, sensor string, start, to time.Time, step time.Duration, n int) ([]*float64, error) {
+	defer timeQuery("series")()
+	values := make([]*float64, n)
+	secs := int64(step / time.Second)
+	rows, err := db.QueryContext(ctx, `SELECT (CAST(strftime('%s', timestamp) AS INTEGER) - ?) / ? AS b, AVG(temperature)
+		FROM temperature_readings WHERE sensor = ? AND timestamp >= ? AND timestamp < ? GROUP BY b ORDER BY b`,
+		start.Unix(), secs, sensor, sqliteTime(start), sqliteTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b int64
+		var v float64
+		if err := rows.Scan(&b, &v); err != nil {
+			return nil, err
+		}
+		if b >= 0 && b < int64(n) {
+			v = roundReading(sensor, v)
+			values[b] = &v
+		}
+	}
+	return values, rows.Err()
+}
+
+// actuatorSeries is the mean duty of an actuator over each step of the
+// grid, from its logged states.
+func actuatorSeries(ctx context.Context, key actuatorKey, starts []time.Time, to time.Time) ([]*float64, error) {
+	hours, _, err := actuatorRuntime(ctx, key, starts, to, nil)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*float64, len(starts))
+	for i, h := range hours {
+		end := to
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		if span := end.Sub(starts[i]).Hours(); span > 0 {
+			v := round3(h / span)
+			values[i] = &v
+		}
+	}
+	return values, nil
+}
+
+// seriesHandler serves GET /api/series, several sensors and actuators
+// resampled onto one grid so a chart can overlay them.
+func seriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var ids []string
+	for _, v := range q["ids"] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > seriesMaxIDs {
+		http.Error(w, fmt.Sprintf("At most %d ids", seriesMaxIDs), http.StatusBadRequest)
+		return
+	}
+	kinds, names := make([]string, len(ids)), make([]string, len(ids))
+	for i, id := range ids {
+		var err error
+		if kinds[i], names[i], err = parseSeriesID(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	to := clock.Now()
+	from := to.Add(-24 * time.Hour)
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s: must be RFC3339", param), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	step := seriesStep(from, to)
+	if v := q.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute || d%time.Minute != 0 {
+			http.Error(w, "step must be a whole number of minutes, at least 1m", http.StatusBadRequest)
+			return
+		}
+		step = d
+	}
+	// The grid is aligned to whole steps, so the same step gives the same
+	// points whatever from is
+	start := from.Truncate(step)
+	n := int((to.Sub(start) + step - 1) / step)
+	if n > seriesMaxPoints {
+		http.Error(w, fmt.Sprintf("At most %d points; use a larger step", seriesMaxPoints), http.StatusBadRequest)
+		return
+	}
+	resp := SeriesResponse{From: start.UTC(), To: to.UTC(), Step: Duration{step}, Times: make([]int64, n), Series: []Series{}}
+	starts := make([]time.Time, n)
+	for i := range starts {
+		starts[i] = start.Add(time.Duration(i) * step)
+		resp.Times[i] = starts[i].Unix()
+	}
+	for i, id := range ids {
+		s := Series{ID: id, Kind: kinds[i], Name: names[i]}
+		var err error
+		if s.Kind == "sensor" {
+			s.Unit = sensorUnit(s.Name)
+			s.Values, err = sensorSeries(r.Context(), s.Name, start, to, step, n)
+		} else {
+			s.Values, err = actuatorSeries(r.Context(), actuatorKey{s.Kind, s.Name}, starts, to)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		resp.Series = append(resp.Series, s)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, resp)
+}
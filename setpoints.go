@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Setpoints are limited to a range that makes sense for a room, so a typo
+// cannot ask for 210°C.
+const (
+	setpointMin = 5.0
+	setpointMax = 35.0
+)
+
+// Setpoint is the target temperature of a heating zone.
+type Setpoint struct {
+	Zone        string    `json:"zone"`
+	Temperature float64   `json:"temperature"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func initSetpointTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS setpoints (
+		zone TEXT PRIMARY KEY,
+		temperature REAL NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func validateSetpoint(zone string, temp float64) error {
+	if zone == "" || strings.Contains(zone, "/") {
+		return fmt.Errorf("zone must be a non-empty name without '/'")
+	}
+	if math.IsNaN(temp) || temp < setpointMin || temp > setpointMax {
+		return fmt.Errorf("temperature must be between %.0f and %.0f°C", setpointMin, setpointMax)
+	}
+	return nil
+}
+
+func listSetpoints() ([]Setpoint, error) {
+	rows, err := db.Query("SELECT zone, temperature, updated_at FROM setpoints ORDER BY zone")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	setpoints := []Setpoint{}
+	for rows.Next() {
+		var sp Setpoint
+		if err := rows.Scan(&sp.Zone, &sp.Temperature, &sp.UpdatedAt); err != nil {
+			return nil, err
+		}
+		sp.UpdatedAt = sp.UpdatedAt.UTC()
+		setpoints = append(setpoints, sp)
+	}
+	return setpoints, rows.Err()
+}
+
+func getSetpoint(zone string) (Setpoint, error) {
+	sp := Setpoint{Zone: zone}
+	err := db.QueryRow("SELECT temperature, updated_at FROM setpoints WHERE zone = ?", zone).Scan(&sp.Temperature, &sp.UpdatedAt)
+	sp.UpdatedAt = sp.UpdatedAt.UTC()
+	return sp, err
+}
+
+// setSetpoint stores a zone's setpoint; it is shared by the HTTP and gRPC
+// APIs.
+func setSetpoint(zone string, temp float64) (Setpoint, error) {
+	sp := Setpoint{Zone: zone, Temperature: temp, UpdatedAt: time.Now().UTC().Truncate(time.Second)}
+	_, err := db.Exec(`INSERT INTO setpoints (zone, temperature, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(zone) DO UPDATE SET temperature = excluded.temperature, updated_at = excluded.updated_at`,
+		zone, temp, sqliteTime(sp.UpdatedAt))
+	if err != nil {
+		return sp, err
+	}
+	controller.setSetpoint(zone, temp)
+	log.Printf("Setpoint of %s set to %.1f°C", zone, temp)
+	return sp, nil
+}
+
+// currentSetpointValue is a zone's setpoint for the audit log, nil when it
+// has none.
+func currentSetpointValue(zone string) interface{} {
+	if sp, err := getSetpoint(zone); err == nil {
+		return sp.Temperature
+	}
+	return nil
+}
+
+// setpointsHandler serves GET /api/setpoints and GET/PUT
+// /api/setpoints/{zone}.
+func setpointsHandler(w http.ResponseWriter, r *http.Request) {
+	zone := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/setpoints"), "/")
+	if zone == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		setpoints, err := listSetpoints()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, setpoints)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sp, err := getSetpoint(zone)
+		if err != nil {
+			http.Error(w, "Setpoint not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, sp)
+	case http.MethodPut:
+		var body struct {
+			Temperature *float64 `json:"temperature"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Temperature == nil {
+			http.Error(w, "Invalid request: temperature is required", http.StatusBadRequest)
+			return
+		}
+		if err := validateSetpoint(zone, *body.Temperature); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		old := currentSetpointValue(zone)
+		sp, err := setSetpoint(zone, *body.Temperature)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error saving setpoint: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, "setpoint.set", zone, old, sp.Temperature)
+		writeJSON(w, http.StatusOK, sp)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
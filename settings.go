@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// settingNames are the config options that can be changed from the
+// settings page. Stored values take precedence over the config file.
+var settingNames = []string{"sample_interval", "thresholds", "units", "retention_days", "notifiers", "theme"}
+
+// settingsMask stands in for notifier credentials in responses. Sending it
+// back keeps the current value.
+const settingsMask = "********"
+
+// Settings are the current values of the editable options, from the
+// settings table or else the config file.
+type Settings struct {
+	SampleInterval Duration                  `json:"sample_interval"`
+	Thresholds     ThresholdConfig           `json:"thresholds"`
+	Units          string                    `json:"units"`
+	RetentionDays  int                       `json:"retention_days"`
+	Notifiers      map[string]NotifierConfig `json:"notifiers"`
+	Theme          ThemeConfig               `json:"theme"`
+}
+
+// SettingsResponse is what /api/settings returns. Stored names the options
+// set in the settings table rather than the config file.
+type SettingsResponse struct {
+	Settings Settings `json:"settings"`
+	Stored   []string `json:"stored"`
+}
+
+func initSettingsTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS settings (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadSettings returns the stored settings as JSON values by name.
+func loadSettings() (map[string]json.RawMessage, error) {
+	stored := map[string]json.RawMessage{}
+	rows, err := db.Query("SELECT name, value FROM settings")
+	if err != nil {
+		// A read-only instance may serve a database from before settings
+		if readOnly && strings.Contains(err.Error(), "no such table") {
+			return stored, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		stored[name] = json.RawMessage(value)
+	}
+	return stored, rows.Err()
+}
+
+// withSettings returns a copy of file with the stored settings applied.
+// Notifiers from the settings are added to those of the file, replacing
+// any of the same name.
+func withSettings(file *Config, stored map[string]json.RawMessage) (*Config, error) {
+	c := cloneConfig(file)
+	if len(stored) == 0 {
+		return c, nil
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("settings: %v", err)
+	}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("settings: %v", err)
+	}
+	return c, nil
+}
+
+// setupSettings applies the stored settings at start, once the database is
+// open.
+func setupSettings() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	fileConfig = config()
+	stored, err := loadSettings()
+	if err != nil {
+		return err
+	}
+	next, err := withSettings(fileConfig, stored)
+	if err != nil {
+		return err
+	}
+	ch, err := prepareConfig(next)
+	if err != nil {
+		return err
+	}
+	if len(stored) > 0 {
+		ch.apply("Applied stored settings")
+	} else {
+		setConfig(next)
+	}
+	return nil
+}
+
+func currentSettings() (SettingsResponse, error) {
+	stored, err := loadSettings()
+	if err != nil {
+		return SettingsResponse{}, err
+	}
+	res := SettingsResponse{Settings: maskedSettings(), Stored: []string{}}
+	for name := range stored {
+		res.Stored = append(res.Stored, name)
+	}
+	sort.Strings(res.Stored)
+	return res, nil
+}
+
+// maskedSettings are the running values of the editable options, with
+// notifier credentials masked.
+func maskedSettings() Settings {
+	s := Settings{
+		SampleInterval: config().SampleInterval,
+		Thresholds:     config().Thresholds,
+		Units:          config().Units,
+		RetentionDays:  config().RetentionDays,
+		Notifiers:      map[string]NotifierConfig{},
+		Theme:          config().Theme,
+	}
+	for name, nc := range config().Notifiers {
+		s.Notifiers[name] = maskNotifier(nc)
+	}
+	return s
+}
+
+// settingValues picks the named options out of maskedSettings, for the
+// audit log.
+func settingValues(names []string) map[string]json.RawMessage {
+	var all map[string]json.RawMessage
+	b, _ := json.Marshal(maskedSettings())
+	json.Unmarshal(b, &all)
+	values := map[string]json.RawMessage{}
+	for _, name := range names {
+		values[name] = all[name]
+	}
+	return values
+}
+
+// maskNotifier hides the credentials of a notifier: tokens, user keys,
+// header values, the URLs of chat webhooks, which are secrets themselves,
+// and other URLs carrying a user and password or query parameters, such
+// as an ntfy URL with auth=.
+func maskNotifier(nc NotifierConfig) NotifierConfig {
+	mask := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return settingsMask
+	}
+	nc.Token, nc.User = mask(nc.Token), mask(nc.User)
+	if nc.Type == "slack" || nc.Type == "discord" || urlHasCredentials(nc.URL) {
+		nc.URL = mask(nc.URL)
+	}
+	if nc.Headers != nil {
+		headers := map[string]string{}
+		for k, v := range nc.Headers {
+			headers[k] = mask(v)
+		}
+		nc.Headers = headers
+	}
+	return nc
+}
+
+// urlHasCredentials reports whether a URL carries a user, a password or a
+// query, where tokens usually go.
+func urlHasCredentials(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.User != nil || u.RawQuery != "")
+}
+
+// unmaskNotifier puts the current credentials back where nc has the mask.
+func unmaskNotifier(name string, nc NotifierConfig) (NotifierConfig, error) {
+	cur, ok := config().Notifiers[name]
+	keep := func(field, v, current string) (string, error) {
+		if v != settingsMask {
+			return v, nil
+		}
+		if !ok || current == "" {
+			return "", fmt.Errorf("notifier %q: %s has no current value to keep", name, field)
+		}
+		return current, nil
+	}
+	var err error
+	if nc.Token, err = keep("token", nc.Token, cur.Token); err != nil {
+		return nc, err
+	}
+	if nc.User, err = keep("user", nc.User, cur.User); err != nil {
+		return nc, err
+	}
+	if nc.URL, err = keep("url", nc.URL, cur.URL); err != nil {
+		return nc, err
+	}
+	for k, v := range nc.Headers {
+		if nc.Headers[k], err = keep("header "+k, v, cur.Headers[k]); err != nil {
+			return nc, err
+		}
+	}
+	return nc, nil
+}
+
+// prepareSettings applies changes to the stored settings and validates the
+// resulting config. A null value removes the stored setting, so the config
+// file's value applies again.
+func prepareSettings(changes map[string]json.RawMessage) (*configChange, map[string]json.RawMessage, error) {
+	stored, err := loadSettings()
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, v := range changes {
+		if string(v) == "null" {
+			delete(stored, name)
+			continue
+		}
+		if name == "notifiers" {
+			var ncs map[string]NotifierConfig
+			if err := json.Unmarshal(v, &ncs); err != nil {
+				return nil, nil, fmt.Errorf("notifiers: %v", err)
+			}
+			for n, nc := range ncs {
+				if ncs[n], err = unmaskNotifier(n, nc); err != nil {
+					return nil, nil, err
+				}
+			}
+			if v, err = json.Marshal(ncs); err != nil {
+				return nil, nil, err
+			}
+		}
+		stored[name] = v
+	}
+	next, err := withSettings(fileConfig, stored)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := prepareConfig(next)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ch, stored, nil
+}
+
+// saveSettings writes the changed settings to the settings table.
+func saveSettings(changes, stored map[string]json.RawMessage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for name := range changes {
+		v, ok := stored[name]
+		if !ok {
+			_, err = tx.Exec("DELETE FROM settings WHERE name = ?", name)
+		} else {
+			_, err = tx.Exec("INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value", name, string(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// updateSettings stores, applies and audits changes to the settings, and
+// returns the status to answer with when that fails.
+func updateSettings(r *http.Request, changes map[string]json.RawMessage) (int, error) {
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	old := settingValues(names)
+	ch, stored, err := prepareSettings(changes)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid settings: %v", err)
+	}
+	if err := saveSettings(changes, stored); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Error saving settings: %v", err)
+	}
+	ch.apply("Settings changed by " + r.RemoteAddr)
+	auditRequest(r, "settings.update", strings.Join(names, ","), old, settingValues(names))
+	return http.StatusOK, nil
+}
+
+// settingsHandler serves GET and PUT /api/settings. PUT takes an object
+// with the settings to change.
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var changes map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid settings: %v", err), http.StatusBadRequest)
+			return
+		}
+		for name := range changes {
+			if !isSettingName(name) {
+				http.Error(w, fmt.Sprintf("Unknown setting %q (editable: %s)", name, strings.Join(settingNames, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+		if status, err := updateSettings(r, changes); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res, err := currentSettings()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func isSettingName(name string) bool {
+	for _, n := range settingNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// settingsPageHandler serves the settings page. It holds no data itself;
+// the page asks for the admin token and uses /api/settings.
+func settingsPageHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := parseTemplate("settings.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+	}{basePath, assetVersion})
+}
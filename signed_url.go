@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func initSecretsTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS app_secrets (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// getOrCreateSecret returns the named secret, generating and storing 32
+// random bytes (hex encoded) the first time it is requested.
+func getOrCreateSecret(name string) (string, error) {
+	return getOrCreateSecretWith(name, func() (string, error) {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(b), nil
+	})
+}
+
+// getOrCreateSecretWith returns the named secret, storing what generate
+// returns the first time it is requested.
+func getOrCreateSecretWith(name string, generate func() (string, error)) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM app_secrets WHERE name = ?", name).Scan(&value)
+	if err == nil {
+		return value, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	if value, err = generate(); err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO app_secrets (name, value) VALUES (?, ?)", name, value); err != nil {
+		return "", err
+	}
+	return value, db.QueryRow("SELECT value FROM app_secrets WHERE name = ?", name).Scan(&value)
+}
+
+// urlSigningKey signs links handed out in notifications. It comes from
+// url_signing_key in the config, or is generated once and kept in the
+// database so links survive restarts.
+var urlSigningKey []byte
+
+func setupURLSigning() error {
+	key := config().URLSigningKey
+	if key == "" {
+		var err error
+		if key, err = getOrCreateSecret("url_signing_key"); err != nil {
+			return err
+		}
+	}
+	urlSigningKey = []byte(key)
+	return nil
+}
+
+func urlSignature(path string, params url.Values) string {
+	mac := hmac.New(sha256.New, urlSigningKey)
+	mac.Write([]byte(path + "?" + params.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL returns an absolute link to path with params that stays valid
+// for ttl. The signature covers the path and every parameter, so it cannot
+// be reused for another image or extended.
+func signedURL(path string, params url.Values, ttl time.Duration) string {
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("exp", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	q.Set("sig", urlSignature(path, q))
+	return dashboardURL() + path + "?" + q.Encode()
+}
+
+// signatureStatus reports whether r carries a signature, and if so whether
+// it is valid and unexpired.
+func signatureStatus(r *http.Request) (signed, valid bool) {
+	q := r.URL.Query()
+	sig := q.Get("sig")
+	if sig == "" {
+		return false, false
+	}
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return true, false
+	}
+	q.Del("sig")
+	want := urlSignature(r.URL.Path, q)
+	return true, subtle.ConstantTimeCompare([]byte(sig), []byte(want)) == 1
+}
+
+// checkSignature rejects requests carrying an invalid or expired signature,
+// writing a 403 and returning false.
+func checkSignature(w http.ResponseWriter, r *http.Request) bool {
+	if signed, valid := signatureStatus(r); signed && !valid {
+		http.Error(w, "Link expired or invalid", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SchedulePeriod sets a zone's target temperature on some weekdays between
+// two local times. To before From runs past midnight.
+type SchedulePeriod struct {
+	Days        []string `json:"days,omitempty"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	Temperature float64  `json:"temperature"`
+}
+
+// Schedule is a week of target temperatures: Default outside the periods,
+// the first matching period inside them.
+type Schedule struct {
+	Default float64          `json:"default"`
+	Periods []SchedulePeriod `json:"periods"`
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compiledPeriod is a period with its days and minutes of the day parsed,
+// and the temperature or price it holds.
+type compiledPeriod struct {
+	days     [7]bool
+	from, to int
+	value    float64
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// compile checks the schedule and prepares it for targetAt.
+func (s Schedule) compile(zone string) ([]compiledPeriod, error) {
+	if err := validateSetpoint(zone, s.Default); err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+	var periods []compiledPeriod
+	for i, p := range s.Periods {
+		c, err := compilePeriod(p.Days, p.From, p.To, p.Temperature)
+		if err != nil {
+			return nil, fmt.Errorf("period %d: %v", i+1, err)
+		}
+		if err := validateSetpoint(zone, p.Temperature); err != nil {
+			return nil, fmt.Errorf("period %d: %v", i+1, err)
+		}
+		periods = append(periods, c)
+	}
+	return periods, nil
+}
+
+// compilePeriod parses the days and times of a weekly period holding v.
+// No days means every day.
+func compilePeriod(days []string, from, to string, v float64) (compiledPeriod, error) {
+	c := compiledPeriod{value: v}
+	var err error
+	if c.from, err = parseClock(from); err != nil {
+		return c, err
+	}
+	if c.to, err = parseClock(to); err != nil {
+		return c, err
+	}
+	if c.from == c.to {
+		return c, fmt.Errorf("from and to are the same")
+	}
+	if len(days) == 0 {
+		c.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range days {
+		wd, ok := weekdayNames[strings.ToLower(d)]
+		if !ok {
+			return c, fmt.Errorf("unknown day %q, use mon..sun", d)
+		}
+		c.days[wd] = true
+	}
+	return c, nil
+}
+
+// targetAt is the scheduled temperature, or the price of a tariff, at t:
+// the first matching period's, else def. A period running past midnight
+// belongs to the day it starts on.
+func targetAt(def float64, periods []compiledPeriod, t time.Time) float64 {
+	t = t.Local()
+	minute := t.Hour()*60 + t.Minute()
+	for _, p := range periods {
+		if p.from < p.to {
+			if p.days[t.Weekday()] && minute >= p.from && minute < p.to {
+				return p.value
+			}
+			continue
+		}
+		if (p.days[t.Weekday()] && minute >= p.from) || (p.days[(t.Weekday()+6)%7] && minute < p.to) {
+			return p.value
+		}
+	}
+	return def
+}
+
+// simStep is the bucket size of the recorded data the simulation runs on.
+const simStep = 5 * time.Minute
+
+// defaultOutdoor stands in for outdoor readings when there are none.
+const defaultOutdoor = 5.0
+
+// ThermalModel is a zone's first-order response learned from its readings:
+// it cools by LossPerHour times the indoor-outdoor difference per hour and
+// warms by HeatingPerHour while heating. Calibrated is set when the heating
+// rate was fitted to the recorded heater runtime.
+type ThermalModel struct {
+	LossPerHour    float64 `json:"lossPerHour"`
+	HeatingPerHour float64 `json:"heatingPerHour"`
+	OutdoorSensor  string  `json:"outdoorSensor,omitempty"`
+	OutdoorAssumed bool    `json:"outdoorAssumed"`
+	Calibrated     bool    `json:"calibrated"`
+	CoolingSteps   int     `json:"coolingSteps"`
+	HeatingSteps   int     `json:"heatingSteps"`
+}
+
+// SimulationResult is the outcome of running a schedule over the window.
+type SimulationResult struct {
+	RuntimeHours     float64  `json:"runtimeHours"`
+	EnergyKWh        *float64 `json:"energyKWh,omitempty"`
+	Cost             *float64 `json:"cost,omitempty"`
+	MeanTemperature  float64  `json:"meanTemperature"`
+	ComfortPercent   float64  `json:"comfortPercent"`
+	DegreeHoursBelow float64  `json:"degreeHoursBelow"`
+}
+
+// SimulationReport is the answer of /api/schedule/simulate. Baseline holds
+// the zone's current setpoint all day; Recorded is what the heaters
+// actually ran, which shows how well the model fits.
+type SimulationReport struct {
+	Zone     string           `json:"zone"`
+	From     time.Time        `json:"from"`
+	To       time.Time        `json:"to"`
+	Model    ThermalModel     `json:"model"`
+	Power    *float64         `json:"powerWatts,omitempty"`
+	Currency string           `json:"currency,omitempty"`
+	Baseline SimulationResult `json:"baseline"`
+	Proposed SimulationResult `json:"proposed"`
+	Recorded *struct {
+		RuntimeHours float64 `json:"runtimeHours"`
+		EnergyKWh    float64 `json:"energyKWh"`
+	} `json:"recorded,omitempty"`
+	RuntimeChangePercent *float64 `json:"runtimeChangePercent,omitempty"`
+}
+
+// bucketedReadings averages a sensor's readings into simStep buckets,
+// keyed by bucket start in Unix seconds.
+func bucketedReadings(sensor string, from, to time.Time) (map[int64]float64, error) {
+	step := int64(simStep / time.Second)
+	rows, err := db.Query(`SELECT CAST(strftime('%s', timestamp) AS INTEGER) / ? AS b, AVG(temperature)
+		FROM temperature_readings WHERE sensor = ? AND timestamp >= ? AND timestamp < ? GROUP BY b`,
+		step, sensor, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	buckets := map[int64]float64{}
+	for rows.Next() {
+		var b int64
+		var v float64
+		if err := rows.Scan(&b, &v); err != nil {
+			return nil, err
+		}
+		buckets[b*step] = v
+	}
+	return buckets, rows.Err()
+}
+
+// outdoorSeries is the outdoor temperature per bucket. Gaps carry the last
+// known value over; before the first reading that reading is used, and
+// without any readings defaultOutdoor.
+type outdoorSeries struct {
+	buckets     map[int64]float64
+	first, last float64
+}
+
+func newOutdoorSeries(buckets map[int64]float64) *outdoorSeries {
+	o := &outdoorSeries{buckets: buckets, first: defaultOutdoor}
+	earliest := int64(math.MaxInt64)
+	for t, v := range buckets {
+		if t < earliest {
+			earliest, o.first = t, v
+		}
+	}
+	o.last = o.first
+	return o
+}
+
+// rewind starts the series over for another pass through the window.
+func (o *outdoorSeries) rewind() {
+	o.last = o.first
+}
+
+func (o *outdoorSeries) at(t int64) float64 {
+	if v, ok := o.buckets[t]; ok {
+		o.last = v
+	}
+	return o.last
+}
+
+// learnModel fits the zone's loss and heating rates. Only steps inside a
+// fall lasting at least three steps count for the losses, as the heater
+// was most likely off for all of them. The heating rate then follows from
+// the heat balance over the window with the recorded runtime, so the model
+// reproduces what the heaters actually ran; without a recorded runtime it
+// is taken from the steps in which the temperature rose.
+func learnModel(indoor map[int64]float64, outdoor *outdoorSeries, from, to time.Time, runtimeHours float64) (ThermalModel, error) {
+	var m ThermalModel
+	outdoor.rewind()
+	step := int64(simStep / time.Second)
+	hours := simStep.Hours()
+	type sample struct{ rate, delta float64 }
+	var falling, run, rises []sample
+	var change, exposure float64
+	pairs, total := 0, 0
+	flush := func() {
+		if len(run) >= 3 {
+			falling = append(falling, run...)
+		}
+		run = run[:0]
+	}
+	for t := from.Unix() / step * step; t < to.Unix(); t += step {
+		total++
+		out := outdoor.at(t)
+		a, ok1 := indoor[t]
+		b, ok2 := indoor[t+step]
+		if !ok1 || !ok2 {
+			flush()
+			continue
+		}
+		pairs++
+		s := sample{(b - a) / hours, a - out}
+		change += b - a
+		exposure += s.delta * hours
+		switch {
+		case s.rate < 0 && s.delta > 1:
+			run = append(run, s)
+		case s.rate > 0:
+			flush()
+			rises = append(rises, s)
+		default:
+			flush()
+		}
+	}
+	flush()
+	m.CoolingSteps, m.HeatingSteps = len(falling), len(rises)
+	if len(falling) < 20 || (runtimeHours <= 0 && len(rises) < 5) {
+		return m, fmt.Errorf("not enough readings to learn the zone's response: %d cooling and %d warming steps, need 20 and 5", len(falling), len(rises))
+	}
+	var sxy, sxx float64
+	for _, f := range falling {
+		sxy += f.rate * f.delta
+		sxx += f.delta * f.delta
+	}
+	m.LossPerHour = -sxy / sxx
+	if runtimeHours > 0 {
+		m.HeatingPerHour = (change + m.LossPerHour*exposure) / (runtimeHours * float64(pairs) / float64(total))
+		m.Calibrated = true
+	} else {
+		for _, r := range rises {
+			m.HeatingPerHour += r.rate + m.LossPerHour*r.delta
+		}
+		m.HeatingPerHour /= float64(len(rises))
+	}
+	if m.HeatingPerHour <= 0 {
+		return m, fmt.Errorf("the recorded warming cannot be told apart from the losses")
+	}
+	return m, nil
+}
+
+// simulate runs the zone's on/off control over the window with the learned
+// model, one minute at a time, starting from the first recorded reading.
+func simulate(m ThermalModel, hysteresis float64, target func(time.Time) float64,
+	indoor map[int64]float64, outdoor *outdoorSeries, from, to time.Time) SimulationResult {
+	var res SimulationResult
+	outdoor.rewind()
+	step := int64(simStep / time.Second)
+	start := from.Unix() / step * step
+	temp := math.NaN()
+	for t := start; t < to.Unix() && math.IsNaN(temp); t += step {
+		if v, ok := indoor[t]; ok {
+			temp = v
+		}
+	}
+	if math.IsNaN(temp) {
+		return res
+	}
+	const dt = 1.0 / 60
+	heating := false
+	var minutes, heated, comfortable, sum float64
+	for t := start; t < to.Unix(); t += step {
+		out := outdoor.at(t)
+		for i := int64(0); i < step; i += 60 {
+			now := time.Unix(t+i, 0)
+			sp := target(now)
+			switch {
+			case temp < sp-hysteresis:
+				heating = true
+			case temp >= sp:
+				heating = false
+			}
+			if heating {
+				heated++
+				temp += m.HeatingPerHour * dt
+			}
+			temp -= m.LossPerHour * (temp - out) * dt
+			minutes++
+			sum += temp
+			if temp >= sp-hysteresis {
+				comfortable++
+			}
+			if temp < sp {
+				res.DegreeHoursBelow += (sp - temp) * dt
+			}
+		}
+	}
+	res.RuntimeHours = heated / 60
+	res.MeanTemperature = sum / minutes
+	res.ComfortPercent = 100 * comfortable / minutes
+	return res
+}
+
+type simulateRequest struct {
+	Zone     string   `json:"zone"`
+	Days     int      `json:"days"`
+	Schedule Schedule `json:"schedule"`
+}
+
+// simulateHandler serves POST /api/schedule/simulate: the proposed
+// schedule is run against the zone's recorded month and compared with
+// holding its current setpoint.
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req simulateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	z, ok := controller.byName[req.Zone]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown zone %q", req.Zone), http.StatusNotFound)
+		return
+	}
+	if req.Days == 0 {
+		req.Days = 30
+	}
+	if req.Days < 1 || req.Days > 90 {
+		http.Error(w, "days must be between 1 and 90", http.StatusBadRequest)
+		return
+	}
+	periods, err := req.Schedule.compile(req.Zone)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+	sp, err := getSetpoint(req.Zone)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Zone %q has no setpoint to compare with", req.Zone), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Whole local days, so the recorded heater runtime covers the same time
+	y, m, d := time.Now().Date()
+	to := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	from := to.AddDate(0, 0, -req.Days)
+	rep := SimulationReport{Zone: req.Zone, From: from.UTC(), To: to.UTC()}
+	indoor, err := bucketedReadings(z.cfg.Sensor, from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	outdoorReadings := map[int64]float64{}
+	if config().OutdoorSensor != "" {
+		if outdoorReadings, err = bucketedReadings(config().OutdoorSensor, from, to); err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	seconds, wh, err := zoneUsage(z.cfg.Heaters, from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The zone's heaters switch together, so its runtime is their average
+	n := float64(len(z.cfg.Heaters))
+	runtime := seconds / 3600 / n
+
+	outdoor := newOutdoorSeries(outdoorReadings)
+	rep.Model, err = learnModel(indoor, outdoor, from, to, runtime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	rep.Model.OutdoorSensor = config().OutdoorSensor
+	rep.Model.OutdoorAssumed = len(outdoorReadings) == 0
+
+	hyst := z.cfg.Hysteresis
+	rep.Baseline = simulate(rep.Model, hyst, func(time.Time) float64 { return sp.Temperature }, indoor, outdoor, from, to)
+	rep.Proposed = simulate(rep.Model, hyst, func(t time.Time) float64 { return targetAt(req.Schedule.Default, periods, t) }, indoor, outdoor, from, to)
+	if rep.Baseline.RuntimeHours > 0 {
+		change := 100 * (rep.Proposed.RuntimeHours - rep.Baseline.RuntimeHours) / rep.Baseline.RuntimeHours
+		rep.RuntimeChangePercent = &change
+	}
+
+	// The heaters' measured power turns runtime into energy and cost
+	if seconds > 0 {
+		rep.Recorded = &struct {
+			RuntimeHours float64 `json:"runtimeHours"`
+			EnergyKWh    float64 `json:"energyKWh"`
+		}{runtime, wh / 1000}
+		if wh > 0 {
+			power := wh * 3600 / seconds * n
+			rep.Power = &power
+			for _, res := range []*SimulationResult{&rep.Baseline, &rep.Proposed} {
+				kwh := res.RuntimeHours * power / 1000
+				res.EnergyKWh = &kwh
+				if config().EnergyPrice > 0 {
+					cost := kwh * config().EnergyPrice
+					res.Cost = &cost
+				}
+			}
+			rep.Currency = config().Currency
+		}
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// zoneUsage adds up the recorded runtime and energy of heaters over the
+// local days from from up to to.
+func zoneUsage(names []string, from, to time.Time) (seconds, wh float64, err error) {
+	args := []interface{}{from.Local().Format("2006-01-02"), to.Local().Format("2006-01-02")}
+	for _, n := range names {
+		args = append(args, n)
+	}
+	err = db.QueryRow(`SELECT COALESCE(SUM(on_seconds), 0), COALESCE(SUM(energy_wh), 0) FROM heater_usage
+		WHERE day >= ? AND day < ? AND heater IN (?`+strings.Repeat(", ?", len(names)-1)+`)`, args...).Scan(&seconds, &wh)
+	return
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// simulating is set by serve -simulate: heaters are switched in memory and
+// the zones' sensors read from a model of their rooms instead.
+var simulating bool
+
+// simulatedWatts is what a simulated heater without watts draws while on.
+const simulatedWatts = 1000
+
+// SimulationConfig is the model of the rooms under -simulate. Each zone
+// cools by LossPerHour times its difference to outdoors per hour and warms
+// by HeatingPerHour with all its heaters on, the model
+// /api/schedule/simulate learns, starting at Start. Zones overrides these
+// per zone. Outdoors swings Swing either side of Outdoor over the day,
+// coldest at 03:00. Readings are recorded every Interval.
+type SimulationConfig struct {
+	Outdoor        *float64                 `json:"outdoor,omitempty"`
+	Swing          *float64                 `json:"swing,omitempty"`
+	LossPerHour    float64                  `json:"loss_per_hour,omitempty"`
+	HeatingPerHour float64                  `json:"heating_per_hour,omitempty"`
+	Start          float64                  `json:"start,omitempty"`
+	Interval       Duration                 `json:"interval,omitempty"`
+	Zones          map[string]SimulatedRoom `json:"zones,omitempty"`
+}
+
+// SimulatedRoom overrides the model of one zone; unset fields are taken
+// from the simulation section.
+type SimulatedRoom struct {
+	LossPerHour    float64 `json:"loss_per_hour,omitempty"`
+	HeatingPerHour float64 `json:"heating_per_hour,omitempty"`
+	Start          float64 `json:"start,omitempty"`
+}
+
+func (c *SimulationConfig) check(zones map[string]ZoneConfig) error {
+	if c.Outdoor == nil {
+		v := defaultOutdoor
+		c.Outdoor = &v
+	}
+	if c.Swing == nil {
+		v := 3.0
+		c.Swing = &v
+	}
+	if c.LossPerHour == 0 {
+		c.LossPerHour = 0.1
+	}
+	if c.HeatingPerHour == 0 {
+		c.HeatingPerHour = 2
+	}
+	if c.Start == 0 {
+		c.Start = 16
+	}
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = 30 * time.Second
+	}
+	if *c.Outdoor < -30 || *c.Outdoor > 30 {
+		return fmt.Errorf("outdoor must be between -30 and 30°C")
+	}
+	if *c.Swing < 0 || *c.Swing > 15 {
+		return fmt.Errorf("swing must be between 0 and 15°C")
+	}
+	if c.Interval.Duration < 5*time.Second || c.Interval.Duration > 10*time.Minute {
+		return fmt.Errorf("interval must be between 5s and 10m")
+	}
+	if err := checkRoomModel(c.LossPerHour, c.HeatingPerHour, c.Start); err != nil {
+		return err
+	}
+	for name, room := range c.Zones {
+		if _, ok := zones[name]; !ok {
+			return fmt.Errorf("zones: unknown zone %q", name)
+		}
+		if err := checkRoomModel(room.LossPerHour, room.HeatingPerHour, room.Start); err != nil {
+			return fmt.Errorf("zones: %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkRoomModel validates a room's model; zero values are left to the
+// defaults.
+func checkRoomModel(loss, heating, start float64) error {
+	if loss < 0 || loss > 1 {
+		return fmt.Errorf("loss_per_hour must be between 0 and 1")
+	}
+	if heating < 0 || heating > 20 {
+		return fmt.Errorf("heating_per_hour must be between 0 and 20°C")
+	}
+	if start != 0 && (start < -10 || start > 35) {
+		return fmt.Errorf("start must be between -10 and 35°C")
+	}
+	return nil
+}
+
+// SimulatedZone is what /api/simulation reports for each modelled room.
+// Output is the share of its heaters that are on.
+type SimulatedZone struct {
+	Zone           string  `json:"zone"`
+	Sensor         string  `json:"sensor"`
+	Temperature    float64 `json:"temperature"`
+	Output         float64 `json:"output"`
+	LossPerHour    float64 `json:"lossPerHour"`
+	HeatingPerHour float64 `json:"heatingPerHour"`
+}
+
+// SimulationStatus is the answer of /api/simulation.
+type SimulationStatus struct {
+	Outdoor       float64         `json:"outdoor"`
+	OutdoorSensor string          `json:"outdoorSensor,omitempty"`
+	Heaters       map[string]bool `json:"heaters"`
+	Zones         []SimulatedZone `json:"zones"`
+}
+
+type simulatedRoom struct {
+	zone, sensor, boiler string
+	heaters              []string
+	temp, loss, heating  float64
+}
+
+// roomSimulation keeps the simulated heaters' relays and the rooms they
+// warm.
+type roomSimulation struct {
+	cfg     SimulationConfig
+	mu      sync.Mutex
+	relays  map[string]bool
+	rooms   []*simulatedRoom
+	outdoor float64
+}
+
+// simulation is the running model, nil unless simulating.
+var simulation *roomSimulation
+
+// simulatedHeater stands a heater in for its plug: it is switched by the
+// simulation, which knows it by the name kept in URL.
+func simulatedHeater(name string, hc HeaterConfig) HeaterConfig {
+	hc.Type, hc.URL, hc.Topic, hc.Pin = "simulated", name, "", nil
+	return hc
+}
+
+// setupSimulation builds the rooms of the zones, each starting from its
+// sensor's last reading when that is recent.
+func setupSimulation(c SimulationConfig, zones map[string]ZoneConfig, boilers map[string]BoilerConfig) {
+	s := &roomSimulation{cfg: c, relays: map[string]bool{}}
+	for name := range config().Heaters {
+		s.relays[name] = false
+	}
+	for name, zc := range zones {
+		room := &simulatedRoom{zone: name, sensor: zc.Sensor, heaters: zc.Heaters,
+			temp: c.Start, loss: c.LossPerHour, heating: c.HeatingPerHour}
+		if zc.Boiler != "" {
+			room.boiler = boilers[zc.Boiler].Heater
+		}
+		if over, ok := c.Zones[name]; ok {
+			if over.LossPerHour != 0 {
+				room.loss = over.LossPerHour
+			}
+			if over.HeatingPerHour != 0 {
+				room.heating = over.HeatingPerHour
+			}
+			if over.Start != 0 {
+				room.temp = over.Start
+			}
+		}
+		if v, at, ok := sensorsMonitor.lastValue(zc.Sensor); ok && time.Since(at) < time.Hour {
+			room.temp = v
+		}
+		s.rooms = append(s.rooms, room)
+	}
+	sort.Slice(s.rooms, func(i, j int) bool { return s.rooms[i].zone < s.rooms[j].zone })
+	simulation = s
+	log.Printf("Simulation: %d zones modelled, heaters switched in memory", len(s.rooms))
+}
+
+// outdoorAt is the simulated outdoor temperature, coldest at 03:00 and
+// warmest at 15:00.
+func (s *roomSimulation) outdoorAt(t time.Time) float64 {
+	t = t.Local()
+	hours := float64(t.Hour()) + float64(t.Minute())/60
+	return *s.cfg.Outdoor - *s.cfg.Swing*math.Cos(2*math.Pi*(hours-3)/24)
+}
+
+// output is the share of a room's heaters that are on, none while its
+// boiler is off. Callers hold s.mu.
+func (s *roomSimulation) output(room *simulatedRoom) float64 {
+	if room.boiler != "" && !s.relays[room.boiler] {
+		return 0
+	}
+	if len(room.heaters) == 0 {
+		return 0
+	}
+	on := 0
+	for _, name := range room.heaters {
+		if s.relays[name] {
+			on++
+		}
+	}
+	return float64(on) / float64(len(room.heaters))
+}
+
+// start records the rooms' first readings, so the self-test finds them,
+// and moves the model on from there.
+func (s *roomSimulation) start() {
+	interval := s.cfg.Interval.Duration
+	for _, room := range s.rooms {
+		sensorsMonitor.expect(room.sensor, interval)
+	}
+	if config().OutdoorSensor != "" {
+		sensorsMonitor.expect(config().OutdoorSensor, interval)
+	}
+	last := clock.Now()
+	s.record(last)
+	go s.run(last)
+}
+
+func (s *roomSimulation) run(last time.Time) {
+	ticker := time.NewTicker(s.cfg.Interval.Duration)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := clock.Now()
+		s.step(now.Sub(last).Hours(), now)
+		last = now
+		s.record(now)
+	}
+}
+
+// step moves the rooms on by the given hours.
+func (s *roomSimulation) step(hours float64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outdoor = s.outdoorAt(now)
+	for _, room := range s.rooms {
+		room.temp += hours * (room.heating*s.output(room) - room.loss*(room.temp-s.outdoor))
+	}
+}
+
+func (s *roomSimulation) record(now time.Time) {
+	s.mu.Lock()
+	s.outdoor = s.outdoorAt(now)
+	outdoor := s.outdoor
+	temps := make(map[string]float64, len(s.rooms))
+	for _, room := range s.rooms {
+		temps[room.sensor] = room.temp
+	}
+	s.mu.Unlock()
+	for sensor, temp := range temps {
+		recordReading(sensor, math.Round(temp*100)/100, sourceSimulated)
+	}
+	if config().OutdoorSensor != "" {
+		recordReading(config().OutdoorSensor, math.Round(outdoor*100)/100, sourceSimulated)
+	}
+}
+
+// plugStatus is a simulated heater's state; it draws its watts while on.
+func (s *roomSimulation) plugStatus(hc HeaterConfig) (plugStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	on, ok := s.relays[hc.URL]
+	if !ok {
+		return plugStatus{}, fmt.Errorf("no simulated heater %q", hc.URL)
+	}
+	st := plugStatus{relayOn: on, hasPower: true}
+	if on {
+		st.power = hc.Watts
+		if st.power == 0 {
+			st.power = simulatedWatts
+		}
+	}
+	return st, nil
+}
+
+func (s *roomSimulation) switchHeater(hc HeaterConfig, on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	was, ok := s.relays[hc.URL]
+	if !ok {
+		return fmt.Errorf("no simulated heater %q", hc.URL)
+	}
+	if was != on {
+		log.Printf("Simulation: heater %s %s", hc.URL, onOff(on))
+	}
+	s.relays[hc.URL] = on
+	return nil
+}
+
+func (s *roomSimulation) status() SimulationStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SimulationStatus{Outdoor: math.Round(s.outdoor*100) / 100, OutdoorSensor: config().OutdoorSensor,
+		Heaters: map[string]bool{}, Zones: []SimulatedZone{}}
+	for name, on := range s.relays {
+		st.Heaters[name] = on
+	}
+	for _, room := range s.rooms {
+		st.Zones = append(st.Zones, SimulatedZone{Zone: room.zone, Sensor: room.sensor,
+			Temperature: math.Round(room.temp*100) / 100, Output: s.output(room),
+			LossPerHour: room.loss, HeatingPerHour: room.heating})
+	}
+	return st
+}
+
+// simulationHandler serves GET /api/simulation, the state of the model
+// while simulating.
+func simulationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if simulation == nil {
+		http.Error(w, "Not simulating; start piheat with -simulate", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, simulation.status())
+}
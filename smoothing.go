@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// defaultSmoothingWindow is the number of points smoothed over when the
+// request gives no window.
+const defaultSmoothingWindow = 5
+
+// chartSmoothing is how /api/chart-data smooths a series: method is "ma",
+// a trailing moving average over window points, or "ema", exponential
+// smoothing with the weight of a window-point average.
+type chartSmoothing struct {
+	method string
+	window int
+}
+
+// parseSmoothing reads the smooth and window parameters; ok is false when
+// none was asked for.
+func parseSmoothing(q url.Values) (s chartSmoothing, ok bool, err error) {
+	s.method = q.Get("smooth")
+	if s.method == "" {
+		if q.Get("window") != "" {
+			return s, false, fmt.Errorf("window needs smooth")
+		}
+		return s, false, nil
+	}
+	if s.method != "ma" && s.method != "ema" {
+		return s, false, fmt.Errorf("smooth must be ma or ema")
+	}
+	s.window = defaultSmoothingWindow
+	if w := q.Get("window"); w != "" {
+		if s.window, err = strconv.Atoi(w); err != nil || s.window < 2 || s.window > 100 {
+			return s, false, fmt.Errorf("window must be a number of points between 2 and 100")
+		}
+	}
+	return s, true, nil
+}
+
+// smooth sets each point's Smoothed from the points up to it. The first
+// points of a moving average use what there is so far.
+func (s chartSmoothing) smooth(points []ChartDataPoint) {
+	switch s.method {
+	case "ma":
+		var sum float64
+		for i := range points {
+			sum += points[i].Temperature
+			n := i + 1
+			if n > s.window {
+				sum -= points[i-s.window].Temperature
+				n = s.window
+			}
+			v := sum / float64(n)
+			points[i].Smoothed = &v
+		}
+	case "ema":
+		alpha := 2 / float64(s.window+1)
+		var v float64
+		for i := range points {
+			if i == 0 {
+				v = points[i].Temperature
+			} else {
+				v += alpha * (points[i].Temperature - v)
+			}
+			ev := v
+			points[i].Smoothed = &ev
+		}
+	}
+}
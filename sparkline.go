@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"time"
+)
+
+// recentValues returns a sensor's readings since the given time, oldest
+// first.
+func recentValues(ctx context.Context, sensor string, since time.Time) ([]float64, error) {
+	defer timeQuery("sparkline")()
+	rows, err := db.QueryContext(ctx, "SELECT temperature FROM temperature_readings WHERE sensor = ? AND timestamp >= ? ORDER BY timestamp",
+		sensor, sqliteTime(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []float64
+	for rows.Next() {
+		var v float64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+var (
+	sparkBackground = color.RGBA{255, 255, 255, 255}
+	sparkLine       = color.RGBA{33, 150, 243, 255}
+)
+
+// lighten mixes c with 75% white, for the area under a line.
+func lighten(c color.RGBA) color.RGBA {
+	mix := func(v uint8) uint8 { return uint8(255 - (255-int(v))*25/100) }
+	return color.RGBA{mix(c.R), mix(c.G), mix(c.B), 255}
+}
+
+// renderSparkline draws values as a filled line chart without axes, scaled
+// to fit the image height.
+func renderSparkline(values []float64, width, height int, line color.RGBA) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{sparkBackground}, image.Point{}, draw.Src)
+
+	if len(values) > 0 {
+		lo, hi := values[0], values[0]
+		for _, v := range values {
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		// Keep flat series in the middle instead of dividing by zero
+		if hi-lo < 1 {
+			mid := (hi + lo) / 2
+			lo, hi = mid-0.5, mid+0.5
+		}
+		const pad = 4
+		x := func(i int) int {
+			if len(values) == 1 {
+				return width / 2
+			}
+			return i * (width - 1) / (len(values) - 1)
+		}
+		y := func(v float64) int {
+			return pad + int((hi-v)/(hi-lo)*float64(height-1-2*pad))
+		}
+
+		fill := lighten(line)
+		for i := 0; i < len(values)-1; i++ {
+			x0, y0, x1, y1 := x(i), y(values[i]), x(i+1), y(values[i+1])
+			for px := x0; px <= x1; px++ {
+				top := y0
+				if x1 > x0 {
+					top = y0 + (y1-y0)*(px-x0)/(x1-x0)
+				}
+				for py := top; py < height; py++ {
+					img.Set(px, py, fill)
+				}
+			}
+		}
+		for i := 0; i < len(values)-1; i++ {
+			drawLine(img, x(i), y(values[i]), x(i+1), y(values[i+1]), line)
+		}
+		if len(values) == 1 {
+			drawLine(img, 0, y(values[0]), width-1, y(values[0]), line)
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// drawLine draws a 2px wide line with Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		img.Set(x0, y0+1, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// alertSparkline renders the last hour of the alert's sensor, coloured by
+// severity, for notifiers that attach images.
+func alertSparkline(a Alert) ([]byte, error) {
+	values, err := recentValues(context.Background(), a.Sensor, a.Time.Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	return renderSparkline(values, 400, 100, severityColor(a)), nil
+}
+
+func severityColor(a Alert) color.RGBA {
+	switch {
+	case a.State == "resolved":
+		return color.RGBA{76, 175, 80, 255}
+	case a.Severity == "critical":
+		return color.RGBA{244, 67, 54, 255}
+	case a.Severity == "warning":
+		return color.RGBA{255, 152, 0, 255}
+	}
+	return sparkLine
+}
+
+// sparklineHandler serves a sensor's recent history as a small PNG, used as
+// the image in chat notifications through signed links.
+func sparklineHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkSignature(w, r) {
+		return
+	}
+	sensor := r.URL.Query().Get("sensor")
+	if sensor == "" {
+		sensor = "cpu"
+	}
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > 7*24*time.Hour {
+			http.Error(w, "Invalid window", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	values, err := recentValues(r.Context(), sensor, time.Now().Add(-window))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(renderSparkline(values, 400, 100, sparkLine))
+}
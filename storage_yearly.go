@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// splitByYear stores readings in one SQLite file per year next to the main
+// database (temperature-2024.db, temperature-2025.db, ...). The main file
+// keeps rules, alert history and settings, and only the current year's file
+// is written to, so old years can be archived by moving their file away
+// while piheat is stopped.
+//
+// Every connection attaches the year files as schemas y2024, y2025, ... and
+// defines a temporary view temperature_readings over all of them, which
+// shadows the (then empty) table of the same name in the main file. Queries
+// keep reading temperature_readings unchanged; writes and deletes go to the
+// year tables directly.
+var splitByYear bool
+
+// openedYears are the years whose files existed when the storage was
+// opened. Files are never removed while piheat runs, so every connection
+// attaches them, as well as the year it is opened in.
+var openedYears map[int]bool
+
+// maxYearFiles is how many databases SQLite attaches to a connection.
+// Beyond that, old year files have to be moved away.
+const maxYearFiles = 10
+
+// yearIDStride offsets the IDs of each year's readings, so IDs stay unique
+// across files: readings of 2025 start at 20250000000001.
+const yearIDStride = 10000000000
+
+func yearSchema(year int) string {
+	return "y" + strconv.Itoa(year)
+}
+
+func yearFile(dbPath string, year int) string {
+	ext := filepath.Ext(dbPath)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(dbPath, ext), year, ext)
+}
+
+// yearFiles lists the existing per-year files of dbPath, by year.
+func yearFiles(dbPath string) (map[int]string, error) {
+	ext := filepath.Ext(dbPath)
+	prefix := strings.TrimSuffix(dbPath, ext) + "-"
+	matches, err := filepath.Glob(prefix + "[0-9][0-9][0-9][0-9]" + ext)
+	if err != nil {
+		return nil, err
+	}
+	files := map[int]string{}
+	for _, m := range matches {
+		year, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext))
+		if err == nil {
+			files[year] = m
+		}
+	}
+	return files, nil
+}
+
+// yearSchemaSQL creates the readings table of a year file, with IDs
+// starting at the year's offset.
+func yearSchemaSQL(schema string, year int) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + schema + `.temperature_readings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			temperature REAL NOT NULL,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			sensor TEXT NOT NULL DEFAULT 'cpu',
+			source TEXT NOT NULL DEFAULT ''
+		)`,
+		"CREATE INDEX IF NOT EXISTS " + schema + ".idx_timestamp ON temperature_readings(timestamp)",
+		"CREATE INDEX IF NOT EXISTS " + schema + ".idx_sensor_timestamp ON temperature_readings(sensor, timestamp)",
+		fmt.Sprintf(`INSERT INTO %s.sqlite_sequence (name, seq) SELECT 'temperature_readings', %d
+			WHERE NOT EXISTS (SELECT 1 FROM %s.sqlite_sequence WHERE name = 'temperature_readings')`,
+			schema, int64(year)*yearIDStride, schema),
+	}
+}
+
+// yearSourceSQL adds the source column to a year file created before
+// sources were recorded.
+func yearSourceSQL(schema string) string {
+	return "ALTER TABLE " + schema + ".temperature_readings ADD COLUMN source TEXT NOT NULL DEFAULT ''"
+}
+
+func isDuplicateColumn(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "duplicate column name")
+}
+
+// attachYears is the connect hook of the per-year driver.
+func attachYears(dbPath string) func(*sqlite3.SQLiteConn) error {
+	return func(conn *sqlite3.SQLiteConn) error {
+		files, err := yearFiles(dbPath)
+		if err != nil {
+			return err
+		}
+		if !readOnly {
+			// The next year is attached in advance, so connections opened
+			// before New Year can write into it afterwards
+			now := time.Now().UTC().Year()
+			for _, y := range []int{now, now + 1} {
+				if _, ok := files[y]; !ok {
+					files[y] = yearFile(dbPath, y)
+				}
+			}
+		}
+		years := make([]int, 0, len(files))
+		for y := range files {
+			years = append(years, y)
+		}
+		sort.Ints(years)
+		if len(years) > maxYearFiles {
+			return fmt.Errorf("%d year files, but SQLite can only attach %d: move the oldest (%s) away while piheat is stopped",
+				len(years), maxYearFiles, files[years[0]])
+		}
+
+		selects := []string{"SELECT id, temperature, timestamp, sensor, source FROM main.temperature_readings"}
+		for _, y := range years {
+			schema := yearSchema(y)
+			if _, err := conn.Exec("ATTACH DATABASE ? AS "+schema, []driver.Value{files[y]}); err != nil {
+				return fmt.Errorf("attaching %s: %v", files[y], err)
+			}
+			source := "source"
+			if !readOnly {
+				for _, stmt := range yearSchemaSQL(schema, y) {
+					if _, err := conn.Exec(stmt, nil); err != nil {
+						return fmt.Errorf("preparing %s: %v", files[y], err)
+					}
+				}
+				if _, err := conn.Exec(yearSourceSQL(schema), nil); err != nil && !isDuplicateColumn(err) {
+					return fmt.Errorf("preparing %s: %v", files[y], err)
+				}
+			} else if _, err := conn.Exec("SELECT source FROM "+schema+".temperature_readings LIMIT 0", nil); err != nil {
+				// A read-only instance cannot add the column to an old file
+				source = "'' AS source"
+			}
+			selects = append(selects, "SELECT id, temperature, timestamp, sensor, "+source+" FROM "+schema+".temperature_readings")
+		}
+		_, err = conn.Exec("CREATE TEMP VIEW temperature_readings AS "+strings.Join(selects, " UNION ALL "), nil)
+		return err
+	}
+}
+
+// openYearlyStorage switches db to per-year storage, first moving readings
+// still held in the main file into their year files.
+func openYearlyStorage(path, dsn string) error {
+	if !readOnly {
+		if err := moveReadingsToYearFiles(path); err != nil {
+			return err
+		}
+	}
+	files, err := yearFiles(path)
+	if err != nil {
+		return err
+	}
+	openedYears = map[int]bool{}
+	for y := range files {
+		openedYears[y] = true
+	}
+	sql.Register("sqlite3_yearly", &sqlite3.SQLiteDriver{ConnectHook: attachYears(path)})
+	yearly, err := sql.Open("sqlite3_yearly", dsn)
+	if err != nil {
+		return err
+	}
+	// Connections are recycled so each one attaches the current year
+	yearly.SetConnMaxLifetime(time.Hour)
+	if err := yearly.Ping(); err != nil {
+		yearly.Close()
+		return err
+	}
+	db.Close()
+	db = yearly
+	return nil
+}
+
+// moveReadingsToYearFiles empties the main readings table into year files,
+// which happens once when -split-by-year is first enabled.
+func moveReadingsToYearFiles(path string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT DISTINCT CAST(strftime('%Y', timestamp) AS INTEGER) FROM temperature_readings")
+	if err != nil {
+		return err
+	}
+	var years []int
+	for rows.Next() {
+		var y int
+		if err := rows.Scan(&y); err != nil {
+			rows.Close()
+			return err
+		}
+		years = append(years, y)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, y := range years {
+		schema := yearSchema(y)
+		if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+schema, yearFile(path, y)); err != nil {
+			return err
+		}
+		for _, stmt := range yearSchemaSQL(schema, y) {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.ExecContext(ctx, yearSourceSQL(schema)); err != nil && !isDuplicateColumn(err) {
+			return err
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`INSERT INTO `+schema+`.temperature_readings (id, temperature, timestamp, sensor, source)
+			SELECT id, temperature, timestamp, sensor, source FROM main.temperature_readings WHERE strftime('%Y', timestamp) = ?`, strconv.Itoa(y))
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM main.temperature_readings WHERE strftime('%Y', timestamp) = ?", strconv.Itoa(y))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		log.Printf("Moved %d readings from %d into %s", n, y, yearFile(path, y))
+		if _, err := conn.ExecContext(ctx, "DETACH DATABASE "+schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readingTables returns the tables holding readings, for statements that
+// modify them and so cannot go through the view.
+func readingTables(tx *sql.Tx) ([]string, error) {
+	if !splitByYear {
+		return []string{"temperature_readings"}, nil
+	}
+	rows, err := tx.Query("PRAGMA database_list")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := []string{"main.temperature_readings"}
+	for rows.Next() {
+		var seq int
+		var name, file string
+		if err := rows.Scan(&seq, &name, &file); err != nil {
+			return nil, err
+		}
+		if len(name) == 5 && strings.HasPrefix(name, "y") {
+			tables = append(tables, name+".temperature_readings")
+		}
+	}
+	return tables, rows.Err()
+}
+
+// readingsTableFor is where a reading taken at ts is inserted: the file of
+// its year, if every connection has it attached, or else the main file,
+// from which the next start moves it into its year file as it does after
+// piheat import.
+func readingsTableFor(ts time.Time) string {
+	if !splitByYear {
+		return "temperature_readings"
+	}
+	year := ts.UTC().Year()
+	if year != time.Now().UTC().Year() && !openedYears[year] {
+		return "main.temperature_readings"
+	}
+	return yearSchema(year) + ".temperature_readings"
+}
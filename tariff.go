@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// TariffBand is a time-of-use electricity price: Price per kWh on Days
+// (default every day) between two local times. To before From runs past
+// midnight. Outside every band energy_price applies.
+type TariffBand struct {
+	Days  []string `json:"days,omitempty"`
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	Price float64  `json:"price"`
+}
+
+// compileTariff checks the bands and prepares them for targetAt.
+func compileTariff(bands []TariffBand) ([]compiledPeriod, error) {
+	var periods []compiledPeriod
+	for i, b := range bands {
+		if b.Price < 0 {
+			return nil, fmt.Errorf("band %d: price must not be negative", i+1)
+		}
+		c, err := compilePeriod(b.Days, b.From, b.To, b.Price)
+		if err != nil {
+			return nil, fmt.Errorf("band %d: %v", i+1, err)
+		}
+		periods = append(periods, c)
+	}
+	return periods, nil
+}
+
+// tariff is the configured time-of-use bands, checked when the config was
+// loaded.
+func tariff() []compiledPeriod {
+	bands, _ := compileTariff(config().Tariff)
+	return bands
+}
+
+// priceHours adds up the price over from to until, in price × hours, so
+// that a constant load's cost is its kW times the result.
+func priceHours(bands []compiledPeriod, from, until time.Time) float64 {
+	if len(bands) == 0 {
+		return config().EnergyPrice * until.Sub(from).Hours()
+	}
+	// The price can only change where a band starts or ends, or at
+	// midnight when the day does
+	minutes := []int{0}
+	for _, b := range bands {
+		minutes = append(minutes, b.from, b.to)
+	}
+	sort.Ints(minutes)
+
+	var total float64
+	for t := from; t.Before(until); {
+		next := nextTariffChange(minutes, t)
+		if next.After(until) {
+			next = until
+		}
+		total += targetAt(config().EnergyPrice, bands, t) * next.Sub(t).Hours()
+		t = next
+	}
+	return total
+}
+
+// nextTariffChange is the first of the minutes of the day after t, local
+// time.
+func nextTariffChange(minutes []int, t time.Time) time.Time {
+	t = t.Local()
+	y, m, d := t.Date()
+	for _, minute := range minutes {
+		if c := time.Date(y, m, d, minute/60, minute%60, 0, 0, time.Local); c.After(t) {
+			return c
+		}
+	}
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+}
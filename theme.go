@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Theme modes: light and dark look the same on every device, auto follows
+// each device's own preference.
+const (
+	themeAuto  = "auto"
+	themeLight = "light"
+	themeDark  = "dark"
+)
+
+const defaultAccent = "#2196f3"
+
+// ThemeConfig is the look of the web UI, stored on the hub so every
+// browser and kiosk showing the dashboard looks the same.
+type ThemeConfig struct {
+	Mode   string `json:"mode"`
+	Accent string `json:"accent"`
+}
+
+func (t ThemeConfig) check() error {
+	if t.Mode != themeAuto && t.Mode != themeLight && t.Mode != themeDark {
+		return fmt.Errorf("mode must be auto, light or dark")
+	}
+	if _, err := parseAccent(t.Accent); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseAccent reads a colour written #rrggbb.
+func parseAccent(s string) ([3]uint8, error) {
+	var rgb [3]uint8
+	if len(s) != 7 || s[0] != '#' {
+		return rgb, fmt.Errorf("accent must be a colour written #rrggbb, not %q", s)
+	}
+	for i := range rgb {
+		v, err := strconv.ParseUint(s[1+2*i:3+2*i], 16, 8)
+		if err != nil {
+			return rgb, fmt.Errorf("accent must be a colour written #rrggbb, not %q", s)
+		}
+		rgb[i] = uint8(v)
+	}
+	return rgb, nil
+}
+
+// Theme is the theme in use and the CSS variables the pages get from it.
+type Theme struct {
+	Mode      string            `json:"mode"`
+	Accent    string            `json:"accent"`
+	Variables map[string]string `json:"variables"`
+}
+
+// currentTheme derives the accent's darker shade, for text and borders on
+// light backgrounds, and its lighter one, for gradients and text on dark
+// ones. The backgrounds of each mode are in style.css.
+func currentTheme() Theme {
+	tc := config().Theme
+	rgb, err := parseAccent(tc.Accent)
+	if err != nil {
+		rgb, _ = parseAccent(defaultAccent)
+	}
+	mix := func(to uint8, f float64) string {
+		c := make([]string, 3)
+		for i, v := range rgb {
+			c[i] = fmt.Sprintf("%02x", uint8(float64(v)+(float64(to)-float64(v))*f+0.5))
+		}
+		return "#" + strings.Join(c, "")
+	}
+	return Theme{Mode: tc.Mode, Accent: strings.ToLower(tc.Accent), Variables: map[string]string{
+		"--accent":        mix(0, 0),
+		"--accent-strong": mix(0, 0.2),
+		"--accent-light":  mix(255, 0.3),
+		"--accent-rgb":    fmt.Sprintf("%d, %d, %d", rgb[0], rgb[1], rgb[2]),
+	}}
+}
+
+// CSS is a :root rule setting the theme's variables, for the pages' heads.
+func (t Theme) CSS() template.CSS {
+	names := make([]string, 0, len(t.Variables))
+	for name := range t.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(":root {")
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s: %s;", name, t.Variables[name])
+	}
+	b.WriteString(" }")
+	return template.CSS(b.String())
+}
+
+// themeHandler serves GET /api/settings/theme to anyone who may see the
+// dashboard, and PUT and DELETE to admins. PUT changes the given fields;
+// DELETE goes back to the config file's theme.
+func themeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, currentTheme())
+	case http.MethodPut, http.MethodDelete:
+		requireAdmin(updateThemeHandler)(w, r)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func updateThemeHandler(w http.ResponseWriter, r *http.Request) {
+	value := json.RawMessage("null")
+	if r.Method == http.MethodPut {
+		next := config().Theme
+		if err := json.NewDecoder(r.Body).Decode(&next); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid theme: %v", err), http.StatusBadRequest)
+			return
+		}
+		next.Accent = strings.ToLower(next.Accent)
+		if err := next.check(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid theme: %v", err), http.StatusBadRequest)
+			return
+		}
+		value, _ = json.Marshal(next)
+	}
+	if status, err := updateSettings(r, map[string]json.RawMessage{"theme": value}); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, http.StatusOK, currentTheme())
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// HTTPConfig bounds how long clients may take to send requests and read
+// responses, and how long a request may work before it is given up.
+type HTTPConfig struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	RequestTimeout    Duration `json:"request_timeout"`
+}
+
+func (c HTTPConfig) check() error {
+	for _, t := range []struct {
+		name string
+		d    Duration
+	}{
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"request_timeout", c.RequestTimeout},
+	} {
+		if t.d.Duration < 0 {
+			return fmt.Errorf("%s must not be negative", t.name)
+		}
+	}
+	if c.WriteTimeout.Duration > 0 && c.RequestTimeout.Duration >= c.WriteTimeout.Duration {
+		return fmt.Errorf("request_timeout must be below write_timeout, so the error can still be sent")
+	}
+	return nil
+}
+
+// newHTTPServer serves h with the connection timeouts of the config, which
+// apply from start; a reload leaves them as they were.
+func newHTTPServer(h http.Handler) *http.Server {
+	c := config().HTTP
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: c.ReadHeaderTimeout.Duration,
+		ReadTimeout:       c.ReadTimeout.Duration,
+		WriteTimeout:      c.WriteTimeout.Duration,
+		IdleTimeout:       c.IdleTimeout.Duration,
+	}
+}
+
+// limitRequests ends the context of a request after request_timeout, so
+// its database queries stop with it as they do when the client goes away.
+// The config is read per request, so reloads apply at once.
+func limitRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d := config().HTTP.RequestTimeout.Duration; d > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
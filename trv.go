@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sourceZigbee is the source of readings from TRVs, followed by the
+	// TRV's name.
+	sourceZigbee = "zigbee2mqtt:"
+	// trvTolerance is how far a TRV's reported value may be from the one
+	// sent before it counts as different. TRVs round setpoints to half
+	// degrees.
+	trvTolerance = 0.25
+	// trvSettle is how long after a command a differing setpoint is taken
+	// for the valve catching up rather than someone turning its knob.
+	trvSettle = 30 * time.Second
+)
+
+// TRVStatus is what /api/trvs reports for each radiator valve.
+type TRVStatus struct {
+	Name        string     `json:"name"`
+	Zone        string     `json:"zone,omitempty"`
+	Mode        string     `json:"mode"`
+	Sensor      string     `json:"sensor"`
+	Temperature *float64   `json:"temperature,omitempty"`
+	Setpoint    *float64   `json:"setpoint,omitempty"`
+	Position    *float64   `json:"position,omitempty"`
+	Battery     *float64   `json:"battery,omitempty"`
+	Available   *bool      `json:"available,omitempty"`
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+}
+
+// trvState is a radiator valve, what it last reported and what piheat
+// last sent it: a setpoint or a position, depending on its mode.
+type trvState struct {
+	name string
+	cfg  TRVConfig
+	zone string
+	want chan float64
+
+	mu       sync.Mutex
+	temp     *float64
+	setpoint *float64
+	position *float64
+	battery  *float64
+	// available is what zigbee2mqtt's availability feature last said,
+	// nil without it.
+	available *bool
+	seen      time.Time
+	sent      *float64
+	sentAt    time.Time
+}
+
+var trvs []*trvState
+
+// setupTRVs validates the trvs section of the config. Zones claim their
+// TRVs in setupZones.
+func setupTRVs(configs map[string]TRVConfig) error {
+	var list []*trvState
+	for name, tc := range configs {
+		if tc.Topic == "" {
+			return fmt.Errorf("trv %q: topic is required", name)
+		}
+		if config().MQTT == nil || config().MQTT.Broker == "" {
+			return fmt.Errorf("trv %q: needs an mqtt broker", name)
+		}
+		switch tc.Mode {
+		case "":
+			tc.Mode = "setpoint"
+		case "setpoint", "valve":
+		default:
+			return fmt.Errorf("trv %q: mode must be setpoint or valve", name)
+		}
+		if tc.Sensor == "" {
+			tc.Sensor = name
+		}
+		if tc.SetpointProperty == "" {
+			tc.SetpointProperty = "current_heating_setpoint"
+		}
+		if tc.PositionProperty == "" {
+			tc.PositionProperty = "position"
+		}
+		list = append(list, &trvState{name: name, cfg: tc, want: make(chan float64, 1)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	trvs = list
+	return nil
+}
+
+// startTRVs subscribes to the state every TRV publishes, and to its
+// availability.
+func startTRVs() {
+	for _, t := range trvs {
+		if err := mqttSubscribe(t.cfg.Topic, t.message); err != nil {
+			log.Printf("Error subscribing to TRV %s: %v", t.name, err)
+		}
+		if err := mqttSubscribe(t.cfg.Topic+"/availability", t.availability); err != nil {
+			log.Printf("Error subscribing to TRV %s: %v", t.name, err)
+		}
+	}
+}
+
+// availability takes zigbee2mqtt's availability of the valve, either
+// {"state": "online"} or, from older versions, the bare state.
+func (t *trvState) availability(topic string, payload []byte) {
+	var msg struct {
+		State string `json:"state"`
+	}
+	state := string(payload)
+	if json.Unmarshal(payload, &msg) == nil {
+		state = msg.State
+	}
+	if state != "online" && state != "offline" {
+		return
+	}
+	available := state == "online"
+	t.mu.Lock()
+	changed := t.available == nil || *t.available != available
+	t.available = &available
+	t.mu.Unlock()
+	if changed {
+		log.Printf("TRV %s is %s", t.name, state)
+	}
+}
+
+// message takes a zigbee2mqtt state update. The local temperature is
+// recorded as a reading; a setpoint that differs from the one piheat sent
+// was set on the valve itself and becomes the zone's setpoint.
+func (t *trvState) message(topic string, payload []byte) {
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return
+	}
+	number := func(key string) *float64 {
+		var v float64
+		if raw, ok := state[key]; ok && json.Unmarshal(raw, &v) == nil && !math.IsNaN(v) {
+			return &v
+		}
+		return nil
+	}
+	temp := number("local_temperature")
+	setpoint := number(t.cfg.SetpointProperty)
+	position := number(t.cfg.PositionProperty)
+	battery := number("battery")
+
+	t.mu.Lock()
+	if temp != nil {
+		t.temp = temp
+	}
+	if setpoint != nil {
+		t.setpoint = setpoint
+	}
+	if battery != nil {
+		t.battery = battery
+	}
+	if position != nil {
+		if t.position == nil || *t.position != *position {
+			recordActuator(actuatorTRV, t.name, positionDuty(*position), clock.Now())
+		}
+		t.position = position
+	}
+	t.seen = clock.Now()
+	first := t.sent == nil
+	adopt := t.zone != "" && t.cfg.Mode == "setpoint" && setpoint != nil && failover.controlling() &&
+		(first || math.Abs(*setpoint-*t.sent) > trvTolerance && clock.Now().Sub(t.sentAt) >= trvSettle)
+	t.mu.Unlock()
+
+	if temp != nil {
+		recordReading(t.cfg.Sensor, *temp, sourceZigbee+t.name)
+	}
+	if adopt && t.adoptSetpoint(*setpoint, first) {
+		t.mu.Lock()
+		v := *setpoint
+		t.sent, t.sentAt = &v, clock.Now()
+		t.mu.Unlock()
+	}
+}
+
+// adoptSetpoint makes a setpoint set on the valve the zone's, and reports
+// whether the zone has it now. Before piheat has sent the valve anything,
+// the valve's setpoint is only taken by a zone that has none.
+func (t *trvState) adoptSetpoint(v float64, first bool) bool {
+	old := currentSetpointValue(t.zone)
+	if first && old != nil {
+		return false
+	}
+	if old != nil && math.Abs(old.(float64)-v) <= trvTolerance {
+		return true
+	}
+	if err := validateSetpoint(t.zone, v); err != nil {
+		log.Printf("Ignoring setpoint %.1f°C from TRV %s: %v", v, t.name, err)
+		return false
+	}
+	sp, err := setSetpoint(t.zone, v)
+	if err != nil {
+		log.Printf("Error saving setpoint from TRV %s: %v", t.name, err)
+		return false
+	}
+	log.Printf("Zone %s takes setpoint %.1f°C set on TRV %s", t.zone, v, t.name)
+	audit(auditTRV, t.name, "setpoint.set", t.zone, old, sp.Temperature)
+	return true
+}
+
+// set replaces the wanted setpoint or position in the mailbox without
+// blocking.
+func (t *trvState) set(v float64) {
+	select {
+	case <-t.want:
+	default:
+	}
+	t.want <- v
+}
+
+// run sends the valve its setpoint or position when the wanted value
+// changes, and again while the valve keeps reporting another one.
+func (t *trvState) run() {
+	property := t.cfg.SetpointProperty
+	if t.cfg.Mode == "valve" {
+		property = t.cfg.PositionProperty
+	}
+	for v := range t.want {
+		t.mu.Lock()
+		reported := t.setpoint
+		if t.cfg.Mode == "valve" {
+			reported = t.position
+		}
+		mismatch := reported != nil && math.Abs(*reported-v) > trvTolerance
+		skip := t.sent != nil && math.Abs(*t.sent-v) <= trvTolerance && (!mismatch || clock.Now().Sub(t.sentAt) < relayEnforce)
+		t.mu.Unlock()
+		if skip {
+			continue
+		}
+		payload, _ := json.Marshal(map[string]float64{property: v})
+		if err := mqttPublish(t.cfg.Topic+"/set", payload); err != nil {
+			log.Printf("Error setting TRV %s %s to %g: %v", t.name, property, v, err)
+			continue
+		}
+		t.mu.Lock()
+		sent := v
+		t.sent, t.sentAt = &sent, clock.Now()
+		t.mu.Unlock()
+	}
+}
+
+func (t *trvState) snapshot() TRVStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := TRVStatus{Name: t.name, Zone: t.zone, Mode: t.cfg.Mode, Sensor: t.cfg.Sensor,
+		Temperature: t.temp, Setpoint: t.setpoint, Position: t.position, Battery: t.battery, Available: t.available}
+	if t.temp != nil {
+		v := roundReading(t.cfg.Sensor, *t.temp)
+		s.Temperature = &v
+	}
+	if !t.seen.IsZero() {
+		seen := t.seen
+		s.LastSeen = &seen
+	}
+	return s
+}
+
+// trvsHandler serves GET /api/trvs.
+func trvsHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]TRVStatus, 0, len(trvs))
+	for _, t := range trvs {
+		list = append(list, t.snapshot())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roles of users. Viewers can see the dashboards and use the read APIs;
+// admins can also change setpoints, alert rules and settings, and use
+// everything under /api/admin.
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
+
+// User is an account that can log in to the dashboard.
+type User struct {
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const sessionCookie = "piheat_session"
+
+// passwordIterations is the PBKDF2 work factor, about a tenth of a second
+// on a Raspberry Pi 4.
+const passwordIterations = 100000
+
+var errBadLogin = errors.New("invalid username or password")
+
+func initUserTables() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Sessions are kept by the hash of their token, so the database alone
+	// is not enough to take one over
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// hashPassword returns a salted PBKDF2-SHA256 hash of password in the form
+// pbkdf2-sha256$<iterations>$<salt>$<key>.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, 32)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword.
+func checkPassword(hash, password string) bool {
+	f := strings.Split(hash, "$")
+	if len(f) != 4 || f[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(f[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err1 := enc.DecodeString(f[2])
+	want, err2 := enc.DecodeString(f[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iter, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := 1; len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// usersEnabled reports whether any user exists. Until the first one is
+// created the dashboard and read APIs stay open, as before users existed.
+func usersEnabled() bool {
+	var n int
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users)").Scan(&n); err != nil {
+		// A read-only instance may serve a database from before users
+		if readOnly && strings.Contains(err.Error(), "no such table") {
+			return false
+		}
+		log.Printf("Error querying database: %v", err)
+		return true
+	}
+	return n > 0
+}
+
+func validRole(role string) bool {
+	return role == roleViewer || role == roleAdmin
+}
+
+func checkNewPassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	return nil
+}
+
+func createUser(username, password, role string) (User, error) {
+	if username == "" || strings.ContainsAny(username, "/ ") {
+		return User{}, errors.New("username must be non-empty, without spaces or slashes")
+	}
+	if !validRole(role) {
+		return User{}, fmt.Errorf("role must be %s or %s", roleViewer, roleAdmin)
+	}
+	if err := checkNewPassword(password); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	u := User{Username: username, Role: role, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if _, err := db.Exec("INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)",
+		u.Username, hash, u.Role, sqliteTime(u.CreatedAt)); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return User{}, fmt.Errorf("user %q already exists", username)
+		}
+		return User{}, err
+	}
+	return u, nil
+}
+
+func listUsers() ([]User, error) {
+	rows, err := db.Query("SELECT username, role, created_at FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []User{}
+	for rows.Next() {
+		var u User
+		var createdAt string
+		if err := rows.Scan(&u.Username, &u.Role, &createdAt); err != nil {
+			return nil, err
+		}
+		u.CreatedAt, _ = parseSQLiteTime(createdAt)
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func getUser(username string) (User, error) {
+	var u User
+	var createdAt string
+	err := db.QueryRow("SELECT username, role, created_at FROM users WHERE username = ?", username).Scan(&u.Username, &u.Role, &createdAt)
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf("%w: %q", errNoUser, username)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	u.CreatedAt, _ = parseSQLiteTime(createdAt)
+	return u, nil
+}
+
+// errLastAdmin keeps the users that remain from being locked out of
+// administration.
+var errLastAdmin = errors.New("that would leave no admin user")
+
+// checkAdminsLeft returns errLastAdmin if taking username out of the admins
+// would leave users but no admin.
+func checkAdminsLeft(tx *sql.Tx, username string, deleting bool) error {
+	var admins, others int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = ? AND username != ?", roleAdmin, username).Scan(&admins); err != nil {
+		return err
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username != ?", username).Scan(&others); err != nil {
+		return err
+	}
+	if admins == 0 && (others > 0 || !deleting) {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// updateUser changes the password and/or role of a user. A new password
+// ends the user's sessions.
+func updateUser(username string, password, role *string) (User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+	var id int64
+	var current string
+	err = tx.QueryRow("SELECT id, role FROM users WHERE username = ?", username).Scan(&id, &current)
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf("%w: %q", errNoUser, username)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if role != nil && *role != current {
+		if !validRole(*role) {
+			return User{}, fmt.Errorf("role must be %s or %s", roleViewer, roleAdmin)
+		}
+		if current == roleAdmin {
+			if err := checkAdminsLeft(tx, username, false); err != nil {
+				return User{}, err
+			}
+		}
+		if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", *role, id); err != nil {
+			return User{}, err
+		}
+	}
+	if password != nil {
+		if err := checkNewPassword(*password); err != nil {
+			return User{}, err
+		}
+		hash, err := hashPassword(*password)
+		if err != nil {
+			return User{}, err
+		}
+		if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, id); err != nil {
+			return User{}, err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+			return User{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return getUser(username)
+}
+
+var errNoUser = errors.New("no such user")
+
+// deleteUser removes a user and their sessions.
+func deleteUser(username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var id int64
+	var role string
+	err = tx.QueryRow("SELECT id, role FROM users WHERE username = ?", username).Scan(&id, &role)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %q", errNoUser, username)
+	}
+	if err != nil {
+		return err
+	}
+	if role == roleAdmin {
+		if err := checkAdminsLeft(tx, username, true); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_landing WHERE username = ?", username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// login checks a username and password and starts a session, returning its
+// token.
+func login(username, password string) (string, User, error) {
+	var id int64
+	var hash, createdAt string
+	var u User
+	err := db.QueryRow("SELECT id, username, password_hash, role, created_at FROM users WHERE username = ?", username).
+		Scan(&id, &u.Username, &hash, &u.Role, &createdAt)
+	if err == sql.ErrNoRows {
+		// Hash anyway, so a failed login takes as long whether or not the
+		// user exists
+		pbkdf2SHA256([]byte(password), nil, passwordIterations, 32)
+		return "", User{}, errBadLogin
+	}
+	if err != nil {
+		return "", User{}, err
+	}
+	if !checkPassword(hash, password) {
+		return "", User{}, errBadLogin
+	}
+	u.CreatedAt, _ = parseSQLiteTime(createdAt)
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", User{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	if _, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", sqliteTime(now)); err != nil {
+		return "", User{}, err
+	}
+	if _, err := db.Exec("INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), id, sqliteTime(now), sqliteTime(now.Add(config().SessionLifetime.Duration))); err != nil {
+		return "", User{}, err
+	}
+	return token, u, nil
+}
+
+// sessionUser returns the user of the session cookie r carries, or nil.
+func sessionUser(r *http.Request) *User {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	return tokenUser(c.Value)
+}
+
+// tokenUser returns the user of an unexpired session token, or nil.
+func tokenUser(token string) *User {
+	var u User
+	var createdAt string
+	err := db.QueryRow(`SELECT u.username, u.role, u.created_at FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`, hashToken(token), sqliteTime(time.Now())).
+		Scan(&u.Username, &u.Role, &createdAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error querying database: %v", err)
+		}
+		return nil
+	}
+	u.CreatedAt, _ = parseSQLiteTime(createdAt)
+	return &u
+}
+
+func logout(r *http.Request) error {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	_, err = db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(c.Value))
+	return err
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string) {
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     basePath + "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// Browsers only send the cookie with cross-site API calls when it is
+	// SameSite=None, which they only accept over HTTPS
+	if config().CORS.AllowCredentials && r.TLS != nil {
+		c.SameSite = http.SameSiteNoneMode
+	}
+	if token == "" {
+		c.MaxAge = -1
+	} else {
+		c.MaxAge = int(config().SessionLifetime.Seconds())
+	}
+	http.SetCookie(w, c)
+}
+
+type userKey struct{}
+
+// currentUser is the logged-in user of a request that passed requireLogin,
+// or nil.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey{}).(*User)
+	return u
+}
+
+// loginPaths can be reached without logging in. Browsers fetch the web app
+// manifest without cookies.
+var loginPaths = map[string]bool{"/login": true, "/api/login": true, "/api/openapi.json": true, "/api/docs": true,
+	"/manifest.json": true, "/sw.js": true}
+
+// viewerPosts are the POST endpoints that change nothing, so viewers may
+// use them.
+var viewerPosts = map[string]bool{"/logout": true, "/api/logout": true, "/api/schedule/simulate": true}
+
+// viewerPuts are the PUT endpoints that only change the viewer's own
+// preferences.
+var viewerPuts = map[string]bool{"/api/landing": true, "/api/language": true}
+
+// viewerOwnPosts are the POST endpoints that only change the viewer's own
+// devices.
+var viewerOwnPosts = map[string]bool{"/api/push/subscribe": true, "/api/push/unsubscribe": true}
+
+// requireLogin makes every request but the login page need a session once
+// users exist: any role may read, only admins may write. The admin_token
+// still works as a bearer token for scripts, signed chart links keep
+// working for chat notifications and registered devices may read.
+func requireLogin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !usersEnabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u := sessionUser(r)
+		if u != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, u))
+		}
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions ||
+			(r.Method == http.MethodPost && viewerPosts[r.URL.Path]) || (r.Method == http.MethodPut && u != nil && viewerPuts[r.URL.Path]) ||
+			(r.Method == http.MethodPost && u != nil && viewerOwnPosts[r.URL.Path])
+		switch {
+		case loginPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/static/") || strings.HasPrefix(r.URL.Path, "/icons/") || strings.HasPrefix(r.URL.Path, "/api/ingest/") ||
+			strings.HasPrefix(r.URL.Path, "/api/presence/") ||
+			r.URL.Path == "/api/failover/sync" || hasAdminToken(r):
+		case u == nil:
+			if signed, valid := signatureStatus(r); read && signed && valid {
+				break
+			}
+			// A registered device, such as a kiosk, may read without a login
+			if read && (requestDevice(r) != nil || newDeviceLink(r)) {
+				break
+			}
+			if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/legacy/") && r.URL.Path != "/metrics" {
+				http.Redirect(w, r, basePath+"/login?next="+url.QueryEscape(basePath+r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			apiError(w, r, http.StatusUnauthorized, "login_required", "Login required")
+			return
+		case !read && u.Role != roleAdmin:
+			apiError(w, r, http.StatusForbidden, "admin_required", "Admin role required")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// safeNext keeps the redirect after login on this site.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return basePath + "/"
+	}
+	return next
+}
+
+// loginPageHandler serves the login form and takes its submission.
+func loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+	var loginErr string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		token, u, err := login(r.PostFormValue("username"), r.PostFormValue("password"))
+		if err == nil {
+			setSessionCookie(w, r, token)
+			log.Printf("User %s logged in from %s", u.Username, r.RemoteAddr)
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		if err != errBadLogin {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		loginErr = err.Error()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, err := parseTemplate("login.html", requestLanguage(r))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		BasePath     string
+		AssetVersion string
+		Next         string
+		Error        string
+	}{basePath, assetVersion, next, loginErr})
+}
+
+// logoutPageHandler ends the session and returns to the login form.
+func logoutPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := logout(r); err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, "")
+	http.Redirect(w, r, basePath+"/login", http.StatusSeeOther)
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginHandler serves POST /api/login and sets the session cookie.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid login: %v", err), http.StatusBadRequest)
+		return
+	}
+	token, u, err := login(req.Username, req.Password)
+	if err == errBadLogin {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token)
+	log.Printf("User %s logged in from %s", u.Username, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, u)
+}
+
+// logoutHandler serves POST /api/logout.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := logout(r); err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionHandler serves GET /api/session, the logged-in user.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+// userAuditValue is what the audit log keeps of a user: the role, and
+// whether the password was changed, never the password itself.
+func userAuditValue(u User, passwordChanged bool) map[string]interface{} {
+	v := map[string]interface{}{"role": u.Role}
+	if passwordChanged {
+		v["password"] = settingsMask
+	}
+	return v
+}
+
+// userRequest is the body of POST /api/admin/users and of PUT on a user,
+// where omitted fields are left as they are.
+type userRequest struct {
+	Username string  `json:"username"`
+	Password *string `json:"password"`
+	Role     *string `json:"role"`
+}
+
+// usersHandler serves /api/admin/users: GET lists the users, POST creates
+// one. /api/admin/users/{name} takes PUT and DELETE.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/admin/users"), "/")
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := listUsers()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			var req userRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid user: %v", err), http.StatusBadRequest)
+				return
+			}
+			role, password := roleViewer, ""
+			if req.Role != nil {
+				role = *req.Role
+			}
+			if req.Password != nil {
+				password = *req.Password
+			}
+			u, err := createUser(req.Username, password, role)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid user: %v", err), http.StatusBadRequest)
+				return
+			}
+			log.Printf("User %s (%s) created from %s", u.Username, u.Role, r.RemoteAddr)
+			auditRequest(r, "user.create", u.Username, nil, u)
+			writeJSON(w, http.StatusCreated, u)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid user: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Role != nil && !validRole(*req.Role) {
+			http.Error(w, fmt.Sprintf("Invalid user: role must be %s or %s", roleViewer, roleAdmin), http.StatusBadRequest)
+			return
+		}
+		if req.Password != nil {
+			if err := checkNewPassword(*req.Password); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid user: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		var old, u User
+		if old, err = getUser(name); err != nil {
+			break
+		}
+		if u, err = updateUser(name, req.Password, req.Role); err == nil {
+			log.Printf("User %s changed from %s", name, r.RemoteAddr)
+			auditRequest(r, "user.update", name, userAuditValue(old, false), userAuditValue(u, req.Password != nil))
+			writeJSON(w, http.StatusOK, u)
+			return
+		}
+	case http.MethodDelete:
+		var old User
+		if old, err = getUser(name); err != nil {
+			break
+		}
+		if err = deleteUser(name); err == nil {
+			log.Printf("User %s deleted from %s", name, r.RemoteAddr)
+			auditRequest(r, "user.delete", name, old, nil)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, errNoUser):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == errLastAdmin:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+	}
+}
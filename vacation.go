@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vacationTemperature is the frost protection a vacation holds the
+	// zones at without a temperature of its own.
+	vacationTemperature = 8
+	// vacationPreheat is how long before the return the zones go back to
+	// their setpoints without a preheat of their own.
+	vacationPreheat = 2 * time.Hour
+	// vacationMaxPreheat bounds the preheat of a vacation.
+	vacationMaxPreheat = 48 * time.Hour
+)
+
+// States of a vacation.
+const (
+	vacationScheduled  = "scheduled"
+	vacationActive     = "active"
+	vacationPreheating = "preheating"
+	vacationEnded      = "ended"
+)
+
+// Vacation holds every zone at Temperature from From until Preheat before
+// To, the return, when the zones go back to their setpoints so the house
+// is warm by the time anybody is back.
+type Vacation struct {
+	ID          int64     `json:"id"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	Temperature float64   `json:"temperature"`
+	Preheat     Duration  `json:"preheat"`
+	State       string    `json:"state"`
+	Actor       string    `json:"actor"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// vacationRequest is the body of POST /api/vacations. From defaults to
+// now, Temperature to vacationTemperature and Preheat to vacationPreheat.
+type vacationRequest struct {
+	From        *time.Time `json:"from"`
+	To          time.Time  `json:"to"`
+	Temperature *float64   `json:"temperature"`
+	Preheat     *Duration  `json:"preheat"`
+}
+
+// preheatFrom is when the zones go back to their setpoints.
+func (v Vacation) preheatFrom() time.Time {
+	return v.To.Add(-v.Preheat.Duration)
+}
+
+func (v Vacation) state(now time.Time) string {
+	switch {
+	case now.Before(v.From):
+		return vacationScheduled
+	case now.Before(v.preheatFrom()):
+		return vacationActive
+	case now.Before(v.To):
+		return vacationPreheating
+	}
+	return vacationEnded
+}
+
+// vacationPlan keeps the vacations that have not ended in memory, for the
+// control loop.
+type vacationPlan struct {
+	mu   sync.Mutex
+	list []Vacation
+	// announced is the vacation and state last logged.
+	announcedID    int64
+	announcedState string
+}
+
+var vacations = &vacationPlan{}
+
+func initVacationTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS vacations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		starts_at DATETIME NOT NULL,
+		ends_at DATETIME NOT NULL,
+		temperature REAL NOT NULL,
+		preheat_seconds INTEGER NOT NULL,
+		actor TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const vacationColumns = "id, starts_at, ends_at, temperature, preheat_seconds, actor, created_at"
+
+func scanVacations(ctx context.Context, now time.Time, query string, args ...interface{}) ([]Vacation, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Vacation{}
+	for rows.Next() {
+		var v Vacation
+		var from, to, createdAt string
+		var preheat int64
+		if err := rows.Scan(&v.ID, &from, &to, &v.Temperature, &preheat, &v.Actor, &createdAt); err != nil {
+			return nil, err
+		}
+		v.From, _ = parseSQLiteTime(from)
+		v.To, _ = parseSQLiteTime(to)
+		v.CreatedAt, _ = parseSQLiteTime(createdAt)
+		v.Preheat = Duration{time.Duration(preheat) * time.Second}
+		v.State = v.state(now)
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// load reads the vacations that have not ended yet.
+func (p *vacationPlan) load() error {
+	now := clock.Now()
+	list, err := scanVacations(context.Background(), now, "SELECT "+vacationColumns+" FROM vacations WHERE ends_at > ? ORDER BY starts_at", sqliteTime(now))
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.list = list
+	return nil
+}
+
+// at returns the vacation under way at now, if any.
+func (p *vacationPlan) at(now time.Time) (Vacation, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, v := range p.list {
+		if s := v.state(now); s == vacationActive || s == vacationPreheating {
+			v.State = s
+			return v, true
+		}
+	}
+	return Vacation{}, false
+}
+
+// announce logs a vacation starting, the preheat and the return, and
+// forgets vacations that have ended.
+func (p *vacationPlan) announce(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var id int64
+	state := ""
+	kept := p.list[:0]
+	for _, v := range p.list {
+		s := v.state(now)
+		if s == vacationEnded {
+			if v.ID == p.announcedID {
+				log.Printf("Vacation %d: over, zones back on their setpoints", v.ID)
+				p.announcedID, p.announcedState = 0, ""
+			}
+			continue
+		}
+		kept = append(kept, v)
+		if id == 0 && (s == vacationActive || s == vacationPreheating) {
+			id, state = v.ID, s
+		}
+	}
+	p.list = kept
+	if id == 0 || (id == p.announcedID && state == p.announcedState) {
+		return
+	}
+	for _, v := range p.list {
+		if v.ID != id {
+			continue
+		}
+		if state == vacationActive {
+			log.Printf("Vacation %d: zones held at %.1f°C until %s", id, v.Temperature, v.preheatFrom().Local().Format("2006-01-02 15:04"))
+		} else {
+			log.Printf("Vacation %d: pre-heating for the return at %s", id, v.To.Local().Format("2006-01-02 15:04"))
+		}
+	}
+	p.announcedID, p.announcedState = id, state
+}
+
+// vacationStep holds a zone at the vacation's frost protection, or while
+// pre-heating leaves its setpoint be. A setpoint already below stands.
+func (z *zoneState) vacationStep(setpoint float64, v Vacation) SetpointStep {
+	if v.State == vacationPreheating {
+		return SetpointStep{Layer: "vacation", Setpoint: setpoint,
+			Detail: "pre-heating for the return at " + v.To.Local().Format("2006-01-02 15:04")}
+	}
+	detail := fmt.Sprintf("on vacation until %s: frost protection %.1f°C", v.preheatFrom().Local().Format("2006-01-02 15:04"), v.Temperature)
+	if setpoint <= v.Temperature {
+		return SetpointStep{Layer: "vacation", Setpoint: setpoint, Detail: detail + ", already below"}
+	}
+	return SetpointStep{Layer: "vacation", Setpoint: v.Temperature, Detail: detail}
+}
+
+// vacationsHandler serves GET and POST /api/vacations and GET and DELETE
+// /api/vacations/{id}.
+func vacationsHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/vacations"), "/")
+	if idStr == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list, err := scanVacations(r.Context(), clock.Now(), "SELECT "+vacationColumns+" FROM vacations ORDER BY starts_at DESC, id DESC LIMIT 100")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			createVacation(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	list, err := scanVacations(r.Context(), clock.Now(), "SELECT "+vacationColumns+" FROM vacations WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(list) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, list[0])
+	case http.MethodDelete:
+		if _, err := db.Exec("DELETE FROM vacations WHERE id = ?", id); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting vacation: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := vacations.load(); err != nil {
+			log.Printf("Error loading vacations: %v", err)
+		}
+		if s := list[0].State; s == vacationActive || s == vacationPreheating {
+			log.Printf("Vacation %d: cancelled, zones back on their setpoints", id)
+		}
+		auditRequest(r, "vacation.delete", idStr, list[0], nil)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createVacation(w http.ResponseWriter, r *http.Request) {
+	var req vacationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	now := clock.Now().UTC().Truncate(time.Second)
+	v := Vacation{From: now, To: req.To.UTC().Truncate(time.Second), Temperature: vacationTemperature,
+		Preheat: Duration{vacationPreheat}, Actor: requestActor(r), CreatedAt: now}
+	if req.From != nil && req.From.After(now) {
+		v.From = req.From.UTC().Truncate(time.Second)
+	}
+	if req.Temperature != nil {
+		v.Temperature = *req.Temperature
+	}
+	if req.Preheat != nil {
+		v.Preheat = *req.Preheat
+	}
+	switch {
+	case !v.To.After(now):
+		http.Error(w, "to, the return, must be in the future", http.StatusBadRequest)
+		return
+	case !v.To.After(v.From):
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	case math.IsNaN(v.Temperature) || v.Temperature < setpointMin || v.Temperature > setpointMax:
+		http.Error(w, fmt.Sprintf("temperature must be between %.0f and %.0f°C", setpointMin, setpointMax), http.StatusBadRequest)
+		return
+	case v.Preheat.Duration < 0 || v.Preheat.Duration > vacationMaxPreheat:
+		http.Error(w, fmt.Sprintf("preheat must be between 0 and %s", vacationMaxPreheat), http.StatusBadRequest)
+		return
+	case v.Preheat.Duration >= v.To.Sub(v.From):
+		http.Error(w, "preheat must be shorter than the vacation", http.StatusBadRequest)
+		return
+	}
+	var overlapping int64
+	err := db.QueryRow("SELECT COUNT(*) FROM vacations WHERE starts_at < ? AND ends_at > ?", sqliteTime(v.To), sqliteTime(v.From)).Scan(&overlapping)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if overlapping > 0 {
+		http.Error(w, "Overlaps another vacation", http.StatusConflict)
+		return
+	}
+	res, err := db.Exec("INSERT INTO vacations (starts_at, ends_at, temperature, preheat_seconds, actor, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		sqliteTime(v.From), sqliteTime(v.To), v.Temperature, int64(v.Preheat.Seconds()), v.Actor, sqliteTime(v.CreatedAt))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving vacation: %v", err), http.StatusInternalServerError)
+		return
+	}
+	v.ID, _ = res.LastInsertId()
+	v.State = v.state(now)
+	if err := vacations.load(); err != nil {
+		log.Printf("Error loading vacations: %v", err)
+	}
+	auditRequest(r, "vacation.create", strconv.FormatInt(v.ID, 10), nil, v)
+	writeJSON(w, http.StatusCreated, v)
+}
+
+func writeVacationMetrics(b *strings.Builder) {
+	v := 0
+	if vac, ok := vacations.at(clock.Now()); ok && vac.State == vacationActive {
+		v = 1
+	}
+	b.WriteString("# HELP piheat_vacation_active Whether the zones are held at a vacation's frost protection.\n")
+	b.WriteString("# TYPE piheat_vacation_active gauge\n")
+	fmt.Fprintf(b, "piheat_vacation_active %d\n", v)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// validationSettle is how many rejected jumps in a row, all close to
+	// each other, are taken as a real change rather than spikes.
+	validationSettle = 3
+	// validationLogEvery is how often rejections of the same sensor are
+	// logged, with the count since the last line.
+	validationLogEvery = time.Minute
+)
+
+// ValidationConfig checks a sensor's readings before they are stored.
+// Readings below Min or above Max are rejected, as are readings more than
+// MaxDelta from the previous accepted one, until validationSettle of them
+// in a row agree. Median stores the median of the latest three readings,
+// which removes single spikes at the cost of one reading's delay.
+type ValidationConfig struct {
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	MaxDelta float64  `json:"max_delta,omitempty"`
+	Median   bool     `json:"median,omitempty"`
+}
+
+func (v ValidationConfig) check() error {
+	if v.Min != nil && v.Max != nil && *v.Min >= *v.Max {
+		return fmt.Errorf("min must be below max")
+	}
+	if v.MaxDelta < 0 {
+		return fmt.Errorf("max_delta must be positive")
+	}
+	return nil
+}
+
+func checkValidation(configs map[string]ValidationConfig) error {
+	for pattern, v := range configs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("validation: invalid sensor pattern %q", pattern)
+		}
+		if err := v.check(); err != nil {
+			return fmt.Errorf("validation %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// validationFor returns the checks of sensor, matched like precision.
+func validationFor(sensor string) (ValidationConfig, bool) {
+	if v, ok := config().Validation[sensor]; ok {
+		return v, true
+	}
+	patterns := make([]string, 0, len(config().Validation))
+	for pattern := range config().Validation {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, sensor); ok {
+			return config().Validation[pattern], true
+		}
+	}
+	return ValidationConfig{}, false
+}
+
+// sensorFilter is a sensor's validation state: the last accepted reading,
+// the jumps rejected in a row, the latest readings for the median and the
+// rejections per reason.
+type sensorFilter struct {
+	last     float64
+	hasLast  bool
+	jumps    []float64
+	recent   []float64
+	rejected map[string]int64
+	pending  int64
+	logged   time.Time
+}
+
+var readingFilters = struct {
+	sync.Mutex
+	sensors map[string]*sensorFilter
+}{sensors: map[string]*sensorFilter{}}
+
+// validateReading checks a reading against its sensor's validation and
+// returns the value to store, or false when it is rejected.
+func validateReading(sensor string, v float64, source string, now time.Time) (float64, bool) {
+	vc, ok := validationFor(sensor)
+	if !ok {
+		return v, true
+	}
+	readingFilters.Lock()
+	defer readingFilters.Unlock()
+	f := readingFilters.sensors[sensor]
+	if f == nil {
+		f = &sensorFilter{rejected: map[string]int64{}}
+		readingFilters.sensors[sensor] = f
+	}
+	var reason string
+	switch {
+	case vc.Min != nil && v < *vc.Min:
+		reason = "range"
+	case vc.Max != nil && v > *vc.Max:
+		reason = "range"
+	case vc.MaxDelta > 0 && f.hasLast && math.Abs(v-f.last) > vc.MaxDelta:
+		f.jumps = append(f.jumps, v)
+		if !f.settled(vc.MaxDelta) {
+			reason = "delta"
+		}
+	}
+	if reason != "" {
+		f.rejected[reason]++
+		f.pending++
+		if now.Sub(f.logged) >= validationLogEvery {
+			detail := fmt.Sprintf("outside %s", validationRange(vc))
+			if reason == "delta" {
+				detail = fmt.Sprintf("%s°C from the previous %s°C, over max_delta %s°C", formatReading(sensor, math.Abs(v-f.last)), formatReading(sensor, f.last), formatReading(sensor, vc.MaxDelta))
+			}
+			log.Printf("Rejected reading %s from %s: %s (%d rejected since the last report)", strconv.FormatFloat(v, 'f', -1, 64), sensorSource(sensor, source), detail, f.pending)
+			f.logged, f.pending = now, 0
+		}
+		return 0, false
+	}
+	if len(f.jumps) > 0 && math.Abs(v-f.last) <= vc.MaxDelta {
+		f.jumps = f.jumps[:0]
+	}
+	f.last, f.hasLast = v, true
+	if !vc.Median {
+		f.recent = f.recent[:0]
+		return v, true
+	}
+	f.recent = append(f.recent, v)
+	if len(f.recent) > 3 {
+		f.recent = f.recent[len(f.recent)-3:]
+	}
+	if len(f.recent) < 3 {
+		return v, true
+	}
+	m := []float64{f.recent[0], f.recent[1], f.recent[2]}
+	sort.Float64s(m)
+	return m[1], true
+}
+
+// settled reports whether the jumps rejected in a row are a real change:
+// enough of them, each within maxDelta of the one before. The new level
+// is then taken as the last accepted reading.
+func (f *sensorFilter) settled(maxDelta float64) bool {
+	if len(f.jumps) < validationSettle {
+		return false
+	}
+	jumps := f.jumps[len(f.jumps)-validationSettle:]
+	for i := 1; i < len(jumps); i++ {
+		if math.Abs(jumps[i]-jumps[i-1]) > maxDelta {
+			f.jumps = jumps[i:]
+			return false
+		}
+	}
+	f.jumps = f.jumps[:0]
+	f.recent = f.recent[:0]
+	return true
+}
+
+func validationRange(vc ValidationConfig) string {
+	lo, hi := "-∞", "∞"
+	if vc.Min != nil {
+		lo = strconv.FormatFloat(*vc.Min, 'f', -1, 64)
+	}
+	if vc.Max != nil {
+		hi = strconv.FormatFloat(*vc.Max, 'f', -1, 64)
+	}
+	return lo + ".." + hi
+}
+
+// sensorSource names a sensor with the device behind it, when it arrived
+// through a listener.
+func sensorSource(sensor, source string) string {
+	if source == "" || source == sourceLocal {
+		return sensor
+	}
+	return sensor + " (" + source + ")"
+}
+
+// rejectedReadings is the number of rejected readings per sensor and
+// reason.
+func rejectedReadings() map[string]map[string]int64 {
+	readingFilters.Lock()
+	defer readingFilters.Unlock()
+	out := map[string]map[string]int64{}
+	for sensor, f := range readingFilters.sensors {
+		if len(f.rejected) == 0 {
+			continue
+		}
+		counts := map[string]int64{}
+		for reason, n := range f.rejected {
+			counts[reason] = n
+		}
+		out[sensor] = counts
+	}
+	return out
+}
+
+func writeValidationMetrics(b *strings.Builder) {
+	rejected := rejectedReadings()
+	sensors := make([]string, 0, len(rejected))
+	for s := range rejected {
+		sensors = append(sensors, s)
+	}
+	sort.Strings(sensors)
+	b.WriteString("# HELP piheat_readings_rejected_total Readings rejected by validation since start, per sensor and reason.\n")
+	b.WriteString("# TYPE piheat_readings_rejected_total counter\n")
+	for _, s := range sensors {
+		for _, reason := range []string{"range", "delta"} {
+			if n, ok := rejected[s][reason]; ok {
+				fmt.Fprintf(b, "piheat_readings_rejected_total{sensor=%s,reason=%q} %d\n", strconv.Quote(s), reason, n)
+			}
+		}
+	}
+}
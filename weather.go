@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	openMeteoURL      = "https://api.open-meteo.com"
+	openWeatherMapURL = "https://api.openweathermap.org"
+	// weatherMinInterval keeps piheat well within the free tiers; neither
+	// service updates more often than every few minutes anyway.
+	weatherMinInterval = time.Minute
+)
+
+// WeatherConfig fetches the outdoor temperature at Latitude and Longitude
+// from Open-Meteo, without a key, or from OpenWeatherMap with APIKey, every
+// Interval (default 15m) and records it as Sensor (default "outdoor").
+// URL replaces the provider's server, such as a self-hosted Open-Meteo.
+type WeatherConfig struct {
+	Provider  string   `json:"provider"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	APIKey    string   `json:"api_key,omitempty"`
+	Sensor    string   `json:"sensor,omitempty"`
+	Interval  Duration `json:"interval"`
+	URL       string   `json:"url,omitempty"`
+}
+
+func (c *WeatherConfig) check() error {
+	if c.Provider == "" {
+		c.Provider = "open-meteo"
+	}
+	switch c.Provider {
+	case "open-meteo":
+	case "openweathermap":
+		if c.APIKey == "" {
+			return fmt.Errorf("openweathermap requires api_key")
+		}
+	default:
+		return fmt.Errorf("provider must be open-meteo or openweathermap")
+	}
+	if c.Latitude < -90 || c.Latitude > 90 || c.Longitude < -180 || c.Longitude > 180 {
+		return fmt.Errorf("latitude must be within ±90 and longitude within ±180")
+	}
+	if c.Latitude == 0 && c.Longitude == 0 {
+		return fmt.Errorf("latitude and longitude are required")
+	}
+	if c.Sensor == "" {
+		c.Sensor = "outdoor"
+	}
+	if c.Interval.Duration == 0 {
+		c.Interval.Duration = 15 * time.Minute
+	}
+	if c.Interval.Duration < weatherMinInterval {
+		return fmt.Errorf("interval must be at least %s", weatherMinInterval)
+	}
+	if c.URL != "" {
+		if _, err := url.Parse(c.URL); err != nil {
+			return fmt.Errorf("url: %v", err)
+		}
+	}
+	return nil
+}
+
+// requestURL is the provider's current weather at the configured place.
+func (c *WeatherConfig) requestURL() string {
+	lat := strconv.FormatFloat(c.Latitude, 'f', -1, 64)
+	lon := strconv.FormatFloat(c.Longitude, 'f', -1, 64)
+	if c.Provider == "openweathermap" {
+		base := openWeatherMapURL
+		if c.URL != "" {
+			base = strings.TrimSuffix(c.URL, "/")
+		}
+		return base + "/data/2.5/weather?" + url.Values{
+			"lat": {lat}, "lon": {lon}, "units": {"metric"}, "appid": {c.APIKey},
+		}.Encode()
+	}
+	base := openMeteoURL
+	if c.URL != "" {
+		base = strings.TrimSuffix(c.URL, "/")
+	}
+	return base + "/v1/forecast?" + url.Values{
+		"latitude": {lat}, "longitude": {lon}, "current": {"temperature_2m"},
+	}.Encode()
+}
+
+// fetchWeather returns the current outdoor temperature in °C.
+func fetchWeather(c *WeatherConfig) (float64, error) {
+	resp, err := outboundClient.Get(c.requestURL())
+	if err != nil {
+		// The error holds the URL, and with it the API key
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", resp.Request.URL.Host, resp.Status)
+	}
+	body := io.LimitReader(resp.Body, 1<<20)
+	if c.Provider == "openweathermap" {
+		var v struct {
+			Main struct {
+				Temp *float64 `json:"temp"`
+			} `json:"main"`
+		}
+		if err := json.NewDecoder(body).Decode(&v); err != nil {
+			return 0, err
+		}
+		if v.Main.Temp == nil {
+			return 0, fmt.Errorf("no main.temp in the response")
+		}
+		return *v.Main.Temp, nil
+	}
+	var v struct {
+		Current struct {
+			Temperature *float64 `json:"temperature_2m"`
+		} `json:"current"`
+	}
+	if err := json.NewDecoder(body).Decode(&v); err != nil {
+		return 0, err
+	}
+	if v.Current.Temperature == nil {
+		return 0, fmt.Errorf("no current.temperature_2m in the response")
+	}
+	return *v.Current.Temperature, nil
+}
+
+// startWeather records the outdoor temperature every interval.
+func startWeather(c *WeatherConfig) {
+	log.Printf("Fetching the outdoor temperature from %s every %s as sensor %s", c.Provider, c.Interval.Duration, c.Sensor)
+	sensorsMonitor.expect(c.Sensor, c.Interval.Duration)
+	go func() {
+		ticker := clock.NewTicker(c.Interval.Duration)
+		defer ticker.Stop()
+		for {
+			temp, err := fetchWeather(c)
+			if err != nil {
+				log.Printf("Error fetching the weather: %v", err)
+			} else {
+				recordReading(c.Sensor, temp, sourceWeather+c.Provider)
+			}
+			<-ticker.C()
+		}
+	}()
+}
@@ -0,0 +1,16 @@
+// The JSON API the pages call, and the message of its errors.
+const api = basePath + '/api/v1';
+
+// apiError rejects with the message of an error response, the detail of its
+// application/problem+json body.
+function apiError(response) {
+    return response.text().then(text => {
+        let message = text.trim();
+        try {
+            message = JSON.parse(text).detail || message;
+        } catch (e) {
+            // not a problem, e.g. from a proxy in front
+        }
+        throw new Error(message);
+    });
+}
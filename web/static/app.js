@@ -0,0 +1,598 @@
+let chart;
+let currentPeriod = 'day';
+// currentCompare is the earlier range overlaid on the chart: previous,
+// week or year, or '' for none
+let currentCompare = '';
+// currentEnergyPeriod is the period of the runtime and cost table
+let currentEnergyPeriod = 'day';
+let units = 'celsius';
+// markers are the annotations of the chart's period, each at the index of
+// the last point at or before it
+let markers = [];
+// bands are the stretches heaters and TRVs ran in the chart's period, as
+// indexes of the points they span
+let bands = [];
+
+// Temperatures are stored in °C; units only changes how they are shown
+function toDisplay(celsius) {
+    return units === 'fahrenheit' ? celsius * 9 / 5 + 32 : celsius;
+}
+
+function unitSymbol() {
+    return units === 'fahrenheit' ? '°F' : '°C';
+}
+
+function setUnits(u) {
+    units = u;
+    chart.data.datasets[0].label = t('chart.series', unitSymbol());
+    chart.options.scales.y.title.text = t('chart.series', unitSymbol());
+    updateChart();
+}
+
+// annotationMarkers draws the annotations as labelled vertical lines.
+const annotationMarkers = {
+    id: 'annotationMarkers',
+    afterDatasetsDraw(chart) {
+        const area = chart.chartArea;
+        const ctx = chart.ctx;
+        markers.forEach(m => {
+            const x = chart.scales.x.getPixelForValue(m.index);
+            ctx.save();
+            ctx.strokeStyle = 'rgba(233, 30, 99, 0.8)';
+            ctx.lineWidth = 1;
+            ctx.setLineDash([4, 4]);
+            ctx.beginPath();
+            ctx.moveTo(x, area.top);
+            ctx.lineTo(x, area.bottom);
+            ctx.stroke();
+            ctx.fillStyle = 'rgb(233, 30, 99)';
+            ctx.font = '11px sans-serif';
+            ctx.translate(x + 3, area.top + 4);
+            ctx.rotate(Math.PI / 2);
+            ctx.fillText(m.label, 0, 0);
+            ctx.restore();
+        });
+    }
+};
+
+// actuatorBands shades the background where an actuator was running, more
+// strongly the further a valve was open.
+const actuatorBands = {
+    id: 'actuatorBands',
+    beforeDatasetsDraw(chart) {
+        const area = chart.chartArea;
+        const ctx = chart.ctx;
+        bands.forEach(b => {
+            const from = chart.scales.x.getPixelForValue(b.from);
+            const to = chart.scales.x.getPixelForValue(b.to);
+            ctx.save();
+            ctx.fillStyle = 'rgba(255, 152, 0, ' + (0.08 + 0.12 * b.duty) + ')';
+            ctx.fillRect(from, area.top, Math.max(to - from, 2), area.bottom - area.top);
+            ctx.restore();
+        });
+    }
+};
+
+// pointIndex is the index of the last point at or before a Unix time.
+function pointIndex(points, unixTime) {
+    let index = 0;
+    points.forEach((p, i) => {
+        if (p.unixTime <= unixTime) {
+            index = i;
+        }
+    });
+    return index;
+}
+
+function initChart() {
+    const ctx = document.getElementById('temperatureChart').getContext('2d');
+    chart = new Chart(ctx, {
+        type: 'line',
+        plugins: [actuatorBands, annotationMarkers],
+        data: {
+            labels: [],
+            datasets: [{
+                label: t('chart.series', '°C'),
+                data: [],
+                borderColor: themeColor('--accent'),
+                backgroundColor: 'rgba(' + themeColor('--accent-rgb') + ', 0.1)',
+                borderWidth: 3,
+                fill: true,
+                tension: 0.4,
+                pointBackgroundColor: themeColor('--accent'),
+                pointBorderColor: themeColor('--surface'),
+                pointBorderWidth: 2,
+                pointRadius: 4,
+                pointHoverRadius: 6
+            }, {
+                label: t('chart.earlier'),
+                data: [],
+                hidden: true,
+                borderColor: 'rgb(255, 152, 0)',
+                borderWidth: 2,
+                borderDash: [6, 4],
+                fill: false,
+                tension: 0.4,
+                pointRadius: 0,
+                pointHoverRadius: 4
+            }]
+        },
+        options: {
+            responsive: true,
+            maintainAspectRatio: false,
+            locale: lang,
+            plugins: {
+                legend: {
+                    display: true,
+                    position: 'top',
+                    labels: {
+                        filter: item => !item.hidden
+                    }
+                }
+            },
+            scales: {
+                x: {
+                    display: true,
+                    title: {
+                        display: true,
+                        text: t('chart.time')
+                    },
+                    grid: {
+                        color: themeColor('--border')
+                    }
+                },
+                y: {
+                    display: true,
+                    title: {
+                        display: true,
+                        text: t('chart.series', '°C')
+                    },
+                    grid: {
+                        color: themeColor('--border')
+                    },
+                    beginAtZero: false
+                }
+            },
+            interaction: {
+                intersect: false,
+                mode: 'index'
+            }
+        }
+    });
+}
+
+// updateComparison overlays the earlier range on the current one, bucket by
+// bucket along the offsets of both.
+function updateComparison(period) {
+    fetch(api + '/chart-data?period=' + period + '&compare=' + currentCompare)
+        .then(response => {
+            if (!response.ok) {
+                return apiError(response);
+            }
+            return response.json();
+        })
+        .then(data => {
+            const offsets = new Map();
+            data.current.points.concat(data.previous.points).forEach(p => offsets.set(p.offset, p.label));
+            const sorted = Array.from(offsets.keys()).sort((a, b) => a - b);
+            const byOffset = points => new Map(points.map(p => [p.offset, toDisplay(p.temperature)]));
+            const current = byOffset(data.current.points);
+            const previous = byOffset(data.previous.points);
+            chart.data.labels = sorted.map(o => offsets.get(o));
+            chart.data.datasets[0].data = sorted.map(o => current.has(o) ? current.get(o) : null);
+            chart.data.datasets[1].data = sorted.map(o => previous.has(o) ? previous.get(o) : null);
+            chart.data.datasets[1].label = t('chart.compare_series', t('compare.name.' + currentCompare), unitSymbol());
+            chart.data.datasets[1].hidden = false;
+            chart.options.spanGaps = true;
+            markers = [];
+            bands = [];
+            chart.update();
+        })
+        .catch(error => {
+            console.error('Error updating comparison:', error);
+        });
+}
+
+function updateChart(period = currentPeriod) {
+    // Years are not compared, and the same day last week only for a day
+    if (currentCompare && period !== 'year' && (currentCompare !== 'week' || period === 'day')) {
+        updateComparison(period);
+        return;
+    }
+    fetch(api + '/chart-data?annotations=1&actuators=all&period=' + period)
+        .then(response => response.json())
+        .then(data => {
+            const points = data.points;
+            chart.data.datasets[1].data = [];
+            chart.data.datasets[1].hidden = true;
+            chart.options.spanGaps = false;
+            chart.data.labels = points.map(d => d.timestamp);
+            chart.data.datasets[0].data = points.map(d => toDisplay(d.temperature));
+            markers = points.length === 0 ? [] : data.annotations.map(a => {
+                return {index: pointIndex(points, a.unixTime), label: a.label};
+            });
+            bands = points.length === 0 ? [] : (data.actuators || []).map(b => {
+                return {from: pointIndex(points, b.unixFrom), to: pointIndex(points, b.unixTo), duty: b.duty};
+            });
+            chart.update();
+        })
+        .catch(error => {
+            console.error('Error updating chart:', error);
+        });
+}
+
+// showDatabaseStatus shows a banner while the database cannot be written.
+function showDatabaseStatus(status) {
+    const banner = document.getElementById('degraded-banner');
+    if (!status) {
+        banner.hidden = true;
+        return;
+    }
+    let text = t('banner.database', new Date(status.since).toLocaleString(lang), status.reason) + ' ';
+    if (status.fallback) {
+        text += t('banner.fallback', status.queued);
+    } else {
+        text += t('banner.queued', status.queued);
+    }
+    if (status.dropped > 0) {
+        text += ' ' + t('banner.dropped', status.dropped);
+    }
+    banner.textContent = text;
+    banner.hidden = false;
+}
+
+function updateTemperature() {
+    fetch(api + '/temperature')
+        .then(response => response.json())
+        .then(data => {
+            if (data.units !== units) {
+                setUnits(data.units);
+            }
+            document.getElementById('temperature').textContent = num(toDisplay(data.temperature), data.decimals) + unitSymbol();
+            document.getElementById('timestamp').textContent = t('current.updated', data.timestamp);
+            showDatabaseStatus(data.database);
+
+            const statusDiv = document.getElementById('status');
+            const temp = data.temperature;
+
+            if (temp < data.thresholds.warning) {
+                statusDiv.className = 'status normal';
+                statusDiv.textContent = t('status.normal');
+            } else if (temp < data.thresholds.critical) {
+                statusDiv.className = 'status warning';
+                statusDiv.textContent = t('status.warning');
+            } else {
+                statusDiv.className = 'status danger';
+                statusDiv.textContent = t('status.critical');
+            }
+
+            // Update chart if we're on current day view
+            if (currentPeriod === 'day') {
+                updateChart();
+            }
+        })
+        .catch(error => {
+            console.error('Error:', error);
+            document.getElementById('temperature').textContent = t('current.error');
+            document.getElementById('timestamp').textContent = t('current.failed');
+        });
+}
+
+function updateSensorStatus() {
+    fetch(api + '/sensors')
+        .then(response => response.json())
+        .then(sensors => {
+            const container = document.getElementById('sensor-status');
+            container.innerHTML = '';
+            sensors.filter(s => !s.online).forEach(s => {
+                const div = document.createElement('div');
+                div.className = 'offline';
+                div.textContent = t('sensor.offline', s.name, new Date(s.lastSeen).toLocaleString(lang));
+                container.appendChild(div);
+            });
+        })
+        .catch(error => {
+            console.error('Error updating sensor status:', error);
+        });
+}
+
+function changePeriod(period, button) {
+    currentPeriod = period;
+
+    // Update button states
+    document.querySelectorAll('.time-btn').forEach(btn => btn.classList.remove('active'));
+    button.classList.add('active');
+
+    // Update chart
+    updateChart(period);
+}
+
+function changeCompare(against) {
+    currentCompare = against;
+    updateChart();
+}
+
+// updateEnergy fills the runtime and cost table, newest period first. It
+// stays hidden until some heater or valve has been recorded.
+function updateEnergy(period = currentEnergyPeriod) {
+    fetch(api + '/energy?period=' + period)
+        .then(response => response.json())
+        .then(rep => {
+            const panel = document.getElementById('energy-panel');
+            panel.hidden = rep.actuators.length === 0;
+            document.getElementById('energy-period').textContent = t(period === 'month' ? 'energy.month' : 'energy.day');
+            const withCost = rep.cost !== undefined;
+            document.querySelectorAll('.energy-cost').forEach(el => { el.hidden = !withCost; });
+            const rows = document.getElementById('energy-rows');
+            rows.innerHTML = '';
+            const cells = (start, p) => {
+                const values = [start, num(p.runtimeHours, 1) + ' h', num(p.estimatedKWh, 1) + ' kWh'];
+                if (withCost) {
+                    values.push(num(p.cost, 2) + (rep.currency ? ' ' + rep.currency : ''));
+                }
+                const tr = document.createElement('tr');
+                values.forEach(v => {
+                    const td = document.createElement('td');
+                    td.textContent = v;
+                    tr.appendChild(td);
+                });
+                rows.appendChild(tr);
+                return tr;
+            };
+            rep.periods.slice().reverse().forEach(p => {
+                const start = new Date(p.start + 'T00:00:00');
+                cells(period === 'month' ? start.toLocaleDateString(lang, {year: 'numeric', month: 'long'}) : start.toLocaleDateString(lang), p);
+            });
+            cells(t('common.total'), {runtimeHours: rep.runtimeHours, estimatedKWh: rep.estimatedKWh, cost: rep.cost}).className = 'total';
+        })
+        .catch(error => {
+            console.error('Error updating energy:', error);
+        });
+}
+
+function changeEnergyPeriod(period, button) {
+    document.querySelectorAll('#energy-panel .time-btn').forEach(btn => btn.classList.remove('active'));
+    button.classList.add('active');
+    currentEnergyPeriod = period;
+    updateEnergy();
+}
+
+// tile adds a tile with a title, a large value and a detail line.
+function tile(container, title, value, detail, className) {
+    const div = document.createElement('div');
+    div.className = 'tile ' + (className || '');
+    [['tile-title', title], ['tile-value', value], ['tile-detail', detail]].forEach(([c, text]) => {
+        const el = document.createElement('div');
+        el.className = c;
+        el.textContent = text;
+        div.appendChild(el);
+    });
+    container.appendChild(div);
+}
+
+// updateZones fills the zone overview.
+function updateZones() {
+    fetch(api + '/zones')
+        .then(response => response.json())
+        .then(zones => {
+            const container = document.getElementById('zones');
+            container.innerHTML = '';
+            if (zones.length === 0) {
+                container.textContent = t('zones.none');
+            }
+            zones.forEach(z => {
+                const temp = z.temperature === undefined ? '–' : num(toDisplay(z.temperature), 1) + unitSymbol();
+                let setpoint = z.setpoint === undefined ? t('zones.no_setpoint') : t('zones.setpoint', num(toDisplay(z.setpoint), 1) + unitSymbol());
+                if (z.override) {
+                    setpoint = t('zones.override', num(toDisplay(z.override.target), 1) + unitSymbol(), timeLeft(z.override.until));
+                }
+                tile(container, (z.heating ? '🔥 ' : '') + z.zone, temp, setpoint + ' · ' + z.reason, z.heating ? 'heating' : '');
+            });
+        })
+        .catch(error => {
+            console.error('Error updating zones:', error);
+        });
+}
+
+// timeLeft is the time until an ISO timestamp in hours and minutes.
+function timeLeft(until) {
+    const minutes = Math.max(0, Math.ceil((new Date(until) - Date.now()) / 60000));
+    return minutes < 60 ? t('time.minutes', minutes) : t('time.hours', Math.floor(minutes / 60), minutes % 60);
+}
+
+// updateSummary fills the summary with every sensor's latest reading.
+function updateSummary() {
+    fetch(api + '/sensors')
+        .then(response => response.json())
+        .then(sensors => {
+            const container = document.getElementById('summary');
+            container.innerHTML = '';
+            sensors.sort((a, b) => a.name.localeCompare(b.name)).forEach(s => {
+                const detail = s.online ? new Date(s.lastSeen).toLocaleTimeString(lang) : t('summary.offline_since', new Date(s.lastSeen).toLocaleString(lang));
+                // Derived metrics in other units than °C are shown as they are
+                const value = s.unit && s.unit !== '°C' ? s.lastValue + ' ' + s.unit : num(toDisplay(s.lastValue), 1) + unitSymbol();
+                tile(container, s.name, value, detail, s.online ? '' : 'offline');
+            });
+        })
+        .catch(error => {
+            console.error('Error updating summary:', error);
+        });
+}
+
+// setLandingView makes the current view the one the dashboard opens with.
+function setLandingView() {
+    fetch(api + '/landing', {
+        method: 'PUT',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({view: view})
+    })
+        .then(response => {
+            if (!response.ok) {
+                return apiError(response);
+            }
+            alert(t('landing.saved'));
+        })
+        .catch(error => {
+            alert(t('landing.failed', error.message));
+        });
+}
+
+// showConnectivity shows a banner while the browser is offline; the
+// service worker then answers with the last data it saw.
+function showConnectivity() {
+    document.getElementById('offline-banner').hidden = navigator.onLine;
+}
+
+// pushSubscription is this browser's subscription to alerts, if any.
+function pushSubscription() {
+    return navigator.serviceWorker.ready.then(registration => registration.pushManager.getSubscription());
+}
+
+// savePushSubscription stores the subscription with the chosen severity.
+function savePushSubscription(subscription) {
+    const body = subscription.toJSON();
+    body.severity = document.getElementById('push-severity').value;
+    return fetch(api + '/push/subscribe', {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify(body)
+    }).then(response => {
+        if (!response.ok) {
+            return apiError(response);
+        }
+        return response.json();
+    });
+}
+
+// updatePushControls shows whether this browser receives alerts, and from
+// which severity.
+function updatePushControls() {
+    const button = document.getElementById('push-button');
+    const severity = document.getElementById('push-severity');
+    pushSubscription().then(subscription => {
+        button.textContent = t(subscription ? 'push.unsubscribe' : 'push.subscribe');
+        severity.hidden = !subscription;
+        const saved = subscription && localStorage.getItem('piheat-push-severity');
+        if (saved) {
+            severity.value = saved;
+        }
+        document.getElementById('push-controls').hidden = false;
+    });
+}
+
+// togglePush subscribes this browser to alerts, asking for permission to
+// show notifications, or unsubscribes it.
+function togglePush() {
+    pushSubscription().then(subscription => {
+        if (subscription) {
+            return fetch(api + '/push/unsubscribe', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({endpoint: subscription.endpoint})
+            }).then(() => subscription.unsubscribe());
+        }
+        return fetch(api + '/push/key')
+            .then(response => response.json())
+            .then(key => navigator.serviceWorker.ready.then(registration =>
+                registration.pushManager.subscribe({userVisibleOnly: true, applicationServerKey: key.publicKey})))
+            .then(savePushSubscription);
+    })
+        .then(updatePushControls)
+        .catch(error => {
+            alert(t('push.failed', error.message));
+        });
+}
+
+// changePushSeverity saves the severity filter of this browser.
+function changePushSeverity() {
+    localStorage.setItem('piheat-push-severity', document.getElementById('push-severity').value);
+    pushSubscription().then(subscription => subscription && savePushSubscription(subscription))
+        .catch(error => {
+            alert(t('push.filter_failed', error.message));
+        });
+}
+
+// updateLanguages fills the language picker, with the browser's own
+// language first.
+function updateLanguages() {
+    fetch(api + '/language')
+        .then(response => response.json())
+        .then(l => {
+            const select = document.getElementById('language');
+            select.innerHTML = '';
+            const auto = document.createElement('option');
+            auto.value = '';
+            auto.textContent = t('language.auto');
+            select.appendChild(auto);
+            l.available.forEach(a => {
+                const option = document.createElement('option');
+                option.value = a.code;
+                option.textContent = a.name;
+                select.appendChild(option);
+            });
+            select.value = l.source === 'user' || l.source === 'cookie' ? l.language : '';
+        })
+        .catch(error => {
+            console.error('Error loading languages:', error);
+        });
+}
+
+// setLanguage shows the UI in a language from now on, or in the browser's
+// for an empty one.
+function setLanguage(language) {
+    fetch(api + '/language', {
+        method: 'PUT',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({language: language})
+    })
+        .then(response => {
+            if (!response.ok) {
+                return apiError(response);
+            }
+            location.reload();
+        })
+        .catch(error => {
+            alert(t('language.failed', error.message));
+        });
+}
+
+if ('serviceWorker' in navigator) {
+    navigator.serviceWorker.register(basePath + '/sw.js?v=' + assetVersion, {scope: basePath + '/'})
+        .catch(error => console.error('Error registering service worker:', error));
+    if ('PushManager' in window) {
+        updatePushControls();
+    }
+}
+window.addEventListener('online', showConnectivity);
+window.addEventListener('offline', showConnectivity);
+showConnectivity();
+updateLanguages();
+watchTheme();
+
+// Initialize everything
+if (view === 'zones') {
+    updateZones();
+    setInterval(updateZones, 10000);
+} else if (view === 'summary') {
+    updateSummary();
+    setInterval(updateSummary, 10000);
+} else {
+    initChart();
+    updateTemperature();
+    updateChart();
+
+    updateSensorStatus();
+    updateEnergy();
+
+    // Auto-refresh current temperature every 5 seconds
+    setInterval(updateTemperature, 5000);
+    setInterval(updateSensorStatus, 30000);
+    setInterval(updateEnergy, 300000);
+
+    // Auto-refresh chart every 30 seconds for day view
+    setInterval(() => {
+        if (currentPeriod === 'day') {
+            updateChart();
+        }
+    }, 30000);
+}
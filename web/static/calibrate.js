@@ -0,0 +1,138 @@
+let sensors = {};
+let offsets = {};
+
+function getJSON(path) {
+    return fetch(api + path).then(response => {
+        if (!response.ok) {
+            return apiError(response);
+        }
+        return response.json();
+    });
+}
+
+function message(text) {
+    document.getElementById('message').textContent = text;
+}
+
+function formatOffset(value) {
+    return (value >= 0 ? '+' : '') + num(value, 2) + '°C';
+}
+
+// load fills the picker with the zones first, by the sensor they read,
+// then every other known sensor
+function load() {
+    Promise.all([getJSON('/zones').catch(() => []), getJSON('/sensors'), getJSON('/calibrations')])
+        .then(([zones, list, calibrations]) => {
+            sensors = {};
+            list.forEach(s => { sensors[s.name] = s; });
+            offsets = {};
+            calibrations.forEach(c => { offsets[c.sensor] = c.offset; });
+            const select = document.getElementById('sensor');
+            const selected = select.value;
+            select.innerHTML = '';
+            select.add(new Option(t('calibrate.choose'), ''));
+            const zoned = new Set();
+            zones.forEach(z => {
+                zoned.add(z.sensor);
+                select.add(new Option(z.zone + ' (' + z.sensor + ')', z.sensor));
+            });
+            list.filter(s => !zoned.has(s.name)).forEach(s => select.add(new Option(s.name, s.name)));
+            select.value = selected;
+        })
+        .catch(error => message(t('common.error', error.message)));
+}
+
+function pick() {
+    const sensor = document.getElementById('sensor').value;
+    document.getElementById('measure').hidden = !sensor;
+    document.getElementById('confirm').hidden = true;
+    message('');
+    showCurrent();
+    loadHistory();
+}
+
+function showCurrent() {
+    const s = sensors[document.getElementById('sensor').value];
+    const current = document.getElementById('current');
+    if (!s) {
+        current.textContent = t('calibrate.no_reading');
+        return;
+    }
+    current.textContent = t('calibrate.reading_at', num(s.lastValue, 2) + '°C', new Date(s.lastSeen).toLocaleTimeString(lang)) +
+        (s.online ? '' : ' ' + t('calibrate.offline'));
+}
+
+// preview works out the offset from the sensor's latest reading; the
+// server does the same with the reading it has when the offset is applied
+function preview(event) {
+    event.preventDefault();
+    const sensor = document.getElementById('sensor').value;
+    getJSON('/sensors').then(list => {
+        list.forEach(s => { sensors[s.name] = s; });
+        showCurrent();
+        const s = sensors[sensor];
+        if (!s) {
+            message(t('calibrate.no_reading_from', sensor));
+            return;
+        }
+        const reference = parseFloat(document.getElementById('reference').value);
+        const current = offsets[sensor] || 0;
+        const raw = s.lastValue - current;
+        document.getElementById('proposal').textContent = t('calibrate.proposal', sensor, num(raw, 2) + '°C',
+            num(reference, 2) + '°C', formatOffset(reference - raw), formatOffset(current));
+        document.getElementById('confirm').hidden = false;
+    }).catch(error => message(t('common.error', error.message)));
+}
+
+function apply(event) {
+    event.preventDefault();
+    const sensor = document.getElementById('sensor').value;
+    const token = document.getElementById('token').value || sessionStorage.getItem('piheat-admin-token');
+    const headers = {'Content-Type': 'application/json'};
+    if (token) {
+        headers['Authorization'] = 'Bearer ' + token;
+    }
+    fetch(api + '/calibrations/' + encodeURIComponent(sensor), {
+        method: 'POST',
+        headers: headers,
+        body: JSON.stringify({reference: parseFloat(document.getElementById('reference').value)})
+    }).then(response => {
+        if (!response.ok) {
+            return apiError(response);
+        }
+        if (document.getElementById('token').value) {
+            sessionStorage.setItem('piheat-admin-token', token);
+        }
+        return response.json();
+    }).then(c => {
+        message(t('calibrate.done', sensor, formatOffset(c.offset)));
+        document.getElementById('confirm').hidden = true;
+        document.getElementById('reference').value = '';
+        load();
+        loadHistory();
+    }).catch(error => message(t('common.error', error.message)));
+}
+
+function loadHistory() {
+    const sensor = document.getElementById('sensor').value;
+    const body = document.getElementById('history');
+    body.innerHTML = '';
+    if (!sensor) {
+        return;
+    }
+    getJSON('/calibrations/' + encodeURIComponent(sensor)).then(list => {
+        list.forEach(c => {
+            const row = body.insertRow();
+            [
+                new Date(c.createdAt).toLocaleString(lang),
+                formatOffset(c.offset),
+                formatOffset(c.previousOffset),
+                c.reference === undefined ? '' : num(c.reference, 2) + '°C',
+                c.reading === undefined ? '' : num(c.reading, 2) + '°C',
+                c.actor
+            ].forEach(text => { row.insertCell().textContent = text; });
+        });
+    }).catch(error => message(t('common.error', error.message)));
+}
+
+load();
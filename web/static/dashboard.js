@@ -0,0 +1,159 @@
+// periodHours is how far back each panel period reaches
+const periodHours = {day: 24, week: 24 * 7, month: 24 * 30, year: 24 * 365};
+const colors = ['rgb(33, 150, 243)', 'rgb(233, 30, 99)', 'rgb(76, 175, 80)', 'rgb(255, 152, 0)', 'rgb(156, 39, 176)',
+    'rgb(0, 150, 136)', 'rgb(121, 85, 72)', 'rgb(96, 125, 139)', 'rgb(205, 220, 57)', 'rgb(63, 81, 181)'];
+
+function getJSON(path) {
+    return fetch(api + path).then(response => {
+        if (!response.ok) {
+            return apiError(response);
+        }
+        return response.json();
+    });
+}
+
+function message(text) {
+    document.getElementById('message').textContent = text;
+}
+
+// list shows the stored dashboards as links
+function list() {
+    getJSON('/dashboards').then(dashboards => {
+        const panels = document.getElementById('panels');
+        panels.className = 'tiles';
+        if (dashboards.length === 0) {
+            message(t('dashboards.none'));
+            return;
+        }
+        dashboards.forEach(d => {
+            const tile = document.createElement('a');
+            tile.className = 'tile';
+            tile.href = basePath + '/dashboards/' + encodeURIComponent(d.name);
+            tile.innerHTML = '<div class="tile-title"></div><div class="tile-detail"></div>';
+            tile.querySelector('.tile-title').textContent = d.title;
+            tile.querySelector('.tile-detail').textContent = t(d.panels.length === 1 ? 'dashboards.panel' : 'dashboards.panels', d.panels.length);
+            panels.appendChild(tile);
+        });
+    }).catch(error => message(t('dashboards.list_failed', error.message)));
+}
+
+// label names a series by what it is rather than its id
+function label(s) {
+    const unit = s.kind === 'sensor' ? ' (' + (s.unit || '°C') + ')' : ' (' + t('dashboards.on') + ')';
+    return s.name + unit;
+}
+
+// latest is the last value of a series that is not null
+function latest(values) {
+    for (let i = values.length - 1; i >= 0; i--) {
+        if (values[i] !== null) {
+            return values[i];
+        }
+    }
+    return null;
+}
+
+function renderPanel(panel, el, data) {
+    if (panel.chart === 'value') {
+        el.innerHTML = '';
+        data.series.forEach(s => {
+            const v = latest(s.values);
+            const tile = document.createElement('div');
+            tile.className = 'tile';
+            tile.innerHTML = '<div class="tile-title"></div><div class="tile-value"></div>';
+            tile.querySelector('.tile-title').textContent = s.name;
+            if (v === null) {
+                tile.querySelector('.tile-value').textContent = '–';
+            } else if (s.kind === 'sensor') {
+                tile.querySelector('.tile-value').textContent = num(v, 1) + (s.unit || '°C');
+            } else {
+                tile.querySelector('.tile-value').textContent = Math.round(v * 100) + '%';
+            }
+            el.appendChild(tile);
+        });
+        return;
+    }
+    const labels = data.times.map(time => {
+        const d = new Date(time * 1000);
+        return panel.period === 'day' ? d.toLocaleTimeString(lang, {hour: '2-digit', minute: '2-digit'}) : d.toLocaleDateString(lang);
+    });
+    // Heaters and TRVs run from 0 to 1, on an axis of their own
+    const datasets = data.series.map((s, i) => ({
+        label: label(s),
+        data: s.values,
+        borderColor: colors[i % colors.length],
+        backgroundColor: colors[i % colors.length].replace('rgb', 'rgba').replace(')', ', 0.3)'),
+        yAxisID: s.kind === 'sensor' ? 'y' : 'y1',
+        stepped: s.kind !== 'sensor',
+        pointRadius: 0,
+        borderWidth: 2,
+        spanGaps: false,
+    }));
+    const actuators = data.series.some(s => s.kind !== 'sensor');
+    let chart = el.chart;
+    if (chart) {
+        chart.data.labels = labels;
+        chart.data.datasets = datasets;
+        chart.update();
+        return;
+    }
+    el.innerHTML = '<canvas></canvas>';
+    chart = new Chart(el.querySelector('canvas').getContext('2d'), {
+        type: panel.chart,
+        data: {labels: labels, datasets: datasets},
+        options: {
+            animation: false,
+            locale: lang,
+            scales: {
+                y: {display: datasets.some(d => d.yAxisID === 'y')},
+                y1: {display: actuators, position: 'right', min: 0, max: 1, grid: {drawOnChartArea: false}},
+            },
+        },
+    });
+    el.chart = chart;
+}
+
+function refresh(dashboard) {
+    const now = new Date();
+    dashboard.panels.forEach((panel, i) => {
+        const from = new Date(now.getTime() - periodHours[panel.period] * 3600 * 1000);
+        const ids = panel.series.map(encodeURIComponent).join(',');
+        getJSON('/series?ids=' + ids + '&from=' + encodeURIComponent(from.toISOString().replace(/\.\d+Z$/, 'Z')))
+            .then(data => renderPanel(panel, document.getElementById('panel-' + i), data))
+            .catch(error => { document.getElementById('panel-' + i).textContent = error.message; });
+    });
+    document.getElementById('updated').textContent = t('dashboards.updated', now.toLocaleTimeString(lang));
+}
+
+// show lays out a dashboard's panels and keeps them up to date
+function show(name) {
+    getJSON('/dashboards/' + encodeURIComponent(name)).then(dashboard => {
+        document.title = t('dashboards.page_title', dashboard.title);
+        document.getElementById('title').textContent = '🧩 ' + dashboard.title;
+        const panels = document.getElementById('panels');
+        dashboard.panels.forEach((panel, i) => {
+            const box = document.createElement('div');
+            box.className = 'chart-container';
+            box.innerHTML = '<h2></h2><div></div>';
+            box.querySelector('h2').textContent = panel.title || panel.series.join(', ');
+            const body = box.querySelector('div');
+            body.id = 'panel-' + i;
+            if (panel.chart === 'value') {
+                body.className = 'tiles';
+            }
+            panels.appendChild(box);
+        });
+        refresh(dashboard);
+        // refresh is a duration such as "1m0s"
+        const match = /^(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s)?$/.exec(dashboard.refresh) || [];
+        const seconds = (+match[1] || 0) * 3600 + (+match[2] || 0) * 60 + (+match[3] || 0);
+        setInterval(() => refresh(dashboard), Math.max(seconds, 10) * 1000);
+    }).catch(error => message(t('dashboards.failed', name, error.message)));
+}
+
+watchTheme();
+if (dashboardName) {
+    show(dashboardName);
+} else {
+    list();
+}
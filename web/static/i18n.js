@@ -0,0 +1,18 @@
+// UI strings of the page's language, handed over by the template as
+// lang and messages.
+
+// t translates key, filling {0}, {1}... with args.
+function t(key, ...args) {
+    let s = key in messages ? messages[key] : key;
+    args.forEach((arg, i) => { s = s.split('{' + i + '}').join(arg); });
+    return s;
+}
+
+// num formats v with decimals digits the way lang writes numbers.
+function num(v, decimals) {
+    return Number(v).toLocaleString(lang, {
+        minimumFractionDigits: decimals,
+        maximumFractionDigits: decimals,
+        useGrouping: false,
+    });
+}
@@ -0,0 +1,115 @@
+let loaded;
+
+// api sends the admin token if one was entered; admins logged in as a
+// user are recognised by their session cookie instead
+function api(method, body) {
+    const headers = {'Content-Type': 'application/json'};
+    const token = sessionStorage.getItem('piheat-admin-token');
+    if (token) {
+        headers['Authorization'] = 'Bearer ' + token;
+    }
+    return fetch(api + '/settings', {
+        method: method,
+        headers: headers,
+        body: body === undefined ? undefined : JSON.stringify(body)
+    }).then(response => {
+        if (response.status === 401 || response.status === 403) {
+            sessionStorage.removeItem('piheat-admin-token');
+            showLogin();
+        }
+        if (!response.ok) {
+            return apiError(response);
+        }
+        return response.json();
+    });
+}
+
+function showLogin() {
+    document.getElementById('login').hidden = false;
+    document.getElementById('settings').hidden = true;
+}
+
+function login(event) {
+    event.preventDefault();
+    sessionStorage.setItem('piheat-admin-token', document.getElementById('token').value);
+    load();
+}
+
+function show(res) {
+    loaded = res;
+    const s = res.settings;
+    document.getElementById('sample_interval').value = s.sample_interval;
+    document.getElementById('warning').value = s.thresholds.warning;
+    document.getElementById('critical').value = s.thresholds.critical;
+    document.getElementById('units').value = s.units;
+    document.getElementById('retention_days').value = s.retention_days;
+    document.getElementById('notifiers').value = JSON.stringify(s.notifiers, null, 2);
+    document.getElementById('theme_mode').value = s.theme.mode;
+    document.getElementById('theme_accent').value = s.theme.accent;
+    document.querySelectorAll('.reset-btn').forEach(btn => {
+        btn.hidden = !res.stored.includes(btn.dataset.setting);
+    });
+    document.getElementById('login').hidden = true;
+    document.getElementById('settings').hidden = false;
+}
+
+function load(quiet) {
+    api('GET')
+        .then(show)
+        .catch(error => { if (!quiet) message(t('common.error', error.message)); });
+}
+
+function message(text) {
+    document.getElementById('message').textContent = text;
+}
+
+// save sends only the settings that were edited, so the others keep
+// following the config file
+function save(event) {
+    event.preventDefault();
+    const s = loaded.settings;
+    let notifiers;
+    try {
+        notifiers = JSON.parse(document.getElementById('notifiers').value);
+    } catch (e) {
+        message(t('settings.notifiers_error', e.message));
+        return;
+    }
+    const edited = {
+        sample_interval: document.getElementById('sample_interval').value,
+        thresholds: {
+            warning: parseFloat(document.getElementById('warning').value),
+            critical: parseFloat(document.getElementById('critical').value)
+        },
+        units: document.getElementById('units').value,
+        retention_days: parseInt(document.getElementById('retention_days').value, 10),
+        notifiers: notifiers,
+        theme: {
+            mode: document.getElementById('theme_mode').value,
+            accent: document.getElementById('theme_accent').value
+        }
+    };
+    const changes = {};
+    Object.keys(edited).forEach(name => {
+        if (JSON.stringify(edited[name]) !== JSON.stringify(s[name])) {
+            changes[name] = edited[name];
+        }
+    });
+    if (Object.keys(changes).length === 0) {
+        message(t('settings.unchanged'));
+        return;
+    }
+    api('PUT', changes)
+        .then(res => { show(res); message(t('settings.saved')); })
+        .catch(error => message(t('common.error', error.message)));
+}
+
+document.querySelectorAll('.reset-btn').forEach(btn => {
+    btn.addEventListener('click', () => {
+        api('PUT', {[btn.dataset.setting]: null})
+            .then(res => { show(res); message(t('settings.reset_done', btn.dataset.setting)); })
+            .catch(error => message(t('common.error', error.message)));
+    });
+});
+
+load(!sessionStorage.getItem('piheat-admin-token'));
@@ -0,0 +1,83 @@
+// The service worker keeps the dashboard's shell, and the latest answer of
+// each API call, so an installed app opens with the last known data while
+// the Pi cannot be reached. It is served as /sw.js and registered with the
+// asset version, which names its cache.
+const version = new URL(self.location).searchParams.get('v') || 'dev';
+const scope = new URL(self.registration.scope).pathname.replace(/\/$/, '');
+const shellCache = 'piheat-shell-' + version;
+const dataCache = 'piheat-data';
+const shell = [
+    scope + '/',
+    scope + '/static/style.css?v=' + version,
+    scope + '/static/i18n.js?v=' + version,
+    scope + '/static/api.js?v=' + version,
+    scope + '/static/theme.js?v=' + version,
+    scope + '/static/app.js?v=' + version,
+    scope + '/static/vendor/chart-3.2.1.min.js?v=' + version,
+    scope + '/manifest.json',
+];
+
+self.addEventListener('install', event => {
+    event.waitUntil(caches.open(shellCache).then(cache => cache.addAll(shell)).then(() => self.skipWaiting()));
+});
+
+// A new release drops the shell of the previous one
+self.addEventListener('activate', event => {
+    event.waitUntil(caches.keys()
+        .then(keys => Promise.all(keys.filter(k => k.startsWith('piheat-shell-') && k !== shellCache).map(k => caches.delete(k))))
+        .then(() => self.clients.claim()));
+});
+
+// networkFirst answers from the network, keeping a copy, and from the copy
+// when the network fails
+function networkFirst(request, cacheName, fallback) {
+    return fetch(request).then(response => {
+        if (response.ok) {
+            const copy = response.clone();
+            caches.open(cacheName).then(cache => cache.put(request, copy));
+        }
+        return response;
+    }).catch(() => caches.match(request).then(cached => cached || (fallback ? caches.match(fallback) : undefined))
+        .then(cached => cached || Response.error()));
+}
+
+self.addEventListener('fetch', event => {
+    const request = event.request;
+    const url = new URL(request.url);
+    if (request.method !== 'GET' || url.origin !== self.location.origin) {
+        return;
+    }
+    if (request.mode === 'navigate') {
+        event.respondWith(networkFirst(request, shellCache, scope + '/'));
+    } else if (url.pathname.startsWith(scope + '/api/')) {
+        event.respondWith(networkFirst(request, dataCache));
+    } else if (url.pathname.startsWith(scope + '/static/') && url.searchParams.get('v') === version) {
+        event.respondWith(caches.match(request).then(cached => cached || fetch(request)));
+    }
+});
+
+// Push messages carry an alert as {title, body, tag, url}
+self.addEventListener('push', event => {
+    let data = {};
+    try {
+        data = event.data ? event.data.json() : {};
+    } catch (e) {
+        data = {body: event.data.text()};
+    }
+    event.waitUntil(self.registration.showNotification(data.title || 'piheat', {
+        body: data.body || '',
+        tag: data.tag,
+        icon: scope + '/icons/192.png',
+        badge: scope + '/icons/192.png',
+        data: {url: data.url || scope + '/'},
+    }));
+});
+
+self.addEventListener('notificationclick', event => {
+    event.notification.close();
+    const target = event.notification.data.url;
+    event.waitUntil(self.clients.matchAll({type: 'window'}).then(windows => {
+        const open = windows.find(w => w.url === new URL(target, self.location).href);
+        return open ? open.focus() : self.clients.openWindow(target);
+    }));
+});
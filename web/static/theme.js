@@ -0,0 +1,29 @@
+// The theme is set on the hub and given to the page as CSS variables;
+// charts read their colours from them.
+
+// themeColor is the value of one of the theme's CSS variables.
+function themeColor(name) {
+    return getComputedStyle(document.documentElement).getPropertyValue(name).trim();
+}
+
+if (window.Chart) {
+    Chart.defaults.color = themeColor('--muted');
+    Chart.defaults.borderColor = themeColor('--border');
+}
+
+// watchTheme reloads the page when an admin changes the theme, so kiosks
+// left open follow it.
+function watchTheme() {
+    const mode = document.documentElement.dataset.theme;
+    const accent = themeColor('--accent');
+    setInterval(() => {
+        fetch(api + '/settings/theme')
+            .then(response => response.json())
+            .then(theme => {
+                if (theme.mode !== mode || theme.accent !== accent) {
+                    location.reload();
+                }
+            })
+            .catch(() => {});
+    }, 60000);
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// webPushTTL is how long a push service keeps a notification for a
+	// browser that is offline.
+	webPushTTL = 24 * time.Hour
+	// webPushRecordSize is the record size of the encrypted payload, which
+	// fits any alert in one record.
+	webPushRecordSize = 4096
+)
+
+// pushSeverityRank orders alert severities for the subscriptions' filters.
+var pushSeverityRank = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// WebPushConfig names the sender to push services, which contact it when
+// its notifications cause trouble. Without subject, public_url is used.
+type WebPushConfig struct {
+	Subject string `json:"subject"`
+}
+
+func (c WebPushConfig) check() error {
+	if c.Subject != "" && !strings.HasPrefix(c.Subject, "mailto:") && !strings.HasPrefix(c.Subject, "https://") {
+		return fmt.Errorf("subject must be a mailto: or https:// URL")
+	}
+	return nil
+}
+
+// pushSubject is the VAPID subject sent with every notification.
+func pushSubject() string {
+	switch {
+	case config().WebPush.Subject != "":
+		return config().WebPush.Subject
+	case strings.HasPrefix(config().PublicURL, "https://"):
+		return dashboardURL()
+	}
+	return "mailto:piheat@localhost"
+}
+
+// PushSubscription is a browser subscribed to alerts, with the endpoint and
+// keys its push service handed it. Severity is the least severe alert it
+// is sent.
+type PushSubscription struct {
+	ID          int64      `json:"id"`
+	Endpoint    string     `json:"endpoint"`
+	P256DH      string     `json:"-"`
+	Auth        string     `json:"-"`
+	Severity    string     `json:"severity"`
+	Username    string     `json:"username"`
+	UserAgent   string     `json:"userAgent,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// pushSubscribeRequest is the body of POST /api/push/subscribe: the
+// browser's PushSubscription as JSON, and the severity filter.
+type pushSubscribeRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256DH string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Severity string `json:"severity"`
+}
+
+func (req *pushSubscribeRequest) check(ctx context.Context) error {
+	u, err := url.Parse(req.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("endpoint must be an https URL")
+	}
+	if err := checkPushHost(ctx, u.Hostname()); err != nil {
+		return err
+	}
+	if _, err := pushPublicKey(req.Keys.P256DH); err != nil {
+		return fmt.Errorf("keys.p256dh: %v", err)
+	}
+	if auth, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Keys.Auth, "=")); err != nil || len(auth) != 16 {
+		return fmt.Errorf("keys.auth must be 16 bytes, base64url encoded")
+	}
+	if req.Severity == "" {
+		req.Severity = "info"
+	}
+	if _, ok := pushSeverityRank[req.Severity]; !ok {
+		return fmt.Errorf("severity must be one of info, warning, critical")
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which is not routed on
+// the internet either.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip is on the internet, rather than piheat
+// itself, the LAN or a link.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || sharedAddressSpace.Contains(ip))
+}
+
+// checkPushHost refuses a push endpoint on a host that is, or resolves
+// to, an address that is not public. Any logged-in user can subscribe, and
+// piheat posts to the endpoint on every alert, so it must not be a way
+// into the LAN.
+func checkPushHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("endpoint host %s: %v", host, err)
+	}
+	for _, a := range addrs {
+		if !publicIP(a.IP) {
+			return fmt.Errorf("endpoint host %s is at %s, not a public address", host, a.IP)
+		}
+	}
+	return nil
+}
+
+// pushDial is pushClient's check of each address it connects to, so a
+// host resolving into the LAN after it subscribed, or a redirect there,
+// is refused too.
+func pushDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("push endpoint at %s, not a public address", host)
+	}
+	return nil
+}
+
+// pushClient delivers notifications, only to public addresses and never
+// through a proxy, which would be dialled instead of the push service.
+var pushClient = &http.Client{
+	Timeout: outboundClient.Timeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: pushDial}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// pushPublicKey decodes a browser's P-256 public key.
+func pushPublicKey(s string) (*ecdsa.PublicKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("not base64url encoded")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), b)
+	if x == nil {
+		return nil, fmt.Errorf("not an uncompressed P-256 point")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+func initPushTable() {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS push_subscriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		endpoint TEXT NOT NULL UNIQUE,
+		p256dh TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		severity TEXT NOT NULL,
+		username TEXT NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_success DATETIME,
+		last_error TEXT NOT NULL DEFAULT ''
+	);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+const pushSubscriptionColumns = "id, endpoint, p256dh, auth, severity, username, user_agent, created_at, last_success, last_error"
+
+func scanPushSubscription(row interface{ Scan(...interface{}) error }) (PushSubscription, error) {
+	var s PushSubscription
+	var createdAt string
+	var lastSuccess sql.NullString
+	err := row.Scan(&s.ID, &s.Endpoint, &s.P256DH, &s.Auth, &s.Severity, &s.Username, &s.UserAgent, &createdAt, &lastSuccess, &s.LastError)
+	if err != nil {
+		return s, err
+	}
+	s.CreatedAt, _ = parseSQLiteTime(createdAt)
+	if lastSuccess.Valid {
+		t, _ := parseSQLiteTime(lastSuccess.String)
+		s.LastSuccess = &t
+	}
+	return s, nil
+}
+
+func pushSubscriptions() ([]PushSubscription, error) {
+	rows, err := db.Query("SELECT " + pushSubscriptionColumns + " FROM push_subscriptions ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subs := []PushSubscription{}
+	for rows.Next() {
+		s, err := scanPushSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// vapidKey signs the notifications so push services know they come from
+// the server browsers subscribed to. It is generated once and kept in the
+// database, as a new key would void every subscription.
+var vapidKey *ecdsa.PrivateKey
+
+func setupWebPush() error {
+	secret, err := getOrCreateSecretWith("vapid_private_key", func() (string, error) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))), nil
+	})
+	if err != nil {
+		return err
+	}
+	d, err := base64.RawURLEncoding.DecodeString(secret)
+	if err != nil || len(d) != 32 {
+		return fmt.Errorf("stored VAPID key is invalid")
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d)
+	vapidKey = key
+	return nil
+}
+
+// vapidPublicKey is the application server key browsers subscribe with.
+func vapidPublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), vapidKey.X, vapidKey.Y))
+}
+
+// vapidAuthorization is the Authorization header for a push to endpoint: a
+// JWT for the push service's origin signed with vapidKey (RFC 8292).
+func vapidAuthorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": pushSubject(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, vapidKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, enc.EncodeToString(sig), vapidPublicKey()), nil
+}
+
+// hkdf is HKDF-SHA256 (RFC 5869) for outputs of up to one hash.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// encryptPush encrypts payload for a subscription as aes128gcm content
+// (RFC 8291): a key agreed between a one-off key pair and the browser's,
+// mixed with its auth secret, in a single record.
+func encryptPush(s PushSubscription, payload []byte) ([]byte, error) {
+	ua, err := pushPublicKey(s.P256DH)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.Auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sx, _ := curve.ScalarMult(ua.X, ua.Y, asPrivate)
+	shared := sx.FillBytes(make([]byte, 32))
+	uaPublic := elliptic.Marshal(curve, ua.X, ua.Y)
+	asPublic := elliptic.Marshal(curve, asX, asY)
+
+	info := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(auth, shared, info, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The padding delimiter 2 marks the last record
+	sealed := gcm.Seal(nil, nonce, append(payload, 2), nil)
+
+	var b bytes.Buffer
+	b.Write(salt)
+	binary.Write(&b, binary.BigEndian, uint32(webPushRecordSize))
+	b.WriteByte(byte(len(asPublic)))
+	b.Write(asPublic)
+	b.Write(sealed)
+	return b.Bytes(), nil
+}
+
+// pushMessage is what the service worker shows as a notification.
+type pushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Tag   string `json:"tag"`
+	URL   string `json:"url"`
+}
+
+// errPushGone is returned when the push service no longer knows a
+// subscription, because the browser unsubscribed or was reset.
+var errPushGone = fmt.Errorf("subscription expired")
+
+// sendPush delivers one encrypted notification. critical asks the push
+// service to wake the device at once.
+func sendPush(s PushSubscription, payload []byte, critical bool) error {
+	body, err := encryptPush(s, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(s.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL/time.Second)))
+	req.Header.Set("Authorization", authorization)
+	if critical {
+		req.Header.Set("Urgency", "high")
+	}
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%s: %s: %s", req.URL.Host, resp.Status, bytes.TrimSpace(text))
+	}
+	return nil
+}
+
+var (
+	pushStatsMu sync.Mutex
+	// pushResults counts notifications since start by result: sent, failed
+	// or expired.
+	pushResults = map[string]int64{}
+)
+
+// pushNotifier is the built-in "push" target, which sends an alert to
+// every subscribed browser whose filter lets its severity through.
+// Subscriptions the push service reports gone are deleted.
+type pushNotifier struct{}
+
+func (pushNotifier) Notify(a Alert) error {
+	if vapidKey == nil {
+		return fmt.Errorf("web push is not set up")
+	}
+	subs, err := pushSubscriptions()
+	if err != nil {
+		return err
+	}
+	target := basePath + "/"
+	if u := dashboardURL(); u != "" {
+		target = u + "/"
+	}
+	payload, err := json.Marshal(pushMessage{Title: alertTitle(a), Body: a.Summary(),
+		Tag: "piheat-" + a.RuleName + "-" + a.Sensor, URL: target})
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, s := range subs {
+		if pushSeverityRank[a.Severity] < pushSeverityRank[s.Severity] {
+			continue
+		}
+		err := sendPush(s, payload, a.Severity == "critical" || a.Urgent)
+		result := "sent"
+		switch {
+		case err == errPushGone:
+			result = "expired"
+			log.Printf("Push subscription %d of %s expired, removing it", s.ID, s.Username)
+			_, err = db.Exec("DELETE FROM push_subscriptions WHERE id = ?", s.ID)
+		case err != nil:
+			result = "failed"
+			failed = append(failed, fmt.Sprintf("subscription %d: %v", s.ID, err))
+			_, err = db.Exec("UPDATE push_subscriptions SET last_error = ? WHERE id = ?", err.Error(), s.ID)
+		default:
+			_, err = db.Exec("UPDATE push_subscriptions SET last_success = ?, last_error = '' WHERE id = ?", sqliteTime(time.Now()), s.ID)
+		}
+		if err != nil {
+			log.Printf("Error updating push subscription %d: %v", s.ID, err)
+		}
+		pushStatsMu.Lock()
+		pushResults[result]++
+		pushStatsMu.Unlock()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// pushKeyHandler serves GET /api/push/key, the key browsers subscribe with.
+func pushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"publicKey": vapidPublicKey()})
+}
+
+// pushSubscribeHandler serves POST /api/push/subscribe, which stores or
+// updates a browser's subscription, and POST /api/push/unsubscribe, which
+// removes it by its endpoint.
+func pushSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req pushSubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid subscription: %v", err), http.StatusBadRequest)
+		return
+	}
+	old, err := scanPushSubscription(db.QueryRow("SELECT "+pushSubscriptionColumns+" FROM push_subscriptions WHERE endpoint = ?", req.Endpoint))
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path == "/api/push/unsubscribe" {
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM push_subscriptions WHERE id = ?", old.ID); err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting subscription: %v", err), http.StatusInternalServerError)
+			return
+		}
+		auditRequest(r, "push.unsubscribe", strconv.FormatInt(old.ID, 10), old, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := req.check(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := PushSubscription{Endpoint: req.Endpoint, P256DH: req.Keys.P256DH, Auth: req.Keys.Auth, Severity: req.Severity,
+		Username: requestActor(r), UserAgent: r.UserAgent(), CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if found {
+		s.ID, s.CreatedAt = old.ID, old.CreatedAt
+		_, err = db.Exec("UPDATE push_subscriptions SET p256dh = ?, auth = ?, severity = ?, username = ?, user_agent = ?, last_error = '' WHERE id = ?",
+			s.P256DH, s.Auth, s.Severity, s.Username, s.UserAgent, s.ID)
+	} else {
+		var res sql.Result
+		res, err = db.Exec("INSERT INTO push_subscriptions (endpoint, p256dh, auth, severity, username, user_agent, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			s.Endpoint, s.P256DH, s.Auth, s.Severity, s.Username, s.UserAgent, sqliteTime(s.CreatedAt))
+		if err == nil {
+			s.ID, err = res.LastInsertId()
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if found {
+		if old.Severity != s.Severity || old.Username != s.Username {
+			auditRequest(r, "push.subscribe", strconv.FormatInt(s.ID, 10), old, s)
+		}
+		writeJSON(w, http.StatusOK, s)
+	} else {
+		auditRequest(r, "push.subscribe", strconv.FormatInt(s.ID, 10), nil, s)
+		writeJSON(w, http.StatusCreated, s)
+	}
+}
+
+// pushSubscriptionsHandler serves GET /api/push/subscriptions and DELETE
+// /api/push/subscriptions/{id}, for admins to see and prune every browser
+// that receives alerts.
+func pushSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	idText := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/push/subscriptions"), "/")
+	if idText == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		subs, err := pushSubscriptions()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error querying database: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, subs)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+	old, err := scanPushSubscription(db.QueryRow("SELECT "+pushSubscriptionColumns+" FROM push_subscriptions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil {
+		_, err = db.Exec("DELETE FROM push_subscriptions WHERE id = ?", id)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting subscription: %v", err), http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "push.unsubscribe", idText, old, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePushMetrics(b *strings.Builder) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM push_subscriptions").Scan(&count); err == nil {
+		b.WriteString("# HELP piheat_push_subscriptions Browsers subscribed to push notifications.\n")
+		b.WriteString("# TYPE piheat_push_subscriptions gauge\n")
+		fmt.Fprintf(b, "piheat_push_subscriptions %d\n", count)
+	}
+	pushStatsMu.Lock()
+	results := make([]string, 0, len(pushResults))
+	for result := range pushResults {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	b.WriteString("# HELP piheat_push_notifications_total Push notifications since start, by result.\n")
+	b.WriteString("# TYPE piheat_push_notifications_total counter\n")
+	for _, result := range results {
+		fmt.Fprintf(b, "piheat_push_notifications_total{result=%q} %d\n", result, pushResults[result])
+	}
+	pushStatsMu.Unlock()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// TestPushSubscribeLAN refuses push endpoints piheat would post into its
+// own host or LAN with, and connections there by a stored subscription.
+func TestPushSubscribeLAN(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256dh := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	auth := base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+	for endpoint, lan := range map[string]bool{
+		"https://127.0.0.1/push/abc":     true,
+		"https://localhost:8443/push":    true,
+		"https://192.168.1.10/push":      true,
+		"https://[fe80::1]/push":         true,
+		"https://[::ffff:10.0.0.1]/push": true,
+		"https://100.64.0.1/push":        true,
+		"https://203.0.113.7/push/abc":   false,
+	} {
+		req := pushSubscribeRequest{Endpoint: endpoint}
+		req.Keys.P256DH, req.Keys.Auth = p256dh, auth
+		err := req.check(context.Background())
+		if lan && (err == nil || !strings.Contains(err.Error(), "not a public address")) {
+			t.Errorf("%s: %v, want refused as not public", endpoint, err)
+		}
+		if !lan && err != nil {
+			t.Errorf("%s: %v", endpoint, err)
+		}
+	}
+
+	withScratchDatabase(t)
+	defer func(prev *ecdsa.PrivateKey) { vapidKey = prev }(vapidKey)
+	if err := setupWebPush(); err != nil {
+		t.Fatal(err)
+	}
+	s := PushSubscription{Endpoint: "https://127.0.0.1:1/push/abc", P256DH: p256dh, Auth: auth}
+	if err := sendPush(s, []byte(`{}`), false); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("push to a stored loopback endpoint: %v, want refused", err)
+	}
+}